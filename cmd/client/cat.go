@@ -0,0 +1,227 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/google/subcommands"
+	"github.com/inbucket/inbucket/pkg/rest/client"
+	"github.com/jhillyerd/enmime"
+	"golang.org/x/net/html"
+)
+
+// catWidth is the column body text is wrapped at.
+const catWidth = 80
+
+// ANSI escape sequences used to color cat output.
+const (
+	ansiReset  = "\x1b[0m"
+	ansiHeader = "\x1b[1;36m"
+	ansiAttach = "\x1b[33m"
+)
+
+// catHeaders are the message headers rendered by cat, in order.
+var catHeaders = []string{"From", "To", "Cc", "Date", "Subject"}
+
+// htmlBlock holds the HTML elements that start a new line of text.
+var htmlBlock = map[string]bool{
+	"address": true, "blockquote": true, "br": true, "div": true, "h1": true, "h2": true,
+	"h3": true, "h4": true, "h5": true, "h6": true, "hr": true, "li": true, "p": true,
+	"pre": true, "table": true, "tr": true,
+}
+
+type catCmd struct {
+	color bool
+}
+
+func (*catCmd) Name() string {
+	return "cat"
+}
+
+func (*catCmd) Synopsis() string {
+	return "render message as text"
+}
+
+func (*catCmd) Usage() string {
+	return `cat [flags] <mailbox> <id>:
+	render the headers, text body, and attachment list of a message
+`
+}
+
+func (c *catCmd) SetFlags(f *flag.FlagSet) {
+	f.BoolVar(&c.color, "color", isTerminal(os.Stdout), "color output")
+}
+
+func (c *catCmd) Execute(
+	_ context.Context, f *flag.FlagSet, _ ...interface{}) subcommands.ExitStatus {
+	mailbox, id := f.Arg(0), f.Arg(1)
+	if mailbox == "" || id == "" {
+		return usage("mailbox and id required")
+	}
+	// Setup REST client
+	rc, err := client.New(baseURL())
+	if err != nil {
+		return fatal("Couldn't build client", err)
+	}
+	source, err := rc.GetMessageSource(mailbox, id)
+	if err != nil {
+		return fatal("Get source REST call failed", err)
+	}
+	if err := renderMessage(os.Stdout, source.Bytes(), c.color); err != nil {
+		return fatal("Error", err)
+	}
+	return subcommands.ExitSuccess
+}
+
+// renderMessage parses the message source, and writes its headers, text body wrapped at
+// catWidth, and a list of attachments to w.  HTML-only messages are rendered without markup.
+func renderMessage(w io.Writer, source []byte, color bool) error {
+	env, err := enmime.ReadEnvelope(bytes.NewReader(source))
+	if err != nil {
+		return err
+	}
+	paint := func(code, s string) string {
+		if !color {
+			return s
+		}
+		return code + s + ansiReset
+	}
+	b := &strings.Builder{}
+	for _, name := range catHeaders {
+		if value := env.GetHeader(name); value != "" {
+			fmt.Fprintf(b, "%s %s\n", paint(ansiHeader, name+":"), value)
+		}
+	}
+	b.WriteString("\n")
+	text := env.Text
+	if env.HTML != "" && !hasTextPart(env.Root) {
+		// enmime converts HTML-only bodies to text itself, keeping markup such as *bold*.
+		text = stripHTML(env.HTML)
+	}
+	b.WriteString(wrapText(strings.TrimRight(text, "\r\n"), catWidth))
+	b.WriteString("\n")
+	if len(env.Attachments) > 0 {
+		fmt.Fprintf(b, "\n%s\n", paint(ansiHeader, "Attachments:"))
+		for _, a := range env.Attachments {
+			name := a.FileName
+			if name == "" {
+				name = "(unnamed)"
+			}
+			fmt.Fprintf(b, "  %s %s, %s\n", paint(ansiAttach, name), a.ContentType,
+				formatSize(len(a.Content)))
+		}
+	}
+	_, err = io.WriteString(w, b.String())
+	return err
+}
+
+// hasTextPart reports whether the MIME tree rooted at p contains a text/plain part which is not an
+// attachment.
+func hasTextPart(p *enmime.Part) bool {
+	for ; p != nil; p = p.NextSibling {
+		if p.ContentType == "text/plain" && p.Disposition != "attachment" {
+			return true
+		}
+		if hasTextPart(p.FirstChild) {
+			return true
+		}
+	}
+	return false
+}
+
+// wrapText breaks the lines of s between words, so they are no longer than width columns unless
+// they contain a longer word.
+func wrapText(s string, width int) string {
+	s = strings.ReplaceAll(s, "\r\n", "\n")
+	b := &strings.Builder{}
+	for i, line := range strings.Split(s, "\n") {
+		if i > 0 {
+			b.WriteByte('\n')
+		}
+		col := 0
+		for j, word := range strings.Fields(line) {
+			n := utf8.RuneCountInString(word)
+			switch {
+			case j == 0:
+				// Keep the indentation of the line.
+				indent := line[:strings.Index(line, word)]
+				b.WriteString(indent)
+				col = utf8.RuneCountInString(indent)
+			case col+1+n > width:
+				b.WriteByte('\n')
+				col = 0
+			default:
+				b.WriteByte(' ')
+				col++
+			}
+			b.WriteString(word)
+			col += n
+		}
+	}
+	return b.String()
+}
+
+// stripHTML returns the text of an HTML document, starting a new line at block elements.
+func stripHTML(s string) string {
+	b := &strings.Builder{}
+	skip := 0
+	z := html.NewTokenizer(strings.NewReader(s))
+	for tt := z.Next(); tt != html.ErrorToken; tt = z.Next() {
+		switch tt {
+		case html.TextToken:
+			if skip == 0 {
+				b.WriteString(strings.Map(func(r rune) rune {
+					if r == '\n' || r == '\r' || r == '\t' {
+						return ' '
+					}
+					return r
+				}, string(z.Text())))
+			}
+		case html.StartTagToken, html.EndTagToken, html.SelfClosingTagToken:
+			name, _ := z.TagName()
+			switch tag := string(name); {
+			case tag == "head" || tag == "script" || tag == "style" || tag == "title":
+				if tt == html.StartTagToken {
+					skip++
+				} else if tt == html.EndTagToken && skip > 0 {
+					skip--
+				}
+			case htmlBlock[tag]:
+				b.WriteByte('\n')
+			}
+		}
+	}
+	// Collapse the white space within lines, and runs of blank lines.
+	var lines []string
+	for _, line := range strings.Split(b.String(), "\n") {
+		line = strings.Join(strings.Fields(line), " ")
+		if line == "" && (len(lines) == 0 || lines[len(lines)-1] == "") {
+			continue
+		}
+		lines = append(lines, line)
+	}
+	return strings.TrimSpace(strings.Join(lines, "\n"))
+}
+
+// formatSize returns n bytes in human readable units.
+func formatSize(n int) string {
+	switch {
+	case n >= 1<<20:
+		return fmt.Sprintf("%.1f MiB", float64(n)/(1<<20))
+	case n >= 1<<10:
+		return fmt.Sprintf("%.1f KiB", float64(n)/(1<<10))
+	}
+	return fmt.Sprintf("%d bytes", n)
+}
+
+// isTerminal returns true if f is a character device, such as a terminal.
+func isTerminal(f *os.File) bool {
+	fi, err := f.Stat()
+	return err == nil && fi.Mode()&os.ModeCharDevice != 0
+}
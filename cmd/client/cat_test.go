@@ -0,0 +1,81 @@
+package main
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+)
+
+func TestRenderMessage(t *testing.T) {
+	long := strings.Repeat("word ", 30)
+	testCases := []struct {
+		name, source string
+		want         []string
+	}{
+		{
+			name: "text",
+			source: "From: Alice <alice@example.com>\r\nTo: bob@example.com\r\n" +
+				"Subject: =?utf-8?q?caf=C3=A9?=\r\n\r\nHello Bob\r\n" + long + "\r\n",
+			want: []string{
+				"From: Alice <alice@example.com>\n",
+				"To: bob@example.com\n",
+				"Subject: café\n",
+				"\nHello Bob\n",
+				strings.TrimSpace(strings.Repeat("word ", 16)) + "\n" +
+					strings.TrimSpace(strings.Repeat("word ", 14)) + "\n",
+			},
+		},
+		{
+			name: "html only",
+			source: "From: alice@example.com\r\nSubject: Rich\r\n" +
+				"Content-Type: text/html; charset=utf-8\r\n\r\n" +
+				"<html><head><style>p { color: red }</style></head>" +
+				"<body><p>Hello <b>Bob</b> &amp; Carol</p><p>Second</p></body></html>\r\n",
+			want: []string{"Subject: Rich\n", "\nHello Bob & Carol\n\nSecond\n"},
+		},
+		{
+			name: "alternative",
+			source: "From: alice@example.com\r\nSubject: Both\r\nMIME-Version: 1.0\r\n" +
+				"Content-Type: multipart/alternative; boundary=b\r\n\r\n" +
+				"--b\r\nContent-Type: text/plain\r\n\r\nPlain *version*\r\n" +
+				"--b\r\nContent-Type: text/html\r\n\r\n<p>HTML version</p>\r\n--b--\r\n",
+			want: []string{"\nPlain *version*\n"},
+		},
+		{
+			name: "attachment",
+			source: "From: alice@example.com\r\nSubject: Files\r\nMIME-Version: 1.0\r\n" +
+				"Content-Type: multipart/mixed; boundary=b\r\n\r\n" +
+				"--b\r\nContent-Type: text/plain\r\n\r\nSee attached\r\n" +
+				"--b\r\nContent-Type: application/pdf\r\n" +
+				"Content-Disposition: attachment; filename=report.pdf\r\n\r\n" +
+				strings.Repeat("x", 2048) + "\r\n--b--\r\n",
+			want: []string{"\nSee attached\n", "Attachments:\n",
+				"  report.pdf application/pdf, 2.0 KiB\n"},
+		},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			b := &bytes.Buffer{}
+			if err := renderMessage(b, []byte(tc.source), false); err != nil {
+				t.Fatal(err)
+			}
+			got := b.String()
+			for _, want := range tc.want {
+				if !strings.Contains(got, want) {
+					t.Errorf("Output does not contain %q:\n%s", want, got)
+				}
+			}
+			if strings.Contains(got, "\x1b[") {
+				t.Errorf("Output contains color without -color:\n%s", got)
+			}
+		})
+	}
+
+	b := &bytes.Buffer{}
+	if err := renderMessage(b, []byte("Subject: Hi\r\n\r\nBody\r\n"), true); err != nil {
+		t.Fatal(err)
+	}
+	if want := ansiHeader + "Subject:" + ansiReset + " Hi\n"; !strings.Contains(b.String(), want) {
+		t.Errorf("Colored output does not contain %q:\n%q", want, b.String())
+	}
+}
@@ -55,6 +55,7 @@ func main() {
 	subcommands.Register(subcommands.FlagsCommand(), "")
 	subcommands.Register(subcommands.CommandsCommand(), "")
 	// Setup my commands
+	subcommands.Register(&catCmd{}, "")
 	subcommands.Register(&listCmd{}, "")
 	subcommands.Register(&matchCmd{}, "")
 	subcommands.Register(&mboxCmd{}, "")
@@ -8,24 +8,40 @@ import (
 	"flag"
 	"fmt"
 	"io"
+	"net"
 	"os"
 	"os/signal"
+	"path/filepath"
 	"runtime"
+	"strings"
 	"syscall"
 	"time"
 
 	"github.com/inbucket/inbucket/pkg/config"
+	"github.com/inbucket/inbucket/pkg/forward"
+	"github.com/inbucket/inbucket/pkg/graphql"
+	"github.com/inbucket/inbucket/pkg/health"
 	"github.com/inbucket/inbucket/pkg/message"
 	"github.com/inbucket/inbucket/pkg/msghub"
 	"github.com/inbucket/inbucket/pkg/policy"
+	"github.com/inbucket/inbucket/pkg/pubsub"
+	"github.com/inbucket/inbucket/pkg/replication"
 	"github.com/inbucket/inbucket/pkg/rest"
+	"github.com/inbucket/inbucket/pkg/server/grpc"
+	"github.com/inbucket/inbucket/pkg/server/imap"
 	"github.com/inbucket/inbucket/pkg/server/pop3"
 	"github.com/inbucket/inbucket/pkg/server/smtp"
 	"github.com/inbucket/inbucket/pkg/server/web"
 	"github.com/inbucket/inbucket/pkg/storage"
+	"github.com/inbucket/inbucket/pkg/storage/badger"
 	"github.com/inbucket/inbucket/pkg/storage/file"
 	"github.com/inbucket/inbucket/pkg/storage/mem"
+	"github.com/inbucket/inbucket/pkg/storage/postgres"
+	"github.com/inbucket/inbucket/pkg/storage/redis"
+	"github.com/inbucket/inbucket/pkg/storage/s3"
+	"github.com/inbucket/inbucket/pkg/storage/sqlite"
 	"github.com/inbucket/inbucket/pkg/stringutil"
+	"github.com/inbucket/inbucket/pkg/webhook"
 	"github.com/inbucket/inbucket/pkg/webui"
 	"github.com/rs/zerolog"
 	"github.com/rs/zerolog/log"
@@ -50,8 +66,13 @@ func init() {
 	}))
 
 	// Register storage implementations.
+	storage.Constructors["badger"] = badger.New
 	storage.Constructors["file"] = file.New
 	storage.Constructors["memory"] = mem.New
+	storage.Constructors["postgres"] = postgres.New
+	storage.Constructors["redis"] = redis.New
+	storage.Constructors["s3"] = s3.New
+	storage.Constructors["sqlite"] = sqlite.New
 }
 
 func main() {
@@ -60,9 +81,16 @@ func main() {
 	pidfile := flag.String("pidfile", "", "Write our PID into the specified file.")
 	logfile := flag.String("logfile", "stderr", "Write out log into the specified file.")
 	logjson := flag.Bool("logjson", false, "Logs are written in JSON format.")
-	netdebug := flag.Bool("netdebug", false, "Dump SMTP & POP3 network traffic to stdout.")
+	netdebug := flag.Bool("netdebug", false, "Dump SMTP, POP3 & IMAP network traffic to stdout.")
+	envfile := flag.String("config", "",
+		"Read env variables from the specified file, re-read by POST /admin/reload.")
 	flag.Usage = func() {
 		fmt.Fprintln(os.Stderr, "Usage: inbucket [options]")
+		fmt.Fprintln(os.Stderr, "       inbucket migrate-index <path>")
+		fmt.Fprintln(os.Stderr, "       inbucket compact [-dry-run] <path>")
+		fmt.Fprintln(os.Stderr, "       inbucket migrate -from=<type>:<path> -to=<type>:<path>")
+		fmt.Fprintln(os.Stderr, "       inbucket export <mailbox> > <file.mbox>")
+		fmt.Fprintln(os.Stderr, "       inbucket import <mailbox> < <file.mbox>")
 		flag.PrintDefaults()
 	}
 	flag.Parse()
@@ -72,22 +100,71 @@ func main() {
 		config.Usage()
 		return
 	}
+	if flag.Arg(0) == "migrate-index" {
+		if flag.NArg() != 2 {
+			flag.Usage()
+			os.Exit(1)
+		}
+		if err := migrateIndex(flag.Arg(1)); err != nil {
+			fmt.Fprintf(os.Stderr, "Migration error: %v\n", err)
+			os.Exit(1)
+		}
+		return
+	}
+	if flag.Arg(0) == "compact" {
+		if err := compact(flag.Args()[1:]); err != nil {
+			fmt.Fprintf(os.Stderr, "Compact error: %v\n", err)
+			os.Exit(1)
+		}
+		return
+	}
+	if flag.Arg(0) == "migrate" {
+		if err := migrateStore(flag.Args()[1:]); err != nil {
+			fmt.Fprintf(os.Stderr, "\nMigration error: %v\n", err)
+			os.Exit(1)
+		}
+		return
+	}
+	if flag.Arg(0) == "export" || flag.Arg(0) == "import" {
+		if flag.NArg() != 2 {
+			flag.Usage()
+			os.Exit(1)
+		}
+		if err := transferMbox(flag.Arg(0), flag.Arg(1)); err != nil {
+			fmt.Fprintf(os.Stderr, "%s error: %v\n", flag.Arg(0), err)
+			os.Exit(1)
+		}
+		return
+	}
 
 	// Process configuration.
 	config.Version = version
 	config.BuildDate = date
-	conf, err := config.Process()
+	loadConfig := func() (*config.Root, error) {
+		conf, err := config.Load(*envfile)
+		if err != nil {
+			return nil, err
+		}
+		if *netdebug {
+			conf.POP3.Debug = true
+			conf.IMAP.Debug = true
+			conf.SMTP.Debug = true
+		}
+		return conf, nil
+	}
+	conf, err := loadConfig()
 	if err != nil {
 		fmt.Fprintf(os.Stderr, "Configuration error: %v\n", err)
 		os.Exit(1)
 	}
-	if *netdebug {
-		conf.POP3.Debug = true
-		conf.SMTP.Debug = true
-	}
+	currentConfig := config.NewCurrent(conf, loadConfig)
 
 	// Logger setup.
-	closeLog, err := openLog(conf.LogLevel, *logfile, *logjson)
+	logformat := conf.LogFormat
+	if *logjson {
+		logformat = "json"
+	}
+	closeLog, err := openLog(conf.LogLevel, logformat, *logfile)
 	if err != nil {
 		fmt.Fprintf(os.Stderr, "Log error: %v\n", err)
 		os.Exit(1)
@@ -122,25 +199,120 @@ func main() {
 		removePIDFile(*pidfile)
 		startupLog.Fatal().Err(err).Str("module", "storage").Msg("Fatal storage error")
 	}
+	healthChecker := health.New(store)
+	baseStore := store
+	healthChecker.Start(rootCtx)
+	replicaMode := conf.Storage.ReplicationMode == config.ReplicationReplica
+	var replicationLog *replication.Log
+	if conf.Storage.ReplicationMode == config.ReplicationPrimary {
+		ps, ok := baseStore.(storage.PathStore)
+		if !ok {
+			removePIDFile(*pidfile)
+			startupLog.Fatal().Str("module", "replication").Str("type", conf.Storage.Type).
+				Msg("Storage type has no local directory for the replication log")
+		}
+		// The log is kept in the store root, beside rather than among the mailboxes.
+		root := filepath.Dir(ps.MailPath())
+		replicationLog, err = replication.OpenLog(filepath.Join(root, replication.LogFile))
+		if err != nil {
+			removePIDFile(*pidfile)
+			startupLog.Fatal().Err(err).Str("module", "replication").
+				Msg("Failed to open replication log")
+		}
+	}
+	broker := pubsub.NewBroker()
+	store, followedStore := wrapStore(conf.Storage, store, replicationLog, broker)
+	if replicaMode {
+		statePath := ""
+		if ps, ok := baseStore.(storage.PathStore); ok {
+			statePath = filepath.Join(filepath.Dir(ps.MailPath()), replication.StateFile)
+		} else {
+			startupLog.Warn().Str("module", "replication").Str("type", conf.Storage.Type).
+				Msg("Storage type has no local directory, replication restarts from the beginning")
+		}
+		follower, err := replication.NewFollower(conf.Storage, followedStore, statePath)
+		if err != nil {
+			removePIDFile(*pidfile)
+			startupLog.Fatal().Err(err).Str("module", "replication").
+				Msg("Failed to start replication")
+		}
+		follower.Start(rootCtx)
+	}
 	msgHub := msghub.New(rootCtx, conf.Web.MonitorHistory)
-	addrPolicy := &policy.Addressing{Config: conf}
-	mmanager := &message.StoreManager{AddrPolicy: addrPolicy, Store: store, Hub: msgHub}
+	addrPolicy := &policy.Addressing{
+		Config:        conf,
+		MailboxPolicy: policy.NewMailboxPolicy(conf.Mailbox),
+		MailboxExists: func(ctx context.Context, mailbox string) (bool, error) {
+			return storage.MailboxExists(ctx, baseStore, mailbox)
+		},
+	}
+	mmanager := &message.StoreManager{
+		AddrPolicy: addrPolicy,
+		Store:      store,
+		Hub:        msgHub,
+		SpamRules:  conf.Mailbox.SpamRules,
+	}
+	if conf.SMTP.DKIMVerify {
+		// Results are recorded after delivery, the wrappers around store do not need to see them.
+		if recorder, ok := baseStore.(storage.DKIMRecorder); ok {
+			mmanager.DKIM = &message.DKIMVerifier{Resolver: net.DefaultResolver, Store: recorder}
+		} else {
+			startupLog.Warn().Str("module", "storage").Str("type", conf.Storage.Type).
+				Msg("Storage type can not record DKIM results, verification disabled")
+		}
+	}
+
+	// Start webhook notifier.
+	if conf.Webhook.URL != "" {
+		webhook.New(currentConfig).Start(rootCtx, msgHub)
+	}
+
+	// Start message forwarder.
+	if len(conf.Forwarding.Rules) > 0 {
+		forward.New(conf.Forwarding, conf.SMTP.Domain, store).Start(rootCtx, msgHub)
+	}
 
-	// Start Retention scanner.
-	retentionScanner := storage.NewRetentionScanner(conf.Storage, store, shutdownChan)
-	retentionScanner.Start()
+	// Start Retention scanner, replicas instead remove messages as the primary expires them.
+	retentionScanner := storage.NewRetentionScanner(currentConfig, store, shutdownChan)
+	if !replicaMode {
+		retentionScanner.Start()
+	}
 
 	// Configure routes and start HTTP server.
 	prefix := stringutil.MakePathPrefixer(conf.Web.BasePath)
 	webui.SetupRoutes(web.Router.PathPrefix(prefix("/serve/")).Subrouter())
 	rest.SetupRoutes(web.Router.PathPrefix(prefix("/api/")).Subrouter())
-	web.Initialize(conf, shutdownChan, mmanager, msgHub)
+	rest.SetupAdminRoutes(web.Router.PathPrefix(prefix("/admin/")).Subrouter())
+	web.Router.Handle(prefix("/healthz"), healthChecker).Methods("GET")
+	web.Router.Handle(prefix("/openapi.yaml"), web.CORS(web.Handler(rest.OpenAPIV1))).
+		Methods("GET")
+	web.Router.PathPrefix(prefix("/docs/")).Handler(rest.DocsV1(prefix("/openapi.yaml"))).
+		Methods("GET")
+	web.Router.Handle(prefix("/graphql"), web.CORS(web.APIAuth(graphql.NewHandler(store, addrPolicy)))).
+		Methods("GET", "POST", "OPTIONS")
+	web.Initialize(conf, shutdownChan, mmanager, msgHub, broker)
+	web.SetCurrentConfig(currentConfig)
+	web.SetReplicationLog(replicationLog)
 	go web.Start(rootCtx)
 
 	// Start POP3 server.
 	pop3Server := pop3.New(conf.POP3, shutdownChan, store)
 	go pop3Server.Start(rootCtx)
 
+	// Start IMAP server.
+	var imapServer *imap.Server
+	if conf.IMAP.Addr != "" {
+		imapServer = imap.New(conf.IMAP, shutdownChan, store)
+		go imapServer.Start(rootCtx)
+	}
+
+	// Start gRPC server.
+	var grpcServer *grpc.Server
+	if conf.GRPC.Addr != "" {
+		grpcServer = grpc.New(conf.GRPC, shutdownChan, store, broker, addrPolicy)
+		go grpcServer.Start(rootCtx)
+	}
+
 	// Start SMTP server.
 	smtpServer := smtp.NewServer(conf.SMTP, shutdownChan, mmanager, addrPolicy)
 	go smtpServer.Start(rootCtx)
@@ -172,13 +344,32 @@ signalLoop:
 	go timedExit(*pidfile)
 	smtpServer.Drain()
 	pop3Server.Drain()
-	retentionScanner.Join()
+	if imapServer != nil {
+		imapServer.Drain()
+	}
+	if grpcServer != nil {
+		grpcServer.Drain()
+	}
+	if mmanager.DKIM != nil {
+		mmanager.DKIM.Wait()
+	}
+	if !replicaMode {
+		retentionScanner.Join()
+	}
+	if err := storage.Sync(baseStore); err != nil {
+		log.Error().Str("module", "storage").Err(err).Msg("Failed to sync storage")
+	}
+	if replicationLog != nil {
+		if err := replicationLog.Sync(); err != nil {
+			log.Error().Str("module", "replication").Err(err).Msg("Failed to sync replication log")
+		}
+	}
 	removePIDFile(*pidfile)
 	closeLog()
 }
 
 // openLog configures zerolog output, returns func to close logfile.
-func openLog(level string, logfile string, json bool) (close func(), err error) {
+func openLog(level string, format string, logfile string) (close func(), err error) {
 	switch level {
 	case "debug":
 		zerolog.SetGlobalLevel(zerolog.DebugLevel)
@@ -191,6 +382,9 @@ func openLog(level string, logfile string, json bool) (close func(), err error)
 	default:
 		return nil, fmt.Errorf("Log level %q not one of: debug, info, warn, error", level)
 	}
+	if format != "text" && format != "json" {
+		return nil, fmt.Errorf("Log format %q not one of: text, json", format)
+	}
 	close = func() {}
 	var w io.Writer
 	color := runtime.GOOS != "windows"
@@ -213,7 +407,7 @@ func openLog(level string, logfile string, json bool) (close func(), err error)
 		}
 	}
 	w = zerolog.SyncWriter(w)
-	if json {
+	if format == "json" {
 		log.Logger = log.Output(w)
 		return close, nil
 	}
@@ -224,6 +418,184 @@ func openLog(level string, logfile string, json bool) (close func(), err error)
 	return close, nil
 }
 
+// migrateIndex converts legacy gob mailbox indexes in the file store at path to JSON lines.
+func migrateIndex(path string) error {
+	if _, err := os.Stat(path); err != nil {
+		return err
+	}
+	store, err := file.New(config.Storage{Params: map[string]string{"path": path}})
+	if err != nil {
+		return err
+	}
+	count, err := store.(*file.Store).MigrateIndexes()
+	fmt.Printf("Migrated %v mailbox indexes\n", count)
+	return err
+}
+
+// compact removes orphaned message files and dangling index entries from the file store at the
+// path given in args.
+func compact(args []string) error {
+	flags := flag.NewFlagSet("compact", flag.ExitOnError)
+	dryRun := flags.Bool("dry-run", false, "Print what would be removed, without removing it.")
+	flags.Usage = flag.Usage
+	_ = flags.Parse(args)
+	if flags.NArg() != 1 {
+		flag.Usage()
+		os.Exit(1)
+	}
+	path := flags.Arg(0)
+	if _, err := os.Stat(path); err != nil {
+		return err
+	}
+	store, err := file.New(config.Storage{Params: map[string]string{"path": path}})
+	if err != nil {
+		return err
+	}
+	report, err := store.(*file.Store).Compact(*dryRun)
+	action := "Removed"
+	if *dryRun {
+		action = "Would remove"
+	}
+	for _, path := range report.OrphanFiles {
+		fmt.Printf("%v orphaned file %v\n", action, path)
+	}
+	for _, path := range report.MissingFiles {
+		fmt.Printf("%v index entry for missing file %v\n", action, path)
+	}
+	fmt.Printf("%v %v orphaned files and %v index entries for missing files\n", action,
+		len(report.OrphanFiles), len(report.MissingFiles))
+	return err
+}
+
+// migrateStore copies all messages between the stores given by the -from and -to flags in args.
+func migrateStore(args []string) error {
+	flags := flag.NewFlagSet("migrate", flag.ExitOnError)
+	from := flags.String("from", "", "Source store, as <type>:<path>.")
+	to := flags.String("to", "", "Destination store, as <type>:<path>.")
+	flags.Usage = flag.Usage
+	_ = flags.Parse(args)
+	if *from == "" || *to == "" || flags.NArg() != 0 {
+		flag.Usage()
+		os.Exit(1)
+	}
+	// Debug logging would interleave with the progress output.
+	closeLog, err := openLog("warn", "text", "stderr")
+	if err != nil {
+		return err
+	}
+	defer closeLog()
+	if i := strings.Index(*from, ":"); i >= 0 {
+		// Opening a missing source would create an empty store.
+		if _, err := os.Stat((*from)[i+1:]); err != nil {
+			return err
+		}
+	}
+	src, err := openStore(*from)
+	if err != nil {
+		return err
+	}
+	if c, ok := src.(io.Closer); ok {
+		defer c.Close()
+	}
+	dst, err := openStore(*to)
+	if err != nil {
+		return err
+	}
+	if c, ok := dst.(io.Closer); ok {
+		defer c.Close()
+	}
+	// Progress is redrawn on the same line until the mailbox is complete.
+	count, err := storage.Migrate(context.Background(), src, dst, func(mailbox string, n, total int) {
+		fmt.Printf("\r%v %v/%v", mailbox, n, total)
+		if n == total {
+			fmt.Println()
+		}
+	})
+	if err != nil {
+		return err
+	}
+	fmt.Printf("Migrated %v messages\n", count)
+	return nil
+}
+
+// openStore opens the store described by spec, in the form <type>:<path>.
+func openStore(spec string) (storage.Store, error) {
+	parts := strings.SplitN(spec, ":", 2)
+	if len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+		return nil, fmt.Errorf("store %q must be in the form <type>:<path>", spec)
+	}
+	if parts[0] != "file" && parts[0] != "sqlite" {
+		return nil, fmt.Errorf("unsupported store type %q, must be file or sqlite", parts[0])
+	}
+	return storage.FromConfig(config.Storage{
+		Type:   parts[0],
+		Params: map[string]string{"path": parts[1]},
+	})
+}
+
+// transferMbox exports the named mailbox from the configured store to stdout, or imports it from
+// stdin, in mbox format.
+func transferMbox(direction string, mailbox string) error {
+	conf, err := config.Process()
+	if err != nil {
+		return err
+	}
+	closeLog, err := openLog(conf.LogLevel, conf.LogFormat, "stderr")
+	if err != nil {
+		return err
+	}
+	defer closeLog()
+	store, err := storage.FromConfig(conf.Storage)
+	if err != nil {
+		return err
+	}
+	if c, ok := store.(io.Closer); ok {
+		defer c.Close()
+	}
+	mmanager := &message.StoreManager{
+		AddrPolicy: &policy.Addressing{
+			Config:        conf,
+			MailboxPolicy: policy.NewMailboxPolicy(conf.Mailbox),
+		},
+		Store: store,
+	}
+	name, err := mmanager.MailboxForAddress(mailbox)
+	if err != nil {
+		return err
+	}
+	var count int
+	if direction == "export" {
+		count, err = mmanager.ExportMbox(context.Background(), os.Stdout, name)
+		fmt.Fprintf(os.Stderr, "Exported %v messages from %v\n", count, name)
+	} else {
+		count, err = mmanager.ImportMbox(context.Background(), os.Stdin, name)
+		fmt.Fprintf(os.Stderr, "Imported %v messages into %v\n", count, name)
+	}
+	return err
+}
+
+// wrapStore wraps store in the layers used by the servers: metrics, the replication log if rlog is
+// not nil, deduplication, publishing of changes to broker, the read-only replica layer, and
+// freezing.  followed is the store a replication follower writes to, below the read-only layer.
+func wrapStore(sc config.Storage, store storage.Store, rlog *replication.Log,
+	broker *pubsub.Broker) (wrapped, followed storage.Store) {
+	replicaMode := sc.ReplicationMode == config.ReplicationReplica
+	store = storage.NewInstrumentedStore(store)
+	if rlog != nil {
+		store = replication.NewPrimaryStore(store, rlog)
+	}
+	if sc.DeduplicateMessages && !replicaMode {
+		// Replicas receive messages already deduplicated by the primary.
+		store = storage.NewDedupStore(store, sc.DeduplicateWindow)
+	}
+	store = pubsub.NewStore(store, broker)
+	followed = store
+	if replicaMode {
+		store = replication.NewReplicaStore(store)
+	}
+	return storage.NewFreezableStore(store), followed
+}
+
 // removePIDFile removes the PID file if created.
 func removePIDFile(pidfile string) {
 	if pidfile != "" {
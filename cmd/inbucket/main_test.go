@@ -0,0 +1,103 @@
+package main
+
+import (
+	"context"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/inbucket/inbucket/pkg/config"
+	"github.com/inbucket/inbucket/pkg/pubsub"
+	"github.com/inbucket/inbucket/pkg/replication"
+	"github.com/inbucket/inbucket/pkg/storage"
+	"github.com/inbucket/inbucket/pkg/storage/file"
+	"github.com/inbucket/inbucket/pkg/test"
+)
+
+// spyStore wraps a store, recording whether its Pager and LatestVisitor were called.
+type spyStore struct {
+	storage.Store
+	paged         bool
+	visitedLatest bool
+}
+
+func (s *spyStore) PageMessages(ctx context.Context, mailbox, after string, limit int,
+	match func(storage.Message) bool) ([]storage.Message, bool, error) {
+	s.paged = true
+	return s.Store.(storage.Pager).PageMessages(ctx, mailbox, after, limit, match)
+}
+
+func (s *spyStore) VisitLatestMessages(
+	ctx context.Context, f func(latest storage.Message) (cont bool)) error {
+	s.visitedLatest = true
+	return s.Store.(storage.LatestVisitor).VisitLatestMessages(ctx, f)
+}
+
+func TestWrapStoreForwards(t *testing.T) {
+	tests := []struct {
+		name    string
+		storage config.Storage
+		primary bool
+	}{
+		{name: "default"},
+		{name: "primary", storage: config.Storage{ReplicationMode: config.ReplicationPrimary},
+			primary: true},
+		{name: "dedup", storage: config.Storage{DeduplicateMessages: true,
+			DeduplicateWindow: time.Minute}},
+		{name: "replica", storage: config.Storage{ReplicationMode: config.ReplicationReplica}},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			dir := t.TempDir()
+			fs, err := file.New(config.Storage{Params: map[string]string{"path": dir}})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if _, ok := fs.(storage.Pager); !ok {
+				t.Fatal("file store does not implement Pager")
+			}
+			if _, ok := fs.(storage.LatestVisitor); !ok {
+				t.Fatal("file store does not implement LatestVisitor")
+			}
+			var rlog *replication.Log
+			if tc.primary {
+				rlog, err = replication.OpenLog(filepath.Join(dir, replication.LogFile))
+				if err != nil {
+					t.Fatal(err)
+				}
+				defer rlog.Close()
+			}
+			spy := &spyStore{Store: fs}
+			store, followed := wrapStore(tc.storage, spy, rlog, pubsub.NewBroker())
+			test.DeliverToStore(t, followed, "box", "first", time.Now())
+			test.DeliverToStore(t, followed, "box", "second", time.Now())
+
+			msgs, more, err := storage.PageMessages(context.Background(), store, "box", "", 1, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !spy.paged {
+				t.Error("file store Pager was not reached through the wrappers")
+			}
+			if len(msgs) != 1 || !more {
+				t.Errorf("got %v messages, more %v, want 1 message and more", len(msgs), more)
+			}
+
+			var latest []string
+			err = storage.VisitLatestMessages(context.Background(), store,
+				func(m storage.Message) bool {
+					latest = append(latest, m.Subject())
+					return true
+				})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !spy.visitedLatest {
+				t.Error("file store LatestVisitor was not reached through the wrappers")
+			}
+			if len(latest) != 1 || latest[0] != "second" {
+				t.Errorf("got latest %v, want [second]", latest)
+			}
+		})
+	}
+}
@@ -1,10 +1,16 @@
 package config
 
 import (
+	"bufio"
 	"fmt"
 	"log"
+	"net"
+	"net/mail"
 	"os"
+	"path/filepath"
+	"regexp"
 	"strings"
+	"sync"
 	"text/tabwriter"
 	"time"
 
@@ -56,33 +62,127 @@ func (n *mbNaming) Decode(v string) error {
 	return nil
 }
 
+// OverflowPolicy determines what happens when a message is delivered to a mailbox at its message
+// cap.
+type OverflowPolicy string
+
+// Mailbox overflow policies, an empty OverflowPolicy is treated as OverflowDropOldest.
+const (
+	OverflowReject     OverflowPolicy = "reject"
+	OverflowDropOldest OverflowPolicy = "drop-oldest"
+	OverflowDropNewest OverflowPolicy = "drop-newest"
+)
+
+// Decode an overflow policy from string.
+func (p *OverflowPolicy) Decode(v string) error {
+	switch OverflowPolicy(strings.ToLower(v)) {
+	case OverflowReject:
+		*p = OverflowReject
+	case OverflowDropOldest:
+		*p = OverflowDropOldest
+	case OverflowDropNewest:
+		*p = OverflowDropNewest
+	default:
+		return fmt.Errorf("Unknown OverflowPolicy: %q", v)
+	}
+	return nil
+}
+
+// ReplicationMode determines the role of this Inbucket in message replication.
+type ReplicationMode string
+
+// Replication modes, an empty ReplicationMode disables replication.
+const (
+	ReplicationNone    ReplicationMode = ""
+	ReplicationPrimary ReplicationMode = "primary"
+	ReplicationReplica ReplicationMode = "replica"
+)
+
+// Decode a replication mode from string.
+func (m *ReplicationMode) Decode(v string) error {
+	switch ReplicationMode(strings.ToLower(v)) {
+	case ReplicationNone:
+		*m = ReplicationNone
+	case ReplicationPrimary:
+		*m = ReplicationPrimary
+	case ReplicationReplica:
+		*m = ReplicationReplica
+	default:
+		return fmt.Errorf("Unknown ReplicationMode: %q", v)
+	}
+	return nil
+}
+
+// ParseCIDR parses an IP network in CIDR notation, or a single IP address.
+func ParseCIDR(s string) (*net.IPNet, error) {
+	s = strings.TrimSpace(s)
+	if ip := net.ParseIP(s); ip != nil {
+		bits := 8 * net.IPv6len
+		if ip4 := ip.To4(); ip4 != nil {
+			ip, bits = ip4, 8*net.IPv4len
+		}
+		return &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)}, nil
+	}
+	_, ipnet, err := net.ParseCIDR(s)
+	return ipnet, err
+}
+
 // Root contains global configuration, and structs with for specific sub-systems.
 type Root struct {
 	LogLevel      string   `required:"true" default:"info" desc:"debug, info, warn, or error"`
+	LogFormat     string   `required:"true" default:"text" desc:"text or json"`
 	MailboxNaming mbNaming `required:"true" default:"local" desc:"Use local, full or domain addressing"`
+	Mailbox       Mailbox
 	SMTP          SMTP
 	POP3          POP3
+	IMAP          IMAP
 	Web           Web
+	GRPC          GRPC
 	Storage       Storage
+	Webhook       Webhook
+	Forwarding    Forwarding
+}
+
+// Mailbox contains the mailbox name and spam policy configuration.
+type Mailbox struct {
+	AllowPlusAddressing bool       `required:"true" default:"true" desc:"Accept user+tag addresses"`
+	StripPlusTag        bool       `required:"true" default:"true" desc:"Deliver user+tag to the user mailbox"`
+	SubdomainRouting    bool       `required:"true" default:"false" desc:"Deliver user@sub.domain to user.sub mailbox"`
+	CatchAllMailbox     string     `desc:"Deliver mail for recipients without a mailbox here"`
+	SpamRules           []SpamRule `desc:"Messages to flag as spam, see docs."`
 }
 
 // SMTP contains the SMTP server configuration.
 type SMTP struct {
-	Addr            string        `required:"true" default:"0.0.0.0:2500" desc:"SMTP server IP4 host:port"`
-	Domain          string        `required:"true" default:"inbucket" desc:"HELO domain"`
-	MaxRecipients   int           `required:"true" default:"200" desc:"Maximum RCPT TO per message"`
-	MaxMessageBytes int           `required:"true" default:"10240000" desc:"Maximum message size"`
-	DefaultAccept   bool          `required:"true" default:"true" desc:"Accept all mail by default?"`
-	AcceptDomains   []string      `desc:"Domains to accept mail for"`
-	RejectDomains   []string      `desc:"Domains to reject mail for"`
-	DefaultStore    bool          `required:"true" default:"true" desc:"Store all mail by default?"`
-	StoreDomains    []string      `desc:"Domains to store mail for"`
-	DiscardDomains  []string      `desc:"Domains to discard mail for"`
-	Timeout         time.Duration `required:"true" default:"300s" desc:"Idle network timeout"`
-	TLSEnabled      bool          `default:"false" desc:"Enable STARTTLS option"`
-	TLSPrivKey      string        `default:"cert.key" desc:"X509 Private Key file for TLS Support"`
-	TLSCert         string        `default:"cert.crt" desc:"X509 Public Certificate file for TLS Support"`
-	Debug           bool          `ignored:"true"`
+	Addr                      string        `required:"true" default:"0.0.0.0:2500" desc:"SMTP server IP4 host:port"`
+	Domain                    string        `required:"true" default:"inbucket" desc:"HELO domain"`
+	Banner                    string        `default:"{hostname} ESMTP Inbucket {version} ready {date}" desc:"Greeting, expands {hostname}, {version} and {date}"`
+	MaxRecipients             int           `required:"true" default:"200" desc:"Maximum RCPT TO per message"`
+	MaxMessageBytes           int64         `required:"true" default:"10240000" desc:"Maximum message size"`
+	DefaultAccept             bool          `required:"true" default:"true" desc:"Accept all mail by default?"`
+	AcceptDomains             []string      `desc:"Domains to accept mail for"`
+	RejectDomains             []string      `desc:"Domains to reject mail for"`
+	DefaultStore              bool          `required:"true" default:"true" desc:"Store all mail by default?"`
+	StoreDomains              []string      `desc:"Domains to store mail for"`
+	DiscardDomains            []string      `desc:"Domains to discard mail for"`
+	Timeout                   time.Duration `required:"true" default:"300s" desc:"Idle network timeout"`
+	TLSEnabled                bool          `default:"false" desc:"Enable STARTTLS option"`
+	TLSPrivKey                string        `default:"cert.key" desc:"X509 Private Key file for TLS Support"`
+	TLSCert                   string        `default:"cert.crt" desc:"X509 Public Certificate file for TLS Support"`
+	TLSRequired               bool          `default:"false" desc:"Require STARTTLS before MAIL"`
+	AuthRequired              bool          `default:"false" desc:"Require AUTH before MAIL"`
+	Username                  string        `desc:"AUTH username, any credentials accepted if empty"`
+	Password                  string        `desc:"AUTH password"`
+	MaxConnsPerIPPerMinute    int           `required:"true" default:"0" desc:"Max connections per IP per minute, 0 for no limit"`
+	MaxMessagesPerIPPerMinute int           `required:"true" default:"0" desc:"Max messages per IP per minute, 0 for no limit"`
+	DKIMVerify                bool          `default:"false" desc:"Verify DKIM signatures of delivered messages"`
+	SPFCheckEnabled           bool          `default:"false" desc:"Check SPF policy of MAIL FROM domain"`
+	EventLogPath              string        `desc:"SMTP session event log file, disabled if empty"`
+	EventLogMaxBytes          int64         `default:"10485760" desc:"Rotate event log when it exceeds this size"`
+	VRFYEnabled               bool          `default:"false" desc:"Answer VRFY with whether a mailbox exists"`
+	EXPNEnabled               bool          `default:"false" desc:"Answer EXPN with the address itself"`
+	MaxNOOPsPerSession        int           `required:"true" default:"0" desc:"Max NOOP commands per session, 0 for no limit"`
+	Debug                     bool          `ignored:"true"`
 }
 
 // POP3 contains the POP3 server configuration.
@@ -93,24 +193,322 @@ type POP3 struct {
 	Debug   bool          `ignored:"true"`
 }
 
+// IMAP contains the IMAP server configuration.
+type IMAP struct {
+	Addr    string        `desc:"IMAP server IP4 host:port, disabled if empty"`
+	Timeout time.Duration `required:"true" default:"1800s" desc:"Idle network timeout"`
+	Debug   bool          `ignored:"true"`
+}
+
 // Web contains the HTTP server configuration.
 type Web struct {
-	Addr           string `required:"true" default:"0.0.0.0:9000" desc:"Web server IP4 host:port"`
-	BasePath       string `default:"" desc:"Base path prefix for UI and API URLs"`
-	UIDir          string `required:"true" default:"ui/dist" desc:"User interface dir"`
-	GreetingFile   string `required:"true" default:"ui/greeting.html" desc:"Home page greeting HTML"`
-	MonitorVisible bool   `required:"true" default:"true" desc:"Show monitor tab in UI?"`
-	MonitorHistory int    `required:"true" default:"30" desc:"Monitor remembered messages"`
-	PProf          bool   `required:"true" default:"false" desc:"Expose profiling tools on /debug/pprof"`
+	Addr                  string        `required:"true" default:"0.0.0.0:9000" desc:"Web server IP4 host:port"`
+	BasePath              string        `default:"" desc:"Base path prefix for UI and API URLs"`
+	UIDir                 string        `required:"true" default:"ui/dist" desc:"User interface dir"`
+	GreetingFile          string        `required:"true" default:"ui/greeting.html" desc:"Home page greeting HTML"`
+	MonitorVisible        bool          `required:"true" default:"true" desc:"Show monitor tab in UI?"`
+	MonitorHistory        int           `required:"true" default:"30" desc:"Monitor remembered messages"`
+	PProf                 bool          `required:"true" default:"false" desc:"Expose profiling tools on /debug/pprof"`
+	AllowBodySearch       bool          `required:"true" default:"false" desc:"Allow REST API to search message bodies"`
+	StreamTimeout         time.Duration `required:"true" default:"10m" desc:"Idle mailbox event stream timeout"`
+	MailboxListMax        int           `required:"true" default:"1000" desc:"Max mailboxes returned by REST API"`
+	SearchMax             int           `required:"true" default:"100" desc:"Max messages returned by REST API search"`
+	ImportMaxBytes        int           `required:"true" default:"26214400" desc:"Max size of REST API imported messages"`
+	PartsMaxDepth         int           `required:"true" default:"10" desc:"Max multipart nesting read by REST API"`
+	TemplatesPath         string        `desc:"Directory of REST API message templates, disabled if empty"`
+	AdminUser             string        `required:"true" default:"admin" desc:"Admin endpoint basic auth username"`
+	AdminPassword         string        `desc:"Admin endpoint basic auth password, disabled if empty"`
+	APIResponseEnvelope   bool          `required:"true" default:"false" desc:"Wrap REST API JSON responses in an envelope"`
+	APIKeys               []string      `desc:"REST API bearer keys, authentication disabled if empty"`
+	APIAuthBypassLoopback bool          `required:"true" default:"false" desc:"Allow REST API requests from loopback without a key"`
+	CORSAllowedOrigins    []string      `desc:"Origins allowed to make REST API requests, * for any"`
+	TLSEnabled            bool          `default:"false" desc:"Serve HTTPS, enabling HTTP/2"`
+	TLSPrivKey            string        `default:"cert.key" desc:"X509 Private Key file for HTTPS"`
+	TLSCert               string        `default:"cert.crt" desc:"X509 Public Certificate file for HTTPS"`
+	PushAssets            []string      `desc:"UI assets pushed with the index page over HTTP/2"`
+	TrustedProxyCIDRs     []string      `desc:"Proxies trusted to set X-Forwarded-For, as CIDRs or IPs"`
+	AdminTLSClientCAFile  string        `desc:"CA certificates of clients allowed to use admin endpoints"`
+}
+
+// GRPC contains the gRPC server configuration.
+type GRPC struct {
+	Addr  string `desc:"gRPC server IP4 host:port, disabled if empty"`
+	Token string `desc:"Bearer token required by gRPC server, disabled if empty"`
 }
 
 // Storage contains the mail store configuration.
 type Storage struct {
-	Type            string            `required:"true" default:"memory" desc:"Storage impl: file or memory"`
-	Params          map[string]string `desc:"Storage impl parameters, see docs."`
-	RetentionPeriod time.Duration     `required:"true" default:"24h" desc:"Duration to retain messages"`
-	RetentionSleep  time.Duration     `required:"true" default:"50ms" desc:"Duration to sleep between mailboxes"`
-	MailboxMsgCap   int               `required:"true" default:"500" desc:"Maximum messages per mailbox"`
+	Type                string              `required:"true" default:"memory" desc:"Storage impl: badger, file, memory, postgres, redis, s3, or sqlite"`
+	Params              map[string]string   `desc:"Storage impl parameters, see docs."`
+	RetentionPeriod     time.Duration       `required:"true" default:"24h" desc:"Duration to retain messages"`
+	RetentionInterval   time.Duration       `required:"true" default:"1m" desc:"Minimum duration between retention scans"`
+	RetentionSleep      time.Duration       `required:"true" default:"50ms" desc:"Duration to sleep between mailboxes"`
+	MailboxMsgCap       int                 `required:"true" default:"500" desc:"Maximum messages per mailbox"`
+	OverflowPolicy      OverflowPolicy      `required:"true" default:"drop-oldest" desc:"reject, drop-oldest, or drop-newest"`
+	QuotaBytes          int64               `required:"true" default:"0" desc:"Maximum bytes of messages per mailbox, 0 for no limit"`
+	DeduplicateMessages bool                `default:"false" desc:"Discard duplicate messages sent to a mailbox"`
+	DeduplicateWindow   time.Duration       `required:"true" default:"5m" desc:"Duration duplicate messages are detected within"`
+	TimezoneNormalize   bool                `default:"true" desc:"Store message dates in UTC, rather than their original offset"`
+	SubjectRewriteRules SubjectRewriteRules `desc:"Subject rewrites applied by file storage, see docs."`
+	ReplicationMode     ReplicationMode     `default:"" desc:"primary, replica, or empty to disable replication"`
+	ReplicateFrom       string              `desc:"URL of the primary Inbucket mirrored in replica mode"`
+	ReplicationInterval time.Duration       `required:"true" default:"1s" desc:"Duration between replica polls of the primary"`
+	Stores              []StoreRoute        `desc:"Additional stores for mailbox domains, see docs."`
+}
+
+// StoreRoute configures an additional store, holding the mailboxes of the domains matching
+// DomainGlob.  Other settings are shared with the default store.
+type StoreRoute struct {
+	Name       string            // Identifies the store in logs and metrics.
+	Type       string            // Storage impl, as accepted by Storage.Type.
+	Path       string            // Storage path parameter, for impls which store to disk.
+	DomainGlob string            // Mailbox domain pattern, as accepted by filepath.Match.
+	Params     map[string]string // Other storage impl parameters.
+}
+
+// Decode a store route from semicolon separated key=value pairs, such as
+// `name=b;type=file;path=/var/mail-b;domain=*.b.example`.  Keys other than name, type, path and
+// domain are storage impl parameters.
+func (r *StoreRoute) Decode(v string) error {
+	*r = StoreRoute{}
+	for _, pair := range strings.Split(v, ";") {
+		pair = strings.TrimSpace(pair)
+		if pair == "" {
+			continue
+		}
+		i := strings.Index(pair, "=")
+		if i < 1 {
+			return fmt.Errorf("Store expected key=value, got %q", pair)
+		}
+		key, value := strings.ToLower(strings.TrimSpace(pair[:i])), strings.TrimSpace(pair[i+1:])
+		switch key {
+		case "name":
+			r.Name = value
+		case "type":
+			r.Type = strings.ToLower(value)
+		case "path":
+			r.Path = value
+		case "domain":
+			if _, err := filepath.Match(value, ""); err != nil {
+				return fmt.Errorf("Store invalid domain pattern %q: %v", value, err)
+			}
+			r.DomainGlob = strings.ToLower(value)
+		default:
+			if r.Params == nil {
+				r.Params = make(map[string]string)
+			}
+			r.Params[key] = value
+		}
+	}
+	if r.Name == "" || r.Type == "" || r.DomainGlob == "" {
+		return fmt.Errorf("Store requires name, type, and domain, got %q", v)
+	}
+	return nil
+}
+
+// SubjectRewriteRule replaces matches of a regular expression in message subjects before they are
+// stored.
+type SubjectRewriteRule struct {
+	Pattern     string // Regular expression, as accepted by regexp.Compile.
+	Replacement string // Replacement text, may refer to submatches as accepted by Regexp.Expand.
+}
+
+// subjectRewriteSep matches the separators between subject rewrite rules and their key=value
+// pairs; a comma or semicolon only separates when followed by a key, so patterns may contain both.
+var subjectRewriteSep = regexp.MustCompile(`[,;]\s*[A-Za-z]+\s*=`)
+
+// splitSubjectRewrite splits v before each separator matching sep, dropping the separator
+// character itself.
+func splitSubjectRewrite(v string, sep byte) []string {
+	var parts []string
+	start := 0
+	for _, loc := range subjectRewriteSep.FindAllStringIndex(v, -1) {
+		if v[loc[0]] != sep {
+			continue
+		}
+		parts = append(parts, v[start:loc[0]])
+		start = loc[0] + 1
+	}
+	return append(parts, v[start:])
+}
+
+// SubjectRewriteRules is a comma separated list of subject rewrite rules.  It decodes itself
+// rather than being split by envconfig, so rule patterns may contain commas.
+type SubjectRewriteRules []SubjectRewriteRule
+
+// Decode a comma separated list of subject rewrite rules.
+func (rs *SubjectRewriteRules) Decode(v string) error {
+	*rs = nil
+	if strings.TrimSpace(v) == "" {
+		return nil
+	}
+	for _, s := range splitSubjectRewrite(v, ',') {
+		var r SubjectRewriteRule
+		if err := r.Decode(s); err != nil {
+			return err
+		}
+		*rs = append(*rs, r)
+	}
+	return nil
+}
+
+// Decode a subject rewrite rule from semicolon separated key=value pairs, such as
+// `pattern=^\[TEST-\d+-\w+\] *;replacement=`, which removes a prefix.  Semicolons not followed
+// by a key belong to the value.
+func (r *SubjectRewriteRule) Decode(v string) error {
+	*r = SubjectRewriteRule{}
+	for _, pair := range splitSubjectRewrite(v, ';') {
+		pair = strings.TrimSpace(pair)
+		if pair == "" {
+			continue
+		}
+		i := strings.Index(pair, "=")
+		if i < 1 {
+			return fmt.Errorf("Subject rewrite rule expected key=value, got %q", pair)
+		}
+		key, value := strings.ToLower(strings.TrimSpace(pair[:i])), strings.TrimSpace(pair[i+1:])
+		switch key {
+		case "pattern":
+			if _, err := regexp.Compile(value); err != nil {
+				return fmt.Errorf("Subject rewrite rule invalid pattern %q: %v", value, err)
+			}
+			r.Pattern = value
+		case "replacement":
+			r.Replacement = value
+		default:
+			return fmt.Errorf("Subject rewrite rule unknown key %q", key)
+		}
+	}
+	if r.Pattern == "" {
+		return fmt.Errorf("Subject rewrite rule requires pattern, got %q", v)
+	}
+	return nil
+}
+
+// Webhook contains the new message notification configuration.
+type Webhook struct {
+	URL     string        `desc:"URL to POST new message notifications to"`
+	Secret  string        `desc:"Secret used to sign notifications"`
+	Timeout time.Duration `required:"true" default:"10s" desc:"Notification request timeout"`
+}
+
+// Forwarding contains the configuration for relaying copies of messages to other SMTP servers.
+type Forwarding struct {
+	Rules   []ForwardingRule `desc:"Messages to relay, see docs."`
+	Workers int              `required:"true" default:"4" desc:"Concurrent forwarding SMTP sessions"`
+	Timeout time.Duration    `required:"true" default:"30s" desc:"Forwarding SMTP session timeout"`
+	// Circuit breaker, pausing forwarding to targets which can not be connected to.
+	CircuitBreakerThreshold int           `required:"true" default:"5" desc:"Consecutive connection failures before a target is paused, 0 to disable"`
+	CircuitBreakerTimeout   time.Duration `required:"true" default:"30s" desc:"Duration forwarding to a failed target is paused"`
+}
+
+// ForwardingRule selects messages to be relayed to another SMTP server.  Empty MailboxGlob and
+// SubjectContains match all messages.
+type ForwardingRule struct {
+	MailboxGlob     string // Mailbox name pattern, as accepted by filepath.Match.
+	SubjectContains string // Case-insensitive subject substring.
+	TargetSMTP      string // Host and port of the SMTP server to relay to.
+	TargetTo        string // Recipient address on the target server.
+}
+
+// Decode a forwarding rule from semicolon separated key=value pairs, such as
+// `mailbox=alerts*;subject=CRITICAL;smtp=relay:25;to=ops@example.com`.
+func (r *ForwardingRule) Decode(v string) error {
+	*r = ForwardingRule{}
+	for _, pair := range strings.Split(v, ";") {
+		pair = strings.TrimSpace(pair)
+		if pair == "" {
+			continue
+		}
+		i := strings.Index(pair, "=")
+		if i < 1 {
+			return fmt.Errorf("Forwarding rule expected key=value, got %q", pair)
+		}
+		key, value := strings.ToLower(strings.TrimSpace(pair[:i])), strings.TrimSpace(pair[i+1:])
+		switch key {
+		case "mailbox":
+			if _, err := filepath.Match(value, ""); err != nil {
+				return fmt.Errorf("Forwarding rule invalid mailbox pattern %q: %v", value, err)
+			}
+			r.MailboxGlob = value
+		case "subject":
+			r.SubjectContains = value
+		case "smtp":
+			if _, _, err := net.SplitHostPort(value); err != nil {
+				return fmt.Errorf("Forwarding rule invalid smtp address %q: %v", value, err)
+			}
+			r.TargetSMTP = value
+		case "to":
+			addr, err := mail.ParseAddress(value)
+			if err != nil {
+				return fmt.Errorf("Forwarding rule invalid to address %q: %v", value, err)
+			}
+			r.TargetTo = addr.Address
+		default:
+			return fmt.Errorf("Forwarding rule unknown key %q", key)
+		}
+	}
+	if r.TargetSMTP == "" || r.TargetTo == "" {
+		return fmt.Errorf("Forwarding rule requires smtp and to, got %q", v)
+	}
+	return nil
+}
+
+// SpamAction determines what happens to a message matching a SpamRule.
+type SpamAction string
+
+// Spam actions, SpamTag only flags the message, SpamQuarantine also delivers it to a separate
+// mailbox.
+const (
+	SpamTag        SpamAction = "tag"
+	SpamQuarantine SpamAction = "quarantine"
+)
+
+// SpamRule selects delivered messages to flag as spam.  A message matches when it matches every
+// non-empty condition of the rule, at least one condition must be set.
+type SpamRule struct {
+	SubjectContains string     // Case-insensitive subject substring.
+	FromDomain      string     // Domain of the From address, compared case-insensitively.
+	BodyContains    string     // Case-insensitive substring of the text or HTML body.
+	Action          SpamAction // Defaults to SpamTag.
+}
+
+// Decode a spam rule from semicolon separated key=value pairs, such as
+// `subject=free money;from=example.com;action=quarantine`.
+func (r *SpamRule) Decode(v string) error {
+	*r = SpamRule{Action: SpamTag}
+	for _, pair := range strings.Split(v, ";") {
+		pair = strings.TrimSpace(pair)
+		if pair == "" {
+			continue
+		}
+		i := strings.Index(pair, "=")
+		if i < 1 {
+			return fmt.Errorf("Spam rule expected key=value, got %q", pair)
+		}
+		key, value := strings.ToLower(strings.TrimSpace(pair[:i])), strings.TrimSpace(pair[i+1:])
+		switch key {
+		case "subject":
+			r.SubjectContains = value
+		case "from":
+			r.FromDomain = strings.ToLower(strings.TrimPrefix(value, "@"))
+		case "body":
+			r.BodyContains = value
+		case "action":
+			switch action := SpamAction(strings.ToLower(value)); action {
+			case SpamTag, SpamQuarantine:
+				r.Action = action
+			default:
+				return fmt.Errorf("Spam rule unknown action %q", value)
+			}
+		default:
+			return fmt.Errorf("Spam rule unknown key %q", key)
+		}
+	}
+	if r.SubjectContains == "" && r.FromDomain == "" && r.BodyContains == "" {
+		return fmt.Errorf("Spam rule requires subject, from, or body, got %q", v)
+	}
+	return nil
 }
 
 // Process loads and parses configuration from the environment.
@@ -118,6 +516,7 @@ func Process() (*Root, error) {
 	c := &Root{}
 	err := envconfig.Process(prefix, c)
 	c.LogLevel = strings.ToLower(c.LogLevel)
+	c.LogFormat = strings.ToLower(c.LogFormat)
 	stringutil.SliceToLower(c.SMTP.AcceptDomains)
 	stringutil.SliceToLower(c.SMTP.RejectDomains)
 	stringutil.SliceToLower(c.SMTP.StoreDomains)
@@ -125,6 +524,76 @@ func Process() (*Root, error) {
 	return c, err
 }
 
+var (
+	// envFileMu protects envFileOrig.
+	envFileMu sync.Mutex
+
+	// envFileOrig holds the original value of each environment variable set by Load, nil if the
+	// variable was unset.
+	envFileOrig = make(map[string]*string)
+)
+
+// Load sets the environment variables listed in envfile, if not empty, then processes and
+// validates the configuration.  Variables set by a previous call to Load are first restored to
+// their original values, so that variables removed from envfile no longer apply.
+func Load(envfile string) (*Root, error) {
+	envFileMu.Lock()
+	defer envFileMu.Unlock()
+	for k, v := range envFileOrig {
+		if v == nil {
+			os.Unsetenv(k)
+		} else {
+			os.Setenv(k, *v)
+		}
+	}
+	envFileOrig = make(map[string]*string)
+	if envfile != "" {
+		vars, err := readEnvFile(envfile)
+		if err != nil {
+			return nil, err
+		}
+		for _, kv := range vars {
+			if _, ok := envFileOrig[kv[0]]; !ok {
+				if v, ok := os.LookupEnv(kv[0]); ok {
+					envFileOrig[kv[0]] = &v
+				} else {
+					envFileOrig[kv[0]] = nil
+				}
+			}
+			os.Setenv(kv[0], kv[1])
+		}
+	}
+	c, err := Process()
+	if err != nil {
+		return nil, err
+	}
+	return c, c.Validate()
+}
+
+// readEnvFile parses the KEY=value lines of an environment file.  Blank lines and lines beginning
+// with # are ignored.
+func readEnvFile(name string) ([][2]string, error) {
+	f, err := os.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	var vars [][2]string
+	scanner := bufio.NewScanner(f)
+	for n := 1; scanner.Scan(); n++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		i := strings.Index(line, "=")
+		if i < 1 {
+			return nil, fmt.Errorf("%v:%v: expected KEY=value", name, n)
+		}
+		vars = append(vars, [2]string{strings.TrimSpace(line[:i]), line[i+1:]})
+	}
+	return vars, scanner.Err()
+}
+
 // Usage prints out the envconfig usage to Stderr.
 func Usage() {
 	tabs := tabwriter.NewWriter(os.Stderr, 1, 0, 4, ' ', 0)
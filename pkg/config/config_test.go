@@ -0,0 +1,152 @@
+package config
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestForwardingRuleDecode(t *testing.T) {
+	var r ForwardingRule
+	err := r.Decode(" mailbox=alerts* ; subject=Critical;smtp=relay:25;to=Ops <ops@example.com>")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := ForwardingRule{
+		MailboxGlob:     "alerts*",
+		SubjectContains: "Critical",
+		TargetSMTP:      "relay:25",
+		TargetTo:        "ops@example.com",
+	}
+	if r != want {
+		t.Errorf("got %+v, want: %+v", r, want)
+	}
+
+	for _, v := range []string{
+		"",
+		"smtp=relay:25",
+		"to=ops@example.com",
+		"smtp=relay;to=ops@example.com",
+		"smtp=relay:25;to=ops",
+		"mailbox=[;smtp=relay:25;to=ops@example.com",
+		"smtp=relay:25;to=ops@example.com;cc=boss@example.com",
+		"smtp=relay:25;to=ops@example.com;junk",
+	} {
+		if err := r.Decode(v); err == nil {
+			t.Errorf("got nil error decoding %q, wanted error", v)
+		}
+	}
+}
+
+func TestSpamRuleDecode(t *testing.T) {
+	var r SpamRule
+	if err := r.Decode("subject=Free Money; from=@Spam.Example ;action=Quarantine"); err != nil {
+		t.Fatal(err)
+	}
+	want := SpamRule{
+		SubjectContains: "Free Money",
+		FromDomain:      "spam.example",
+		Action:          SpamQuarantine,
+	}
+	if r != want {
+		t.Errorf("got %+v, want: %+v", r, want)
+	}
+	if err := r.Decode("body=unsubscribe"); err != nil || r.Action != SpamTag {
+		t.Errorf("got %+v, %v, want action %q", r, err, SpamTag)
+	}
+	for _, v := range []string{"", "action=tag", "subject=x;action=delete", "subject=x;to=y",
+		"subject"} {
+		if err := r.Decode(v); err == nil {
+			t.Errorf("got nil error decoding %q, wanted error", v)
+		}
+	}
+}
+
+func TestSubjectRewriteRuleDecode(t *testing.T) {
+	var r SubjectRewriteRule
+	if err := r.Decode(` pattern=^\[TEST-(\d+)-\w+\] *; replacement=[$1] `); err != nil {
+		t.Fatal(err)
+	}
+	want := SubjectRewriteRule{Pattern: `^\[TEST-(\d+)-\w+\] *`, Replacement: "[$1]"}
+	if r != want {
+		t.Errorf("got %+v, want: %+v", r, want)
+	}
+	if err := r.Decode("pattern=a=b"); err != nil || r.Pattern != "a=b" || r.Replacement != "" {
+		t.Errorf("got %+v, %v, want pattern a=b", r, err)
+	}
+	if err := r.Decode("pattern=a;b, c;replacement=d"); err != nil || r.Pattern != "a;b, c" ||
+		r.Replacement != "d" {
+		t.Errorf("got %+v, %v, want pattern a;b, c", r, err)
+	}
+	for _, v := range []string{"", "replacement=x", "pattern=[", "pattern=x;subject=y", "pattern"} {
+		if err := r.Decode(v); err == nil {
+			t.Errorf("got nil error decoding %q, wanted error", v)
+		}
+	}
+}
+
+func TestSubjectRewriteRulesDecode(t *testing.T) {
+	var rs SubjectRewriteRules
+	err := rs.Decode(`pattern=^\[TEST-\d{1,3}\] *;replacement=, pattern=(a|b){2,};replacement=x,y`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := SubjectRewriteRules{
+		{Pattern: `^\[TEST-\d{1,3}\] *`},
+		{Pattern: `(a|b){2,}`, Replacement: "x,y"},
+	}
+	if !reflect.DeepEqual(rs, want) {
+		t.Errorf("got %+v, want: %+v", rs, want)
+	}
+	if err := rs.Decode(" "); err != nil || rs != nil {
+		t.Errorf("got %+v, %v, want no rules", rs, err)
+	}
+	for _, v := range []string{"pattern=x,replacement=y", "pattern=x,pattern=["} {
+		if err := rs.Decode(v); err == nil {
+			t.Errorf("got nil error decoding %q, wanted error", v)
+		}
+	}
+}
+
+func TestStoreRouteDecode(t *testing.T) {
+	var r StoreRoute
+	err := r.Decode(" name=b;Type=File; path=/var/mail-b;domain=*.B.example;compress=true")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if r.Name != "b" || r.Type != "file" || r.Path != "/var/mail-b" ||
+		r.DomainGlob != "*.b.example" || len(r.Params) != 1 || r.Params["compress"] != "true" {
+		t.Errorf("got %+v", r)
+	}
+
+	for _, v := range []string{
+		"",
+		"type=file;domain=b.example",
+		"name=b;domain=b.example",
+		"name=b;type=file",
+		"name=b;type=file;domain=[",
+		"name=b;type=file;domain=b.example;junk",
+	} {
+		if err := r.Decode(v); err == nil {
+			t.Errorf("got nil error decoding %q, wanted error", v)
+		}
+	}
+}
+
+func TestReplicationModeDecode(t *testing.T) {
+	var m ReplicationMode
+	for v, want := range map[string]ReplicationMode{
+		"":        ReplicationNone,
+		"primary": ReplicationPrimary,
+		"Replica": ReplicationReplica,
+	} {
+		if err := m.Decode(v); err != nil {
+			t.Errorf("Decode(%q) got error: %v", v, err)
+		}
+		if m != want {
+			t.Errorf("Decode(%q) got %q, want: %q", v, m, want)
+		}
+	}
+	if err := m.Decode("standby"); err == nil {
+		t.Error("got nil error decoding standby, wanted error")
+	}
+}
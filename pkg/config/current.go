@@ -0,0 +1,167 @@
+package config
+
+import (
+	"errors"
+	"fmt"
+	"reflect"
+	"regexp"
+	"strings"
+	"sync"
+)
+
+// reloadable lists the fields which may be changed by Reload while the server is running.  All
+// other fields, such as listen addresses and the storage type and parameters, require a restart.
+var reloadable = map[string]bool{
+	"LogLevel":                  true,
+	"Storage.RetentionPeriod":   true,
+	"Storage.RetentionInterval": true,
+	"Storage.RetentionSleep":    true,
+	"Webhook.URL":               true,
+	"Webhook.Secret":            true,
+}
+
+// ErrReloadDisabled indicates Reload was called on a Current without a load function.
+var ErrReloadDisabled = errors.New("configuration reload is not enabled")
+
+// RestartError is returned by Reload when the new configuration changes fields which require a
+// restart.
+type RestartError struct {
+	Fields []string
+}
+
+func (e *RestartError) Error() string {
+	return "restart required to change " + strings.Join(e.Fields, ", ")
+}
+
+// Current holds the active configuration, which may be replaced by Reload.  It is safe for
+// concurrent use.
+type Current struct {
+	mu   sync.RWMutex
+	root *Root
+	load func() (*Root, error)
+}
+
+// NewCurrent creates a Current holding root.  Reload obtains the new configuration from load,
+// which may be nil to disable reloading.
+func NewCurrent(root *Root, load func() (*Root, error)) *Current {
+	return &Current{root: root, load: load}
+}
+
+// Get returns the active configuration, which must not be modified.
+func (c *Current) Get() *Root {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return c.root
+}
+
+// Reload loads a new configuration and makes it active, returning the names of the changed
+// fields.  If any changed field requires a restart, a *RestartError is returned and the active
+// configuration is unchanged.
+func (c *Current) Reload() (changed []string, err error) {
+	if c.load == nil {
+		return nil, ErrReloadDisabled
+	}
+	root, err := c.load()
+	if err != nil {
+		return nil, err
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	changed = Changed(c.root, root)
+	var restart []string
+	for _, field := range changed {
+		if !reloadable[field] {
+			restart = append(restart, field)
+		}
+	}
+	// The retention scanner and webhook notifier are only started if enabled.
+	if (c.root.Storage.RetentionPeriod > 0) != (root.Storage.RetentionPeriod > 0) {
+		restart = append(restart, "Storage.RetentionPeriod")
+	}
+	if (c.root.Webhook.URL != "") != (root.Webhook.URL != "") {
+		restart = append(restart, "Webhook.URL")
+	}
+	if len(restart) > 0 {
+		return nil, &RestartError{Fields: restart}
+	}
+	c.root = root
+	return changed, nil
+}
+
+// Changed returns the dotted names of the fields which differ between a and b, in declaration
+// order.
+func Changed(a, b *Root) []string {
+	changed := make([]string, 0)
+	changedFields(&changed, "", reflect.ValueOf(a).Elem(), reflect.ValueOf(b).Elem())
+	return changed
+}
+
+// changedFields appends the names of fields which differ between structs a and b to changed.
+func changedFields(changed *[]string, prefix string, a, b reflect.Value) {
+	for i := 0; i < a.NumField(); i++ {
+		name := prefix + a.Type().Field(i).Name
+		fa, fb := a.Field(i), b.Field(i)
+		if fa.Kind() == reflect.Struct {
+			changedFields(changed, name+".", fa, fb)
+			continue
+		}
+		if !reflect.DeepEqual(fa.Interface(), fb.Interface()) {
+			*changed = append(*changed, name)
+		}
+	}
+}
+
+// Validate checks settings which can not be verified while decoding the environment.
+func (c *Root) Validate() error {
+	switch c.LogLevel {
+	case "debug", "info", "warn", "error":
+	default:
+		return fmt.Errorf("LogLevel must be debug, info, warn, or error, got %q", c.LogLevel)
+	}
+	switch c.LogFormat {
+	case "text", "json":
+	default:
+		return fmt.Errorf("LogFormat must be text or json, got %q", c.LogFormat)
+	}
+	for _, s := range c.Web.TrustedProxyCIDRs {
+		if _, err := ParseCIDR(s); err != nil {
+			return fmt.Errorf("TrustedProxyCIDRs contains invalid CIDR %q", s)
+		}
+	}
+	if c.Web.AdminTLSClientCAFile != "" && !c.Web.TLSEnabled {
+		return fmt.Errorf("AdminTLSClientCAFile requires Web TLSEnabled")
+	}
+	if c.Storage.RetentionInterval <= 0 {
+		return fmt.Errorf("RetentionInterval must be positive, got %v", c.Storage.RetentionInterval)
+	}
+	if c.Storage.QuotaBytes < 0 {
+		return fmt.Errorf("QuotaBytes must not be negative, got %v", c.Storage.QuotaBytes)
+	}
+	if c.Storage.QuotaBytes > 0 && c.Storage.Type != "file" {
+		return fmt.Errorf("QuotaBytes is only supported by file storage, got %q", c.Storage.Type)
+	}
+	if c.Storage.ReplicationMode == ReplicationReplica && c.Storage.ReplicateFrom == "" {
+		return fmt.Errorf("ReplicateFrom is required in replica ReplicationMode")
+	}
+	names := make(map[string]bool)
+	for _, r := range c.Storage.Stores {
+		if names[r.Name] {
+			return fmt.Errorf("Stores contains duplicate name %q", r.Name)
+		}
+		names[r.Name] = true
+		if c.Storage.QuotaBytes > 0 && r.Type != "file" {
+			return fmt.Errorf("QuotaBytes is only supported by file storage, got store %q of type %q",
+				r.Name, r.Type)
+		}
+	}
+	for _, r := range c.Storage.SubjectRewriteRules {
+		if _, err := regexp.Compile(r.Pattern); err != nil {
+			return fmt.Errorf("SubjectRewriteRules contains invalid pattern %q: %v", r.Pattern, err)
+		}
+	}
+	if len(c.Storage.Stores) > 0 && c.Storage.ReplicationMode != ReplicationNone {
+		return fmt.Errorf("Stores can not be used with ReplicationMode %q",
+			c.Storage.ReplicationMode)
+	}
+	return nil
+}
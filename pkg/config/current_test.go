@@ -0,0 +1,158 @@
+package config
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestReload(t *testing.T) {
+	base := Root{LogLevel: "info", Storage: Storage{RetentionPeriod: time.Hour, Type: "memory"}}
+	testCases := []struct {
+		name    string
+		modify  func(*Root)
+		changed []string
+		restart []string
+	}{
+		{"unchanged", func(r *Root) {}, []string{}, nil},
+		{"reloadable", func(r *Root) {
+			r.LogLevel = "debug"
+			r.Storage.RetentionPeriod = time.Minute
+		}, []string{"LogLevel", "Storage.RetentionPeriod"}, nil},
+		{"restart", func(r *Root) {
+			r.LogLevel = "debug"
+			r.SMTP.Addr = "0.0.0.0:25"
+			r.Storage.Type = "file"
+			r.Storage.Params = map[string]string{"path": "/tmp"}
+		}, nil, []string{"SMTP.Addr", "Storage.Type", "Storage.Params"}},
+		{"disable retention", func(r *Root) {
+			r.Storage.RetentionPeriod = 0
+		}, nil, []string{"Storage.RetentionPeriod"}},
+		{"enable webhook", func(r *Root) {
+			r.Webhook.URL = "http://localhost/hook"
+		}, nil, []string{"Webhook.URL"}},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			old := base
+			next := base
+			tc.modify(&next)
+			c := NewCurrent(&old, func() (*Root, error) { return &next, nil })
+			changed, err := c.Reload()
+			if tc.restart != nil {
+				rerr, ok := err.(*RestartError)
+				if !ok {
+					t.Fatalf("Got error %v, want: *RestartError", err)
+				}
+				if !reflect.DeepEqual(rerr.Fields, tc.restart) {
+					t.Errorf("Got restart fields %v, want: %v", rerr.Fields, tc.restart)
+				}
+				if c.Get() != &old {
+					t.Error("Configuration was replaced despite restart error")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(changed, tc.changed) {
+				t.Errorf("Got changed %v, want: %v", changed, tc.changed)
+			}
+			if c.Get() != &next {
+				t.Error("Configuration was not replaced")
+			}
+		})
+	}
+
+	if _, err := NewCurrent(&base, nil).Reload(); err != ErrReloadDisabled {
+		t.Errorf("Got error %v without load func, want: %v", err, ErrReloadDisabled)
+	}
+}
+
+func TestLoad(t *testing.T) {
+	dir, err := ioutil.TempDir("", "inbucket")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	envfile := filepath.Join(dir, "inbucket.env")
+	write := func(content string) {
+		t.Helper()
+		if err := ioutil.WriteFile(envfile, []byte(content), 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	const key = "INBUCKET_STORAGE_RETENTIONPERIOD"
+	os.Setenv(key, "2h")
+	defer os.Unsetenv(key)
+
+	write("# Comment\n\nINBUCKET_STORAGE_RETENTIONPERIOD=30m\nINBUCKET_LOGLEVEL=debug\n")
+	c, err := Load(envfile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c.Storage.RetentionPeriod != 30*time.Minute || c.LogLevel != "debug" {
+		t.Errorf("Got RetentionPeriod %v, LogLevel %q, want: 30m, debug",
+			c.Storage.RetentionPeriod, c.LogLevel)
+	}
+
+	// Variables removed from the file revert to the environment.
+	write("INBUCKET_LOGLEVEL=warn\n")
+	c, err = Load(envfile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c.Storage.RetentionPeriod != 2*time.Hour || c.LogLevel != "warn" {
+		t.Errorf("Got RetentionPeriod %v, LogLevel %q, want: 2h, warn",
+			c.Storage.RetentionPeriod, c.LogLevel)
+	}
+	if _, ok := os.LookupEnv("INBUCKET_LOGLEVEL"); !ok {
+		t.Error("INBUCKET_LOGLEVEL was not set")
+	}
+
+	write("INBUCKET_STORAGE_SUBJECTREWRITERULES=pattern=^\\[TEST-\\d{1,3}\\] *;replacement=\n")
+	c, err = Load(envfile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := SubjectRewriteRules{{Pattern: `^\[TEST-\d{1,3}\] *`}}
+	if !reflect.DeepEqual(c.Storage.SubjectRewriteRules, want) {
+		t.Errorf("Got SubjectRewriteRules %+v, want: %+v", c.Storage.SubjectRewriteRules, want)
+	}
+
+	for _, content := range []string{
+		"INBUCKET_LOGLEVEL=loud\n",
+		"INBUCKET_LOGLEVEL\n",
+		"INBUCKET_STORAGE_SUBJECTREWRITERULES=pattern=[TEST-\n",
+		"INBUCKET_STORAGE_RETENTIONINTERVAL=0\n",
+		"INBUCKET_STORAGE_RETENTIONINTERVAL=-1m\n",
+	} {
+		write(content)
+		if _, err := Load(envfile); err == nil {
+			t.Errorf("Got nil error for %q", content)
+		}
+	}
+
+	// A reload to an invalid configuration keeps the active one.
+	write("INBUCKET_STORAGE_RETENTIONINTERVAL=0\n")
+	cur := NewCurrent(c, func() (*Root, error) { return Load(envfile) })
+	if _, err := cur.Reload(); err == nil {
+		t.Error("Got nil error reloading RetentionInterval 0")
+	}
+	if cur.Get() != c {
+		t.Error("Configuration was replaced by an invalid reload")
+	}
+
+	if _, err := Load(filepath.Join(dir, "missing.env")); err == nil {
+		t.Error("Got nil error for missing file")
+	}
+	if _, err := Load(""); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := os.LookupEnv("INBUCKET_LOGLEVEL"); ok {
+		t.Error("INBUCKET_LOGLEVEL was not restored")
+	}
+}
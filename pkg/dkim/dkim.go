@@ -0,0 +1,447 @@
+// Package dkim verifies DomainKeys Identified Mail signatures, as specified by RFC 6376.
+package dkim
+
+import (
+	"bytes"
+	"context"
+	"crypto"
+	"crypto/rsa"
+	_ "crypto/sha1" // Register hashes used by signature algorithms.
+	_ "crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"fmt"
+	"hash"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Result is the outcome of verifying the DKIM signatures of a message.  The zero value indicates
+// the message has not been verified.
+type Result int
+
+const (
+	// None indicates the message is not signed.
+	None Result = iota + 1
+	// Pass indicates a signature was verified.
+	Pass
+	// Fail indicates a signature did not match the message.
+	Fail
+	// TempError indicates the public key could not be retrieved due to a temporary error.
+	TempError
+	// PermError indicates a signature or public key could not be processed.
+	PermError
+)
+
+var resultNames = map[Result]string{
+	None:      "none",
+	Pass:      "pass",
+	Fail:      "fail",
+	TempError: "temperror",
+	PermError: "permerror",
+}
+
+// String returns the RFC 8601 name of the result, or an empty string if not verified.
+func (r Result) String() string {
+	return resultNames[r]
+}
+
+// MarshalText returns the name of the result.
+func (r Result) MarshalText() ([]byte, error) {
+	return []byte(r.String()), nil
+}
+
+// UnmarshalText sets the result from its name.
+func (r *Result) UnmarshalText(text []byte) error {
+	for result, name := range resultNames {
+		if name == string(text) {
+			*r = result
+			return nil
+		}
+	}
+	if len(text) == 0 {
+		*r = 0
+		return nil
+	}
+	return fmt.Errorf("unknown DKIM result %q", text)
+}
+
+// Resolver looks up the DNS TXT records holding DKIM public keys; it is implemented by
+// *net.Resolver.
+type Resolver interface {
+	LookupTXT(ctx context.Context, name string) ([]string, error)
+}
+
+// verifyError is the result of verifying a single signature which did not pass.
+type verifyError struct {
+	result Result
+	reason string
+}
+
+func (e *verifyError) Error() string {
+	return e.result.String() + ": " + e.reason
+}
+
+func permError(format string, args ...interface{}) error {
+	return &verifyError{result: PermError, reason: fmt.Sprintf(format, args...)}
+}
+
+// Verify checks the DKIM signatures of the message source, looking up public keys with
+// resolver.  The result of the first passing signature is returned along with its signing
+// domain, otherwise the result of the first signature.
+func Verify(ctx context.Context, resolver Resolver, source []byte) (result Result, domain string) {
+	header, body := splitMessage(source)
+	result = None
+	for i, field := range header {
+		if !strings.EqualFold(field.name, "DKIM-Signature") {
+			continue
+		}
+		sig, err := parseSignature(field.value)
+		if err == nil {
+			err = verifySignature(ctx, resolver, header, i, body, sig)
+		}
+		d := ""
+		if sig != nil {
+			d = sig.domain
+		}
+		if err == nil {
+			return Pass, d
+		}
+		if result == None {
+			result, domain = err.(*verifyError).result, d
+		}
+	}
+	return result, domain
+}
+
+// headerField is a header field of a message, name is the field name as it appears in the
+// message, and raw is the complete field including folding and the trailing CRLF.
+type headerField struct {
+	name  string
+	value string
+	raw   string
+}
+
+// splitMessage returns the header fields and body of source, with line endings normalized to
+// CRLF.
+func splitMessage(source []byte) (header []headerField, body []byte) {
+	source = bytes.Replace(source, []byte("\r\n"), []byte("\n"), -1)
+	source = bytes.Replace(source, []byte("\n"), []byte("\r\n"), -1)
+	head := source
+	if i := bytes.Index(source, []byte("\r\n\r\n")); i >= 0 {
+		head, body = source[:i+2], source[i+4:]
+	} else if bytes.HasPrefix(source, []byte("\r\n")) {
+		head, body = nil, source[2:]
+	}
+	for _, line := range strings.SplitAfter(string(head), "\r\n") {
+		if line == "" {
+			continue
+		}
+		if (line[0] == ' ' || line[0] == '\t') && len(header) > 0 {
+			// Continuation of a folded field.
+			header[len(header)-1].raw += line
+			continue
+		}
+		header = append(header, headerField{raw: line})
+	}
+	for i := range header {
+		f := &header[i]
+		if c := strings.IndexByte(f.raw, ':'); c >= 0 {
+			f.name = f.raw[:c]
+			f.value = f.raw[c+1:]
+		} else {
+			f.name = strings.TrimRight(f.raw, "\r\n")
+		}
+	}
+	return header, body
+}
+
+// signature holds the tags of a DKIM-Signature field.
+type signature struct {
+	hash      crypto.Hash
+	sig       []byte
+	bodyHash  []byte
+	relaxedH  bool
+	relaxedB  bool
+	domain    string
+	headers   []string
+	length    int64 // -1 if the whole body is signed.
+	selector  string
+	expiresAt int64 // 0 if the signature does not expire.
+}
+
+// parseTags parses a DKIM tag=value list, removing whitespace.
+func parseTags(s string) (map[string]string, error) {
+	tags := make(map[string]string)
+	for _, spec := range strings.Split(s, ";") {
+		spec = removeSpace(spec)
+		if spec == "" {
+			continue
+		}
+		i := strings.IndexByte(spec, '=')
+		if i < 1 {
+			return nil, fmt.Errorf("malformed tag %q", spec)
+		}
+		if _, ok := tags[spec[:i]]; ok {
+			return nil, fmt.Errorf("duplicate tag %q", spec[:i])
+		}
+		tags[spec[:i]] = spec[i+1:]
+	}
+	return tags, nil
+}
+
+// removeSpace removes all whitespace, including folding, from s.
+func removeSpace(s string) string {
+	return strings.Map(func(r rune) rune {
+		switch r {
+		case ' ', '\t', '\r', '\n':
+			return -1
+		}
+		return r
+	}, s)
+}
+
+// parseSignature parses the value of a DKIM-Signature field.  If the tags could be parsed, the
+// signature is returned along with any error so the signing domain may be reported.
+func parseSignature(value string) (*signature, error) {
+	tags, err := parseTags(value)
+	if err != nil {
+		return nil, permError("%v", err)
+	}
+	sig := &signature{domain: strings.ToLower(tags["d"]), length: -1}
+	for _, tag := range []string{"v", "a", "b", "bh", "d", "h", "s"} {
+		if tags[tag] == "" {
+			return sig, permError("missing %v= tag", tag)
+		}
+	}
+	if tags["v"] != "1" {
+		return sig, permError("unsupported version %q", tags["v"])
+	}
+	switch tags["a"] {
+	case "rsa-sha256":
+		sig.hash = crypto.SHA256
+	case "rsa-sha1":
+		sig.hash = crypto.SHA1
+	default:
+		return sig, permError("unsupported algorithm %q", tags["a"])
+	}
+	if sig.sig, err = base64.StdEncoding.DecodeString(tags["b"]); err != nil {
+		return sig, permError("malformed b= tag: %v", err)
+	}
+	if sig.bodyHash, err = base64.StdEncoding.DecodeString(tags["bh"]); err != nil {
+		return sig, permError("malformed bh= tag: %v", err)
+	}
+	canon := strings.SplitN(tags["c"], "/", 2)
+	for i, c := range canon {
+		switch c {
+		case "", "simple":
+		case "relaxed":
+			if i == 0 {
+				sig.relaxedH = true
+			} else {
+				sig.relaxedB = true
+			}
+		default:
+			return sig, permError("unsupported canonicalization %q", tags["c"])
+		}
+	}
+	for _, name := range strings.Split(tags["h"], ":") {
+		sig.headers = append(sig.headers, strings.ToLower(name))
+	}
+	if !contains(sig.headers, "from") {
+		return sig, permError("From field not signed")
+	}
+	if l, ok := tags["l"]; ok {
+		if sig.length, err = strconv.ParseInt(l, 10, 64); err != nil || sig.length < 0 {
+			return sig, permError("malformed l= tag %q", l)
+		}
+	}
+	if x, ok := tags["x"]; ok {
+		if sig.expiresAt, err = strconv.ParseInt(x, 10, 64); err != nil {
+			return sig, permError("malformed x= tag %q", x)
+		}
+	}
+	sig.selector = tags["s"]
+	return sig, nil
+}
+
+// timeNow allows tests to control the time signatures expire.
+var timeNow = time.Now
+
+// verifySignature verifies sig, which was parsed from header field sigIndex.
+func verifySignature(
+	ctx context.Context,
+	resolver Resolver,
+	header []headerField,
+	sigIndex int,
+	body []byte,
+	sig *signature,
+) error {
+	if sig.expiresAt != 0 && timeNow().Unix() > sig.expiresAt {
+		return permError("signature expired")
+	}
+	key, err := lookupKey(ctx, resolver, sig.selector+"._domainkey."+sig.domain)
+	if err != nil {
+		return err
+	}
+
+	// Body hash.
+	cbody := canonicalBody(body, sig.relaxedB)
+	if sig.length >= 0 {
+		if sig.length > int64(len(cbody)) {
+			return permError("l= tag exceeds body length")
+		}
+		cbody = cbody[:sig.length]
+	}
+	h := sig.hash.New()
+	_, _ = h.Write(cbody)
+	if !bytes.Equal(h.Sum(nil), sig.bodyHash) {
+		return &verifyError{result: Fail, reason: "body hash does not match"}
+	}
+
+	// Header hash.
+	h = sig.hash.New()
+	writeSignedHeaders(h, header, sig)
+	sigField := header[sigIndex]
+	sigField.raw = stripSignature(sigField.raw)
+	_, _ = h.Write([]byte(strings.TrimSuffix(canonicalField(sigField, sig.relaxedH), "\r\n")))
+	if err := rsa.VerifyPKCS1v15(key, sig.hash, h.Sum(nil), sig.sig); err != nil {
+		return &verifyError{result: Fail, reason: "signature does not match"}
+	}
+	return nil
+}
+
+// writeSignedHeaders writes the canonical form of the fields listed in the h= tag of sig to h.
+// Each name selects the last field of that name not already selected.
+func writeSignedHeaders(h hash.Hash, header []headerField, sig *signature) {
+	used := make(map[int]bool)
+	for _, name := range sig.headers {
+		for i := len(header) - 1; i >= 0; i-- {
+			if used[i] || !strings.EqualFold(strings.TrimRight(header[i].name, " \t"), name) {
+				continue
+			}
+			used[i] = true
+			_, _ = h.Write([]byte(canonicalField(header[i], sig.relaxedH)))
+			break
+		}
+	}
+}
+
+// stripSignature removes the value of the b= tag from a raw DKIM-Signature field.
+func stripSignature(raw string) string {
+	c := strings.IndexByte(raw, ':')
+	tags := strings.Split(raw[c+1:], ";")
+	for i, tag := range tags {
+		if eq := strings.IndexByte(tag, '='); eq >= 0 && removeSpace(tag[:eq]) == "b" {
+			end := len(tag)
+			if i == len(tags)-1 {
+				// Keep the CRLF ending the field.
+				end = len(strings.TrimRight(tag, "\r\n"))
+			}
+			tags[i] = tag[:eq+1] + tag[end:]
+		}
+	}
+	return raw[:c+1] + strings.Join(tags, ";")
+}
+
+// canonicalField returns the field in simple or relaxed header canonical form, including the
+// trailing CRLF.
+func canonicalField(f headerField, relaxed bool) string {
+	if !relaxed {
+		return f.raw
+	}
+	c := strings.IndexByte(f.raw, ':')
+	name := strings.ToLower(strings.TrimRight(f.raw[:c], " \t"))
+	value := strings.Replace(f.raw[c+1:], "\r\n", "", -1)
+	value = strings.Join(strings.FieldsFunc(value, func(r rune) bool {
+		return r == ' ' || r == '\t'
+	}), " ")
+	return name + ":" + value + "\r\n"
+}
+
+// canonicalBody returns the body in simple or relaxed body canonical form.
+func canonicalBody(body []byte, relaxed bool) []byte {
+	lines := strings.SplitAfter(string(body), "\r\n")
+	if relaxed {
+		for i, line := range lines {
+			crlf := strings.HasSuffix(line, "\r\n")
+			line = strings.TrimRight(strings.TrimSuffix(line, "\r\n"), " \t")
+			line = strings.Join(strings.FieldsFunc(line, func(r rune) bool {
+				return r == ' ' || r == '\t'
+			}), " ")
+			if crlf {
+				line += "\r\n"
+			}
+			lines[i] = line
+		}
+	}
+	// Remove empty lines from the end of the body.
+	for len(lines) > 0 && (lines[len(lines)-1] == "" || lines[len(lines)-1] == "\r\n") {
+		lines = lines[:len(lines)-1]
+	}
+	cbody := strings.Join(lines, "")
+	if cbody == "" {
+		if relaxed {
+			return nil
+		}
+		return []byte("\r\n")
+	}
+	if !strings.HasSuffix(cbody, "\r\n") {
+		cbody += "\r\n"
+	}
+	return []byte(cbody)
+}
+
+// lookupKey retrieves the RSA public key published at name.
+func lookupKey(ctx context.Context, resolver Resolver, name string) (*rsa.PublicKey, error) {
+	txts, err := resolver.LookupTXT(ctx, name)
+	if err != nil {
+		if dnsErr, ok := err.(*net.DNSError); ok && dnsErr.IsNotFound {
+			return nil, permError("no key for signature: %v", err)
+		}
+		return nil, &verifyError{result: TempError, reason: err.Error()}
+	}
+	if len(txts) == 0 {
+		return nil, permError("no key for signature")
+	}
+	tags, err := parseTags(strings.Join(txts, ""))
+	if err != nil {
+		return nil, permError("malformed key record: %v", err)
+	}
+	if v, ok := tags["v"]; ok && v != "DKIM1" {
+		return nil, permError("unsupported key version %q", v)
+	}
+	if k, ok := tags["k"]; ok && k != "rsa" {
+		return nil, permError("unsupported key type %q", k)
+	}
+	if tags["p"] == "" {
+		return nil, permError("key revoked")
+	}
+	der, err := base64.StdEncoding.DecodeString(tags["p"])
+	if err != nil {
+		return nil, permError("malformed key: %v", err)
+	}
+	if pub, err := x509.ParsePKIXPublicKey(der); err == nil {
+		if key, ok := pub.(*rsa.PublicKey); ok {
+			return key, nil
+		}
+		return nil, permError("key is not RSA")
+	}
+	key, err := x509.ParsePKCS1PublicKey(der)
+	if err != nil {
+		return nil, permError("malformed key: %v", err)
+	}
+	return key, nil
+}
+
+// contains returns true if s is in list.
+func contains(list []string, s string) bool {
+	for _, v := range list {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,218 @@
+package dkim
+
+import (
+	"context"
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+// stubResolver returns the TXT records in records, or err if set.
+type stubResolver struct {
+	records map[string][]string
+	err     error
+}
+
+func (r *stubResolver) LookupTXT(ctx context.Context, name string) ([]string, error) {
+	if r.err != nil {
+		return nil, r.err
+	}
+	if txts, ok := r.records[name]; ok {
+		return txts, nil
+	}
+	return nil, &net.DNSError{Err: "no such host", Name: name, IsNotFound: true}
+}
+
+const unsigned = "From: Alice <alice@example.com>\r\n" +
+	"To: bob@example.org\r\n" +
+	"Subject:  Hello\r\n" +
+	"\tworld\r\n" +
+	"\r\n" +
+	"Hi  Bob, \r\n" +
+	"\r\n" +
+	"\r\n"
+
+// sign returns source with a DKIM-Signature field added, using the tags in spec followed by bh=
+// and b=.
+func sign(t *testing.T, key *rsa.PrivateKey, source, spec string) string {
+	t.Helper()
+	header, body := splitMessage([]byte(source))
+	sig, err := parseSignature(spec + "; bh=AA==; b=AA==")
+	if err != nil {
+		t.Fatal(err)
+	}
+	cbody := canonicalBody(body, sig.relaxedB)
+	if sig.length >= 0 {
+		cbody = cbody[:sig.length]
+	}
+	bh := sha256.Sum256(cbody)
+	field := "DKIM-Signature: " + spec + ";\r\n\tbh=" + base64.StdEncoding.EncodeToString(bh[:]) +
+		"; b=\r\n"
+	h := sha256.New()
+	writeSignedHeaders(h, header, sig)
+	_, _ = h.Write([]byte(strings.TrimSuffix(
+		canonicalField(headerField{raw: field}, sig.relaxedH), "\r\n")))
+	b, err := rsa.SignPKCS1v15(rand.Reader, key, crypto.SHA256, h.Sum(nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+	field = strings.TrimSuffix(field, "\r\n") + base64.StdEncoding.EncodeToString(b) + "\r\n"
+	return field + source
+}
+
+func TestVerify(t *testing.T) {
+	key, err := rsa.GenerateKey(rand.Reader, 1024)
+	if err != nil {
+		t.Fatal(err)
+	}
+	der, err := x509.MarshalPKIXPublicKey(&key.PublicKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	other, err := rsa.GenerateKey(rand.Reader, 1024)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pkcs1 := x509.MarshalPKCS1PublicKey(&key.PublicKey)
+	p := base64.StdEncoding.EncodeToString(der)
+	resolver := &stubResolver{records: map[string][]string{
+		// Long keys are split across TXT strings.
+		"sel._domainkey.example.com":     {"v=DKIM1; k=rsa; p=" + p[:56], p[56:]},
+		"pkcs1._domainkey.example.com":   {"p=" + base64.StdEncoding.EncodeToString(pkcs1)},
+		"revoked._domainkey.example.com": {"v=DKIM1; p="},
+	}}
+
+	const relaxed = "v=1; a=rsa-sha256; c=relaxed/relaxed; d=Example.com; s=sel; " +
+		"h=From:To:Subject"
+	const simple = "v=1; a=rsa-sha256; d=example.com; s=sel; h=from:subject"
+	testCases := []struct {
+		name     string
+		source   string
+		resolver Resolver
+		result   Result
+		domain   string
+	}{
+		{"unsigned", unsigned, resolver, None, ""},
+		{"relaxed", sign(t, key, unsigned, relaxed), resolver, Pass, "example.com"},
+		{"simple", sign(t, key, unsigned, simple), resolver, Pass, "example.com"},
+		{"LF line endings",
+			strings.Replace(sign(t, key, unsigned, relaxed), "\r\n", "\n", -1),
+			resolver, Pass, "example.com"},
+		{"relaxed whitespace changes",
+			strings.Replace(sign(t, key, unsigned, relaxed), "Hi  Bob, ", "Hi Bob,\t", 1),
+			resolver, Pass, "example.com"},
+		{"simple whitespace changes",
+			strings.Replace(sign(t, key, unsigned, simple), "Hi  Bob, ", "Hi Bob,\t", 1),
+			resolver, Fail, "example.com"},
+		{"body changed",
+			strings.Replace(sign(t, key, unsigned, relaxed), "Bob", "Eve", 1),
+			resolver, Fail, "example.com"},
+		{"header changed",
+			strings.Replace(sign(t, key, unsigned, relaxed), "Alice", "Eve", 1),
+			resolver, Fail, "example.com"},
+		{"unsigned header changed",
+			strings.Replace(sign(t, key, unsigned, simple), "bob@", "eve@", 1),
+			resolver, Pass, "example.com"},
+		{"length limited",
+			sign(t, key, unsigned, relaxed+"; l=5") + "Appended\r\n",
+			resolver, Pass, "example.com"},
+		{"wrong key", sign(t, other, unsigned, relaxed), resolver, Fail, "example.com"},
+		{"PKCS1 key", sign(t, key, unsigned, strings.Replace(relaxed, "s=sel", "s=pkcs1", 1)),
+			resolver, Pass, "example.com"},
+		{"revoked key",
+			sign(t, key, unsigned, strings.Replace(relaxed, "s=sel", "s=revoked", 1)),
+			resolver, PermError, "example.com"},
+		{"missing key",
+			sign(t, key, unsigned, strings.Replace(relaxed, "s=sel", "s=missing", 1)),
+			resolver, PermError, "example.com"},
+		{"DNS failure", sign(t, key, unsigned, relaxed),
+			&stubResolver{err: &net.DNSError{Err: "timeout", IsTimeout: true}},
+			TempError, "example.com"},
+		{"expired", sign(t, key, unsigned, relaxed+"; x=1000"), resolver, PermError,
+			"example.com"},
+		{"From not signed",
+			strings.Replace(sign(t, key, unsigned, relaxed), "h=From:", "h=", 1),
+			resolver, PermError, "example.com"},
+		{"malformed", "DKIM-Signature: v=1; a\r\n" + unsigned, resolver, PermError, ""},
+		{"second signature passes",
+			sign(t, key, sign(t, other, unsigned, relaxed), relaxed),
+			resolver, Pass, "example.com"},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			result, domain := Verify(context.Background(), tc.resolver, []byte(tc.source))
+			if result != tc.result {
+				t.Errorf("Got result %v, want: %v", result, tc.result)
+			}
+			if domain != tc.domain {
+				t.Errorf("Got domain %q, want: %q", domain, tc.domain)
+			}
+		})
+	}
+}
+
+func TestVerifyNotExpired(t *testing.T) {
+	timeNow = func() time.Time { return time.Unix(1000, 0) }
+	defer func() { timeNow = time.Now }()
+	key, err := rsa.GenerateKey(rand.Reader, 1024)
+	if err != nil {
+		t.Fatal(err)
+	}
+	der := x509.MarshalPKCS1PublicKey(&key.PublicKey)
+	resolver := &stubResolver{records: map[string][]string{
+		"sel._domainkey.example.com": {"p=" + base64.StdEncoding.EncodeToString(der)},
+	}}
+	source := sign(t, key, unsigned, "v=1; a=rsa-sha256; d=example.com; s=sel; h=from; x=1000")
+	if result, _ := Verify(context.Background(), resolver, []byte(source)); result != Pass {
+		t.Errorf("Got result %v, want: %v", result, Pass)
+	}
+}
+
+func TestCanonicalBody(t *testing.T) {
+	testCases := []struct {
+		body    string
+		relaxed bool
+		want    string
+	}{
+		{"", false, "\r\n"},
+		{"", true, ""},
+		{"\r\n\r\n", false, "\r\n"},
+		{"\r\n\r\n", true, ""},
+		{"a \t b \r\n \r\n", false, "a \t b \r\n \r\n"},
+		{"a \t b \r\n \r\n", true, "a b\r\n"},
+		{"no newline", false, "no newline\r\n"},
+	}
+	for _, tc := range testCases {
+		if got := string(canonicalBody([]byte(tc.body), tc.relaxed)); got != tc.want {
+			t.Errorf("Got %q for body %q relaxed %v, want: %q", got, tc.body, tc.relaxed,
+				tc.want)
+		}
+	}
+}
+
+func TestResultText(t *testing.T) {
+	for _, want := range []Result{0, None, Pass, Fail, TempError, PermError} {
+		text, err := want.MarshalText()
+		if err != nil {
+			t.Fatal(err)
+		}
+		var got Result
+		if err := got.UnmarshalText(text); err != nil {
+			t.Fatal(err)
+		}
+		if got != want {
+			t.Errorf("Got %v after round trip of %q, want: %v", got, text, want)
+		}
+	}
+	var r Result
+	if err := r.UnmarshalText([]byte("bogus")); err == nil {
+		t.Error("Expected error for unknown result")
+	}
+}
@@ -0,0 +1,96 @@
+package forward
+
+import (
+	"sync"
+	"time"
+)
+
+// breakerState is the state of a circuit breaker.
+type breakerState int
+
+const (
+	breakerClosed   breakerState = iota // Connections are attempted.
+	breakerOpen                         // Connections are skipped until the timeout passes.
+	breakerHalfOpen                     // A single probe connection is in progress.
+)
+
+func (s breakerState) String() string {
+	switch s {
+	case breakerOpen:
+		return "open"
+	case breakerHalfOpen:
+		return "half-open"
+	}
+	return "closed"
+}
+
+// breaker is a circuit breaker for the connections to a single forwarding target.  After
+// threshold consecutive connection failures it opens, skipping connections for timeout.  Then
+// one probe connection is allowed; the breaker closes if it succeeds, and opens again if not.  A
+// nil breaker allows every connection.
+type breaker struct {
+	threshold int
+	timeout   time.Duration
+	now       func() time.Time
+
+	mu       sync.Mutex
+	state    breakerState
+	failures int       // Consecutive failures while closed.
+	opened   time.Time // When the breaker last opened.
+}
+
+// newBreaker creates a closed breaker, or returns nil if threshold is not positive.
+func newBreaker(threshold int, timeout time.Duration) *breaker {
+	if threshold <= 0 {
+		return nil
+	}
+	return &breaker{threshold: threshold, timeout: timeout, now: time.Now}
+}
+
+// allow returns true if a connection should be attempted, in which case its outcome must be
+// passed to done.
+func (b *breaker) allow() bool {
+	if b == nil {
+		return true
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	switch b.state {
+	case breakerOpen:
+		if b.now().Sub(b.opened) < b.timeout {
+			return false
+		}
+		b.state = breakerHalfOpen
+		return true
+	case breakerHalfOpen:
+		return false
+	}
+	return true
+}
+
+// done records the outcome of a connection allowed by allow, and returns the resulting state.
+func (b *breaker) done(ok bool) breakerState {
+	if b == nil {
+		return breakerClosed
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	switch {
+	case ok:
+		b.state = breakerClosed
+		b.failures = 0
+	case b.state == breakerHalfOpen:
+		b.state = breakerOpen
+		b.opened = b.now()
+	case b.state == breakerOpen:
+		// A connection started before the breaker opened.
+	default:
+		b.failures++
+		if b.failures >= b.threshold {
+			b.state = breakerOpen
+			b.opened = b.now()
+			b.failures = 0
+		}
+	}
+	return b.state
+}
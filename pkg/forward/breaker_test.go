@@ -0,0 +1,95 @@
+package forward
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/inbucket/inbucket/pkg/config"
+	"github.com/inbucket/inbucket/pkg/storage/mem"
+)
+
+func TestBreaker(t *testing.T) {
+	now := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	b := newBreaker(3, 30*time.Second)
+	b.now = func() time.Time { return now }
+	check := func(want breakerState, allow bool) {
+		t.Helper()
+		if b.state != want {
+			t.Errorf("Got state %v, want: %v", b.state, want)
+		}
+		if got := b.allow(); got != allow {
+			t.Errorf("Got allow %v in state %v, want: %v", got, want, allow)
+		}
+	}
+
+	// Closed: failures below the threshold, or broken by a success, leave it closed.
+	check(breakerClosed, true)
+	b.done(false)
+	check(breakerClosed, true)
+	b.done(false)
+	check(breakerClosed, true)
+	b.done(true)
+	for i := 0; i < 2; i++ {
+		check(breakerClosed, true)
+		b.done(false)
+	}
+	check(breakerClosed, true)
+	if got := b.done(false); got != breakerOpen {
+		t.Fatalf("Got state %v after threshold failures, want: %v", got, breakerOpen)
+	}
+
+	// Open: connections are skipped until the timeout passes.
+	check(breakerOpen, false)
+	now = now.Add(29 * time.Second)
+	check(breakerOpen, false)
+
+	// Half-open: a single probe is allowed, failure opens it again.
+	now = now.Add(time.Second)
+	check(breakerOpen, true)
+	check(breakerHalfOpen, false)
+	if got := b.done(false); got != breakerOpen {
+		t.Fatalf("Got state %v after failed probe, want: %v", got, breakerOpen)
+	}
+	check(breakerOpen, false)
+
+	// A successful probe closes it.
+	now = now.Add(30 * time.Second)
+	check(breakerOpen, true)
+	if got := b.done(true); got != breakerClosed {
+		t.Fatalf("Got state %v after successful probe, want: %v", got, breakerClosed)
+	}
+	check(breakerClosed, true)
+
+	// A nil breaker, from a zero threshold, allows everything.
+	b = newBreaker(0, time.Second)
+	if b != nil || !b.allow() || b.done(false) != breakerClosed {
+		t.Errorf("Got breaker %v for zero threshold, want: nil", b)
+	}
+}
+
+func TestForwardCircuitBreaker(t *testing.T) {
+	// Reserve a port, then close it so connections are refused.
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := ln.Addr().String()
+	_ = ln.Close()
+
+	store, _ := mem.New(config.Storage{})
+	hub := startForwarderConfig(t, store, config.Forwarding{
+		Rules:                   []config.ForwardingRule{{TargetSMTP: addr, TargetTo: "a@b.com"}},
+		Workers:                 1,
+		Timeout:                 5 * time.Second,
+		CircuitBreakerThreshold: 2,
+		CircuitBreakerTimeout:   time.Hour,
+	})
+	failed, skipped := expFailedTotal.Value(), expSkippedTotal.Value()
+	for i := 0; i < 4; i++ {
+		deliver(t, store, hub, "box", "subject")
+	}
+	waitCounter(t, func() bool {
+		return expFailedTotal.Value() == failed+2 && expSkippedTotal.Value() == skipped+2
+	})
+}
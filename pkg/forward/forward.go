@@ -0,0 +1,208 @@
+// Package forward relays copies of new messages matching the configured rules to other SMTP
+// servers.
+package forward
+
+import (
+	"context"
+	"errors"
+	"expvar"
+	"io"
+	"net"
+	"net/smtp"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/inbucket/inbucket/pkg/config"
+	"github.com/inbucket/inbucket/pkg/msghub"
+	"github.com/inbucket/inbucket/pkg/storage"
+	"github.com/rs/zerolog/log"
+)
+
+// Maximum number of messages waiting to be checked against the rules.
+const queueLen = 100
+
+// errCircuitOpen is returned by send when the circuit breaker of the target is open.
+var errCircuitOpen = errors.New("circuit breaker open")
+
+var (
+	expForwardedTotal = new(expvar.Int)
+	expFailedTotal    = new(expvar.Int)
+	expDroppedTotal   = new(expvar.Int)
+	expSkippedTotal   = new(expvar.Int)
+)
+
+func init() {
+	m := expvar.NewMap("forward")
+	m.Set("ForwardedTotal", expForwardedTotal)
+	m.Set("FailedTotal", expFailedTotal)
+	m.Set("DroppedTotal", expDroppedTotal)
+	m.Set("SkippedTotal", expSkippedTotal)
+}
+
+// Forwarder is a msghub.Listener that relays a copy of each new message matching a forwarding rule
+// to the target SMTP server of the rule.  Messages are read back from the store by a pool of
+// workers, so forwarding never delays delivery.
+type Forwarder struct {
+	conf   config.Forwarding
+	domain string // HELO domain.
+	store  storage.Store
+	queue  chan msghub.Message
+
+	breakers map[string]*breaker // Circuit breakers by target SMTP address.
+}
+
+// New creates a Forwarder for the provided configuration, domain is sent in the SMTP HELO.
+func New(conf config.Forwarding, domain string, store storage.Store) *Forwarder {
+	breakers := make(map[string]*breaker)
+	for _, rule := range conf.Rules {
+		if breakers[rule.TargetSMTP] == nil {
+			breakers[rule.TargetSMTP] = newBreaker(
+				conf.CircuitBreakerThreshold, conf.CircuitBreakerTimeout)
+		}
+	}
+	return &Forwarder{
+		conf:     conf,
+		domain:   domain,
+		store:    store,
+		queue:    make(chan msghub.Message, queueLen),
+		breakers: breakers,
+	}
+}
+
+// Start registers the Forwarder with the hub, then forwards messages until the context is canceled.
+func (f *Forwarder) Start(ctx context.Context, hub *msghub.Hub) {
+	log.Info().Str("phase", "startup").Str("module", "forward").Int("rules", len(f.conf.Rules)).
+		Msg("Message forwarding enabled")
+	hub.AddListener(f)
+	workers := f.conf.Workers
+	if workers < 1 {
+		workers = 1
+	}
+	for i := 0; i < workers; i++ {
+		go f.run(ctx)
+	}
+}
+
+// Receive queues a message to be checked against the rules, it will be dropped if the queue is
+// full.
+func (f *Forwarder) Receive(msg msghub.Message) error {
+	select {
+	case f.queue <- msg:
+	default:
+		expDroppedTotal.Add(1)
+		log.Warn().Str("module", "forward").Str("mailbox", msg.Mailbox).Str("id", msg.ID).
+			Msg("Forwarding queue full, dropped message")
+	}
+	return nil
+}
+
+// run forwards queued messages until the context is canceled.
+func (f *Forwarder) run(ctx context.Context) {
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case msg := <-f.queue:
+			f.forward(ctx, msg)
+		}
+	}
+}
+
+// forward relays the message to the target of each matching rule.
+func (f *Forwarder) forward(ctx context.Context, msg msghub.Message) {
+	slog := log.With().Str("module", "forward").Str("mailbox", msg.Mailbox).
+		Str("id", msg.ID).Logger()
+	for _, rule := range f.conf.Rules {
+		if !Match(rule, msg.Mailbox, msg.Subject) {
+			continue
+		}
+		if err := f.send(ctx, rule, msg); err != nil {
+			if err == errCircuitOpen {
+				expSkippedTotal.Add(1)
+				slog.Debug().Str("target", rule.TargetSMTP).
+					Msg("Target unavailable, skipped forwarding")
+				continue
+			}
+			expFailedTotal.Add(1)
+			slog.Warn().Str("target", rule.TargetSMTP).Err(err).Msg("Message forwarding failed")
+			continue
+		}
+		expForwardedTotal.Add(1)
+		slog.Debug().Str("target", rule.TargetSMTP).Str("to", rule.TargetTo).
+			Msg("Forwarded message")
+	}
+}
+
+// send relays a single copy of the message in a new SMTP session.
+func (f *Forwarder) send(ctx context.Context, rule config.ForwardingRule, msg msghub.Message) error {
+	sm, err := f.store.GetMessage(ctx, msg.Mailbox, msg.ID)
+	if err != nil {
+		return err
+	}
+	r, err := sm.Source()
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+	b := f.breakers[rule.TargetSMTP]
+	if !b.allow() {
+		return errCircuitOpen
+	}
+	dialer := &net.Dialer{Timeout: f.conf.Timeout}
+	conn, err := dialer.DialContext(ctx, "tcp", rule.TargetSMTP)
+	if b.done(err == nil) == breakerOpen {
+		log.Warn().Str("module", "forward").Str("target", rule.TargetSMTP).
+			Dur("timeout", f.conf.CircuitBreakerTimeout).
+			Msg("Forwarding target unavailable, circuit breaker open")
+	}
+	if err != nil {
+		return err
+	}
+	if f.conf.Timeout > 0 {
+		_ = conn.SetDeadline(time.Now().Add(f.conf.Timeout))
+	}
+	host, _, _ := net.SplitHostPort(rule.TargetSMTP)
+	c, err := smtp.NewClient(conn, host)
+	if err != nil {
+		_ = conn.Close()
+		return err
+	}
+	defer c.Close()
+	if err := c.Hello(f.domain); err != nil {
+		return err
+	}
+	// The original sender is kept, so bounces from the target are returned to them.
+	from := ""
+	if sm.From() != nil {
+		from = sm.From().Address
+	}
+	if err := c.Mail(from); err != nil {
+		return err
+	}
+	if err := c.Rcpt(rule.TargetTo); err != nil {
+		return err
+	}
+	w, err := c.Data()
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(w, r); err != nil {
+		_ = w.Close()
+		return err
+	}
+	if err := w.Close(); err != nil {
+		return err
+	}
+	return c.Quit()
+}
+
+// Match returns true if the mailbox and subject of a message are selected by rule.
+func Match(rule config.ForwardingRule, mailbox, subject string) bool {
+	if rule.MailboxGlob != "" {
+		if ok, _ := filepath.Match(rule.MailboxGlob, mailbox); !ok {
+			return false
+		}
+	}
+	return strings.Contains(strings.ToLower(subject), strings.ToLower(rule.SubjectContains))
+}
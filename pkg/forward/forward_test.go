@@ -0,0 +1,187 @@
+package forward
+
+import (
+	"context"
+	"io/ioutil"
+	"net"
+	"net/textproto"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/inbucket/inbucket/pkg/config"
+	"github.com/inbucket/inbucket/pkg/msghub"
+	"github.com/inbucket/inbucket/pkg/storage"
+	"github.com/inbucket/inbucket/pkg/storage/mem"
+	"github.com/inbucket/inbucket/pkg/test"
+)
+
+// envelope is a message received by the test SMTP server.
+type envelope struct {
+	from string
+	to   []string
+	data string
+}
+
+// setupServer starts an SMTP server which accepts every command, and records the messages it
+// receives.
+func setupServer(t *testing.T) (string, chan envelope) {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = ln.Close() })
+	received := make(chan envelope, 10)
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go serve(textproto.NewConn(conn), received)
+		}
+	}()
+	return ln.Addr().String(), received
+}
+
+// serve handles a single SMTP session.
+func serve(conn *textproto.Conn, received chan envelope) {
+	defer conn.Close()
+	_ = conn.PrintfLine("220 test ESMTP")
+	var env envelope
+	for {
+		line, err := conn.ReadLine()
+		if err != nil {
+			return
+		}
+		verb, arg := line, ""
+		if i := strings.IndexByte(line, ':'); i > 0 {
+			verb, arg = line[:i], strings.Trim(line[i+1:], "<>")
+		}
+		switch strings.ToUpper(strings.Fields(verb)[0]) {
+		case "MAIL":
+			env = envelope{from: arg}
+		case "RCPT":
+			env.to = append(env.to, arg)
+		case "DATA":
+			_ = conn.PrintfLine("354 Go ahead")
+			b, err := ioutil.ReadAll(conn.DotReader())
+			if err != nil {
+				return
+			}
+			env.data = string(b)
+			received <- env
+		case "QUIT":
+			_ = conn.PrintfLine("221 Bye")
+			return
+		}
+		_ = conn.PrintfLine("250 OK")
+	}
+}
+
+// startForwarder creates a Forwarder for the rules, and returns the hub it listens to.
+func startForwarder(t *testing.T, store storage.Store, rules ...config.ForwardingRule) *msghub.Hub {
+	t.Helper()
+	conf := config.Forwarding{Rules: rules, Workers: 2, Timeout: 5 * time.Second}
+	return startForwarderConfig(t, store, conf)
+}
+
+// startForwarderConfig creates a Forwarder for conf, and returns the hub it listens to.
+func startForwarderConfig(t *testing.T, store storage.Store, conf config.Forwarding) *msghub.Hub {
+	t.Helper()
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(cancel)
+	hub := msghub.New(ctx, 0)
+	New(conf, "inbucket.test", store).Start(ctx, hub)
+	hub.Sync()
+	return hub
+}
+
+// deliver adds a message to the store, and dispatches it to the hub.
+func deliver(t *testing.T, store storage.Store, hub *msghub.Hub, mailbox, subject string) {
+	t.Helper()
+	id, size := test.DeliverToStore(t, store, mailbox, subject, time.Now())
+	hub.Dispatch(msghub.Message{Mailbox: mailbox, ID: id, Subject: subject, Size: size})
+}
+
+func TestForward(t *testing.T) {
+	addr, received := setupServer(t)
+	store, _ := mem.New(config.Storage{})
+	hub := startForwarder(t, store, config.ForwardingRule{
+		MailboxGlob:     "alerts*",
+		SubjectContains: "urgent",
+		TargetSMTP:      addr,
+		TargetTo:        "oncall@example.com",
+	})
+	before := expForwardedTotal.Value()
+	deliver(t, store, hub, "alerts-db", "URGENT: disk full")
+
+	var env envelope
+	select {
+	case env = <-received:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Timeout waiting for forwarded message")
+	}
+	if env.from != "somebodyelse@host" {
+		t.Errorf("got MAIL FROM %q, want: %q", env.from, "somebodyelse@host")
+	}
+	if len(env.to) != 1 || env.to[0] != "oncall@example.com" {
+		t.Errorf("got RCPT TO %q, want: [oncall@example.com]", env.to)
+	}
+	if !strings.Contains(env.data, "Subject: URGENT: disk full") {
+		t.Errorf("got data %q, want original message", env.data)
+	}
+	waitCounter(t, func() bool { return expForwardedTotal.Value() == before+1 })
+}
+
+func TestForwardFailure(t *testing.T) {
+	// Reserve a port, then close it so connections are refused.
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := ln.Addr().String()
+	_ = ln.Close()
+
+	store, _ := mem.New(config.Storage{})
+	hub := startForwarder(t, store, config.ForwardingRule{TargetSMTP: addr, TargetTo: "a@b.com"})
+	before := expFailedTotal.Value()
+	deliver(t, store, hub, "box", "subject")
+	waitCounter(t, func() bool { return expFailedTotal.Value() == before+1 })
+}
+
+func TestMatch(t *testing.T) {
+	testCases := []struct {
+		glob, contains   string
+		mailbox, subject string
+		want             bool
+	}{
+		{"", "", "any", "thing", true},
+		{"alerts*", "", "alerts-db", "", true},
+		{"alerts*", "", "ops", "", false},
+		{"", "urgent", "any", "Very URGENT news", true},
+		{"", "urgent", "any", "Routine news", false},
+		{"ops", "urgent", "ops", "urgent", true},
+		{"ops", "urgent", "dev", "urgent", false},
+	}
+	for _, tc := range testCases {
+		rule := config.ForwardingRule{MailboxGlob: tc.glob, SubjectContains: tc.contains}
+		if got := Match(rule, tc.mailbox, tc.subject); got != tc.want {
+			t.Errorf("Match(%q, %q, %q, %q) got %v, want: %v",
+				tc.glob, tc.contains, tc.mailbox, tc.subject, got, tc.want)
+		}
+	}
+}
+
+// waitCounter waits for cond to become true, or fails the test.
+func waitCounter(t *testing.T, cond func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatal("Timeout waiting for counter")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
@@ -0,0 +1,80 @@
+// Package graphql implements the Inbucket GraphQL API, which allows clients to query only the
+// message fields they need.
+package graphql
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+
+	gql "github.com/graph-gophers/graphql-go"
+	"github.com/inbucket/inbucket/pkg/policy"
+	"github.com/inbucket/inbucket/pkg/storage"
+	"github.com/rs/zerolog/log"
+)
+
+// maxRequestBytes limits the size of POSTed queries.
+const maxRequestBytes = 1 << 20
+
+// readOnlyKey marks the context of requests which may not run mutations.
+type readOnlyKey struct{}
+
+// request holds the parameters of a GraphQL request.
+type request struct {
+	Query         string                 `json:"query"`
+	OperationName string                 `json:"operationName"`
+	Variables     map[string]interface{} `json:"variables"`
+}
+
+// Handler serves GraphQL requests, as GET query parameters or a POSTed JSON body.  Mutations
+// are only allowed in POST requests, so they can not be triggered by a link.
+type Handler struct {
+	schema *gql.Schema
+}
+
+// NewHandler creates a Handler resolving queries against store.
+func NewHandler(store storage.Store, addrPolicy *policy.Addressing) *Handler {
+	return &Handler{
+		schema: gql.MustParseSchema(schema, &Resolver{store: store, addrPolicy: addrPolicy}),
+	}
+}
+
+// ServeHTTP implements http.Handler.
+func (h *Handler) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	var params request
+	ctx := req.Context()
+	switch req.Method {
+	case http.MethodGet:
+		q := req.URL.Query()
+		params.Query = q.Get("query")
+		params.OperationName = q.Get("operationName")
+		if v := q.Get("variables"); v != "" {
+			if err := json.Unmarshal([]byte(v), &params.Variables); err != nil {
+				http.Error(w, "Invalid variables: "+err.Error(), http.StatusBadRequest)
+				return
+			}
+		}
+		ctx = context.WithValue(ctx, readOnlyKey{}, true)
+	case http.MethodPost:
+		body := http.MaxBytesReader(w, req.Body, maxRequestBytes)
+		if err := json.NewDecoder(body).Decode(&params); err != nil {
+			http.Error(w, "Invalid request: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+	default:
+		w.Header().Set("Allow", "GET, POST")
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if params.Query == "" {
+		http.Error(w, "Missing query", http.StatusBadRequest)
+		return
+	}
+
+	resp := h.schema.Exec(ctx, params.Query, params.OperationName, params.Variables)
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	w.Header().Set("Expires", "-1")
+	if err := json.NewEncoder(w).Encode(resp); err != nil {
+		log.Debug().Str("module", "graphql").Err(err).Msg("Failed to write response")
+	}
+}
@@ -0,0 +1,218 @@
+package graphql
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/graph-gophers/graphql-go/gqltesting"
+	"github.com/inbucket/inbucket/pkg/config"
+	"github.com/inbucket/inbucket/pkg/policy"
+	"github.com/inbucket/inbucket/pkg/storage"
+	"github.com/inbucket/inbucket/pkg/storage/mem"
+	"github.com/inbucket/inbucket/pkg/test"
+)
+
+var testDate = time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC)
+
+// sourceCounter is a store which counts the calls to Source of the messages it returns.
+type sourceCounter struct {
+	storage.Store
+	reads int
+}
+
+func (s *sourceCounter) GetMessage(ctx context.Context, mailbox, id string) (storage.Message, error) {
+	m, err := s.Store.GetMessage(ctx, mailbox, id)
+	if m == nil || err != nil {
+		return m, err
+	}
+	return &countedMessage{m, &s.reads}, nil
+}
+
+func (s *sourceCounter) GetMessages(ctx context.Context, mailbox string) ([]storage.Message, error) {
+	messages, err := s.Store.GetMessages(ctx, mailbox)
+	for i, m := range messages {
+		messages[i] = &countedMessage{m, &s.reads}
+	}
+	return messages, err
+}
+
+type countedMessage struct {
+	storage.Message
+	reads *int
+}
+
+func (m *countedMessage) Source() (io.ReadCloser, error) {
+	*m.reads++
+	return m.Message.Source()
+}
+
+// setupHandler returns a Handler serving a memory store holding two messages in mailbox "box",
+// and one in "other".
+func setupHandler(t *testing.T) (*Handler, *sourceCounter, []string, int64) {
+	t.Helper()
+	ms, err := mem.New(config.Storage{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var ids []string
+	var size int64
+	for i, mailbox := range []string{"box", "box", "other"} {
+		var id string
+		id, size = test.DeliverToStore(t, ms, mailbox, fmt.Sprintf("subject %v", i), testDate)
+		ids = append(ids, id)
+	}
+	store := &sourceCounter{Store: ms}
+	addrPolicy := &policy.Addressing{Config: &config.Root{MailboxNaming: config.LocalNaming}}
+	return NewHandler(store, addrPolicy), store, ids, size
+}
+
+func TestQueries(t *testing.T) {
+	h, store, ids, size := setupHandler(t)
+	gqltesting.RunTests(t, []*gqltesting.Test{
+		{
+			Schema:         h.schema,
+			Query:          fmt.Sprintf(`{ message(mailbox: "box@example.com", id: %q) { id subject } }`, ids[0]),
+			ExpectedResult: fmt.Sprintf(`{"message": {"id": %q, "subject": "subject 0"}}`, ids[0]),
+		},
+		{
+			Schema:         h.schema,
+			Query:          `{ message(mailbox: "box", id: "nope") { id } }`,
+			ExpectedResult: `{"message": null}`,
+		},
+		{
+			Schema: h.schema,
+			Query: `query Box($name: String!) {
+				messages(mailbox: $name) { mailbox from to date size seen tags attachmentCount }
+			}`,
+			Variables: map[string]interface{}{"name": "box"},
+			ExpectedResult: fmt.Sprintf(`{"messages": [
+				{"mailbox": "box", "from": "Some B. Else <somebodyelse@host>",
+					"to": ["Some Body <somebody@host>"], "date": "2024-01-02T03:04:05Z",
+					"size": %[1]v, "seen": false, "tags": [], "attachmentCount": 0},
+				{"mailbox": "box", "from": "Some B. Else <somebodyelse@host>",
+					"to": ["Some Body <somebody@host>"], "date": "2024-01-02T03:04:05Z",
+					"size": %[1]v, "seen": false, "tags": [], "attachmentCount": 0}
+			]}`, size),
+		},
+		{
+			Schema: h.schema,
+			Query:  `{ mailboxes { name messageCount messages { subject } } }`,
+			ExpectedResult: `{"mailboxes": [
+				{"name": "box", "messageCount": 2,
+					"messages": [{"subject": "subject 0"}, {"subject": "subject 1"}]},
+				{"name": "other", "messageCount": 1, "messages": [{"subject": "subject 2"}]}
+			]}`,
+		},
+		{
+			Schema: h.schema,
+			Query:  `{ latestMessages { mailbox subject } }`,
+			ExpectedResult: `{"latestMessages": [
+				{"mailbox": "box", "subject": "subject 1"},
+				{"mailbox": "other", "subject": "subject 2"}
+			]}`,
+		},
+	})
+	if store.reads != 0 {
+		t.Errorf("got %v source reads without rawSize, want: 0", store.reads)
+	}
+
+	gqltesting.RunTest(t, &gqltesting.Test{
+		Schema:         h.schema,
+		Query:          `{ messages(mailbox: "box") { rawSize } }`,
+		ExpectedResult: fmt.Sprintf(`{"messages": [{"rawSize": %[1]v}, {"rawSize": %[1]v}]}`, size),
+	})
+	if store.reads != 2 {
+		t.Errorf("got %v source reads for rawSize, want: 2", store.reads)
+	}
+}
+
+func TestMutations(t *testing.T) {
+	h, store, ids, _ := setupHandler(t)
+	gqltesting.RunTests(t, []*gqltesting.Test{
+		{
+			Schema:         h.schema,
+			Query:          fmt.Sprintf(`mutation { deleteMessage(mailbox: "box", id: %q) }`, ids[0]),
+			ExpectedResult: `{"deleteMessage": true}`,
+		},
+		{
+			Schema:         h.schema,
+			Query:          fmt.Sprintf(`mutation { deleteMessage(mailbox: "box", id: %q) }`, ids[0]),
+			ExpectedResult: `{"deleteMessage": false}`,
+		},
+		{
+			Schema:         h.schema,
+			Query:          `mutation { purgeMailbox(mailbox: "other") }`,
+			ExpectedResult: `{"purgeMailbox": 1}`,
+		},
+	})
+	test.GetAndCountMessages(t, store, "box", 1)
+	test.GetAndCountMessages(t, store, "other", 0)
+}
+
+func TestHandler(t *testing.T) {
+	h, store, ids, _ := setupHandler(t)
+	serve := func(req *http.Request) (int, map[string]interface{}) {
+		t.Helper()
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, req)
+		var result map[string]interface{}
+		if w.Code == http.StatusOK {
+			if err := json.Unmarshal(w.Body.Bytes(), &result); err != nil {
+				t.Fatalf("failed to decode %q: %v", w.Body, err)
+			}
+		}
+		return w.Code, result
+	}
+
+	// GET query.
+	q := url.Values{
+		"query":     {`query Subject($id: String!) { message(mailbox: "box", id: $id) { subject } }`},
+		"variables": {fmt.Sprintf(`{"id": %q}`, ids[1])},
+	}
+	code, result := serve(httptest.NewRequest("GET", "/graphql?"+q.Encode(), nil))
+	if code != http.StatusOK {
+		t.Fatalf("GET got status %v, want: %v", code, http.StatusOK)
+	}
+	if got := fmt.Sprint(result["data"]); got != "map[message:map[subject:subject 1]]" {
+		t.Errorf("GET got data %v", got)
+	}
+
+	// Mutations are refused over GET.
+	q = url.Values{"query": {`mutation { purgeMailbox(mailbox: "box") }`}}
+	_, result = serve(httptest.NewRequest("GET", "/graphql?"+q.Encode(), nil))
+	if result["errors"] == nil {
+		t.Errorf("GET mutation got no errors, want: %q", errReadOnly)
+	}
+	test.GetAndCountMessages(t, store, "box", 2)
+
+	// POST mutation.
+	body := `{"query": "mutation Purge($name: String!) { purgeMailbox(mailbox: $name) }",
+		"variables": {"name": "box"}}`
+	code, result = serve(httptest.NewRequest("POST", "/graphql", strings.NewReader(body)))
+	if code != http.StatusOK {
+		t.Fatalf("POST got status %v, want: %v", code, http.StatusOK)
+	}
+	if got := fmt.Sprint(result["data"]); got != "map[purgeMailbox:2]" {
+		t.Errorf("POST got data %v", got)
+	}
+	test.GetAndCountMessages(t, store, "box", 0)
+
+	// Bad requests.
+	if code, _ := serve(httptest.NewRequest("POST", "/graphql", strings.NewReader("{"))); code != 400 {
+		t.Errorf("invalid JSON got status %v, want: 400", code)
+	}
+	if code, _ := serve(httptest.NewRequest("GET", "/graphql", nil)); code != 400 {
+		t.Errorf("missing query got status %v, want: 400", code)
+	}
+	if code, _ := serve(httptest.NewRequest("PUT", "/graphql", nil)); code != 405 {
+		t.Errorf("PUT got status %v, want: 405", code)
+	}
+}
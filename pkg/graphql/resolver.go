@@ -0,0 +1,219 @@
+package graphql
+
+import (
+	"context"
+	"errors"
+	"io"
+	"io/ioutil"
+	"sort"
+
+	gql "github.com/graph-gophers/graphql-go"
+	"github.com/inbucket/inbucket/pkg/policy"
+	"github.com/inbucket/inbucket/pkg/storage"
+	"github.com/inbucket/inbucket/pkg/stringutil"
+)
+
+// errReadOnly is returned by mutations in requests which only allow queries.
+var errReadOnly = errors.New("mutations must be sent in a POST request")
+
+// Resolver resolves the Query and Mutation fields of the schema.
+type Resolver struct {
+	store      storage.Store
+	addrPolicy *policy.Addressing
+}
+
+// Message resolves the message query.
+func (r *Resolver) Message(
+	ctx context.Context, args struct{ Mailbox, ID string }) (*messageResolver, error) {
+	name, err := r.addrPolicy.ExtractMailbox(args.Mailbox)
+	if err != nil {
+		return nil, err
+	}
+	m, err := r.store.GetMessage(ctx, name, args.ID)
+	if err == storage.ErrNotExist || m == nil {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &messageResolver{m}, nil
+}
+
+// Messages resolves the messages query.
+func (r *Resolver) Messages(
+	ctx context.Context, args struct{ Mailbox string }) ([]*messageResolver, error) {
+	name, err := r.addrPolicy.ExtractMailbox(args.Mailbox)
+	if err != nil {
+		return nil, err
+	}
+	messages, err := r.store.GetMessages(ctx, name)
+	if err != nil {
+		return nil, err
+	}
+	return makeMessages(messages), nil
+}
+
+// Mailboxes resolves the mailboxes query, ordered by name.
+func (r *Resolver) Mailboxes(ctx context.Context) ([]*mailboxResolver, error) {
+	mailboxes := make([]*mailboxResolver, 0)
+	err := r.store.VisitMailboxes(ctx, func(messages []storage.Message) bool {
+		if len(messages) > 0 {
+			mailboxes = append(mailboxes, &mailboxResolver{messages})
+		}
+		return true
+	})
+	sort.Slice(mailboxes, func(i, j int) bool {
+		return mailboxes[i].Name() < mailboxes[j].Name()
+	})
+	return mailboxes, err
+}
+
+// LatestMessages resolves the latestMessages query, newest first, without loading the earlier
+// messages of each mailbox where the store supports it.
+func (r *Resolver) LatestMessages(ctx context.Context) ([]*messageResolver, error) {
+	var messages []storage.Message
+	err := storage.VisitLatestMessages(ctx, r.store, func(latest storage.Message) bool {
+		messages = append(messages, latest)
+		return true
+	})
+	sort.Slice(messages, func(i, j int) bool {
+		if !messages[i].Date().Equal(messages[j].Date()) {
+			return messages[i].Date().After(messages[j].Date())
+		}
+		return messages[i].Mailbox() < messages[j].Mailbox()
+	})
+	return makeMessages(messages), err
+}
+
+// DeleteMessage resolves the deleteMessage mutation.
+func (r *Resolver) DeleteMessage(ctx context.Context, args struct{ Mailbox, ID string }) (bool, error) {
+	if ctx.Value(readOnlyKey{}) != nil {
+		return false, errReadOnly
+	}
+	name, err := r.addrPolicy.ExtractMailbox(args.Mailbox)
+	if err != nil {
+		return false, err
+	}
+	// Not every store reports removing a missing message as an error.
+	m, err := r.store.GetMessage(ctx, name, args.ID)
+	if err == storage.ErrNotExist || (err == nil && m == nil) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	err = r.store.RemoveMessage(ctx, name, m.ID())
+	if err == storage.ErrNotExist {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+// PurgeMailbox resolves the purgeMailbox mutation.
+func (r *Resolver) PurgeMailbox(ctx context.Context, args struct{ Mailbox string }) (int32, error) {
+	if ctx.Value(readOnlyKey{}) != nil {
+		return 0, errReadOnly
+	}
+	name, err := r.addrPolicy.ExtractMailbox(args.Mailbox)
+	if err != nil {
+		return 0, err
+	}
+	messages, err := r.store.GetMessages(ctx, name)
+	if err != nil {
+		return 0, err
+	}
+	if err := r.store.PurgeMessages(ctx, name); err != nil {
+		return 0, err
+	}
+	return int32(len(messages)), nil
+}
+
+// mailboxResolver resolves the fields of a Mailbox.
+type mailboxResolver struct {
+	messages []storage.Message
+}
+
+func (m *mailboxResolver) Name() string                 { return m.messages[0].Mailbox() }
+func (m *mailboxResolver) MessageCount() int32          { return int32(len(m.messages)) }
+func (m *mailboxResolver) Messages() []*messageResolver { return makeMessages(m.messages) }
+
+// messageResolver resolves the fields of a Message.
+type messageResolver struct {
+	m storage.Message
+}
+
+func (m *messageResolver) Mailbox() string    { return m.m.Mailbox() }
+func (m *messageResolver) ID() string         { return m.m.ID() }
+func (m *messageResolver) From() string       { return stringutil.StringAddress(m.m.From()) }
+func (m *messageResolver) To() []string       { return stringutil.StringAddressList(m.m.To()) }
+func (m *messageResolver) Subject() string    { return m.m.Subject() }
+func (m *messageResolver) Date() gql.Time     { return gql.Time{Time: m.m.Date()} }
+func (m *messageResolver) Size() int32        { return int32(m.m.Size()) }
+func (m *messageResolver) Seen() bool         { return m.m.Seen() }
+func (m *messageResolver) EnvelopeID() string { return m.m.EnvelopeID() }
+func (m *messageResolver) SPFResult() string  { return m.m.SPFResult() }
+
+// Tags returns the tags of the message, never nil.
+func (m *messageResolver) Tags() []string {
+	if tags := m.m.Tags(); tags != nil {
+		return tags
+	}
+	return []string{}
+}
+
+// RawSize reads the message source to measure it, so it is only resolved when requested.
+func (m *messageResolver) RawSize() (int32, error) {
+	r, err := m.m.Source()
+	if err != nil {
+		return 0, err
+	}
+	defer r.Close()
+	n, err := io.Copy(ioutil.Discard, r)
+	return int32(n), err
+}
+
+// DKIMResult returns the DKIM verification result, empty if the message has not been verified.
+func (m *messageResolver) DKIMResult() string {
+	if dm, ok := m.m.(storage.DKIMMessage); ok {
+		result, _ := dm.DKIM()
+		return result.String()
+	}
+	return ""
+}
+
+// DKIMDomain returns the DKIM signing domain, empty if the store does not record it.
+func (m *messageResolver) DKIMDomain() string {
+	if dm, ok := m.m.(storage.DKIMMessage); ok {
+		_, domain := dm.DKIM()
+		return domain
+	}
+	return ""
+}
+
+// AttachmentCount returns the number of attachments, 0 if the store does not record it.
+func (m *messageResolver) AttachmentCount() int32 {
+	if am, ok := m.m.(storage.AttachmentMessage); ok {
+		count, _ := am.Attachments()
+		return int32(count)
+	}
+	return 0
+}
+
+// AttachmentBytes returns the decoded size of the attachments, 0 if the store does not record
+// it.
+func (m *messageResolver) AttachmentBytes() int32 {
+	if am, ok := m.m.(storage.AttachmentMessage); ok {
+		_, size := am.Attachments()
+		return int32(size)
+	}
+	return 0
+}
+
+// makeMessages wraps messages in resolvers.
+func makeMessages(messages []storage.Message) []*messageResolver {
+	resolvers := make([]*messageResolver, len(messages))
+	for i, m := range messages {
+		resolvers[i] = &messageResolver{m}
+	}
+	return resolvers
+}
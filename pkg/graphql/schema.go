@@ -0,0 +1,56 @@
+package graphql
+
+// schema is the GraphQL schema served by Handler.
+const schema = `
+schema {
+	query: Query
+	mutation: Mutation
+}
+
+scalar Time
+
+type Query {
+	# message returns the specified message, or null if it does not exist.
+	message(mailbox: String!, id: String!): Message
+	# messages returns the messages in a mailbox, oldest first.
+	messages(mailbox: String!): [Message!]!
+	# mailboxes returns every mailbox containing messages.
+	mailboxes: [Mailbox!]!
+	# latestMessages returns the latest message of each mailbox, newest first.
+	latestMessages: [Message!]!
+}
+
+type Mutation {
+	# deleteMessage removes a message, returning false if it did not exist.
+	deleteMessage(mailbox: String!, id: String!): Boolean!
+	# purgeMailbox removes all messages from a mailbox, returning the number removed.
+	purgeMailbox(mailbox: String!): Int!
+}
+
+type Mailbox {
+	name: String!
+	messageCount: Int!
+	messages: [Message!]!
+}
+
+type Message {
+	mailbox: String!
+	id: String!
+	from: String!
+	to: [String!]!
+	subject: String!
+	date: Time!
+	# size is the size of the message recorded when it was stored.
+	size: Int!
+	# rawSize is the size of the stored message source, which must be read to measure it.
+	rawSize: Int!
+	seen: Boolean!
+	tags: [String!]!
+	envelopeId: String!
+	spfResult: String!
+	dkimResult: String!
+	dkimDomain: String!
+	attachmentCount: Int!
+	attachmentBytes: Int!
+}
+`
@@ -0,0 +1,139 @@
+// Package health reports the health of the message store, for use by liveness and readiness
+// probes.
+package health
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"sync/atomic"
+	"time"
+
+	"github.com/inbucket/inbucket/pkg/storage"
+	"github.com/rs/zerolog/log"
+)
+
+const (
+	// Status values.
+	statusOK          = "ok"
+	statusUnavailable = "unavailable"
+
+	// Interval between counts of the messages in the store.
+	countInterval = 30 * time.Second
+)
+
+// Status is the JSON health report.
+type Status struct {
+	Status        string `json:"status"`
+	StoreWritable bool   `json:"storeWritable"`
+	DiskFreeBytes uint64 `json:"diskFreeBytes"`
+	MessageCount  int64  `json:"messageCount"`
+}
+
+// Checker checks the health of a store, and serves the result over HTTP.
+type Checker struct {
+	store    storage.Store
+	path     string                            // Directory holding messages, empty if not on disk.
+	writable func(path string) error           // Returns an error if path is not writable.
+	diskFree func(path string) (uint64, error) // Returns the bytes available under path.
+	count    int64                             // Cached message count, accessed atomically.
+}
+
+// New creates a Checker for the store.  Store writability and disk space are only checked for
+// stores implementing storage.PathStore.
+func New(store storage.Store) *Checker {
+	c := &Checker{
+		store:    store,
+		writable: checkWritable,
+		diskFree: diskFree,
+	}
+	if ps, ok := store.(storage.PathStore); ok {
+		c.path = ps.MailPath()
+	}
+	return c
+}
+
+// Start counts the messages in the store, and continues to update the count every
+// countInterval until the context is done.
+func (c *Checker) Start(ctx context.Context) {
+	go func() {
+		ticker := time.NewTicker(countInterval)
+		defer ticker.Stop()
+		for {
+			c.updateCount(ctx)
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+			}
+		}
+	}()
+}
+
+// updateCount visits every mailbox to update the cached message count.
+func (c *Checker) updateCount(ctx context.Context) {
+	var count int64
+	err := c.store.VisitMailboxes(ctx, func(messages []storage.Message) bool {
+		count += int64(len(messages))
+		return true
+	})
+	if err != nil {
+		log.Warn().Str("module", "health").Err(err).Msg("Failed to count messages")
+		return
+	}
+	atomic.StoreInt64(&c.count, count)
+}
+
+// Check returns the current health of the store.
+func (c *Checker) Check() *Status {
+	s := &Status{
+		Status:        statusOK,
+		StoreWritable: true,
+		MessageCount:  atomic.LoadInt64(&c.count),
+	}
+	if c.path == "" {
+		return s
+	}
+	if err := c.writable(c.path); err != nil {
+		log.Warn().Str("module", "health").Str("path", c.path).Err(err).
+			Msg("Store is not writable")
+		s.Status = statusUnavailable
+		s.StoreWritable = false
+	}
+	free, err := c.diskFree(c.path)
+	if err != nil {
+		log.Warn().Str("module", "health").Str("path", c.path).Err(err).
+			Msg("Failed to get free disk space")
+	}
+	s.DiskFreeBytes = free
+	return s
+}
+
+// ServeHTTP responds with the JSON health report, the status code is 503 if the store is not
+// writable.
+func (c *Checker) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	s := c.Check()
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-cache")
+	if !s.StoreWritable {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}
+	if err := json.NewEncoder(w).Encode(s); err != nil {
+		log.Debug().Str("module", "health").Err(err).Msg("Failed to write health report")
+	}
+}
+
+// checkWritable creates and removes a temporary file in path.
+func checkWritable(path string) error {
+	f, err := ioutil.TempFile(path, ".healthz-")
+	if err != nil {
+		return err
+	}
+	cerr := f.Close()
+	if err := os.Remove(f.Name()); err != nil {
+		return err
+	}
+	return cerr
+}
@@ -0,0 +1,110 @@
+package health
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/inbucket/inbucket/pkg/config"
+	"github.com/inbucket/inbucket/pkg/storage/file"
+	"github.com/inbucket/inbucket/pkg/storage/mem"
+	"github.com/inbucket/inbucket/pkg/test"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestHealthOK(t *testing.T) {
+	store, _ := mem.New(config.Storage{})
+	test.DeliverToStore(t, store, "box1", "subject", time.Now())
+	test.DeliverToStore(t, store, "box1", "subject", time.Now())
+	test.DeliverToStore(t, store, "box2", "subject", time.Now())
+	c := New(store)
+	c.path = "/mail"
+	c.writable = func(path string) error {
+		assert.Equal(t, "/mail", path)
+		return nil
+	}
+	c.diskFree = func(path string) (uint64, error) { return 1234, nil }
+	c.updateCount(context.Background())
+
+	w := httptest.NewRecorder()
+	c.ServeHTTP(w, httptest.NewRequest("GET", "/healthz", nil))
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, "application/json", w.Header().Get("Content-Type"))
+	var got map[string]interface{}
+	if err := json.Unmarshal(w.Body.Bytes(), &got); err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]interface{}{
+		"status":        "ok",
+		"storeWritable": true,
+		"diskFreeBytes": 1234.0,
+		"messageCount":  3.0,
+	}
+	assert.Equal(t, want, got)
+}
+
+func TestHealthNotWritable(t *testing.T) {
+	store, _ := mem.New(config.Storage{})
+	c := New(store)
+	c.path = "/mail"
+	c.writable = func(path string) error { return errors.New("read-only file system") }
+	c.diskFree = func(path string) (uint64, error) { return 0, errors.New("no disk") }
+
+	w := httptest.NewRecorder()
+	c.ServeHTTP(w, httptest.NewRequest("GET", "/healthz", nil))
+	assert.Equal(t, http.StatusServiceUnavailable, w.Code)
+	var got Status
+	if err := json.Unmarshal(w.Body.Bytes(), &got); err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, Status{Status: "unavailable"}, got)
+}
+
+func TestHealthNoPath(t *testing.T) {
+	store, _ := mem.New(config.Storage{})
+	c := New(store)
+	c.writable = func(path string) error {
+		t.Error("writable called for store without a path")
+		return nil
+	}
+	s := c.Check()
+	assert.Equal(t, &Status{Status: "ok", StoreWritable: true}, s)
+}
+
+func TestHealthFileStore(t *testing.T) {
+	path, err := ioutil.TempDir("", "inbucket")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(path)
+	store, err := file.New(config.Storage{Params: map[string]string{"path": path}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	test.DeliverToStore(t, store, "box", "subject", time.Now())
+	c := New(store)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	c.Start(ctx)
+	deadline := time.Now().Add(5 * time.Second)
+	for c.Check().MessageCount != 1 && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	s := c.Check()
+	assert.Equal(t, statusOK, s.Status)
+	assert.True(t, s.StoreWritable)
+	assert.Equal(t, int64(1), s.MessageCount)
+	assert.NotZero(t, s.DiskFreeBytes)
+	files, err := ioutil.ReadDir(store.(*file.Store).MailPath())
+	assert.Nil(t, err)
+	for _, f := range files {
+		assert.True(t, f.IsDir(), "temporary file %v was not removed", f.Name())
+	}
+}
@@ -0,0 +1,217 @@
+package message
+
+import (
+	"archive/tar"
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/mail"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/inbucket/inbucket/pkg/storage"
+	"github.com/rs/zerolog/log"
+)
+
+// Backup archives contain a directory for each mailbox, holding the mailbox index followed by the
+// raw message files.
+const (
+	backupIndexName = "index.jsonl"
+	backupRawExt    = ".raw"
+)
+
+// backupIndexEntry is a line of a mailbox index in a backup archive.
+type backupIndexEntry struct {
+	ID      string    `json:"id"`
+	Date    time.Time `json:"date"`
+	Subject string    `json:"subject"`
+	Size    int64     `json:"size"`
+	Seen    bool      `json:"seen"`
+	EnvID   string    `json:"envid,omitempty"`
+	SPF     string    `json:"spf,omitempty"`
+	Tags    []string  `json:"tags,omitempty"`
+}
+
+// BackupError indicates a backup archive could not be read.
+type BackupError struct {
+	Err error
+}
+
+func (e *BackupError) Error() string {
+	return "invalid backup archive: " + e.Err.Error()
+}
+
+// Backup writes a gzipped tar archive of every message in the store to w.  If the store is a
+// storage.Freezer, changes are blocked until the backup is complete.
+func (s *StoreManager) Backup(ctx context.Context, w io.Writer) error {
+	if f, ok := s.Store.(storage.Freezer); ok {
+		thaw := f.Freeze()
+		defer thaw()
+	}
+	gz := gzip.NewWriter(w)
+	tw := tar.NewWriter(gz)
+	var werr error
+	err := s.Store.VisitMailboxes(ctx, func(messages []storage.Message) bool {
+		werr = backupMailbox(tw, messages)
+		return werr == nil
+	})
+	if err != nil {
+		return err
+	}
+	if werr != nil {
+		return werr
+	}
+	if err := tw.Close(); err != nil {
+		return err
+	}
+	return gz.Close()
+}
+
+// backupMailbox writes the index and raw message files of a mailbox to tw.
+func backupMailbox(tw *tar.Writer, messages []storage.Message) error {
+	if len(messages) == 0 {
+		return nil
+	}
+	mailbox := messages[0].Mailbox()
+	index := &bytes.Buffer{}
+	enc := json.NewEncoder(index)
+	for _, m := range messages {
+		err := enc.Encode(&backupIndexEntry{
+			ID:      m.ID(),
+			Date:    m.Date(),
+			Subject: m.Subject(),
+			Size:    m.Size(),
+			Seen:    m.Seen(),
+			EnvID:   m.EnvelopeID(),
+			SPF:     m.SPFResult(),
+			Tags:    m.Tags(),
+		})
+		if err != nil {
+			return err
+		}
+	}
+	if err := writeTarFile(tw, path.Join(mailbox, backupIndexName), index.Bytes(),
+		time.Now()); err != nil {
+		return err
+	}
+	for _, m := range messages {
+		r, err := m.Source()
+		if err != nil {
+			return fmt.Errorf("failed to read message %v/%v: %v", mailbox, m.ID(), err)
+		}
+		raw, err := ioutil.ReadAll(r)
+		_ = r.Close()
+		if err != nil {
+			return fmt.Errorf("failed to read message %v/%v: %v", mailbox, m.ID(), err)
+		}
+		name := path.Join(mailbox, m.ID()+backupRawExt)
+		if err := writeTarFile(tw, name, raw, m.Date()); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// writeTarFile adds a regular file to the archive.
+func writeTarFile(tw *tar.Writer, name string, content []byte, modTime time.Time) error {
+	err := tw.WriteHeader(&tar.Header{
+		Typeflag: tar.TypeReg,
+		Name:     name,
+		Mode:     0640,
+		Size:     int64(len(content)),
+		ModTime:  modTime,
+	})
+	if err != nil {
+		return err
+	}
+	_, err = tw.Write(content)
+	return err
+}
+
+// Restore imports every message in a gzipped tar archive written by Backup, returning the number
+// of messages imported.  Messages are added to the mailboxes they were backed up from, and
+// receive new IDs.
+func (s *StoreManager) Restore(ctx context.Context, r io.Reader) (count int, err error) {
+	gz, err := gzip.NewReader(bufio.NewReader(r))
+	if err != nil {
+		return 0, &BackupError{err}
+	}
+	defer gz.Close()
+	tr := tar.NewReader(gz)
+	// Index entries of the messages in the current mailbox.
+	index := make(map[string]*backupIndexEntry)
+	indexMailbox := ""
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			return count, nil
+		}
+		if err != nil {
+			return count, &BackupError{err}
+		}
+		if hdr.Typeflag != tar.TypeReg {
+			continue
+		}
+		mailbox, file := path.Split(hdr.Name)
+		mailbox = strings.TrimSuffix(mailbox, "/")
+		if mailbox == "" || strings.Contains(mailbox, "/") {
+			log.Warn().Str("module", "message").Str("name", hdr.Name).
+				Msg("Ignoring unexpected file in backup")
+			continue
+		}
+		content, err := ioutil.ReadAll(tr)
+		if err != nil {
+			return count, &BackupError{err}
+		}
+		if file == backupIndexName {
+			indexMailbox = mailbox
+			index = make(map[string]*backupIndexEntry)
+			dec := json.NewDecoder(bytes.NewReader(content))
+			for dec.More() {
+				entry := &backupIndexEntry{}
+				if err := dec.Decode(entry); err != nil {
+					return count, &BackupError{fmt.Errorf("index for mailbox %v: %v", mailbox, err)}
+				}
+				index[entry.ID] = entry
+			}
+			continue
+		}
+		if !strings.HasSuffix(file, backupRawExt) {
+			log.Warn().Str("module", "message").Str("name", hdr.Name).
+				Msg("Ignoring unexpected file in backup")
+			continue
+		}
+		msg, err := mail.ReadMessage(bytes.NewReader(content))
+		if err != nil {
+			return count, &BackupError{fmt.Errorf("message %v: %v", hdr.Name, err)}
+		}
+		delivery := importDelivery(mailbox, msg, content)
+		var entry *backupIndexEntry
+		if mailbox == indexMailbox {
+			entry = index[strings.TrimSuffix(file, backupRawExt)]
+		}
+		if entry != nil {
+			// Preserve the original delivery date.
+			delivery.Meta.Date = entry.Date
+			delivery.Meta.EnvelopeID = entry.EnvID
+			delivery.Meta.SPFResult = entry.SPF
+			delivery.Meta.Tags = entry.Tags
+		}
+		id, err := s.deliver(ctx, delivery)
+		if err != nil {
+			return count, err
+		}
+		count++
+		if id != "" && entry != nil && entry.Seen {
+			if err := s.Store.MarkSeen(ctx, mailbox, id); err != nil {
+				return count, err
+			}
+		}
+	}
+}
@@ -0,0 +1,47 @@
+package message
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/inbucket/inbucket/pkg/dkim"
+	"github.com/inbucket/inbucket/pkg/storage"
+	"github.com/rs/zerolog/log"
+)
+
+// dkimTimeout limits the time spent verifying the DKIM signatures of a single message.
+const dkimTimeout = 30 * time.Second
+
+// DKIMVerifier verifies the DKIM signatures of delivered messages in the background, recording
+// the results in Store.
+type DKIMVerifier struct {
+	Resolver dkim.Resolver
+	Store    storage.DKIMRecorder
+	wg       sync.WaitGroup
+}
+
+// Verify starts verification of the DKIM signatures of the specified message, without waiting
+// for it to complete.
+func (v *DKIMVerifier) Verify(mailbox, id string, source []byte) {
+	v.wg.Add(1)
+	go func() {
+		defer v.wg.Done()
+		ctx, cancel := context.WithTimeout(context.Background(), dkimTimeout)
+		defer cancel()
+		result, domain := dkim.Verify(ctx, v.Resolver, source)
+		logger := log.With().Str("module", "message").Str("mailbox", mailbox).Str("id", id).
+			Logger()
+		if err := v.Store.SetDKIM(ctx, mailbox, id, result, domain); err != nil {
+			logger.Warn().Err(err).Msg("Failed to record DKIM result")
+			return
+		}
+		logger.Debug().Str("result", result.String()).Str("domain", domain).
+			Msg("Verified DKIM signature")
+	}()
+}
+
+// Wait blocks until all verifications in progress have completed.
+func (v *DKIMVerifier) Wait() {
+	v.wg.Wait()
+}
@@ -0,0 +1,99 @@
+package message_test
+
+import (
+	"context"
+	"net"
+	"testing"
+
+	"github.com/inbucket/inbucket/pkg/config"
+	"github.com/inbucket/inbucket/pkg/dkim"
+	"github.com/inbucket/inbucket/pkg/message"
+	"github.com/inbucket/inbucket/pkg/policy"
+	"github.com/inbucket/inbucket/pkg/storage"
+	"github.com/inbucket/inbucket/pkg/storage/mem"
+)
+
+// dkimKey is the public key for signedMessage, published at test._domainkey.example.com.
+const dkimKey = "v=DKIM1; k=rsa; p=MIGfMA0GCSqGSIb3DQEBAQUAA4GNADCBiQKBgQCqVQe7WqAuSTZP//wp9uF7" +
+	"pyUN43ic5jBFg0dbyIa5E6gU+JiGJtS2ZjlvJC2qaTBIKUH+X91efFGVQEqKwajtDeZSG0V71dd6r+fgWwFd4VQEa" +
+	"A4EDmjLz69WxlhG3I+9MyLPhiacO9EA7IoBgyGBw9RWurI9AE7nKpSWywFggQIDAQAB"
+
+const signedMessage = "DKIM-Signature: v=1; a=rsa-sha256; c=relaxed/relaxed; d=example.com;" +
+	" s=test; h=from:to:subject;\r\n" +
+	"\tbh=YJC6sFHGk5paEfivUv71xLRk9l6/Mpywbes6g++OLys=; b=LgjaosPjvsEbiPSwRZrjFQQ695/bZRuOQ+" +
+	"b022QO5xfQnmWyC5R9gouJzb3KSfHfuuMALKU6GPherPImgXJ4EgVsQ7YwT7WTzu5Q1/d2d8ND3zwIzAqvRnyfkk" +
+	"3atuaE9DD/H0Cjrf6I1cog9dvJgiuZH70bjL5XxS9qt2GMeXo=\r\n" +
+	"From: alice@example.com\r\n" +
+	"To: bob@inbucket.local\r\n" +
+	"Subject: Signed\r\n" +
+	"\r\n" +
+	"Hello Bob\r\n"
+
+// stubResolver serves dkimKey.
+type stubResolver struct{}
+
+func (stubResolver) LookupTXT(ctx context.Context, name string) ([]string, error) {
+	if name == "test._domainkey.example.com" {
+		return []string{dkimKey}, nil
+	}
+	return nil, &net.DNSError{Err: "no such host", Name: name, IsNotFound: true}
+}
+
+func TestDeliverDKIM(t *testing.T) {
+	store, err := mem.New(config.Storage{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	mm := &message.StoreManager{
+		Store: store,
+		DKIM: &message.DKIMVerifier{
+			Resolver: stubResolver{},
+			Store:    store.(storage.DKIMRecorder),
+		},
+	}
+	testCases := []struct {
+		name   string
+		source string
+		result dkim.Result
+		domain string
+	}{
+		{"signed", signedMessage, dkim.Pass, "example.com"},
+		{"tampered", signedMessage[:len(signedMessage)-5] + "Eve\r\n", dkim.Fail, "example.com"},
+		{"unsigned", "From: alice@example.com\r\n\r\nHello\r\n", dkim.None, ""},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			to := &policy.Recipient{Mailbox: "bob"}
+			id, err := mm.Deliver(context.Background(), to, "alice@example.com", "", "",
+				[]*policy.Recipient{to}, "Received: by test\r\n", []byte(tc.source))
+			if err != nil {
+				t.Fatal(err)
+			}
+			mm.DKIM.Wait()
+			msg, err := mm.GetMessage(context.Background(), "bob", id)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if msg.DKIMResult != tc.result || msg.DKIMDomain != tc.domain {
+				t.Errorf("Got result %v, domain %q, want: %v, %q", msg.DKIMResult,
+					msg.DKIMDomain, tc.result, tc.domain)
+			}
+		})
+	}
+
+	// Verification is disabled by default.
+	mm.DKIM = nil
+	to := &policy.Recipient{Mailbox: "bob"}
+	id, err := mm.Deliver(context.Background(), to, "alice@example.com", "", "",
+		[]*policy.Recipient{to}, "", []byte(signedMessage))
+	if err != nil {
+		t.Fatal(err)
+	}
+	msg, err := mm.GetMessage(context.Background(), "bob", id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if msg.DKIMResult != 0 {
+		t.Errorf("Got result %v without verifier, want none recorded", msg.DKIMResult)
+	}
+}
@@ -0,0 +1,65 @@
+package message
+
+import (
+	"encoding/base64"
+	"html"
+	"io"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strings"
+)
+
+// cidPattern matches cid: URLs, as used by HTML bodies to reference inline images.
+var cidPattern = regexp.MustCompile(`(?i)cid:[^"'\s()<>]+`)
+
+// ParseHTML parses the message source and returns its HTML body, along with the inline images
+// of the message keyed by Content-ID.  Messages without an HTML part have their plain text body
+// escaped and wrapped in a <pre> element.  Multipart entities nested more than maxDepth levels
+// deep are not descended into.
+func ParseHTML(r io.Reader, maxDepth int) (body string, inlineImages map[string][]byte, err error) {
+	parts, err := ReadParts(r, maxDepth)
+	if err != nil {
+		return "", nil, err
+	}
+	var htmlPart, textPart *Part
+	inlineImages = make(map[string][]byte)
+	for _, part := range parts {
+		switch {
+		case part.ContentID != "" && strings.HasPrefix(part.MediaType, "image/"):
+			inlineImages[part.ContentID] = part.Content
+		case part.Filename != "":
+			// Attachment, not a body.
+		case part.MediaType == "text/html" && htmlPart == nil:
+			htmlPart = part
+		case part.MediaType == "text/plain" && textPart == nil:
+			textPart = part
+		}
+	}
+	switch {
+	case htmlPart != nil:
+		body = string(htmlPart.Content)
+	case textPart != nil:
+		body = "<pre>" + html.EscapeString(string(textPart.Content)) + "</pre>"
+	default:
+		body = "<pre></pre>"
+	}
+	return body, inlineImages, nil
+}
+
+// EmbedImages rewrites the cid: references in body to data URIs containing the matching
+// images.  References without a matching image are left as-is.
+func EmbedImages(body string, images map[string][]byte) string {
+	return cidPattern.ReplaceAllStringFunc(body, func(ref string) string {
+		cid, err := url.PathUnescape(ref[len("cid:"):])
+		if err != nil {
+			return ref
+		}
+		content, ok := images[cid]
+		if !ok {
+			return ref
+		}
+		return "data:" + http.DetectContentType(content) + ";base64," +
+			base64.StdEncoding.EncodeToString(content)
+	})
+}
@@ -0,0 +1,80 @@
+package message_test
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/inbucket/inbucket/pkg/message"
+)
+
+const relatedMessage = "From: alice@host\r\nSubject: related\r\nMIME-Version: 1.0\r\n" +
+	"Content-Type: multipart/related; boundary=outer\r\n\r\n" +
+	"--outer\r\n" +
+	"Content-Type: multipart/alternative; boundary=inner\r\n\r\n" +
+	"--inner\r\n" +
+	"Content-Type: text/plain; charset=us-ascii\r\n\r\n" +
+	"Text body\r\n" +
+	"--inner\r\n" +
+	"Content-Type: text/html; charset=us-ascii\r\n\r\n" +
+	"<p><img src=\"cid:logo@host\"><img src=\"cid:missing@host\"></p>\r\n" +
+	"--inner--\r\n" +
+	"--outer\r\n" +
+	"Content-Type: image/png\r\n" +
+	"Content-ID: <logo@host>\r\n" +
+	"Content-Disposition: inline\r\n" +
+	"Content-Transfer-Encoding: base64\r\n\r\n" +
+	"iVBORw0KGgo=\r\n" +
+	"--outer--\r\n"
+
+func TestParseHTML(t *testing.T) {
+	testCases := []struct {
+		name   string
+		source string
+		body   string
+		images map[string]string
+	}{
+		{"related", relatedMessage,
+			"<p><img src=\"cid:logo@host\"><img src=\"cid:missing@host\"></p>",
+			map[string]string{"logo@host": "\x89PNG\r\n\x1a\n"}},
+		{"plain", "From: alice@host\r\n\r\n<b>Hello</b>\r\n",
+			"<pre>&lt;b&gt;Hello&lt;/b&gt;\r\n</pre>", map[string]string{}},
+		{"mixed", mixedMessage, "<p>HTML body</p>", map[string]string{}},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			body, images, err := message.ParseHTML(strings.NewReader(tc.source), 10)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if body != tc.body {
+				t.Errorf("Got body %q, want: %q", body, tc.body)
+			}
+			if len(images) != len(tc.images) {
+				t.Errorf("Got %v images, want: %v", len(images), len(tc.images))
+			}
+			for cid, want := range tc.images {
+				if got := string(images[cid]); got != want {
+					t.Errorf("Got image %q content %q, want: %q", cid, got, want)
+				}
+			}
+		})
+	}
+
+	if _, _, err := message.ParseHTML(strings.NewReader("not a message"), 10); err == nil {
+		t.Error("Expected error for malformed message")
+	}
+}
+
+func TestEmbedImages(t *testing.T) {
+	images := map[string][]byte{
+		"logo@host":  []byte("\x89PNG\r\n\x1a\n"),
+		"a b@host":   []byte("GIF89a"),
+		"other@host": []byte("unused"),
+	}
+	body := `<img src="cid:logo@host"><img src='CID:a%20b@host'><img src="cid:missing@host">`
+	want := `<img src="data:image/png;base64,iVBORw0KGgo="><img src='data:image/gif;base64,` +
+		`R0lGODlh'><img src="cid:missing@host">`
+	if got := message.EmbedImages(body, images); got != want {
+		t.Errorf("Got %q, want: %q", got, want)
+	}
+}
@@ -2,11 +2,14 @@ package message
 
 import (
 	"bytes"
+	"context"
 	"io"
 	"net/mail"
+	"sort"
 	"strings"
 	"time"
 
+	"github.com/inbucket/inbucket/pkg/config"
 	"github.com/inbucket/inbucket/pkg/msghub"
 	"github.com/inbucket/inbucket/pkg/policy"
 	"github.com/inbucket/inbucket/pkg/storage"
@@ -18,19 +21,35 @@ import (
 // Manager is the interface controllers use to interact with messages.
 type Manager interface {
 	Deliver(
+		ctx context.Context,
 		to *policy.Recipient,
 		from string,
+		envelopeID string,
+		spfResult string,
 		recipients []*policy.Recipient,
 		prefix string,
 		content []byte,
 	) (id string, err error)
-	GetMetadata(mailbox string) ([]*Metadata, error)
-	GetMessage(mailbox, id string) (*Message, error)
-	MarkSeen(mailbox, id string) error
-	PurgeMessages(mailbox string) error
-	RemoveMessage(mailbox, id string) error
-	SourceReader(mailbox, id string) (io.ReadCloser, error)
+	Import(
+		ctx context.Context, mailbox string, msg *mail.Message, source []byte) (id string, err error)
+	GetMailboxes(ctx context.Context) ([]*MailboxSummary, error)
+	GetMetadata(ctx context.Context, mailbox string) ([]*Metadata, error)
+	GetMetadataPage(ctx context.Context, mailbox, after string, limit int,
+		match func(*Metadata) bool) (metas []*Metadata, next string, err error)
+	GetMessage(ctx context.Context, mailbox, id string) (*Message, error)
+	MarkSeen(ctx context.Context, mailbox, id string) error
+	MarkUnseen(ctx context.Context, mailbox, id string) error
+	SetTags(ctx context.Context, mailbox, id string, tags []string) error
+	PurgeMessages(ctx context.Context, mailbox string) error
+	RemoveMessage(ctx context.Context, mailbox, id string) error
+	MoveMessage(ctx context.Context, src, id, dst string) (newID string, err error)
+	CopyMessage(ctx context.Context, src, id, dst string) (newID string, err error)
+	SourceReader(ctx context.Context, mailbox, id string) (io.ReadCloser, error)
+	RawMessage(ctx context.Context, mailbox, id string) (*Metadata, io.ReadCloser, error)
 	MailboxForAddress(address string) (string, error)
+	VisitMetadata(ctx context.Context, f func(messages []*Metadata) (cont bool)) error
+	Backup(ctx context.Context, w io.Writer) error
+	Restore(ctx context.Context, r io.Reader) (count int, err error)
 }
 
 // StoreManager is a message Manager backed by the storage.Store.
@@ -38,12 +57,19 @@ type StoreManager struct {
 	AddrPolicy *policy.Addressing
 	Store      storage.Store
 	Hub        *msghub.Hub
+	DKIM       *DKIMVerifier     // DKIM signatures of delivered messages are verified if set.
+	SpamRules  []config.SpamRule // Delivered messages matching a rule are flagged as spam.
+
+	moveLock storage.HashLock // Held by MoveMessage on the source and destination mailboxes.
 }
 
 // Deliver submits a new message to the store.
 func (s *StoreManager) Deliver(
+	ctx context.Context,
 	to *policy.Recipient,
 	from string,
+	envelopeID string,
+	spfResult string,
 	recipients []*policy.Recipient,
 	prefix string,
 	source []byte,
@@ -65,25 +91,81 @@ func (s *StoreManager) Deliver(
 			toaddr[i] = &torecip.Address
 		}
 	}
-	log.Debug().Str("module", "message").Str("mailbox", to.Mailbox).Msg("Delivering message")
-	delivery := &Delivery{
+	mailbox := to.Mailbox
+	var tags []string
+	if rule := matchSpamRule(s.SpamRules, fromaddr[0], env); rule != nil {
+		prefix += SpamHeader + ": yes\r\n"
+		tags = []string{SpamTag}
+		if rule.Action == config.SpamQuarantine {
+			mailbox = SpamMailboxPrefix + mailbox
+		}
+		log.Debug().Str("module", "message").Str("mailbox", to.Mailbox).
+			Str("action", string(rule.Action)).Msg("Message matched spam rule")
+	}
+	log.Debug().Str("module", "message").Str("mailbox", mailbox).Msg("Delivering message")
+	id, err := s.deliver(ctx, &Delivery{
 		Meta: Metadata{
-			Mailbox: to.Mailbox,
-			From:    fromaddr[0],
-			To:      toaddr,
-			Date:    time.Now(),
-			Subject: env.GetHeader("Subject"),
+			Mailbox:    mailbox,
+			From:       fromaddr[0],
+			To:         toaddr,
+			Date:       time.Now(),
+			Subject:    env.GetHeader("Subject"),
+			Size:       int64(len(prefix) + len(source)),
+			EnvelopeID: envelopeID,
+			SPFResult:  spfResult,
+			Tags:       tags,
 		},
 		Reader: io.MultiReader(strings.NewReader(prefix), bytes.NewReader(source)),
+	})
+	if err == nil && id != "" && s.DKIM != nil {
+		s.DKIM.Verify(mailbox, id, source)
 	}
-	id, err := s.Store.AddMessage(delivery)
+	return id, err
+}
+
+// Import adds an existing message to the specified mailbox.  msg is the parsed header of source,
+// its Date header is used as the message date when present.
+func (s *StoreManager) Import(
+	ctx context.Context, mailbox string, msg *mail.Message, source []byte) (string, error) {
+	log.Debug().Str("module", "message").Str("mailbox", mailbox).Msg("Importing message")
+	return s.deliver(ctx, importDelivery(mailbox, msg, source))
+}
+
+// importDelivery creates a Delivery of an existing message, see Import.
+func importDelivery(mailbox string, msg *mail.Message, source []byte) *Delivery {
+	date, err := msg.Header.Date()
+	if err != nil {
+		date = time.Now()
+	}
+	from := &mail.Address{}
+	if fromaddr, err := msg.Header.AddressList("From"); err == nil && len(fromaddr) > 0 {
+		from = fromaddr[0]
+	}
+	toaddr, _ := msg.Header.AddressList("To")
+	subject := stringutil.DecodeHeader(msg.Header.Get("Subject"))
+	return &Delivery{
+		Meta: Metadata{
+			Mailbox: mailbox,
+			From:    from,
+			To:      toaddr,
+			Date:    date,
+			Subject: subject,
+			Size:    int64(len(source)),
+		},
+		Reader: bytes.NewReader(source),
+	}
+}
+
+// deliver adds the delivery to the store, and broadcasts it to the hub.
+func (s *StoreManager) deliver(ctx context.Context, delivery *Delivery) (string, error) {
+	id, err := s.Store.AddMessage(ctx, delivery)
 	if err != nil {
 		return "", err
 	}
-	if s.Hub != nil {
+	if s.Hub != nil && id != "" {
 		// Broadcast message information.
 		broadcast := msghub.Message{
-			Mailbox: to.Mailbox,
+			Mailbox: delivery.Mailbox(),
 			ID:      id,
 			From:    stringutil.StringAddress(delivery.From()),
 			To:      stringutil.StringAddressList(delivery.To()),
@@ -96,9 +178,36 @@ func (s *StoreManager) Deliver(
 	return id, nil
 }
 
+// GetMailboxes returns a summary of every mailbox in the store, sorted by name.
+func (s *StoreManager) GetMailboxes(ctx context.Context) ([]*MailboxSummary, error) {
+	summaries := make([]*MailboxSummary, 0)
+	err := s.Store.VisitMailboxes(ctx, func(messages []storage.Message) bool {
+		if len(messages) == 0 {
+			return true
+		}
+		summary := &MailboxSummary{Name: messages[0].Mailbox()}
+		for _, m := range messages {
+			summary.MessageCount++
+			summary.TotalBytes += m.Size()
+			if m.Date().After(summary.LatestDate) {
+				summary.LatestDate = m.Date()
+			}
+		}
+		summaries = append(summaries, summary)
+		return true
+	})
+	if err != nil {
+		return nil, err
+	}
+	sort.Slice(summaries, func(i, j int) bool {
+		return summaries[i].Name < summaries[j].Name
+	})
+	return summaries, nil
+}
+
 // GetMetadata returns a slice of metadata for the specified mailbox.
-func (s *StoreManager) GetMetadata(mailbox string) ([]*Metadata, error) {
-	messages, err := s.Store.GetMessages(mailbox)
+func (s *StoreManager) GetMetadata(ctx context.Context, mailbox string) ([]*Metadata, error) {
+	messages, err := s.Store.GetMessages(ctx, mailbox)
 	if err != nil {
 		return nil, err
 	}
@@ -109,9 +218,34 @@ func (s *StoreManager) GetMetadata(mailbox string) ([]*Metadata, error) {
 	return metas, nil
 }
 
+// GetMetadataPage returns metadata for up to limit messages accepted by match, which follow the
+// message with ID after in the specified mailbox.  next is the ID of the last message returned if
+// further matching messages follow the page, otherwise it is empty.
+func (s *StoreManager) GetMetadataPage(ctx context.Context, mailbox, after string, limit int,
+	match func(*Metadata) bool) (metas []*Metadata, next string, err error) {
+	var smatch func(storage.Message) bool
+	if match != nil {
+		smatch = func(sm storage.Message) bool {
+			return match(makeMetadata(sm))
+		}
+	}
+	messages, more, err := storage.PageMessages(ctx, s.Store, mailbox, after, limit, smatch)
+	if err != nil {
+		return nil, "", err
+	}
+	metas = make([]*Metadata, len(messages))
+	for i, sm := range messages {
+		metas[i] = makeMetadata(sm)
+	}
+	if more && len(metas) > 0 {
+		next = metas[len(metas)-1].ID
+	}
+	return metas, next, nil
+}
+
 // GetMessage returns the specified message.
-func (s *StoreManager) GetMessage(mailbox, id string) (*Message, error) {
-	sm, err := s.Store.GetMessage(mailbox, id)
+func (s *StoreManager) GetMessage(ctx context.Context, mailbox, id string) (*Message, error) {
+	sm, err := s.Store.GetMessage(ctx, mailbox, id)
 	if err != nil || sm == nil {
 		return nil, err
 	}
@@ -129,46 +263,107 @@ func (s *StoreManager) GetMessage(mailbox, id string) (*Message, error) {
 }
 
 // MarkSeen marks the message as having been read.
-func (s *StoreManager) MarkSeen(mailbox, id string) error {
+func (s *StoreManager) MarkSeen(ctx context.Context, mailbox, id string) error {
 	log.Debug().Str("module", "manager").Str("mailbox", mailbox).Str("id", id).
 		Msg("Marking as seen")
-	return s.Store.MarkSeen(mailbox, id)
+	return s.Store.MarkSeen(ctx, mailbox, id)
+}
+
+// MarkUnseen marks the message as not having been read.
+func (s *StoreManager) MarkUnseen(ctx context.Context, mailbox, id string) error {
+	log.Debug().Str("module", "manager").Str("mailbox", mailbox).Str("id", id).
+		Msg("Marking as unseen")
+	return s.Store.MarkUnseen(ctx, mailbox, id)
+}
+
+// SetTags replaces the tags of the message.
+func (s *StoreManager) SetTags(ctx context.Context, mailbox, id string, tags []string) error {
+	return s.Store.SetTags(ctx, mailbox, id, tags)
 }
 
 // PurgeMessages removes all messages from the specified mailbox.
-func (s *StoreManager) PurgeMessages(mailbox string) error {
-	return s.Store.PurgeMessages(mailbox)
+func (s *StoreManager) PurgeMessages(ctx context.Context, mailbox string) error {
+	return s.Store.PurgeMessages(ctx, mailbox)
 }
 
 // RemoveMessage deletes the specified message.
-func (s *StoreManager) RemoveMessage(mailbox, id string) error {
-	return s.Store.RemoveMessage(mailbox, id)
+func (s *StoreManager) RemoveMessage(ctx context.Context, mailbox, id string) error {
+	return s.Store.RemoveMessage(ctx, mailbox, id)
 }
 
 // SourceReader allows the stored message source to be read.
-func (s *StoreManager) SourceReader(mailbox, id string) (io.ReadCloser, error) {
-	sm, err := s.Store.GetMessage(mailbox, id)
+func (s *StoreManager) SourceReader(
+	ctx context.Context, mailbox, id string) (io.ReadCloser, error) {
+	sm, err := s.Store.GetMessage(ctx, mailbox, id)
 	if err != nil || sm == nil {
 		return nil, err
 	}
 	return sm.Source()
 }
 
+// RawMessage returns the metadata of the specified message, and a reader for its stored source.
+func (s *StoreManager) RawMessage(
+	ctx context.Context, mailbox, id string) (*Metadata, io.ReadCloser, error) {
+	sm, err := s.Store.GetMessage(ctx, mailbox, id)
+	if err != nil || sm == nil {
+		return nil, nil, err
+	}
+	r, err := sm.Source()
+	if err != nil {
+		return nil, nil, err
+	}
+	return makeMetadata(sm), r, nil
+}
+
 // MailboxForAddress parses an email address to return the canonical mailbox name.
 func (s *StoreManager) MailboxForAddress(mailbox string) (string, error) {
 	return s.AddrPolicy.ExtractMailbox(mailbox)
 }
 
+// VisitMetadata calls f with the metadata of each non-empty mailbox in the store, until f returns
+// false.
+func (s *StoreManager) VisitMetadata(
+	ctx context.Context, f func(messages []*Metadata) (cont bool)) error {
+	return s.Store.VisitMailboxes(ctx, func(messages []storage.Message) bool {
+		if len(messages) == 0 {
+			return true
+		}
+		metas := make([]*Metadata, len(messages))
+		for i, sm := range messages {
+			metas[i] = makeMetadata(sm)
+		}
+		return f(metas)
+	})
+}
+
 // makeMetadata populates Metadata from a storage.Message.
 func makeMetadata(m storage.Message) *Metadata {
-	return &Metadata{
-		Mailbox: m.Mailbox(),
-		ID:      m.ID(),
-		From:    m.From(),
-		To:      m.To(),
-		Date:    m.Date(),
-		Subject: m.Subject(),
-		Size:    m.Size(),
-		Seen:    m.Seen(),
+	meta := &Metadata{
+		Mailbox:    m.Mailbox(),
+		ID:         m.ID(),
+		From:       m.From(),
+		To:         m.To(),
+		Date:       m.Date(),
+		ReceivedAt: storage.ReceivedAt(m),
+		Subject:    m.Subject(),
+		Size:       m.Size(),
+		Seen:       m.Seen(),
+		EnvelopeID: m.EnvelopeID(),
+		SPFResult:  m.SPFResult(),
+		Tags:       m.Tags(),
+		Priority:   storage.PriorityNormal,
+	}
+	if dm, ok := m.(storage.DKIMMessage); ok {
+		meta.DKIMResult, meta.DKIMDomain = dm.DKIM()
+	}
+	if am, ok := m.(storage.AttachmentMessage); ok {
+		meta.AttachmentCount, meta.AttachmentBytes = am.Attachments()
+	}
+	if sm, ok := m.(storage.SnippetMessage); ok {
+		meta.Snippet = sm.Snippet()
+	}
+	if pm, ok := m.(storage.PriorityMessage); ok {
+		meta.Priority = pm.Priority()
 	}
+	return meta
 }
@@ -0,0 +1,151 @@
+package message
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/mail"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/rs/zerolog/log"
+)
+
+// mboxFromDate is the asctime() layout of the date in an mbox From line.
+const mboxFromDate = time.ANSIC
+
+// mboxFromQuoted matches body lines which must be quoted with '>' in mboxrd format, so they are not
+// mistaken for From lines.
+var mboxFromQuoted = regexp.MustCompile(`^>*From `)
+
+// ExportMbox writes the messages in mailbox to w in mboxrd format (RFC 4155), oldest first.
+func (s *StoreManager) ExportMbox(
+	ctx context.Context, w io.Writer, mailbox string) (count int, err error) {
+	messages, err := s.Store.GetMessages(ctx, mailbox)
+	if err != nil {
+		return 0, err
+	}
+	sort.SliceStable(messages, func(i, j int) bool {
+		return messages[i].Date().Before(messages[j].Date())
+	})
+	bw := bufio.NewWriter(w)
+	for _, m := range messages {
+		from := "MAILER-DAEMON"
+		if m.From() != nil && m.From().Address != "" {
+			from = m.From().Address
+		}
+		r, err := m.Source()
+		if err != nil {
+			return count, err
+		}
+		source, err := ioutil.ReadAll(r)
+		_ = r.Close()
+		if err != nil {
+			return count, err
+		}
+		fmt.Fprintf(bw, "From %s %s\n", from, m.Date().UTC().Format(mboxFromDate))
+		for len(source) > 0 {
+			line := source
+			if i := bytes.IndexByte(source, '\n'); i >= 0 {
+				line = source[:i+1]
+			}
+			source = source[len(line):]
+			if mboxFromQuoted.Match(line) {
+				_ = bw.WriteByte('>')
+			}
+			_, _ = bw.Write(line)
+			if len(source) == 0 && line[len(line)-1] != '\n' {
+				_ = bw.WriteByte('\n')
+			}
+		}
+		// Messages are separated by an empty line.
+		if err := bw.WriteByte('\n'); err != nil {
+			return count, err
+		}
+		count++
+	}
+	return count, bw.Flush()
+}
+
+// ImportMbox adds each message in the mboxrd (RFC 4155) formatted r to mailbox.  The date from
+// each From line is used as the delivery date.
+func (s *StoreManager) ImportMbox(
+	ctx context.Context, r io.Reader, mailbox string) (count int, err error) {
+	br := bufio.NewReader(r)
+	var source []byte
+	var date time.Time
+	inMessage := false
+	finish := func() error {
+		if !inMessage {
+			return nil
+		}
+		// Remove the empty line separating messages.
+		source = bytes.TrimSuffix(source, []byte("\n"))
+		msg, err := mail.ReadMessage(bytes.NewReader(source))
+		if err != nil {
+			return fmt.Errorf("message %v: %v", count+1, err)
+		}
+		delivery := importDelivery(mailbox, msg, source)
+		if !date.IsZero() {
+			delivery.Meta.Date = date
+		}
+		if _, err := s.deliver(ctx, delivery); err != nil {
+			return err
+		}
+		count++
+		return nil
+	}
+	for {
+		line, rerr := br.ReadBytes('\n')
+		if rerr != nil && rerr != io.EOF {
+			return count, rerr
+		}
+		if bytes.HasPrefix(line, []byte("From ")) {
+			if err := finish(); err != nil {
+				return count, err
+			}
+			inMessage = true
+			source = nil
+			date = parseMboxFromDate(string(line))
+		} else if len(line) > 0 {
+			if !inMessage {
+				if len(bytes.TrimSpace(line)) == 0 {
+					continue
+				}
+				return count, fmt.Errorf("mbox does not begin with a From line")
+			}
+			if mboxFromQuoted.Match(line) {
+				line = line[1:]
+			}
+			source = append(source, line...)
+		}
+		if rerr == io.EOF {
+			break
+		}
+	}
+	if err := finish(); err != nil {
+		return count, err
+	}
+	log.Debug().Str("module", "message").Str("mailbox", mailbox).Int("count", count).
+		Msg("Imported mbox")
+	return count, nil
+}
+
+// parseMboxFromDate returns the date from an mbox From line, or the zero time if it could not be
+// parsed.
+func parseMboxFromDate(line string) time.Time {
+	fields := strings.SplitN(strings.TrimRight(line, "\r\n"), " ", 3)
+	if len(fields) < 3 {
+		return time.Time{}
+	}
+	date, err := time.Parse(mboxFromDate, strings.TrimSpace(fields[2]))
+	if err != nil {
+		return time.Time{}
+	}
+	return date
+}
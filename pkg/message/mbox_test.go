@@ -0,0 +1,116 @@
+package message_test
+
+import (
+	"bytes"
+	"context"
+	"io/ioutil"
+	"net/mail"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/inbucket/inbucket/pkg/config"
+	"github.com/inbucket/inbucket/pkg/message"
+	"github.com/inbucket/inbucket/pkg/storage/mem"
+)
+
+func TestMboxRoundTrip(t *testing.T) {
+	sources := []string{
+		"From: alice@host\r\nDate: Sat, 02 Jan 2021 03:04:05 +0000\r\n\r\n" +
+			"From the start\r\n>From quoted\r\n",
+		"From: \"Bob\" <bob@host>\r\nDate: Sat, 02 Jan 2021 05:04:05 +0100\r\n\r\n" +
+			"body\r\n\r\n",
+		"Date: Sat, 02 Jan 2021 05:04:05 +0000\n\nunix line endings\nFrom here\n",
+	}
+	base := time.Date(2021, 1, 2, 3, 4, 5, 0, time.UTC)
+	src := newManager(t)
+	// Deliver out of order, export is chronological.
+	for i := len(sources) - 1; i >= 0; i-- {
+		msg, err := mail.ReadMessage(strings.NewReader(sources[i]))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := src.Import(context.Background(), "box", msg, []byte(sources[i])); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	mbox := &bytes.Buffer{}
+	count, err := src.ExportMbox(context.Background(), mbox, "box")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if count != len(sources) {
+		t.Errorf("exported %v messages, want %v", count, len(sources))
+	}
+	want := "From alice@host Sat Jan  2 03:04:05 2021\n" +
+		"From: alice@host\r\nDate: Sat, 02 Jan 2021 03:04:05 +0000\r\n\r\n" +
+		">From the start\r\n>>From quoted\r\n\n" +
+		"From bob@host Sat Jan  2 04:04:05 2021\n" +
+		"From: \"Bob\" <bob@host>\r\nDate: Sat, 02 Jan 2021 05:04:05 +0100\r\n\r\n" +
+		"body\r\n\r\n\n" +
+		"From MAILER-DAEMON Sat Jan  2 05:04:05 2021\n" +
+		"Date: Sat, 02 Jan 2021 05:04:05 +0000\n\nunix line endings\n>From here\n\n"
+	if got := mbox.String(); got != want {
+		t.Errorf("got mbox:\n%q\nwant:\n%q", got, want)
+	}
+
+	dst := newManager(t)
+	count, err = dst.ImportMbox(context.Background(), bytes.NewReader(mbox.Bytes()), "copy")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if count != len(sources) {
+		t.Errorf("imported %v messages, want %v", count, len(sources))
+	}
+	messages, err := dst.Store.GetMessages(context.Background(), "copy")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(messages) != len(sources) {
+		t.Fatalf("got %v messages, want %v", len(messages), len(sources))
+	}
+	for i, m := range messages {
+		r, err := m.Source()
+		if err != nil {
+			t.Fatal(err)
+		}
+		got, _ := ioutil.ReadAll(r)
+		_ = r.Close()
+		if string(got) != sources[i] {
+			t.Errorf("message %v got source %q, want %q", i, got, sources[i])
+		}
+		if want := base.Add(time.Duration(i) * time.Hour); !m.Date().Equal(want) {
+			t.Errorf("message %v got date %v, want %v", i, m.Date(), want)
+		}
+	}
+	again := &bytes.Buffer{}
+	if _, err := dst.ExportMbox(context.Background(), again, "copy"); err != nil {
+		t.Fatal(err)
+	}
+	if again.String() != mbox.String() {
+		t.Errorf("re-exported mbox differs:\n%q", again.String())
+	}
+}
+
+func TestMboxImportInvalid(t *testing.T) {
+	mm := newManager(t)
+	_, err := mm.ImportMbox(context.Background(), strings.NewReader("Subject: no separator\n\n"), "box")
+	if err == nil {
+		t.Error("got nil error for mbox without From line")
+	}
+	count, err := mm.ImportMbox(context.Background(), strings.NewReader(""), "box")
+	if err != nil || count != 0 {
+		t.Errorf("got %v, %v for empty mbox, want 0, nil", count, err)
+	}
+}
+
+// newManager creates a StoreManager backed by a memory store.
+func newManager(t *testing.T) *message.StoreManager {
+	t.Helper()
+	store, err := mem.New(config.Storage{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &message.StoreManager{Store: store}
+}
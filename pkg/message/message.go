@@ -8,20 +8,45 @@ import (
 	"net/textproto"
 	"time"
 
+	"github.com/inbucket/inbucket/pkg/dkim"
 	"github.com/inbucket/inbucket/pkg/storage"
+	"github.com/inbucket/inbucket/pkg/stringutil"
 	"github.com/jhillyerd/enmime"
 )
 
+// MailboxSummary describes the content of a mailbox.
+type MailboxSummary struct {
+	Name         string
+	MessageCount int
+	TotalBytes   int64
+	LatestDate   time.Time
+}
+
 // Metadata holds information about a message, but not the content.
 type Metadata struct {
-	Mailbox string
-	ID      string
-	From    *mail.Address
-	To      []*mail.Address
-	Date    time.Time
-	Subject string
-	Size    int64
-	Seen    bool
+	Mailbox    string
+	ID         string
+	From       *mail.Address
+	To         []*mail.Address
+	Date       time.Time
+	ReceivedAt time.Time // When the store received the message, Date if it is not recorded.
+	Subject    string
+	Size       int64
+	Seen       bool
+	EnvelopeID string      // SMTP DSN envelope ID, empty if not provided.
+	DKIMResult dkim.Result // Zero until the DKIM signature has been verified.
+	DKIMDomain string      // DKIM signing domain, empty if not signed.
+	SPFResult  string      // SPF check result, empty if not checked.
+	Tags       []string    // Annotations set through the API.
+	// AttachmentCount and AttachmentBytes are recorded by stores implementing
+	// storage.AttachmentMessage, zero otherwise.
+	AttachmentCount int
+	AttachmentBytes int64 // Total decoded size of the attachments.
+	// Snippet is recorded by stores implementing storage.SnippetMessage, empty otherwise.
+	Snippet string
+	// Priority is recorded by stores implementing storage.PriorityMessage, otherwise it is
+	// storage.PriorityNormal.
+	Priority int
 }
 
 // Message holds both the metadata and content of a message.
@@ -48,6 +73,30 @@ func (m *Message) Header() textproto.MIMEHeader {
 	return m.env.Root.Header
 }
 
+// AddressList parses the named header as a list of addresses, returning nil if it is absent or
+// malformed.
+func (m *Message) AddressList(key string) []*mail.Address {
+	addrs, err := mail.Header(m.Header()).AddressList(key)
+	if err != nil {
+		return nil
+	}
+	return addrs
+}
+
+// DecodedHeader returns the header map for this message, with RFC 2047 encoded words decoded.
+// Values which fail to decode are returned as-is.
+func (m *Message) DecodedHeader() map[string][]string {
+	header := make(map[string][]string, len(m.Header()))
+	for k, vs := range m.Header() {
+		decoded := make([]string, len(vs))
+		for i, v := range vs {
+			decoded[i] = stringutil.DecodeHeader(v)
+		}
+		header[k] = decoded
+	}
+	return header
+}
+
 // HTML returns the HTML body of the message.
 func (m *Message) HTML() string {
 	return m.env.HTML
@@ -115,3 +164,18 @@ func (d *Delivery) Source() (io.ReadCloser, error) {
 func (d *Delivery) Seen() bool {
 	return d.Meta.Seen
 }
+
+// EnvelopeID getter.
+func (d *Delivery) EnvelopeID() string {
+	return d.Meta.EnvelopeID
+}
+
+// SPFResult getter.
+func (d *Delivery) SPFResult() string {
+	return d.Meta.SPFResult
+}
+
+// Tags getter.
+func (d *Delivery) Tags() []string {
+	return d.Meta.Tags
+}
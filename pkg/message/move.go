@@ -0,0 +1,120 @@
+package message
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io/ioutil"
+
+	"github.com/inbucket/inbucket/pkg/storage"
+	"github.com/inbucket/inbucket/pkg/stringutil"
+	"github.com/rs/zerolog/log"
+)
+
+// ErrSameMailbox is returned by MoveMessage when the source and destination mailboxes are the
+// same.
+var ErrSameMailbox = errors.New("source and destination mailbox are the same")
+
+// moveHook is called by MoveMessage after the message has been added to the destination, and
+// before it is removed from the source.  If it returns an error the move is abandoned, leaving the
+// message in both mailboxes.  It is set by tests to interrupt a move.
+var moveHook func() error
+
+// MoveMessage copies the specified message to the dst mailbox, preserving its metadata, then
+// removes it from the src mailbox.  It returns the ID of the message in dst.
+//
+// Moves hold a lock on both mailboxes, acquired in hash order, so concurrent moves between the same
+// mailboxes can not lose or duplicate a message.  If the move fails after the message was added to
+// dst, it is left in both mailboxes rather than lost; if dst is full and discards the copy,
+// storage.ErrMailboxFull is returned and the message stays in src.
+func (s *StoreManager) MoveMessage(ctx context.Context, src, id, dst string) (string, error) {
+	if src == dst {
+		return "", ErrSameMailbox
+	}
+	unlock := s.lockMailboxes(src, dst)
+	defer unlock()
+	log.Debug().Str("module", "message").Str("mailbox", src).Str("id", id).
+		Str("destination", dst).Msg("Moving message")
+	srcID, newID, err := s.copyMessage(ctx, src, id, dst)
+	if err != nil {
+		return "", err
+	}
+	if moveHook != nil {
+		if err := moveHook(); err != nil {
+			return "", err
+		}
+	}
+	if err := s.Store.RemoveMessage(ctx, src, srcID); err != nil {
+		return "", err
+	}
+	return newID, nil
+}
+
+// CopyMessage adds a copy of the specified message to the dst mailbox, preserving its metadata,
+// and returns the ID of the copy.  The copy has its own stored content, so removing either message
+// does not affect the other.
+func (s *StoreManager) CopyMessage(ctx context.Context, src, id, dst string) (string, error) {
+	log.Debug().Str("module", "message").Str("mailbox", src).Str("id", id).
+		Str("destination", dst).Msg("Copying message")
+	_, newID, err := s.copyMessage(ctx, src, id, dst)
+	return newID, err
+}
+
+// copyMessage adds a copy of the specified message to the dst mailbox, and returns the resolved
+// ID of the source message, as id may be "latest", along with the ID of the copy.
+func (s *StoreManager) copyMessage(
+	ctx context.Context, src, id, dst string) (srcID, newID string, err error) {
+	sm, err := s.Store.GetMessage(ctx, src, id)
+	if err != nil {
+		return "", "", err
+	}
+	if sm == nil {
+		return "", "", storage.ErrNotExist
+	}
+	r, err := sm.Source()
+	if err != nil {
+		return "", "", err
+	}
+	source, err := ioutil.ReadAll(r)
+	_ = r.Close()
+	if err != nil {
+		return "", "", err
+	}
+	meta := makeMetadata(sm)
+	meta.Mailbox = dst
+	meta.ID = ""
+	meta.Size = int64(len(source))
+	newID, err = s.deliver(ctx, &Delivery{Meta: *meta, Reader: bytes.NewReader(source)})
+	if err != nil {
+		return "", "", err
+	}
+	if newID == "" {
+		// Discarded by the drop-newest overflow policy of dst.
+		return "", "", storage.ErrMailboxFull
+	}
+	if meta.Seen {
+		if err := s.Store.MarkSeen(ctx, dst, newID); err != nil {
+			return "", "", err
+		}
+	}
+	return sm.ID(), newID, nil
+}
+
+// lockMailboxes locks the move locks of both mailboxes, and returns a func to unlock them.  Locks
+// are always acquired in hash order to prevent deadlock between moves in opposite directions.
+func (s *StoreManager) lockMailboxes(a, b string) (unlock func()) {
+	ha, hb := stringutil.HashMailboxName(a), stringutil.HashMailboxName(b)
+	if ha > hb {
+		ha, hb = hb, ha
+	}
+	first, second := s.moveLock.Get(ha), s.moveLock.Get(hb)
+	first.Lock()
+	if second == first {
+		return first.Unlock
+	}
+	second.Lock()
+	return func() {
+		second.Unlock()
+		first.Unlock()
+	}
+}
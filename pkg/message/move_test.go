@@ -0,0 +1,239 @@
+package message
+
+import (
+	"context"
+	"errors"
+	"io/ioutil"
+	"net/mail"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/inbucket/inbucket/pkg/config"
+	"github.com/inbucket/inbucket/pkg/storage"
+	"github.com/inbucket/inbucket/pkg/storage/mem"
+)
+
+const moveSource = "From: Alice <alice@host>\r\nTo: bob@host\r\nSubject: Move me\r\n" +
+	"Date: Wed, 01 Feb 2012 10:11:12 -0800\r\n\r\nTest Body\r\n"
+
+// newMoveManager creates a StoreManager backed by a memory store.
+func newMoveManager(t *testing.T) *StoreManager {
+	t.Helper()
+	store, err := mem.New(config.Storage{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &StoreManager{Store: store}
+}
+
+// importMove adds moveSource to the mailbox, and returns its ID.
+func importMove(t *testing.T, mm *StoreManager, mailbox string) string {
+	t.Helper()
+	msg, err := mail.ReadMessage(strings.NewReader(moveSource))
+	if err != nil {
+		t.Fatal(err)
+	}
+	id, err := mm.Import(context.Background(), mailbox, msg, []byte(moveSource))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return id
+}
+
+func TestMoveMessage(t *testing.T) {
+	mm := newMoveManager(t)
+	ctx := context.Background()
+	id := importMove(t, mm, "src")
+	if err := mm.SetTags(ctx, "src", id, []string{"sorted"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := mm.MarkSeen(ctx, "src", id); err != nil {
+		t.Fatal(err)
+	}
+	orig, err := mm.Store.GetMessage(ctx, "src", id)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	newID, err := mm.MoveMessage(ctx, "src", id, "dst")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if m, _ := mm.Store.GetMessage(ctx, "src", id); m != nil {
+		t.Error("got source message after move, want: nil")
+	}
+	moved, err := mm.Store.GetMessage(ctx, "dst", newID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !moved.Date().Equal(orig.Date()) {
+		t.Errorf("got date %v, want: %v", moved.Date(), orig.Date())
+	}
+	if moved.From().String() != orig.From().String() {
+		t.Errorf("got from %v, want: %v", moved.From(), orig.From())
+	}
+	if len(moved.To()) != 1 || moved.To()[0].Address != "bob@host" {
+		t.Errorf("got to %v, want: [bob@host]", moved.To())
+	}
+	if !moved.Seen() {
+		t.Error("got unseen message, want seen")
+	}
+	if tags := moved.Tags(); len(tags) != 1 || tags[0] != "sorted" {
+		t.Errorf("got tags %v, want: [sorted]", tags)
+	}
+	r, err := moved.Source()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+	if b, _ := ioutil.ReadAll(r); string(b) != moveSource {
+		t.Errorf("got source %q, want: %q", b, moveSource)
+	}
+
+	if _, err := mm.MoveMessage(ctx, "src", id, "dst"); err != storage.ErrNotExist {
+		t.Errorf("got err %v moving missing message, want: %v", err, storage.ErrNotExist)
+	}
+	if _, err := mm.MoveMessage(ctx, "dst", newID, "dst"); err != ErrSameMailbox {
+		t.Errorf("got err %v moving to same mailbox, want: %v", err, ErrSameMailbox)
+	}
+}
+
+func TestCopyMessage(t *testing.T) {
+	mm := newMoveManager(t)
+	ctx := context.Background()
+	id := importMove(t, mm, "src")
+	orig, err := mm.Store.GetMessage(ctx, "src", id)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	copyID, err := mm.CopyMessage(ctx, "src", id, "dst")
+	if err != nil {
+		t.Fatal(err)
+	}
+	copied, err := mm.Store.GetMessage(ctx, "dst", copyID)
+	if err != nil || copied == nil {
+		t.Fatalf("GetMessage(%q) = %v, %v", copyID, copied, err)
+	}
+	if !copied.Date().Equal(orig.Date()) {
+		t.Errorf("got date %v, want: %v", copied.Date(), orig.Date())
+	}
+	// Copies within a mailbox get a new ID.
+	dupID, err := mm.CopyMessage(ctx, "src", id, "src")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if dupID == id {
+		t.Errorf("got copy ID %q, want different from source", dupID)
+	}
+
+	// Removing the copies leaves the source intact.
+	if err := mm.RemoveMessage(ctx, "dst", copyID); err != nil {
+		t.Fatal(err)
+	}
+	if err := mm.RemoveMessage(ctx, "src", dupID); err != nil {
+		t.Fatal(err)
+	}
+	src, err := mm.Store.GetMessage(ctx, "src", id)
+	if err != nil || src == nil {
+		t.Fatalf("GetMessage(%q) = %v, %v after removing copy", id, src, err)
+	}
+	r, err := src.Source()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+	if b, _ := ioutil.ReadAll(r); string(b) != moveSource {
+		t.Errorf("got source %q, want: %q", b, moveSource)
+	}
+
+	if _, err := mm.CopyMessage(ctx, "src", "missing", "dst"); err != storage.ErrNotExist {
+		t.Errorf("got err %v copying missing message, want: %v", err, storage.ErrNotExist)
+	}
+}
+
+// TestMoveMessageInterrupted verifies a move interrupted after the message was added to the
+// destination leaves it in both mailboxes.
+func TestMoveMessageInterrupted(t *testing.T) {
+	mm := newMoveManager(t)
+	ctx := context.Background()
+	id := importMove(t, mm, "src")
+	interrupted := errors.New("interrupted")
+	moveHook = func() error { return interrupted }
+	defer func() { moveHook = nil }()
+
+	if _, err := mm.MoveMessage(ctx, "src", id, "dst"); err != interrupted {
+		t.Fatalf("got err %v, want: %v", err, interrupted)
+	}
+	if _, err := mm.Store.GetMessage(ctx, "src", id); err != nil {
+		t.Errorf("got err %v reading source, want: nil", err)
+	}
+	if msgs, _ := mm.Store.GetMessages(ctx, "dst"); len(msgs) != 1 {
+		t.Errorf("got %v destination messages, want: 1", len(msgs))
+	}
+}
+
+// TestMoveMessageFull verifies a message is kept in its mailbox when a full destination mailbox
+// discards it under the drop-newest overflow policy.
+func TestMoveMessageFull(t *testing.T) {
+	store, err := mem.New(config.Storage{MailboxMsgCap: 1, OverflowPolicy: config.OverflowDropNewest})
+	if err != nil {
+		t.Fatal(err)
+	}
+	mm := &StoreManager{Store: store}
+	ctx := context.Background()
+	id := importMove(t, mm, "src")
+	importMove(t, mm, "dst")
+
+	if newID, err := mm.MoveMessage(ctx, "src", id, "dst"); err != storage.ErrMailboxFull {
+		t.Fatalf("got %q, %v, want: %v", newID, err, storage.ErrMailboxFull)
+	}
+	if newID, err := mm.CopyMessage(ctx, "src", id, "dst"); err != storage.ErrMailboxFull {
+		t.Fatalf("got %q, %v copying, want: %v", newID, err, storage.ErrMailboxFull)
+	}
+	if m, err := mm.Store.GetMessage(ctx, "src", id); err != nil || m == nil {
+		t.Errorf("got %v, %v reading source, want: message", m, err)
+	}
+	if msgs, _ := mm.Store.GetMessages(ctx, "dst"); len(msgs) != 1 {
+		t.Errorf("got %v destination messages, want: 1", len(msgs))
+	}
+}
+
+// TestMoveMessageConcurrent verifies concurrent moves in opposite directions neither deadlock, nor
+// lose messages.
+func TestMoveMessageConcurrent(t *testing.T) {
+	mm := newMoveManager(t)
+	ctx := context.Background()
+	const count = 20
+	for i := 0; i < count; i++ {
+		importMove(t, mm, "alpha")
+		importMove(t, mm, "bravo")
+	}
+	move := func(src, dst string) {
+		msgs, err := mm.Store.GetMessages(ctx, src)
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		for _, m := range msgs {
+			if _, err := mm.MoveMessage(ctx, src, m.ID(), dst); err != nil {
+				t.Error(err)
+			}
+		}
+	}
+	var wg sync.WaitGroup
+	wg.Add(2)
+	go func() { defer wg.Done(); move("alpha", "bravo") }()
+	go func() { defer wg.Done(); move("bravo", "alpha") }()
+	wg.Wait()
+
+	total := 0
+	for _, name := range []string{"alpha", "bravo"} {
+		msgs, _ := mm.Store.GetMessages(ctx, name)
+		total += len(msgs)
+	}
+	if total != 2*count {
+		t.Errorf("got %v messages after moves, want: %v", total, 2*count)
+	}
+}
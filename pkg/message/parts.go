@@ -0,0 +1,110 @@
+package message
+
+import (
+	"encoding/base64"
+	"io"
+	"io/ioutil"
+	"mime"
+	"mime/multipart"
+	"mime/quotedprintable"
+	"net/mail"
+	"net/textproto"
+	"strings"
+)
+
+// Part is a decoded, non-multipart, MIME part of a message.
+type Part struct {
+	Index       int
+	ContentType string // Content-Type header, including parameters.
+	MediaType   string // Content-Type without parameters.
+	Filename    string
+	ContentID   string // Content-ID header, without angle brackets.
+	Content     []byte
+}
+
+// ReadParts parses the message source and returns its parts in depth-first order.  Multipart
+// entities nested more than maxDepth levels deep are not descended into.
+func ReadParts(r io.Reader, maxDepth int) ([]*Part, error) {
+	msg, err := mail.ReadMessage(r)
+	if err != nil {
+		return nil, err
+	}
+	pr := &partReader{maxDepth: maxDepth}
+	if err := pr.read(textproto.MIMEHeader(msg.Header), msg.Body, 0); err != nil {
+		return nil, err
+	}
+	return pr.parts, nil
+}
+
+// partReader accumulates the parts of a message as it is walked.
+type partReader struct {
+	maxDepth int
+	parts    []*Part
+}
+
+// read adds the entity with the specified header and body to parts, descending into multipart
+// entities.
+func (pr *partReader) read(header textproto.MIMEHeader, body io.Reader, depth int) error {
+	ctype := header.Get("Content-Type")
+	if ctype == "" {
+		ctype = "text/plain; charset=us-ascii"
+	}
+	mediatype, params, err := mime.ParseMediaType(ctype)
+	if err != nil {
+		// Serve malformed types as opaque data.
+		mediatype, params = "application/octet-stream", nil
+	}
+	if strings.HasPrefix(mediatype, "multipart/") && params["boundary"] != "" {
+		if depth >= pr.maxDepth {
+			return nil
+		}
+		mr := multipart.NewReader(body, params["boundary"])
+		for {
+			part, err := mr.NextPart()
+			if err == io.EOF {
+				return nil
+			}
+			if err != nil {
+				return err
+			}
+			if err := pr.read(part.Header, part, depth+1); err != nil {
+				return err
+			}
+		}
+	}
+	content, err := ioutil.ReadAll(decodeBody(header, body))
+	if err != nil {
+		return err
+	}
+	pr.parts = append(pr.parts, &Part{
+		Index:       len(pr.parts),
+		ContentType: ctype,
+		MediaType:   mediatype,
+		Filename:    partFilename(header, params),
+		ContentID:   strings.Trim(strings.TrimSpace(header.Get("Content-Id")), "<>"),
+		Content:     content,
+	})
+	return nil
+}
+
+// decodeBody wraps body with a decoder for its Content-Transfer-Encoding.
+func decodeBody(header textproto.MIMEHeader, body io.Reader) io.Reader {
+	switch strings.ToLower(strings.TrimSpace(header.Get("Content-Transfer-Encoding"))) {
+	case "base64":
+		return base64.NewDecoder(base64.StdEncoding, body)
+	case "quoted-printable":
+		return quotedprintable.NewReader(body)
+	}
+	return body
+}
+
+// partFilename returns the filename from the Content-Disposition header, falling back to the
+// Content-Type name parameter.
+func partFilename(header textproto.MIMEHeader, ctypeParams map[string]string) string {
+	if _, params, err := mime.ParseMediaType(header.Get("Content-Disposition")); err == nil {
+		if name := params["filename"]; name != "" {
+			return name
+		}
+	}
+	return ctypeParams["name"]
+}
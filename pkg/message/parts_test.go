@@ -0,0 +1,108 @@
+package message_test
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/inbucket/inbucket/pkg/message"
+)
+
+const (
+	plainMessage = "From: alice@host\r\nSubject: plain\r\n\r\nHello plain text\r\n"
+
+	qpMessage = "From: alice@host\r\nSubject: qp\r\n" +
+		"Content-Type: text/plain; charset=utf-8\r\n" +
+		"Content-Transfer-Encoding: quoted-printable\r\n\r\n" +
+		"caf=C3=A9\r\n"
+
+	mixedMessage = "From: alice@host\r\nSubject: mixed\r\nMIME-Version: 1.0\r\n" +
+		"Content-Type: multipart/mixed; boundary=outer\r\n\r\n" +
+		"--outer\r\n" +
+		"Content-Type: multipart/alternative; boundary=inner\r\n\r\n" +
+		"--inner\r\n" +
+		"Content-Type: text/plain; charset=us-ascii\r\n\r\n" +
+		"Text body\r\n" +
+		"--inner\r\n" +
+		"Content-Type: text/html; charset=us-ascii\r\n" +
+		"Content-Transfer-Encoding: quoted-printable\r\n\r\n" +
+		"<p>HTML=20body</p>\r\n" +
+		"--inner--\r\n" +
+		"--outer\r\n" +
+		"Content-Type: application/octet-stream; name=\"data.bin\"\r\n" +
+		"Content-Disposition: attachment; filename=\"report.bin\"\r\n" +
+		"Content-Transfer-Encoding: base64\r\n\r\n" +
+		"AAECA/8=\r\n" +
+		"--outer\r\n" +
+		"Content-Type: image/png; name=\"pixel.png\"\r\n" +
+		"Content-Transfer-Encoding: base64\r\n\r\n" +
+		"iVBORw0K\r\nGgo=\r\n" +
+		"--outer--\r\n"
+)
+
+func TestReadParts(t *testing.T) {
+	type want struct {
+		mediaType, filename, content string
+	}
+	testCases := []struct {
+		name     string
+		source   string
+		maxDepth int
+		want     []want
+	}{
+		{"plain", plainMessage, 10, []want{
+			{"text/plain", "", "Hello plain text\r\n"},
+		}},
+		{"quoted-printable", qpMessage, 10, []want{
+			{"text/plain", "", "café\r\n"},
+		}},
+		{"mixed", mixedMessage, 10, []want{
+			{"text/plain", "", "Text body"},
+			{"text/html", "", "<p>HTML body</p>"},
+			{"application/octet-stream", "report.bin", "\x00\x01\x02\x03\xff"},
+			{"image/png", "pixel.png", "\x89PNG\r\n\x1a\n"},
+		}},
+		{"depth limited", mixedMessage, 1, []want{
+			{"application/octet-stream", "report.bin", "\x00\x01\x02\x03\xff"},
+			{"image/png", "pixel.png", "\x89PNG\r\n\x1a\n"},
+		}},
+		{"depth zero", mixedMessage, 0, []want{}},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			parts, err := message.ReadParts(strings.NewReader(tc.source), tc.maxDepth)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(parts) != len(tc.want) {
+				t.Fatalf("Got %v parts, want: %v", len(parts), len(tc.want))
+			}
+			for i, w := range tc.want {
+				p := parts[i]
+				if p.Index != i {
+					t.Errorf("Part %v got index %v", i, p.Index)
+				}
+				if p.MediaType != w.mediaType {
+					t.Errorf("Part %v got media type %q, want: %q", i, p.MediaType, w.mediaType)
+				}
+				if p.Filename != w.filename {
+					t.Errorf("Part %v got filename %q, want: %q", i, p.Filename, w.filename)
+				}
+				if string(p.Content) != w.content {
+					t.Errorf("Part %v got content %q, want: %q", i, p.Content, w.content)
+				}
+			}
+		})
+	}
+}
+
+func TestReadPartsMalformed(t *testing.T) {
+	_, err := message.ReadParts(strings.NewReader("not a message"), 10)
+	if err == nil {
+		t.Error("Expected error for malformed message")
+	}
+	truncated := mixedMessage[:strings.Index(mixedMessage, "--inner--")]
+	_, err = message.ReadParts(strings.NewReader(truncated), 10)
+	if err == nil {
+		t.Error("Expected error for truncated multipart message")
+	}
+}
@@ -0,0 +1,64 @@
+package message
+
+import (
+	"net/mail"
+	"strings"
+
+	"github.com/inbucket/inbucket/pkg/config"
+	"github.com/jhillyerd/enmime"
+)
+
+const (
+	// SpamHeader is added, with the value yes, to the source of messages matching a spam rule.
+	SpamHeader = "X-Inbucket-Spam"
+
+	// SpamTag is the tag given to messages matching a spam rule.
+	SpamTag = "spam"
+
+	// SpamMailboxPrefix is prepended to the mailbox name of messages quarantined by a spam rule.
+	SpamMailboxPrefix = "_spam_"
+)
+
+// IsSpam returns true if the message was flagged by a spam rule.
+func (m *Metadata) IsSpam() bool {
+	for _, t := range m.Tags {
+		if t == SpamTag {
+			return true
+		}
+	}
+	return false
+}
+
+// matchSpamRule returns the first rule matching the message, or nil if none match.
+func matchSpamRule(
+	rules []config.SpamRule, from *mail.Address, env *enmime.Envelope) *config.SpamRule {
+	if len(rules) == 0 {
+		return nil
+	}
+	subject := strings.ToLower(env.GetHeader("Subject"))
+	domain := ""
+	if i := strings.LastIndex(from.Address, "@"); i >= 0 {
+		domain = strings.ToLower(from.Address[i+1:])
+	}
+	var body string
+	for i := range rules {
+		r := &rules[i]
+		if r.SubjectContains != "" &&
+			!strings.Contains(subject, strings.ToLower(r.SubjectContains)) {
+			continue
+		}
+		if r.FromDomain != "" && !strings.EqualFold(r.FromDomain, domain) {
+			continue
+		}
+		if r.BodyContains != "" {
+			if body == "" {
+				body = strings.ToLower(env.Text + "\n" + env.HTML)
+			}
+			if !strings.Contains(body, strings.ToLower(r.BodyContains)) {
+				continue
+			}
+		}
+		return r
+	}
+	return nil
+}
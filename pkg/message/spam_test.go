@@ -0,0 +1,76 @@
+package message_test
+
+import (
+	"context"
+	"io/ioutil"
+	"strings"
+	"testing"
+
+	"github.com/inbucket/inbucket/pkg/config"
+	"github.com/inbucket/inbucket/pkg/message"
+	"github.com/inbucket/inbucket/pkg/policy"
+	"github.com/inbucket/inbucket/pkg/storage/mem"
+)
+
+func TestDeliverSpam(t *testing.T) {
+	store, err := mem.New(config.Storage{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	mm := &message.StoreManager{
+		Store: store,
+		SpamRules: []config.SpamRule{
+			{SubjectContains: "free money", Action: config.SpamTag},
+			{FromDomain: "spam.example", Action: config.SpamQuarantine},
+			{BodyContains: "unsubscribe", Action: config.SpamTag},
+			{SubjectContains: "both", FromDomain: "both.example", Action: config.SpamQuarantine},
+		},
+	}
+	testCases := []struct {
+		name, from, subject, body, mailbox string
+		spam                               bool
+	}{
+		{"clean", "alice@example.com", "Hello", "Hi Bob", "bob", false},
+		{"subject", "alice@example.com", "Get FREE money now", "Hi Bob", "bob", true},
+		{"from domain", "eve@SPAM.example", "Hello", "Hi Bob", "_spam_bob", true},
+		{"body", "alice@example.com", "Hello", "Click to Unsubscribe", "bob", true},
+		{"partial rule", "alice@example.com", "both", "Hi Bob", "bob", false},
+		{"whole rule", "alice@both.example", "both", "Hi Bob", "_spam_bob", true},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			ctx := context.Background()
+			source := "From: " + tc.from + "\r\nTo: bob@example.com\r\nSubject: " + tc.subject +
+				"\r\n\r\n" + tc.body + "\r\n"
+			to := &policy.Recipient{Mailbox: "bob"}
+			id, err := mm.Deliver(ctx, to, tc.from, "", "", []*policy.Recipient{to},
+				"Received: by test\r\n", []byte(source))
+			if err != nil {
+				t.Fatal(err)
+			}
+			msg, err := mm.GetMessage(ctx, tc.mailbox, id)
+			if err != nil || msg == nil {
+				t.Fatalf("GetMessage(%q, %q) = %v, %v", tc.mailbox, id, msg, err)
+			}
+			if got := msg.IsSpam(); got != tc.spam {
+				t.Errorf("Got spam %v, want: %v", got, tc.spam)
+			}
+			r, err := mm.SourceReader(ctx, tc.mailbox, id)
+			if err != nil {
+				t.Fatal(err)
+			}
+			b, err := ioutil.ReadAll(r)
+			_ = r.Close()
+			if err != nil {
+				t.Fatal(err)
+			}
+			header := strings.Contains(string(b), "\r\nX-Inbucket-Spam: yes\r\n")
+			if header != tc.spam {
+				t.Errorf("Got spam header %v, want: %v in:\n%s", header, tc.spam, b)
+			}
+			if msg.Size != int64(len(b)) {
+				t.Errorf("Got size %v, want: %v", msg.Size, len(b))
+			}
+		})
+	}
+}
@@ -0,0 +1,171 @@
+package message
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	htmltemplate "html/template"
+	"io/ioutil"
+	"mime"
+	"mime/quotedprintable"
+	"net/mail"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"text/template"
+	"time"
+)
+
+// TemplateExt is the file name extension of message templates.
+const TemplateExt = ".tmpl"
+
+var (
+	// ErrNoTemplate is returned by Generate when the named template does not exist.
+	ErrNoTemplate = errors.New("template does not exist")
+
+	// templateName matches valid template names, which must not traverse directories.
+	templateName = regexp.MustCompile(`^[A-Za-z0-9_-]+$`)
+
+	// templateSection matches the comments starting each section of a template, capturing the
+	// section name and optional content type.
+	templateSection = regexp.MustCompile(`(?m)^\{\{/\* *([A-Za-z]+) *([^ */]+/[^ *]+)? *\*/\}\}\r?\n`)
+)
+
+// TemplateError reports a template which could not be rendered into a valid message.
+type TemplateError struct {
+	Name string
+	Err  error
+}
+
+func (e *TemplateError) Error() string {
+	return fmt.Sprintf("template %q: %v", e.Name, e.Err)
+}
+
+// Generate renders the named template file in dir with vars, and returns the source of the
+// resulting message.  A template contains From, To, Subject, and Body sections, each started by a
+// line holding only a comment with the section name, such as `{{/* Subject */}}`.  The Body
+// comment may name the content type of the body, `{{/* Body text/html */}}`; an HTML body is
+// rendered with html/template so that vars are escaped.  The content type defaults to text/plain.
+func Generate(dir, name string, vars map[string]interface{}) ([]byte, error) {
+	if !templateName.MatchString(name) {
+		return nil, ErrNoTemplate
+	}
+	text, err := ioutil.ReadFile(filepath.Join(dir, name+TemplateExt))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, ErrNoTemplate
+		}
+		return nil, err
+	}
+	source, err := generate(name, string(text), vars)
+	if err != nil {
+		return nil, &TemplateError{Name: name, Err: err}
+	}
+	return source, nil
+}
+
+// generate renders the template text with vars, see Generate.
+func generate(name, text string, vars map[string]interface{}) ([]byte, error) {
+	sections := make(map[string]string)
+	bodyType := "text/plain"
+	locs := templateSection.FindAllStringSubmatchIndex(text, -1)
+	if len(locs) == 0 {
+		return nil, errors.New("no sections found")
+	}
+	for i, loc := range locs {
+		section := text[loc[2]:loc[3]]
+		switch section {
+		case "From", "To", "Subject", "Body":
+		default:
+			return nil, fmt.Errorf("unknown %v section", section)
+		}
+		end := len(text)
+		if i+1 < len(locs) {
+			end = locs[i+1][0]
+		}
+		if _, ok := sections[section]; ok {
+			return nil, fmt.Errorf("duplicate %v section", section)
+		}
+		sections[section] = text[loc[1]:end]
+		if section == "Body" && loc[4] >= 0 {
+			bodyType = text[loc[4]:loc[5]]
+		}
+	}
+	header := make(map[string]string)
+	for _, section := range []string{"From", "To", "Subject", "Body"} {
+		tmpl, ok := sections[section]
+		if !ok {
+			return nil, fmt.Errorf("missing %v section", section)
+		}
+		if section == "Body" {
+			continue
+		}
+		value, err := execute(name, tmpl, vars, false)
+		if err != nil {
+			return nil, err
+		}
+		// Fold the section into a single header line.
+		header[section] = strings.Join(strings.Fields(value), " ")
+	}
+	mediatype, _, err := mime.ParseMediaType(bodyType)
+	if err != nil || !strings.HasPrefix(mediatype, "text/") {
+		return nil, fmt.Errorf("invalid body content type %q", bodyType)
+	}
+	body, err := execute(name, sections["Body"], vars, mediatype == "text/html")
+	if err != nil {
+		return nil, err
+	}
+
+	// Validate the addresses, and encode them in case they contain non-ASCII names.
+	for _, h := range []string{"From", "To"} {
+		addrs, err := mail.ParseAddressList(header[h])
+		if err != nil {
+			return nil, fmt.Errorf("invalid %v address: %v", h, err)
+		}
+		list := make([]string, len(addrs))
+		for i, a := range addrs {
+			list[i] = a.String()
+		}
+		header[h] = strings.Join(list, ", ")
+	}
+
+	b := &bytes.Buffer{}
+	fmt.Fprintf(b, "From: %s\r\n", header["From"])
+	fmt.Fprintf(b, "To: %s\r\n", header["To"])
+	fmt.Fprintf(b, "Subject: %s\r\n", mime.QEncoding.Encode("utf-8", header["Subject"]))
+	fmt.Fprintf(b, "Date: %s\r\n", time.Now().Format(time.RFC1123Z))
+	b.WriteString("MIME-Version: 1.0\r\n")
+	fmt.Fprintf(b, "Content-Type: %s; charset=utf-8\r\n", mediatype)
+	b.WriteString("Content-Transfer-Encoding: quoted-printable\r\n\r\n")
+	// Normalize line endings to CRLF, which quoted-printable preserves as line breaks.
+	body = strings.ReplaceAll(strings.TrimRight(body, "\r\n"), "\r\n", "\n")
+	body = strings.ReplaceAll(body, "\n", "\r\n") + "\r\n"
+	qp := quotedprintable.NewWriter(b)
+	if _, err := qp.Write([]byte(body)); err != nil {
+		return nil, err
+	}
+	if err := qp.Close(); err != nil {
+		return nil, err
+	}
+	return b.Bytes(), nil
+}
+
+// execute renders a single template section, escaping vars for HTML if html is true.
+func execute(name, text string, vars map[string]interface{}, html bool) (string, error) {
+	b := &strings.Builder{}
+	if html {
+		t, err := htmltemplate.New(name).Parse(text)
+		if err != nil {
+			return "", err
+		}
+		err = t.Execute(b, vars)
+		return b.String(), err
+	}
+	t, err := template.New(name).Parse(text)
+	if err != nil {
+		return "", err
+	}
+	err = t.Execute(b, vars)
+	return b.String(), err
+}
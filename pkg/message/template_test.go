@@ -0,0 +1,54 @@
+package message
+
+import (
+	"bytes"
+	"net/mail"
+	"strings"
+	"testing"
+)
+
+func TestGenerate(t *testing.T) {
+	const valid = "{{/* From */}}\nfrom@example.com\n{{/* To */}}\n{{.to}}\n" +
+		"{{/* Subject */}}\n{{.subject}}\n"
+	vars := map[string]interface{}{
+		"to":      "José <jose@example.com>",
+		"subject": "Line\r\nBcc: injected@example.com",
+	}
+
+	source, err := generate("t", valid+"{{/* Body */}}\n{{.subject}}\n", vars)
+	if err != nil {
+		t.Fatal(err)
+	}
+	msg, err := mail.ReadMessage(bytes.NewReader(source))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := msg.Header.Get("Subject"), "Line Bcc: injected@example.com"; got != want {
+		t.Errorf("Got subject %q, want: %q", got, want)
+	}
+	if got := msg.Header.Get("Bcc"); got != "" {
+		t.Errorf("Got Bcc %q, want none", got)
+	}
+	if to, err := msg.Header.AddressList("To"); err != nil || to[0].Name != "José" {
+		t.Errorf("Got To %v, %v, want: José", to, err)
+	}
+	if got := msg.Header.Get("Content-Type"); got != "text/plain; charset=utf-8" {
+		t.Errorf("Got content type %q, want: text/plain", got)
+	}
+
+	invalid := map[string]string{
+		"no sections":  "Just a body",
+		"missing":      "{{/* From */}}\nfrom@example.com\n{{/* Body */}}\nBody\n",
+		"duplicate":    valid + "{{/* To */}}\nother@example.com\n{{/* Body */}}\nBody\n",
+		"unknown":      valid + "{{/* Cc */}}\nother@example.com\n{{/* Body */}}\nBody\n",
+		"content type": valid + "{{/* Body image/png */}}\nBody\n",
+		"syntax":       valid + "{{/* Body */}}\n{{.subject\n",
+		"address": strings.Replace(valid, "from@example.com", "not an address", 1) +
+			"{{/* Body */}}\n",
+	}
+	for name, text := range invalid {
+		if _, err := generate(name, text, vars); err == nil {
+			t.Errorf("Got nil error for %v template, want error", name)
+		}
+	}
+}
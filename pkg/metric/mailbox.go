@@ -0,0 +1,37 @@
+package metric
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var (
+	// MailboxMessages tracks the number of messages stored in each mailbox.
+	MailboxMessages = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: "inbucket",
+		Name:      "mailbox_messages",
+		Help:      "Number of messages stored in the mailbox.",
+	}, []string{"mailbox"})
+
+	// MailboxBytes tracks the total size of the messages stored in each mailbox.
+	MailboxBytes = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: "inbucket",
+		Name:      "mailbox_bytes",
+		Help:      "Total size of the messages stored in the mailbox.",
+	}, []string{"mailbox"})
+)
+
+func init() {
+	prometheus.MustRegister(MailboxMessages, MailboxBytes)
+}
+
+// SetMailbox records the message count and total size of the named mailbox.  Empty mailboxes are
+// removed from the gauges.
+func SetMailbox(mailbox string, count int, size int64) {
+	if count == 0 {
+		MailboxMessages.DeleteLabelValues(mailbox)
+		MailboxBytes.DeleteLabelValues(mailbox)
+		return
+	}
+	MailboxMessages.WithLabelValues(mailbox).Set(float64(count))
+	MailboxBytes.WithLabelValues(mailbox).Set(float64(size))
+}
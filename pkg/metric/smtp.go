@@ -0,0 +1,17 @@
+package metric
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// SMTPNoops counts NOOP commands received by the SMTP server, which monitoring tools send to check
+// that it is alive.
+var SMTPNoops = prometheus.NewCounter(prometheus.CounterOpts{
+	Namespace: "inbucket",
+	Name:      "smtp_noop_total",
+	Help:      "Number of SMTP NOOP commands received.",
+})
+
+func init() {
+	prometheus.MustRegister(SMTPNoops)
+}
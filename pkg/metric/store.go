@@ -0,0 +1,40 @@
+package metric
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// Outcome label values.
+const (
+	OutcomeSuccess = "success"
+	OutcomeError   = "error"
+)
+
+var (
+	// StoreAddSeconds tracks the duration of message store AddMessage calls.
+	StoreAddSeconds = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: "inbucket",
+		Name:      "store_add_message_duration_seconds",
+		Help:      "Duration of message store AddMessage calls.",
+		Buckets:   []float64{.001, .0025, .005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10},
+	}, []string{"outcome"})
+
+	// StoreOperations counts message store calls, other than AddMessage.
+	StoreOperations = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "inbucket",
+		Name:      "store_operations_total",
+		Help:      "Number of message store operations.",
+	}, []string{"operation", "outcome"})
+)
+
+func init() {
+	prometheus.MustRegister(StoreAddSeconds, StoreOperations)
+}
+
+// Outcome returns the outcome label value for err.
+func Outcome(err error) string {
+	if err != nil {
+		return OutcomeError
+	}
+	return OutcomeSuccess
+}
@@ -67,11 +67,11 @@ func (hub *Hub) Dispatch(msg Message) {
 			// Add to history buffer
 			h.history.Value = msg
 			h.history = h.history.Next()
-			// Deliver message to all listeners, removing listeners if they return an error
-			for l := range h.listeners {
-				if err := l.Receive(msg); err != nil {
-					delete(h.listeners, l)
-				}
+		}
+		// Deliver message to all listeners, removing listeners if they return an error
+		for l := range h.listeners {
+			if err := l.Receive(msg); err != nil {
+				delete(h.listeners, l)
 			}
 		}
 	}
@@ -71,6 +71,22 @@ func TestHubZeroLen(t *testing.T) {
 	// Just making sure Hub doesn't panic
 }
 
+func TestHubZeroLenListener(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	hub := New(ctx, 0)
+	l := newTestListener(1)
+	hub.AddListener(l)
+	hub.Dispatch(Message{})
+	// Listeners should receive new messages even though there is no history
+	select {
+	case <-l.done:
+		break
+	case <-time.After(time.Second):
+		t.Error("Timeout:", l)
+	}
+}
+
 func TestHubZeroListeners(t *testing.T) {
 	ctx, cancel := context.WithCancel(context.Background())
 	defer cancel()
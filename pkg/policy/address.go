@@ -3,6 +3,7 @@ package policy
 import (
 	"bytes"
 	"fmt"
+	"net"
 	"net/mail"
 	"strings"
 
@@ -13,20 +14,41 @@ import (
 // Addressing handles email address policy.
 type Addressing struct {
 	Config *config.Root
+	// MailboxPolicy controls mailbox naming, DefaultMailboxPolicy is used if nil.
+	MailboxPolicy *MailboxPolicy
+	// MailboxExists is used by Route to find recipients without a mailbox, catch-all routing is
+	// disabled if nil.
+	MailboxExists MailboxProbe
 }
 
 // ExtractMailbox extracts the mailbox name from a partial email address.
 func (a *Addressing) ExtractMailbox(address string) (string, error) {
+	if a.Config.MailboxNaming == config.DomainNaming && strings.HasPrefix(address, "[") {
+		// Mailbox lookup of an address literal via the API.
+		if _, _, ok := parseAddressLiteral(address); !ok {
+			return "", fmt.Errorf("Address literal %q failed validation", address)
+		}
+		return canonicalDomain(address), nil
+	}
 	local, domain, err := parseEmailAddress(address)
 	if err != nil {
 		return "", err
 	}
+	domain = canonicalDomain(domain)
 	local, err = parseMailboxName(local)
 	if err != nil {
 		return "", err
 	}
+	mbPolicy := a.MailboxPolicy
+	if mbPolicy == nil {
+		mbPolicy = &DefaultMailboxPolicy
+	}
+	local, err = mbPolicy.localMailbox(local)
+	if err != nil {
+		return "", err
+	}
 	if a.Config.MailboxNaming == config.LocalNaming {
-		return local, nil
+		return mbPolicy.subdomainMailbox(local, domain), nil
 	}
 	if a.Config.MailboxNaming == config.DomainNaming {
 		// If no domain is specified, assume this is being
@@ -66,13 +88,17 @@ func (a *Addressing) NewRecipient(address string) (*Recipient, error) {
 	}
 	ar, err := mail.ParseAddress(address)
 	if err != nil {
-		return nil, err
+		if domain[0] != '[' {
+			return nil, err
+		}
+		// Older versions of net/mail do not support address literals.
+		ar = &mail.Address{Address: address}
 	}
 	return &Recipient{
 		Address:    *ar,
 		addrPolicy: a,
 		LocalPart:  local,
-		Domain:     domain,
+		Domain:     canonicalDomain(domain),
 		Mailbox:    mailbox,
 	}, nil
 }
@@ -119,12 +145,16 @@ func ParseEmailAddress(address string) (local string, domain string, err error)
 	return local, domain, nil
 }
 
-// ValidateDomainPart returns true if the domain part complies to RFC3696, RFC1035. Used by
-// ParseEmailAddress().
+// ValidateDomainPart returns true if the domain part complies to RFC3696, RFC1035, or is an
+// RFC5321 address literal. Used by ParseEmailAddress().
 func ValidateDomainPart(domain string) bool {
 	if len(domain) == 0 {
 		return false
 	}
+	if domain[0] == '[' {
+		_, _, ok := parseAddressLiteral(domain)
+		return ok
+	}
 	if len(domain) > 255 {
 		return false
 	}
@@ -168,6 +198,47 @@ func ValidateDomainPart(domain string) bool {
 	return true
 }
 
+// parseAddressLiteral parses an RFC5321 address literal domain, such as [192.0.2.1] or
+// [IPv6:2001:db8::1].  ok is false if domain is not a valid address literal.
+func parseAddressLiteral(domain string) (ip net.IP, v6 bool, ok bool) {
+	if len(domain) < 2 || domain[0] != '[' || domain[len(domain)-1] != ']' {
+		return nil, false, false
+	}
+	addr := domain[1 : len(domain)-1]
+	if len(addr) > 5 && strings.EqualFold(addr[:5], "IPv6:") {
+		addr = addr[5:]
+		// net.ParseIP also accepts IPv4 dotted decimal, which is not valid here.
+		if !strings.Contains(addr, ":") {
+			return nil, false, false
+		}
+		ip = net.ParseIP(addr)
+		return ip, true, ip != nil
+	}
+	if strings.Contains(addr, ":") {
+		// General address literals are not supported.
+		return nil, false, false
+	}
+	ip = net.ParseIP(addr)
+	return ip, false, ip != nil
+}
+
+// canonicalDomain returns address literals in a canonical lowercase form, such that each IP
+// address maps to a single mailbox; other domains are returned unchanged.
+func canonicalDomain(domain string) string {
+	ip, v6, ok := parseAddressLiteral(domain)
+	if !ok {
+		return domain
+	}
+	if !v6 {
+		return "[" + ip.String() + "]"
+	}
+	if ip4 := ip.To4(); ip4 != nil {
+		// net.IP formats IPv4-mapped addresses in dotted decimal only.
+		return "[ipv6:::ffff:" + ip4.String() + "]"
+	}
+	return "[ipv6:" + ip.String() + "]"
+}
+
 // parseEmailAddress unescapes an email address, and splits the local part from the domain part.  An
 // error is returned if the local part fails validation following the guidelines in RFC3696. The
 // domain part is optional and not validated.
@@ -308,8 +379,5 @@ func parseMailboxName(localPart string) (result string, err error) {
 	if len(invalid) > 0 {
 		return "", fmt.Errorf("Mailbox name contained invalid character(s): %q", invalid)
 	}
-	if idx := strings.Index(result, "+"); idx > -1 {
-		result = result[0:idx]
-	}
 	return result, nil
 }
@@ -342,6 +342,82 @@ func TestExtractMailboxInvalid(t *testing.T) {
 	}
 }
 
+func TestMailboxPolicy(t *testing.T) {
+	// Expected mailbox for each input, indexed by the policy flags; "" means rejected.
+	type want struct {
+		input   string
+		plain   string // No flags.
+		plus    string // AllowPlusAddressing.
+		strip   string // AllowPlusAddressing, StripPlusTag.
+		subPlus string // AllowPlusAddressing, SubdomainRouting.
+		subStrp string // AllowPlusAddressing, StripPlusTag, SubdomainRouting.
+		subOnly string // SubdomainRouting.
+	}
+	testTable := []want{
+		{"user", "user", "user", "user", "user", "user", "user"},
+		{"user@example.com", "user", "user", "user", "user", "user", "user"},
+		{"User@Sub.Example.com", "user", "user", "user", "user.sub", "user.sub", "user.sub"},
+		{"user@a.b.example.com", "user", "user", "user", "user.a.b", "user.a.b", "user.a.b"},
+		{"user@sub.example.co.uk", "user", "user", "user", "user.sub", "user.sub", "user.sub"},
+		{"user@example.co.uk", "user", "user", "user", "user", "user", "user"},
+		{"user@localhost", "user", "user", "user", "user", "user", "user"},
+		{"user+tag", "", "user+tag", "user", "user+tag", "user", ""},
+		{"user+tag@sub.example.com", "", "user+tag", "user", "user+tag.sub", "user.sub", ""},
+		{"+tag@example.com", "", "+tag", "", "+tag", "", ""},
+	}
+	for _, tc := range testTable {
+		for _, c := range []struct {
+			mbPolicy policy.MailboxPolicy
+			expect   string
+		}{
+			{policy.MailboxPolicy{}, tc.plain},
+			{policy.MailboxPolicy{StripPlusTag: true}, tc.plain},
+			{policy.MailboxPolicy{AllowPlusAddressing: true}, tc.plus},
+			{policy.MailboxPolicy{AllowPlusAddressing: true, StripPlusTag: true}, tc.strip},
+			{policy.MailboxPolicy{AllowPlusAddressing: true, SubdomainRouting: true}, tc.subPlus},
+			{policy.MailboxPolicy{AllowPlusAddressing: true, StripPlusTag: true,
+				SubdomainRouting: true}, tc.subStrp},
+			{policy.MailboxPolicy{SubdomainRouting: true}, tc.subOnly},
+			{policy.MailboxPolicy{StripPlusTag: true, SubdomainRouting: true}, tc.subOnly},
+		} {
+			mbPolicy := c.mbPolicy
+			ap := policy.Addressing{
+				Config:        &config.Root{MailboxNaming: config.LocalNaming},
+				MailboxPolicy: &mbPolicy,
+			}
+			// Routing decisions must be deterministic.
+			for i := 0; i < 3; i++ {
+				got, err := ap.ExtractMailbox(tc.input)
+				if c.expect == "" {
+					if err == nil {
+						t.Errorf("%+v: got %q for %q, want error", c.mbPolicy, got, tc.input)
+					}
+					continue
+				}
+				if err != nil {
+					t.Errorf("%+v: error for %q: %v", c.mbPolicy, tc.input, err)
+				} else if got != c.expect {
+					t.Errorf("%+v: got %q for %q, want: %q", c.mbPolicy, got, tc.input, c.expect)
+				}
+			}
+		}
+	}
+
+	// Subdomain routing only applies to local naming.
+	ap := policy.Addressing{
+		Config: &config.Root{MailboxNaming: config.FullNaming},
+		MailboxPolicy: &policy.MailboxPolicy{
+			AllowPlusAddressing: true, StripPlusTag: true, SubdomainRouting: true},
+	}
+	got, err := ap.ExtractMailbox("user+tag@sub.example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got != "user@sub.example.com" {
+		t.Errorf("got %q, want: %q", got, "user@sub.example.com")
+	}
+}
+
 func TestValidateDomain(t *testing.T) {
 	testTable := []struct {
 		input  string
@@ -365,6 +441,11 @@ func TestValidateDomain(t *testing.T) {
 		{strings.Repeat("a", 256), false, "Max domain length is 255"},
 		{strings.Repeat("a", 63) + ".com", true, "Should allow 63 char domain label"},
 		{strings.Repeat("a", 64) + ".com", false, "Max domain label length is 63"},
+		{"[192.0.2.1]", true, "IPv4 address literal is valid"},
+		{"[IPv6:2001:db8::1]", true, "IPv6 address literal is valid"},
+		{"[2001:db8::1]", false, "IPv6 address literal requires tag"},
+		{"[IPv6:192.0.2.1]", false, "IPv6 tag requires IPv6 address"},
+		{"[192.0.2.1", false, "Address literal must be closed"},
 	}
 	for _, tt := range testTable {
 		if policy.ValidateDomainPart(tt.input) != tt.expect {
@@ -373,6 +454,65 @@ func TestValidateDomain(t *testing.T) {
 	}
 }
 
+func TestAddressLiteral(t *testing.T) {
+	fullPolicy := policy.Addressing{Config: &config.Root{MailboxNaming: config.FullNaming}}
+	domainPolicy := policy.Addressing{Config: &config.Root{MailboxNaming: config.DomainNaming}}
+	testTable := []struct {
+		input  string // Domain part of address
+		domain string // Expected mailbox for domain naming, empty if invalid
+	}{
+		{"[IPv6:::1]", "[ipv6:::1]"},
+		{"[ipv6:::1]", "[ipv6:::1]"},
+		{"[IPv6:2001:db8::1]", "[ipv6:2001:db8::1]"},
+		{"[IPv6:2001:0DB8:0000:0000:0000:0000:0000:0001]", "[ipv6:2001:db8::1]"},
+		{"[IPv6:2001:db8:85a3:8d3:1319:8a2e:370:7348]", "[ipv6:2001:db8:85a3:8d3:1319:8a2e:370:7348]"},
+		{"[IPv6:::ffff:192.0.2.128]", "[ipv6:::ffff:192.0.2.128]"},
+		{"[IPv6:::FFFF:C000:0280]", "[ipv6:::ffff:192.0.2.128]"},
+		{"[IPv6:2001:db8::192.0.2.1]", "[ipv6:2001:db8::c000:201]"},
+		{"[192.0.2.1]", "[192.0.2.1]"},
+		{"[IPv6:]", ""},
+		{"[IPv6:192.0.2.1]", ""},
+		{"[IPv6:2001:db8::g]", ""},
+		{"[IPv6:2001:db8::1:2:3:4:5:6:7]", ""},
+		{"[IPv6:fe80::1%eth0]", ""},
+		{"[2001:db8::1]", ""},
+		{"[192.0.2.256]", ""},
+		{"[]", ""},
+	}
+	for _, tc := range testTable {
+		t.Run(tc.input, func(t *testing.T) {
+			full, err := fullPolicy.ExtractMailbox("user@" + tc.input)
+			if tc.domain == "" {
+				if err == nil {
+					t.Errorf("got %q, want error", full)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if want := "user@" + tc.domain; full != want {
+				t.Errorf("got full mailbox %q, want %q", full, want)
+			}
+			domain, err := domainPolicy.ExtractMailbox("user@" + tc.input)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if domain != tc.domain {
+				t.Errorf("got domain mailbox %q, want %q", domain, tc.domain)
+			}
+			// Mailbox lookup by address literal.
+			domain, err = domainPolicy.ExtractMailbox(tc.input)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if domain != tc.domain {
+				t.Errorf("got domain lookup mailbox %q, want %q", domain, tc.domain)
+			}
+		})
+	}
+}
+
 func TestValidateLocal(t *testing.T) {
 	testTable := []struct {
 		input  string
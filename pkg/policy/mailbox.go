@@ -0,0 +1,64 @@
+package policy
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/inbucket/inbucket/pkg/config"
+	"golang.org/x/net/publicsuffix"
+)
+
+// MailboxPolicy controls how the local and domain parts of an address are mapped to a mailbox
+// name.
+type MailboxPolicy struct {
+	// AllowPlusAddressing accepts local parts containing a +tag.
+	AllowPlusAddressing bool
+	// StripPlusTag routes user+tag to the user mailbox, requires AllowPlusAddressing.
+	StripPlusTag bool
+	// SubdomainRouting routes user@sub.example.com to the user.sub mailbox, when using local
+	// mailbox naming.
+	SubdomainRouting bool
+}
+
+// DefaultMailboxPolicy accepts plus addressing, and strips the tag.
+var DefaultMailboxPolicy = MailboxPolicy{AllowPlusAddressing: true, StripPlusTag: true}
+
+// NewMailboxPolicy creates a MailboxPolicy from the mailbox configuration.
+func NewMailboxPolicy(conf config.Mailbox) *MailboxPolicy {
+	return &MailboxPolicy{
+		AllowPlusAddressing: conf.AllowPlusAddressing,
+		StripPlusTag:        conf.StripPlusTag,
+		SubdomainRouting:    conf.SubdomainRouting,
+	}
+}
+
+// localMailbox applies the plus addressing policy to a validated, lowercase, local part.
+func (p *MailboxPolicy) localMailbox(local string) (string, error) {
+	idx := strings.Index(local, "+")
+	if idx == -1 {
+		return local, nil
+	}
+	if !p.AllowPlusAddressing {
+		return "", fmt.Errorf("Mailbox name %q contains a plus tag", local)
+	}
+	if p.StripPlusTag {
+		local = local[0:idx]
+		if local == "" {
+			return "", fmt.Errorf("Mailbox name cannot be empty")
+		}
+	}
+	return local, nil
+}
+
+// subdomainMailbox appends the subdomain labels of domain, if any, to the mailbox name.
+func (p *MailboxPolicy) subdomainMailbox(mailbox, domain string) string {
+	if !p.SubdomainRouting || domain == "" || domain[0] == '[' {
+		return mailbox
+	}
+	domain = strings.ToLower(strings.TrimSuffix(domain, "."))
+	base, err := publicsuffix.EffectiveTLDPlusOne(domain)
+	if err != nil || base == domain {
+		return mailbox
+	}
+	return mailbox + "." + strings.TrimSuffix(domain, "."+base)
+}
@@ -12,6 +12,8 @@ type Recipient struct {
 	Domain string
 	// Mailbox is the canonical mailbox name for this recipient.
 	Mailbox string
+	// Routing indicates if Mailbox was chosen by catch-all routing.
+	Routing RoutingDecision
 }
 
 // ShouldAccept returns true if Inbucket should accept mail for this recipient.
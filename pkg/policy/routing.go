@@ -0,0 +1,49 @@
+package policy
+
+import "context"
+
+// RoutingDecision indicates which mailbox mail for a recipient is delivered to.
+type RoutingDecision int
+
+// Routing decisions.
+const (
+	// Personal delivers to the recipient's own mailbox.
+	Personal RoutingDecision = iota
+	// CatchAll delivers to the catch-all mailbox, as the recipient does not have a mailbox.
+	CatchAll
+)
+
+func (d RoutingDecision) String() string {
+	switch d {
+	case Personal:
+		return "personal"
+	case CatchAll:
+		return "catch-all"
+	}
+	return "unknown"
+}
+
+// MailboxProbe returns true if the named mailbox exists.
+type MailboxProbe func(ctx context.Context, mailbox string) (bool, error)
+
+// Route chooses the mailbox mail for r will be delivered to, and must be called before the
+// message is received.  If a catch-all mailbox is configured and the mailbox of r does not exist,
+// r is re-routed to the catch-all mailbox.
+func (a *Addressing) Route(ctx context.Context, r *Recipient) (RoutingDecision, error) {
+	catchAll := a.Config.Mailbox.CatchAllMailbox
+	if catchAll == "" || a.MailboxExists == nil || r.Mailbox == catchAll {
+		r.Routing = Personal
+		return Personal, nil
+	}
+	exists, err := a.MailboxExists(ctx, r.Mailbox)
+	if err != nil {
+		return Personal, err
+	}
+	if exists {
+		r.Routing = Personal
+		return Personal, nil
+	}
+	r.Mailbox = catchAll
+	r.Routing = CatchAll
+	return CatchAll, nil
+}
@@ -0,0 +1,71 @@
+package policy_test
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/inbucket/inbucket/pkg/config"
+	"github.com/inbucket/inbucket/pkg/policy"
+)
+
+func TestRoute(t *testing.T) {
+	existing := map[string]bool{"alice": true}
+	probe := func(ctx context.Context, mailbox string) (bool, error) {
+		if mailbox == "broken" {
+			return false, errors.New("probe failed")
+		}
+		return existing[mailbox], nil
+	}
+	testCases := []struct {
+		name     string
+		catchAll string
+		probe    policy.MailboxProbe
+		address  string
+		want     policy.RoutingDecision
+		mailbox  string
+	}{
+		{"existing mailbox", "catchall", probe, "alice@example.com", policy.Personal, "alice"},
+		{"new mailbox", "catchall", probe, "bob@example.com", policy.CatchAll, "catchall"},
+		{"catch-all mailbox", "catchall", probe, "catchall@example.com", policy.Personal,
+			"catchall"},
+		{"not configured", "", probe, "bob@example.com", policy.Personal, "bob"},
+		{"no probe", "catchall", nil, "bob@example.com", policy.Personal, "bob"},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			ap := &policy.Addressing{
+				Config: &config.Root{MailboxNaming: config.LocalNaming,
+					Mailbox: config.Mailbox{CatchAllMailbox: tc.catchAll}},
+				MailboxExists: tc.probe,
+			}
+			r, err := ap.NewRecipient(tc.address)
+			if err != nil {
+				t.Fatal(err)
+			}
+			got, err := ap.Route(context.Background(), r)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got != tc.want || r.Routing != tc.want {
+				t.Errorf("Got decision %v, recipient %v, want: %v", got, r.Routing, tc.want)
+			}
+			if r.Mailbox != tc.mailbox {
+				t.Errorf("Got mailbox %q, want: %q", r.Mailbox, tc.mailbox)
+			}
+		})
+	}
+
+	ap := &policy.Addressing{
+		Config: &config.Root{MailboxNaming: config.LocalNaming,
+			Mailbox: config.Mailbox{CatchAllMailbox: "catchall"}},
+		MailboxExists: probe,
+	}
+	r, err := ap.NewRecipient("broken@example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := ap.Route(context.Background(), r); err == nil {
+		t.Error("Got nil error for failed probe")
+	}
+}
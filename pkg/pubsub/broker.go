@@ -0,0 +1,103 @@
+// Package pubsub notifies subscribers of changes to the contents of individual mailboxes.
+package pubsub
+
+import (
+	"sync"
+	"time"
+)
+
+// Length of each subscription's event queue.
+const subscriptionLen = 100
+
+// EventType describes the change to a mailbox.
+type EventType string
+
+const (
+	// MessageAdded events are published after a message has been stored.
+	MessageAdded EventType = "MessageAdded"
+	// MessageDeleted events are published after a message has been removed.
+	MessageDeleted EventType = "MessageDeleted"
+)
+
+// Event describes a change to a mailbox.  Only the Type, Mailbox and ID fields are populated for
+// MessageDeleted events.
+type Event struct {
+	Type    EventType
+	Mailbox string
+	ID      string
+	From    string
+	To      []string
+	Subject string
+	Date    time.Time
+	Size    int64
+}
+
+// Broker fans published events out to the subscribers of each mailbox.
+type Broker struct {
+	sync.RWMutex
+	subs map[string]map[*Subscription]struct{} // Subscriptions by mailbox name.
+}
+
+// Subscription receives the events published for a single mailbox.
+type Subscription struct {
+	// C receives events, it is closed by Unsubscribe.
+	C       <-chan Event
+	c       chan Event
+	broker  *Broker
+	mailbox string
+	once    sync.Once
+}
+
+// NewBroker creates an empty Broker.
+func NewBroker() *Broker {
+	return &Broker{subs: make(map[string]map[*Subscription]struct{})}
+}
+
+// Subscribe registers interest in events for the named mailbox.  The caller must Unsubscribe
+// when it is no longer interested.
+func (b *Broker) Subscribe(mailbox string) *Subscription {
+	c := make(chan Event, subscriptionLen)
+	s := &Subscription{C: c, c: c, broker: b, mailbox: mailbox}
+	b.Lock()
+	defer b.Unlock()
+	if b.subs[mailbox] == nil {
+		b.subs[mailbox] = make(map[*Subscription]struct{})
+	}
+	b.subs[mailbox][s] = struct{}{}
+	return s
+}
+
+// Publish delivers the event to each subscriber of its mailbox.  Publish never blocks; events are
+// dropped for subscribers that have fallen behind.
+func (b *Broker) Publish(e Event) {
+	b.RLock()
+	defer b.RUnlock()
+	for s := range b.subs[e.Mailbox] {
+		select {
+		case s.c <- e:
+		default:
+		}
+	}
+}
+
+// Subscribers returns the number of subscriptions to the named mailbox.
+func (b *Broker) Subscribers(mailbox string) int {
+	b.RLock()
+	defer b.RUnlock()
+	return len(b.subs[mailbox])
+}
+
+// Unsubscribe removes the subscription from its broker and closes C.  It is safe to call more
+// than once.
+func (s *Subscription) Unsubscribe() {
+	s.once.Do(func() {
+		b := s.broker
+		b.Lock()
+		defer b.Unlock()
+		delete(b.subs[s.mailbox], s)
+		if len(b.subs[s.mailbox]) == 0 {
+			delete(b.subs, s.mailbox)
+		}
+		close(s.c)
+	})
+}
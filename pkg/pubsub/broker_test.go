@@ -0,0 +1,67 @@
+package pubsub
+
+import (
+	"testing"
+)
+
+func TestBrokerFanOut(t *testing.T) {
+	b := NewBroker()
+	subs := []*Subscription{b.Subscribe("box"), b.Subscribe("box")}
+	other := b.Subscribe("other")
+	defer other.Unsubscribe()
+	b.Publish(Event{Type: MessageAdded, Mailbox: "box", ID: "1"})
+	for i, s := range subs {
+		select {
+		case e := <-s.C:
+			if e.ID != "1" {
+				t.Errorf("subscriber %v got ID %q, want: %q", i, e.ID, "1")
+			}
+		default:
+			t.Errorf("subscriber %v did not receive event", i)
+		}
+		s.Unsubscribe()
+	}
+	select {
+	case e := <-other.C:
+		t.Errorf("other mailbox received event: %+v", e)
+	default:
+	}
+}
+
+func TestBrokerUnsubscribe(t *testing.T) {
+	b := NewBroker()
+	s1 := b.Subscribe("box")
+	s2 := b.Subscribe("box")
+	if got := b.Subscribers("box"); got != 2 {
+		t.Fatalf("got %v subscribers, want: 2", got)
+	}
+	s1.Unsubscribe()
+	s1.Unsubscribe()
+	if got := b.Subscribers("box"); got != 1 {
+		t.Errorf("got %v subscribers, want: 1", got)
+	}
+	if _, ok := <-s1.C; ok {
+		t.Error("got open channel, want closed after Unsubscribe")
+	}
+	s2.Unsubscribe()
+	if got := b.Subscribers("box"); got != 0 {
+		t.Errorf("got %v subscribers, want: 0", got)
+	}
+	if len(b.subs) != 0 {
+		t.Errorf("got %v mailboxes, want: 0", len(b.subs))
+	}
+	// Publishing to a mailbox without subscribers must not panic.
+	b.Publish(Event{Type: MessageAdded, Mailbox: "box", ID: "1"})
+}
+
+func TestBrokerPublishDoesNotBlock(t *testing.T) {
+	b := NewBroker()
+	s := b.Subscribe("box")
+	defer s.Unsubscribe()
+	for i := 0; i < subscriptionLen*2; i++ {
+		b.Publish(Event{Type: MessageAdded, Mailbox: "box"})
+	}
+	if got := len(s.C); got != subscriptionLen {
+		t.Errorf("got %v queued events, want: %v", got, subscriptionLen)
+	}
+}
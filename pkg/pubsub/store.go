@@ -0,0 +1,87 @@
+package pubsub
+
+import (
+	"context"
+	"github.com/inbucket/inbucket/pkg/storage"
+	"github.com/inbucket/inbucket/pkg/stringutil"
+)
+
+// Store wraps a storage.Store, publishing an event to the Broker each time a message is added or
+// removed.
+type Store struct {
+	storage.Store
+	broker *Broker
+}
+
+var _ storage.Store = &Store{}
+var _ storage.Pager = &Store{}
+var _ storage.LatestVisitor = &Store{}
+
+// NewStore wraps store, publishing its changes to broker.
+func NewStore(store storage.Store, broker *Broker) *Store {
+	return &Store{Store: store, broker: broker}
+}
+
+// AddMessage stores the message, then publishes a MessageAdded event.  No event is published if
+// the store discarded the message.
+func (s *Store) AddMessage(ctx context.Context, m storage.Message) (string, error) {
+	id, err := s.Store.AddMessage(ctx, m)
+	if err != nil || id == "" {
+		return "", err
+	}
+	s.broker.Publish(Event{
+		Type:    MessageAdded,
+		Mailbox: m.Mailbox(),
+		ID:      id,
+		From:    stringutil.StringAddress(m.From()),
+		To:      stringutil.StringAddressList(m.To()),
+		Subject: m.Subject(),
+		Date:    m.Date(),
+		Size:    m.Size(),
+	})
+	return id, nil
+}
+
+// PurgeMessages deletes all messages in the named mailbox, publishing a MessageDeleted event for
+// each.
+func (s *Store) PurgeMessages(ctx context.Context, mailbox string) error {
+	var ids []string
+	if s.broker.Subscribers(mailbox) > 0 {
+		messages, err := s.Store.GetMessages(ctx, mailbox)
+		if err != nil {
+			return err
+		}
+		for _, m := range messages {
+			ids = append(ids, m.ID())
+		}
+	}
+	if err := s.Store.PurgeMessages(ctx, mailbox); err != nil {
+		return err
+	}
+	for _, id := range ids {
+		s.broker.Publish(Event{Type: MessageDeleted, Mailbox: mailbox, ID: id})
+	}
+	return nil
+}
+
+// RemoveMessage deletes the message, then publishes a MessageDeleted event.
+func (s *Store) RemoveMessage(ctx context.Context, mailbox, id string) error {
+	if err := s.Store.RemoveMessage(ctx, mailbox, id); err != nil {
+		return err
+	}
+	s.broker.Publish(Event{Type: MessageDeleted, Mailbox: mailbox, ID: id})
+	return nil
+}
+
+// PageMessages returns a page of messages from the named mailbox, see storage.Pager.
+func (s *Store) PageMessages(ctx context.Context, mailbox, after string, limit int,
+	match func(storage.Message) bool) ([]storage.Message, bool, error) {
+	return storage.PageMessages(ctx, s.Store, mailbox, after, limit, match)
+}
+
+// VisitLatestMessages calls f with the latest message of each non-empty mailbox, see
+// storage.LatestVisitor.
+func (s *Store) VisitLatestMessages(
+	ctx context.Context, f func(latest storage.Message) (cont bool)) error {
+	return storage.VisitLatestMessages(ctx, s.Store, f)
+}
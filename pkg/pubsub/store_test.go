@@ -0,0 +1,83 @@
+package pubsub
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/inbucket/inbucket/pkg/config"
+	"github.com/inbucket/inbucket/pkg/storage/mem"
+	"github.com/inbucket/inbucket/pkg/test"
+)
+
+func TestStorePublishes(t *testing.T) {
+	ms, err := mem.New(config.Storage{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	b := NewBroker()
+	s := NewStore(ms, b)
+	sub := b.Subscribe("box")
+	defer sub.Unsubscribe()
+
+	id1, _ := test.DeliverToStore(t, s, "box", "subject 1", time.Now())
+	id2, _ := test.DeliverToStore(t, s, "box", "subject 2", time.Now())
+	test.DeliverToStore(t, s, "other", "subject 3", time.Now())
+	if err := s.RemoveMessage(context.Background(), "box", id1); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.PurgeMessages(context.Background(), "box"); err != nil {
+		t.Fatal(err)
+	}
+
+	want := []Event{
+		{Type: MessageAdded, Mailbox: "box", ID: id1, Subject: "subject 1"},
+		{Type: MessageAdded, Mailbox: "box", ID: id2, Subject: "subject 2"},
+		{Type: MessageDeleted, Mailbox: "box", ID: id1},
+		{Type: MessageDeleted, Mailbox: "box", ID: id2},
+	}
+	for _, w := range want {
+		select {
+		case got := <-sub.C:
+			if got.Type != w.Type || got.Mailbox != w.Mailbox || got.ID != w.ID ||
+				got.Subject != w.Subject {
+				t.Errorf("got event %+v, want: %+v", got, w)
+			}
+		default:
+			t.Fatalf("missing event %+v", w)
+		}
+	}
+	select {
+	case got := <-sub.C:
+		t.Errorf("got unexpected event %+v", got)
+	default:
+	}
+}
+
+func TestStoreDiscarded(t *testing.T) {
+	ms, err := mem.New(config.Storage{
+		MailboxMsgCap: 1, OverflowPolicy: config.OverflowDropNewest})
+	if err != nil {
+		t.Fatal(err)
+	}
+	b := NewBroker()
+	s := NewStore(ms, b)
+	sub := b.Subscribe("box")
+	defer sub.Unsubscribe()
+
+	id, _ := test.DeliverToStore(t, s, "box", "subject 1", time.Now())
+	test.DeliverToStore(t, s, "box", "subject 2", time.Now())
+	select {
+	case got := <-sub.C:
+		if got.ID != id {
+			t.Errorf("got event %+v, want ID: %q", got, id)
+		}
+	default:
+		t.Fatal("missing event")
+	}
+	select {
+	case got := <-sub.C:
+		t.Errorf("got unexpected event %+v", got)
+	default:
+	}
+}
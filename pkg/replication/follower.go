@@ -0,0 +1,224 @@
+package replication
+
+import (
+	"bytes"
+	"context"
+	"encoding/gob"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/inbucket/inbucket/pkg/config"
+	"github.com/inbucket/inbucket/pkg/storage"
+	"github.com/rs/zerolog/log"
+)
+
+// StateFile is the name of the file in the root of a replica store holding its progress through
+// the replication log of the primary.
+const StateFile = "replication.state"
+
+// state is the progress of a Follower, persisted so a restarted replica resumes where it left off.
+type state struct {
+	Offset int64
+	// IDs maps mailbox and primary message ID to the ID of the local copy, where they differ.
+	IDs map[string]map[string]string
+}
+
+// Follower polls the replication log of a primary, applying each event to the local store.
+type Follower struct {
+	logURL    string
+	user      *url.Userinfo
+	store     storage.Store
+	interval  time.Duration
+	client    *http.Client
+	statePath string
+	state     state
+}
+
+// NewFollower creates a Follower of the primary at conf.ReplicateFrom, which applies events to
+// store.  Progress is saved in statePath, or held in memory if statePath is empty.
+func NewFollower(conf config.Storage, store storage.Store, statePath string) (*Follower, error) {
+	u, err := url.Parse(conf.ReplicateFrom)
+	if err != nil {
+		return nil, fmt.Errorf("invalid ReplicateFrom URL: %v", err)
+	}
+	if u.Scheme != "http" && u.Scheme != "https" {
+		return nil, fmt.Errorf("invalid ReplicateFrom URL %q: scheme must be http or https",
+			conf.ReplicateFrom)
+	}
+	user := u.User
+	u.User = nil
+	u.Path = strings.TrimSuffix(u.Path, "/") + "/admin/replication/log"
+	f := &Follower{
+		logURL:    u.String(),
+		user:      user,
+		store:     store,
+		interval:  conf.ReplicationInterval,
+		client:    &http.Client{Timeout: 30 * time.Second},
+		statePath: statePath,
+		state:     state{IDs: make(map[string]map[string]string)},
+	}
+	if err := f.loadState(); err != nil {
+		return nil, err
+	}
+	return f, nil
+}
+
+// Start polls the primary until ctx is canceled.
+func (f *Follower) Start(ctx context.Context) {
+	log.Info().Str("module", "replication").Str("primary", f.logURL).
+		Int64("offset", f.state.Offset).Msg("Replicating from primary")
+	go func() {
+		for {
+			for {
+				n, err := f.poll(ctx)
+				if err != nil {
+					if ctx.Err() == nil {
+						log.Warn().Str("module", "replication").Err(err).
+							Msg("Failed to replicate from primary")
+					}
+					break
+				}
+				if n == 0 {
+					break
+				}
+			}
+			select {
+			case <-ctx.Done():
+				return
+			case <-time.After(f.interval):
+			}
+		}
+	}()
+}
+
+// poll fetches and applies the next events in the log of the primary, returning how many were
+// applied.
+func (f *Follower) poll(ctx context.Context) (int, error) {
+	q := url.Values{}
+	q.Set("offset", strconv.FormatInt(f.state.Offset, 10))
+	req, err := http.NewRequestWithContext(ctx, "GET", f.logURL+"?"+q.Encode(), nil)
+	if err != nil {
+		return 0, err
+	}
+	if f.user != nil {
+		password, _ := f.user.Password()
+		req.SetBasicAuth(f.user.Username(), password)
+	}
+	resp, err := f.client.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return 0, fmt.Errorf("primary returned %v", resp.Status)
+	}
+	b, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return 0, err
+	}
+	applied := 0
+	defer func() {
+		if applied > 0 {
+			f.saveState()
+		}
+	}()
+	for len(b) > 0 {
+		e, n, err := decodeEvent(b)
+		if err != nil {
+			return applied, err
+		}
+		if err := f.apply(ctx, e); err != nil {
+			return applied, fmt.Errorf("applying event for %v/%v: %v", e.Mailbox, e.ID, err)
+		}
+		b = b[n:]
+		f.state.Offset += int64(n)
+		applied++
+	}
+	return applied, nil
+}
+
+// apply makes the change recorded by e to the local store.
+func (f *Follower) apply(ctx context.Context, e *Event) error {
+	switch e.Op {
+	case OpAdd:
+		var id string
+		var err error
+		if im, ok := f.store.(storage.Importer); ok {
+			id, err = im.ImportMessage(ctx, &eventMessage{e})
+		} else {
+			id, err = f.store.AddMessage(ctx, &eventMessage{e})
+		}
+		if err != nil {
+			return err
+		}
+		if id != e.ID {
+			if f.state.IDs[e.Mailbox] == nil {
+				f.state.IDs[e.Mailbox] = make(map[string]string)
+			}
+			f.state.IDs[e.Mailbox][e.ID] = id
+		}
+	case OpRemove:
+		id := e.ID
+		if local, ok := f.state.IDs[e.Mailbox][e.ID]; ok {
+			id = local
+			delete(f.state.IDs[e.Mailbox], e.ID)
+		}
+		err := f.store.RemoveMessage(ctx, e.Mailbox, id)
+		if err != nil && err != storage.ErrNotExist {
+			return err
+		}
+	case OpPurge:
+		delete(f.state.IDs, e.Mailbox)
+		return f.store.PurgeMessages(ctx, e.Mailbox)
+	default:
+		return fmt.Errorf("unknown replication op %v", e.Op)
+	}
+	return nil
+}
+
+// loadState reads the saved progress of the Follower, if any.
+func (f *Follower) loadState() error {
+	if f.statePath == "" {
+		return nil
+	}
+	b, err := ioutil.ReadFile(f.statePath)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+	if err := gob.NewDecoder(bytes.NewReader(b)).Decode(&f.state); err != nil {
+		return fmt.Errorf("reading replication state %v: %v", f.statePath, err)
+	}
+	if f.state.IDs == nil {
+		f.state.IDs = make(map[string]map[string]string)
+	}
+	return nil
+}
+
+// saveState writes the progress of the Follower, replacing the file so it is never left partially
+// written.
+func (f *Follower) saveState() {
+	if f.statePath == "" {
+		return
+	}
+	buf := new(bytes.Buffer)
+	err := gob.NewEncoder(buf).Encode(&f.state)
+	if err == nil {
+		tmp := f.statePath + ".tmp"
+		if err = ioutil.WriteFile(tmp, buf.Bytes(), 0666); err == nil {
+			err = os.Rename(tmp, f.statePath)
+		}
+	}
+	if err != nil {
+		log.Error().Str("module", "replication").Str("path", f.statePath).Err(err).
+			Msg("Failed to save replication state")
+	}
+}
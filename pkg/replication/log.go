@@ -0,0 +1,182 @@
+// Package replication mirrors the messages of a primary Inbucket to read-only replicas.  The
+// primary records every change to its store in a Log, which replicas fetch over HTTP and apply to
+// their own store.
+package replication
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/gob"
+	"errors"
+	"fmt"
+	"io"
+	"net/mail"
+	"os"
+	"sync"
+	"time"
+)
+
+// LogFile is the name of the replication log in the root of a primary store.
+const LogFile = "replication.log"
+
+// recordHeaderSize is the size of the big-endian length which precedes each record.
+const recordHeaderSize = 4
+
+// maxRecordSize limits the size of a record, protecting replicas from a corrupt length.
+const maxRecordSize = 1 << 30
+
+// ErrOffset is returned by Log.Read when the offset is beyond the end of the log.
+var ErrOffset = errors.New("offset beyond end of replication log")
+
+// Op is the change to the store recorded by an Event.
+type Op uint8
+
+// Operations recorded in the replication log.
+const (
+	OpAdd Op = iota + 1
+	OpRemove
+	OpPurge
+)
+
+// Event is a single change to the primary store.  Message fields are only set for OpAdd, and ID is
+// empty for OpPurge.
+type Event struct {
+	Op         Op
+	Mailbox    string
+	ID         string
+	From       *mail.Address
+	To         []*mail.Address
+	Date       time.Time
+	Subject    string
+	EnvelopeID string
+	SPFResult  string
+	Tags       []string
+	Source     []byte
+}
+
+// Log is an append-only file of Events.  Each record is a gob encoded Event, preceded by its
+// length, so replicas can read the log from any record boundary.
+type Log struct {
+	mu   sync.Mutex
+	file *os.File
+	size int64
+}
+
+// OpenLog opens or creates the log at path.  A partial record left at the end of the log by a
+// crash is discarded.
+func OpenLog(path string) (*Log, error) {
+	file, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0666)
+	if err != nil {
+		return nil, err
+	}
+	l := &Log{file: file}
+	fi, err := file.Stat()
+	if err != nil {
+		_ = file.Close()
+		return nil, err
+	}
+	l.size = l.recordsEnd(0, fi.Size(), fi.Size())
+	if l.size < fi.Size() {
+		if err := file.Truncate(l.size); err != nil {
+			_ = file.Close()
+			return nil, err
+		}
+	}
+	if _, err := file.Seek(l.size, io.SeekStart); err != nil {
+		_ = file.Close()
+		return nil, err
+	}
+	return l, nil
+}
+
+// Append writes the event to the end of the log.
+func (l *Log) Append(e *Event) error {
+	buf := new(bytes.Buffer)
+	buf.Write(make([]byte, recordHeaderSize))
+	if err := gob.NewEncoder(buf).Encode(e); err != nil {
+		return err
+	}
+	b := buf.Bytes()
+	binary.BigEndian.PutUint32(b, uint32(len(b)-recordHeaderSize))
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	n, err := l.file.Write(b)
+	if err != nil {
+		// Remove any partial record, so later records are not lost behind it.
+		if n > 0 {
+			_ = l.file.Truncate(l.size)
+			_, _ = l.file.Seek(l.size, io.SeekStart)
+		}
+		return err
+	}
+	l.size += int64(n)
+	return nil
+}
+
+// Size returns the length of the log in bytes, which is the offset of the next record.
+func (l *Log) Size() int64 {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.size
+}
+
+// Read returns the whole records starting at offset, totaling no more than limit bytes unless the
+// first record alone is larger.  The returned slice is empty if offset is the end of the log.
+func (l *Log) Read(offset, limit int64) ([]byte, error) {
+	size := l.Size()
+	if offset < 0 || offset > size {
+		return nil, ErrOffset
+	}
+	// Records before size are never changed, so they can be read without holding the lock.
+	end := l.recordsEnd(offset, size, offset+limit)
+	b := make([]byte, end-offset)
+	if _, err := l.file.ReadAt(b, offset); err != nil {
+		return nil, err
+	}
+	return b, nil
+}
+
+// Sync commits the log to stable storage.
+func (l *Log) Sync() error {
+	return l.file.Sync()
+}
+
+// Close closes the log file.
+func (l *Log) Close() error {
+	return l.file.Close()
+}
+
+// recordsEnd walks the records from offset, returning the end of the last whole record which ends
+// before size, and before limit unless it is the first record.
+func (l *Log) recordsEnd(offset, size, limit int64) int64 {
+	header := make([]byte, recordHeaderSize)
+	end := offset
+	for end+recordHeaderSize <= size {
+		if _, err := l.file.ReadAt(header, end); err != nil {
+			break
+		}
+		next := end + recordHeaderSize + int64(binary.BigEndian.Uint32(header))
+		if next > size || (next > limit && end > offset) {
+			break
+		}
+		end = next
+	}
+	return end
+}
+
+// decodeEvent decodes the first record in b, returning the event and the length of the record.
+func decodeEvent(b []byte) (*Event, int, error) {
+	if len(b) < recordHeaderSize {
+		return nil, 0, fmt.Errorf("truncated replication record header")
+	}
+	n := binary.BigEndian.Uint32(b)
+	if n > maxRecordSize || int64(len(b)-recordHeaderSize) < int64(n) {
+		return nil, 0, fmt.Errorf("truncated replication record of %v bytes", n)
+	}
+	e := &Event{}
+	record := b[recordHeaderSize : recordHeaderSize+n]
+	if err := gob.NewDecoder(bytes.NewReader(record)).Decode(e); err != nil {
+		return nil, 0, err
+	}
+	return e, recordHeaderSize + int(n), nil
+}
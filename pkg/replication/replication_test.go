@@ -0,0 +1,195 @@
+package replication
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/inbucket/inbucket/pkg/config"
+	"github.com/inbucket/inbucket/pkg/storage"
+	"github.com/inbucket/inbucket/pkg/storage/mem"
+	"github.com/inbucket/inbucket/pkg/test"
+)
+
+func TestLog(t *testing.T) {
+	path := filepath.Join(t.TempDir(), LogFile)
+	l, err := OpenLog(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	events := []*Event{
+		{Op: OpAdd, Mailbox: "box", ID: "1", Subject: "First", Source: []byte("source 1")},
+		{Op: OpAdd, Mailbox: "box", ID: "2", Subject: "Second", Source: make([]byte, 1000)},
+		{Op: OpRemove, Mailbox: "box", ID: "1"},
+		{Op: OpPurge, Mailbox: "box"},
+	}
+	var ends []int64
+	for _, e := range events {
+		if err := l.Append(e); err != nil {
+			t.Fatal(err)
+		}
+		ends = append(ends, l.Size())
+	}
+
+	// Read everything.
+	b, err := l.Read(0, 1<<20)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if int64(len(b)) != ends[3] {
+		t.Fatalf("Read %v bytes, want: %v", len(b), ends[3])
+	}
+	for i, want := range events {
+		e, n, err := decodeEvent(b)
+		if err != nil {
+			t.Fatalf("Event %v: %v", i, err)
+		}
+		if e.Op != want.Op || e.ID != want.ID || e.Subject != want.Subject ||
+			len(e.Source) != len(want.Source) {
+			t.Errorf("Event %v is %+v, want: %+v", i, e, want)
+		}
+		b = b[n:]
+	}
+
+	// Limited reads return whole records, and at least one.
+	b, _ = l.Read(0, ends[0]+1)
+	if int64(len(b)) != ends[0] {
+		t.Errorf("Read %v bytes with limit, want: %v", len(b), ends[0])
+	}
+	b, _ = l.Read(ends[0], 1)
+	if int64(len(b)) != ends[1]-ends[0] {
+		t.Errorf("Read %v bytes with small limit, want: %v", len(b), ends[1]-ends[0])
+	}
+	b, _ = l.Read(ends[3], 1<<20)
+	if len(b) != 0 {
+		t.Errorf("Read %v bytes at end of log, want: 0", len(b))
+	}
+	if _, err := l.Read(ends[3]+1, 1<<20); err != ErrOffset {
+		t.Errorf("Got error %v reading beyond end of log, want: %v", err, ErrOffset)
+	}
+	if err := l.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// A partial record from a crash is discarded when the log is opened.
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, _ = f.Write([]byte{0, 0, 1, 0, 'x'})
+	_ = f.Close()
+	l, err = OpenLog(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	if l.Size() != ends[3] {
+		t.Errorf("Reopened log size is %v, want: %v", l.Size(), ends[3])
+	}
+	if err := l.Append(&Event{Op: OpPurge, Mailbox: "other"}); err != nil {
+		t.Fatal(err)
+	}
+	b, _ = l.Read(ends[3], 1<<20)
+	if e, _, err := decodeEvent(b); err != nil || e.Mailbox != "other" {
+		t.Errorf("Got event %+v, error %v after reopen, want: purge of other", e, err)
+	}
+}
+
+func TestPrimaryStore(t *testing.T) {
+	l, err := OpenLog(filepath.Join(t.TempDir(), LogFile))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	inner, _ := mem.New(
+		config.Storage{MailboxMsgCap: 1, OverflowPolicy: config.OverflowDropNewest})
+	store := NewPrimaryStore(inner, l)
+	id, _ := test.DeliverToStore(t, store, "box", "kept", time.Now())
+	// Dropped by the overflow policy, so not logged.
+	test.DeliverToStore(t, store, "box", "dropped", time.Now())
+	if err := store.RemoveMessage(context.Background(), "box", id); err != nil {
+		t.Fatal(err)
+	}
+
+	b, err := l.Read(0, 1<<20)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got []string
+	for len(b) > 0 {
+		e, n, err := decodeEvent(b)
+		if err != nil {
+			t.Fatal(err)
+		}
+		got = append(got, strings.Join([]string{strconv.Itoa(int(e.Op)), e.ID, e.Subject}, ":"))
+		b = b[n:]
+	}
+	want := []string{"1:" + id + ":kept", "2:" + id + ":"}
+	if strings.Join(got, " ") != strings.Join(want, " ") {
+		t.Errorf("Got events %q, want: %q", got, want)
+	}
+}
+
+func TestReplicaStore(t *testing.T) {
+	inner, _ := mem.New(config.Storage{})
+	id, _ := test.DeliverToStore(t, inner, "box", "subject", time.Now())
+	store := NewReplicaStore(inner)
+	ctx := context.Background()
+	_, err := store.AddMessage(ctx, &eventMessage{&Event{Mailbox: "box"}})
+	if err != storage.ErrReadOnly {
+		t.Errorf("AddMessage got error %v, want: %v", err, storage.ErrReadOnly)
+	}
+	if err := store.RemoveMessage(ctx, "box", id); err != storage.ErrReadOnly {
+		t.Errorf("RemoveMessage got error %v, want: %v", err, storage.ErrReadOnly)
+	}
+	if err := store.PurgeMessages(ctx, "box"); err != storage.ErrReadOnly {
+		t.Errorf("PurgeMessages got error %v, want: %v", err, storage.ErrReadOnly)
+	}
+	// Reads and local state are still available.
+	test.GetAndCountMessages(t, store, "box", 1)
+	if err := store.MarkSeen(ctx, "box", id); err != nil {
+		t.Errorf("MarkSeen got error %v", err)
+	}
+}
+
+func TestFollowerState(t *testing.T) {
+	statePath := filepath.Join(t.TempDir(), StateFile)
+	conf := config.Storage{ReplicateFrom: "http://primary:9000/"}
+	replica, _ := mem.New(config.Storage{})
+	f, err := NewFollower(conf, replica, statePath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if f.logURL != "http://primary:9000/admin/replication/log" {
+		t.Errorf("Got log URL %q", f.logURL)
+	}
+	ctx := context.Background()
+	add := &Event{Op: OpAdd, Mailbox: "box", ID: "primary-id", Source: []byte("Subject: x\r\n")}
+	if err := f.apply(ctx, add); err != nil {
+		t.Fatal(err)
+	}
+	f.state.Offset = 42
+	f.saveState()
+
+	// A restarted follower resumes, and can remove the message by its primary ID.
+	f, err = NewFollower(conf, replica, statePath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if f.state.Offset != 42 {
+		t.Errorf("Got offset %v, want: 42", f.state.Offset)
+	}
+	if err := f.apply(ctx, &Event{Op: OpRemove, Mailbox: "box", ID: "primary-id"}); err != nil {
+		t.Fatal(err)
+	}
+	test.GetAndCountMessages(t, replica, "box", 0)
+
+	_, err = NewFollower(config.Storage{ReplicateFrom: "ftp://primary"}, replica, "")
+	if err == nil {
+		t.Error("Got nil error for ftp URL, want error")
+	}
+}
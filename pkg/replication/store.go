@@ -0,0 +1,165 @@
+package replication
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"io/ioutil"
+	"net/mail"
+	"time"
+
+	"github.com/inbucket/inbucket/pkg/storage"
+	"github.com/rs/zerolog/log"
+)
+
+// PrimaryStore wraps a Store, recording each message added or removed in a Log.
+type PrimaryStore struct {
+	storage.Store
+	log *Log
+}
+
+var _ storage.Pager = &PrimaryStore{}
+var _ storage.LatestVisitor = &PrimaryStore{}
+
+// NewPrimaryStore wraps store, recording its changes in l.
+func NewPrimaryStore(store storage.Store, l *Log) *PrimaryStore {
+	return &PrimaryStore{Store: store, log: l}
+}
+
+// AddMessage stores the message, then records it in the log.
+func (s *PrimaryStore) AddMessage(ctx context.Context, m storage.Message) (string, error) {
+	r, err := m.Source()
+	if err != nil {
+		return "", err
+	}
+	source, err := ioutil.ReadAll(r)
+	_ = r.Close()
+	if err != nil {
+		return "", err
+	}
+	e := &Event{
+		Op:         OpAdd,
+		Mailbox:    m.Mailbox(),
+		From:       m.From(),
+		To:         m.To(),
+		Date:       m.Date(),
+		Subject:    m.Subject(),
+		EnvelopeID: m.EnvelopeID(),
+		SPFResult:  m.SPFResult(),
+		Tags:       m.Tags(),
+		Source:     source,
+	}
+	id, err := s.Store.AddMessage(ctx, &eventMessage{e})
+	if err != nil || id == "" {
+		// Not stored, or dropped by the overflow policy.
+		return id, err
+	}
+	e.ID = id
+	s.record(e)
+	return id, nil
+}
+
+// RemoveMessage deletes the message, then records the removal in the log.
+func (s *PrimaryStore) RemoveMessage(ctx context.Context, mailbox, id string) error {
+	if err := s.Store.RemoveMessage(ctx, mailbox, id); err != nil {
+		return err
+	}
+	s.record(&Event{Op: OpRemove, Mailbox: mailbox, ID: id})
+	return nil
+}
+
+// PurgeMessages deletes every message in the mailbox, then records the purge in the log.
+func (s *PrimaryStore) PurgeMessages(ctx context.Context, mailbox string) error {
+	if err := s.Store.PurgeMessages(ctx, mailbox); err != nil {
+		return err
+	}
+	s.record(&Event{Op: OpPurge, Mailbox: mailbox})
+	return nil
+}
+
+// PageMessages returns a page of messages from the named mailbox, see storage.Pager.
+func (s *PrimaryStore) PageMessages(ctx context.Context, mailbox, after string, limit int,
+	match func(storage.Message) bool) ([]storage.Message, bool, error) {
+	return storage.PageMessages(ctx, s.Store, mailbox, after, limit, match)
+}
+
+// VisitLatestMessages calls f with the latest message of each non-empty mailbox, see
+// storage.LatestVisitor.
+func (s *PrimaryStore) VisitLatestMessages(
+	ctx context.Context, f func(latest storage.Message) (cont bool)) error {
+	return storage.VisitLatestMessages(ctx, s.Store, f)
+}
+
+// record appends e to the log.  The change has already been made, so a failure is logged rather
+// than returned; replicas will be missing the change.
+func (s *PrimaryStore) record(e *Event) {
+	if err := s.log.Append(e); err != nil {
+		log.Error().Str("module", "replication").Str("mailbox", e.Mailbox).Str("id", e.ID).
+			Err(err).Msg("Failed to append to replication log")
+	}
+}
+
+// ReplicaStore wraps a Store, rejecting new messages and deletions which must instead be made on
+// the primary.  Messages may still be read, and marked seen or tagged locally.
+type ReplicaStore struct {
+	storage.Store
+}
+
+var _ storage.Pager = &ReplicaStore{}
+var _ storage.LatestVisitor = &ReplicaStore{}
+
+// NewReplicaStore wraps store, making its message list read-only.
+func NewReplicaStore(store storage.Store) *ReplicaStore {
+	return &ReplicaStore{Store: store}
+}
+
+// AddMessage returns storage.ErrReadOnly.
+func (s *ReplicaStore) AddMessage(ctx context.Context, m storage.Message) (string, error) {
+	return "", storage.ErrReadOnly
+}
+
+// RemoveMessage returns storage.ErrReadOnly.
+func (s *ReplicaStore) RemoveMessage(ctx context.Context, mailbox, id string) error {
+	return storage.ErrReadOnly
+}
+
+// PurgeMessages returns storage.ErrReadOnly.
+func (s *ReplicaStore) PurgeMessages(ctx context.Context, mailbox string) error {
+	return storage.ErrReadOnly
+}
+
+// PageMessages returns a page of messages from the named mailbox, see storage.Pager.
+func (s *ReplicaStore) PageMessages(ctx context.Context, mailbox, after string, limit int,
+	match func(storage.Message) bool) ([]storage.Message, bool, error) {
+	return storage.PageMessages(ctx, s.Store, mailbox, after, limit, match)
+}
+
+// VisitLatestMessages calls f with the latest message of each non-empty mailbox, see
+// storage.LatestVisitor.
+func (s *ReplicaStore) VisitLatestMessages(
+	ctx context.Context, f func(latest storage.Message) (cont bool)) error {
+	return storage.VisitLatestMessages(ctx, s.Store, f)
+}
+
+// eventMessage adapts an OpAdd Event to storage.Message.
+type eventMessage struct {
+	e *Event
+}
+
+var _ storage.Message = &eventMessage{}
+
+func (m *eventMessage) Mailbox() string     { return m.e.Mailbox }
+func (m *eventMessage) ID() string          { return m.e.ID }
+func (m *eventMessage) From() *mail.Address { return m.e.From }
+func (m *eventMessage) To() []*mail.Address { return m.e.To }
+func (m *eventMessage) Date() time.Time     { return m.e.Date }
+func (m *eventMessage) Subject() string     { return m.e.Subject }
+func (m *eventMessage) Size() int64         { return int64(len(m.e.Source)) }
+func (m *eventMessage) Seen() bool          { return false }
+func (m *eventMessage) EnvelopeID() string  { return m.e.EnvelopeID }
+func (m *eventMessage) SPFResult() string   { return m.e.SPFResult }
+func (m *eventMessage) Tags() []string      { return m.e.Tags }
+
+func (m *eventMessage) Source() (io.ReadCloser, error) {
+	return ioutil.NopCloser(bytes.NewReader(m.e.Source)), nil
+}
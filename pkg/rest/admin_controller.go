@@ -0,0 +1,222 @@
+package rest
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/inbucket/inbucket/pkg/config"
+	"github.com/inbucket/inbucket/pkg/message"
+	"github.com/inbucket/inbucket/pkg/replication"
+	"github.com/inbucket/inbucket/pkg/rest/model"
+	"github.com/inbucket/inbucket/pkg/server/web"
+	"github.com/inbucket/inbucket/pkg/storage/file"
+	"github.com/rs/zerolog"
+	"github.com/rs/zerolog/log"
+)
+
+// adminAuth wraps an admin handler, requiring HTTP basic authentication.  Admin handlers are not
+// available if no admin password is configured.  If config.Web.AdminTLSClientCAFile is set, a
+// verified TLS client certificate is also required, and its name is logged with each request.
+func adminAuth(h web.Handler) web.Handler {
+	return func(w http.ResponseWriter, req *http.Request, ctx *web.Context) error {
+		conf := ctx.RootConfig.Web
+		if conf.AdminPassword == "" {
+			http.NotFound(w, req)
+			return nil
+		}
+		client := ""
+		if conf.AdminTLSClientCAFile != "" {
+			client = web.ClientCertName(req)
+			if client == "" {
+				log.Info().Str("module", "rest").Str("remote", web.RemoteIP(req)).
+					Str("path", req.RequestURI).Msg("Rejected admin request without client certificate")
+				http.Error(w, "Client certificate required", http.StatusBadRequest)
+				return nil
+			}
+		}
+		user, password, ok := req.BasicAuth()
+		if !ok ||
+			subtle.ConstantTimeCompare([]byte(user), []byte(conf.AdminUser)) != 1 ||
+			subtle.ConstantTimeCompare([]byte(password), []byte(conf.AdminPassword)) != 1 {
+			if ok {
+				log.Info().Str("module", "rest").Str("remote", web.RemoteIP(req)).
+					Str("path", req.RequestURI).Msg("Rejected unauthorized admin request")
+			}
+			w.Header().Set("WWW-Authenticate", `Basic realm="Inbucket Admin"`)
+			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+			return nil
+		}
+		if client != "" {
+			log.Info().Str("module", "rest").Str("remote", web.RemoteIP(req)).Str("client", client).
+				Str("method", req.Method).Str("path", req.RequestURI).Msg("Admin request")
+		}
+		return h(w, req, ctx)
+	}
+}
+
+// AdminBackup streams a gzipped tar archive of every message in the store.
+//
+// @Summary Back up every message
+// @Tags admin
+// @ID backup
+// @Produce application/gzip,plain
+// @Success 200 {file} file "Gzipped tar archive of every message."
+// @Failure 401 {string} string "A valid API key or admin credentials are required."
+// @Failure 500 {string} string "The server failed to complete the request."
+// @Security adminBasic
+// @Router /admin/backup [post]
+func AdminBackup(w http.ResponseWriter, req *http.Request, ctx *web.Context) (err error) {
+	filename := "inbucket-backup-" + time.Now().UTC().Format("20060102T150405Z") + ".tar.gz"
+	w.Header().Set("Content-Type", "application/gzip")
+	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", filename))
+	if err := ctx.Manager.Backup(req.Context(), w); err != nil {
+		// The response has been started, the client will receive a truncated archive.
+		log.Error().Str("module", "rest").Err(err).Msg("Backup failed")
+	}
+	return nil
+}
+
+// AdminRestore imports every message in a gzipped tar archive written by AdminBackup.
+//
+// @Summary Restore messages from a backup
+// @Tags admin
+// @ID restore
+// @Accept application/gzip
+// @Produce json,plain
+// @Param archive body string true "Gzipped tar archive written by backup."
+// @Success 200 {object} model.JSONRestoreV1 "The messages were restored."
+// @Failure 400 {string} string "The request parameters or body are invalid."
+// @Failure 401 {string} string "A valid API key or admin credentials are required."
+// @Failure 500 {string} string "The server failed to complete the request."
+// @Security adminBasic
+// @Router /admin/restore [post]
+func AdminRestore(w http.ResponseWriter, req *http.Request, ctx *web.Context) (err error) {
+	count, err := ctx.Manager.Restore(req.Context(), req.Body)
+	if err != nil {
+		if _, ok := err.(*message.BackupError); ok {
+			http.Error(w, fmt.Sprintf("%v, restored %v messages", err, count),
+				http.StatusBadRequest)
+			return nil
+		}
+		return fmt.Errorf("Restore failed after %v messages: %v", count, err)
+	}
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	return json.NewEncoder(w).Encode(&model.JSONRestoreV1{Restored: count})
+}
+
+// AdminReload reloads the configuration, applying changes to settings which do not require a
+// restart.  If any changed setting requires a restart, nothing is applied and 409 Conflict is
+// returned listing those settings.
+//
+// @Summary Reload the configuration
+// @Description Applies changed settings which do not require a restart.  If any changed
+// @Description setting requires a restart, nothing is applied.
+// @Tags admin
+// @ID reload
+// @Produce json,plain
+// @Success 200 {object} model.JSONReloadV1 "The changed settings were applied."
+// @Failure 400 {string} string "The request parameters or body are invalid."
+// @Failure 401 {string} string "A valid API key or admin credentials are required."
+// @Failure 409 {object} model.JSONReloadV1 "Changed settings require a restart."
+// @Failure 501 {string} string "Reloading is not enabled."
+// @Security adminBasic
+// @Router /admin/reload [post]
+func AdminReload(w http.ResponseWriter, req *http.Request, ctx *web.Context) (err error) {
+	if ctx.Config == nil {
+		http.Error(w, config.ErrReloadDisabled.Error(), http.StatusNotImplemented)
+		return nil
+	}
+	changed, err := ctx.Config.Reload()
+	if err != nil {
+		if rerr, ok := err.(*config.RestartError); ok {
+			log.Warn().Str("module", "rest").Strs("fields", rerr.Fields).
+				Msg("Configuration reload requires restart")
+			w.Header().Set("Content-Type", "application/json; charset=utf-8")
+			w.WriteHeader(http.StatusConflict)
+			return json.NewEncoder(w).Encode(
+				&model.JSONReloadV1{Changed: []string{}, Restart: rerr.Fields})
+		}
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return nil
+	}
+	for _, field := range changed {
+		if field == "LogLevel" {
+			level, err := zerolog.ParseLevel(ctx.Config.Get().LogLevel)
+			if err != nil {
+				return err
+			}
+			zerolog.SetGlobalLevel(level)
+		}
+	}
+	log.Info().Str("module", "rest").Strs("fields", changed).Msg("Configuration reloaded")
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	return json.NewEncoder(w).Encode(&model.JSONReloadV1{Changed: changed})
+}
+
+// AdminStatsReset zeroes the file store activity counters published under the store expvar map.
+//
+// @Summary Reset the store statistics
+// @Description Zeroes the file store activity counters in the `store` expvar map.
+// @Tags admin
+// @ID resetStats
+// @Produce plain
+// @Success 204 "The counters were reset."
+// @Failure 401 {string} string "A valid API key or admin credentials are required."
+// @Security adminBasic
+// @Router /admin/stats/reset [post]
+func AdminStatsReset(w http.ResponseWriter, req *http.Request, ctx *web.Context) (err error) {
+	file.ResetStats()
+	log.Info().Str("module", "rest").Msg("Store statistics reset")
+	w.WriteHeader(http.StatusNoContent)
+	return nil
+}
+
+// replicationReadLimit is the number of replication log bytes returned per request.
+const replicationReadLimit = 8 << 20
+
+// AdminReplicationLog returns the replication log records following the offset query parameter,
+// for replicas to apply.  It is only available when this Inbucket is a replication primary.
+//
+// @Summary Read the replication log
+// @Description Only available when this Inbucket is a replication primary.
+// @Tags admin
+// @ID replicationLog
+// @Produce octet-stream,plain
+// @Param offset query int false "Offset of the first log byte to return." minimum(0) default(0)
+// @Success 200 {file} file "Replication log records."
+// @Failure 400 {string} string "The request parameters or body are invalid."
+// @Failure 401 {string} string "A valid API key or admin credentials are required."
+// @Failure 404 {string} string "This Inbucket is not a replication primary."
+// @Failure 416 {string} string "The offset is beyond the end of the log."
+// @Security adminBasic
+// @Router /admin/replication/log [get]
+func AdminReplicationLog(w http.ResponseWriter, req *http.Request, ctx *web.Context) (err error) {
+	if ctx.ReplicationLog == nil {
+		http.NotFound(w, req)
+		return nil
+	}
+	var offset int64
+	if v := req.URL.Query().Get("offset"); v != "" {
+		offset, err = strconv.ParseInt(v, 10, 64)
+		if err != nil {
+			http.Error(w, "Invalid offset", http.StatusBadRequest)
+			return nil
+		}
+	}
+	b, err := ctx.ReplicationLog.Read(offset, replicationReadLimit)
+	if err == replication.ErrOffset {
+		http.Error(w, err.Error(), http.StatusRequestedRangeNotSatisfiable)
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	w.Header().Set("Content-Type", "application/octet-stream")
+	w.Header().Set("Content-Length", strconv.Itoa(len(b)))
+	_, err = w.Write(b)
+	return err
+}
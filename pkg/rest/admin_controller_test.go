@@ -0,0 +1,491 @@
+package rest
+
+import (
+	"bytes"
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/json"
+	"encoding/pem"
+	"expvar"
+	"io"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/inbucket/inbucket/pkg/config"
+	"github.com/inbucket/inbucket/pkg/message"
+	"github.com/inbucket/inbucket/pkg/policy"
+	"github.com/inbucket/inbucket/pkg/replication"
+	"github.com/inbucket/inbucket/pkg/rest/model"
+	"github.com/inbucket/inbucket/pkg/server/web"
+	"github.com/inbucket/inbucket/pkg/storage"
+	"github.com/inbucket/inbucket/pkg/storage/mem"
+)
+
+func testAdminPost(url, user, password string, body []byte) *httptest.ResponseRecorder {
+	req, _ := http.NewRequest("POST", url, bytes.NewReader(body))
+	if user != "" {
+		req.SetBasicAuth(user, password)
+	}
+	w := httptest.NewRecorder()
+	web.Router.ServeHTTP(w, req)
+	return w
+}
+
+func TestAdminAuth(t *testing.T) {
+	mm := &message.StoreManager{Store: newAdminStore(t)}
+
+	// Admin endpoints are not available without a password.
+	logbuf := setupWebServerConfig(mm, config.Web{AdminUser: "admin"})
+	w := testAdminPost("/admin/backup", "admin", "", nil)
+	if w.Code != http.StatusNotFound {
+		t.Errorf("Expected code %v, got %v", http.StatusNotFound, w.Code)
+	}
+
+	setupWebServerConfig(mm, config.Web{AdminUser: "admin", AdminPassword: "secret"})
+	for _, path := range []string{"/admin/backup", "/admin/restore", "/admin/stats/reset"} {
+		for _, creds := range [][2]string{{"", ""}, {"admin", "wrong"}, {"root", "secret"}} {
+			w := testAdminPost(path, creds[0], creds[1], nil)
+			if w.Code != http.StatusUnauthorized {
+				t.Errorf("%v %q: expected code %v, got %v", path, creds,
+					http.StatusUnauthorized, w.Code)
+			}
+			if w.Header().Get("WWW-Authenticate") == "" {
+				t.Errorf("%v %q: WWW-Authenticate header missing", path, creds)
+			}
+		}
+	}
+
+	if t.Failed() {
+		// Wait for handler to finish logging
+		time.Sleep(2 * time.Second)
+		// Dump buffered log data if there was a failure
+		_, _ = io.Copy(os.Stderr, logbuf)
+	}
+}
+
+func TestAdminBackupRestore(t *testing.T) {
+	webConfig := config.Web{AdminUser: "admin", AdminPassword: "secret"}
+	addrPolicy := &policy.Addressing{Config: &config.Root{MailboxNaming: config.FullNaming}}
+	src := newAdminStore(t)
+	mm := &message.StoreManager{AddrPolicy: addrPolicy, Store: storage.NewFreezableStore(src)}
+	date1 := time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC)
+	date2 := date1.Add(time.Hour)
+	addAdminMessage(t, src, "box1", "First", date1)
+	id2 := addAdminMessage(t, src, "box1", "Second", date2)
+	addAdminMessage(t, src, "box2", "Third", date1)
+	if err := src.MarkSeen(context.Background(), "box1", id2); err != nil {
+		t.Fatal(err)
+	}
+	logbuf := setupWebServerConfig(mm, webConfig)
+
+	w := testAdminPost("/admin/backup", "admin", "secret", nil)
+	if w.Code != http.StatusOK {
+		t.Fatalf("Expected code %v, got %v", http.StatusOK, w.Code)
+	}
+	if got := w.Header().Get("Content-Type"); got != "application/gzip" {
+		t.Errorf("Content-Type is %q, want: application/gzip", got)
+	}
+	disp := w.Header().Get("Content-Disposition")
+	if !strings.HasPrefix(disp, `attachment; filename="inbucket-backup-`) ||
+		!strings.HasSuffix(disp, `.tar.gz"`) {
+		t.Errorf("Content-Disposition is %q", disp)
+	}
+	archive := w.Body.Bytes()
+
+	// Restore into an empty store.
+	dst := newAdminStore(t)
+	setupWebServerConfig(&message.StoreManager{AddrPolicy: addrPolicy, Store: dst}, webConfig)
+	w = testAdminPost("/admin/restore", "admin", "secret", archive)
+	if w.Code != http.StatusOK {
+		t.Fatalf("Expected code %v, got %v: %s", http.StatusOK, w.Code, w.Body.String())
+	}
+	var result model.JSONRestoreV1
+	if err := json.Unmarshal(w.Body.Bytes(), &result); err != nil {
+		t.Fatal(err)
+	}
+	if result.Restored != 3 {
+		t.Errorf("Restored %v messages, want: 3", result.Restored)
+	}
+	for _, mailbox := range []string{"box1", "box2"} {
+		want, _ := src.GetMessages(context.Background(), mailbox)
+		got, _ := dst.GetMessages(context.Background(), mailbox)
+		if len(got) != len(want) {
+			t.Errorf("Got %v messages in %v, want: %v", len(got), mailbox, len(want))
+			continue
+		}
+		for i := range want {
+			if got[i].Subject() != want[i].Subject() {
+				t.Errorf("Got subject %q, want: %q", got[i].Subject(), want[i].Subject())
+			}
+			if !got[i].Date().Equal(want[i].Date()) {
+				t.Errorf("Got date %v, want: %v", got[i].Date(), want[i].Date())
+			}
+			if got[i].Seen() != want[i].Seen() {
+				t.Errorf("Got seen %v for %q, want: %v", got[i].Seen(), got[i].Subject(),
+					want[i].Seen())
+			}
+			if gotSrc, wantSrc := readSource(t, got[i]), readSource(t, want[i]); gotSrc != wantSrc {
+				t.Errorf("Got source %q, want: %q", gotSrc, wantSrc)
+			}
+		}
+	}
+
+	// Invalid archive.
+	w = testAdminPost("/admin/restore", "admin", "secret", []byte("not an archive"))
+	if w.Code != http.StatusBadRequest {
+		t.Errorf("Expected code %v, got %v", http.StatusBadRequest, w.Code)
+	}
+
+	if t.Failed() {
+		// Wait for handler to finish logging
+		time.Sleep(2 * time.Second)
+		// Dump buffered log data if there was a failure
+		_, _ = io.Copy(os.Stderr, logbuf)
+	}
+}
+
+func TestAdminReload(t *testing.T) {
+	webConfig := config.Web{AdminUser: "admin", AdminPassword: "secret"}
+	mm := &message.StoreManager{Store: newAdminStore(t)}
+	logbuf := setupWebServerConfig(mm, webConfig)
+	w := testAdminPost("/admin/reload", "admin", "secret", nil)
+	if w.Code != http.StatusNotImplemented {
+		t.Errorf("Expected code %v without config, got %v", http.StatusNotImplemented, w.Code)
+	}
+
+	active := &config.Root{LogLevel: "info", Web: webConfig,
+		Storage: config.Storage{RetentionPeriod: time.Hour}}
+	next := *active
+	conf := config.NewCurrent(active, func() (*config.Root, error) {
+		reloaded := next
+		return &reloaded, nil
+	})
+	web.SetCurrentConfig(conf)
+	defer web.SetCurrentConfig(nil)
+
+	// Changes requiring a restart are rejected.
+	next.SMTP.Addr = "0.0.0.0:25"
+	next.Storage.RetentionPeriod = time.Minute
+	w = testAdminPost("/admin/reload", "admin", "secret", nil)
+	if w.Code != http.StatusConflict {
+		t.Fatalf("Expected code %v, got %v: %s", http.StatusConflict, w.Code, w.Body)
+	}
+	var result model.JSONReloadV1
+	if err := json.NewDecoder(w.Body).Decode(&result); err != nil {
+		t.Fatal(err)
+	}
+	if len(result.Restart) != 1 || result.Restart[0] != "SMTP.Addr" {
+		t.Errorf("Got restart fields %v, want: [SMTP.Addr]", result.Restart)
+	}
+	if conf.Get() != active {
+		t.Error("Configuration was replaced despite conflict")
+	}
+
+	next.SMTP.Addr = active.SMTP.Addr
+	w = testAdminPost("/admin/reload", "admin", "secret", nil)
+	if w.Code != http.StatusOK {
+		t.Fatalf("Expected code %v, got %v: %s", http.StatusOK, w.Code, w.Body)
+	}
+	result = model.JSONReloadV1{}
+	if err := json.NewDecoder(w.Body).Decode(&result); err != nil {
+		t.Fatal(err)
+	}
+	if len(result.Changed) != 1 || result.Changed[0] != "Storage.RetentionPeriod" {
+		t.Errorf("Got changed fields %v, want: [Storage.RetentionPeriod]", result.Changed)
+	}
+	if got := conf.Get().Storage.RetentionPeriod; got != time.Minute {
+		t.Errorf("Got RetentionPeriod %v, want: %v", got, time.Minute)
+	}
+
+	if t.Failed() {
+		// Dump buffered log data if there was a failure
+		_, _ = io.Copy(os.Stderr, logbuf)
+	}
+}
+
+func TestAdminStatsReset(t *testing.T) {
+	mm := &message.StoreManager{Store: newAdminStore(t)}
+	logbuf := setupWebServerConfig(mm, config.Web{AdminUser: "admin", AdminPassword: "secret"})
+	added := expvar.Get("store").(*expvar.Map).Get("AddedTotal").(*expvar.Int)
+	added.Set(5)
+
+	w := testAdminPost("/admin/stats/reset", "admin", "wrong", nil)
+	if w.Code != http.StatusUnauthorized || added.Value() != 5 {
+		t.Errorf("Got code %v, AddedTotal %v, want: %v, 5", w.Code, added.Value(),
+			http.StatusUnauthorized)
+	}
+	w = testAdminPost("/admin/stats/reset", "admin", "secret", nil)
+	if w.Code != http.StatusNoContent {
+		t.Errorf("Expected code %v, got %v: %s", http.StatusNoContent, w.Code, w.Body)
+	}
+	if got := added.Value(); got != 0 {
+		t.Errorf("Got AddedTotal %v, want: 0", got)
+	}
+
+	if t.Failed() {
+		// Dump buffered log data if there was a failure
+		_, _ = io.Copy(os.Stderr, logbuf)
+	}
+}
+
+func TestAdminReplication(t *testing.T) {
+	webConfig := config.Web{AdminUser: "admin", AdminPassword: "secret"}
+	l, err := replication.OpenLog(filepath.Join(t.TempDir(), replication.LogFile))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	primary := replication.NewPrimaryStore(newAdminStore(t), l)
+	logbuf := setupWebServerConfig(&message.StoreManager{Store: primary}, webConfig)
+	srv := httptest.NewServer(web.Router)
+	defer srv.Close()
+	get := func(query string) int {
+		req, _ := http.NewRequest("GET", srv.URL+"/admin/replication/log"+query, nil)
+		req.SetBasicAuth("admin", "secret")
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		_ = resp.Body.Close()
+		return resp.StatusCode
+	}
+
+	// Not available unless this is a primary.
+	if code := get("?offset=0"); code != http.StatusNotFound {
+		t.Errorf("Expected code %v without log, got %v", http.StatusNotFound, code)
+	}
+	web.SetReplicationLog(l)
+	defer web.SetReplicationLog(nil)
+	if code := get("?offset=x"); code != http.StatusBadRequest {
+		t.Errorf("Expected code %v for invalid offset, got %v", http.StatusBadRequest, code)
+	}
+	if code := get("?offset=1000"); code != http.StatusRequestedRangeNotSatisfiable {
+		t.Errorf("Expected code %v for offset beyond end, got %v",
+			http.StatusRequestedRangeNotSatisfiable, code)
+	}
+
+	// Start a replica following the primary.
+	replica := newAdminStore(t)
+	follower, err := replication.NewFollower(config.Storage{
+		ReplicateFrom:       strings.Replace(srv.URL, "http://", "http://admin:secret@", 1),
+		ReplicationInterval: 10 * time.Millisecond,
+	}, replica, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	follower.Start(ctx)
+
+	date := time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC)
+	addAdminMessage(t, primary, "box1", "First", date)
+	id2 := addAdminMessage(t, primary, "box1", "Second", date)
+	addAdminMessage(t, primary, "box1", "Third", date)
+	addAdminMessage(t, primary, "box2", "Fourth", date)
+	if err := primary.RemoveMessage(ctx, "box1", id2); err != nil {
+		t.Fatal(err)
+	}
+	if err := primary.PurgeMessages(ctx, "box2"); err != nil {
+		t.Fatal(err)
+	}
+
+	// Replica must converge within 500ms.
+	subjects := func(store storage.Store, mailbox string) string {
+		msgs, err := store.GetMessages(ctx, mailbox)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var s []string
+		for _, m := range msgs {
+			s = append(s, m.Subject())
+		}
+		return strings.Join(s, ",")
+	}
+	deadline := time.Now().Add(500 * time.Millisecond)
+	for subjects(replica, "box1") != "First,Third" || subjects(replica, "box2") != "" {
+		if time.Now().After(deadline) {
+			t.Fatalf("Replica has box1 %q, box2 %q; want: \"First,Third\", \"\"",
+				subjects(replica, "box1"), subjects(replica, "box2"))
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+	msgs, _ := replica.GetMessages(ctx, "box1")
+	if got, want := readSource(t, msgs[1]), "Body of Third"; !strings.Contains(got, want) {
+		t.Errorf("Got source %q, want it to contain %q", got, want)
+	}
+
+	if t.Failed() {
+		// Wait for handler to finish logging
+		time.Sleep(2 * time.Second)
+		// Dump buffered log data if there was a failure
+		_, _ = io.Copy(os.Stderr, logbuf)
+	}
+}
+
+func newAdminStore(t *testing.T) storage.Store {
+	t.Helper()
+	store, err := mem.New(config.Storage{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return store
+}
+
+func addAdminMessage(
+	t *testing.T, store storage.Store, mailbox, subject string, date time.Time) string {
+	t.Helper()
+	source := "From: sender@example.com\r\nTo: " + mailbox + "@example.com\r\nSubject: " +
+		subject + "\r\n\r\nBody of " + subject + "\r\n"
+	id, err := store.AddMessage(context.Background(), &message.Delivery{
+		Meta: message.Metadata{
+			Mailbox: mailbox,
+			Subject: subject,
+			Date:    date,
+			Size:    int64(len(source)),
+		},
+		Reader: strings.NewReader(source),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return id
+}
+
+func readSource(t *testing.T, m storage.Message) string {
+	t.Helper()
+	r, err := m.Source()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+	b, err := ioutil.ReadAll(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(b)
+}
+
+func TestAdminTLSClientCert(t *testing.T) {
+	dir := t.TempDir()
+	caCert, caKey := newTestCert(t, dir, "ca", nil, nil)
+	newTestCert(t, dir, "server", caCert, caKey)
+	newTestCert(t, dir, "client", caCert, caKey)
+	webConfig := config.Web{
+		AdminUser:            "admin",
+		AdminPassword:        "secret",
+		TLSEnabled:           true,
+		TLSCert:              filepath.Join(dir, "server.crt"),
+		TLSPrivKey:           filepath.Join(dir, "server.key"),
+		AdminTLSClientCAFile: filepath.Join(dir, "ca.crt"),
+	}
+	addrPolicy := &policy.Addressing{Config: &config.Root{MailboxNaming: config.FullNaming}}
+	mm := &message.StoreManager{AddrPolicy: addrPolicy, Store: newAdminStore(t)}
+	logbuf := setupWebServerConfig(mm, webConfig)
+	tlsConfig, err := web.NewTLSConfig(webConfig)
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := httptest.NewUnstartedServer(web.Router)
+	srv.TLS = tlsConfig
+	srv.EnableHTTP2 = true
+	srv.StartTLS()
+	defer srv.Close()
+
+	roots := x509.NewCertPool()
+	roots.AddCert(caCert)
+	clientCert, err := tls.LoadX509KeyPair(
+		filepath.Join(dir, "client.crt"), filepath.Join(dir, "client.key"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	do := func(method, path string, certs []tls.Certificate) int {
+		client := &http.Client{Transport: &http.Transport{
+			TLSClientConfig: &tls.Config{RootCAs: roots, Certificates: certs}}}
+		req, _ := http.NewRequest(method, srv.URL+path, nil)
+		req.SetBasicAuth("admin", "secret")
+		resp, err := client.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		_ = resp.Body.Close()
+		return resp.StatusCode
+	}
+
+	// Other routes do not require a client certificate.
+	if code := do("GET", "/api/v1/mailbox/test", nil); code != http.StatusOK {
+		t.Errorf("Expected code %v for API without certificate, got %v", http.StatusOK, code)
+	}
+	if code := do("POST", "/admin/backup", nil); code != http.StatusBadRequest {
+		t.Errorf("Expected code %v for admin without certificate, got %v",
+			http.StatusBadRequest, code)
+	}
+	certs := []tls.Certificate{clientCert}
+	if code := do("POST", "/admin/backup", certs); code != http.StatusOK {
+		t.Errorf("Expected code %v for admin with certificate, got %v", http.StatusOK, code)
+	}
+
+	if t.Failed() {
+		// Dump buffered log data if there was a failure
+		_, _ = io.Copy(os.Stderr, logbuf)
+	}
+}
+
+// newTestCert creates a certificate named cn, and writes it and its key to cn.crt and cn.key in
+// dir.  The certificate is a self-signed CA if parent is nil.
+func newTestCert(t *testing.T, dir, cn string, parent *x509.Certificate,
+	parentKey *ecdsa.PrivateKey) (*x509.Certificate, *ecdsa.PrivateKey) {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: cn},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+		IPAddresses:  []net.IP{net.IPv4(127, 0, 0, 1)},
+	}
+	if parent == nil {
+		template.IsCA = true
+		template.BasicConstraintsValid = true
+		template.KeyUsage |= x509.KeyUsageCertSign
+		parent, parentKey = template, key
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, parent, &key.PublicKey, parentKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	certPEM := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})
+	keyPEM := pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER})
+	if err := ioutil.WriteFile(filepath.Join(dir, cn+".crt"), certPEM, 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(dir, cn+".key"), keyPEM, 0600); err != nil {
+		t.Fatal(err)
+	}
+	return cert, key
+}
@@ -1,51 +1,512 @@
 package rest
 
 import (
+	"bytes"
+	"context"
 	"fmt"
 	"io"
+	"io/ioutil"
+	"math"
+	"mime"
 	"net/http"
+	"net/mail"
+	"path/filepath"
 
 	"crypto/md5"
 	"encoding/hex"
 	"encoding/json"
+	"sort"
 	"strconv"
+	"strings"
 
+	"github.com/inbucket/inbucket/pkg/message"
 	"github.com/inbucket/inbucket/pkg/rest/model"
 	"github.com/inbucket/inbucket/pkg/server/web"
 	"github.com/inbucket/inbucket/pkg/storage"
 	"github.com/inbucket/inbucket/pkg/stringutil"
 )
 
-// MailboxListV1 renders a list of messages in a mailbox
+// mailboxesFlushInterval is the number of mailboxes MailboxesV1 writes between flushes.
+const mailboxesFlushInterval = 100
+
+// MailboxesV1 renders a summary of every mailbox, sorted by name.  The optional offset and limit
+// query parameters select a page of results; limit is capped by the MailboxListMax config, unless
+// it is zero.
+//
+// @Summary List mailboxes
+// @Description Summarizes every mailbox, sorted by name.
+// @Tags mailbox
+// @ID listMailboxes
+// @Produce json,plain
+// @Param offset query int false "Number of mailboxes to skip." minimum(0) default(0)
+// @Param limit query int false "Maximum count, capped by `INBUCKET_WEB_MAILBOXLISTMAX`." minimum(0)
+// @Success 200 {array} model.JSONMailboxV1 "Mailbox summaries."
+// @Failure 400 {string} string "The request parameters or body are invalid."
+// @Failure 401 {string} string "A valid API key or admin credentials are required."
+// @Failure 500 {string} string "The server failed to complete the request."
+// @Security apiKey
+// @Router /api/v1/mailboxes [get]
+func MailboxesV1(w http.ResponseWriter, req *http.Request, ctx *web.Context) (err error) {
+	max := ctx.RootConfig.Web.MailboxListMax
+	if max <= 0 {
+		max = math.MaxInt32
+	}
+	offset, err := queryInt(req, "offset", 0)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return nil
+	}
+	limit, err := queryInt(req, "limit", max)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return nil
+	}
+	if limit > max {
+		limit = max
+	}
+	mailboxes, err := ctx.Manager.GetMailboxes(req.Context())
+	if err != nil {
+		return fmt.Errorf("Failed to get mailboxes: %v", err)
+	}
+	if offset > len(mailboxes) {
+		offset = len(mailboxes)
+	}
+	mailboxes = mailboxes[offset:]
+	if limit < len(mailboxes) {
+		mailboxes = mailboxes[:limit]
+	}
+
+	if enc, _ := web.NegotiateEncoding(req); enc == web.EncodingMsgpack {
+		return renderMailboxesMsgpack(w, mailboxes)
+	}
+
+	// Stream the array one element at a time, rather than buffering the entire response.
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	w.Header().Set("Expires", "-1")
+	flusher, _ := w.(http.Flusher)
+	if _, err := io.WriteString(w, "["); err != nil {
+		return err
+	}
+	enc := json.NewEncoder(w)
+	for i, mb := range mailboxes {
+		if i > 0 {
+			if _, err := io.WriteString(w, ","); err != nil {
+				return err
+			}
+			if flusher != nil && i%mailboxesFlushInterval == 0 {
+				flusher.Flush()
+			}
+		}
+		if err := enc.Encode(&model.JSONMailboxV1{
+			Name:         mb.Name,
+			MessageCount: mb.MessageCount,
+			TotalBytes:   mb.TotalBytes,
+			LatestDate:   mb.LatestDate,
+		}); err != nil {
+			return err
+		}
+	}
+	_, err = io.WriteString(w, "]\n")
+	return err
+}
+
+// renderMailboxesMsgpack streams mailboxes as a msgpack array, one element at a time.
+func renderMailboxesMsgpack(w http.ResponseWriter, mailboxes []*message.MailboxSummary) error {
+	w.Header().Set("Content-Type", string(web.EncodingMsgpack))
+	w.Header().Set("Expires", "-1")
+	flusher, _ := w.(http.Flusher)
+	enc := web.NewMsgpackEncoder(w)
+	if err := enc.EncodeArrayLen(len(mailboxes)); err != nil {
+		return err
+	}
+	for i, mb := range mailboxes {
+		if flusher != nil && i > 0 && i%mailboxesFlushInterval == 0 {
+			flusher.Flush()
+		}
+		if err := enc.Encode(&model.JSONMailboxV1{
+			Name:         mb.Name,
+			MessageCount: mb.MessageCount,
+			TotalBytes:   mb.TotalBytes,
+			LatestDate:   mb.LatestDate,
+		}); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// queryInt parses the named non-negative integer query parameter, returning def if it is absent.
+func queryInt(req *http.Request, name string, def int) (int, error) {
+	value := req.URL.Query().Get(name)
+	if value == "" {
+		return def, nil
+	}
+	i, err := strconv.Atoi(value)
+	if err != nil || i < 0 {
+		return 0, fmt.Errorf("%v must be a non-negative integer", name)
+	}
+	return i, nil
+}
+
+// queryPriority parses the named message priority query parameter, returning def if it is absent.
+func queryPriority(req *http.Request, name string, def int) (int, error) {
+	p, err := queryInt(req, name, def)
+	if err != nil || p < storage.PriorityHighest || p > storage.PriorityLowest {
+		return 0, fmt.Errorf("%v must be an integer from %v to %v", name,
+			storage.PriorityHighest, storage.PriorityLowest)
+	}
+	return p, nil
+}
+
+// messagePageSize is the number of messages MailboxListV1 returns per page, unless the limit query
+// parameter is set.
+const messagePageSize = 25
+
+// MailboxListV1 renders a list of messages in a mailbox, only the unread messages if the
+// unreadOnly query parameter is true, only those with a tag containing the tag query parameter
+// if it is set, and only spam or non-spam messages if the spam query parameter is true or false
+// rather than all.  The minPriority and maxPriority query parameters limit the X-Priority style
+// priority of the messages, from 1 for the highest to 5 for the lowest.  Messages are listed in
+// mailbox order, or oldest first by the sortBy query parameter, receivedAt or date.  If the after
+// or limit query parameters are set, a page of messages following the message with ID after is
+// rendered instead, along with the cursor for the next page; sortBy is not supported for pages.
+//
+// @Summary List messages in a mailbox
+// @Description Returns the headers of the messages in the mailbox, oldest first.  If either
+// @Description `after` or `limit` is given, a MessagePage is returned instead.
+// @Tags mailbox
+// @ID listMessages
+// @Produce json,plain
+// @Param name path string true "Mailbox name, or an email address."
+// @Param unreadOnly query bool false "Only list messages which have not been read." default(false)
+// @Param tag query string false "Only list messages with a tag containing this text."
+// @Param spam query string false "Spam only if true, none if false, or all." Enums(true,false,all)
+// @Param minPriority query int false "Lowest priority number to list." minimum(1) maximum(5)
+// @Param maxPriority query int false "Highest priority number to list." minimum(1) maximum(5)
+// @Param sortBy query string false "Sort order, not with after or limit." Enums(receivedAt,date)
+// @Param after query string false "Cursor from a previous page; empty selects the first page."
+// @Param limit query int false "Messages per page, 25 if zero or omitted." minimum(0)
+// @Success 200 {object} model.JSONMessagePageV1 "Message headers, or a page."
+// @x-one-of {"200": [{"type": "array", "items": {"$ref": "#/components/schemas/MessageHeader"}}]}
+// @Failure 400 {string} string "The request parameters or body are invalid."
+// @Failure 401 {string} string "A valid API key or admin credentials are required."
+// @Failure 500 {string} string "The server failed to complete the request."
+// @Security apiKey
+// @Router /api/v1/mailbox/{name} [get]
 func MailboxListV1(w http.ResponseWriter, req *http.Request, ctx *web.Context) (err error) {
 	// Don't have to validate these aren't empty, Gorilla returns 404
 	name, err := ctx.Manager.MailboxForAddress(ctx.Vars["name"])
 	if err != nil {
 		return err
 	}
-	messages, err := ctx.Manager.GetMetadata(name)
+	unreadOnly := false
+	if value := req.URL.Query().Get("unreadOnly"); value != "" {
+		if unreadOnly, err = strconv.ParseBool(value); err != nil {
+			http.Error(w, "unreadOnly must be true or false", http.StatusBadRequest)
+			return nil
+		}
+	}
+	query := req.URL.Query()
+	spam := strings.ToLower(query.Get("spam"))
+	if spam != "" && spam != "all" && spam != "true" && spam != "false" {
+		http.Error(w, "spam must be true, false, or all", http.StatusBadRequest)
+		return nil
+	}
+	minPriority, err := queryPriority(req, "minPriority", storage.PriorityHighest)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return nil
+	}
+	maxPriority, err := queryPriority(req, "maxPriority", storage.PriorityLowest)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return nil
+	}
+	sortBy := query.Get("sortBy")
+	if sortBy != "" && sortBy != "receivedAt" && sortBy != "date" {
+		http.Error(w, "sortBy must be receivedAt or date", http.StatusBadRequest)
+		return nil
+	}
+	tag := query.Get("tag")
+	match := func(msg *message.Metadata) bool {
+		if unreadOnly && msg.Seen {
+			return false
+		}
+		if msg.Priority < minPriority || msg.Priority > maxPriority {
+			return false
+		}
+		if (spam == "true" || spam == "false") && msg.IsSpam() != (spam == "true") {
+			return false
+		}
+		if tag == "" {
+			return true
+		}
+		for _, t := range msg.Tags {
+			if strings.Contains(t, tag) {
+				return true
+			}
+		}
+		return false
+	}
+	if _, paged := query["after"]; paged || query.Get("limit") != "" {
+		if sortBy != "" {
+			http.Error(w, "sortBy cannot be combined with after or limit", http.StatusBadRequest)
+			return nil
+		}
+		limit, err := queryInt(req, "limit", messagePageSize)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return nil
+		}
+		if limit == 0 {
+			limit = messagePageSize
+		}
+		messages, next, err := ctx.Manager.GetMetadataPage(
+			req.Context(), name, query.Get("after"), limit, match)
+		if err == storage.ErrNotExist {
+			http.Error(w, "after must be the ID of a message in the mailbox",
+				http.StatusBadRequest)
+			return nil
+		}
+		if err != nil {
+			return fmt.Errorf("Failed to get messages for %v: %v", name, err)
+		}
+		return web.Render(w, req, &model.JSONMessagePageV1{
+			Messages:   jsonMessageHeaders(name, messages),
+			NextCursor: next,
+		})
+	}
+	messages, err := ctx.Manager.GetMetadata(req.Context(), name)
 	if err != nil {
 		// This doesn't indicate empty, likely an IO error
 		return fmt.Errorf("Failed to get messages for %v: %v", name, err)
 	}
-	jmessages := make([]*model.JSONMessageHeaderV1, len(messages))
-	for i, msg := range messages {
-		jmessages[i] = &model.JSONMessageHeaderV1{
-			Mailbox:     name,
-			ID:          msg.ID,
-			From:        stringutil.StringAddress(msg.From),
-			To:          stringutil.StringAddressList(msg.To),
-			Subject:     msg.Subject,
-			Date:        msg.Date,
-			PosixMillis: msg.Date.UnixNano() / 1000000,
-			Size:        msg.Size,
-			Seen:        msg.Seen,
+	matched := make([]*message.Metadata, 0, len(messages))
+	for _, msg := range messages {
+		if match(msg) {
+			matched = append(matched, msg)
+		}
+	}
+	switch sortBy {
+	case "receivedAt":
+		sort.SliceStable(matched, func(i, j int) bool {
+			return matched[i].ReceivedAt.Before(matched[j].ReceivedAt)
+		})
+	case "date":
+		sort.SliceStable(matched, func(i, j int) bool {
+			return matched[i].Date.Before(matched[j].Date)
+		})
+	}
+	return web.Render(w, req, jsonMessageHeaders(name, matched))
+}
+
+// MailboxSearchV1 renders a list of messages in a mailbox matching the from, subject, and body
+// query parameters.  Matching is case-insensitive, and all specified parameters must match.
+//
+// @Summary Search a mailbox
+// @Description Lists the messages in the mailbox matching every given parameter, ignoring
+// @Description case.  At least one parameter is required.
+// @Tags mailbox
+// @ID searchMailbox
+// @Produce json,plain
+// @Param name path string true "Mailbox name, or an email address."
+// @Param from query string false "Text the from address must contain."
+// @Param subject query string false "Text the subject must contain."
+// @Param body query string false "Body text, if `INBUCKET_WEB_ALLOWBODYSEARCH` is enabled."
+// @Success 200 {array} model.JSONMessageHeaderV1 "Matching message headers."
+// @Failure 400 {string} string "The request parameters or body are invalid."
+// @Failure 401 {string} string "A valid API key or admin credentials are required."
+// @Failure 403 {string} string "Body search is not enabled."
+// @Failure 500 {string} string "The server failed to complete the request."
+// @Security apiKey
+// @Router /api/v1/mailbox/{name}/search [get]
+func MailboxSearchV1(w http.ResponseWriter, req *http.Request, ctx *web.Context) (err error) {
+	// Don't have to validate these aren't empty, Gorilla returns 404
+	name, err := ctx.Manager.MailboxForAddress(ctx.Vars["name"])
+	if err != nil {
+		return err
+	}
+	query := req.URL.Query()
+	from := strings.ToLower(query.Get("from"))
+	subject := strings.ToLower(query.Get("subject"))
+	body := strings.ToLower(query.Get("body"))
+	if from == "" && subject == "" && body == "" {
+		http.Error(w, "At least one of from, subject, or body is required", http.StatusBadRequest)
+		return nil
+	}
+	if body != "" && !ctx.RootConfig.Web.AllowBodySearch {
+		http.Error(w, "Body search is disabled", http.StatusForbidden)
+		return nil
+	}
+	messages, err := ctx.Manager.GetMetadata(req.Context(), name)
+	if err != nil {
+		// This doesn't indicate empty, likely an IO error
+		return fmt.Errorf("Failed to get messages for %v: %v", name, err)
+	}
+	matches := make([]*message.Metadata, 0)
+	for _, meta := range messages {
+		if from != "" &&
+			!strings.Contains(strings.ToLower(stringutil.StringAddress(meta.From)), from) {
+			continue
+		}
+		if subject != "" && !strings.Contains(strings.ToLower(meta.Subject), subject) {
+			continue
+		}
+		if body != "" {
+			// Search the decoded bodies, so that encoded content may be matched.
+			msg, err := ctx.Manager.GetMessage(req.Context(), name, meta.ID)
+			if err == storage.ErrNotExist {
+				continue
+			}
+			if err != nil {
+				return fmt.Errorf("GetMessage(%q) failed: %v", meta.ID, err)
+			}
+			if !strings.Contains(strings.ToLower(msg.Text()), body) &&
+				!strings.Contains(strings.ToLower(msg.HTML()), body) {
+				continue
+			}
+		}
+		matches = append(matches, meta)
+	}
+	return web.Render(w, req, jsonMessageHeaders(name, matches))
+}
+
+// MailboxQuotaV1 renders the storage quota of a mailbox, and the bytes used by its messages.
+// Available bytes are null if no quota is configured.
+//
+// @Summary Get the storage quota of a mailbox
+// @Tags mailbox
+// @ID getMailboxQuota
+// @Produce json,plain
+// @Param name path string true "Mailbox name, or an email address."
+// @Success 200 {object} model.JSONMailboxQuotaV1 "Quota and usage."
+// @Failure 401 {string} string "A valid API key or admin credentials are required."
+// @Failure 500 {string} string "The server failed to complete the request."
+// @Security apiKey
+// @Router /api/v1/mailbox/{name}/quota [get]
+func MailboxQuotaV1(w http.ResponseWriter, req *http.Request, ctx *web.Context) (err error) {
+	// Don't have to validate these aren't empty, Gorilla returns 404
+	name, err := ctx.Manager.MailboxForAddress(ctx.Vars["name"])
+	if err != nil {
+		return err
+	}
+	messages, err := ctx.Manager.GetMetadata(req.Context(), name)
+	if err != nil {
+		// This doesn't indicate empty, likely an IO error
+		return fmt.Errorf("Failed to get messages for %v: %v", name, err)
+	}
+	quota := &model.JSONMailboxQuotaV1{QuotaBytes: ctx.RootConfig.Storage.QuotaBytes}
+	for _, msg := range messages {
+		quota.UsedBytes += msg.Size
+	}
+	if quota.QuotaBytes > 0 {
+		available := quota.QuotaBytes - quota.UsedBytes
+		if available < 0 {
+			available = 0
+		}
+		quota.AvailableBytes = &available
+	}
+	return web.Render(w, req, quota)
+}
+
+// SearchV1 renders a list of messages from all mailboxes matching the to, from, and subject query
+// parameters, and the mailbox glob pattern.  Matching is case-insensitive, and all specified
+// parameters must match.  The number of results is capped by the SearchMax config, unless it is
+// zero.
+//
+// @Summary Search every mailbox
+// @Description Lists messages matching every given parameter, ignoring case.  At least one
+// @Description parameter is required.  Results are capped by `INBUCKET_WEB_SEARCHMAX`.
+// @Tags mailbox
+// @ID searchMessages
+// @Produce json,plain
+// @Param to query string false "Text a to address must contain."
+// @Param from query string false "Text the from address must contain."
+// @Param subject query string false "Text the subject must contain."
+// @Param mailbox query string false "Glob pattern the mailbox name must match."
+// @Success 200 {array} model.JSONMessageHeaderV1 "Matching message headers."
+// @Failure 400 {string} string "The request parameters or body are invalid."
+// @Failure 401 {string} string "A valid API key or admin credentials are required."
+// @Failure 500 {string} string "The server failed to complete the request."
+// @Security apiKey
+// @Router /api/v1/search [get]
+func SearchV1(w http.ResponseWriter, req *http.Request, ctx *web.Context) (err error) {
+	query := req.URL.Query()
+	to := strings.ToLower(query.Get("to"))
+	from := strings.ToLower(query.Get("from"))
+	subject := strings.ToLower(query.Get("subject"))
+	pattern := query.Get("mailbox")
+	if to == "" && from == "" && subject == "" && pattern == "" {
+		http.Error(w, "At least one of to, from, subject, or mailbox is required",
+			http.StatusBadRequest)
+		return nil
+	}
+	if _, err := filepath.Match(pattern, ""); err != nil {
+		http.Error(w, "Invalid mailbox pattern", http.StatusBadRequest)
+		return nil
+	}
+	max := ctx.RootConfig.Web.SearchMax
+	matches := make([]*model.JSONMessageHeaderV1, 0)
+	err = ctx.Manager.VisitMetadata(req.Context(), func(messages []*message.Metadata) bool {
+		if pattern != "" {
+			if ok, _ := filepath.Match(pattern, messages[0].Mailbox); !ok {
+				return true
+			}
+		}
+		for _, meta := range messages {
+			if to != "" && !matchAddressList(meta.To, to) {
+				continue
+			}
+			if from != "" &&
+				!strings.Contains(strings.ToLower(stringutil.StringAddress(meta.From)), from) {
+				continue
+			}
+			if subject != "" && !strings.Contains(strings.ToLower(meta.Subject), subject) {
+				continue
+			}
+			matches = append(matches, jsonMessageHeaders(meta.Mailbox, []*message.Metadata{meta})...)
+			if max > 0 && len(matches) >= max {
+				return false
+			}
+		}
+		return true
+	})
+	if err != nil {
+		return fmt.Errorf("Failed to search mailboxes: %v", err)
+	}
+	return web.Render(w, req, matches)
+}
+
+// matchAddressList returns true if any of the addresses contain the lowercase substr.
+func matchAddressList(addrs []*mail.Address, substr string) bool {
+	for _, addr := range addrs {
+		if strings.Contains(strings.ToLower(stringutil.StringAddress(addr)), substr) {
+			return true
 		}
 	}
-	return web.RenderJSON(w, jmessages)
+	return false
 }
 
-// MailboxShowV1 renders a particular message from a mailbox
+// MailboxShowV1 renders a particular message from a mailbox.  The decoded headers map may be
+// omitted with the headers=false query parameter.  Conditional requests are answered with
+// 304 Not Modified if the message is unchanged.
+//
+// @Summary Get a message
+// @Description Supports conditional requests with `If-None-Match` and `If-Modified-Since`.
+// @Tags message
+// @ID getMessage
+// @Produce json,plain
+// @Param name path string true "Mailbox name, or an email address."
+// @Param id path string true "Message ID, or `latest` for the most recent message."
+// @Param headers query bool false "Include the decoded `headers` map." default(true)
+// @Success 200 {object} model.JSONMessageV1 "The message."
+// @Success 304 "The message has not been modified."
+// @Failure 400 {string} string "The request parameters or body are invalid."
+// @Failure 401 {string} string "A valid API key or admin credentials are required."
+// @Failure 404 {string} string "The mailbox or message does not exist."
+// @Failure 500 {string} string "The server failed to complete the request."
+// @Security apiKey
+// @Router /api/v1/mailbox/{name}/{id} [get]
 func MailboxShowV1(w http.ResponseWriter, req *http.Request, ctx *web.Context) (err error) {
 	// Don't have to validate these aren't empty, Gorilla returns 404
 	id := ctx.Vars["id"]
@@ -53,7 +514,15 @@ func MailboxShowV1(w http.ResponseWriter, req *http.Request, ctx *web.Context) (
 	if err != nil {
 		return err
 	}
-	msg, err := ctx.Manager.GetMessage(name, id)
+	withHeaders := true
+	if v := req.URL.Query().Get("headers"); v != "" {
+		withHeaders, err = strconv.ParseBool(v)
+		if err != nil {
+			http.Error(w, "headers must be true or false", http.StatusBadRequest)
+			return nil
+		}
+	}
+	msg, err := ctx.Manager.GetMessage(req.Context(), name, id)
 	if err != nil && err != storage.ErrNotExist {
 		return fmt.Errorf("GetMessage(%q) failed: %v", id, err)
 	}
@@ -61,6 +530,14 @@ func MailboxShowV1(w http.ResponseWriter, req *http.Request, ctx *web.Context) (
 		http.NotFound(w, req)
 		return nil
 	}
+	// The tag covers everything in the response which may differ for the same message.
+	enc, _ := web.NegotiateEncoding(req)
+	etag := web.ETag(name, msg.ID, req.Host, string(enc), strconv.FormatBool(withHeaders),
+		strconv.FormatBool(msg.Seen), strings.Join(msg.Tags, ","), msg.DKIMResult.String(),
+		msg.DKIMDomain)
+	if web.CheckNotModified(w, req, etag, msg.Date) {
+		return nil
+	}
 	attachParts := msg.Attachments()
 	attachments := make([]*model.JSONMessageAttachmentV1, len(attachParts))
 	for i, part := range attachParts {
@@ -77,18 +554,35 @@ func MailboxShowV1(w http.ResponseWriter, req *http.Request, ctx *web.Context) (
 			MD5:          hex.EncodeToString(checksum[:]),
 		}
 	}
-	return web.RenderJSON(w,
+	var headers map[string][]string
+	if withHeaders {
+		headers = msg.DecodedHeader()
+	}
+	return web.Render(w, req,
 		&model.JSONMessageV1{
-			Mailbox:     name,
-			ID:          msg.ID,
-			From:        stringutil.StringAddress(msg.From),
-			To:          stringutil.StringAddressList(msg.To),
-			Subject:     msg.Subject,
-			Date:        msg.Date,
-			PosixMillis: msg.Date.UnixNano() / 1000000,
-			Size:        msg.Size,
-			Seen:        msg.Seen,
-			Header:      msg.Header(),
+			Mailbox:         name,
+			ID:              msg.ID,
+			From:            stringutil.StringAddress(msg.From),
+			To:              stringutil.StringAddressList(msg.To),
+			Cc:              stringutil.StringAddressList(msg.AddressList("Cc")),
+			ReplyTo:         stringutil.StringAddressList(msg.AddressList("Reply-To")),
+			MessageID:       msg.Header().Get("Message-ID"),
+			Subject:         msg.Subject,
+			Date:            msg.Date,
+			PosixMillis:     msg.Date.UnixNano() / 1000000,
+			ReceivedAt:      msg.ReceivedAt,
+			Size:            msg.Size,
+			Seen:            msg.Seen,
+			EnvelopeID:      msg.EnvelopeID,
+			DKIMResult:      msg.DKIMResult.String(),
+			DKIMDomain:      msg.DKIMDomain,
+			SPFResult:       msg.SPFResult,
+			Tags:            msg.Tags,
+			AttachmentCount: msg.AttachmentCount,
+			AttachmentBytes: msg.AttachmentBytes,
+			Priority:        msg.Priority,
+			Header:          msg.Header(),
+			Headers:         headers,
 			Body: &model.JSONMessageBodyV1{
 				Text: msg.Text(),
 				HTML: msg.HTML(),
@@ -98,6 +592,22 @@ func MailboxShowV1(w http.ResponseWriter, req *http.Request, ctx *web.Context) (
 }
 
 // MailboxMarkSeenV1 marks a message as read.
+//
+// @Summary Mark a message as read
+// @Description Only the `seen` property of the request body is used.
+// @Tags message
+// @ID markMessageSeen
+// @Accept json
+// @Produce json,plain
+// @Param name path string true "Mailbox name, or an email address."
+// @Param id path string true "Message ID, or `latest` for the most recent message."
+// @Param request body model.JSONMessageHeaderV1 true "Message header with `seen` set."
+// @Success 200 {string} string "OK"
+// @Failure 401 {string} string "A valid API key or admin credentials are required."
+// @Failure 404 {string} string "The mailbox or message does not exist."
+// @Failure 500 {string} string "The server failed to complete the request."
+// @Security apiKey
+// @Router /api/v1/mailbox/{name}/{id} [patch]
 func MailboxMarkSeenV1(w http.ResponseWriter, req *http.Request, ctx *web.Context) (err error) {
 	// Don't have to validate these aren't empty, Gorilla returns 404
 	id := ctx.Vars["id"]
@@ -105,13 +615,12 @@ func MailboxMarkSeenV1(w http.ResponseWriter, req *http.Request, ctx *web.Contex
 	if err != nil {
 		return err
 	}
-	dec := json.NewDecoder(req.Body)
 	dm := model.JSONMessageHeaderV1{}
-	if err := dec.Decode(&dm); err != nil {
-		return fmt.Errorf("Failed to decode JSON: %v", err)
+	if err := web.DecodeBody(req, &dm); err != nil {
+		return fmt.Errorf("Failed to decode request body: %v", err)
 	}
 	if dm.Seen {
-		err = ctx.Manager.MarkSeen(name, id)
+		err = ctx.Manager.MarkSeen(req.Context(), name, id)
 		if err == storage.ErrNotExist {
 			http.NotFound(w, req)
 			return nil
@@ -121,25 +630,385 @@ func MailboxMarkSeenV1(w http.ResponseWriter, req *http.Request, ctx *web.Contex
 			return fmt.Errorf("MarkSeen(%q) failed: %v", id, err)
 		}
 	}
-	return web.RenderJSON(w, "OK")
+	return web.Render(w, req, "OK")
+}
+
+// MailboxMarkReadV1 marks a message as read or unread.
+//
+// @Summary Mark a message as read or unread
+// @Tags message
+// @ID setMessageRead
+// @Accept json
+// @Produce json,plain
+// @Param name path string true "Mailbox name, or an email address."
+// @Param id path string true "Message ID, or `latest` for the most recent message."
+// @Param request body model.JSONMessageReadV1 true "Read status."
+// @Success 200 {string} string "OK"
+// @Failure 400 {string} string "The request parameters or body are invalid."
+// @Failure 401 {string} string "A valid API key or admin credentials are required."
+// @Failure 404 {string} string "The mailbox or message does not exist."
+// @Failure 500 {string} string "The server failed to complete the request."
+// @Security apiKey
+// @Router /api/v1/mailbox/{name}/{id}/read [put]
+func MailboxMarkReadV1(w http.ResponseWriter, req *http.Request, ctx *web.Context) (err error) {
+	// Don't have to validate these aren't empty, Gorilla returns 404
+	id := ctx.Vars["id"]
+	name, err := ctx.Manager.MailboxForAddress(ctx.Vars["name"])
+	if err != nil {
+		return err
+	}
+	var body model.JSONMessageReadV1
+	if err := web.DecodeBody(req, &body); err != nil {
+		http.Error(w, fmt.Sprintf("Failed to decode request body: %v", err), http.StatusBadRequest)
+		return nil
+	}
+	if body.Read {
+		err = ctx.Manager.MarkSeen(req.Context(), name, id)
+	} else {
+		err = ctx.Manager.MarkUnseen(req.Context(), name, id)
+	}
+	if err == storage.ErrNotExist {
+		http.NotFound(w, req)
+		return nil
+	}
+	if err != nil {
+		// This doesn't indicate empty, likely an IO error
+		return fmt.Errorf("Failed to mark %q read %v: %v", id, body.Read, err)
+	}
+	return web.Render(w, req, "OK")
+}
+
+// maxTagLength is the maximum length of a message tag.
+const maxTagLength = 64
+
+// MailboxTagsV1 replaces the tags of a message.  Tags must be 1 to maxTagLength printable ASCII
+// characters.
+//
+// @Summary Replace the tags of a message
+// @Description Tags must be 1 to 64 printable ASCII characters.
+// @Tags message
+// @ID setMessageTags
+// @Accept json
+// @Produce json,plain
+// @Param name path string true "Mailbox name, or an email address."
+// @Param id path string true "Message ID, or `latest` for the most recent message."
+// @Param request body model.JSONMessageTagsV1 true "New tags."
+// @Success 200 {string} string "OK"
+// @Failure 400 {string} string "The request parameters or body are invalid."
+// @Failure 401 {string} string "A valid API key or admin credentials are required."
+// @Failure 404 {string} string "The mailbox or message does not exist."
+// @Failure 500 {string} string "The server failed to complete the request."
+// @Security apiKey
+// @Router /api/v1/mailbox/{name}/{id}/tags [put]
+func MailboxTagsV1(w http.ResponseWriter, req *http.Request, ctx *web.Context) (err error) {
+	// Don't have to validate these aren't empty, Gorilla returns 404
+	id := ctx.Vars["id"]
+	name, err := ctx.Manager.MailboxForAddress(ctx.Vars["name"])
+	if err != nil {
+		return err
+	}
+	var body model.JSONMessageTagsV1
+	if err := web.DecodeBody(req, &body); err != nil {
+		http.Error(w, fmt.Sprintf("Failed to decode request body: %v", err), http.StatusBadRequest)
+		return nil
+	}
+	for _, tag := range body.Tags {
+		if !validTag(tag) {
+			http.Error(w, fmt.Sprintf("Invalid tag %q, must be 1 to %v printable ASCII characters",
+				tag, maxTagLength), http.StatusBadRequest)
+			return nil
+		}
+	}
+	err = ctx.Manager.SetTags(req.Context(), name, id, body.Tags)
+	if err == storage.ErrNotExist {
+		http.NotFound(w, req)
+		return nil
+	}
+	if err != nil {
+		// This doesn't indicate empty, likely an IO error
+		return fmt.Errorf("SetTags(%q) failed: %v", id, err)
+	}
+	return web.Render(w, req, "OK")
+}
+
+// validTag returns true if tag is 1 to maxTagLength printable ASCII characters.
+func validTag(tag string) bool {
+	if tag == "" || len(tag) > maxTagLength {
+		return false
+	}
+	for i := 0; i < len(tag); i++ {
+		if tag[i] < ' ' || tag[i] > '~' {
+			return false
+		}
+	}
+	return true
 }
 
-// MailboxPurgeV1 deletes all messages from a mailbox
+// MailboxPurgeV1 deletes all messages from a mailbox.  Responds with 404 if the mailbox is already
+// empty.
+//
+// @Summary Delete every message in a mailbox
+// @Tags mailbox
+// @ID purgeMailbox
+// @Produce plain
+// @Param name path string true "Mailbox name, or an email address."
+// @Success 204 "The messages were deleted."
+// @Failure 401 {string} string "A valid API key or admin credentials are required."
+// @Failure 404 {string} string "The mailbox or message does not exist."
+// @Failure 500 {string} string "The server failed to complete the request."
+// @Security apiKey
+// @Router /api/v1/mailbox/{name} [delete]
 func MailboxPurgeV1(w http.ResponseWriter, req *http.Request, ctx *web.Context) (err error) {
 	// Don't have to validate these aren't empty, Gorilla returns 404
 	name, err := ctx.Manager.MailboxForAddress(ctx.Vars["name"])
 	if err != nil {
 		return err
 	}
-	// Delete all messages
-	err = ctx.Manager.PurgeMessages(name)
+	messages, err := ctx.Manager.GetMetadata(req.Context(), name)
+	if err != nil {
+		return fmt.Errorf("Failed to get messages for %v: %v", name, err)
+	}
+	if len(messages) == 0 {
+		http.NotFound(w, req)
+		return nil
+	}
+	// Delete all messages, the store holds the mailbox lock for the duration of the purge.
+	err = ctx.Manager.PurgeMessages(req.Context(), name)
 	if err != nil {
 		return fmt.Errorf("Mailbox(%q) purge failed: %v", name, err)
 	}
-	return web.RenderJSON(w, "OK")
+	w.WriteHeader(http.StatusNoContent)
+	return nil
+}
+
+// MailboxImportV1 adds the message/rfc822 request body to a mailbox.
+//
+// @Summary Import a message
+// @Description Adds the message in the request body to the mailbox.  The size of the message
+// @Description is limited by `INBUCKET_WEB_IMPORTMAXBYTES`.
+// @Tags mailbox
+// @ID importMessage
+// @Accept message/rfc822
+// @Produce json,plain
+// @Param name path string true "Mailbox name, or an email address."
+// @Param message body string true "Message source."
+// @Success 201 {object} model.JSONMessageRefV1 "The message was added."
+// @Failure 400 {string} string "The request parameters or body are invalid."
+// @Failure 401 {string} string "A valid API key or admin credentials are required."
+// @Failure 413 {string} string "The message is too large."
+// @Failure 415 {string} string "The request body is not message/rfc822."
+// @Failure 500 {string} string "The server failed to complete the request."
+// @Failure 507 {string} string "The mailbox is full, or over its quota."
+// @Security apiKey
+// @Router /api/v1/mailbox/{name} [post]
+func MailboxImportV1(w http.ResponseWriter, req *http.Request, ctx *web.Context) (err error) {
+	// Don't have to validate these aren't empty, Gorilla returns 404
+	name, err := ctx.Manager.MailboxForAddress(ctx.Vars["name"])
+	if err != nil {
+		return err
+	}
+	mediatype, _, err := mime.ParseMediaType(req.Header.Get("Content-Type"))
+	if err != nil || mediatype != "message/rfc822" {
+		http.Error(w, "Content-Type must be message/rfc822", http.StatusUnsupportedMediaType)
+		return nil
+	}
+	max := int64(ctx.RootConfig.Web.ImportMaxBytes)
+	source, err := ioutil.ReadAll(http.MaxBytesReader(w, req.Body, max))
+	if err != nil {
+		if int64(len(source)) >= max {
+			http.Error(w, fmt.Sprintf("Message exceeds maximum size of %v bytes", max),
+				http.StatusRequestEntityTooLarge)
+			return nil
+		}
+		return fmt.Errorf("Failed to read message: %v", err)
+	}
+	msg, err := mail.ReadMessage(bytes.NewReader(source))
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Malformed message: %v", err), http.StatusBadRequest)
+		return nil
+	}
+	id, err := ctx.Manager.Import(req.Context(), name, msg, source)
+	if err == storage.ErrMailboxFull || err == storage.ErrQuotaExceeded {
+		http.Error(w, fmt.Sprintf("Mailbox %q is full", name), http.StatusInsufficientStorage)
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("Mailbox(%q) import failed: %v", name, err)
+	}
+	return web.RenderStatus(w, req, http.StatusCreated, &model.JSONMessageRefV1{Mailbox: name, ID: id})
+}
+
+// MailboxGenerateV1 renders the message template named in the request body, and adds the
+// resulting message to a mailbox.
+//
+// @Summary Generate a message from a template
+// @Description Renders a template from the `INBUCKET_WEB_TEMPLATESPATH` directory, and adds
+// @Description the resulting message to the mailbox.
+// @Tags mailbox
+// @ID generateMessage
+// @Accept json
+// @Produce json,plain
+// @Param name path string true "Mailbox name, or an email address."
+// @Param request body model.JSONMessageGenerateV1 true "Template and variables."
+// @Success 201 {object} model.JSONMessageRefV1 "The message was added."
+// @Failure 400 {string} string "The request parameters or body are invalid."
+// @Failure 401 {string} string "A valid API key or admin credentials are required."
+// @Failure 404 {string} string "The template does not exist."
+// @Failure 422 {string} string "The template could not be rendered."
+// @Failure 500 {string} string "The server failed to complete the request."
+// @Failure 507 {string} string "The mailbox is full, or over its quota."
+// @Security apiKey
+// @Router /api/v1/mailbox/{name}/generate [post]
+func MailboxGenerateV1(w http.ResponseWriter, req *http.Request, ctx *web.Context) (err error) {
+	dir := ctx.RootConfig.Web.TemplatesPath
+	if dir == "" {
+		http.Error(w, "Message templates are not configured", http.StatusNotFound)
+		return nil
+	}
+	// Don't have to validate these aren't empty, Gorilla returns 404
+	name, err := ctx.Manager.MailboxForAddress(ctx.Vars["name"])
+	if err != nil {
+		return err
+	}
+	var body model.JSONMessageGenerateV1
+	if err := web.DecodeBody(req, &body); err != nil {
+		http.Error(w, fmt.Sprintf("Failed to decode request body: %v", err), http.StatusBadRequest)
+		return nil
+	}
+	source, err := message.Generate(dir, body.Template, body.Vars)
+	if err == message.ErrNoTemplate {
+		http.Error(w, fmt.Sprintf("Template %q does not exist", body.Template),
+			http.StatusNotFound)
+		return nil
+	}
+	if tErr, ok := err.(*message.TemplateError); ok {
+		http.Error(w, tErr.Error(), http.StatusUnprocessableEntity)
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("Failed to generate message: %v", err)
+	}
+	msg, err := mail.ReadMessage(bytes.NewReader(source))
+	if err != nil {
+		return fmt.Errorf("Generated malformed message: %v", err)
+	}
+	id, err := ctx.Manager.Import(req.Context(), name, msg, source)
+	if err == storage.ErrMailboxFull || err == storage.ErrQuotaExceeded {
+		http.Error(w, fmt.Sprintf("Mailbox %q is full", name), http.StatusInsufficientStorage)
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("Mailbox(%q) generate failed: %v", name, err)
+	}
+	return web.RenderStatus(w, req, http.StatusCreated, &model.JSONMessageRefV1{Mailbox: name, ID: id})
+}
+
+// MailboxMoveV1 moves a message to the destination mailbox named in the request body, and returns
+// its new ID.
+//
+// @Summary Move a message to another mailbox
+// @Tags message
+// @ID moveMessage
+// @Accept json
+// @Produce json,plain
+// @Param name path string true "Mailbox name, or an email address."
+// @Param id path string true "Message ID, or `latest` for the most recent message."
+// @Param request body model.JSONMessageMoveV1 true "Destination mailbox."
+// @Success 200 {object} model.JSONMessageRefV1 "The message was moved."
+// @Failure 400 {string} string "The request parameters or body are invalid."
+// @Failure 401 {string} string "A valid API key or admin credentials are required."
+// @Failure 404 {string} string "The mailbox or message does not exist."
+// @Failure 500 {string} string "The server failed to complete the request."
+// @Failure 507 {string} string "The mailbox is full, or over its quota."
+// @Security apiKey
+// @Router /api/v1/mailbox/{name}/{id}/move [post]
+func MailboxMoveV1(w http.ResponseWriter, req *http.Request, ctx *web.Context) (err error) {
+	return relocateMessage(w, req, ctx, "MoveMessage", ctx.Manager.MoveMessage, http.StatusOK)
+}
+
+// MailboxCopyV1 copies a message to the destination mailbox named in the request body, and
+// returns the ID of the copy.
+//
+// @Summary Copy a message to another mailbox
+// @Tags message
+// @ID copyMessage
+// @Accept json
+// @Produce json,plain
+// @Param name path string true "Mailbox name, or an email address."
+// @Param id path string true "Message ID, or `latest` for the most recent message."
+// @Param request body model.JSONMessageMoveV1 true "Destination mailbox."
+// @Success 201 {object} model.JSONMessageRefV1 "The message was copied."
+// @Failure 400 {string} string "The request parameters or body are invalid."
+// @Failure 401 {string} string "A valid API key or admin credentials are required."
+// @Failure 404 {string} string "The mailbox or message does not exist."
+// @Failure 500 {string} string "The server failed to complete the request."
+// @Failure 507 {string} string "The mailbox is full, or over its quota."
+// @Security apiKey
+// @Router /api/v1/mailbox/{name}/{id}/copy [post]
+func MailboxCopyV1(w http.ResponseWriter, req *http.Request, ctx *web.Context) (err error) {
+	return relocateMessage(w, req, ctx, "CopyMessage", ctx.Manager.CopyMessage, http.StatusCreated)
+}
+
+// relocateMessage calls op, either Manager.MoveMessage or Manager.CopyMessage, with the message
+// and the destination mailbox named in the request body, then responds with status and the
+// reference to the new message.
+func relocateMessage(
+	w http.ResponseWriter,
+	req *http.Request,
+	ctx *web.Context,
+	opName string,
+	op func(ctx context.Context, src, id, dst string) (string, error),
+	status int,
+) (err error) {
+	// Don't have to validate these aren't empty, Gorilla returns 404
+	id := ctx.Vars["id"]
+	name, err := ctx.Manager.MailboxForAddress(ctx.Vars["name"])
+	if err != nil {
+		return err
+	}
+	var body model.JSONMessageMoveV1
+	if err := web.DecodeBody(req, &body); err != nil {
+		http.Error(w, fmt.Sprintf("Failed to decode request body: %v", err), http.StatusBadRequest)
+		return nil
+	}
+	dest, err := ctx.Manager.MailboxForAddress(body.Destination)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Invalid destination: %v", err), http.StatusBadRequest)
+		return nil
+	}
+	newID, err := op(req.Context(), name, id, dest)
+	switch err {
+	case nil:
+	case storage.ErrNotExist:
+		http.NotFound(w, req)
+		return nil
+	case storage.ErrMailboxFull, storage.ErrQuotaExceeded:
+		http.Error(w, fmt.Sprintf("Mailbox %q is full", dest), http.StatusInsufficientStorage)
+		return nil
+	case message.ErrSameMailbox:
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return nil
+	default:
+		return fmt.Errorf("%v(%q) failed: %v", opName, id, err)
+	}
+	return web.RenderStatus(w, req, status, &model.JSONMessageRefV1{Mailbox: dest, ID: newID})
 }
 
 // MailboxSourceV1 displays the raw source of a message, including headers. Renders text/plain
+//
+// @Summary Get the source of a message as text
+// @Tags message
+// @ID getMessageSource
+// @Produce plain
+// @Param name path string true "Mailbox name, or an email address."
+// @Param id path string true "Message ID, or `latest` for the most recent message."
+// @Success 200 {string} string "Message source."
+// @Success 304 "The message has not been modified."
+// @Failure 401 {string} string "A valid API key or admin credentials are required."
+// @Failure 404 {string} string "The mailbox or message does not exist."
+// @Failure 500 {string} string "The server failed to complete the request."
+// @Security apiKey
+// @Router /api/v1/mailbox/{name}/{id}/source [get]
 func MailboxSourceV1(w http.ResponseWriter, req *http.Request, ctx *web.Context) (err error) {
 	// Don't have to validate these aren't empty, Gorilla returns 404
 	id := ctx.Vars["id"]
@@ -147,21 +1016,221 @@ func MailboxSourceV1(w http.ResponseWriter, req *http.Request, ctx *web.Context)
 	if err != nil {
 		return err
 	}
-	r, err := ctx.Manager.SourceReader(name, id)
+	meta, r, err := ctx.Manager.RawMessage(req.Context(), name, id)
 	if err != nil && err != storage.ErrNotExist {
-		return fmt.Errorf("SourceReader(%q) failed: %v", id, err)
+		return fmt.Errorf("RawMessage(%q) failed: %v", id, err)
 	}
 	if r == nil {
 		http.NotFound(w, req)
 		return nil
 	}
+	defer r.Close()
+	if web.CheckNotModified(w, req, web.ETag(name, meta.ID), meta.Date) {
+		return nil
+	}
 	// Output message source
 	w.Header().Set("Content-Type", "text/plain")
 	_, err = io.Copy(w, r)
 	return err
 }
 
+// MailboxRawV1 downloads the stored source of a message as an attachment.
+//
+// @Summary Download the source of a message
+// @Tags message
+// @ID downloadMessage
+// @Produce message/rfc822,plain
+// @Param name path string true "Mailbox name, or an email address."
+// @Param id path string true "Message ID, or `latest` for the most recent message."
+// @Success 200 {file} file "Message source, as an `.eml` attachment."
+// @Success 304 "The message has not been modified."
+// @Failure 401 {string} string "A valid API key or admin credentials are required."
+// @Failure 404 {string} string "The mailbox or message does not exist."
+// @Failure 500 {string} string "The server failed to complete the request."
+// @Security apiKey
+// @Router /api/v1/mailbox/{name}/{id}/raw [get]
+func MailboxRawV1(w http.ResponseWriter, req *http.Request, ctx *web.Context) (err error) {
+	// Don't have to validate these aren't empty, Gorilla returns 404
+	id := ctx.Vars["id"]
+	name, err := ctx.Manager.MailboxForAddress(ctx.Vars["name"])
+	if err != nil {
+		return err
+	}
+	meta, r, err := ctx.Manager.RawMessage(req.Context(), name, id)
+	if err != nil && err != storage.ErrNotExist {
+		return fmt.Errorf("RawMessage(%q) failed: %v", id, err)
+	}
+	if r == nil {
+		http.NotFound(w, req)
+		return nil
+	}
+	defer r.Close()
+	// Use the resolved ID, as id may be "latest".
+	if web.CheckNotModified(w, req, web.ETag(name, meta.ID), meta.Date) {
+		return nil
+	}
+	w.Header().Set("Content-Type", "message/rfc822")
+	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", meta.ID+".eml"))
+	w.Header().Set("Content-Length", strconv.FormatInt(meta.Size, 10))
+	_, err = io.Copy(w, r)
+	return err
+}
+
+// MailboxPartsV1 renders a list of the decoded MIME parts of a message.
+//
+// @Summary List the MIME parts of a message
+// @Tags message
+// @ID listMessageParts
+// @Produce json,plain
+// @Param name path string true "Mailbox name, or an email address."
+// @Param id path string true "Message ID, or `latest` for the most recent message."
+// @Success 200 {array} model.JSONMessagePartV1 "Decoded MIME parts."
+// @Failure 401 {string} string "A valid API key or admin credentials are required."
+// @Failure 404 {string} string "The mailbox or message does not exist."
+// @Failure 500 {string} string "The server failed to complete the request."
+// @Security apiKey
+// @Router /api/v1/mailbox/{name}/{id}/parts [get]
+func MailboxPartsV1(w http.ResponseWriter, req *http.Request, ctx *web.Context) (err error) {
+	parts, err := messageParts(req, ctx)
+	if err == storage.ErrNotExist {
+		http.NotFound(w, req)
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	jparts := make([]*model.JSONMessagePartV1, len(parts))
+	for i, part := range parts {
+		jparts[i] = &model.JSONMessagePartV1{
+			PartIndex:   part.Index,
+			ContentType: part.MediaType,
+			Filename:    part.Filename,
+			Size:        len(part.Content),
+		}
+	}
+	return web.Render(w, req, jparts)
+}
+
+// MailboxPartV1 outputs the decoded content of a single MIME part of a message.
+//
+// @Summary Get the decoded content of a MIME part
+// @Tags message
+// @ID getMessagePart
+// @Produce */*,plain
+// @Param name path string true "Mailbox name, or an email address."
+// @Param id path string true "Message ID, or `latest` for the most recent message."
+// @Param part path int true "Index of the part, as listed by listMessageParts." minimum(0)
+// @Success 200 {file} file "Part content, with its own content type."
+// @Failure 401 {string} string "A valid API key or admin credentials are required."
+// @Failure 404 {string} string "The mailbox or message does not exist."
+// @Failure 500 {string} string "The server failed to complete the request."
+// @Security apiKey
+// @Router /api/v1/mailbox/{name}/{id}/parts/{part} [get]
+func MailboxPartV1(w http.ResponseWriter, req *http.Request, ctx *web.Context) (err error) {
+	index, err := strconv.Atoi(ctx.Vars["part"])
+	if err != nil {
+		http.NotFound(w, req)
+		return nil
+	}
+	parts, err := messageParts(req, ctx)
+	if err == storage.ErrNotExist || (err == nil && index >= len(parts)) {
+		http.NotFound(w, req)
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	part := parts[index]
+	w.Header().Set("Content-Type", part.ContentType)
+	w.Header().Set("Content-Length", strconv.Itoa(len(part.Content)))
+	if part.Filename != "" {
+		w.Header().Set("Content-Disposition",
+			mime.FormatMediaType("attachment", map[string]string{"filename": part.Filename}))
+	}
+	_, err = w.Write(part.Content)
+	return err
+}
+
+// MailboxHTMLV1 outputs the HTML body of a message, with inline images embedded as data URIs.
+// Messages without an HTML body have their plain text body rendered as preformatted text.
+//
+// @Summary Get the HTML body of a message
+// @Description Inline images are embedded as data URIs.  A plain text body is rendered as
+// @Description preformatted text.
+// @Tags message
+// @ID getMessageHTML
+// @Produce html,plain
+// @Param name path string true "Mailbox name, or an email address."
+// @Param id path string true "Message ID, or `latest` for the most recent message."
+// @Success 200 {string} string "HTML document."
+// @Failure 401 {string} string "A valid API key or admin credentials are required."
+// @Failure 404 {string} string "The mailbox or message does not exist."
+// @Failure 500 {string} string "The server failed to complete the request."
+// @Security apiKey
+// @Router /api/v1/mailbox/{name}/{id}/html [get]
+func MailboxHTMLV1(w http.ResponseWriter, req *http.Request, ctx *web.Context) (err error) {
+	// Don't have to validate these aren't empty, Gorilla returns 404
+	id := ctx.Vars["id"]
+	name, err := ctx.Manager.MailboxForAddress(ctx.Vars["name"])
+	if err != nil {
+		return err
+	}
+	_, r, err := ctx.Manager.RawMessage(req.Context(), name, id)
+	if err != nil && err != storage.ErrNotExist {
+		return fmt.Errorf("RawMessage(%q) failed: %v", id, err)
+	}
+	if r == nil {
+		http.NotFound(w, req)
+		return nil
+	}
+	defer r.Close()
+	body, images, err := message.ParseHTML(r, ctx.RootConfig.Web.PartsMaxDepth)
+	if err != nil {
+		return fmt.Errorf("Failed to parse HTML of %q: %v", id, err)
+	}
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	_, err = io.WriteString(w, message.EmbedImages(body, images))
+	return err
+}
+
+// messageParts reads the MIME parts of the message specified by the request.  Returns
+// storage.ErrNotExist if the message does not exist.
+func messageParts(req *http.Request, ctx *web.Context) ([]*message.Part, error) {
+	// Don't have to validate these aren't empty, Gorilla returns 404
+	id := ctx.Vars["id"]
+	name, err := ctx.Manager.MailboxForAddress(ctx.Vars["name"])
+	if err != nil {
+		return nil, err
+	}
+	_, r, err := ctx.Manager.RawMessage(req.Context(), name, id)
+	if err != nil && err != storage.ErrNotExist {
+		return nil, fmt.Errorf("RawMessage(%q) failed: %v", id, err)
+	}
+	if r == nil {
+		return nil, storage.ErrNotExist
+	}
+	defer r.Close()
+	parts, err := message.ReadParts(r, ctx.RootConfig.Web.PartsMaxDepth)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to read parts of %q: %v", id, err)
+	}
+	return parts, nil
+}
+
 // MailboxDeleteV1 removes a particular message from a mailbox
+//
+// @Summary Delete a message
+// @Tags message
+// @ID deleteMessage
+// @Produce json,plain
+// @Param name path string true "Mailbox name, or an email address."
+// @Param id path string true "Message ID, or `latest` for the most recent message."
+// @Success 200 {string} string "OK"
+// @Failure 401 {string} string "A valid API key or admin credentials are required."
+// @Failure 404 {string} string "The mailbox or message does not exist."
+// @Failure 500 {string} string "The server failed to complete the request."
+// @Security apiKey
+// @Router /api/v1/mailbox/{name}/{id} [delete]
 func MailboxDeleteV1(w http.ResponseWriter, req *http.Request, ctx *web.Context) (err error) {
 	// Don't have to validate these aren't empty, Gorilla returns 404
 	id := ctx.Vars["id"]
@@ -169,7 +1238,7 @@ func MailboxDeleteV1(w http.ResponseWriter, req *http.Request, ctx *web.Context)
 	if err != nil {
 		return err
 	}
-	err = ctx.Manager.RemoveMessage(name, id)
+	err = ctx.Manager.RemoveMessage(req.Context(), name, id)
 	if err == storage.ErrNotExist {
 		http.NotFound(w, req)
 		return nil
@@ -178,5 +1247,34 @@ func MailboxDeleteV1(w http.ResponseWriter, req *http.Request, ctx *web.Context)
 		// This doesn't indicate missing, likely an IO error
 		return fmt.Errorf("RemoveMessage(%q) failed: %v", id, err)
 	}
-	return web.RenderJSON(w, "OK")
+	return web.Render(w, req, "OK")
+}
+
+// jsonMessageHeaders converts message metadata into the JSON list representation.
+func jsonMessageHeaders(name string, messages []*message.Metadata) []*model.JSONMessageHeaderV1 {
+	jmessages := make([]*model.JSONMessageHeaderV1, len(messages))
+	for i, msg := range messages {
+		jmessages[i] = &model.JSONMessageHeaderV1{
+			Mailbox:         name,
+			ID:              msg.ID,
+			From:            stringutil.StringAddress(msg.From),
+			To:              stringutil.StringAddressList(msg.To),
+			Subject:         msg.Subject,
+			Date:            msg.Date,
+			PosixMillis:     msg.Date.UnixNano() / 1000000,
+			ReceivedAt:      msg.ReceivedAt,
+			Size:            msg.Size,
+			Seen:            msg.Seen,
+			EnvelopeID:      msg.EnvelopeID,
+			DKIMResult:      msg.DKIMResult.String(),
+			DKIMDomain:      msg.DKIMDomain,
+			SPFResult:       msg.SPFResult,
+			Tags:            msg.Tags,
+			AttachmentCount: msg.AttachmentCount,
+			AttachmentBytes: msg.AttachmentBytes,
+			Snippet:         msg.Snippet,
+			Priority:        msg.Priority,
+		}
+	}
+	return jmessages
 }
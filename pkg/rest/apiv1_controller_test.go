@@ -1,17 +1,41 @@
 package rest
 
 import (
+	"bytes"
+	"context"
 	"encoding/json"
+	"fmt"
 	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
 	"net/mail"
 	"net/textproto"
+	"net/url"
 	"os"
+	"path/filepath"
+	"reflect"
+	"strconv"
+	"strings"
 	"testing"
 	"time"
 
+	"github.com/inbucket/inbucket/pkg/config"
 	"github.com/inbucket/inbucket/pkg/message"
+	"github.com/inbucket/inbucket/pkg/policy"
+	"github.com/inbucket/inbucket/pkg/pubsub"
+	"github.com/inbucket/inbucket/pkg/rest/model"
+	"github.com/inbucket/inbucket/pkg/server/web"
+	"github.com/inbucket/inbucket/pkg/storage"
+	"github.com/inbucket/inbucket/pkg/storage/file"
+	"github.com/inbucket/inbucket/pkg/storage/mem"
 	"github.com/inbucket/inbucket/pkg/test"
 	"github.com/jhillyerd/enmime"
+	"github.com/vmihailenco/msgpack/v5"
+	"go.opentelemetry.io/otel"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+	"go.opentelemetry.io/otel/trace"
 )
 
 const (
@@ -82,6 +106,10 @@ func TestRestMailboxList(t *testing.T) {
 		To:      []*mail.Address{{Name: "", Address: "to1@host"}},
 		Subject: "subject 2",
 		Date:    time.Date(2012, 7, 1, 10, 11, 12, 253, tzPDT),
+
+		AttachmentCount: 2,
+		AttachmentBytes: 4096,
+		Snippet:         "Hello <world>",
 	}
 	mm.AddMessage("good", &message.Message{Metadata: meta1})
 	mm.AddMessage("good", &message.Message{Metadata: meta2})
@@ -115,6 +143,8 @@ func TestRestMailboxList(t *testing.T) {
 	decodedNumberEquals(t, result, "[0]/posix-millis", 1328119872000)
 	decodedNumberEquals(t, result, "[0]/size", 0)
 	decodedBoolEquals(t, result, "[0]/seen", false)
+	decodedNumberEquals(t, result, "[0]/attachmentCount", 0)
+	decodedNumberEquals(t, result, "[0]/attachmentBytes", 0)
 	decodedStringEquals(t, result, "[1]/mailbox", "good")
 	decodedStringEquals(t, result, "[1]/id", "0002")
 	decodedStringEquals(t, result, "[1]/from", "<from2@host>")
@@ -124,6 +154,9 @@ func TestRestMailboxList(t *testing.T) {
 	decodedNumberEquals(t, result, "[1]/posix-millis", 1341162672000)
 	decodedNumberEquals(t, result, "[1]/size", 0)
 	decodedBoolEquals(t, result, "[1]/seen", false)
+	decodedNumberEquals(t, result, "[1]/attachmentCount", 2)
+	decodedNumberEquals(t, result, "[1]/attachmentBytes", 4096)
+	decodedStringEquals(t, result, "[1]/snippet", "Hello <world>")
 
 	if t.Failed() {
 		// Wait for handler to finish logging
@@ -186,6 +219,9 @@ func TestRestMessage(t *testing.T) {
 			Subject: "subject 1",
 			Date:    time.Date(2012, 2, 1, 10, 11, 12, 253, tzPST),
 			Seen:    true,
+
+			AttachmentCount: 1,
+			AttachmentBytes: 1150,
 		},
 		&enmime.Envelope{
 			Text: "This is some text",
@@ -230,6 +266,8 @@ func TestRestMessage(t *testing.T) {
 	decodedNumberEquals(t, result, "posix-millis", 1328119872000)
 	decodedNumberEquals(t, result, "size", 0)
 	decodedBoolEquals(t, result, "seen", true)
+	decodedNumberEquals(t, result, "attachmentCount", 1)
+	decodedNumberEquals(t, result, "attachmentBytes", 1150)
 	decodedStringEquals(t, result, "body/text", "This is some text")
 	decodedStringEquals(t, result, "body/html", "This is some HTML")
 	decodedStringEquals(t, result, "header/To/[0]", "fred@fish.com")
@@ -248,6 +286,521 @@ func TestRestMessage(t *testing.T) {
 	}
 }
 
+func TestRestMessageHeaders(t *testing.T) {
+	store, err := mem.New(config.Storage{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	mm := &message.StoreManager{
+		AddrPolicy: &policy.Addressing{Config: &config.Root{MailboxNaming: config.FullNaming}},
+		Store:      store,
+	}
+	logbuf := setupWebServer(mm)
+	source := "Received: from relay1.host by mx.host;\r\n" +
+		"\tWed, 01 Feb 2012 10:11:12 -0800\r\n" +
+		"Received: from client.host\r\n" +
+		"  by relay1.host; Wed, 01 Feb 2012 10:11:10 -0800\r\n" +
+		"From: alice@host\r\n" +
+		"To: bob@host\r\n" +
+		"Cc: \"Carol\" <carol@host>, dave@host\r\n" +
+		"Reply-To: replies@host\r\n" +
+		"Message-ID: <1234@host>\r\n" +
+		"Subject: =?utf-8?q?Caf=C3=A9_menu?=\r\n" +
+		"X-Test-Case: headers\r\n" +
+		"\r\n" +
+		"Test Body\r\n"
+	id, err := mm.Deliver(context.Background(), &policy.Recipient{Mailbox: "box"}, "alice@host",
+		"env-1234", "pass", nil, "", []byte(source))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	w, err := testRestGet("http://localhost/api/v1/mailbox/box/" + id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if w.Code != 200 {
+		t.Fatalf("Expected code 200, got %v", w.Code)
+	}
+	var result map[string]interface{}
+	if err := json.NewDecoder(w.Body).Decode(&result); err != nil {
+		t.Fatalf("Failed to decode JSON: %v", err)
+	}
+	decodedStringEquals(t, result, "cc/[0]", "Carol <carol@host>")
+	decodedStringEquals(t, result, "cc/[1]", "<dave@host>")
+	decodedStringEquals(t, result, "replyTo/[0]", "<replies@host>")
+	decodedStringEquals(t, result, "messageId", "<1234@host>")
+	decodedStringEquals(t, result, "envelopeId", "env-1234")
+	decodedStringEquals(t, result, "spfResult", "pass")
+	decodedStringEquals(t, result, "subject", "Café menu")
+	decodedStringEquals(t, result, "headers/Subject/[0]", "Café menu")
+	decodedStringEquals(t, result, "headers/X-Test-Case/[0]", "headers")
+	decodedStringEquals(t, result, "headers/Received/[0]",
+		"from relay1.host by mx.host; Wed, 01 Feb 2012 10:11:12 -0800")
+	decodedStringEquals(t, result, "headers/Received/[1]",
+		"from client.host by relay1.host; Wed, 01 Feb 2012 10:11:10 -0800")
+	decodedStringEquals(t, result, "header/Subject/[0]", "=?utf-8?q?Caf=C3=A9_menu?=")
+
+	// Opt out of decoded headers.
+	w, err = testRestGet("http://localhost/api/v1/mailbox/box/" + id + "?headers=false")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if w.Code != 200 {
+		t.Fatalf("Expected code 200, got %v", w.Code)
+	}
+	result = nil
+	if err := json.NewDecoder(w.Body).Decode(&result); err != nil {
+		t.Fatalf("Failed to decode JSON: %v", err)
+	}
+	if _, ok := result["headers"]; ok {
+		t.Error("Expected headers to be omitted")
+	}
+	decodedStringEquals(t, result, "messageId", "<1234@host>")
+
+	w, err = testRestGet("http://localhost/api/v1/mailbox/box/" + id + "?headers=maybe")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if w.Code != 400 {
+		t.Errorf("Expected code 400, got %v", w.Code)
+	}
+
+	if t.Failed() {
+		// Dump buffered log data if there was a failure
+		_, _ = io.Copy(os.Stderr, logbuf)
+	}
+}
+
+func TestRestMarkRead(t *testing.T) {
+	mm := test.NewManager()
+	logbuf := setupWebServer(mm)
+	for _, id := range []string{"0001", "0002", "0003"} {
+		mm.AddMessage("good", &message.Message{Metadata: message.Metadata{
+			Mailbox: "good",
+			ID:      id,
+			From:    &mail.Address{Address: "from@host"},
+			Date:    time.Date(2012, 2, 1, 10, 11, 12, 0, time.UTC),
+		}})
+	}
+	// listUnread returns the IDs of unread messages.
+	listUnread := func() []string {
+		t.Helper()
+		w, err := testRestGet("http://localhost/api/v1/mailbox/good?unreadOnly=true")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if w.Code != 200 {
+			t.Fatalf("Expected code 200, got %v", w.Code)
+		}
+		var result []model.JSONMessageHeaderV1
+		if err := json.NewDecoder(w.Body).Decode(&result); err != nil {
+			t.Fatalf("Failed to decode JSON: %v", err)
+		}
+		ids := []string{}
+		for _, m := range result {
+			if m.Seen {
+				t.Errorf("Got read message %v in unread list", m.ID)
+			}
+			ids = append(ids, m.ID)
+		}
+		return ids
+	}
+	put := func(id, body string, want int) {
+		t.Helper()
+		w, err := testRestPut("http://localhost/api/v1/mailbox/good/"+id+"/read", body)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if w.Code != want {
+			t.Errorf("Got code %v for %v %v, want: %v", w.Code, id, body, want)
+		}
+	}
+
+	put("0001", `{"read":true}`, 200)
+	put("0003", `{"read":true}`, 200)
+	if got, want := listUnread(), []string{"0002"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("Got unread %v, want: %v", got, want)
+	}
+	put("0003", `{"read":false}`, 200)
+	if got, want := listUnread(), []string{"0002", "0003"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("Got unread %v, want: %v", got, want)
+	}
+	// All messages are listed by default.
+	w, err := testRestGet("http://localhost/api/v1/mailbox/good?unreadOnly=false")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var result []interface{}
+	if err := json.NewDecoder(w.Body).Decode(&result); err != nil {
+		t.Fatalf("Failed to decode JSON: %v", err)
+	}
+	if len(result) != 3 {
+		t.Errorf("Got %v messages, want 3", len(result))
+	}
+	decodedBoolEquals(t, result, "[0]/seen", true)
+
+	put("0009", `{"read":true}`, 404)
+	put("0001", `{"read":`, 400)
+	w, err = testRestGet("http://localhost/api/v1/mailbox/good?unreadOnly=maybe")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if w.Code != 400 {
+		t.Errorf("Got code %v for invalid unreadOnly, want: 400", w.Code)
+	}
+
+	if t.Failed() {
+		// Wait for handler to finish logging
+		time.Sleep(2 * time.Second)
+		// Dump buffered log data if there was a failure
+		_, _ = io.Copy(os.Stderr, logbuf)
+	}
+}
+
+func TestRestMessageTags(t *testing.T) {
+	mm := test.NewManager()
+	logbuf := setupWebServer(mm)
+	for _, id := range []string{"0001", "0002", "0003"} {
+		mm.AddMessage("good", &message.Message{Metadata: message.Metadata{
+			Mailbox: "good",
+			ID:      id,
+			From:    &mail.Address{Address: "from@host"},
+			Date:    time.Date(2012, 2, 1, 10, 11, 12, 0, time.UTC),
+		}})
+	}
+	// list returns the IDs of messages matching the tag query parameter.
+	list := func(tag string) []string {
+		t.Helper()
+		w, err := testRestGet("http://localhost/api/v1/mailbox/good?tag=" + url.QueryEscape(tag))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if w.Code != 200 {
+			t.Fatalf("Expected code 200, got %v", w.Code)
+		}
+		var result []model.JSONMessageHeaderV1
+		if err := json.NewDecoder(w.Body).Decode(&result); err != nil {
+			t.Fatalf("Failed to decode JSON: %v", err)
+		}
+		ids := []string{}
+		for _, m := range result {
+			ids = append(ids, m.ID)
+		}
+		return ids
+	}
+	put := func(id, body string, want int) {
+		t.Helper()
+		w, err := testRestPut("http://localhost/api/v1/mailbox/good/"+id+"/tags", body)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if w.Code != want {
+			t.Errorf("Got code %v for %v %v, want: %v", w.Code, id, body, want)
+		}
+	}
+
+	put("0001", `{"tags":["signup","run-1"]}`, 200)
+	put("0002", `{"tags":["reset","run-2"]}`, 200)
+	put("0003", `{"tags":["signup"]}`, 200)
+	if got, want := list("signup"), []string{"0001", "0003"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("Got tagged %v, want: %v", got, want)
+	}
+	if got, want := list("run-"), []string{"0001", "0002"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("Got tagged %v, want: %v", got, want)
+	}
+	// Tags are replaced, not merged.
+	put("0001", `{"tags":["login"]}`, 200)
+	if got, want := list("signup"), []string{"0003"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("Got tagged %v after replace, want: %v", got, want)
+	}
+	if got, want := list(""), []string{"0001", "0002", "0003"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("Got %v without tag, want: %v", got, want)
+	}
+	w, err := testRestGet("http://localhost/api/v1/mailbox/good")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var result []interface{}
+	if err := json.NewDecoder(w.Body).Decode(&result); err != nil {
+		t.Fatalf("Failed to decode JSON: %v", err)
+	}
+	decodedStringEquals(t, result, "[0]/tags/[0]", "login")
+
+	// Invalid tags are rejected without changing the existing tags.
+	for _, body := range []string{
+		`{"tags":[""]}`,
+		`{"tags":["` + strings.Repeat("x", 65) + `"]}`,
+		`{"tags":["tab\there"]}`,
+		`{"tags":["café"]}`,
+		`{"tags":["ok","line\nbreak"]}`,
+		`{"tags":`,
+	} {
+		put("0003", body, 400)
+	}
+	if got, want := list("signup"), []string{"0003"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("Got tagged %v after invalid tags, want: %v", got, want)
+	}
+	put("0003", `{"tags":["`+strings.Repeat("x", 64)+`"]}`, 200)
+	put("0009", `{"tags":["signup"]}`, 404)
+
+	if t.Failed() {
+		// Wait for handler to finish logging
+		time.Sleep(2 * time.Second)
+		// Dump buffered log data if there was a failure
+		_, _ = io.Copy(os.Stderr, logbuf)
+	}
+}
+
+func TestRestMailboxListPaged(t *testing.T) {
+	store, err := mem.New(config.Storage{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	mm := &message.StoreManager{
+		AddrPolicy: &policy.Addressing{Config: &config.Root{MailboxNaming: config.FullNaming}},
+		Store:      store,
+	}
+	logbuf := setupWebServer(mm)
+	var ids []string
+	for i := 0; i < 3; i++ {
+		id, _ := test.DeliverToStore(t, store, "good", fmt.Sprintf("subject %v", i), time.Now())
+		ids = append(ids, id)
+	}
+	// page returns the IDs and next cursor of the requested page.
+	page := func(query string) ([]string, string) {
+		t.Helper()
+		w, err := testRestGet("http://localhost/api/v1/mailbox/good?" + query)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if w.Code != 200 {
+			t.Fatalf("Expected code 200 for %q, got %v: %s", query, w.Code, w.Body)
+		}
+		var result model.JSONMessagePageV1
+		if err := json.NewDecoder(w.Body).Decode(&result); err != nil {
+			t.Fatalf("Failed to decode JSON: %v", err)
+		}
+		got := []string{}
+		for _, m := range result.Messages {
+			got = append(got, m.ID)
+		}
+		return got, result.NextCursor
+	}
+
+	got, next := page("limit=2")
+	if want := ids[:2]; !reflect.DeepEqual(got, want) || next != ids[1] {
+		t.Errorf("Got first page %v, next %q, want: %v, %q", got, next, want, ids[1])
+	}
+	// A message delivered between requests appears on a later page.
+	late, _ := test.DeliverToStore(t, store, "good", "late", time.Now())
+	got, next = page("limit=2&after=" + url.QueryEscape(next))
+	if want := []string{ids[2], late}; !reflect.DeepEqual(got, want) || next != "" {
+		t.Errorf("Got second page %v, next %q, want: %v, \"\"", got, next, want)
+	}
+	// The default page holds all four messages.
+	got, next = page("after=")
+	if len(got) != 4 || next != "" {
+		t.Errorf("Got default page %v, next %q, want 4 messages", got, next)
+	}
+	if err := store.MarkSeen(context.Background(), "good", ids[0]); err != nil {
+		t.Fatal(err)
+	}
+	got, next = page("limit=1&unreadOnly=true")
+	if want := ids[1:2]; !reflect.DeepEqual(got, want) || next != ids[1] {
+		t.Errorf("Got unread page %v, next %q, want: %v, %q", got, next, want, ids[1])
+	}
+	for _, query := range []string{"after=unknown", "limit=-1", "limit=x"} {
+		w, err := testRestGet("http://localhost/api/v1/mailbox/good?" + query)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if w.Code != 400 {
+			t.Errorf("Got code %v for %q, want: 400", w.Code, query)
+		}
+	}
+
+	if t.Failed() {
+		// Dump buffered log data if there was a failure
+		_, _ = io.Copy(os.Stderr, logbuf)
+	}
+}
+
+func TestRestMailboxListSpam(t *testing.T) {
+	mm := test.NewManager()
+	logbuf := setupWebServer(mm)
+	for i, tags := range [][]string{nil, {message.SpamTag}, {"signup", message.SpamTag}} {
+		mm.AddMessage("good", &message.Message{Metadata: message.Metadata{
+			Mailbox: "good",
+			ID:      fmt.Sprintf("%04d", i+1),
+			From:    &mail.Address{Address: "from@host"},
+			Date:    time.Date(2012, 2, 1, 10, 11, 12, 0, time.UTC),
+			Tags:    tags,
+		}})
+	}
+	for query, want := range map[string][]string{
+		"":                      {"0001", "0002", "0003"},
+		"spam=all":              {"0001", "0002", "0003"},
+		"spam=true":             {"0002", "0003"},
+		"spam=FALSE":            {"0001"},
+		"spam=true&tag=signup":  {"0003"},
+		"spam=true&limit=1":     {"0002"},
+		"spam=false&tag=signup": {},
+		"spam=true&after=0002":  {"0003"},
+		"spam=false&after=0001": {},
+	} {
+		w, err := testRestGet("http://localhost/api/v1/mailbox/good?" + query)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if w.Code != 200 {
+			t.Fatalf("Expected code 200 for %q, got %v", query, w.Code)
+		}
+		var result []model.JSONMessageHeaderV1
+		if strings.Contains(query, "limit") || strings.Contains(query, "after") {
+			var page model.JSONMessagePageV1
+			if err := json.NewDecoder(w.Body).Decode(&page); err != nil {
+				t.Fatalf("Failed to decode JSON: %v", err)
+			}
+			for _, m := range page.Messages {
+				result = append(result, *m)
+			}
+		} else if err := json.NewDecoder(w.Body).Decode(&result); err != nil {
+			t.Fatalf("Failed to decode JSON: %v", err)
+		}
+		got := []string{}
+		for _, m := range result {
+			got = append(got, m.ID)
+		}
+		if !reflect.DeepEqual(got, want) {
+			t.Errorf("Got %v for %q, want: %v", got, query, want)
+		}
+	}
+	w, err := testRestGet("http://localhost/api/v1/mailbox/good?spam=maybe")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if w.Code != 400 {
+		t.Errorf("Got code %v for invalid spam, want: 400", w.Code)
+	}
+
+	if t.Failed() {
+		// Dump buffered log data if there was a failure
+		_, _ = io.Copy(os.Stderr, logbuf)
+	}
+}
+
+func TestRestMailboxListPriority(t *testing.T) {
+	mm := test.NewManager()
+	logbuf := setupWebServer(mm)
+	for i, priority := range []int{1, 2, 3, 5} {
+		mm.AddMessage("good", &message.Message{Metadata: message.Metadata{
+			Mailbox:  "good",
+			ID:       fmt.Sprintf("%04d", i+1),
+			From:     &mail.Address{Address: "from@host"},
+			Date:     time.Date(2012, 2, 1, 10, 11, 12, 0, time.UTC),
+			Priority: priority,
+		}})
+	}
+	for query, want := range map[string][]string{
+		"":                            {"0001", "0002", "0003", "0004"},
+		"minPriority=1&maxPriority=2": {"0001", "0002"},
+		"minPriority=3":               {"0003", "0004"},
+		"maxPriority=1":               {"0001"},
+		"minPriority=4&maxPriority=4": {},
+	} {
+		w, err := testRestGet("http://localhost/api/v1/mailbox/good?" + query)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if w.Code != 200 {
+			t.Fatalf("Expected code 200 for %q, got %v", query, w.Code)
+		}
+		var result []model.JSONMessageHeaderV1
+		if err := json.NewDecoder(w.Body).Decode(&result); err != nil {
+			t.Fatalf("Failed to decode JSON: %v", err)
+		}
+		got := []string{}
+		for _, m := range result {
+			got = append(got, m.ID)
+		}
+		if !reflect.DeepEqual(got, want) {
+			t.Errorf("Got %v for %q, want: %v", got, query, want)
+		}
+		if query == "maxPriority=1" && len(result) == 1 && result[0].Priority != 1 {
+			t.Errorf("Got priority %v, want: 1", result[0].Priority)
+		}
+	}
+	for _, query := range []string{"minPriority=0", "maxPriority=6", "minPriority=high"} {
+		w, err := testRestGet("http://localhost/api/v1/mailbox/good?" + query)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if w.Code != 400 {
+			t.Errorf("Got code %v for %q, want: 400", w.Code, query)
+		}
+	}
+
+	if t.Failed() {
+		// Dump buffered log data if there was a failure
+		_, _ = io.Copy(os.Stderr, logbuf)
+	}
+}
+
+func TestRestMailboxListSortBy(t *testing.T) {
+	mm := test.NewManager()
+	logbuf := setupWebServer(mm)
+	base := time.Date(2012, 2, 1, 10, 11, 12, 0, time.UTC)
+	// Listed in ID order; received in the opposite order of their dates.
+	for i, hours := range []int{2, 0, 1} {
+		mm.AddMessage("good", &message.Message{Metadata: message.Metadata{
+			Mailbox:    "good",
+			ID:         fmt.Sprintf("%04d", i+1),
+			From:       &mail.Address{Address: "from@host"},
+			Date:       base.Add(time.Duration(hours) * time.Hour),
+			ReceivedAt: base.Add(time.Duration(-hours) * time.Hour),
+		}})
+	}
+	for query, want := range map[string][]string{
+		"":                  {"0001", "0002", "0003"},
+		"sortBy=date":       {"0002", "0003", "0001"},
+		"sortBy=receivedAt": {"0001", "0003", "0002"},
+	} {
+		w, err := testRestGet("http://localhost/api/v1/mailbox/good?" + query)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if w.Code != 200 {
+			t.Fatalf("Expected code 200 for %q, got %v", query, w.Code)
+		}
+		var result []model.JSONMessageHeaderV1
+		if err := json.NewDecoder(w.Body).Decode(&result); err != nil {
+			t.Fatalf("Failed to decode JSON: %v", err)
+		}
+		got := []string{}
+		for _, m := range result {
+			got = append(got, m.ID)
+		}
+		if !reflect.DeepEqual(got, want) {
+			t.Errorf("Got %v for %q, want: %v", got, query, want)
+		}
+	}
+	for _, query := range []string{"sortBy=size", "sortBy=date&limit=2"} {
+		w, err := testRestGet("http://localhost/api/v1/mailbox/good?" + query)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if w.Code != 400 {
+			t.Errorf("Got code %v for %q, want: 400", w.Code, query)
+		}
+	}
+
+	if t.Failed() {
+		// Dump buffered log data if there was a failure
+		_, _ = io.Copy(os.Stderr, logbuf)
+	}
+}
+
 func TestRestMarkSeen(t *testing.T) {
 	mm := test.NewManager()
 	logbuf := setupWebServer(mm)
@@ -311,3 +864,1500 @@ func TestRestMarkSeen(t *testing.T) {
 		_, _ = io.Copy(os.Stderr, logbuf)
 	}
 }
+
+func TestRestMailboxSearch(t *testing.T) {
+	mm := test.NewManager()
+	logbuf := setupWebServerConfig(mm, config.Web{AllowBodySearch: true})
+	date := time.Date(2012, 2, 1, 10, 11, 12, 253, time.UTC)
+	messages := []struct {
+		id, from, subject, text string
+	}{
+		{"0001", "alice@host", "Welcome Aboard", "Please confirm your account"},
+		{"0002", "bob@host", "Password reset", "Click to reset your password"},
+		{"0003", "alice@host", "Password changed", "Your password was changed"},
+	}
+	for _, m := range messages {
+		mm.AddMessage("good", message.New(
+			message.Metadata{
+				Mailbox: "good",
+				ID:      m.id,
+				From:    &mail.Address{Address: m.from},
+				To:      []*mail.Address{{Address: "to@host"}},
+				Subject: m.subject,
+				Date:    date,
+			},
+			&enmime.Envelope{Text: m.text},
+		))
+	}
+
+	testCases := []struct {
+		query string
+		want  []string
+	}{
+		{"from=ALICE", []string{"0001", "0003"}},
+		{"subject=password", []string{"0002", "0003"}},
+		{"from=alice&subject=password", []string{"0003"}},
+		{"body=RESET", []string{"0002"}},
+		{"from=alice&body=confirm", []string{"0001"}},
+		{"subject=password&body=confirm", []string{}},
+		{"from=nobody", []string{}},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.query, func(t *testing.T) {
+			w, err := testRestGet("http://localhost/api/v1/mailbox/good/search?" + tc.query)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if w.Code != 200 {
+				t.Fatalf("Expected code %v, got %v", 200, w.Code)
+			}
+			var result []interface{}
+			if err := json.NewDecoder(w.Body).Decode(&result); err != nil {
+				t.Fatalf("Failed to decode JSON: %v", err)
+			}
+			if len(result) != len(tc.want) {
+				t.Fatalf("Expected %v results, got %v", len(tc.want), len(result))
+			}
+			for i, id := range tc.want {
+				decodedStringEquals(t, result, "["+strconv.Itoa(i)+"]/id", id)
+				decodedStringEquals(t, result, "["+strconv.Itoa(i)+"]/mailbox", "good")
+			}
+		})
+	}
+
+	// No filter parameters.
+	w, err := testRestGet("http://localhost/api/v1/mailbox/good/search")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if w.Code != 400 {
+		t.Errorf("Expected code %v, got %v", 400, w.Code)
+	}
+
+	// Body search disabled.
+	setupWebServerConfig(mm, config.Web{AllowBodySearch: false})
+	w, err = testRestGet("http://localhost/api/v1/mailbox/good/search?body=reset")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if w.Code != 403 {
+		t.Errorf("Expected code %v, got %v", 403, w.Code)
+	}
+	w, err = testRestGet("http://localhost/api/v1/mailbox/good/search?subject=reset")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if w.Code != 200 {
+		t.Errorf("Expected code %v, got %v", 200, w.Code)
+	}
+
+	if t.Failed() {
+		// Wait for handler to finish logging
+		time.Sleep(2 * time.Second)
+		// Dump buffered log data if there was a failure
+		_, _ = io.Copy(os.Stderr, logbuf)
+	}
+}
+
+func TestRestMailboxPurge(t *testing.T) {
+	mm := test.NewManager()
+	logbuf := setupWebServer(mm)
+	mm.AddMessage("good", &message.Message{Metadata: message.Metadata{Mailbox: "good", ID: "0001"}})
+
+	for _, tc := range []struct {
+		mailbox string
+		want    int
+	}{
+		{"good", 204},
+		{"good", 404},
+		{"empty", 404},
+		{"foo%20bar", 500},
+	} {
+		w, err := testRestDelete("http://localhost/api/v1/mailbox/" + tc.mailbox)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if w.Code != tc.want {
+			t.Errorf("Expected code %v for %v, got %v", tc.want, tc.mailbox, w.Code)
+		}
+	}
+
+	if t.Failed() {
+		// Dump buffered log data if there was a failure
+		_, _ = io.Copy(os.Stderr, logbuf)
+	}
+}
+
+// TestRestMailboxPurgeConcurrent verifies messages delivered during a purge are either removed
+// or retained intact, and every message delivered before the purge is removed.
+func TestRestMailboxPurgeConcurrent(t *testing.T) {
+	store, err := mem.New(config.Storage{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	mm := &message.StoreManager{
+		AddrPolicy: &policy.Addressing{Config: &config.Root{MailboxNaming: config.FullNaming}},
+		Store:      store,
+	}
+	logbuf := setupWebServer(mm)
+	const count = 200
+	for i := 0; i < count; i++ {
+		test.DeliverToStore(t, store, "box", "before", time.Now())
+	}
+
+	// Deliver while purging.
+	errs := make(chan error, count)
+	go func() {
+		for i := 0; i < count; i++ {
+			_, err := store.AddMessage(context.Background(), &message.Delivery{
+				Meta: message.Metadata{Mailbox: "box", Subject: "during", Date: time.Now()},
+				Reader: ioutil.NopCloser(strings.NewReader(
+					"Subject: during\r\n\r\nTest Body\r\n")),
+			})
+			errs <- err
+		}
+		close(errs)
+	}()
+	w, err := testRestDelete("http://localhost/api/v1/mailbox/box")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if w.Code != 204 {
+		t.Errorf("Expected code 204, got %v", w.Code)
+	}
+	for err := range errs {
+		if err != nil {
+			t.Errorf("Delivery during purge failed: %v", err)
+		}
+	}
+
+	msgs, err := store.GetMessages(context.Background(), "box")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, m := range msgs {
+		if m.Subject() != "during" {
+			t.Errorf("Got message %v with subject %q after purge", m.ID(), m.Subject())
+			continue
+		}
+		r, err := m.Source()
+		if err != nil {
+			t.Errorf("Source of message %v failed: %v", m.ID(), err)
+			continue
+		}
+		_ = r.Close()
+	}
+
+	if t.Failed() {
+		// Dump buffered log data if there was a failure
+		_, _ = io.Copy(os.Stderr, logbuf)
+	}
+}
+
+func TestRestMailboxImport(t *testing.T) {
+	mm := test.NewManager()
+	logbuf := setupWebServerConfig(mm, config.Web{ImportMaxBytes: 200})
+	valid := "From: alice@host\r\nTo: bob@host\r\nSubject: imported\r\n" +
+		"Date: Wed, 01 Feb 2012 10:11:12 -0800\r\n\r\nTest Body\r\n"
+
+	testCases := []struct {
+		name        string
+		contentType string
+		body        string
+		want        int
+	}{
+		{"valid", "message/rfc822", valid, 201},
+		{"no date", "message/rfc822", "Subject: no date\r\n\r\nTest Body\r\n", 201},
+		{"oversized", "message/rfc822", valid + strings.Repeat("x", 200), 413},
+		{"malformed header", "message/rfc822", "Subject no colon\r\n\r\nTest Body\r\n", 400},
+		{"empty", "message/rfc822", "", 400},
+		{"content type", "text/plain", valid, 415},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			w, err := testRestPost("http://localhost/api/v1/mailbox/import", tc.contentType,
+				tc.body)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if w.Code != tc.want {
+				t.Fatalf("Expected code %v, got %v: %s", tc.want, w.Code, w.Body)
+			}
+		})
+	}
+
+	// Imported messages are in the mailbox.
+	metas, _ := mm.GetMetadata(context.Background(), "import")
+	if len(metas) != 2 {
+		t.Fatalf("Expected 2 messages, got %v", len(metas))
+	}
+	if metas[0].Subject != "imported" {
+		t.Errorf("Got subject %q, want: %q", metas[0].Subject, "imported")
+	}
+	want := time.Date(2012, 2, 1, 10, 11, 12, 0, time.FixedZone("", -8*3600))
+	if !metas[0].Date.Equal(want) {
+		t.Errorf("Got date %v, want: %v", metas[0].Date, want)
+	}
+	if time.Since(metas[1].Date) > time.Minute {
+		t.Errorf("Got date %v, want: now", metas[1].Date)
+	}
+	w, err := testRestGet("http://localhost/api/v1/mailbox/import")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var result []model.JSONMessageHeaderV1
+	if err := json.NewDecoder(w.Body).Decode(&result); err != nil {
+		t.Fatalf("Failed to decode JSON: %v", err)
+	}
+	if len(result) != 2 || result[0].ID != metas[0].ID {
+		t.Errorf("Got mailbox list %+v", result)
+	}
+
+	if t.Failed() {
+		// Dump buffered log data if there was a failure
+		_, _ = io.Copy(os.Stderr, logbuf)
+	}
+}
+
+// TestRestMailboxImportStore verifies imported messages are stored with metadata from the
+// message header.
+func TestRestMailboxImportStore(t *testing.T) {
+	store, err := mem.New(config.Storage{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	mm := &message.StoreManager{
+		AddrPolicy: &policy.Addressing{Config: &config.Root{MailboxNaming: config.FullNaming}},
+		Store:      store,
+	}
+	logbuf := setupWebServerConfig(mm, config.Web{ImportMaxBytes: 1000})
+	source := "From: Alice <alice@host>\r\nTo: bob@host, carol@host\r\n" +
+		"Subject: =?utf-8?q?caf=C3=A9?=\r\nDate: Wed, 01 Feb 2012 10:11:12 -0800\r\n\r\n" +
+		"Test Body\r\n"
+	w, err := testRestPost("http://localhost/api/v1/mailbox/import", "message/rfc822", source)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if w.Code != 201 {
+		t.Fatalf("Expected code 201, got %v: %s", w.Code, w.Body)
+	}
+	var ref model.JSONMessageRefV1
+	if err := json.NewDecoder(w.Body).Decode(&ref); err != nil {
+		t.Fatalf("Failed to decode JSON: %v", err)
+	}
+	m, err := store.GetMessage(context.Background(), "import", ref.ID)
+	if err != nil || m == nil {
+		t.Fatalf("GetMessage(%q) = %v, %v", ref.ID, m, err)
+	}
+	if got, want := m.From().String(), `"Alice" <alice@host>`; got != want {
+		t.Errorf("Got from %v, want: %v", got, want)
+	}
+	if len(m.To()) != 2 {
+		t.Errorf("Got %v to addresses, want: 2", len(m.To()))
+	}
+	if m.Subject() != "café" {
+		t.Errorf("Got subject %q, want: %q", m.Subject(), "café")
+	}
+	if m.Date().Unix() != 1328119872 {
+		t.Errorf("Got date %v, want: 2012-02-01T10:11:12-08:00", m.Date())
+	}
+	if m.Size() != int64(len(source)) {
+		t.Errorf("Got size %v, want: %v", m.Size(), len(source))
+	}
+
+	// The backdated message is still received now.
+	w, err = testRestGet("http://localhost/api/v1/mailbox/import/" + ref.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var msg model.JSONMessageV1
+	if err := json.NewDecoder(w.Body).Decode(&msg); err != nil {
+		t.Fatalf("Failed to decode JSON: %v", err)
+	}
+	if age := time.Since(msg.ReceivedAt); age < 0 || age > time.Minute {
+		t.Errorf("Got receivedAt %v, want: now", msg.ReceivedAt)
+	}
+	if msg.Date.Unix() != 1328119872 {
+		t.Errorf("Got date %v, want: 2012-02-01T10:11:12-08:00", msg.Date)
+	}
+
+	if t.Failed() {
+		// Dump buffered log data if there was a failure
+		_, _ = io.Copy(os.Stderr, logbuf)
+	}
+}
+
+func TestRestMailboxQuota(t *testing.T) {
+	source := "From: alice@host\r\nSubject: quota\r\n\r\n" + strings.Repeat("x", 100) + "\r\n"
+	size := int64(len(source))
+	conf := config.Storage{
+		Params:     map[string]string{"path": t.TempDir()},
+		QuotaBytes: 2*size + size/2,
+	}
+	store, err := file.New(conf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	mm := &message.StoreManager{
+		AddrPolicy: &policy.Addressing{Config: &config.Root{MailboxNaming: config.FullNaming}},
+		Store:      store,
+	}
+	root := &config.Root{Web: config.Web{ImportMaxBytes: 1000}, Storage: conf}
+	logbuf := setupWebServerRoot(mm, root, pubsub.NewBroker())
+	quota := func(wantUsed int64) {
+		t.Helper()
+		w, err := testRestGet("http://localhost/api/v1/mailbox/box/quota")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if w.Code != 200 {
+			t.Fatalf("Expected code 200, got %v: %s", w.Code, w.Body)
+		}
+		var got model.JSONMailboxQuotaV1
+		if err := json.NewDecoder(w.Body).Decode(&got); err != nil {
+			t.Fatalf("Failed to decode JSON: %v", err)
+		}
+		if got.QuotaBytes != conf.QuotaBytes || got.UsedBytes != wantUsed ||
+			got.AvailableBytes == nil || *got.AvailableBytes != conf.QuotaBytes-wantUsed {
+			t.Errorf("Got quota %+v, want %v used of %v", got, wantUsed, conf.QuotaBytes)
+		}
+	}
+	post := func() *httptest.ResponseRecorder {
+		t.Helper()
+		w, err := testRestPost("http://localhost/api/v1/mailbox/box", "message/rfc822", source)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return w
+	}
+
+	quota(0)
+	var ref model.JSONMessageRefV1
+	for i := 0; i < 2; i++ {
+		w := post()
+		if w.Code != 201 {
+			t.Fatalf("Expected code 201, got %v: %s", w.Code, w.Body)
+		}
+		if err := json.NewDecoder(w.Body).Decode(&ref); err != nil {
+			t.Fatalf("Failed to decode JSON: %v", err)
+		}
+	}
+	quota(2 * size)
+	if w := post(); w.Code != 507 {
+		t.Errorf("Got code %v importing over quota, want: 507", w.Code)
+	}
+	quota(2 * size)
+
+	// Deleting a message makes room for another.
+	if w, err := testRestDelete("http://localhost/api/v1/mailbox/box/" + ref.ID); err != nil ||
+		w.Code != 200 {
+		t.Fatalf("Delete failed: %v, %v", w.Code, err)
+	}
+	quota(size)
+	if w := post(); w.Code != 201 {
+		t.Errorf("Got code %v importing after delete, want: 201", w.Code)
+	}
+
+	// Without a quota, available bytes is null.
+	root.Storage.QuotaBytes = 0
+	w, err := testRestGet("http://localhost/api/v1/mailbox/box/quota")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := strings.TrimSpace(w.Body.String()); got !=
+		fmt.Sprintf(`{"quotaBytes":0,"usedBytes":%v,"availableBytes":null}`, 2*size) {
+		t.Errorf("Got body %s without quota", got)
+	}
+
+	if t.Failed() {
+		// Dump buffered log data if there was a failure
+		_, _ = io.Copy(os.Stderr, logbuf)
+	}
+}
+
+func TestRestMailboxMove(t *testing.T) {
+	store, err := mem.New(config.Storage{MailboxMsgCap: 1, OverflowPolicy: config.OverflowReject})
+	if err != nil {
+		t.Fatal(err)
+	}
+	mm := &message.StoreManager{
+		AddrPolicy: &policy.Addressing{Config: &config.Root{MailboxNaming: config.FullNaming}},
+		Store:      store,
+	}
+	logbuf := setupWebServer(mm)
+	srcID, _ := test.DeliverToStore(t, store, "src", "move", time.Now())
+	test.DeliverToStore(t, store, "full", "occupant", time.Now())
+	move := func(id, body string) *httptest.ResponseRecorder {
+		t.Helper()
+		w, err := testRestPost(
+			"http://localhost/api/v1/mailbox/src/"+id+"/move", "application/json", body)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return w
+	}
+
+	if w := move(srcID, `{"destination":"full"}`); w.Code != 507 {
+		t.Errorf("Got code %v moving to full mailbox, want: 507", w.Code)
+	}
+	for _, body := range []string{`{"destination":""}`, `{"destination":"src"}`, `{"dest`} {
+		if w := move(srcID, body); w.Code != 400 {
+			t.Errorf("Got code %v for %v, want: 400", w.Code, body)
+		}
+	}
+	if w := move("9999", `{"destination":"dst"}`); w.Code != 404 {
+		t.Errorf("Got code %v moving missing message, want: 404", w.Code)
+	}
+	// Failed moves leave the message in place.
+	test.GetAndCountMessages(t, store, "src", 1)
+	test.GetAndCountMessages(t, store, "full", 1)
+
+	w := move(srcID, `{"destination":"dst"}`)
+	if w.Code != 200 {
+		t.Fatalf("Expected code 200, got %v: %s", w.Code, w.Body)
+	}
+	var ref model.JSONMessageRefV1
+	if err := json.NewDecoder(w.Body).Decode(&ref); err != nil {
+		t.Fatalf("Failed to decode JSON: %v", err)
+	}
+	if ref.Mailbox != "dst" {
+		t.Errorf("Got mailbox %q, want: %q", ref.Mailbox, "dst")
+	}
+	m, err := store.GetMessage(context.Background(), "dst", ref.ID)
+	if err != nil || m == nil {
+		t.Fatalf("GetMessage(%q) = %v, %v", ref.ID, m, err)
+	}
+	if m.Subject() != "move" {
+		t.Errorf("Got subject %q, want: %q", m.Subject(), "move")
+	}
+	test.GetAndCountMessages(t, store, "src", 0)
+
+	if t.Failed() {
+		// Dump buffered log data if there was a failure
+		_, _ = io.Copy(os.Stderr, logbuf)
+	}
+}
+
+func TestRestMailboxCopy(t *testing.T) {
+	store, err := mem.New(config.Storage{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	mm := &message.StoreManager{
+		AddrPolicy: &policy.Addressing{Config: &config.Root{MailboxNaming: config.FullNaming}},
+		Store:      store,
+	}
+	logbuf := setupWebServer(mm)
+	srcID, _ := test.DeliverToStore(t, store, "src", "copy", time.Now())
+	copyTo := func(id, body string) *httptest.ResponseRecorder {
+		t.Helper()
+		w, err := testRestPost(
+			"http://localhost/api/v1/mailbox/src/"+id+"/copy", "application/json", body)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return w
+	}
+
+	if w := copyTo("9999", `{"destination":"dst"}`); w.Code != 404 {
+		t.Errorf("Got code %v copying missing message, want: 404", w.Code)
+	}
+	if w := copyTo(srcID, `{"destination":""}`); w.Code != 400 {
+		t.Errorf("Got code %v copying to empty destination, want: 400", w.Code)
+	}
+	w := copyTo(srcID, `{"destination":"dst"}`)
+	if w.Code != 201 {
+		t.Fatalf("Expected code 201, got %v: %s", w.Code, w.Body)
+	}
+	var ref model.JSONMessageRefV1
+	if err := json.NewDecoder(w.Body).Decode(&ref); err != nil {
+		t.Fatalf("Failed to decode JSON: %v", err)
+	}
+	if ref.Mailbox != "dst" || ref.ID == "" {
+		t.Errorf("Got reference %+v, want mailbox dst with an ID", ref)
+	}
+	test.GetAndCountMessages(t, store, "src", 1)
+	test.GetAndCountMessages(t, store, "dst", 1)
+
+	if t.Failed() {
+		// Dump buffered log data if there was a failure
+		_, _ = io.Copy(os.Stderr, logbuf)
+	}
+}
+
+// TestRestResponseEnvelope verifies JSON responses are wrapped when the envelope is enabled.
+func TestRestResponseEnvelope(t *testing.T) {
+	mm := test.NewManager()
+	logbuf := setupWebServerConfig(mm, config.Web{APIResponseEnvelope: true})
+	mm.AddMessage("good", &message.Message{Metadata: message.Metadata{
+		Mailbox: "good",
+		ID:      "0001",
+		From:    &mail.Address{Address: "from@host"},
+		Date:    time.Date(2012, 2, 1, 10, 11, 12, 0, time.UTC),
+	}})
+	w, err := testRestGet("http://localhost/api/v1/mailbox/good")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if w.Code != 200 {
+		t.Fatalf("Expected code 200, got %v", w.Code)
+	}
+	var result interface{}
+	if err := json.NewDecoder(w.Body).Decode(&result); err != nil {
+		t.Fatalf("Failed to decode JSON: %v", err)
+	}
+	decodedStringEquals(t, result, "requestId", w.Header().Get("X-Request-Id"))
+	decodedStringEquals(t, result, "data/[0]/id", "0001")
+
+	if t.Failed() {
+		// Dump buffered log data if there was a failure
+		_, _ = io.Copy(os.Stderr, logbuf)
+	}
+}
+
+// TestRestMsgpack verifies responses are encoded as msgpack when preferred by the Accept header,
+// and have the same fields as the JSON encoding.
+func TestRestMsgpack(t *testing.T) {
+	mm := test.NewManager()
+	logbuf := setupWebServer(mm)
+	for _, id := range []string{"0001", "0002"} {
+		mm.AddMessage("good", &message.Message{Metadata: message.Metadata{
+			Mailbox:         "good",
+			ID:              id,
+			From:            &mail.Address{Name: "From", Address: "from@host"},
+			To:              []*mail.Address{{Address: "to@host"}},
+			Subject:         "subject " + id,
+			Date:            time.Date(2012, 2, 1, 10, 11, 12, 253, time.UTC),
+			Size:            1234,
+			Tags:            []string{"a"},
+			AttachmentCount: 1,
+			AttachmentBytes: 100,
+		}})
+	}
+	get := func(url, accept string) *httptest.ResponseRecorder {
+		t.Helper()
+		req, err := http.NewRequest("GET", url, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.Header.Set("Accept", accept)
+		w := httptest.NewRecorder()
+		web.Router.ServeHTTP(w, req)
+		return w
+	}
+
+	// Round trip the message list through both encodings.
+	w := get("http://localhost/api/v1/mailbox/good", "application/json")
+	var fromJSON []model.JSONMessageHeaderV1
+	if err := json.NewDecoder(w.Body).Decode(&fromJSON); err != nil {
+		t.Fatalf("Failed to decode JSON: %v", err)
+	}
+	w = get("http://localhost/api/v1/mailbox/good", "application/msgpack")
+	if w.Code != 200 {
+		t.Fatalf("Expected code 200, got %v", w.Code)
+	}
+	if got := w.Header().Get("Content-Type"); got != "application/msgpack" {
+		t.Errorf("Expected Content-Type application/msgpack, got %q", got)
+	}
+	var fromMsgpack []model.JSONMessageHeaderV1
+	dec := msgpack.NewDecoder(w.Body)
+	dec.SetCustomStructTag("json")
+	if err := dec.Decode(&fromMsgpack); err != nil {
+		t.Fatalf("Failed to decode msgpack: %v", err)
+	}
+	if len(fromJSON) != 2 || len(fromMsgpack) != 2 {
+		t.Fatalf("Expected 2 messages, got %v JSON and %v msgpack",
+			len(fromJSON), len(fromMsgpack))
+	}
+	for i := range fromJSON {
+		j, m := fromJSON[i], fromMsgpack[i]
+		if !j.Date.Equal(m.Date) {
+			t.Errorf("Message %v date got %v from msgpack, want: %v", i, m.Date, j.Date)
+		}
+		j.Date, m.Date = time.Time{}, time.Time{}
+		if !reflect.DeepEqual(j, m) {
+			t.Errorf("Message %v got %+v from msgpack, want: %+v", i, m, j)
+		}
+	}
+
+	// Streamed mailbox list.
+	w = get("http://localhost/api/v1/mailboxes", "application/msgpack")
+	var mailboxes []model.JSONMailboxV1
+	dec = msgpack.NewDecoder(w.Body)
+	dec.SetCustomStructTag("json")
+	if err := dec.Decode(&mailboxes); err != nil {
+		t.Fatalf("Failed to decode msgpack: %v", err)
+	}
+	if len(mailboxes) != 1 || mailboxes[0].Name != "good" || mailboxes[0].MessageCount != 2 {
+		t.Errorf("Expected mailbox good with 2 messages, got %+v", mailboxes)
+	}
+
+	// msgpack request body.
+	body, err := msgpack.Marshal(map[string][]string{"tags": {"packed"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	req, err := http.NewRequest("PUT", "http://localhost/api/v1/mailbox/good/0001/tags",
+		bytes.NewReader(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("Content-Type", "application/msgpack")
+	w = httptest.NewRecorder()
+	web.Router.ServeHTTP(w, req)
+	if w.Code != 200 {
+		t.Errorf("Expected code 200 for msgpack body, got %v", w.Code)
+	}
+	if msg, _ := mm.GetMessage(context.Background(), "good", "0001"); msg == nil ||
+		!reflect.DeepEqual(msg.Tags, []string{"packed"}) {
+		t.Errorf("Expected tags [packed], got %+v", msg)
+	}
+
+	// Neither encoding acceptable.
+	if w := get("http://localhost/api/v1/mailbox/good", "text/xml"); w.Code != 406 {
+		t.Errorf("Expected code 406, got %v", w.Code)
+	}
+
+	if t.Failed() {
+		// Dump buffered log data if there was a failure
+		_, _ = io.Copy(os.Stderr, logbuf)
+	}
+}
+
+// TestRestAPIKeys verifies API requests require a bearer key when keys are configured.
+func TestRestAPIKeys(t *testing.T) {
+	mm := test.NewManager()
+	logbuf := setupWebServerConfig(mm, config.Web{APIKeys: []string{"secret"}})
+	get := func(auth string) *httptest.ResponseRecorder {
+		req, err := http.NewRequest("GET", "http://localhost/api/v1/mailbox/good", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if auth != "" {
+			req.Header.Set("Authorization", auth)
+		}
+		w := httptest.NewRecorder()
+		web.Router.ServeHTTP(w, req)
+		return w
+	}
+
+	if w := get("Bearer secret"); w.Code != 200 {
+		t.Errorf("Expected code 200 with valid key, got %v", w.Code)
+	}
+	w := get("Bearer wrong")
+	if w.Code != 401 {
+		t.Fatalf("Expected code 401 with invalid key, got %v", w.Code)
+	}
+	var result interface{}
+	if err := json.NewDecoder(w.Body).Decode(&result); err != nil {
+		t.Fatalf("Failed to decode JSON: %v", err)
+	}
+	decodedStringEquals(t, result, "error", "Unauthorized")
+	if w := get(""); w.Code != 401 {
+		t.Errorf("Expected code 401 without key, got %v", w.Code)
+	}
+
+	if t.Failed() {
+		// Dump buffered log data if there was a failure
+		_, _ = io.Copy(os.Stderr, logbuf)
+	}
+}
+
+// TestRestCORS verifies pre-flight requests are answered before API key authentication.
+func TestRestCORS(t *testing.T) {
+	mm := test.NewManager()
+	logbuf := setupWebServerConfig(mm, config.Web{
+		APIKeys:            []string{"secret"},
+		CORSAllowedOrigins: []string{"http://dash.example.com"},
+	})
+	req, err := http.NewRequest("OPTIONS", "http://localhost/api/v1/mailbox/good/0001", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("Origin", "http://dash.example.com")
+	req.Header.Set("Access-Control-Request-Method", "DELETE")
+	req.Header.Set("Access-Control-Request-Headers", "authorization")
+	w := httptest.NewRecorder()
+	web.Router.ServeHTTP(w, req)
+	if w.Code != 204 {
+		t.Errorf("Expected code 204, got %v", w.Code)
+	}
+	if got := w.Header().Get("Access-Control-Allow-Origin"); got != "http://dash.example.com" {
+		t.Errorf("Expected Access-Control-Allow-Origin http://dash.example.com, got %q", got)
+	}
+	if got := w.Header().Get("Access-Control-Allow-Methods"); !strings.Contains(got, "DELETE") {
+		t.Errorf("Expected Access-Control-Allow-Methods to contain DELETE, got %q", got)
+	}
+
+	// Without an Origin, OPTIONS is not a pre-flight request and requires a key.
+	req.Header.Del("Origin")
+	w = httptest.NewRecorder()
+	web.Router.ServeHTTP(w, req)
+	if w.Code != 401 {
+		t.Errorf("Expected code 401 without Origin, got %v", w.Code)
+	}
+	req.Header.Set("Authorization", "Bearer secret")
+	w = httptest.NewRecorder()
+	web.Router.ServeHTTP(w, req)
+	if w.Code != 405 {
+		t.Errorf("Expected code 405 without Origin, got %v", w.Code)
+	}
+	if got := w.Header().Get("Access-Control-Allow-Origin"); got != "" {
+		t.Errorf("Expected no Access-Control-Allow-Origin without Origin, got %q", got)
+	}
+
+	if t.Failed() {
+		// Dump buffered log data if there was a failure
+		_, _ = io.Copy(os.Stderr, logbuf)
+	}
+}
+
+// TestRestTraceContext verifies store spans continue the trace from the traceparent request
+// header, and are recorded as root spans without it.
+func TestRestTraceContext(t *testing.T) {
+	exporter := tracetest.NewInMemoryExporter()
+	defer func(tp trace.TracerProvider) { otel.SetTracerProvider(tp) }(otel.GetTracerProvider())
+	otel.SetTracerProvider(sdktrace.NewTracerProvider(
+		sdktrace.WithSpanProcessor(sdktrace.NewSimpleSpanProcessor(exporter))))
+	store, err := mem.New(config.Storage{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	mm := &message.StoreManager{
+		AddrPolicy: &policy.Addressing{Config: &config.Root{MailboxNaming: config.FullNaming}},
+		Store:      storage.NewInstrumentedStore(store),
+	}
+	logbuf := setupWebServerConfig(mm, config.Web{ImportMaxBytes: 1000})
+	w, err := testRestPost("http://localhost/api/v1/mailbox/box", "message/rfc822",
+		"Subject: traced\r\n\r\nTest Body\r\n")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if w.Code != 201 {
+		t.Fatalf("Expected code 201, got %v: %s", w.Code, w.Body)
+	}
+	var ref model.JSONMessageRefV1
+	if err := json.NewDecoder(w.Body).Decode(&ref); err != nil {
+		t.Fatalf("Failed to decode JSON: %v", err)
+	}
+	spans := exporter.GetSpans()
+	if len(spans) != 1 || spans[0].Name != "storage.AddMessage" {
+		t.Fatalf("got spans %v, want: storage.AddMessage", spans)
+	}
+	if spans[0].Parent.IsValid() {
+		t.Errorf("got parent %v without traceparent, want root span", spans[0].Parent)
+	}
+	exporter.Reset()
+
+	const (
+		traceID = "4bf92f3577b34da6a3ce929d0e0e4736"
+		spanID  = "00f067aa0ba902b7"
+	)
+	req, err := http.NewRequest("GET", "http://localhost/api/v1/mailbox/box/"+ref.ID, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Add("Accept", "application/json")
+	req.Header.Add("traceparent", "00-"+traceID+"-"+spanID+"-01")
+	w = httptest.NewRecorder()
+	web.Router.ServeHTTP(w, req)
+	if w.Code != 200 {
+		t.Fatalf("Expected code 200, got %v: %s", w.Code, w.Body)
+	}
+	spans = exporter.GetSpans()
+	if len(spans) != 1 || spans[0].Name != "storage.GetMessage" {
+		t.Fatalf("got spans %v, want: storage.GetMessage", spans)
+	}
+	if got := spans[0].SpanContext.TraceID().String(); got != traceID {
+		t.Errorf("got trace ID %v, want: %v", got, traceID)
+	}
+	if got := spans[0].Parent.SpanID().String(); got != spanID {
+		t.Errorf("got parent span ID %v, want: %v", got, spanID)
+	}
+
+	if t.Failed() {
+		// Dump buffered log data if there was a failure
+		_, _ = io.Copy(os.Stderr, logbuf)
+	}
+}
+
+func TestRestMailboxRaw(t *testing.T) {
+	dir, err := ioutil.TempDir("", "inbucket")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	store, err := file.New(config.Storage{Params: map[string]string{"path": dir}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	mm := &message.StoreManager{
+		AddrPolicy: &policy.Addressing{Config: &config.Root{MailboxNaming: config.FullNaming}},
+		Store:      store,
+	}
+	logbuf := setupWebServer(mm)
+	id1, size1 := test.DeliverToStore(t, store, "box", "subject 1", time.Now())
+	id2, size2 := test.DeliverToStore(t, store, "box", "subject 2", time.Now())
+
+	for _, tc := range []struct {
+		id, want string
+		size     int64
+	}{
+		{id1, id1, size1},
+		{id2, id2, size2},
+		{"latest", id2, size2},
+	} {
+		t.Run(tc.id, func(t *testing.T) {
+			w, err := testRestGet("http://localhost/api/v1/mailbox/box/" + tc.id + "/raw")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if w.Code != 200 {
+				t.Fatalf("Expected code 200, got %v", w.Code)
+			}
+			for k, v := range map[string]string{
+				"Content-Type":        "message/rfc822",
+				"Content-Disposition": `attachment; filename="` + tc.want + `.eml"`,
+				"Content-Length":      strconv.FormatInt(tc.size, 10),
+			} {
+				if got := w.Header().Get(k); got != v {
+					t.Errorf("Got %v header %q, want: %q", k, got, v)
+				}
+			}
+			// Compare with the message file.
+			var raw []byte
+			err = filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+				if err == nil && info.Name() == tc.want+".raw" {
+					raw, err = ioutil.ReadFile(path)
+				}
+				return err
+			})
+			if err != nil || raw == nil {
+				t.Fatalf("Failed to read %v.raw: %v", tc.want, err)
+			}
+			if !bytes.Equal(w.Body.Bytes(), raw) {
+				t.Errorf("Got body %q, want: %q", w.Body.Bytes(), raw)
+			}
+		})
+	}
+
+	// Unknown message.
+	w, err := testRestGet("http://localhost/api/v1/mailbox/box/0000/raw")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if w.Code != 404 {
+		t.Errorf("Expected code 404, got %v", w.Code)
+	}
+
+	if t.Failed() {
+		// Dump buffered log data if there was a failure
+		_, _ = io.Copy(os.Stderr, logbuf)
+	}
+}
+
+func TestRestMailboxConditional(t *testing.T) {
+	store, err := mem.New(config.Storage{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	mm := &message.StoreManager{
+		AddrPolicy: &policy.Addressing{Config: &config.Root{MailboxNaming: config.FullNaming}},
+		Store:      store,
+	}
+	logbuf := setupWebServer(mm)
+	date := time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC)
+	id, _ := test.DeliverToStore(t, store, "box", "subject", date)
+	get := func(path string, header map[string]string) *httptest.ResponseRecorder {
+		req, _ := http.NewRequest("GET", "http://localhost/api/v1/mailbox/box/"+path, nil)
+		for k, v := range header {
+			req.Header.Set(k, v)
+		}
+		w := httptest.NewRecorder()
+		web.Router.ServeHTTP(w, req)
+		return w
+	}
+
+	for _, path := range []string{id, id + "/source", id + "/raw"} {
+		t.Run(path, func(t *testing.T) {
+			w := get(path, nil)
+			if w.Code != http.StatusOK {
+				t.Fatalf("Expected code %v, got %v", http.StatusOK, w.Code)
+			}
+			etag := w.Header().Get("ETag")
+			if !strings.HasPrefix(etag, `"`) || !strings.HasSuffix(etag, `"`) {
+				t.Errorf("Got ETag %q, want a quoted string", etag)
+			}
+			if got, want := w.Header().Get("Last-Modified"), "Thu, 02 Jan 2020 03:04:05 GMT"; got != want {
+				t.Errorf("Got Last-Modified %q, want: %q", got, want)
+			}
+			body := w.Body.String()
+
+			for _, tc := range []struct {
+				name   string
+				header map[string]string
+				want   int
+			}{
+				{"matching etag", map[string]string{"If-None-Match": etag}, http.StatusNotModified},
+				{"listed etag", map[string]string{"If-None-Match": `"x", W/` + etag},
+					http.StatusNotModified},
+				{"wrong etag", map[string]string{"If-None-Match": `"x"`}, http.StatusOK},
+				{"wrong etag, not modified", map[string]string{
+					"If-None-Match":     `"x"`,
+					"If-Modified-Since": "Thu, 02 Jan 2020 03:04:05 GMT",
+				}, http.StatusOK},
+				{"not modified", map[string]string{"If-Modified-Since": "Thu, 02 Jan 2020 03:04:05 GMT"},
+					http.StatusNotModified},
+				{"modified", map[string]string{"If-Modified-Since": "Thu, 02 Jan 2020 03:04:04 GMT"},
+					http.StatusOK},
+			} {
+				w := get(path, tc.header)
+				if w.Code != tc.want {
+					t.Errorf("%v: expected code %v, got %v", tc.name, tc.want, w.Code)
+				}
+				if w.Code == http.StatusNotModified && w.Body.Len() != 0 {
+					t.Errorf("%v: got body %q with 304", tc.name, w.Body.String())
+				}
+				if w.Code == http.StatusOK && w.Body.String() != body {
+					t.Errorf("%v: got body %q, want: %q", tc.name, w.Body.String(), body)
+				}
+			}
+		})
+	}
+
+	// Marking the message seen changes the rendered message, but not its source.
+	w := get(id, nil)
+	etag := w.Header().Get("ETag")
+	rawETag := get(id+"/raw", nil).Header().Get("ETag")
+	if err := store.MarkSeen(context.Background(), "box", id); err != nil {
+		t.Fatal(err)
+	}
+	if w := get(id, map[string]string{"If-None-Match": etag}); w.Code != http.StatusOK {
+		t.Errorf("Expected code %v after MarkSeen, got %v", http.StatusOK, w.Code)
+	}
+	w = get(id+"/raw", map[string]string{"If-None-Match": rawETag})
+	if w.Code != http.StatusNotModified {
+		t.Errorf("Expected raw code %v after MarkSeen, got %v", http.StatusNotModified, w.Code)
+	}
+
+	if t.Failed() {
+		// Dump buffered log data if there was a failure
+		_, _ = io.Copy(os.Stderr, logbuf)
+	}
+}
+
+func TestRestMailboxParts(t *testing.T) {
+	store, err := mem.New(config.Storage{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	mm := &message.StoreManager{
+		AddrPolicy: &policy.Addressing{Config: &config.Root{MailboxNaming: config.FullNaming}},
+		Store:      store,
+	}
+	logbuf := setupWebServerConfig(mm, config.Web{PartsMaxDepth: 10})
+	source := "From: alice@host\r\nSubject: parts\r\n" +
+		"Content-Type: multipart/mixed; boundary=outer\r\n\r\n" +
+		"--outer\r\n" +
+		"Content-Type: text/plain; charset=utf-8\r\n\r\n" +
+		"Text body\r\n" +
+		"--outer\r\n" +
+		"Content-Type: application/pdf\r\n" +
+		"Content-Disposition: attachment; filename=\"report.pdf\"\r\n" +
+		"Content-Transfer-Encoding: base64\r\n\r\n" +
+		"JVBERi0xLjQK\r\n" +
+		"--outer--\r\n"
+	id, err := store.AddMessage(context.Background(), &message.Delivery{
+		Meta:   message.Metadata{Mailbox: "box", Date: time.Now()},
+		Reader: strings.NewReader(source),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// List parts.
+	w, err := testRestGet("http://localhost/api/v1/mailbox/box/" + id + "/parts")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if w.Code != 200 {
+		t.Fatalf("Expected code 200, got %v", w.Code)
+	}
+	var result []model.JSONMessagePartV1
+	if err := json.NewDecoder(w.Body).Decode(&result); err != nil {
+		t.Fatalf("Failed to decode JSON: %v", err)
+	}
+	want := []model.JSONMessagePartV1{
+		{PartIndex: 0, ContentType: "text/plain", Size: 9},
+		{PartIndex: 1, ContentType: "application/pdf", Filename: "report.pdf", Size: 9},
+	}
+	if len(result) != len(want) {
+		t.Fatalf("Got parts %+v, want: %+v", result, want)
+	}
+	for i := range want {
+		if result[i] != want[i] {
+			t.Errorf("Got part %+v, want: %+v", result[i], want[i])
+		}
+	}
+
+	// Download parts.
+	for _, tc := range []struct {
+		index, ctype, disposition, content string
+	}{
+		{"0", "text/plain; charset=utf-8", "", "Text body"},
+		{"1", "application/pdf", "attachment; filename=report.pdf", "%PDF-1.4\n"},
+	} {
+		w, err := testRestGet("http://localhost/api/v1/mailbox/box/" + id + "/parts/" + tc.index)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if w.Code != 200 {
+			t.Fatalf("Expected code 200 for part %v, got %v", tc.index, w.Code)
+		}
+		if got := w.Header().Get("Content-Type"); got != tc.ctype {
+			t.Errorf("Part %v got Content-Type %q, want: %q", tc.index, got, tc.ctype)
+		}
+		if got := w.Header().Get("Content-Disposition"); got != tc.disposition {
+			t.Errorf("Part %v got Content-Disposition %q, want: %q", tc.index, got,
+				tc.disposition)
+		}
+		if got := w.Body.String(); got != tc.content {
+			t.Errorf("Part %v got content %q, want: %q", tc.index, got, tc.content)
+		}
+	}
+
+	// Missing parts and messages.
+	for _, path := range []string{id + "/parts/2", "0000/parts", "0000/parts/0"} {
+		w, err := testRestGet("http://localhost/api/v1/mailbox/box/" + path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if w.Code != 404 {
+			t.Errorf("Expected code 404 for %v, got %v", path, w.Code)
+		}
+	}
+
+	if t.Failed() {
+		// Dump buffered log data if there was a failure
+		_, _ = io.Copy(os.Stderr, logbuf)
+	}
+}
+
+func TestRestMailboxHTML(t *testing.T) {
+	store, err := mem.New(config.Storage{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	mm := &message.StoreManager{
+		AddrPolicy: &policy.Addressing{Config: &config.Root{MailboxNaming: config.FullNaming}},
+		Store:      store,
+	}
+	logbuf := setupWebServerConfig(mm, config.Web{PartsMaxDepth: 10})
+	source := "From: alice@host\r\nSubject: html\r\n" +
+		"Content-Type: multipart/related; boundary=outer\r\n\r\n" +
+		"--outer\r\n" +
+		"Content-Type: text/html; charset=utf-8\r\n\r\n" +
+		"<img src=\"cid:logo@host\">\r\n" +
+		"--outer\r\n" +
+		"Content-Type: text/plain; charset=utf-8\r\n\r\n" +
+		"Text body\r\n" +
+		"--outer\r\n" +
+		"Content-Type: image/png\r\n" +
+		"Content-ID: <logo@host>\r\n" +
+		"Content-Transfer-Encoding: base64\r\n\r\n" +
+		"iVBORw0KGgo=\r\n" +
+		"--outer--\r\n"
+	id, err := store.AddMessage(context.Background(), &message.Delivery{
+		Meta:   message.Metadata{Mailbox: "box", Date: time.Now()},
+		Reader: strings.NewReader(source),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	w, err := testRestGet("http://localhost/api/v1/mailbox/box/" + id + "/html")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if w.Code != 200 {
+		t.Fatalf("Expected code 200, got %v", w.Code)
+	}
+	if got, want := w.Header().Get("Content-Type"), "text/html; charset=utf-8"; got != want {
+		t.Errorf("Got Content-Type %q, want: %q", got, want)
+	}
+	if got, want := w.Body.String(), `<img src="data:image/png;base64,iVBORw0KGgo=">`; got != want {
+		t.Errorf("Got body %q, want: %q", got, want)
+	}
+
+	w, err = testRestGet("http://localhost/api/v1/mailbox/box/0000/html")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if w.Code != 404 {
+		t.Errorf("Expected code 404, got %v", w.Code)
+	}
+
+	if t.Failed() {
+		// Dump buffered log data if there was a failure
+		_, _ = io.Copy(os.Stderr, logbuf)
+	}
+}
+
+func TestRestSearch(t *testing.T) {
+	mm := test.NewManager()
+	logbuf := setupWebServerConfig(mm, config.Web{SearchMax: 4})
+	date := time.Date(2012, 2, 1, 10, 11, 12, 253, time.UTC)
+	messages := []struct {
+		mailbox, id, from, subject string
+		to                         []string
+	}{
+		{"ci-build1", "0001", "alice@host", "Welcome Aboard", []string{"ci@example.com"}},
+		{"ci-build1", "0002", "bob@host", "Password reset", []string{"ci@example.com"}},
+		{"ci-build2", "0003", "alice@host", "Password changed",
+			[]string{"other@host", "ci@example.com"}},
+		{"james", "0004", "bob@host", "Password reset", []string{"james@host"}},
+		{"many", "0005", "carol@host", "Newsletter", []string{"many@host"}},
+		{"many", "0006", "carol@host", "Newsletter", []string{"many@host"}},
+		{"many", "0007", "carol@host", "Newsletter", []string{"many@host"}},
+		{"many", "0008", "carol@host", "Newsletter", []string{"many@host"}},
+		{"many", "0009", "carol@host", "Newsletter", []string{"many@host"}},
+	}
+	for _, m := range messages {
+		to := make([]*mail.Address, len(m.to))
+		for i, addr := range m.to {
+			to[i] = &mail.Address{Address: addr}
+		}
+		mm.AddMessage(m.mailbox, &message.Message{Metadata: message.Metadata{
+			Mailbox: m.mailbox,
+			ID:      m.id,
+			From:    &mail.Address{Address: m.from},
+			To:      to,
+			Subject: m.subject,
+			Date:    date,
+		}})
+	}
+
+	testCases := []struct {
+		query string
+		want  []string // mailbox/id
+	}{
+		{"to=@EXAMPLE.com", []string{"ci-build1/0001", "ci-build1/0002", "ci-build2/0003"}},
+		{"to=other@host", []string{"ci-build2/0003"}},
+		{"to=@example.com&subject=password", []string{"ci-build1/0002", "ci-build2/0003"}},
+		{"subject=password&from=bob", []string{"ci-build1/0002", "james/0004"}},
+		{"mailbox=ci-*", []string{"ci-build1/0001", "ci-build1/0002", "ci-build2/0003"}},
+		{"mailbox=ci-build?&from=alice", []string{"ci-build1/0001", "ci-build2/0003"}},
+		{"mailbox=[j-m]*&subject=password", []string{"james/0004"}},
+		{"mailbox=ci", []string{}},
+		{"subject=newsletter", []string{"many/0005", "many/0006", "many/0007", "many/0008"}},
+		{"to=nobody", []string{}},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.query, func(t *testing.T) {
+			w, err := testRestGet("http://localhost/api/v1/search?" + tc.query)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if w.Code != 200 {
+				t.Fatalf("Expected code %v, got %v", 200, w.Code)
+			}
+			var result []model.JSONMessageHeaderV1
+			if err := json.NewDecoder(w.Body).Decode(&result); err != nil {
+				t.Fatalf("Failed to decode JSON: %v", err)
+			}
+			got := make([]string, len(result))
+			for i, header := range result {
+				got[i] = header.Mailbox + "/" + header.ID
+			}
+			if strings.Join(got, ",") != strings.Join(tc.want, ",") {
+				t.Errorf("Got results %v, want: %v", got, tc.want)
+			}
+		})
+	}
+
+	// Invalid requests.
+	for _, query := range []string{"", "?mailbox=[", "?to=x&mailbox=a\\"} {
+		w, err := testRestGet("http://localhost/api/v1/search" + query)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if w.Code != 400 {
+			t.Errorf("Expected code 400 for %q, got %v", query, w.Code)
+		}
+	}
+
+	if t.Failed() {
+		// Dump buffered log data if there was a failure
+		_, _ = io.Copy(os.Stderr, logbuf)
+	}
+}
+
+func TestRestMailboxes(t *testing.T) {
+	// Setup
+	mm := test.NewManager()
+	logbuf := setupWebServerConfig(mm, config.Web{MailboxListMax: 200})
+	date := time.Date(2012, 2, 1, 10, 11, 12, 0, time.UTC)
+	for i := 249; i >= 0; i-- {
+		name := fmt.Sprintf("box%03d", i)
+		for j := 0; j <= i%3; j++ {
+			mm.AddMessage(name, &message.Message{Metadata: message.Metadata{
+				Mailbox: name,
+				ID:      strconv.Itoa(j),
+				Date:    date.Add(time.Duration(j) * time.Hour),
+				Size:    100,
+			}})
+		}
+	}
+
+	testCases := []struct {
+		query string
+		first int // Index of first mailbox expected.
+		count int
+	}{
+		{"", 0, 200},
+		{"?limit=10", 0, 10},
+		{"?offset=5&limit=10", 5, 10},
+		{"?offset=240&limit=20", 240, 10},
+		{"?offset=100", 100, 150},
+		{"?offset=300", 0, 0},
+		{"?limit=0", 0, 0},
+		{"?limit=1000", 0, 200},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.query, func(t *testing.T) {
+			w, err := testRestGet("http://localhost/api/v1/mailboxes" + tc.query)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if w.Code != 200 {
+				t.Fatalf("Expected code 200, got %v", w.Code)
+			}
+			var result []model.JSONMailboxV1
+			if err := json.NewDecoder(w.Body).Decode(&result); err != nil {
+				t.Fatalf("Failed to decode JSON: %v", err)
+			}
+			if len(result) != tc.count {
+				t.Fatalf("Expected %v results, got %v", tc.count, len(result))
+			}
+			for i, got := range result {
+				n := tc.first + i
+				want := model.JSONMailboxV1{
+					Name:         fmt.Sprintf("box%03d", n),
+					MessageCount: n%3 + 1,
+					TotalBytes:   int64(100 * (n%3 + 1)),
+					LatestDate:   date.Add(time.Duration(n%3) * time.Hour),
+				}
+				if !got.LatestDate.Equal(want.LatestDate) {
+					t.Errorf("Got latestDate %v, want: %v", got.LatestDate, want.LatestDate)
+				}
+				got.LatestDate = want.LatestDate
+				if got != want {
+					t.Errorf("Got mailbox %+v, want: %+v", got, want)
+				}
+			}
+		})
+	}
+
+	// Invalid parameters
+	for _, query := range []string{"?limit=x", "?limit=-1", "?offset=-1"} {
+		w, err := testRestGet("http://localhost/api/v1/mailboxes" + query)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if w.Code != 400 {
+			t.Errorf("Expected code 400 for %v, got %v", query, w.Code)
+		}
+	}
+
+	if t.Failed() {
+		// Dump buffered log data if there was a failure
+		_, _ = io.Copy(os.Stderr, logbuf)
+	}
+}
+
+func TestRestMailboxesStreamed(t *testing.T) {
+	// Setup
+	mm := test.NewManager()
+	logbuf := setupWebServer(mm)
+	for i := 0; i < 2*mailboxesFlushInterval+1; i++ {
+		name := fmt.Sprintf("box%03d", i)
+		mm.AddMessage(name, &message.Message{Metadata: message.Metadata{Mailbox: name, ID: "1"}})
+	}
+
+	// Record each write to the response.
+	w := &chunkRecorder{ResponseRecorder: httptest.NewRecorder()}
+	req, err := http.NewRequest("GET", "http://localhost/api/v1/mailboxes", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	web.Router.ServeHTTP(w, req)
+	if w.Code != 200 {
+		t.Fatalf("Expected code 200, got %v", w.Code)
+	}
+	if !w.Flushed {
+		t.Error("Expected response to be flushed")
+	}
+	// One write per element, plus separators and brackets.
+	if len(w.chunks) < 2*mailboxesFlushInterval {
+		t.Errorf("Expected response in many writes, got %v", len(w.chunks))
+	}
+	for _, chunk := range w.chunks {
+		if len(chunk) > 200 {
+			t.Errorf("Expected small writes, got %v bytes", len(chunk))
+			break
+		}
+	}
+	var result []model.JSONMailboxV1
+	if err := json.NewDecoder(w.Body).Decode(&result); err != nil {
+		t.Fatalf("Failed to decode JSON: %v", err)
+	}
+	if len(result) != 2*mailboxesFlushInterval+1 {
+		t.Errorf("Expected %v results, got %v", 2*mailboxesFlushInterval+1, len(result))
+	}
+
+	if t.Failed() {
+		// Dump buffered log data if there was a failure
+		_, _ = io.Copy(os.Stderr, logbuf)
+	}
+}
+
+// chunkRecorder records the content of each Write to the response.
+type chunkRecorder struct {
+	*httptest.ResponseRecorder
+	chunks []string
+}
+
+func (r *chunkRecorder) Write(p []byte) (int, error) {
+	r.chunks = append(r.chunks, string(p))
+	return r.ResponseRecorder.Write(p)
+}
+
+// BenchmarkMessageListEncoding compares the JSON and msgpack encodings of a 100 message list, the
+// encoded size is reported as bytes/list.
+func BenchmarkMessageListEncoding(b *testing.B) {
+	messages := make([]*message.Metadata, 100)
+	for i := range messages {
+		messages[i] = &message.Metadata{
+			Mailbox: "benchmark",
+			ID:      fmt.Sprintf("2024-01-02T03:04:05.%06d-%04d", i, i),
+			From:    &mail.Address{Name: "Sender Name", Address: "sender@example.com"},
+			To:      []*mail.Address{{Name: "Recipient", Address: "recipient@example.com"}},
+			Subject: fmt.Sprintf("Benchmark message number %v", i),
+			Date:    time.Date(2024, 1, 2, 3, 4, 5, i, time.UTC),
+			Size:    int64(2048 + i),
+			Seen:    i%2 == 0,
+			Tags:    []string{"bench"},
+		}
+	}
+	list := jsonMessageHeaders("benchmark", messages)
+	encoders := []struct {
+		name   string
+		encode func(io.Writer) error
+	}{
+		{"JSON", func(w io.Writer) error { return json.NewEncoder(w).Encode(list) }},
+		{"msgpack", func(w io.Writer) error { return web.NewMsgpackEncoder(w).Encode(list) }},
+	}
+	for _, e := range encoders {
+		b.Run(e.name, func(b *testing.B) {
+			buf := new(bytes.Buffer)
+			for i := 0; i < b.N; i++ {
+				buf.Reset()
+				if err := e.encode(buf); err != nil {
+					b.Fatal(err)
+				}
+			}
+			b.ReportMetric(float64(buf.Len()), "bytes/list")
+		})
+	}
+}
+
+func TestRestMailboxGenerate(t *testing.T) {
+	dir := t.TempDir()
+	templates := map[string]string{
+		"welcome": "{{/* From */}}\nExample <noreply@example.com>\n" +
+			"{{/* To */}}\n{{.name}} <{{.address}}>\n" +
+			"{{/* Subject */}}\nWelcome, {{.name}}\n" +
+			"{{/* Body text/html */}}\n<p>Hello {{.name}}!</p>\n",
+		"reset": "{{/* From */}}\nnoreply@example.com\n" +
+			"{{/* To */}}\n{{.address}}\n" +
+			"{{/* Subject */}}\nPassword reset\n" +
+			"{{/* Body */}}\nHi {{.name}},\n\nYour code is {{.code}}.\n",
+		"broken": "{{/* From */}}\nnoreply@example.com\n{{/* Subject */}}\nNo recipient\n" +
+			"{{/* Body */}}\nBody\n",
+	}
+	for name, text := range templates {
+		err := ioutil.WriteFile(filepath.Join(dir, name+".tmpl"), []byte(text), 0644)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	store, err := mem.New(config.Storage{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	mm := &message.StoreManager{
+		AddrPolicy: &policy.Addressing{Config: &config.Root{MailboxNaming: config.FullNaming}},
+		Store:      store,
+	}
+	logbuf := setupWebServerConfig(mm, config.Web{TemplatesPath: dir})
+
+	generate := func(body string, want int) *model.JSONMessageRefV1 {
+		t.Helper()
+		w, err := testRestPost("http://localhost/api/v1/mailbox/alice@example.com/generate",
+			"application/json", body)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if w.Code != want {
+			t.Fatalf("Expected code %v, got %v: %s", want, w.Code, w.Body)
+		}
+		if want != 201 {
+			return nil
+		}
+		ref := &model.JSONMessageRefV1{}
+		if err := json.NewDecoder(w.Body).Decode(ref); err != nil {
+			t.Fatalf("Failed to decode JSON: %v", err)
+		}
+		return ref
+	}
+
+	// Variables are escaped in the HTML body, but not in the header.
+	ref := generate(`{"template":"welcome",`+
+		`"vars":{"name":"Alice & Bob","address":"alice@example.com"}}`, 201)
+	msg, err := mm.GetMessage(context.Background(), ref.Mailbox, ref.ID)
+	if err != nil || msg == nil {
+		t.Fatalf("GetMessage(%q) = %v, %v", ref.ID, msg, err)
+	}
+	if got, want := msg.To[0].String(), `"Alice & Bob" <alice@example.com>`; got != want {
+		t.Errorf("Got to %v, want: %v", got, want)
+	}
+	if got, want := msg.Subject, "Welcome, Alice & Bob"; got != want {
+		t.Errorf("Got subject %q, want: %q", got, want)
+	}
+	if got, want := msg.HTML(), "<p>Hello Alice &amp; Bob!</p>"; !strings.Contains(got, want) {
+		t.Errorf("Got HTML %q, want it to contain: %q", got, want)
+	}
+
+	ref = generate(`{"template":"reset",`+
+		`"vars":{"name":"Alice","address":"alice@example.com","code":1234}}`, 201)
+	msg, err = mm.GetMessage(context.Background(), ref.Mailbox, ref.ID)
+	if err != nil || msg == nil {
+		t.Fatalf("GetMessage(%q) = %v, %v", ref.ID, msg, err)
+	}
+	if got, want := msg.Subject, "Password reset"; got != want {
+		t.Errorf("Got subject %q, want: %q", got, want)
+	}
+	if got, want := msg.Text(), "Hi Alice,\r\n\r\nYour code is 1234."; !strings.Contains(got, want) {
+		t.Errorf("Got text %q, want it to contain: %q", got, want)
+	}
+
+	generate(`{"template":"missing"}`, 404)
+	generate(`{"template":"../welcome"}`, 404)
+	generate(`{"template":"broken"}`, 422)
+	generate(`{"template":`, 400)
+
+	if t.Failed() {
+		// Dump buffered log data if there was a failure
+		_, _ = io.Copy(os.Stderr, logbuf)
+	}
+}
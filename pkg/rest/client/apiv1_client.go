@@ -102,7 +102,8 @@ func (c *Client) DeleteMessage(name, id string) error {
 	return nil
 }
 
-// PurgeMailbox deletes all messages in the given mailbox
+// PurgeMailbox deletes all messages in the given mailbox, it is not an error for the mailbox to
+// already be empty.
 func (c *Client) PurgeMailbox(name string) error {
 	uri := "/api/v1/mailbox/" + url.QueryEscape(name)
 	resp, err := c.do("DELETE", uri, nil)
@@ -110,7 +111,9 @@ func (c *Client) PurgeMailbox(name string) error {
 		return err
 	}
 	_ = resp.Body.Close()
-	if resp.StatusCode != http.StatusOK {
+	switch resp.StatusCode {
+	case http.StatusOK, http.StatusNoContent, http.StatusNotFound:
+	default:
 		return fmt.Errorf("Unexpected HTTP response status %v: %s", resp.StatusCode, resp.Status)
 	}
 	return nil
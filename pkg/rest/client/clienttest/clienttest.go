@@ -0,0 +1,250 @@
+// Package clienttest provides an Inbucket REST API client for Go test suites, which delivers
+// messages to, and waits for messages in, a running Inbucket server.
+package clienttest
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/inbucket/inbucket/pkg/rest/model"
+)
+
+const (
+	// minPollInterval is the delay before WaitForMessage first polls the mailbox again.
+	minPollInterval = 10 * time.Millisecond
+
+	// maxPollInterval caps the delay between WaitForMessage polls, which doubles after each.
+	maxPollInterval = time.Second
+)
+
+// ErrNotFound is returned when the requested message does not exist.
+var ErrNotFound = errors.New("message not found")
+
+// Message is a message including its content, as returned by the REST API.
+type Message struct {
+	model.JSONMessageV1
+}
+
+// Client accesses the REST API of an Inbucket server.
+type Client struct {
+	HTTPClient *http.Client
+	baseURL    *url.URL
+
+	mu        sync.Mutex
+	mailboxes map[string]bool // Mailboxes accessed, purged by Cleanup.
+}
+
+// New creates a Client for the Inbucket server at baseURL, ex: "http://localhost:9000".
+func New(baseURL string) (*Client, error) {
+	u, err := url.Parse(baseURL)
+	if err != nil {
+		return nil, err
+	}
+	return &Client{
+		HTTPClient: &http.Client{Timeout: 30 * time.Second},
+		baseURL:    u,
+		mailboxes:  make(map[string]bool),
+	}, nil
+}
+
+// NewTestClient creates a Client for the Inbucket server at serverURL, failing the test if the
+// URL is invalid.  Cleanup is registered to run when the test completes, so mailboxes used by the
+// test are purged.
+func NewTestClient(t testing.TB, serverURL string) *Client {
+	t.Helper()
+	c, err := New(serverURL)
+	if err != nil {
+		t.Fatalf("Inbucket client for %q: %v", serverURL, err)
+	}
+	t.Cleanup(func() {
+		if err := c.Cleanup(context.Background()); err != nil {
+			t.Errorf("Inbucket client cleanup: %v", err)
+		}
+	})
+	return c
+}
+
+// Cleanup purges every mailbox accessed by the client, and closes its idle connections.
+func (c *Client) Cleanup(ctx context.Context) error {
+	c.mu.Lock()
+	mailboxes := c.mailboxes
+	c.mailboxes = make(map[string]bool)
+	c.mu.Unlock()
+	defer c.HTTPClient.CloseIdleConnections()
+	for name := range mailboxes {
+		resp, err := c.do(ctx, "DELETE", name, "", "", nil)
+		if err != nil {
+			return err
+		}
+		_ = resp.Body.Close()
+		switch resp.StatusCode {
+		case http.StatusOK, http.StatusNoContent, http.StatusNotFound:
+		default:
+			return fmt.Errorf("purge mailbox %q, unexpected status %v", name, resp.Status)
+		}
+	}
+	return nil
+}
+
+// SendMessage adds the raw RFC 5322 message to the mailbox, and returns its ID.
+func (c *Client) SendMessage(ctx context.Context, mailbox, raw string) (id string, err error) {
+	resp, err := c.do(ctx, "POST", mailbox, "", "message/rfc822", strings.NewReader(raw))
+	if err != nil {
+		return "", err
+	}
+	ref := &model.JSONMessageRefV1{}
+	if err := decode(resp, http.StatusCreated, ref); err != nil {
+		return "", fmt.Errorf("send to mailbox %q: %v", mailbox, err)
+	}
+	return ref.ID, nil
+}
+
+// GetMessage returns the message with the given mailbox and ID, or ErrNotFound.
+func (c *Client) GetMessage(ctx context.Context, mailbox, id string) (*Message, error) {
+	resp, err := c.do(ctx, "GET", mailbox, id, "", nil)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode == http.StatusNotFound {
+		_ = resp.Body.Close()
+		return nil, ErrNotFound
+	}
+	msg := &Message{}
+	if err := decode(resp, http.StatusOK, msg); err != nil {
+		return nil, fmt.Errorf("get message %q in mailbox %q: %v", id, mailbox, err)
+	}
+	return msg, nil
+}
+
+// ListMessages returns every message in the mailbox, oldest first, including their content.
+func (c *Client) ListMessages(ctx context.Context, mailbox string) ([]*Message, error) {
+	headers, err := c.listHeaders(ctx, mailbox)
+	if err != nil {
+		return nil, err
+	}
+	msgs := make([]*Message, 0, len(headers))
+	for _, h := range headers {
+		msg, err := c.GetMessage(ctx, mailbox, h.ID)
+		if err == ErrNotFound {
+			// Deleted since it was listed.
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		msgs = append(msgs, msg)
+	}
+	return msgs, nil
+}
+
+// WaitForMessage polls the mailbox until it holds a message for which predicate returns true, and
+// returns that message.  A nil predicate matches any message.  The interval between polls starts
+// small, and doubles after each poll.  An error is returned if no message matches within timeout,
+// or before ctx is done.
+func (c *Client) WaitForMessage(ctx context.Context, mailbox string,
+	predicate func(*Message) bool, timeout time.Duration) (*Message, error) {
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+	checked := make(map[string]bool)
+	interval := minPollInterval
+	for {
+		headers, err := c.listHeaders(ctx, mailbox)
+		if err != nil && ctx.Err() == nil {
+			return nil, err
+		}
+		for _, h := range headers {
+			if checked[h.ID] {
+				continue
+			}
+			msg, err := c.GetMessage(ctx, mailbox, h.ID)
+			if err == ErrNotFound {
+				continue
+			}
+			if err != nil {
+				if ctx.Err() != nil {
+					break
+				}
+				return nil, err
+			}
+			checked[h.ID] = true
+			if predicate == nil || predicate(msg) {
+				return msg, nil
+			}
+		}
+		select {
+		case <-ctx.Done():
+			return nil, fmt.Errorf("wait for message in mailbox %q: %v", mailbox, ctx.Err())
+		case <-time.After(interval):
+		}
+		if interval *= 2; interval > maxPollInterval {
+			interval = maxPollInterval
+		}
+	}
+}
+
+// listHeaders returns the headers of the messages in the mailbox.
+func (c *Client) listHeaders(
+	ctx context.Context, mailbox string) ([]*model.JSONMessageHeaderV1, error) {
+	resp, err := c.do(ctx, "GET", mailbox, "", "", nil)
+	if err != nil {
+		return nil, err
+	}
+	var headers []*model.JSONMessageHeaderV1
+	if err := decode(resp, http.StatusOK, &headers); err != nil {
+		return nil, fmt.Errorf("list mailbox %q: %v", mailbox, err)
+	}
+	return headers, nil
+}
+
+// do sends a request for the mailbox, or the message with id if it is not empty.  Unless it purges
+// the mailbox, the mailbox is recorded for Cleanup.
+func (c *Client) do(ctx context.Context, method, mailbox, id, contentType string,
+	body io.Reader) (*http.Response, error) {
+	if method != "DELETE" || id != "" {
+		c.mu.Lock()
+		c.mailboxes[mailbox] = true
+		c.mu.Unlock()
+	}
+	uri := "/api/v1/mailbox/" + url.PathEscape(mailbox)
+	if id != "" {
+		uri += "/" + url.PathEscape(id)
+	}
+	rel, err := url.Parse(uri)
+	if err != nil {
+		return nil, err
+	}
+	u := c.baseURL.ResolveReference(rel)
+	req, err := http.NewRequestWithContext(ctx, method, u.String(), body)
+	if err != nil {
+		return nil, err
+	}
+	if contentType != "" {
+		req.Header.Set("Content-Type", contentType)
+	}
+	req.Header.Set("Accept", "application/json")
+	return c.HTTPClient.Do(req)
+}
+
+// decode closes the response body, after decoding it as JSON into v if the response has the
+// expected status.
+func decode(resp *http.Response, status int, v interface{}) error {
+	defer func() {
+		_ = resp.Body.Close()
+	}()
+	if resp.StatusCode != status {
+		msg, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 512))
+		return fmt.Errorf("unexpected status %v: %s", resp.Status, bytes.TrimSpace(msg))
+	}
+	return json.NewDecoder(resp.Body).Decode(v)
+}
@@ -0,0 +1,157 @@
+package clienttest_test
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/inbucket/inbucket/pkg/rest/client/clienttest"
+)
+
+func TestClient(t *testing.T) {
+	baseURL := startInbucket(t)
+	c := clienttest.NewTestClient(t, baseURL)
+	ctx := context.Background()
+
+	id, err := c.SendMessage(ctx, "alice", message("first", "Hello Alice"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	msg, err := c.GetMessage(ctx, "alice", id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if msg.ID != id || msg.Mailbox != "alice" || msg.Subject != "first" {
+		t.Errorf("Got message %v/%v %q, want: alice/%v %q", msg.Mailbox, msg.ID, msg.Subject,
+			id, "first")
+	}
+	if got := strings.TrimSpace(msg.Body.Text); got != "Hello Alice" {
+		t.Errorf("Got body %q, want: %q", got, "Hello Alice")
+	}
+	if _, err := c.GetMessage(ctx, "alice", "missing"); err != clienttest.ErrNotFound {
+		t.Errorf("Got error %v for missing message, want: %v", err, clienttest.ErrNotFound)
+	}
+
+	if _, err := c.SendMessage(ctx, "alice", message("second", "Goodbye")); err != nil {
+		t.Fatal(err)
+	}
+	msgs, err := c.ListMessages(ctx, "alice")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(msgs) != 2 || msgs[0].Subject != "first" || msgs[1].Body.Text == "" {
+		t.Errorf("Got %v messages, want: first and second with content", len(msgs))
+	}
+	if _, err := c.SendMessage(ctx, "alice", "not a message"); err == nil {
+		t.Error("Got nil error sending malformed message, want error")
+	}
+
+	// Deliver a matching message after WaitForMessage has polled a few times.
+	go func() {
+		time.Sleep(200 * time.Millisecond)
+		if _, err := c.SendMessage(ctx, "bob", message("later", "Your code is 1234")); err != nil {
+			t.Error(err)
+		}
+	}()
+	msg, err = c.WaitForMessage(ctx, "bob", func(m *clienttest.Message) bool {
+		return strings.Contains(m.Body.Text, "code")
+	}, 10*time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if msg.Subject != "later" {
+		t.Errorf("Got subject %q, want: %q", msg.Subject, "later")
+	}
+	_, err = c.WaitForMessage(ctx, "alice", func(m *clienttest.Message) bool {
+		return m.Subject == "never"
+	}, 100*time.Millisecond)
+	if err == nil {
+		t.Error("Got nil error waiting for a message that never arrives, want error")
+	}
+
+	// Cleanup purges the mailboxes used.
+	if err := c.Cleanup(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if msgs, err := c.ListMessages(ctx, "alice"); err != nil || len(msgs) != 0 {
+		t.Errorf("Got %v messages, error %v after cleanup, want: 0", len(msgs), err)
+	}
+}
+
+// message returns the source of a message with subject and body.
+func message(subject, body string) string {
+	return "From: sender@example.com\r\nTo: rcpt@example.com\r\nSubject: " + subject +
+		"\r\n\r\n" + body + "\r\n"
+}
+
+// startInbucket builds and starts an Inbucket server on free ports, and returns its base URL.  The
+// server is stopped when the test completes.
+func startInbucket(t *testing.T) string {
+	t.Helper()
+	if testing.Short() {
+		t.Skip("Starting Inbucket server is slow")
+	}
+	goBin, err := exec.LookPath("go")
+	if err != nil {
+		t.Skip("go command not found")
+	}
+	bin := filepath.Join(t.TempDir(), "inbucket")
+	build := exec.Command(goBin, "build", "-o", bin, "github.com/inbucket/inbucket/cmd/inbucket")
+	if out, err := build.CombinedOutput(); err != nil {
+		t.Fatalf("Failed to build inbucket: %v\n%s", err, out)
+	}
+
+	webAddr := freeAddr(t)
+	cmd := exec.Command(bin)
+	cmd.Dir = t.TempDir()
+	cmd.Env = append(os.Environ(),
+		"INBUCKET_WEB_ADDR="+webAddr,
+		"INBUCKET_SMTP_ADDR="+freeAddr(t),
+		"INBUCKET_POP3_ADDR="+freeAddr(t),
+		"INBUCKET_STORAGE_TYPE=memory",
+		"INBUCKET_LOGLEVEL=warn",
+	)
+	if err := cmd.Start(); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		_ = cmd.Process.Kill()
+		_ = cmd.Wait()
+	})
+
+	// Wait for the web server to accept requests.
+	baseURL := "http://" + webAddr
+	deadline := time.Now().Add(10 * time.Second)
+	for {
+		resp, err := http.Get(baseURL + "/api/v1/mailboxes")
+		if err == nil {
+			_ = resp.Body.Close()
+			if resp.StatusCode == http.StatusOK {
+				return baseURL
+			}
+			err = fmt.Errorf("status %v", resp.Status)
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("Inbucket did not start: %v", err)
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+}
+
+// freeAddr returns a loopback address with a port which is not in use.
+func freeAddr(t *testing.T) string {
+	t.Helper()
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	return l.Addr().String()
+}
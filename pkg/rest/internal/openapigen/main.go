@@ -0,0 +1,159 @@
+// Command openapigen generates openapi.yaml, the OpenAPI 3.0 specification of the REST and admin
+// APIs, from the swag annotations of the rest package handlers.  swag produces a Swagger 2.0
+// document, which is converted to OpenAPI 3.0.  It is run by go generate in the rest package.
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+
+	"github.com/getkin/kin-openapi/openapi2"
+	"github.com/getkin/kin-openapi/openapi2conv"
+	"github.com/getkin/kin-openapi/openapi3"
+	"github.com/swaggo/swag"
+	"gopkg.in/yaml.v3"
+)
+
+// header is written at the start of the generated file.
+const header = "# Code generated by openapigen from the rest handler annotations. DO NOT EDIT.\n"
+
+// oneOfExtension names an operation extension listing alternative schemas for the JSON content of
+// its responses, which Swagger 2.0 can not express.  Its value maps status codes to schemas, as in
+// `@x-one-of {"200": [{"$ref": "#/components/schemas/MessageHeader"}]}`.
+const oneOfExtension = "x-one-of"
+
+func main() {
+	out := flag.String("o", "", "output `file`, standard output if empty")
+	dir := flag.String("dir", ".", "`directory` of the rest package")
+	flag.Parse()
+	b, err := generate(*dir)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "openapigen: %v\n", err)
+		os.Exit(1)
+	}
+	if *out == "" {
+		_, err = os.Stdout.Write(b)
+	} else {
+		err = ioutil.WriteFile(*out, b, 0644)
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "openapigen: %v\n", err)
+		os.Exit(1)
+	}
+}
+
+// generate parses the annotations of the rest package in dir, and returns the OpenAPI 3.0
+// specification as YAML.
+func generate(dir string) ([]byte, error) {
+	parser := swag.New(
+		swag.SetStrict(true),
+		swag.SetExcludedDirsAndFiles("client,internal"),
+		swag.SetDebugger(log.New(ioutil.Discard, "", 0)))
+	if err := parser.ParseAPI(dir, "openapi.go", 100); err != nil {
+		return nil, err
+	}
+	b, err := json.Marshal(parser.GetSwagger())
+	if err != nil {
+		return nil, err
+	}
+	var doc2 openapi2.T
+	if err := json.Unmarshal(b, &doc2); err != nil {
+		return nil, err
+	}
+	doc, err := openapi2conv.ToV3(&doc2)
+	if err != nil {
+		return nil, err
+	}
+	doc.OpenAPI = "3.0.3"
+	doc.Info.Contact = nil
+	splitContent(doc)
+	if err := applyOneOf(doc); err != nil {
+		return nil, err
+	}
+
+	buf := bytes.NewBufferString(header)
+	enc := yaml.NewEncoder(buf)
+	enc.SetIndent(2)
+	if err := enc.Encode(doc); err != nil {
+		return nil, err
+	}
+	if err := enc.Close(); err != nil {
+		return nil, err
+	}
+
+	// Load the result to resolve and check references.
+	loaded, err := openapi3.NewLoader().LoadFromData(buf.Bytes())
+	if err != nil {
+		return nil, err
+	}
+	if err := loaded.Validate(context.Background()); err != nil {
+		return nil, fmt.Errorf("generated specification is invalid: %v", err)
+	}
+	return buf.Bytes(), nil
+}
+
+// splitContent separates the content types swag assigns to every response of an operation: error
+// responses are plain text, other responses are not when the operation produces anything else.
+func splitContent(doc *openapi3.T) {
+	for _, item := range doc.Paths.Map() {
+		for _, op := range item.Operations() {
+			for code, resp := range op.Responses.Map() {
+				content := resp.Value.Content
+				plain := content.Get("text/plain")
+				if plain == nil || len(content) < 2 {
+					continue
+				}
+				if code >= "400" {
+					resp.Value.Content = openapi3.NewContentWithSchema(
+						openapi3.NewStringSchema(), []string{"text/plain"})
+				} else {
+					delete(content, "text/plain")
+				}
+			}
+		}
+	}
+}
+
+// applyOneOf replaces the JSON response schemas of operations with the oneOfExtension by a oneOf
+// of the generated schema and the listed alternatives.
+func applyOneOf(doc *openapi3.T) error {
+	for path, item := range doc.Paths.Map() {
+		for method, op := range item.Operations() {
+			v, ok := op.Extensions[oneOfExtension]
+			if !ok {
+				continue
+			}
+			delete(op.Extensions, oneOfExtension)
+			b, err := json.Marshal(v)
+			if err != nil {
+				return err
+			}
+			var alts map[string]openapi3.SchemaRefs
+			if err := json.Unmarshal(b, &alts); err != nil {
+				return fmt.Errorf("%v %v: invalid %v: %v", method, path, oneOfExtension, err)
+			}
+			for code, schemas := range alts {
+				resp := op.Responses.Value(code)
+				if resp == nil || resp.Value == nil {
+					return fmt.Errorf("%v %v: %v response %v not found", method, path,
+						oneOfExtension, code)
+				}
+				content := resp.Value.Content.Get("application/json")
+				if content == nil {
+					return fmt.Errorf("%v %v: %v response %v has no JSON content", method, path,
+						oneOfExtension, code)
+				}
+				content.Schema = &openapi3.SchemaRef{Value: &openapi3.Schema{
+					OneOf: append(openapi3.SchemaRefs{content.Schema}, schemas...),
+				}}
+			}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,22 @@
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"testing"
+)
+
+// TestGenerate verifies the committed openapi.yaml is up to date with the handler annotations.
+func TestGenerate(t *testing.T) {
+	got, err := generate("../..")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want, err := ioutil.ReadFile("../../openapi.yaml")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, want) {
+		t.Error("openapi.yaml is out of date, run go generate ./pkg/rest")
+	}
+}
@@ -6,32 +6,118 @@ import (
 
 // JSONMessageHeaderV1 contains the basic header data for a message
 type JSONMessageHeaderV1 struct {
-	Mailbox     string    `json:"mailbox"`
-	ID          string    `json:"id"`
-	From        string    `json:"from"`
-	To          []string  `json:"to"`
-	Subject     string    `json:"subject"`
-	Date        time.Time `json:"date"`
-	PosixMillis int64     `json:"posix-millis"`
-	Size        int64     `json:"size"`
-	Seen        bool      `json:"seen"`
-}
+	Mailbox         string    `json:"mailbox"`
+	ID              string    `json:"id"`
+	From            string    `json:"from"`
+	To              []string  `json:"to" extensions:"x-nullable"`
+	Subject         string    `json:"subject"`
+	Date            time.Time `json:"date" format:"date-time"`
+	PosixMillis     int64     `json:"posix-millis"`
+	ReceivedAt      time.Time `json:"receivedAt" format:"date-time"`
+	Size            int64     `json:"size"`
+	Seen            bool      `json:"seen"`
+	EnvelopeID      string    `json:"envelopeId,omitempty"`
+	DKIMResult      string    `json:"dkimResult,omitempty"`
+	DKIMDomain      string    `json:"dkimDomain,omitempty"`
+	SPFResult       string    `json:"spfResult,omitempty"`
+	Tags            []string  `json:"tags,omitempty"`
+	AttachmentCount int       `json:"attachmentCount"`
+	AttachmentBytes int64     `json:"attachmentBytes"`
+	Snippet         string    `json:"snippet,omitempty"`
+	Priority        int       `json:"priority" minimum:"1" maximum:"5"`
+} // @name MessageHeader
+
+// JSONMessagePageV1 contains a page of message headers, and the cursor for the next page, which is
+// empty if this is the last page
+type JSONMessagePageV1 struct {
+	Messages   []*JSONMessageHeaderV1 `json:"messages"`
+	NextCursor string                 `json:"nextCursor"`
+} // @name MessagePage
+
+// JSONMessageReadV1 sets the read status of a message.
+type JSONMessageReadV1 struct {
+	Read bool `json:"read"`
+} // @name MessageRead
+
+// JSONMessageTagsV1 replaces the tags of a message.
+type JSONMessageTagsV1 struct {
+	Tags []string `json:"tags"`
+} // @name MessageTags
+
+// JSONMessageMoveV1 names the mailbox a message is moved to.
+type JSONMessageMoveV1 struct {
+	Destination string `json:"destination"`
+} // @name MessageMove
+
+// JSONMessageGenerateV1 names the template a message is generated from, and the variables it is
+// rendered with.
+type JSONMessageGenerateV1 struct {
+	Template string                 `json:"template"`
+	Vars     map[string]interface{} `json:"vars"`
+} // @name MessageGenerate
+
+// JSONMailboxV1 summarizes the content of a mailbox
+type JSONMailboxV1 struct {
+	Name         string    `json:"name"`
+	MessageCount int       `json:"messageCount"`
+	TotalBytes   int64     `json:"totalBytes"`
+	LatestDate   time.Time `json:"latestDate" format:"date-time"`
+} // @name Mailbox
+
+// JSONMailboxQuotaV1 reports the storage quota of a mailbox, AvailableBytes is nil if there is no
+// quota
+type JSONMailboxQuotaV1 struct {
+	QuotaBytes     int64  `json:"quotaBytes"`
+	UsedBytes      int64  `json:"usedBytes"`
+	AvailableBytes *int64 `json:"availableBytes" extensions:"x-nullable"`
+} // @name MailboxQuota
+
+// JSONMessageRefV1 identifies a message, it is sent when a message is deleted
+type JSONMessageRefV1 struct {
+	Mailbox string `json:"mailbox"`
+	ID      string `json:"id"`
+} // @name MessageRef
+
+// JSONRestoreV1 reports the number of messages imported from a backup archive
+type JSONRestoreV1 struct {
+	Restored int `json:"restored"`
+} // @name Restore
+
+// JSONReloadV1 lists the configuration fields changed by a reload, or the fields which could not
+// be changed without a restart
+type JSONReloadV1 struct {
+	Changed []string `json:"changed" extensions:"x-nullable"`
+	Restart []string `json:"restart,omitempty"`
+} // @name Reload
 
 // JSONMessageV1 contains the same data as the header plus a JSONMessageBody
 type JSONMessageV1 struct {
-	Mailbox     string                     `json:"mailbox"`
-	ID          string                     `json:"id"`
-	From        string                     `json:"from"`
-	To          []string                   `json:"to"`
-	Subject     string                     `json:"subject"`
-	Date        time.Time                  `json:"date"`
-	PosixMillis int64                      `json:"posix-millis"`
-	Size        int64                      `json:"size"`
-	Seen        bool                       `json:"seen"`
-	Body        *JSONMessageBodyV1         `json:"body"`
-	Header      map[string][]string        `json:"header"`
-	Attachments []*JSONMessageAttachmentV1 `json:"attachments"`
-}
+	Mailbox         string                     `json:"mailbox"`
+	ID              string                     `json:"id"`
+	From            string                     `json:"from"`
+	To              []string                   `json:"to" extensions:"x-nullable"`
+	Cc              []string                   `json:"cc" extensions:"x-nullable"`
+	ReplyTo         []string                   `json:"replyTo" extensions:"x-nullable"`
+	MessageID       string                     `json:"messageId"`
+	Subject         string                     `json:"subject"`
+	Date            time.Time                  `json:"date" format:"date-time"`
+	PosixMillis     int64                      `json:"posix-millis"`
+	ReceivedAt      time.Time                  `json:"receivedAt" format:"date-time"`
+	Size            int64                      `json:"size"`
+	Seen            bool                       `json:"seen"`
+	EnvelopeID      string                     `json:"envelopeId,omitempty"`
+	DKIMResult      string                     `json:"dkimResult,omitempty"`
+	DKIMDomain      string                     `json:"dkimDomain,omitempty"`
+	SPFResult       string                     `json:"spfResult,omitempty"`
+	Tags            []string                   `json:"tags,omitempty"`
+	AttachmentCount int                        `json:"attachmentCount"`
+	AttachmentBytes int64                      `json:"attachmentBytes"`
+	Priority        int                        `json:"priority" minimum:"1" maximum:"5"`
+	Body            *JSONMessageBodyV1         `json:"body"`
+	Header          map[string][]string        `json:"header" extensions:"x-nullable"`
+	Headers         map[string][]string        `json:"headers,omitempty"`
+	Attachments     []*JSONMessageAttachmentV1 `json:"attachments"`
+} // @name Message
 
 // JSONMessageAttachmentV1 contains information about a MIME attachment
 type JSONMessageAttachmentV1 struct {
@@ -40,10 +126,29 @@ type JSONMessageAttachmentV1 struct {
 	DownloadLink string `json:"download-link"`
 	ViewLink     string `json:"view-link"`
 	MD5          string `json:"md5"`
-}
+} // @name MessageAttachment
+
+// JSONMessagePartV1 describes a decoded MIME part of a message
+type JSONMessagePartV1 struct {
+	PartIndex   int    `json:"partIndex"`
+	ContentType string `json:"contentType"`
+	Filename    string `json:"filename"`
+	Size        int    `json:"size"`
+} // @name MessagePart
 
 // JSONMessageBodyV1 contains the Text and HTML versions of the message body
 type JSONMessageBodyV1 struct {
 	Text string `json:"text"`
 	HTML string `json:"html"`
-}
+} // @name MessageBody
+
+// JSONSocketRequestV1 is sent by WebSocket clients to subscribe to, or unsubscribe from, a mailbox
+type JSONSocketRequestV1 struct {
+	Action  string `json:"action"`
+	Mailbox string `json:"mailbox"`
+} // @name SocketRequest
+
+// JSONSocketErrorV1 is sent to WebSocket clients in response to an invalid request
+type JSONSocketErrorV1 struct {
+	Error string `json:"error"`
+} // @name SocketError
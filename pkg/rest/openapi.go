@@ -0,0 +1,71 @@
+package rest
+
+import (
+	_ "embed" // For the OpenAPI specification.
+	"net/http"
+	"time"
+
+	"github.com/inbucket/inbucket/pkg/server/web"
+	httpSwagger "github.com/swaggo/http-swagger"
+)
+
+//go:generate go run ./internal/openapigen -o openapi.yaml
+
+// The general API information below, and the annotations of each handler, are read by swag to
+// generate openapi.yaml.
+//
+// @title Inbucket REST API
+// @version 1
+// @description REST API of the Inbucket email testing server.
+// @description
+// @description Mailbox names are resolved according to the `INBUCKET_MAILBOX_NAMING`
+// @description setting, so a full email address may be used as `{name}`.  Message IDs may
+// @description be given as `latest` to select the most recent message in the mailbox.
+// @description
+// @description Errors are returned as a plain text description with the status code.  When
+// @description `INBUCKET_WEB_APIRESPONSEENVELOPE` is enabled, JSON responses are wrapped in
+// @description an envelope object, which is not described here.  Endpoints producing JSON
+// @description also produce msgpack when requested with `Accept: application/msgpack`.
+// @BasePath /
+//
+// @tag.name mailbox
+// @tag.description Mailboxes and their messages.
+// @tag.name message
+// @tag.description Individual messages.
+// @tag.name monitor
+// @tag.description Notification of new messages.
+// @tag.name admin
+// @tag.description Administration, authenticated by `INBUCKET_WEB_ADMINUSER` and password.
+//
+// @securityDefinitions.apikey apiKey
+// @in header
+// @name Authorization
+// @description `Bearer` followed by one of `INBUCKET_WEB_APIKEYS`, if any are configured.
+//
+// @securityDefinitions.basic adminBasic
+
+// openAPISpec is the OpenAPI 3.0 specification of the REST and admin APIs.  It is generated from
+// the swag annotations of the handlers by go generate, TestOpenAPIResponses validates the handler
+// responses against it.
+//
+//go:embed openapi.yaml
+var openAPISpec []byte
+
+// openAPIETag identifies the embedded specification, which only changes between builds.
+var openAPIETag = web.ETag(string(openAPISpec))
+
+// OpenAPIV1 serves the OpenAPI specification of the REST and admin APIs.
+func OpenAPIV1(w http.ResponseWriter, req *http.Request, ctx *web.Context) (err error) {
+	if web.CheckNotModified(w, req, openAPIETag, time.Time{}) {
+		return nil
+	}
+	w.Header().Set("Content-Type", "application/yaml")
+	_, err = w.Write(openAPISpec)
+	return err
+}
+
+// DocsV1 returns a handler serving SwaggerUI, which browses the specification served at specURL.
+// It must be routed by path prefix, the prefix of the first request locates the UI assets.
+func DocsV1(specURL string) http.Handler {
+	return httpSwagger.Handler(httpSwagger.URL(specURL))
+}
@@ -0,0 +1,216 @@
+package rest
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io"
+	"net/http/httptest"
+	"os"
+	"regexp"
+	"strings"
+	"testing"
+
+	"github.com/getkin/kin-openapi/openapi3"
+	"github.com/getkin/kin-openapi/openapi3filter"
+	"github.com/getkin/kin-openapi/routers/gorillamux"
+	"github.com/gorilla/mux"
+	"github.com/inbucket/inbucket/pkg/config"
+	"github.com/inbucket/inbucket/pkg/message"
+	"github.com/inbucket/inbucket/pkg/policy"
+	"github.com/inbucket/inbucket/pkg/server/web"
+	"github.com/inbucket/inbucket/pkg/storage/mem"
+)
+
+// loadSpec loads and validates the embedded OpenAPI specification.
+func loadSpec(t *testing.T) *openapi3.T {
+	t.Helper()
+	doc, err := openapi3.NewLoader().LoadFromData(openAPISpec)
+	if err != nil {
+		t.Fatalf("Failed to load openapi.yaml: %v", err)
+	}
+	if err := doc.Validate(context.Background()); err != nil {
+		t.Fatalf("Invalid openapi.yaml: %v", err)
+	}
+	return doc
+}
+
+// TestOpenAPIRoutes verifies every REST and admin route is documented, and every documented
+// operation is routed.
+func TestOpenAPIRoutes(t *testing.T) {
+	doc := loadSpec(t)
+	r := mux.NewRouter()
+	SetupRoutes(r.PathPrefix("/api/").Subrouter())
+	SetupAdminRoutes(r.PathPrefix("/admin/").Subrouter())
+	pattern := regexp.MustCompile(`\{(\w+):[^}]*\}`)
+	routed := make(map[string]bool)
+	err := r.Walk(func(route *mux.Route, _ *mux.Router, _ []*mux.Route) error {
+		tmpl, err := route.GetPathTemplate()
+		if err != nil {
+			return nil
+		}
+		methods, err := route.GetMethods()
+		if err != nil {
+			return nil
+		}
+		path := pattern.ReplaceAllString(tmpl, "{$1}")
+		for _, m := range methods {
+			if m == "OPTIONS" {
+				continue
+			}
+			routed[m+" "+path] = true
+			if item := doc.Paths.Value(path); item == nil || item.GetOperation(m) == nil {
+				t.Errorf("Route %v %v is not documented", m, path)
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for path, item := range doc.Paths.Map() {
+		for method := range item.Operations() {
+			if !routed[method+" "+path] {
+				t.Errorf("Documented operation %v %v is not routed", method, path)
+			}
+		}
+	}
+}
+
+// TestOpenAPIResponses verifies handler responses are documented, and response bodies are valid
+// according to the documented schemas.
+func TestOpenAPIResponses(t *testing.T) {
+	doc := loadSpec(t)
+	router, err := gorillamux.NewRouter(doc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	store, err := mem.New(config.Storage{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	mm := &message.StoreManager{
+		AddrPolicy: &policy.Addressing{Config: &config.Root{MailboxNaming: config.FullNaming}},
+		Store:      store,
+	}
+	logbuf := setupWebServerConfig(mm, config.Web{ImportMaxBytes: 10000})
+	for _, ctype := range []string{"message/rfc822", "text/html"} {
+		openapi3filter.RegisterBodyDecoder(ctype, openapi3filter.FileBodyDecoder)
+		defer openapi3filter.UnregisterBodyDecoder(ctype)
+	}
+
+	// call requests url, and validates the response against the documented operation.
+	call := func(method, url, contentType, body string, status int) map[string]interface{} {
+		t.Helper()
+		var w *httptest.ResponseRecorder
+		var err error
+		switch method {
+		case "GET":
+			w, err = testRestGet(url)
+		case "DELETE":
+			w, err = testRestDelete(url)
+		case "POST":
+			w, err = testRestPost(url, contentType, body)
+		case "PUT":
+			w, err = testRestPut(url, body)
+		case "PATCH":
+			w, err = testRestPatch(url, body)
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		if w.Code != status {
+			t.Fatalf("%v %v got status %v, want: %v: %s", method, url, w.Code, status, w.Body)
+		}
+		req := httptest.NewRequest(method, url, strings.NewReader(body))
+		route, params, err := router.FindRoute(req)
+		if err != nil {
+			t.Fatalf("%v %v: %v", method, url, err)
+		}
+		input := &openapi3filter.ResponseValidationInput{
+			RequestValidationInput: &openapi3filter.RequestValidationInput{
+				Request:    req,
+				PathParams: params,
+				Route:      route,
+			},
+			Status:  w.Code,
+			Header:  w.Header(),
+			Options: &openapi3filter.Options{IncludeResponseStatus: true},
+		}
+		input.SetBodyBytes(w.Body.Bytes())
+		if err := openapi3filter.ValidateResponse(context.Background(), input); err != nil {
+			t.Errorf("%v %v: %v\n%s", method, url, err, w.Body)
+		}
+		var v map[string]interface{}
+		_ = json.Unmarshal(w.Body.Bytes(), &v)
+		return v
+	}
+
+	const base = "http://localhost"
+	source := "From: Alice <alice@example.com>\r\nTo: bob@example.com\r\nSubject: hello\r\n" +
+		"Date: Wed, 01 Feb 2012 10:11:12 -0800\r\n\r\nHello Bob\r\n"
+	ref := call("POST", base+"/api/v1/mailbox/box", "message/rfc822", source, 201)
+	id, _ := ref["id"].(string)
+	msgURL := base + "/api/v1/mailbox/box/" + id
+
+	call("GET", base+"/api/v1/mailboxes", "", "", 200)
+	call("GET", base+"/api/v1/mailbox/box", "", "", 200)
+	call("GET", base+"/api/v1/mailbox/box?limit=1", "", "", 200)
+	call("GET", base+"/api/v1/mailbox/box?spam=maybe", "", "", 400)
+	call("GET", base+"/api/v1/mailbox/box/search?subject=hel", "", "", 200)
+	call("GET", base+"/api/v1/mailbox/box/quota", "", "", 200)
+	call("GET", base+"/api/v1/search?mailbox=b*", "", "", 200)
+	call("GET", msgURL, "", "", 200)
+	call("GET", base+"/api/v1/mailbox/box/missing", "", "", 404)
+	call("GET", msgURL+"/parts", "", "", 200)
+	call("GET", msgURL+"/parts/0", "", "", 200)
+	call("GET", msgURL+"/html", "", "", 200)
+	call("GET", msgURL+"/source", "", "", 200)
+	call("GET", msgURL+"/raw", "", "", 200)
+	call("PUT", msgURL+"/read", "", `{"read":true}`, 200)
+	call("PUT", msgURL+"/tags", "", `{"tags":["a"]}`, 200)
+	call("PATCH", msgURL, "", `{"seen":true}`, 200)
+	call("POST", msgURL+"/copy", "application/json", `{"destination":"other"}`, 201)
+	moved := call("POST", msgURL+"/move", "application/json",
+		`{"destination":"other"}`, 200)
+	movedID, _ := moved["id"].(string)
+	call("DELETE", base+"/api/v1/mailbox/other/"+movedID, "", "", 200)
+	call("DELETE", base+"/api/v1/mailbox/other", "", "", 204)
+
+	// The specification itself is served.
+	w := httptest.NewRecorder()
+	web.Handler(OpenAPIV1).ServeHTTP(w, httptest.NewRequest("GET", base+"/openapi.yaml", nil))
+	if w.Code != 200 || w.Header().Get("Content-Type") != "application/yaml" ||
+		!bytes.Equal(w.Body.Bytes(), openAPISpec) {
+		t.Errorf("Got OpenAPIV1 status %v, content type %q, want: 200 application/yaml", w.Code,
+			w.Header().Get("Content-Type"))
+	}
+
+	if t.Failed() {
+		// Dump buffered log data if there was a failure
+		_, _ = io.Copy(os.Stderr, logbuf)
+	}
+}
+
+// TestDocsV1 verifies SwaggerUI is served, and browses the given specification.
+func TestDocsV1(t *testing.T) {
+	h := DocsV1("/base/openapi.yaml")
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, httptest.NewRequest("GET", "/base/docs/", nil))
+	if w.Code != 301 || w.Header().Get("Location") != "/base/docs/index.html" {
+		t.Errorf("Got status %v, location %q, want: 301 /base/docs/index.html", w.Code,
+			w.Header().Get("Location"))
+	}
+	w = httptest.NewRecorder()
+	h.ServeHTTP(w, httptest.NewRequest("GET", "/base/docs/index.html", nil))
+	// The URL is escaped as a JavaScript string.
+	if w.Code != 200 || !strings.Contains(w.Body.String(), `url: "\/base\/openapi.yaml"`) {
+		t.Errorf("Got index status %v, want: 200 referencing /base/openapi.yaml:\n%s", w.Code,
+			w.Body)
+	}
+	w = httptest.NewRecorder()
+	h.ServeHTTP(w, httptest.NewRequest("GET", "/base/docs/swagger-ui-bundle.js", nil))
+	if w.Code != 200 || w.Body.Len() == 0 {
+		t.Errorf("Got asset status %v, want: 200", w.Code)
+	}
+}
@@ -5,21 +5,69 @@ import "github.com/inbucket/inbucket/pkg/server/web"
 
 // SetupRoutes populates the routes for the REST interface
 func SetupRoutes(r *mux.Router) {
+	r.Use(web.CORS, web.ResponseEnvelope, web.APIAuth)
 	// API v1
+	r.PathPrefix("/v1/").Handler(web.PreflightHandler).Name("PreflightV1").Methods("OPTIONS")
+	r.Path("/v1/mailboxes").Handler(
+		web.Negotiate(web.Handler(MailboxesV1))).Name("MailboxesV1").Methods("GET")
 	r.Path("/v1/mailbox/{name}").Handler(
-		web.Handler(MailboxListV1)).Name("MailboxListV1").Methods("GET")
+		web.Negotiate(web.Handler(MailboxListV1))).Name("MailboxListV1").Methods("GET")
 	r.Path("/v1/mailbox/{name}").Handler(
 		web.Handler(MailboxPurgeV1)).Name("MailboxPurgeV1").Methods("DELETE")
+	r.Path("/v1/mailbox/{name}").Handler(
+		web.Negotiate(web.Handler(MailboxImportV1))).Name("MailboxImportV1").Methods("POST")
+	r.Path("/v1/mailbox/{name}/generate").Handler(
+		web.Negotiate(web.Handler(MailboxGenerateV1))).Name("MailboxGenerateV1").Methods("POST")
+	r.Path("/v1/mailbox/{name}/search").Handler(
+		web.Negotiate(web.Handler(MailboxSearchV1))).Name("MailboxSearchV1").Methods("GET")
+	r.Path("/v1/mailbox/{name}/quota").Handler(
+		web.Negotiate(web.Handler(MailboxQuotaV1))).Name("MailboxQuotaV1").Methods("GET")
+	r.Path("/v1/mailbox/{name}/stream").Handler(
+		web.Handler(MailboxStreamV1)).Name("MailboxStreamV1").Methods("GET")
 	r.Path("/v1/mailbox/{name}/{id}").Handler(
-		web.Handler(MailboxShowV1)).Name("MailboxShowV1").Methods("GET")
+		web.Negotiate(web.Handler(MailboxShowV1))).Name("MailboxShowV1").Methods("GET")
 	r.Path("/v1/mailbox/{name}/{id}").Handler(
-		web.Handler(MailboxMarkSeenV1)).Name("MailboxMarkSeenV1").Methods("PATCH")
+		web.Negotiate(web.Handler(MailboxMarkSeenV1))).Name("MailboxMarkSeenV1").Methods("PATCH")
 	r.Path("/v1/mailbox/{name}/{id}").Handler(
-		web.Handler(MailboxDeleteV1)).Name("MailboxDeleteV1").Methods("DELETE")
+		web.Negotiate(web.Handler(MailboxDeleteV1))).Name("MailboxDeleteV1").Methods("DELETE")
+	r.Path("/v1/mailbox/{name}/{id}/read").Handler(
+		web.Negotiate(web.Handler(MailboxMarkReadV1))).Name("MailboxMarkReadV1").Methods("PUT")
+	r.Path("/v1/mailbox/{name}/{id}/tags").Handler(
+		web.Negotiate(web.Handler(MailboxTagsV1))).Name("MailboxTagsV1").Methods("PUT")
+	r.Path("/v1/mailbox/{name}/{id}/move").Handler(
+		web.Negotiate(web.Handler(MailboxMoveV1))).Name("MailboxMoveV1").Methods("POST")
+	r.Path("/v1/mailbox/{name}/{id}/copy").Handler(
+		web.Negotiate(web.Handler(MailboxCopyV1))).Name("MailboxCopyV1").Methods("POST")
 	r.Path("/v1/mailbox/{name}/{id}/source").Handler(
 		web.Handler(MailboxSourceV1)).Name("MailboxSourceV1").Methods("GET")
+	r.Path("/v1/mailbox/{name}/{id}/raw").Handler(
+		web.Handler(MailboxRawV1)).Name("MailboxRawV1").Methods("GET")
+	r.Path("/v1/mailbox/{name}/{id}/html").Handler(
+		web.Handler(MailboxHTMLV1)).Name("MailboxHTMLV1").Methods("GET")
+	r.Path("/v1/mailbox/{name}/{id}/parts").Handler(
+		web.Negotiate(web.Handler(MailboxPartsV1))).Name("MailboxPartsV1").Methods("GET")
+	r.Path("/v1/mailbox/{name}/{id}/parts/{part:[0-9]+}").Handler(
+		web.Handler(MailboxPartV1)).Name("MailboxPartV1").Methods("GET")
+	r.Path("/v1/search").Handler(
+		web.Negotiate(web.Handler(SearchV1))).Name("SearchV1").Methods("GET")
+	r.Path("/v1/ws").Handler(
+		web.Handler(SocketV1)).Name("SocketV1").Methods("GET")
 	r.Path("/v1/monitor/messages").Handler(
 		web.Handler(MonitorAllMessagesV1)).Name("MonitorAllMessagesV1").Methods("GET")
 	r.Path("/v1/monitor/messages/{name}").Handler(
 		web.Handler(MonitorMailboxMessagesV1)).Name("MonitorMailboxMessagesV1").Methods("GET")
 }
+
+// SetupAdminRoutes populates the routes for the admin interface
+func SetupAdminRoutes(r *mux.Router) {
+	r.Path("/backup").Handler(
+		web.Handler(adminAuth(AdminBackup))).Name("AdminBackup").Methods("POST")
+	r.Path("/restore").Handler(
+		web.Handler(adminAuth(AdminRestore))).Name("AdminRestore").Methods("POST")
+	r.Path("/reload").Handler(
+		web.Handler(adminAuth(AdminReload))).Name("AdminReload").Methods("POST")
+	r.Path("/replication/log").Handler(
+		web.Handler(adminAuth(AdminReplicationLog))).Name("AdminReplicationLog").Methods("GET")
+	r.Path("/stats/reset").Handler(
+		web.Handler(adminAuth(AdminStatsReset))).Name("AdminStatsReset").Methods("POST")
+}
@@ -149,6 +149,16 @@ func (ml *msgListener) Close() {
 
 // MonitorAllMessagesV1 is a web handler which upgrades the connection to a websocket and notifies
 // the client of all messages received.
+//
+// @Summary Monitor all messages over a WebSocket
+// @Description Upgrades to a WebSocket, which is sent a MessageHeader for each new message.
+// @Tags monitor
+// @ID monitorMessages
+// @Produce plain
+// @Success 101 "Switched to the WebSocket protocol."
+// @Failure 401 {string} string "A valid API key or admin credentials are required."
+// @Security apiKey
+// @Router /api/v1/monitor/messages [get]
 func MonitorAllMessagesV1(
 	w http.ResponseWriter, req *http.Request, ctx *web.Context) (err error) {
 	// Upgrade to Websocket.
@@ -172,6 +182,17 @@ func MonitorAllMessagesV1(
 
 // MonitorMailboxMessagesV1 is a web handler which upgrades the connection to a websocket and
 // notifies the client of messages received by a particular mailbox.
+//
+// @Summary Monitor a mailbox over a WebSocket
+// @Description Upgrades to a WebSocket, which is sent a MessageHeader for each new message.
+// @Tags monitor
+// @ID monitorMailboxMessages
+// @Produce plain
+// @Param name path string true "Mailbox name, or an email address."
+// @Success 101 "Switched to the WebSocket protocol."
+// @Failure 401 {string} string "A valid API key or admin credentials are required."
+// @Security apiKey
+// @Router /api/v1/monitor/messages/{name} [get]
 func MonitorMailboxMessagesV1(
 	w http.ResponseWriter, req *http.Request, ctx *web.Context) (err error) {
 	name, err := ctx.Manager.MailboxForAddress(ctx.Vars["name"])
@@ -0,0 +1,138 @@
+package rest
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"time"
+
+	"github.com/inbucket/inbucket/pkg/pubsub"
+	"github.com/inbucket/inbucket/pkg/rest/model"
+	"github.com/inbucket/inbucket/pkg/server/web"
+	"github.com/rs/zerolog/log"
+)
+
+// MailboxStreamV1 is a web handler which streams Server-Sent Events to the client as messages are
+// added to or deleted from a particular mailbox.  The stream is closed after the configured
+// timeout passes without any events, clients are expected to reconnect.  It works over HTTP/1.1 and
+// HTTP/2, extending the write deadline before each event so that the stream is not cut short by
+// the HTTP server write timeout.
+//
+// @Summary Stream mailbox events
+// @Description Streams Server-Sent Events as messages are added to, or deleted from, the
+// @Description mailbox.  `message` events carry a MessageHeader, `delete` events a
+// @Description MessageRef.  The stream is closed after `INBUCKET_WEB_STREAMTIMEOUT` passes
+// @Description without events; clients are expected to reconnect.
+// @Tags monitor
+// @ID streamMailbox
+// @Produce text/event-stream,plain
+// @Param name path string true "Mailbox name, or an email address."
+// @Success 200 {string} string "Event stream."
+// @Failure 401 {string} string "A valid API key or admin credentials are required."
+// @Security apiKey
+// @Router /api/v1/mailbox/{name}/stream [get]
+func MailboxStreamV1(w http.ResponseWriter, req *http.Request, ctx *web.Context) (err error) {
+	name, err := ctx.Manager.MailboxForAddress(ctx.Vars["name"])
+	if err != nil {
+		return err
+	}
+	if _, ok := w.(http.Flusher); !ok {
+		return errors.New("event streams are not supported by this connection")
+	}
+	rc := http.NewResponseController(w)
+	web.ExpStreamConnectsCurrent.Add(1)
+	defer web.ExpStreamConnectsCurrent.Add(-1)
+	slog := log.With().Str("module", "rest").Str("proto", "SSE").
+		Str("remote", req.RemoteAddr).Str("mailbox", name).Logger()
+	slog.Debug().Msg("Opened event stream")
+
+	// Register interest in mailbox; then stream events until the client goes away.
+	sub := ctx.Broker.Subscribe(name)
+	defer sub.Unsubscribe()
+	// Clear the read deadline set by the HTTP server, it would otherwise end the request.
+	_ = rc.SetReadDeadline(time.Time{})
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.WriteHeader(http.StatusOK)
+	if streamWrite(w, rc, "") != nil {
+		return nil
+	}
+	// A zero timeout disables idle stream pruning.
+	var idle *time.Timer
+	var idleC <-chan time.Time
+	if timeout := ctx.RootConfig.Web.StreamTimeout; timeout > 0 {
+		idle = time.NewTimer(timeout)
+		idleC = idle.C
+		defer idle.Stop()
+	}
+	ping := time.NewTicker(pingPeriod)
+	defer ping.Stop()
+	for {
+		var data string
+		select {
+		case <-req.Context().Done():
+			slog.Debug().Msg("Client closed event stream")
+			return nil
+		case <-idleC:
+			slog.Debug().Msg("Closing idle event stream")
+			return nil
+		case <-ping.C:
+			data = ": ping\n\n"
+		case e := <-sub.C:
+			if idle != nil {
+				if !idle.Stop() {
+					<-idle.C
+				}
+				idle.Reset(ctx.RootConfig.Web.StreamTimeout)
+			}
+			data, err = formatEvent(e)
+			if err != nil {
+				// The response has started, so errors cannot be returned to the client.
+				slog.Error().Err(err).Msg("Failed to encode event")
+				return nil
+			}
+		}
+		if err := streamWrite(w, rc, data); err != nil {
+			slog.Debug().Err(err).Msg("Event stream write failed")
+			return nil
+		}
+	}
+}
+
+// formatEvent encodes a pubsub.Event as a Server-Sent Event.
+func formatEvent(e pubsub.Event) (string, error) {
+	var v interface{}
+	switch e.Type {
+	case pubsub.MessageAdded:
+		v = &model.JSONMessageHeaderV1{
+			Mailbox:     e.Mailbox,
+			ID:          e.ID,
+			From:        e.From,
+			To:          e.To,
+			Subject:     e.Subject,
+			Date:        e.Date,
+			PosixMillis: e.Date.UnixNano() / 1000000,
+			Size:        e.Size,
+		}
+	default:
+		v = &model.JSONMessageRefV1{Mailbox: e.Mailbox, ID: e.ID}
+	}
+	data, err := json.Marshal(v)
+	if err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("event: %s\ndata: %s\n\n", e.Type, data), nil
+}
+
+// streamWrite writes data to the client, flushing it immediately.
+func streamWrite(w http.ResponseWriter, rc *http.ResponseController, data string) error {
+	if err := rc.SetWriteDeadline(time.Now().Add(writeWait)); err != nil {
+		return err
+	}
+	if _, err := io.WriteString(w, data); err != nil {
+		return err
+	}
+	return rc.Flush()
+}
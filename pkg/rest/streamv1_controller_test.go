@@ -0,0 +1,191 @@
+package rest
+
+import (
+	"bufio"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/inbucket/inbucket/pkg/config"
+	"github.com/inbucket/inbucket/pkg/pubsub"
+	"github.com/inbucket/inbucket/pkg/server/web"
+	"github.com/inbucket/inbucket/pkg/test"
+)
+
+// streamEvent is a parsed Server-Sent Event.
+type streamEvent struct {
+	event string
+	data  map[string]interface{}
+}
+
+func TestRestMailboxStream(t *testing.T) {
+	broker := pubsub.NewBroker()
+	logbuf := setupWebServerBroker(test.NewManager(),
+		config.Web{StreamTimeout: time.Minute}, broker)
+	srv := httptest.NewServer(web.Router)
+	defer srv.Close()
+
+	// Multiple concurrent subscribers.
+	resp1, events1 := openStream(t, http.DefaultClient, srv.URL+"/api/v1/mailbox/box/stream")
+	defer resp1.Body.Close()
+	resp2, events2 := openStream(t, http.DefaultClient, srv.URL+"/api/v1/mailbox/box/stream")
+	defer resp2.Body.Close()
+	waitSubscribers(t, broker, "box", 2)
+	if got := resp1.Header.Get("Content-Type"); got != "text/event-stream" {
+		t.Errorf("got Content-Type %q, want: %q", got, "text/event-stream")
+	}
+
+	date := time.Date(2012, 2, 1, 10, 11, 12, 0, time.UTC)
+	broker.Publish(pubsub.Event{Type: pubsub.MessageAdded, Mailbox: "box", ID: "0001",
+		From: "<from@host>", To: []string{"<to@host>"}, Subject: "subject", Date: date, Size: 42})
+	broker.Publish(pubsub.Event{Type: pubsub.MessageAdded, Mailbox: "other", ID: "0002"})
+	broker.Publish(pubsub.Event{Type: pubsub.MessageDeleted, Mailbox: "box", ID: "0001"})
+	for _, events := range []chan streamEvent{events1, events2} {
+		e := nextEvent(t, events)
+		if e.event != "MessageAdded" {
+			t.Errorf("got event %q, want: MessageAdded", e.event)
+		}
+		for k, want := range map[string]interface{}{
+			"mailbox": "box",
+			"id":      "0001",
+			"from":    "<from@host>",
+			"subject": "subject",
+			"size":    float64(42),
+		} {
+			if got := e.data[k]; got != want {
+				t.Errorf("got %v %v, want: %v", k, got, want)
+			}
+		}
+		e = nextEvent(t, events)
+		if e.event != "MessageDeleted" {
+			t.Errorf("got event %q, want: MessageDeleted", e.event)
+		}
+		if e.data["id"] != "0001" {
+			t.Errorf("got id %v, want: 0001", e.data["id"])
+		}
+	}
+
+	// Disconnecting a client removes its subscription.
+	resp1.Body.Close()
+	waitSubscribers(t, broker, "box", 1)
+	resp2.Body.Close()
+	waitSubscribers(t, broker, "box", 0)
+
+	if t.Failed() {
+		// Dump buffered log data if there was a failure
+		_, _ = io.Copy(os.Stderr, logbuf)
+	}
+}
+
+func TestRestMailboxStreamTimeout(t *testing.T) {
+	broker := pubsub.NewBroker()
+	setupWebServerBroker(test.NewManager(),
+		config.Web{StreamTimeout: 100 * time.Millisecond}, broker)
+	srv := httptest.NewServer(web.Router)
+	defer srv.Close()
+
+	resp, events := openStream(t, http.DefaultClient, srv.URL+"/api/v1/mailbox/box/stream")
+	defer resp.Body.Close()
+	waitSubscribers(t, broker, "box", 1)
+	select {
+	case _, ok := <-events:
+		if ok {
+			t.Fatal("got event, wanted stream to be closed")
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Timeout waiting for idle stream to be closed")
+	}
+	waitSubscribers(t, broker, "box", 0)
+}
+
+// TestRestMailboxStreamHTTP2 verifies event streams work over HTTP/2, which can not be hijacked.
+func TestRestMailboxStreamHTTP2(t *testing.T) {
+	broker := pubsub.NewBroker()
+	logbuf := setupWebServerBroker(test.NewManager(),
+		config.Web{StreamTimeout: time.Minute}, broker)
+	srv := httptest.NewUnstartedServer(web.Router)
+	srv.EnableHTTP2 = true
+	srv.StartTLS()
+	defer srv.Close()
+
+	resp, events := openStream(t, srv.Client(), srv.URL+"/api/v1/mailbox/box/stream")
+	defer resp.Body.Close()
+	if resp.ProtoMajor != 2 {
+		t.Fatalf("got protocol %v, want: HTTP/2", resp.Proto)
+	}
+	waitSubscribers(t, broker, "box", 1)
+	broker.Publish(pubsub.Event{Type: pubsub.MessageDeleted, Mailbox: "box", ID: "0001"})
+	e := nextEvent(t, events)
+	if e.event != "MessageDeleted" || e.data["id"] != "0001" {
+		t.Errorf("got event %q %v, want: MessageDeleted 0001", e.event, e.data)
+	}
+	resp.Body.Close()
+	waitSubscribers(t, broker, "box", 0)
+
+	if t.Failed() {
+		// Dump buffered log data if there was a failure
+		_, _ = io.Copy(os.Stderr, logbuf)
+	}
+}
+
+// openStream connects to an event stream, parsed events are sent to the returned channel which
+// is closed at the end of the stream.
+func openStream(t *testing.T, client *http.Client, url string) (*http.Response, chan streamEvent) {
+	t.Helper()
+	resp, err := client.Get(url)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("got status %v, want: %v", resp.StatusCode, http.StatusOK)
+	}
+	events := make(chan streamEvent, 10)
+	go func() {
+		defer close(events)
+		var e streamEvent
+		scanner := bufio.NewScanner(resp.Body)
+		for scanner.Scan() {
+			line := scanner.Text()
+			switch {
+			case strings.HasPrefix(line, "event: "):
+				e.event = strings.TrimPrefix(line, "event: ")
+			case strings.HasPrefix(line, "data: "):
+				_ = json.Unmarshal([]byte(strings.TrimPrefix(line, "data: ")), &e.data)
+			case line == "" && e.event != "":
+				events <- e
+				e = streamEvent{}
+			}
+		}
+	}()
+	return resp, events
+}
+
+func nextEvent(t *testing.T, events chan streamEvent) streamEvent {
+	t.Helper()
+	select {
+	case e, ok := <-events:
+		if !ok {
+			t.Fatal("Event stream closed unexpectedly")
+		}
+		return e
+	case <-time.After(5 * time.Second):
+		t.Fatal("Timeout waiting for event")
+	}
+	return streamEvent{}
+}
+
+func waitSubscribers(t *testing.T, broker *pubsub.Broker, mailbox string, want int) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for broker.Subscribers(mailbox) != want {
+		if time.Now().After(deadline) {
+			t.Fatalf("got %v subscribers, want: %v", broker.Subscribers(mailbox), want)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
@@ -0,0 +1,206 @@
+package rest
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/inbucket/inbucket/pkg/message"
+	"github.com/inbucket/inbucket/pkg/pubsub"
+	"github.com/inbucket/inbucket/pkg/rest/model"
+	"github.com/inbucket/inbucket/pkg/server/web"
+	"github.com/rs/zerolog"
+	"github.com/rs/zerolog/log"
+)
+
+// Actions accepted in a JSONSocketRequestV1, subscribe is assumed if none is specified.
+const (
+	actionSubscribe   = "subscribe"
+	actionUnsubscribe = "unsubscribe"
+)
+
+// socketSession relays messages from the pubsub.Broker to a WebSocket client, for each of the
+// mailboxes it has subscribed to.
+type socketSession struct {
+	conn    *websocket.Conn
+	broker  *pubsub.Broker
+	manager message.Manager
+	log     zerolog.Logger
+	writeMu sync.Mutex                      // Serializes writes to conn.
+	subs    map[string]*pubsub.Subscription // Subscriptions by mailbox, owned by readLoop.
+	done    chan struct{}                   // Closed once the client has disconnected.
+	wg      sync.WaitGroup                  // Tracks relay and ping goroutines.
+}
+
+// SocketV1 is a web handler which upgrades the connection to a websocket.  The client subscribes
+// to mailboxes by sending JSONSocketRequestV1 frames, and is then notified of messages received
+// by those mailboxes.
+//
+// @Summary Subscribe to mailboxes over a WebSocket
+// @Description Upgrades to a WebSocket.  The client sends
+// @Description `{"action": "subscribe", "mailbox": name}` objects to subscribe to mailboxes, or
+// @Description `unsubscribe` from them; the server sends a MessageHeader for each new message, or
+// @Description `{"error": text}` for invalid requests.
+// @Tags monitor
+// @ID subscribe
+// @Produce plain
+// @Success 101 "Switched to the WebSocket protocol."
+// @Failure 401 {string} string "A valid API key or admin credentials are required."
+// @Security apiKey
+// @Router /api/v1/ws [get]
+func SocketV1(w http.ResponseWriter, req *http.Request, ctx *web.Context) (err error) {
+	// Upgrade to Websocket.
+	conn, err := upgrader.Upgrade(w, req, nil)
+	if err != nil {
+		return err
+	}
+	web.ExpWebSocketConnectsCurrent.Add(1)
+	defer web.ExpWebSocketConnectsCurrent.Add(-1)
+	s := &socketSession{
+		conn:    conn,
+		broker:  ctx.Broker,
+		manager: ctx.Manager,
+		log: log.With().Str("module", "rest").Str("proto", "WebSocket").
+			Str("remote", conn.RemoteAddr().String()).Logger(),
+		subs: make(map[string]*pubsub.Subscription),
+		done: make(chan struct{}),
+	}
+	s.log.Debug().Msg("Upgraded to WebSocket")
+	s.wg.Add(1)
+	go s.pingLoop()
+	s.readLoop()
+
+	// Client has gone away, stop relaying.
+	close(s.done)
+	for _, sub := range s.subs {
+		sub.Unsubscribe()
+	}
+	_ = conn.Close()
+	s.wg.Wait()
+	return nil
+}
+
+// readLoop handles requests from the client until it disconnects.
+func (s *socketSession) readLoop() {
+	s.conn.SetReadLimit(maxMessageSize)
+	_ = s.conn.SetReadDeadline(time.Now().Add(pongWait))
+	s.conn.SetPongHandler(func(string) error {
+		return s.conn.SetReadDeadline(time.Now().Add(pongWait))
+	})
+	for {
+		mtype, data, err := s.conn.ReadMessage()
+		if err != nil {
+			if websocket.IsUnexpectedCloseError(
+				err,
+				websocket.CloseNormalClosure,
+				websocket.CloseGoingAway,
+				websocket.CloseNoStatusReceived,
+			) {
+				// Unexpected close code
+				s.log.Warn().Err(err).Msg("Socket error")
+			} else {
+				s.log.Debug().Msg("Closing socket")
+			}
+			return
+		}
+		if err := s.handle(mtype, data); err != nil {
+			s.log.Debug().Err(err).Msg("Invalid request")
+			if s.write(&model.JSONSocketErrorV1{Error: err.Error()}) != nil {
+				return
+			}
+		}
+	}
+}
+
+// handle processes a single request frame.
+func (s *socketSession) handle(mtype int, data []byte) error {
+	if mtype != websocket.TextMessage {
+		return fmt.Errorf("expected text frame")
+	}
+	var req model.JSONSocketRequestV1
+	if err := json.Unmarshal(data, &req); err != nil {
+		return fmt.Errorf("invalid request: %v", err)
+	}
+	if req.Mailbox == "" {
+		return fmt.Errorf("mailbox is required")
+	}
+	name, err := s.manager.MailboxForAddress(req.Mailbox)
+	if err != nil {
+		return err
+	}
+	switch req.Action {
+	case "", actionSubscribe:
+		if s.subs[name] == nil {
+			sub := s.broker.Subscribe(name)
+			s.subs[name] = sub
+			s.wg.Add(1)
+			go s.relay(sub)
+		}
+	case actionUnsubscribe:
+		sub := s.subs[name]
+		if sub == nil {
+			return fmt.Errorf("not subscribed to %q", name)
+		}
+		sub.Unsubscribe()
+		delete(s.subs, name)
+	default:
+		return fmt.Errorf("unknown action %q", req.Action)
+	}
+	return nil
+}
+
+// relay sends new messages to the client until the subscription is closed.
+func (s *socketSession) relay(sub *pubsub.Subscription) {
+	defer s.wg.Done()
+	for e := range sub.C {
+		if e.Type != pubsub.MessageAdded {
+			continue
+		}
+		header := &model.JSONMessageHeaderV1{
+			Mailbox:     e.Mailbox,
+			ID:          e.ID,
+			From:        e.From,
+			To:          e.To,
+			Subject:     e.Subject,
+			Date:        e.Date,
+			PosixMillis: e.Date.UnixNano() / 1000000,
+			Size:        e.Size,
+		}
+		if s.write(header) != nil {
+			// Write failed, readLoop will notice the broken connection.
+			return
+		}
+	}
+}
+
+// pingLoop pings the client until it disconnects.
+func (s *socketSession) pingLoop() {
+	defer s.wg.Done()
+	ticker := time.NewTicker(pingPeriod)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-s.done:
+			return
+		case <-ticker.C:
+			s.writeMu.Lock()
+			_ = s.conn.SetWriteDeadline(time.Now().Add(writeWait))
+			err := s.conn.WriteMessage(websocket.PingMessage, []byte{})
+			s.writeMu.Unlock()
+			if err != nil {
+				return
+			}
+		}
+	}
+}
+
+// write sends v to the client as JSON.
+func (s *socketSession) write(v interface{}) error {
+	s.writeMu.Lock()
+	defer s.writeMu.Unlock()
+	_ = s.conn.SetWriteDeadline(time.Now().Add(writeWait))
+	return s.conn.WriteJSON(v)
+}
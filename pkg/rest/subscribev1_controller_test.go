@@ -0,0 +1,110 @@
+package rest
+
+import (
+	"io"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/inbucket/inbucket/pkg/config"
+	"github.com/inbucket/inbucket/pkg/pubsub"
+	"github.com/inbucket/inbucket/pkg/rest/model"
+	"github.com/inbucket/inbucket/pkg/server/web"
+	"github.com/inbucket/inbucket/pkg/test"
+	"go.uber.org/goleak"
+)
+
+func TestRestSocket(t *testing.T) {
+	broker := pubsub.NewBroker()
+	logbuf := setupWebServerBroker(test.NewManager(), config.Web{}, broker)
+	srv := httptest.NewServer(web.Router)
+	url := "ws" + strings.TrimPrefix(srv.URL, "http") + "/api/v1/ws"
+	conn, _, err := websocket.DefaultDialer.Dial(url, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Multiple subscriptions per connection.
+	for _, req := range []model.JSONSocketRequestV1{
+		{Mailbox: "box1"},
+		{Action: "subscribe", Mailbox: "box2"},
+		{Action: "subscribe", Mailbox: "box3"},
+	} {
+		if err := conn.WriteJSON(req); err != nil {
+			t.Fatal(err)
+		}
+	}
+	waitSubscribers(t, broker, "box1", 1)
+	waitSubscribers(t, broker, "box2", 1)
+	waitSubscribers(t, broker, "box3", 1)
+	err = conn.WriteJSON(&model.JSONSocketRequestV1{Action: "unsubscribe", Mailbox: "box3"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	waitSubscribers(t, broker, "box3", 0)
+
+	broker.Publish(pubsub.Event{Type: pubsub.MessageAdded, Mailbox: "box1", ID: "0001",
+		Subject: "subject 1"})
+	broker.Publish(pubsub.Event{Type: pubsub.MessageDeleted, Mailbox: "box1", ID: "0001"})
+	broker.Publish(pubsub.Event{Type: pubsub.MessageAdded, Mailbox: "box3", ID: "0002"})
+	broker.Publish(pubsub.Event{Type: pubsub.MessageAdded, Mailbox: "box2", ID: "0003",
+		Subject: "subject 3"})
+	got := make(map[string]string)
+	for i := 0; i < 2; i++ {
+		var header model.JSONMessageHeaderV1
+		if err := readSocket(conn, &header); err != nil {
+			t.Fatal(err)
+		}
+		got[header.Mailbox+"/"+header.ID] = header.Subject
+	}
+	want := map[string]string{"box1/0001": "subject 1", "box2/0003": "subject 3"}
+	for k, v := range want {
+		if got[k] != v {
+			t.Errorf("got subject %q for %v, want: %q", got[k], k, v)
+		}
+	}
+
+	// Invalid requests receive an error frame.
+	for _, req := range []string{
+		`garbage`,
+		`{"action": "dance", "mailbox": "box1"}`,
+		`{"action": "subscribe"}`,
+		`{"action": "unsubscribe", "mailbox": "box3"}`,
+	} {
+		if err := conn.WriteMessage(websocket.TextMessage, []byte(req)); err != nil {
+			t.Fatal(err)
+		}
+		var resp model.JSONSocketErrorV1
+		if err := readSocket(conn, &resp); err != nil {
+			t.Fatal(err)
+		}
+		if resp.Error == "" {
+			t.Errorf("got empty error for request %s", req)
+		}
+	}
+
+	// Disconnecting removes all subscriptions, without leaking goroutines.
+	_ = conn.WriteMessage(websocket.CloseMessage,
+		websocket.FormatCloseMessage(websocket.CloseNormalClosure, ""))
+	_ = conn.Close()
+	waitSubscribers(t, broker, "box1", 0)
+	waitSubscribers(t, broker, "box2", 0)
+	srv.Close()
+	goleak.VerifyNone(t,
+		goleak.IgnoreTopFunction("github.com/inbucket/inbucket/pkg/metric.metricsTicker"),
+		goleak.IgnoreTopFunction("github.com/inbucket/inbucket/pkg/storage/file.countGenerator"))
+
+	if t.Failed() {
+		// Dump buffered log data if there was a failure
+		_, _ = io.Copy(os.Stderr, logbuf)
+	}
+}
+
+// readSocket reads a JSON frame from conn into v.
+func readSocket(conn *websocket.Conn, v interface{}) error {
+	_ = conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	return conn.ReadJSON(v)
+}
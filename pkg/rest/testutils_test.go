@@ -12,6 +12,7 @@ import (
 	"github.com/inbucket/inbucket/pkg/config"
 	"github.com/inbucket/inbucket/pkg/message"
 	"github.com/inbucket/inbucket/pkg/msghub"
+	"github.com/inbucket/inbucket/pkg/pubsub"
 	"github.com/inbucket/inbucket/pkg/server/web"
 )
 
@@ -37,20 +38,68 @@ func testRestPatch(url string, body string) (*httptest.ResponseRecorder, error)
 	return w, nil
 }
 
+func testRestPut(url string, body string) (*httptest.ResponseRecorder, error) {
+	req, err := http.NewRequest("PUT", url, strings.NewReader(body))
+	req.Header.Add("Accept", "application/json")
+	if err != nil {
+		return nil, err
+	}
+	w := httptest.NewRecorder()
+	web.Router.ServeHTTP(w, req)
+	return w, nil
+}
+
+func testRestPost(url string, contentType string, body string) (*httptest.ResponseRecorder, error) {
+	req, err := http.NewRequest("POST", url, strings.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Add("Accept", "application/json")
+	req.Header.Add("Content-Type", contentType)
+	w := httptest.NewRecorder()
+	web.Router.ServeHTTP(w, req)
+	return w, nil
+}
+
+func testRestDelete(url string) (*httptest.ResponseRecorder, error) {
+	req, err := http.NewRequest("DELETE", url, nil)
+	req.Header.Add("Accept", "application/json")
+	if err != nil {
+		return nil, err
+	}
+	w := httptest.NewRecorder()
+	web.Router.ServeHTTP(w, req)
+	return w, nil
+}
+
 func setupWebServer(mm message.Manager) *bytes.Buffer {
+	return setupWebServerConfig(mm, config.Web{})
+}
+
+// setupWebServerConfig is setupWebServer with additional web configuration.
+func setupWebServerConfig(mm message.Manager, webConfig config.Web) *bytes.Buffer {
+	return setupWebServerBroker(mm, webConfig, pubsub.NewBroker())
+}
+
+// setupWebServerBroker is setupWebServerConfig with the provided pubsub.Broker.
+func setupWebServerBroker(
+	mm message.Manager, webConfig config.Web, broker *pubsub.Broker) *bytes.Buffer {
+	return setupWebServerRoot(mm, &config.Root{Web: webConfig}, broker)
+}
+
+// setupWebServerRoot is setupWebServerBroker with the provided root configuration.
+func setupWebServerRoot(
+	mm message.Manager, cfg *config.Root, broker *pubsub.Broker) *bytes.Buffer {
 	// Capture log output
 	buf := new(bytes.Buffer)
 	log.SetOutput(buf)
 
 	// Have to reset default mux to prevent duplicate routes
-	cfg := &config.Root{
-		Web: config.Web{
-			UIDir: "../ui",
-		},
-	}
+	cfg.Web.UIDir = "../ui"
 	shutdownChan := make(chan bool)
 	SetupRoutes(web.Router.PathPrefix("/api/").Subrouter())
-	web.Initialize(cfg, shutdownChan, mm, &msghub.Hub{})
+	SetupAdminRoutes(web.Router.PathPrefix("/admin/").Subrouter())
+	web.Initialize(cfg, shutdownChan, mm, &msghub.Hub{}, broker)
 
 	return buf
 }
@@ -0,0 +1,156 @@
+// Package grpc implements the Inbucket gRPC API, which provides access to stored messages for
+// clients generated from proto/inbucket/v1/service.proto.
+package grpc
+
+import (
+	"context"
+	"crypto/subtle"
+	"net"
+	"strings"
+
+	"github.com/inbucket/inbucket/pkg/config"
+	"github.com/inbucket/inbucket/pkg/policy"
+	"github.com/inbucket/inbucket/pkg/pubsub"
+	"github.com/inbucket/inbucket/pkg/storage"
+	inbucketv1 "github.com/inbucket/inbucket/proto/inbucket/v1"
+	"github.com/rs/zerolog/log"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+)
+
+// Server defines an instance of the gRPC server.
+type Server struct {
+	inbucketv1.UnimplementedMessageServiceServer
+	config         config.GRPC        // gRPC configuration.
+	store          storage.Store      // Mail store.
+	broker         *pubsub.Broker     // Mailbox change events.
+	addrPolicy     *policy.Addressing // Mailbox name policy.
+	server         *grpc.Server       // gRPC request handler.
+	globalShutdown chan bool          // Inbucket shutdown signal.
+	stopping       chan struct{}      // Closed to end WatchMailbox streams at shutdown.
+	stopped        chan struct{}      // Closed once active calls have finished.
+}
+
+// New creates a new Server struct.
+func New(
+	grpcConfig config.GRPC,
+	shutdownChan chan bool,
+	store storage.Store,
+	broker *pubsub.Broker,
+	addrPolicy *policy.Addressing,
+) *Server {
+	s := &Server{
+		config:         grpcConfig,
+		store:          store,
+		broker:         broker,
+		addrPolicy:     addrPolicy,
+		globalShutdown: shutdownChan,
+		stopping:       make(chan struct{}),
+		stopped:        make(chan struct{}),
+	}
+	var opts []grpc.ServerOption
+	if grpcConfig.Token != "" {
+		opts = append(opts,
+			grpc.UnaryInterceptor(s.authorizeUnary), grpc.StreamInterceptor(s.authorizeStream))
+	}
+	s.server = grpc.NewServer(opts...)
+	inbucketv1.RegisterMessageServiceServer(s.server, s)
+	return s
+}
+
+// Start the server and handle requests until ctx is canceled.
+func (s *Server) Start(ctx context.Context) {
+	slog := log.With().Str("module", "grpc").Str("phase", "startup").Logger()
+	addr, err := net.ResolveTCPAddr("tcp4", s.config.Addr)
+	if err != nil {
+		slog.Error().Err(err).Msg("Failed to build tcp4 address")
+		close(s.stopped)
+		s.emergencyShutdown()
+		return
+	}
+	slog.Info().Str("addr", addr.String()).Msg("gRPC listening on tcp4")
+	listener, err := net.ListenTCP("tcp4", addr)
+	if err != nil {
+		slog.Error().Err(err).Msg("Failed to start tcp4 listener")
+		close(s.stopped)
+		s.emergencyShutdown()
+		return
+	}
+	s.serve(ctx, listener)
+}
+
+// serve handles requests on listener until ctx is canceled, then waits for active calls to
+// finish.
+func (s *Server) serve(ctx context.Context, listener net.Listener) {
+	defer close(s.stopped)
+	errc := make(chan error, 1)
+	go func() {
+		errc <- s.server.Serve(listener)
+	}()
+	select {
+	case <-ctx.Done():
+		log.Debug().Str("module", "grpc").Str("phase", "shutdown").
+			Msg("gRPC shutdown requested, calls will be drained")
+		close(s.stopping)
+		s.server.GracefulStop()
+	case err := <-errc:
+		log.Error().Str("module", "grpc").Err(err).Msg("gRPC server failed")
+		s.emergencyShutdown()
+	}
+}
+
+func (s *Server) emergencyShutdown() {
+	// Shutdown Inbucket
+	select {
+	case _ = <-s.globalShutdown:
+	default:
+		close(s.globalShutdown)
+	}
+}
+
+// Drain causes the caller to block until all active gRPC calls have finished.
+func (s *Server) Drain() {
+	<-s.stopped
+	log.Debug().Str("module", "grpc").Str("phase", "shutdown").Msg("gRPC calls have drained")
+}
+
+// authorizeUnary rejects unary calls without the configured bearer token.
+func (s *Server) authorizeUnary(
+	ctx context.Context,
+	req interface{},
+	info *grpc.UnaryServerInfo,
+	handler grpc.UnaryHandler,
+) (interface{}, error) {
+	if err := s.authorize(ctx); err != nil {
+		return nil, err
+	}
+	return handler(ctx, req)
+}
+
+// authorizeStream rejects streaming calls without the configured bearer token.
+func (s *Server) authorizeStream(
+	srv interface{},
+	ss grpc.ServerStream,
+	info *grpc.StreamServerInfo,
+	handler grpc.StreamHandler,
+) error {
+	if err := s.authorize(ss.Context()); err != nil {
+		return err
+	}
+	return handler(srv, ss)
+}
+
+// authorize checks the authorization metadata of the call holds the configured bearer token.
+func (s *Server) authorize(ctx context.Context) error {
+	md, _ := metadata.FromIncomingContext(ctx)
+	for _, value := range md.Get("authorization") {
+		token := strings.TrimPrefix(value, "Bearer ")
+		if token != value &&
+			subtle.ConstantTimeCompare([]byte(token), []byte(s.config.Token)) == 1 {
+			return nil
+		}
+	}
+	return status.Error(codes.Unauthenticated, "valid bearer token required")
+}
@@ -0,0 +1,195 @@
+package grpc
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/inbucket/inbucket/pkg/config"
+	"github.com/inbucket/inbucket/pkg/policy"
+	"github.com/inbucket/inbucket/pkg/pubsub"
+	"github.com/inbucket/inbucket/pkg/storage"
+	"github.com/inbucket/inbucket/pkg/storage/mem"
+	"github.com/inbucket/inbucket/pkg/test"
+	inbucketv1 "github.com/inbucket/inbucket/proto/inbucket/v1"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+	"google.golang.org/grpc/test/bufconn"
+)
+
+// setupServer starts a Server on an in-memory listener, returning the store it serves, a client
+// connected to it, and a function to shut it down.
+func setupServer(
+	t *testing.T, conf config.GRPC,
+) (storage.Store, inbucketv1.MessageServiceClient, func()) {
+	t.Helper()
+	ms, err := mem.New(config.Storage{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	broker := pubsub.NewBroker()
+	store := pubsub.NewStore(ms, broker)
+	addrPolicy := &policy.Addressing{Config: &config.Root{MailboxNaming: config.LocalNaming}}
+	server := New(conf, make(chan bool), store, broker, addrPolicy)
+	listener := bufconn.Listen(1 << 20)
+	ctx, cancel := context.WithCancel(context.Background())
+	go server.serve(ctx, listener)
+	conn, err := grpc.DialContext(ctx, "bufnet",
+		grpc.WithContextDialer(func(ctx context.Context, _ string) (net.Conn, error) {
+			return listener.DialContext(ctx)
+		}),
+		grpc.WithTransportCredentials(insecure.NewCredentials()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return store, inbucketv1.NewMessageServiceClient(conn), func() {
+		_ = conn.Close()
+		cancel()
+		server.Drain()
+	}
+}
+
+// checkCode reports an error if err does not have the gRPC status code want.
+func checkCode(t *testing.T, method string, err error, want codes.Code) {
+	t.Helper()
+	if got := status.Code(err); got != want {
+		t.Errorf("%v got code %v, want: %v (%v)", method, got, want, err)
+	}
+}
+
+func TestMessageService(t *testing.T) {
+	store, client, teardown := setupServer(t, config.GRPC{})
+	defer teardown()
+	ctx := context.Background()
+	id1, _ := test.DeliverToStore(t, store, "alice", "first", time.Now())
+	id2, _ := test.DeliverToStore(t, store, "alice", "second", time.Now())
+
+	list, err := client.ListMessages(ctx, &inbucketv1.ListMessagesRequest{
+		Mailbox: "Alice@example.com"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(list.Messages) != 2 {
+		t.Fatalf("Got %v messages, want: 2", len(list.Messages))
+	}
+	if got := list.Messages[1]; got.Id != id2 || got.Subject != "second" || got.Mailbox != "alice" {
+		t.Errorf("Got message %v, want ID %v with subject second", got, id2)
+	}
+
+	get, err := client.GetMessage(ctx, &inbucketv1.GetMessageRequest{Mailbox: "alice", Id: id1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if get.Message.Subject != "first" || get.Message.Size != int64(len(get.Source)) ||
+		len(get.Source) == 0 {
+		t.Errorf("Got message %v with %v byte source, want first", get.Message, len(get.Source))
+	}
+	if get.Message.Date.AsTime().IsZero() {
+		t.Error("Got zero message date")
+	}
+	_, err = client.GetMessage(ctx, &inbucketv1.GetMessageRequest{Mailbox: "alice", Id: "nope"})
+	checkCode(t, "GetMessage", err, codes.NotFound)
+	_, err = client.ListMessages(ctx, &inbucketv1.ListMessagesRequest{Mailbox: "first last"})
+	checkCode(t, "ListMessages", err, codes.InvalidArgument)
+
+	_, err = client.DeleteMessage(ctx, &inbucketv1.DeleteMessageRequest{Mailbox: "alice", Id: id1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	test.GetAndCountMessages(t, store, "alice", 1)
+	_, err = client.PurgeMailbox(ctx, &inbucketv1.PurgeMailboxRequest{Mailbox: "alice"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	test.GetAndCountMessages(t, store, "alice", 0)
+}
+
+func TestWatchMailbox(t *testing.T) {
+	store, client, teardown := setupServer(t, config.GRPC{})
+	defer teardown()
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	stream, err := client.WatchMailbox(ctx, &inbucketv1.WatchMailboxRequest{Mailbox: "bob"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The subscription is registered asynchronously, deliver until the first event arrives.
+	events := make(chan *inbucketv1.WatchMailboxResponse)
+	go func() {
+		defer close(events)
+		for {
+			e, err := stream.Recv()
+			if err != nil {
+				return
+			}
+			select {
+			case events <- e:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+	var added *inbucketv1.WatchMailboxResponse
+	for added == nil {
+		test.DeliverToStore(t, store, "bob", "hello", time.Now())
+		select {
+		case added = <-events:
+		case <-time.After(50 * time.Millisecond):
+		case <-ctx.Done():
+			t.Fatal("Timed out waiting for added event")
+		}
+	}
+	want := inbucketv1.WatchMailboxResponse_EVENT_TYPE_MESSAGE_ADDED
+	if added.Type != want || added.Message.Subject != "hello" || added.Message.Mailbox != "bob" {
+		t.Errorf("Got event %v, want %v of hello", added, want)
+	}
+	if err := store.RemoveMessage(ctx, "bob", added.Message.Id); err != nil {
+		t.Fatal(err)
+	}
+	for e := range events {
+		if e.Type == inbucketv1.WatchMailboxResponse_EVENT_TYPE_MESSAGE_DELETED {
+			if e.Message.Id != added.Message.Id {
+				t.Errorf("Got deleted ID %v, want: %v", e.Message.Id, added.Message.Id)
+			}
+			return
+		}
+	}
+	t.Error("Stream ended without deleted event")
+}
+
+func TestAuthorization(t *testing.T) {
+	_, client, teardown := setupServer(t, config.GRPC{Token: "s3cret"})
+	defer teardown()
+	req := &inbucketv1.ListMessagesRequest{Mailbox: "carol"}
+	testCases := []struct {
+		auth string
+		want codes.Code
+	}{
+		{"", codes.Unauthenticated},
+		{"Bearer wrong", codes.Unauthenticated},
+		{"s3cret", codes.Unauthenticated},
+		{"Basic s3cret", codes.Unauthenticated},
+		{"Bearer s3cret", codes.OK},
+	}
+	for _, tc := range testCases {
+		ctx := context.Background()
+		if tc.auth != "" {
+			ctx = metadata.AppendToOutgoingContext(ctx, "authorization", tc.auth)
+		}
+		_, err := client.ListMessages(ctx, req)
+		checkCode(t, "ListMessages with "+tc.auth, err, tc.want)
+	}
+
+	// Streams are authorized before the handler runs.
+	stream, err := client.WatchMailbox(context.Background(),
+		&inbucketv1.WatchMailboxRequest{Mailbox: "carol"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = stream.Recv()
+	checkCode(t, "WatchMailbox", err, codes.Unauthenticated)
+}
@@ -0,0 +1,177 @@
+package grpc
+
+import (
+	"context"
+	"io/ioutil"
+
+	"github.com/inbucket/inbucket/pkg/pubsub"
+	"github.com/inbucket/inbucket/pkg/storage"
+	"github.com/inbucket/inbucket/pkg/stringutil"
+	inbucketv1 "github.com/inbucket/inbucket/proto/inbucket/v1"
+	"github.com/rs/zerolog/log"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/timestamppb"
+)
+
+// GetMessage returns the metadata and source of a message.
+func (s *Server) GetMessage(
+	ctx context.Context, req *inbucketv1.GetMessageRequest,
+) (*inbucketv1.GetMessageResponse, error) {
+	name, err := s.mailbox(req.Mailbox)
+	if err != nil {
+		return nil, err
+	}
+	m, err := s.store.GetMessage(ctx, name, req.Id)
+	if err == nil && m == nil {
+		err = storage.ErrNotExist
+	}
+	if err != nil {
+		return nil, storeError(err)
+	}
+	r, err := m.Source()
+	if err != nil {
+		return nil, storeError(err)
+	}
+	defer r.Close()
+	source, err := ioutil.ReadAll(r)
+	if err != nil {
+		return nil, storeError(err)
+	}
+	return &inbucketv1.GetMessageResponse{Message: makeMessage(m), Source: source}, nil
+}
+
+// ListMessages returns the metadata of the messages in a mailbox.
+func (s *Server) ListMessages(
+	ctx context.Context, req *inbucketv1.ListMessagesRequest,
+) (*inbucketv1.ListMessagesResponse, error) {
+	name, err := s.mailbox(req.Mailbox)
+	if err != nil {
+		return nil, err
+	}
+	messages, err := s.store.GetMessages(ctx, name)
+	if err != nil {
+		return nil, storeError(err)
+	}
+	resp := &inbucketv1.ListMessagesResponse{
+		Messages: make([]*inbucketv1.Message, len(messages)),
+	}
+	for i, m := range messages {
+		resp.Messages[i] = makeMessage(m)
+	}
+	return resp, nil
+}
+
+// DeleteMessage removes a message from a mailbox.
+func (s *Server) DeleteMessage(
+	ctx context.Context, req *inbucketv1.DeleteMessageRequest,
+) (*inbucketv1.DeleteMessageResponse, error) {
+	name, err := s.mailbox(req.Mailbox)
+	if err != nil {
+		return nil, err
+	}
+	if err := s.store.RemoveMessage(ctx, name, req.Id); err != nil {
+		return nil, storeError(err)
+	}
+	return &inbucketv1.DeleteMessageResponse{}, nil
+}
+
+// PurgeMailbox removes all messages from a mailbox.
+func (s *Server) PurgeMailbox(
+	ctx context.Context, req *inbucketv1.PurgeMailboxRequest,
+) (*inbucketv1.PurgeMailboxResponse, error) {
+	name, err := s.mailbox(req.Mailbox)
+	if err != nil {
+		return nil, err
+	}
+	if err := s.store.PurgeMessages(ctx, name); err != nil {
+		return nil, storeError(err)
+	}
+	return &inbucketv1.PurgeMailboxResponse{}, nil
+}
+
+// WatchMailbox streams the events published for a mailbox until the client cancels the call or
+// the server shuts down.
+func (s *Server) WatchMailbox(
+	req *inbucketv1.WatchMailboxRequest, stream inbucketv1.MessageService_WatchMailboxServer,
+) error {
+	name, err := s.mailbox(req.Mailbox)
+	if err != nil {
+		return err
+	}
+	slog := log.With().Str("module", "grpc").Str("mailbox", name).Logger()
+	slog.Debug().Msg("Opened mailbox watch")
+	sub := s.broker.Subscribe(name)
+	defer sub.Unsubscribe()
+	for {
+		select {
+		case <-stream.Context().Done():
+			slog.Debug().Msg("Client closed mailbox watch")
+			return nil
+		case <-s.stopping:
+			return status.Error(codes.Unavailable, "server shutting down")
+		case e := <-sub.C:
+			if err := stream.Send(makeEvent(e)); err != nil {
+				slog.Debug().Err(err).Msg("Mailbox watch send failed")
+				return err
+			}
+		}
+	}
+}
+
+// mailbox returns the name of the mailbox for address, an InvalidArgument error if it is not
+// valid.
+func (s *Server) mailbox(address string) (string, error) {
+	name, err := s.addrPolicy.ExtractMailbox(address)
+	if err != nil {
+		return "", status.Error(codes.InvalidArgument, err.Error())
+	}
+	return name, nil
+}
+
+// storeError converts an error returned by the store into a gRPC status error.
+func storeError(err error) error {
+	switch err {
+	case storage.ErrNotExist:
+		return status.Error(codes.NotFound, err.Error())
+	case context.Canceled:
+		return status.Error(codes.Canceled, err.Error())
+	case context.DeadlineExceeded:
+		return status.Error(codes.DeadlineExceeded, err.Error())
+	}
+	return status.Error(codes.Internal, err.Error())
+}
+
+// makeMessage converts a stored message into its gRPC representation.
+func makeMessage(m storage.Message) *inbucketv1.Message {
+	return &inbucketv1.Message{
+		Mailbox: m.Mailbox(),
+		Id:      m.ID(),
+		From:    stringutil.StringAddress(m.From()),
+		To:      stringutil.StringAddressList(m.To()),
+		Subject: m.Subject(),
+		Date:    timestamppb.New(m.Date()),
+		Size:    m.Size(),
+		Seen:    m.Seen(),
+		Tags:    m.Tags(),
+	}
+}
+
+// makeEvent converts a pubsub.Event into its gRPC representation.
+func makeEvent(e pubsub.Event) *inbucketv1.WatchMailboxResponse {
+	resp := &inbucketv1.WatchMailboxResponse{
+		Message: &inbucketv1.Message{Mailbox: e.Mailbox, Id: e.ID},
+	}
+	switch e.Type {
+	case pubsub.MessageAdded:
+		resp.Type = inbucketv1.WatchMailboxResponse_EVENT_TYPE_MESSAGE_ADDED
+		resp.Message.From = e.From
+		resp.Message.To = e.To
+		resp.Message.Subject = e.Subject
+		resp.Message.Date = timestamppb.New(e.Date)
+		resp.Message.Size = e.Size
+	case pubsub.MessageDeleted:
+		resp.Type = inbucketv1.WatchMailboxResponse_EVENT_TYPE_MESSAGE_DELETED
+	}
+	return resp
+}
@@ -0,0 +1,165 @@
+package imap
+
+import (
+	"context"
+	"errors"
+	"strings"
+
+	"github.com/emersion/go-imap"
+	"github.com/emersion/go-imap/backend"
+	"github.com/emersion/go-imap/commands"
+	imapserver "github.com/emersion/go-imap/server"
+	"github.com/rs/zerolog"
+	"github.com/rs/zerolog/log"
+)
+
+// errNotSupported is returned for commands which would change the mailbox hierarchy, or add
+// messages to a mailbox.
+var errNotSupported = errors.New("not supported by Inbucket")
+
+// storeBackend logs in IMAP users, any user name and password are accepted.
+type storeBackend struct {
+	*Server
+}
+
+// Login implements backend.Backend.
+func (b *storeBackend) Login(conn *imap.ConnInfo, username, password string) (backend.User,
+	error) {
+	if username == "" {
+		return nil, backend.ErrInvalidCredentials
+	}
+	logger := log.With().Str("module", "imap").Str("remote", conn.RemoteAddr.String()).
+		Str("user", username).Logger()
+	logger.Info().Msg("IMAP login")
+	ctx, cancel := context.WithCancel(context.Background())
+	return &user{Server: b.Server, name: username, ctx: ctx, cancel: cancel, logger: logger}, nil
+}
+
+// user is a logged in IMAP user, whose INBOX is the Inbucket mailbox of the same name.
+type user struct {
+	*Server
+	name   string             // Login name.
+	ctx    context.Context    // Canceled at logout.
+	cancel context.CancelFunc // Cancels ctx.
+	logger zerolog.Logger     // User specific logger.
+}
+
+// Username implements backend.User.
+func (u *user) Username() string {
+	return u.name
+}
+
+// ListMailboxes implements backend.User.  Only INBOX is listed, other Inbucket mailboxes may be
+// selected by name.
+func (u *user) ListMailboxes(subscribed bool) ([]backend.Mailbox, error) {
+	return []backend.Mailbox{u.mailbox(imap.InboxName)}, nil
+}
+
+// GetMailbox implements backend.User, loading the messages of the named mailbox.
+func (u *user) GetMailbox(name string) (backend.Mailbox, error) {
+	mbox := u.mailbox(name)
+	if mbox.mailbox == "" {
+		return nil, backend.ErrNoSuchMailbox
+	}
+	if err := mbox.load(); err != nil {
+		return nil, err
+	}
+	return mbox, nil
+}
+
+// mailbox returns the mailbox for an IMAP mailbox name; INBOX is the mailbox named by the login
+// user, other names select the Inbucket mailbox of the same name.
+func (u *user) mailbox(name string) *mailbox {
+	mbox := &mailbox{user: u, name: name, mailbox: name}
+	if strings.EqualFold(name, imap.InboxName) {
+		mbox.name = imap.InboxName
+		mbox.mailbox = u.name
+	}
+	return mbox
+}
+
+// CreateMailbox implements backend.User.
+func (u *user) CreateMailbox(name string) error {
+	return errNotSupported
+}
+
+// DeleteMailbox implements backend.User.
+func (u *user) DeleteMailbox(name string) error {
+	return errNotSupported
+}
+
+// RenameMailbox implements backend.User.
+func (u *user) RenameMailbox(existingName, newName string) error {
+	return errNotSupported
+}
+
+// Logout implements backend.User, it is also called when the connection is closed.
+func (u *user) Logout() error {
+	u.cancel()
+	u.logger.Info().Msg("IMAP logout")
+	return nil
+}
+
+// sessionExtension overrides the go-imap handlers of commands which depend on the state of the
+// session, as the backend interfaces do not expose it.
+type sessionExtension struct{}
+
+// Capabilities implements imapserver.Extension.
+func (sessionExtension) Capabilities(c imapserver.Conn) []string {
+	return nil
+}
+
+// Command implements imapserver.Extension.
+func (sessionExtension) Command(name string) imapserver.HandlerFactory {
+	switch name {
+	case "SELECT":
+		return func() imapserver.Handler { return &selectHandler{} }
+	case "EXAMINE":
+		return func() imapserver.Handler {
+			h := &selectHandler{}
+			h.ReadOnly = true
+			return h
+		}
+	case "NOOP":
+		return func() imapserver.Handler { return &pollHandler{} }
+	case "CHECK":
+		return func() imapserver.Handler { return &pollHandler{check: true} }
+	}
+	return nil
+}
+
+// selectHandler handles SELECT and EXAMINE, recording whether the mailbox was opened read-only,
+// in which case fetching a message must not set \Seen.
+type selectHandler struct {
+	imapserver.Select
+}
+
+// Handle implements imapserver.Handler.
+func (h *selectHandler) Handle(conn imapserver.Conn) error {
+	// A successful SELECT also returns an error, the status response.
+	err := h.Select.Handle(conn)
+	ctx := conn.Context()
+	if mbox, ok := ctx.Mailbox.(*mailbox); ok {
+		mbox.readOnly = ctx.MailboxReadOnly
+	}
+	return err
+}
+
+// pollHandler handles NOOP and CHECK, reporting messages added to or removed from the selected
+// mailbox since it was last loaded.
+type pollHandler struct {
+	commands.Noop      // Neither command has arguments.
+	check         bool // CHECK, which requires a selected mailbox.
+}
+
+// Handle implements imapserver.Handler.
+func (h *pollHandler) Handle(conn imapserver.Conn) error {
+	mbox, ok := conn.Context().Mailbox.(*mailbox)
+	if !ok {
+		if h.check {
+			return imapserver.ErrNoMailboxSelected
+		}
+		return nil
+	}
+	return mbox.poll(conn)
+}
@@ -0,0 +1,422 @@
+package imap
+
+import (
+	"context"
+	"io/ioutil"
+	"net"
+	"net/mail"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/emersion/go-imap"
+	"github.com/emersion/go-imap/client"
+	"github.com/inbucket/inbucket/pkg/config"
+	"github.com/inbucket/inbucket/pkg/message"
+	"github.com/inbucket/inbucket/pkg/storage"
+	"github.com/inbucket/inbucket/pkg/storage/mem"
+)
+
+// setupServer starts an IMAP server on a loopback port, returning its store and a client connected
+// to it.
+func setupServer(t *testing.T) (storage.Store, *client.Client) {
+	t.Helper()
+	store, err := mem.New(config.Storage{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := New(config.IMAP{Timeout: 30 * time.Minute}, make(chan bool), store)
+	server.listener, err = net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	server.wg.Add(1)
+	go server.serve(ctx)
+	c, err := client.Dial(server.listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		if c.State() != imap.LogoutState {
+			_ = c.Logout()
+		}
+		cancel()
+		_ = server.server.Close()
+		server.Drain()
+	})
+	return store, c
+}
+
+// addMessage adds a message with subject and body to the mailbox, returning its ID.
+func addMessage(t *testing.T, store storage.Store, mailbox, subject, body string) string {
+	t.Helper()
+	source := "From: Sender <sender@example.com>\r\nTo: rcpt@example.com\r\nSubject: " + subject +
+		"\r\n\r\n" + body + "\r\n"
+	id, err := store.AddMessage(context.Background(), &message.Delivery{
+		Meta: message.Metadata{
+			Mailbox: mailbox,
+			From:    &mail.Address{Name: "Sender", Address: "sender@example.com"},
+			To:      []*mail.Address{{Address: "rcpt@example.com"}},
+			Date:    time.Date(2020, 3, 4, 5, 6, 7, 0, time.UTC),
+			Subject: subject,
+			Size:    int64(len(source)),
+		},
+		Reader: strings.NewReader(source),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return id
+}
+
+// fetch fetches items of the messages in set, by UID if uid is true.
+func fetch(t *testing.T, c *client.Client, set string, uid bool,
+	items ...imap.FetchItem) []*imap.Message {
+	t.Helper()
+	seqSet, err := imap.ParseSeqSet(set)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ch := make(chan *imap.Message, 10)
+	if uid {
+		err = c.UidFetch(seqSet, items, ch)
+	} else {
+		err = c.Fetch(seqSet, items, ch)
+	}
+	if err != nil {
+		t.Fatalf("FETCH %v %v: %v", set, items, err)
+	}
+	var msgs []*imap.Message
+	for msg := range ch {
+		msgs = append(msgs, msg)
+	}
+	return msgs
+}
+
+// bodySection parses a FETCH body section item.
+func bodySection(t *testing.T, item string) *imap.BodySectionName {
+	t.Helper()
+	section, err := imap.ParseBodySectionName(imap.FetchItem(item))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return section
+}
+
+// bodyText returns the fetched content of section.
+func bodyText(t *testing.T, msg *imap.Message, section *imap.BodySectionName) string {
+	t.Helper()
+	r := msg.GetBody(section)
+	if r == nil {
+		t.Fatalf("Message %v has no %v section", msg.SeqNum, section.FetchItem())
+	}
+	b, err := ioutil.ReadAll(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(b)
+}
+
+// search searches the selected mailbox, by UID if uid is true.
+func search(t *testing.T, c *client.Client, criteria *imap.SearchCriteria, uid bool) []uint32 {
+	t.Helper()
+	var got []uint32
+	var err error
+	if uid {
+		got, err = c.UidSearch(criteria)
+	} else {
+		got, err = c.Search(criteria)
+	}
+	if err != nil {
+		t.Fatalf("SEARCH: %v", err)
+	}
+	return got
+}
+
+func TestLoginSelect(t *testing.T) {
+	store, c := setupServer(t)
+	addMessage(t, store, "james", "first", "Hello")
+
+	if err := c.Login("", "pass"); err == nil {
+		t.Error("LOGIN without a user name succeeded, want error")
+	}
+	if err := c.Login("james", "secret pass"); err != nil {
+		t.Fatal(err)
+	}
+	ch := make(chan *imap.MailboxInfo, 10)
+	if err := c.List("", "*", ch); err != nil {
+		t.Fatal(err)
+	}
+	var names []string
+	for info := range ch {
+		names = append(names, info.Name)
+	}
+	if !reflect.DeepEqual(names, []string{"INBOX"}) {
+		t.Errorf("LIST got %v, want: [INBOX]", names)
+	}
+	status, err := c.Status("INBOX",
+		[]imap.StatusItem{imap.StatusMessages, imap.StatusUnseen, imap.StatusUidNext})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if status.Messages != 1 || status.Unseen != 1 || status.UidNext != 2 {
+		t.Errorf("STATUS got MESSAGES %v UNSEEN %v UIDNEXT %v, want: 1 1 2", status.Messages,
+			status.Unseen, status.UidNext)
+	}
+
+	status, err = c.Select("INBOX", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if status.ReadOnly || status.Messages != 1 || status.UnseenSeqNum != 1 || status.UidNext != 2 {
+		t.Errorf("SELECT got read-only %v, EXISTS %v, UNSEEN %v, UIDNEXT %v, want: false 1 1 2",
+			status.ReadOnly, status.Messages, status.UnseenSeqNum, status.UidNext)
+	}
+
+	// Other mailboxes are selected by name.
+	status, err = c.Select("other", true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !status.ReadOnly || status.Messages != 0 {
+		t.Errorf("EXAMINE got read-only %v, EXISTS %v, want: true 0", status.ReadOnly,
+			status.Messages)
+	}
+	if err := c.Create("folder"); err == nil {
+		t.Error("CREATE succeeded, want error")
+	}
+	if err := c.Logout(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestFetch(t *testing.T) {
+	store, c := setupServer(t)
+	id := addMessage(t, store, "james", "first", "Hello James")
+	addMessage(t, store, "james", "second", "Goodbye")
+
+	if err := c.Login("james", "pass"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := c.Select("INBOX", false); err != nil {
+		t.Fatal(err)
+	}
+	subject := bodySection(t, "BODY.PEEK[HEADER.FIELDS (SUBJECT)]")
+	msgs := fetch(t, c, "1", false, imap.FetchUid, imap.FetchFlags, imap.FetchRFC822Size,
+		imap.FetchEnvelope, subject.FetchItem())
+	if len(msgs) != 1 {
+		t.Fatalf("FETCH got %v messages, want: 1", len(msgs))
+	}
+	msg := msgs[0]
+	if msg.Uid != 1 || msg.Size != 88 || len(msg.Flags) != 0 {
+		t.Errorf("FETCH got UID %v, RFC822.SIZE %v, FLAGS %v, want: 1 88 ()", msg.Uid, msg.Size,
+			msg.Flags)
+	}
+	env := msg.Envelope
+	if env == nil || env.Subject != "first" || len(env.From) != 1 ||
+		env.From[0].Address() != "sender@example.com" || len(env.To) != 1 ||
+		env.To[0].Address() != "rcpt@example.com" {
+		t.Errorf("FETCH got ENVELOPE %+v, want subject first, from sender, to rcpt", env)
+	}
+	if got := bodyText(t, msg, subject); got != "Subject: first\r\n\r\n" {
+		t.Errorf("FETCH got header %q, want: %q", got, "Subject: first\r\n\r\n")
+	}
+	msgs = fetch(t, c, "2:*", false, imap.FetchBodyStructure)
+	if len(msgs) != 1 || msgs[0].SeqNum != 2 || msgs[0].BodyStructure == nil ||
+		msgs[0].BodyStructure.MIMEType != "text" {
+		t.Errorf("FETCH 2:* BODYSTRUCTURE got %+v, want message 2 text/plain", msgs)
+	}
+
+	// Fetching the body sets \Seen.
+	text := bodySection(t, "BODY[TEXT]")
+	msgs = fetch(t, c, "1:*", true, text.FetchItem())
+	wantText := []string{"Hello James\r\n", "Goodbye\r\n"}
+	if len(msgs) != len(wantText) {
+		t.Fatalf("UID FETCH got %v messages, want: %v", len(msgs), len(wantText))
+	}
+	for i, msg := range msgs {
+		if got := bodyText(t, msg, text); got != wantText[i] {
+			t.Errorf("UID FETCH got text %q, want: %q", got, wantText[i])
+		}
+		if !reflect.DeepEqual(msg.Flags, []string{imap.SeenFlag}) {
+			t.Errorf("UID FETCH got flags %v, want: [\\Seen]", msg.Flags)
+		}
+	}
+	msg2, err := store.GetMessage(context.Background(), "james", id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !msg2.Seen() {
+		t.Error("Got unseen message after FETCH of body, want seen")
+	}
+
+	partial := bodySection(t, "BODY[]<0.7>")
+	msgs = fetch(t, c, "2", false, partial.FetchItem())
+	if got := bodyText(t, msgs[0], partial); got != "From: S" {
+		t.Errorf("FETCH partial got %q, want: %q", got, "From: S")
+	}
+
+	// A mailbox opened with EXAMINE is not changed by fetching.
+	third := addMessage(t, store, "james", "third", "Unread")
+	if _, err := c.Select("INBOX", true); err != nil {
+		t.Fatal(err)
+	}
+	fetch(t, c, "3", false, bodySection(t, "BODY[]").FetchItem())
+	msg3, err := store.GetMessage(context.Background(), "james", third)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if msg3.Seen() {
+		t.Error("Got seen message after FETCH in EXAMINE mailbox, want unseen")
+	}
+}
+
+func TestSearchStoreExpunge(t *testing.T) {
+	store, c := setupServer(t)
+	updates := make(chan client.Update, 10)
+	c.Updates = updates
+	addMessage(t, store, "james", "first", "Hello")
+	secondID := addMessage(t, store, "james", "second", "Your code is 1234")
+	addMessage(t, store, "james", "third", "Bye")
+
+	if err := c.Login("james", "pass"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := c.Select("INBOX", false); err != nil {
+		t.Fatal(err)
+	}
+	criteria := imap.NewSearchCriteria()
+	criteria.Body = []string{"code"}
+	if got := search(t, c, criteria, false); !reflect.DeepEqual(got, []uint32{2}) {
+		t.Errorf("SEARCH BODY got %v, want: [2]", got)
+	}
+	first, third := imap.NewSearchCriteria(), imap.NewSearchCriteria()
+	first.Header.Add("Subject", "first")
+	third.Header.Add("Subject", "third")
+	criteria = imap.NewSearchCriteria()
+	criteria.Or = [][2]*imap.SearchCriteria{{first, third}}
+	if got := search(t, c, criteria, true); !reflect.DeepEqual(got, []uint32{1, 3}) {
+		t.Errorf("UID SEARCH OR got %v, want: [1 3]", got)
+	}
+
+	seqSet, _ := imap.ParseSeqSet("1")
+	ch := make(chan *imap.Message, 10)
+	err := c.Store(seqSet, imap.FormatFlagsOp(imap.AddFlags, false),
+		[]interface{}{imap.SeenFlag}, ch)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if msg := <-ch; msg == nil || !reflect.DeepEqual(msg.Flags, []string{imap.SeenFlag}) {
+		t.Errorf("STORE got %+v, want flags [\\Seen]", msg)
+	}
+	criteria = imap.NewSearchCriteria()
+	criteria.WithoutFlags = []string{imap.SeenFlag}
+	if got := search(t, c, criteria, false); !reflect.DeepEqual(got, []uint32{2, 3}) {
+		t.Errorf("SEARCH UNSEEN got %v, want: [2 3]", got)
+	}
+	seqSet, _ = imap.ParseSeqSet("2")
+	err = c.UidStore(seqSet, imap.FormatFlagsOp(imap.AddFlags, true),
+		[]interface{}{imap.DeletedFlag}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expunged := make(chan uint32, 10)
+	if err := c.Expunge(expunged); err != nil {
+		t.Fatal(err)
+	}
+	if n := <-expunged; n != 2 {
+		t.Errorf("EXPUNGE got %v, want: 2", n)
+	}
+	stored, err := store.GetMessages(context.Background(), "james")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, m := range stored {
+		if m.ID() == secondID {
+			t.Error("Got expunged message in store, want it removed")
+		}
+	}
+	msgs := fetch(t, c, "1:*", false, imap.FetchUid, imap.FetchFlags)
+	if len(msgs) != 2 || msgs[0].Uid != 1 || msgs[1].Uid != 3 ||
+		!reflect.DeepEqual(msgs[0].Flags, []string{imap.SeenFlag}) || len(msgs[1].Flags) != 0 {
+		t.Errorf("FETCH after EXPUNGE got %+v, want UIDs 1 and 3, 1 seen", msgs)
+	}
+
+	// Messages added and removed by others are reported by NOOP, UIDs are not reused.
+	addMessage(t, store, "james", "fourth", "Again")
+	if err := c.Noop(); err != nil {
+		t.Fatal(err)
+	}
+	if n := c.Mailbox().Messages; n != 3 {
+		t.Errorf("NOOP got %v EXISTS, want: 3", n)
+	}
+	criteria = imap.NewSearchCriteria()
+	if got := search(t, c, criteria, true); !reflect.DeepEqual(got, []uint32{1, 3, 4}) {
+		t.Errorf("UID SEARCH ALL got %v, want: [1 3 4]", got)
+	}
+	if err := store.PurgeMessages(context.Background(), "james"); err != nil {
+		t.Fatal(err)
+	}
+	for len(updates) > 0 {
+		<-updates
+	}
+	if err := c.Noop(); err != nil {
+		t.Fatal(err)
+	}
+	var got []uint32
+	for len(updates) > 0 {
+		if u, ok := (<-updates).(*client.ExpungeUpdate); ok {
+			got = append(got, u.SeqNum)
+		}
+	}
+	if !reflect.DeepEqual(got, []uint32{3, 2, 1}) {
+		t.Errorf("NOOP after purge got EXPUNGE %v, want: [3 2 1]", got)
+	}
+
+	if _, err := c.Select("INBOX", true); err != nil {
+		t.Fatal(err)
+	}
+	seqSet, _ = imap.ParseSeqSet("1")
+	err = c.Store(seqSet, imap.FormatFlagsOp(imap.AddFlags, true),
+		[]interface{}{imap.DeletedFlag}, nil)
+	if err == nil {
+		t.Error("STORE on read-only mailbox succeeded, want error")
+	}
+}
+
+func TestContains(t *testing.T) {
+	mb := &mailbox{messages: []*mailboxMessage{{uid: 2}, {uid: 5}, {uid: 7}}}
+	testCases := []struct {
+		set  string
+		uid  bool
+		want []int // Indexes of the messages in set.
+	}{
+		{"1", false, []int{0}},
+		{"*", false, []int{2}},
+		{"2:*", false, []int{1, 2}},
+		{"*:2", false, []int{1, 2}},
+		{"3:1", false, []int{0, 1, 2}},
+		{"5", true, []int{1}},
+		{"*", true, []int{2}},
+		{"3:6", true, []int{1}},
+		{"1,7", true, []int{2}},
+	}
+	for _, tc := range testCases {
+		set, err := imap.ParseSeqSet(tc.set)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var got []int
+		for i := range mb.messages {
+			if mb.contains(set, i, tc.uid) {
+				got = append(got, i)
+			}
+		}
+		if !reflect.DeepEqual(got, tc.want) {
+			t.Errorf("%q (uid %v) got %v, want: %v", tc.set, tc.uid, got, tc.want)
+		}
+	}
+}
@@ -0,0 +1,155 @@
+package imap
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	imapserver "github.com/emersion/go-imap/server"
+	"github.com/inbucket/inbucket/pkg/config"
+	"github.com/inbucket/inbucket/pkg/storage"
+	"github.com/rs/zerolog/log"
+)
+
+// Server defines an instance of the IMAP server.
+type Server struct {
+	config         config.IMAP        // IMAP configuration.
+	store          storage.Store      // Mail store.
+	server         *imapserver.Server // go-imap server, which handles the IMAP protocol.
+	listener       net.Listener       // TCP listener.
+	globalShutdown chan bool          // Inbucket shutdown signal.
+	wg             *sync.WaitGroup    // Waitgroup tracking the serve go routine.
+	uidValidity    uint32             // UIDVALIDITY of every mailbox, the server start time.
+	uidsMu         sync.Mutex         // Guards uids.
+	uids           map[string]*uidMap
+}
+
+// uidMap holds the UIDs assigned to the messages of a mailbox.
+type uidMap struct {
+	next uint32            // UID of the next new message.
+	ids  map[string]uint32 // UIDs by message ID.
+}
+
+// New creates a new Server struct.
+func New(imapConfig config.IMAP, shutdownChan chan bool, store storage.Store) *Server {
+	s := &Server{
+		config:         imapConfig,
+		store:          store,
+		globalShutdown: shutdownChan,
+		wg:             new(sync.WaitGroup),
+		uidValidity:    uint32(time.Now().Unix()),
+		uids:           make(map[string]*uidMap),
+	}
+	s.server = imapserver.New(&storeBackend{s})
+	// Any user name and password are accepted, as with POP3, so there is nothing for TLS to
+	// protect.
+	s.server.AllowInsecureAuth = true
+	s.server.AutoLogout = imapConfig.Timeout
+	s.server.ErrorLog = errorLog{}
+	if imapConfig.Debug {
+		s.server.Debug = os.Stdout
+	}
+	s.server.Enable(sessionExtension{})
+	return s
+}
+
+// Start the server and listen for connections
+func (s *Server) Start(ctx context.Context) {
+	slog := log.With().Str("module", "imap").Str("phase", "startup").Logger()
+	addr, err := net.ResolveTCPAddr("tcp4", s.config.Addr)
+	if err != nil {
+		slog.Error().Err(err).Msg("Failed to build tcp4 address")
+		s.emergencyShutdown()
+		return
+	}
+	slog.Info().Str("addr", addr.String()).Msg("IMAP listening on tcp4")
+	s.listener, err = net.ListenTCP("tcp4", addr)
+	if err != nil {
+		slog.Error().Err(err).Msg("Failed to start tcp4 listener")
+		s.emergencyShutdown()
+		return
+	}
+	// Listener go routine.
+	s.wg.Add(1)
+	go s.serve(ctx)
+	// Wait for shutdown.
+	<-ctx.Done()
+	slog = log.With().Str("module", "imap").Str("phase", "shutdown").Logger()
+	slog.Debug().Msg("IMAP shutdown requested, connections will be closed")
+	// IMAP clients stay connected while idle, so connections are closed rather than drained.
+	// Closing the listener will cause the serve() go routine to exit.
+	if err := s.server.Close(); err != nil {
+		slog.Error().Err(err).Msg("Failed to close IMAP server")
+	}
+}
+
+// serve accepts connections until the listener is closed, it must be added to wg by the caller.
+func (s *Server) serve(ctx context.Context) {
+	defer s.wg.Done()
+	err := s.server.Serve(s.listener)
+	select {
+	case <-ctx.Done():
+		// IMAP is shutting down.
+	default:
+		// Something went wrong.
+		log.Error().Str("module", "imap").Err(err).Msg("IMAP accept failed")
+		s.emergencyShutdown()
+	}
+}
+
+// assignUIDs returns the UIDs of messages, which must be in mailbox order, assigning new UIDs to
+// messages seen for the first time.  UIDs of messages no longer in the mailbox are forgotten, the
+// next UID is retained so that UIDs are never reused.
+func (s *Server) assignUIDs(mailbox string, messages []storage.Message) (uids []uint32,
+	next uint32) {
+	s.uidsMu.Lock()
+	defer s.uidsMu.Unlock()
+	m := s.uids[mailbox]
+	if m == nil {
+		m = &uidMap{next: 1}
+		s.uids[mailbox] = m
+	}
+	ids := make(map[string]uint32, len(messages))
+	uids = make([]uint32, len(messages))
+	for i, msg := range messages {
+		uid, ok := m.ids[msg.ID()]
+		if !ok {
+			uid = m.next
+			m.next++
+		}
+		ids[msg.ID()] = uid
+		uids[i] = uid
+	}
+	m.ids = ids
+	return uids, m.next
+}
+
+func (s *Server) emergencyShutdown() {
+	// Shutdown Inbucket
+	select {
+	case <-s.globalShutdown:
+	default:
+		close(s.globalShutdown)
+	}
+}
+
+// Drain causes the caller to block until the IMAP server has stopped accepting connections.
+func (s *Server) Drain() {
+	s.wg.Wait()
+	log.Debug().Str("module", "imap").Str("phase", "shutdown").Msg("IMAP connections have drained")
+}
+
+// errorLog writes the errors of the go-imap server to the Inbucket log.
+type errorLog struct{}
+
+func (errorLog) Printf(format string, v ...interface{}) {
+	log.Warn().Str("module", "imap").Msgf(format, v...)
+}
+
+func (errorLog) Println(v ...interface{}) {
+	log.Warn().Str("module", "imap").Msg(strings.TrimSuffix(fmt.Sprintln(v...), "\n"))
+}
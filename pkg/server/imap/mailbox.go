@@ -0,0 +1,389 @@
+package imap
+
+import (
+	"bufio"
+	"bytes"
+	"io/ioutil"
+	"time"
+
+	"github.com/emersion/go-imap"
+	"github.com/emersion/go-imap/backend/backendutil"
+	"github.com/emersion/go-imap/responses"
+	imapserver "github.com/emersion/go-imap/server"
+	"github.com/emersion/go-message"
+	"github.com/emersion/go-message/textproto"
+	"github.com/inbucket/inbucket/pkg/storage"
+)
+
+// permanentFlags are the flags which may be changed by STORE, \Seen is saved in the store while
+// \Deleted lasts until the mailbox is expunged or closed.
+var permanentFlags = []string{imap.SeenFlag, imap.DeletedFlag}
+
+// mailbox is an IMAP mailbox opened by a session.  It holds the session's view of the Inbucket
+// mailbox, which is only updated by the session's own commands, and when polled by NOOP or CHECK.
+type mailbox struct {
+	*user
+	name     string            // IMAP mailbox name.
+	mailbox  string            // Inbucket mailbox name.
+	readOnly bool              // Mailbox was opened with EXAMINE.
+	messages []*mailboxMessage // Messages in sequence number order.
+	uidNext  uint32            // UID of the next message added to the mailbox.
+}
+
+// mailboxMessage is a message in an opened mailbox.
+type mailboxMessage struct {
+	storage.Message
+	uid     uint32 // IMAP UID.
+	seen    bool   // \Seen flag.
+	deleted bool   // \Deleted flag, the message is removed by EXPUNGE.
+}
+
+// flags returns the IMAP flags of the message.
+func (m *mailboxMessage) flags() []string {
+	flags := []string{}
+	if m.seen {
+		flags = append(flags, imap.SeenFlag)
+	}
+	if m.deleted {
+		flags = append(flags, imap.DeletedFlag)
+	}
+	return flags
+}
+
+// source returns the raw content of the message.
+func (m *mailboxMessage) source() ([]byte, error) {
+	r, err := m.Source()
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+	return ioutil.ReadAll(r)
+}
+
+// Name implements backend.Mailbox.
+func (mb *mailbox) Name() string {
+	return mb.name
+}
+
+// Info implements backend.Mailbox, Inbucket mailboxes are flat.
+func (mb *mailbox) Info() (*imap.MailboxInfo, error) {
+	return &imap.MailboxInfo{
+		Attributes: []string{imap.HasNoChildrenAttr},
+		Delimiter:  "/",
+		Name:       mb.name,
+	}, nil
+}
+
+// load reads the messages of the mailbox from the store.
+func (mb *mailbox) load() error {
+	msgs, err := mb.store.GetMessages(mb.ctx, mb.mailbox)
+	if err != nil {
+		mb.logger.Error().Str("mailbox", mb.mailbox).Err(err).Msg("Failed to load messages")
+		return err
+	}
+	uids, next := mb.assignUIDs(mb.mailbox, msgs)
+	mb.uidNext = next
+	mb.messages = make([]*mailboxMessage, len(msgs))
+	for i, msg := range msgs {
+		mb.messages[i] = &mailboxMessage{Message: msg, uid: uids[i], seen: msg.Seen()}
+	}
+	return nil
+}
+
+// poll reloads the mailbox, reporting messages removed or added by other clients to conn.
+func (mb *mailbox) poll(conn imapserver.Conn) error {
+	msgs, err := mb.store.GetMessages(mb.ctx, mb.mailbox)
+	if err != nil {
+		mb.logger.Error().Str("mailbox", mb.mailbox).Err(err).Msg("Failed to load messages")
+		return err
+	}
+	uids, next := mb.assignUIDs(mb.mailbox, msgs)
+	mb.uidNext = next
+	present := make(map[string]bool, len(msgs))
+	for _, msg := range msgs {
+		present[msg.ID()] = true
+	}
+	// Report removed messages from the highest sequence number down, so that the sequence numbers
+	// of the remaining messages do not change between responses.
+	expunged := make(chan uint32, len(mb.messages))
+	known := make(map[string]bool, len(mb.messages))
+	for i := len(mb.messages) - 1; i >= 0; i-- {
+		if present[mb.messages[i].ID()] {
+			known[mb.messages[i].ID()] = true
+			continue
+		}
+		expunged <- uint32(i + 1)
+		mb.messages = append(mb.messages[:i], mb.messages[i+1:]...)
+	}
+	close(expunged)
+	if err := conn.WriteResp(&responses.Expunge{SeqNums: expunged}); err != nil {
+		return err
+	}
+	added := false
+	for i, msg := range msgs {
+		if !known[msg.ID()] {
+			mb.messages = append(mb.messages,
+				&mailboxMessage{Message: msg, uid: uids[i], seen: msg.Seen()})
+			added = true
+		}
+	}
+	if !added {
+		return nil
+	}
+	status := imap.NewMailboxStatus(mb.name, []imap.StatusItem{imap.StatusMessages})
+	status.Messages = uint32(len(mb.messages))
+	return conn.WriteResp(&responses.Select{Mailbox: status})
+}
+
+// Status implements backend.Mailbox.
+func (mb *mailbox) Status(items []imap.StatusItem) (*imap.MailboxStatus, error) {
+	status := imap.NewMailboxStatus(mb.name, items)
+	status.Flags = permanentFlags
+	status.PermanentFlags = permanentFlags
+	var unseen uint32
+	for i, m := range mb.messages {
+		if !m.seen {
+			if unseen == 0 {
+				status.UnseenSeqNum = uint32(i + 1)
+			}
+			unseen++
+		}
+	}
+	for _, item := range items {
+		switch item {
+		case imap.StatusMessages:
+			status.Messages = uint32(len(mb.messages))
+		case imap.StatusRecent:
+			status.Recent = 0
+		case imap.StatusUidNext:
+			status.UidNext = mb.uidNext
+		case imap.StatusUidValidity:
+			status.UidValidity = mb.uidValidity
+		case imap.StatusUnseen:
+			status.Unseen = unseen
+		}
+	}
+	return status, nil
+}
+
+// SetSubscribed implements backend.Mailbox.
+func (mb *mailbox) SetSubscribed(subscribed bool) error {
+	return errNotSupported
+}
+
+// Check implements backend.Mailbox, CHECK is handled by pollHandler.
+func (mb *mailbox) Check() error {
+	return nil
+}
+
+// ListMessages implements backend.Mailbox.
+func (mb *mailbox) ListMessages(uid bool, seqSet *imap.SeqSet, items []imap.FetchItem,
+	ch chan<- *imap.Message) error {
+	defer close(ch)
+	for i, m := range mb.messages {
+		if !mb.contains(seqSet, i, uid) {
+			continue
+		}
+		fetched, err := mb.fetch(uint32(i+1), m, items)
+		if err != nil {
+			return err
+		}
+		ch <- fetched
+	}
+	return nil
+}
+
+// fetch returns the requested items of message m.  Fetching a body section, other than with
+// BODY.PEEK, sets the \Seen flag, which is then included in the response.
+func (mb *mailbox) fetch(seqNum uint32, m *mailboxMessage, items []imap.FetchItem) (*imap.Message,
+	error) {
+	fetched := imap.NewMessage(seqNum, items)
+	var source []byte
+	// parse returns the header and body of the message, reading it on first use.
+	parse := func() (textproto.Header, *bufio.Reader, error) {
+		if source == nil {
+			var err error
+			if source, err = m.source(); err != nil {
+				mb.logger.Error().Str("id", m.ID()).Err(err).Msg("Failed to read message")
+				return textproto.Header{}, nil, err
+			}
+		}
+		body := bufio.NewReader(bytes.NewReader(source))
+		header, err := textproto.ReadHeader(body)
+		return header, body, err
+	}
+	for _, item := range items {
+		switch item {
+		case imap.FetchEnvelope:
+			header, _, err := parse()
+			if err != nil {
+				return nil, err
+			}
+			fetched.Envelope, _ = backendutil.FetchEnvelope(header)
+		case imap.FetchBody, imap.FetchBodyStructure:
+			header, body, err := parse()
+			if err != nil {
+				return nil, err
+			}
+			fetched.BodyStructure, _ = backendutil.FetchBodyStructure(header, body,
+				item == imap.FetchBodyStructure)
+		case imap.FetchFlags:
+			// Added last, as reading the body may set \Seen.
+		case imap.FetchInternalDate:
+			fetched.InternalDate = storage.ReceivedAt(m.Message)
+		case imap.FetchRFC822Size:
+			fetched.Size = uint32(m.Size())
+		case imap.FetchUid:
+			fetched.Uid = m.uid
+		default:
+			section, err := imap.ParseBodySectionName(item)
+			if err != nil {
+				return nil, err
+			}
+			header, body, err := parse()
+			if err != nil {
+				return nil, err
+			}
+			// A section which does not exist is returned empty.
+			fetched.Body[section], _ = backendutil.FetchBodySection(header, body, section)
+			if !section.Peek && !m.seen && !mb.readOnly {
+				if err := mb.setSeen(m, true); err != nil {
+					return nil, err
+				}
+				fetched.Items[imap.FetchFlags] = nil
+			}
+		}
+	}
+	if _, ok := fetched.Items[imap.FetchFlags]; ok {
+		fetched.Flags = m.flags()
+	}
+	return fetched, nil
+}
+
+// SearchMessages implements backend.Mailbox.
+func (mb *mailbox) SearchMessages(uid bool, criteria *imap.SearchCriteria) ([]uint32, error) {
+	var ids []uint32
+	for i, m := range mb.messages {
+		source, err := m.source()
+		if err != nil {
+			mb.logger.Error().Str("id", m.ID()).Err(err).Msg("Failed to read message")
+			return nil, err
+		}
+		// Messages in unknown charsets are still matched by their headers.
+		entity, err := message.Read(bytes.NewReader(source))
+		if err != nil && !message.IsUnknownCharset(err) {
+			continue
+		}
+		ok, err := backendutil.Match(entity, uint32(i+1), m.uid, storage.ReceivedAt(m.Message),
+			m.flags(), criteria)
+		if err == nil && ok {
+			ids = append(ids, mb.number(i, uid))
+		}
+	}
+	return ids, nil
+}
+
+// CreateMessage implements backend.Mailbox, APPEND is not supported.
+func (mb *mailbox) CreateMessage(flags []string, date time.Time, body imap.Literal) error {
+	return errNotSupported
+}
+
+// UpdateMessagesFlags implements backend.Mailbox, changing the \Seen and \Deleted flags of
+// messages, other flags are ignored.
+func (mb *mailbox) UpdateMessagesFlags(uid bool, seqSet *imap.SeqSet, op imap.FlagsOp,
+	flags []string) error {
+	for i, m := range mb.messages {
+		if !mb.contains(seqSet, i, uid) {
+			continue
+		}
+		var seen, deleted bool
+		for _, flag := range backendutil.UpdateFlags(m.flags(), op, flags) {
+			switch flag {
+			case imap.SeenFlag:
+				seen = true
+			case imap.DeletedFlag:
+				deleted = true
+			}
+		}
+		if seen != m.seen {
+			if err := mb.setSeen(m, seen); err != nil {
+				return err
+			}
+		}
+		m.deleted = deleted
+	}
+	return nil
+}
+
+// CopyMessages implements backend.Mailbox, COPY is not supported.
+func (mb *mailbox) CopyMessages(uid bool, seqSet *imap.SeqSet, dest string) error {
+	return errNotSupported
+}
+
+// Expunge implements backend.Mailbox, removing messages with the \Deleted flag from the store.
+func (mb *mailbox) Expunge() error {
+	kept := make([]*mailboxMessage, 0, len(mb.messages))
+	for _, m := range mb.messages {
+		if !m.deleted {
+			kept = append(kept, m)
+			continue
+		}
+		mb.logger.Debug().Str("mailbox", mb.mailbox).Str("id", m.ID()).Msg("Deleting message")
+		err := mb.store.RemoveMessage(mb.ctx, mb.mailbox, m.ID())
+		if err != nil && err != storage.ErrNotExist {
+			// The message has already been reported as expunged, it will be reported again as a
+			// new message when the mailbox is next polled.
+			mb.logger.Warn().Str("mailbox", mb.mailbox).Str("id", m.ID()).Err(err).
+				Msg("Error deleting message")
+		}
+	}
+	mb.messages = kept
+	return nil
+}
+
+// setSeen updates the \Seen flag of the message in the store.
+func (mb *mailbox) setSeen(m *mailboxMessage, seen bool) error {
+	var err error
+	if seen {
+		err = mb.store.MarkSeen(mb.ctx, mb.mailbox, m.ID())
+	} else {
+		err = mb.store.MarkUnseen(mb.ctx, mb.mailbox, m.ID())
+	}
+	if err != nil {
+		mb.logger.Error().Str("mailbox", mb.mailbox).Str("id", m.ID()).Err(err).
+			Msg("Failed to update seen flag")
+		return err
+	}
+	m.seen = seen
+	return nil
+}
+
+// number returns the UID of the message at index i if uid is true, otherwise its sequence number.
+func (mb *mailbox) number(i int, uid bool) uint32 {
+	if uid {
+		return mb.messages[i].uid
+	}
+	return uint32(i + 1)
+}
+
+// contains reports whether set contains the message at index i.  The go-imap SeqSet does not know
+// the value of *, the largest number in the mailbox.
+func (mb *mailbox) contains(set *imap.SeqSet, i int, uid bool) bool {
+	n, star := mb.number(i, uid), mb.number(len(mb.messages)-1, uid)
+	for _, seq := range set.Set {
+		start, stop := seq.Start, seq.Stop
+		if start == 0 {
+			start = star
+		}
+		if stop == 0 {
+			stop = star
+		}
+		if start > stop {
+			start, stop = stop, start
+		}
+		if start <= n && n <= stop {
+			return true
+		}
+	}
+	return false
+}
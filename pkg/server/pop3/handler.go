@@ -2,6 +2,7 @@ package pop3
 
 import (
 	"bufio"
+	"context"
 	"fmt"
 	"io"
 	"net"
@@ -57,28 +58,33 @@ var commands = map[string]bool{
 
 // Session defines an active POP3 session
 type Session struct {
-	*Server                      // Reference to the server we belong to.
-	id         int               // Session ID number.
-	conn       net.Conn          // Our network connection.
-	remoteHost string            // IP address of client.
-	sendError  error             // Used to bail out of read loop on send error.
-	state      State             // Current session state.
-	reader     *bufio.Reader     // Buffered reader for our net conn.
-	user       string            // Mailbox name.
-	messages   []storage.Message // Slice of messages in mailbox.
-	retain     []bool            // Messages to retain upon UPDATE (true=retain).
-	msgCount   int               // Number of undeleted messages.
-	logger     zerolog.Logger    // Session specific logger.
-	debug      bool              // Print network traffic to stdout.
+	*Server                       // Reference to the server we belong to.
+	id         int                // Session ID number.
+	ctx        context.Context    // Canceled when the session ends.
+	cancel     context.CancelFunc // Cancels ctx.
+	conn       net.Conn           // Our network connection.
+	remoteHost string             // IP address of client.
+	sendError  error              // Used to bail out of read loop on send error.
+	state      State              // Current session state.
+	reader     *bufio.Reader      // Buffered reader for our net conn.
+	user       string             // Mailbox name.
+	messages   []storage.Message  // Slice of messages in mailbox.
+	retain     []bool             // Messages to retain upon UPDATE (true=retain).
+	msgCount   int                // Number of undeleted messages.
+	logger     zerolog.Logger     // Session specific logger.
+	debug      bool               // Print network traffic to stdout.
 }
 
 // NewSession creates a new POP3 session
 func NewSession(server *Server, id int, conn net.Conn, logger zerolog.Logger) *Session {
 	reader := bufio.NewReader(conn)
 	host, _, _ := net.SplitHostPort(conn.RemoteAddr().String())
+	ctx, cancel := context.WithCancel(context.Background())
 	return &Session{
 		Server:     server,
 		id:         id,
+		ctx:        ctx,
+		cancel:     cancel,
 		conn:       conn,
 		state:      AUTHORIZATION,
 		reader:     reader,
@@ -111,6 +117,7 @@ func (s *Server) startSession(id int, conn net.Conn) {
 	}()
 
 	ssn := NewSession(s, id, conn, logger)
+	defer ssn.cancel()
 	ssn.send(fmt.Sprintf("+OK Inbucket POP3 server ready <%v.%v@%v>", os.Getpid(),
 		time.Now().Unix(), s.config.Domain))
 
@@ -370,6 +377,11 @@ func (s *Session) transactionHandler(cmd string, args []string) {
 			s.send("-ERR RETR argument must not exceed the number of messages")
 			return
 		}
+		if !s.retain[msgNum-1] {
+			s.logger.Warn().Msgf("Client tried to RETR a message it had deleted")
+			s.send(fmt.Sprintf("-ERR You deleted message %v", msgNum))
+			return
+		}
 		s.send(fmt.Sprintf("+OK %v bytes follows", s.messages[msgNum-1].Size()))
 		s.sendMessage(s.messages[msgNum-1])
 	case "TOP":
@@ -394,6 +406,11 @@ func (s *Session) transactionHandler(cmd string, args []string) {
 			s.send("-ERR TOP first argument must not exceed the number of messages")
 			return
 		}
+		if !s.retain[msgNum-1] {
+			s.logger.Warn().Msgf("Client tried to TOP a message it had deleted")
+			s.send(fmt.Sprintf("-ERR You deleted message %v", msgNum))
+			return
+		}
 
 		var lines int64
 		lines, err = strconv.ParseInt(args[1], 10, 32)
@@ -508,7 +525,7 @@ func (s *Session) sendMessageTop(msg storage.Message, lineCount int) {
 // Load the users mailbox
 func (s *Session) loadMailbox() {
 	s.logger = s.logger.With().Str("mailbox", s.user).Logger()
-	m, err := s.store.GetMessages(s.user)
+	m, err := s.store.GetMessages(s.ctx, s.user)
 	if err != nil {
 		s.logger.Error().Msgf("Failed to load messages for %v: %v", s.user, err)
 	}
@@ -534,7 +551,7 @@ func (s *Session) processDeletes() {
 	for i, msg := range s.messages {
 		if !s.retain[i] {
 			s.logger.Debug().Str("id", msg.ID()).Msg("Deleting message")
-			if err := s.store.RemoveMessage(s.user, msg.ID()); err != nil {
+			if err := s.store.RemoveMessage(s.ctx, s.user, msg.ID()); err != nil {
 				s.logger.Warn().Str("id", msg.ID()).Err(err).Msg("Error deleting message")
 			}
 		}
@@ -0,0 +1,172 @@
+package pop3
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"net"
+	"net/mail"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/inbucket/inbucket/pkg/config"
+	"github.com/inbucket/inbucket/pkg/message"
+	"github.com/inbucket/inbucket/pkg/storage"
+	"github.com/inbucket/inbucket/pkg/storage/mem"
+)
+
+// client is a minimal POP3 client for testing.
+type client struct {
+	t    *testing.T
+	conn net.Conn
+	r    *bufio.Reader
+}
+
+// readLine reads a response line, without its line ending.
+func (c *client) readLine() string {
+	c.t.Helper()
+	line, err := c.r.ReadString('\n')
+	if err != nil {
+		c.t.Fatalf("Reading response: %v", err)
+	}
+	return strings.TrimRight(line, "\r\n")
+}
+
+// cmd sends a command, and returns the first line of its response.
+func (c *client) cmd(format string, args ...interface{}) string {
+	c.t.Helper()
+	if _, err := fmt.Fprintf(c.conn, format+"\r\n", args...); err != nil {
+		c.t.Fatal(err)
+	}
+	return c.readLine()
+}
+
+// mustCmd sends a command, failing the test unless the response starts with want.
+func (c *client) mustCmd(want, format string, args ...interface{}) string {
+	c.t.Helper()
+	resp := c.cmd(format, args...)
+	if !strings.HasPrefix(resp, want) {
+		c.t.Fatalf("%v got %q, want: %q", fmt.Sprintf(format, args...), resp, want)
+	}
+	return resp
+}
+
+// readMultiline reads the lines of a multi-line response, up to the terminating dot.
+func (c *client) readMultiline() []string {
+	c.t.Helper()
+	var lines []string
+	for {
+		line := c.readLine()
+		if line == "." {
+			return lines
+		}
+		lines = append(lines, line)
+	}
+}
+
+// setupServer starts a POP3 server on a loopback port, returning its store and a client connected
+// to it.
+func setupServer(t *testing.T) (storage.Store, *client) {
+	t.Helper()
+	store, err := mem.New(config.Storage{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	conf := config.POP3{Domain: "inbucket", Timeout: 10 * time.Second}
+	server := New(conf, make(chan bool), store)
+	server.listener, err = net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	go server.serve(ctx)
+	conn, err := net.Dial("tcp", server.listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		_ = conn.Close()
+		cancel()
+		_ = server.listener.Close()
+		server.Drain()
+	})
+	c := &client{t: t, conn: conn, r: bufio.NewReader(conn)}
+	if greeting := c.readLine(); !strings.HasPrefix(greeting, "+OK") {
+		t.Fatalf("Got greeting %q, want: +OK", greeting)
+	}
+	return store, c
+}
+
+// addMessage adds a message with subject and body to the mailbox.
+func addMessage(t *testing.T, store storage.Store, mailbox, subject, body string) {
+	t.Helper()
+	source := "From: sender@example.com\r\nSubject: " + subject + "\r\n\r\n" + body + "\r\n"
+	_, err := store.AddMessage(context.Background(), &message.Delivery{
+		Meta: message.Metadata{
+			Mailbox: mailbox,
+			From:    &mail.Address{Address: "sender@example.com"},
+			Date:    time.Now(),
+			Subject: subject,
+			Size:    int64(len(source)),
+		},
+		Reader: strings.NewReader(source),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestSession(t *testing.T) {
+	store, c := setupServer(t)
+	addMessage(t, store, "james", "first", "Hello\r\n.hidden line")
+	addMessage(t, store, "james", "second", "Goodbye")
+
+	c.mustCmd("-ERR", "STAT")
+	c.mustCmd("+OK", "USER james")
+	c.mustCmd("+OK Found 2 messages for james", "PASS secret")
+	c.mustCmd("+OK 2 119", "STAT")
+	c.mustCmd("+OK", "LIST")
+	if got := c.readMultiline(); strings.Join(got, ",") != "1 65,2 54" {
+		t.Errorf("LIST got %q, want: 1 65,2 54", got)
+	}
+
+	// RETR sends the message source, dot-stuffing lines starting with a dot.
+	c.mustCmd("+OK 65 bytes", "RETR 1")
+	want := []string{"From: sender@example.com", "Subject: first", "", "Hello", "..hidden line"}
+	if got := c.readMultiline(); strings.Join(got, "\n") != strings.Join(want, "\n") {
+		t.Errorf("RETR got %q, want: %q", got, want)
+	}
+	c.mustCmd("+OK", "TOP 2 0")
+	want = []string{"From: sender@example.com", "Subject: second", ""}
+	if got := c.readMultiline(); strings.Join(got, "\n") != strings.Join(want, "\n") {
+		t.Errorf("TOP got %q, want: %q", got, want)
+	}
+
+	// Deleted messages are hidden until RSET, and removed by QUIT.
+	c.mustCmd("+OK", "DELE 1")
+	c.mustCmd("-ERR", "RETR 1")
+	c.mustCmd("-ERR", "DELE 1")
+	c.mustCmd("+OK 1 54", "STAT")
+	c.mustCmd("+OK", "RSET")
+	c.mustCmd("+OK 2 119", "STAT")
+	c.mustCmd("+OK", "DELE 2")
+	msgs, err := store.GetMessages(context.Background(), "james")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(msgs) != 2 {
+		t.Errorf("Got %v messages before QUIT, want: 2", len(msgs))
+	}
+	c.mustCmd("+OK", "QUIT")
+	if _, err := c.r.ReadString('\n'); err == nil {
+		t.Error("Got nil error reading after QUIT, want connection closed")
+	}
+	msgs, err = store.GetMessages(context.Background(), "james")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(msgs) != 1 || msgs[0].Subject() != "first" {
+		t.Errorf("Got %v messages after QUIT, want: first", len(msgs))
+	}
+}
@@ -0,0 +1,102 @@
+package smtp
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"fmt"
+	"math/big"
+	"net"
+	"os"
+	"time"
+)
+
+const (
+	// Size of generated RSA keys.
+	certKeyBits = 2048
+
+	// Validity period of generated certificates.
+	certValidFor = 10 * 365 * 24 * time.Hour
+)
+
+// ensureCertificate generates a self-signed certificate for domain, writing it to certFile and
+// keyFile, if neither file exists.  Returns true if a certificate was generated.
+func ensureCertificate(certFile, keyFile, domain string) (generated bool, err error) {
+	_, certErr := os.Stat(certFile)
+	_, keyErr := os.Stat(keyFile)
+	if certErr == nil && keyErr == nil {
+		return false, nil
+	}
+	if !os.IsNotExist(certErr) || !os.IsNotExist(keyErr) {
+		// Don't replace a partial or unreadable key pair.
+		if certErr == nil {
+			return false, keyErr
+		}
+		return false, certErr
+	}
+	certPEM, keyPEM, err := generateCertificate(domain, time.Now())
+	if err != nil {
+		return false, err
+	}
+	if err := writeFile(keyFile, keyPEM, 0600); err != nil {
+		return false, err
+	}
+	if err := writeFile(certFile, certPEM, 0644); err != nil {
+		_ = os.Remove(keyFile)
+		return false, err
+	}
+	return true, nil
+}
+
+// generateCertificate creates a PEM encoded self-signed certificate and RSA private key for
+// domain, valid from now.
+func generateCertificate(domain string, now time.Time) (certPEM, keyPEM []byte, err error) {
+	key, err := rsa.GenerateKey(rand.Reader, certKeyBits)
+	if err != nil {
+		return nil, nil, err
+	}
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		return nil, nil, err
+	}
+	template := &x509.Certificate{
+		SerialNumber:          serial,
+		Subject:               pkix.Name{CommonName: domain, Organization: []string{"Inbucket"}},
+		NotBefore:             now.Add(-time.Hour),
+		NotAfter:              now.Add(certValidFor),
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageKeyEncipherment,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		BasicConstraintsValid: true,
+	}
+	if ip := net.ParseIP(domain); ip != nil {
+		template.IPAddresses = []net.IP{ip}
+	} else {
+		template.DNSNames = []string{domain}
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to create certificate: %v", err)
+	}
+	certPEM = pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})
+	keyPEM = pem.EncodeToMemory(&pem.Block{
+		Type:  "RSA PRIVATE KEY",
+		Bytes: x509.MarshalPKCS1PrivateKey(key),
+	})
+	return certPEM, keyPEM, nil
+}
+
+// writeFile creates the named file, failing if it already exists.
+func writeFile(name string, data []byte, perm os.FileMode) error {
+	f, err := os.OpenFile(name, os.O_WRONLY|os.O_CREATE|os.O_EXCL, perm)
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(data); err != nil {
+		_ = f.Close()
+		_ = os.Remove(name)
+		return err
+	}
+	return f.Close()
+}
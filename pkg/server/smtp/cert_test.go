@@ -0,0 +1,79 @@
+package smtp
+
+import (
+	"bytes"
+	"crypto/rsa"
+	"crypto/tls"
+	"crypto/x509"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"runtime"
+	"testing"
+	"time"
+)
+
+func TestEnsureCertificate(t *testing.T) {
+	dir, err := ioutil.TempDir("", "inbucket")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	certFile := filepath.Join(dir, "cert.crt")
+	keyFile := filepath.Join(dir, "cert.key")
+
+	generated, err := ensureCertificate(certFile, keyFile, "inbucket.local")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !generated {
+		t.Fatal("Expected a certificate to be generated")
+	}
+	info, err := os.Stat(keyFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if perm := info.Mode() & os.ModePerm; perm != 0600 && runtime.GOOS != "windows" {
+		t.Errorf("Got key file mode %v, want 0600", perm)
+	}
+	pair, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(pair.Certificate[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := cert.VerifyHostname("inbucket.local"); err != nil {
+		t.Error(err)
+	}
+	err = cert.CheckSignature(cert.SignatureAlgorithm, cert.RawTBSCertificate, cert.Signature)
+	if err != nil || !bytes.Equal(cert.RawIssuer, cert.RawSubject) {
+		t.Errorf("Certificate is not self-signed: %v", err)
+	}
+	if bits := cert.PublicKey.(*rsa.PublicKey).N.BitLen(); bits != 2048 {
+		t.Errorf("Got %v bit key, want 2048", bits)
+	}
+	if d := time.Until(cert.NotAfter); d < 9*365*24*time.Hour {
+		t.Errorf("Got certificate expiring in %v, want 10 years", d)
+	}
+
+	// Existing certificates are not replaced.
+	before, _ := ioutil.ReadFile(certFile)
+	generated, err = ensureCertificate(certFile, keyFile, "inbucket.local")
+	if err != nil {
+		t.Fatal(err)
+	}
+	after, _ := ioutil.ReadFile(certFile)
+	if generated || !bytes.Equal(before, after) {
+		t.Error("Existing certificate was replaced")
+	}
+
+	// Nor is a partial key pair.
+	if err := os.Remove(certFile); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := ensureCertificate(certFile, keyFile, "inbucket.local"); err == nil {
+		t.Error("Expected an error for a missing certificate with existing key")
+	}
+}
@@ -0,0 +1,113 @@
+package smtp
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// maxEnvelopeIDLen is the maximum length of a decoded ENVID parameter, per RFC 3461.
+const maxEnvelopeIDLen = 100
+
+// DSNEnvelope holds the Delivery Status Notification parameters (RFC 3461) of a mail transaction.
+// Inbucket does not send notifications, but accepts the parameters and records the envelope ID
+// with delivered messages.
+type DSNEnvelope struct {
+	Ret        string            // RET parameter of MAIL: FULL or HDRS.
+	EnvelopeID string            // ENVID parameter of MAIL, xtext decoded.
+	Notify     map[string]string // NOTIFY parameter of RCPT, by recipient address.
+	ORcpt      map[string]string // ORCPT parameter of RCPT, by recipient address.
+}
+
+// parseMail validates and records the DSN parameters of a MAIL command.
+func (d *DSNEnvelope) parseMail(args map[string]string) error {
+	if ret, ok := args["RET"]; ok {
+		ret = strings.ToUpper(ret)
+		if ret != "FULL" && ret != "HDRS" {
+			return errors.New("RET must be FULL or HDRS")
+		}
+		d.Ret = ret
+	}
+	if envid, ok := args["ENVID"]; ok {
+		id, err := decodeXtext(envid)
+		if err != nil {
+			return fmt.Errorf("ENVID %v", err)
+		}
+		if len(id) > maxEnvelopeIDLen {
+			return fmt.Errorf("ENVID exceeds %v characters", maxEnvelopeIDLen)
+		}
+		d.EnvelopeID = id
+	}
+	return nil
+}
+
+// parseRcpt validates and records the DSN parameters of a RCPT command for addr.
+func (d *DSNEnvelope) parseRcpt(addr string, args map[string]string) error {
+	notify, hasNotify := args["NOTIFY"]
+	if hasNotify {
+		notify = strings.ToUpper(notify)
+		for _, n := range strings.Split(notify, ",") {
+			switch n {
+			case "SUCCESS", "FAILURE", "DELAY":
+			case "NEVER":
+				if notify != "NEVER" {
+					return errors.New("NOTIFY=NEVER may not be combined with other values")
+				}
+			default:
+				return fmt.Errorf("NOTIFY value %q not recognized", n)
+			}
+		}
+	}
+	orcpt, hasORcpt := args["ORCPT"]
+	if hasORcpt {
+		i := strings.IndexByte(orcpt, ';')
+		if i < 1 {
+			return errors.New("ORCPT must be of the form addr-type;address")
+		}
+		orig, err := decodeXtext(orcpt[i+1:])
+		if err != nil {
+			return fmt.Errorf("ORCPT %v", err)
+		}
+		orcpt = orcpt[:i] + ";" + orig
+	}
+	if hasNotify {
+		if d.Notify == nil {
+			d.Notify = make(map[string]string)
+		}
+		d.Notify[addr] = notify
+	}
+	if hasORcpt {
+		if d.ORcpt == nil {
+			d.ORcpt = make(map[string]string)
+		}
+		d.ORcpt[addr] = orcpt
+	}
+	return nil
+}
+
+// decodeXtext decodes an RFC 3461 xtext string, where characters outside of printable ASCII,
+// '+' and '=' are encoded as a '+' followed by two hex digits.
+func decodeXtext(s string) (string, error) {
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		switch {
+		case c == '+':
+			if i+3 > len(s) {
+				return "", errors.New("has truncated hexchar")
+			}
+			v, err := strconv.ParseUint(s[i+1:i+3], 16, 8)
+			if err != nil {
+				return "", fmt.Errorf("has invalid hexchar %q", s[i:i+3])
+			}
+			b.WriteByte(byte(v))
+			i += 2
+		case c < '!' || c > '~' || c == '=':
+			return "", fmt.Errorf("has invalid character %q", c)
+		default:
+			b.WriteByte(c)
+		}
+	}
+	return b.String(), nil
+}
@@ -0,0 +1,53 @@
+package smtp
+
+import "testing"
+
+func TestDecodeXtext(t *testing.T) {
+	testCases := []struct {
+		input, want string
+		ok          bool
+	}{
+		{"", "", true},
+		{"abc", "abc", true},
+		{"user+40example.com", "user@example.com", true},
+		{"a+2Bb+3D", "a+b=", true},
+		{"+e9t+E9", "\xe9t\xe9", true},
+		{"a+2", "", false},
+		{"a+GG", "", false},
+		{"a=b", "", false},
+		{"a\xffb", "", false},
+	}
+	for _, tc := range testCases {
+		got, err := decodeXtext(tc.input)
+		if (err == nil) != tc.ok {
+			t.Errorf("decodeXtext(%q) got err %v, want ok %v", tc.input, err, tc.ok)
+			continue
+		}
+		if got != tc.want {
+			t.Errorf("decodeXtext(%q) got %q, want %q", tc.input, got, tc.want)
+		}
+	}
+}
+
+func TestDSNEnvelopeRcpt(t *testing.T) {
+	var d DSNEnvelope
+	err := d.parseRcpt("u1@example.com", map[string]string{
+		"NOTIFY": "failure,delay",
+		"ORCPT":  "rfc822;U1+40example.com",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := d.Notify["u1@example.com"]; got != "FAILURE,DELAY" {
+		t.Errorf("Got NOTIFY %q, want FAILURE,DELAY", got)
+	}
+	if got := d.ORcpt["u1@example.com"]; got != "rfc822;U1@example.com" {
+		t.Errorf("Got ORCPT %q, want rfc822;U1@example.com", got)
+	}
+	if err := d.parseRcpt("u2@example.com", map[string]string{"NOTIFY": "SOMETIMES"}); err == nil {
+		t.Error("Expected error for unknown NOTIFY value")
+	}
+	if _, ok := d.Notify["u2@example.com"]; ok {
+		t.Error("Invalid NOTIFY was recorded")
+	}
+}
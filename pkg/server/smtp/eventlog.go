@@ -0,0 +1,155 @@
+package smtp
+
+import (
+	"encoding/json"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/rs/zerolog/log"
+)
+
+// eventLogBuffer is the number of events queued for writing before further events are dropped.
+const eventLogBuffer = 1024
+
+// Event names recorded in the event log.
+const (
+	eventConnect      = "connect"
+	eventEHLO         = "ehlo"
+	eventMailFrom     = "mail-from"
+	eventRcptTo       = "rcpt-to"
+	eventDataReceived = "data-received"
+	eventQuit         = "quit"
+	eventError        = "error"
+)
+
+// event is a single line of the event log, fields not relevant to the event are omitted.
+type event struct {
+	Time       time.Time `json:"time"`
+	Session    int       `json:"session"`
+	Remote     string    `json:"remote"`
+	Event      string    `json:"event"`
+	Domain     string    `json:"domain,omitempty"`
+	From       string    `json:"from,omitempty"`
+	To         string    `json:"to,omitempty"`
+	Size       int       `json:"size,omitempty"`
+	Recipients int       `json:"recipients,omitempty"`
+	Error      string    `json:"error,omitempty"`
+}
+
+// eventLog writes SMTP session events to a file as JSON lines, renaming the file with a .1
+// suffix and starting a new one when it would exceed maxBytes.  Events are written by a
+// background goroutine so sessions never block on file I/O; events are dropped if the queue is
+// full.  A nil eventLog discards all events.
+type eventLog struct {
+	path     string
+	maxBytes int64
+	file     *os.File
+	size     int64 // Bytes written to file.
+	events   chan *event
+	done     chan struct{}
+	close    sync.Once
+}
+
+// newEventLog opens the event log at path for appending, or returns nil if path is empty.
+func newEventLog(path string, maxBytes int64) (*eventLog, error) {
+	if path == "" {
+		return nil, nil
+	}
+	l := &eventLog{
+		path:     path,
+		maxBytes: maxBytes,
+		events:   make(chan *event, eventLogBuffer),
+		done:     make(chan struct{}),
+	}
+	if err := l.open(); err != nil {
+		return nil, err
+	}
+	go l.run()
+	return l, nil
+}
+
+// open opens the log file, continuing from the end of an existing file.
+func (l *eventLog) open() error {
+	f, err := os.OpenFile(l.path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+	if err != nil {
+		return err
+	}
+	info, err := f.Stat()
+	if err != nil {
+		_ = f.Close()
+		return err
+	}
+	l.file = f
+	l.size = info.Size()
+	return nil
+}
+
+// record queues e for writing, dropping it if the queue is full.
+func (l *eventLog) record(e *event) {
+	if l == nil {
+		return
+	}
+	select {
+	case l.events <- e:
+	default:
+		expEventsDroppedTotal.Add(1)
+	}
+}
+
+// Close writes queued events and closes the log file.  Events must not be recorded after Close.
+func (l *eventLog) Close() {
+	if l == nil {
+		return
+	}
+	l.close.Do(func() {
+		close(l.events)
+		<-l.done
+	})
+}
+
+// run writes queued events until the queue is closed.
+func (l *eventLog) run() {
+	defer close(l.done)
+	slog := log.With().Str("module", "smtp").Str("phase", "eventlog").Logger()
+	for e := range l.events {
+		line, err := json.Marshal(e)
+		if err != nil {
+			slog.Error().Err(err).Msg("Failed to encode event")
+			continue
+		}
+		line = append(line, '\n')
+		if l.file != nil && l.size > 0 && l.size+int64(len(line)) > l.maxBytes {
+			if err := l.rotate(); err != nil {
+				slog.Error().Err(err).Str("path", l.path).Msg("Failed to rotate event log")
+			}
+		}
+		if l.file == nil {
+			continue
+		}
+		n, err := l.file.Write(line)
+		l.size += int64(n)
+		if err != nil {
+			slog.Error().Err(err).Str("path", l.path).Msg("Failed to write event log")
+		}
+	}
+	if l.file != nil {
+		if err := l.file.Close(); err != nil {
+			slog.Error().Err(err).Str("path", l.path).Msg("Failed to close event log")
+		}
+	}
+}
+
+// rotate renames the log file with a .1 suffix, replacing any previous one, and opens a new file.
+// The current file is reopened if it could not be renamed.
+func (l *eventLog) rotate() error {
+	err := l.file.Close()
+	l.file = nil
+	if err == nil {
+		err = os.Rename(l.path, l.path+".1")
+	}
+	if oerr := l.open(); err == nil {
+		err = oerr
+	}
+	return err
+}
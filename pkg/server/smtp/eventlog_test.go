@@ -0,0 +1,183 @@
+package smtp
+
+import (
+	"bufio"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"net/textproto"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/inbucket/inbucket/pkg/config"
+	"github.com/inbucket/inbucket/pkg/test"
+)
+
+// readEvents returns the events in the event log at path.
+func readEvents(t *testing.T, path string) []event {
+	t.Helper()
+	f, err := os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	var events []event
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		var e event
+		if err := json.Unmarshal(scanner.Bytes(), &e); err != nil {
+			t.Fatalf("Failed to decode event %q: %v", scanner.Text(), err)
+		}
+		events = append(events, e)
+	}
+	if err := scanner.Err(); err != nil {
+		t.Fatal(err)
+	}
+	return events
+}
+
+// TestEventLogSession verifies a full SMTP session, and one which fails during DATA, are recorded
+// in the event log.
+func TestEventLogSession(t *testing.T) {
+	dir, err := ioutil.TempDir("", "inbucket-eventlog")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "smtp.log")
+	ds := test.NewStore()
+	server, logbuf, teardown := setupSMTPServerConfig(ds, func(c *config.SMTP) {
+		c.DefaultStore = true
+		c.EventLogPath = path
+		c.EventLogMaxBytes = 1 << 20
+		c.Timeout = 5 * time.Second
+	})
+	defer teardown()
+
+	conn := setupTCPSession(t, server)
+	c := textproto.NewConn(conn)
+	if code, _, err := c.ReadCodeLine(220); err != nil {
+		t.Fatalf("Expected a 220 greeting, got %v: %v", code, err)
+	}
+	script := []scriptStep{
+		{"EHLO client.example.com", 250},
+		{"MAIL FROM:<john@gmail.com>", 250},
+		{"RCPT TO:<u1@gmail.com>", 250},
+		{"RCPT TO:<u2@gmail.com>", 250},
+		{"DATA", 354},
+		{"Subject: test\r\n\r\nHi\r\n.", 250},
+		{"QUIT", 221},
+	}
+	if err := playScriptAgainst(t, c, script); err != nil {
+		t.Error(err)
+	}
+	_ = conn.Close()
+
+	// Disconnect during DATA.
+	conn = setupTCPSession(t, server)
+	c = textproto.NewConn(conn)
+	if code, _, err := c.ReadCodeLine(220); err != nil {
+		t.Fatalf("Expected a 220 greeting, got %v: %v", code, err)
+	}
+	script = []scriptStep{
+		{"HELO client.example.com", 250},
+		{"MAIL FROM:<john@gmail.com>", 250},
+		{"RCPT TO:<u1@gmail.com>", 250},
+		{"DATA", 354},
+	}
+	if err := playScriptAgainst(t, c, script); err != nil {
+		t.Error(err)
+	}
+	_ = conn.Close()
+
+	// Drain closes the event log once sessions have finished.
+	server.Drain()
+	events := readEvents(t, path)
+	want := []event{
+		{Event: eventConnect},
+		{Event: eventEHLO, Domain: "client.example.com"},
+		{Event: eventMailFrom, From: "john@gmail.com"},
+		{Event: eventRcptTo, To: "u1@gmail.com"},
+		{Event: eventRcptTo, To: "u2@gmail.com"},
+		{Event: eventDataReceived, From: "john@gmail.com", Size: 18, Recipients: 2},
+		{Event: eventQuit},
+		{Event: eventConnect},
+		{Event: eventEHLO, Domain: "client.example.com"},
+		{Event: eventMailFrom, From: "john@gmail.com"},
+		{Event: eventRcptTo, To: "u1@gmail.com"},
+		{Event: eventError, Error: "unexpected EOF"},
+	}
+	if len(events) != len(want) {
+		t.Fatalf("Got %v events, want %v: %+v", len(events), len(want), events)
+	}
+	for i, got := range events {
+		if got.Time.IsZero() || got.Remote != "127.0.0.1" || got.Session == 0 {
+			t.Errorf("Event %v missing time, remote or session: %+v", i, got)
+		}
+		got.Time, got.Remote, got.Session = time.Time{}, "", 0
+		if got != want[i] {
+			t.Errorf("Event %v got %+v, want: %+v", i, got, want[i])
+		}
+	}
+
+	if t.Failed() {
+		// Wait for handler to finish logging
+		time.Sleep(2 * time.Second)
+		// Dump buffered log data if there was a failure
+		_, _ = io.Copy(os.Stderr, logbuf)
+	}
+}
+
+func TestEventLogRotate(t *testing.T) {
+	dir, err := ioutil.TempDir("", "inbucket-eventlog")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "smtp.log")
+	l, err := newEventLog(path, 300)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 1; i <= 5; i++ {
+		l.record(&event{Session: i, Event: eventConnect, Remote: "192.0.2.1"})
+	}
+	l.Close()
+	l.Close()
+
+	// Each event is 86 bytes, so the log is rotated after every third.
+	rotated := readEvents(t, path+".1")
+	current := readEvents(t, path)
+	if len(rotated) != 3 || len(current) != 2 {
+		t.Fatalf("Got %v rotated and %v current events, want 3 and 2", len(rotated),
+			len(current))
+	}
+	if rotated[0].Session != 1 || current[0].Session != 4 {
+		t.Errorf("Got sessions %v and %v first, want 1 and 4", rotated[0].Session,
+			current[0].Session)
+	}
+
+	// An existing log is appended to.
+	l, err = newEventLog(path, 300)
+	if err != nil {
+		t.Fatal(err)
+	}
+	l.record(&event{Session: 6, Event: eventConnect, Remote: "192.0.2.1"})
+	l.Close()
+	if got := len(readEvents(t, path)); got != 3 {
+		t.Errorf("Got %v events after reopening, want 3", got)
+	}
+	if data, _ := ioutil.ReadFile(path); !strings.HasSuffix(string(data), "}\n") {
+		t.Errorf("Got log %q, want JSON lines", data)
+	}
+
+	var disabled *eventLog
+	disabled.record(&event{Event: eventConnect})
+	disabled.Close()
+	if l, err := newEventLog("", 300); l != nil || err != nil {
+		t.Errorf("Got %v, %v for empty path, want nil, nil", l, err)
+	}
+}
@@ -3,9 +3,14 @@ package smtp
 import (
 	"bufio"
 	"bytes"
+	"context"
+	"crypto/subtle"
 	"crypto/tls"
+	"encoding/base64"
+	"errors"
 	"fmt"
 	"io"
+	"io/ioutil"
 	"net"
 	"net/textproto"
 	"regexp"
@@ -13,7 +18,11 @@ import (
 	"strings"
 	"time"
 
+	"github.com/inbucket/inbucket/pkg/config"
+	"github.com/inbucket/inbucket/pkg/metric"
 	"github.com/inbucket/inbucket/pkg/policy"
+	"github.com/inbucket/inbucket/pkg/spf"
+	"github.com/inbucket/inbucket/pkg/storage"
 	"github.com/rs/zerolog"
 	"github.com/rs/zerolog/log"
 )
@@ -25,6 +34,9 @@ const (
 	// timeStampFormat to use in Received header.
 	timeStampFormat = "Mon, 02 Jan 2006 15:04:05 -0700 (MST)"
 
+	// defaultBanner is the greeting used when none is configured.
+	defaultBanner = "{hostname} ESMTP Inbucket {version} ready {date}"
+
 	// GREET State: Waiting for HELO
 	GREET State = iota
 	// READY State: Got HELO, waiting for MAIL
@@ -37,11 +49,17 @@ const (
 	QUIT
 )
 
-// fromRegex captures the from address and optional BODY=8BITMIME clause.  Matches FROM, while
-// accepting '>' as quoted pair and in double quoted strings (?i) makes the regex case insensitive,
-// (?:) is non-grouping sub-match
+// fromRegex captures the from address and optional ESMTP parameters, such as BODY=8BITMIME.
+// Matches FROM, while accepting '>' as quoted pair and in double quoted strings (?i) makes the
+// regex case insensitive, (?:) is non-grouping sub-match
 var fromRegex = regexp.MustCompile(
-	"(?i)^FROM:\\s*<((?:(?:\\\\>|[^>])+|\"[^\"]+\"@[^>])+)?>( [\\w= ]+)?$")
+	"(?i)^FROM:\\s*<((?:(?:\\\\>|[^>])+|\"[^\"]+\"@[^>])+)?>( [!-~ ]+)?$")
+
+// paramKeyRegex matches an ESMTP parameter keyword.
+var paramKeyRegex = regexp.MustCompile(`^[[:alnum:]][[:alnum:]-]*$`)
+
+// errMessageTooLarge is returned by readDataBlock when the message exceeds MaxMessageBytes.
+var errMessageTooLarge = errors.New("message exceeds maximum size")
 
 func (s State) String() string {
 	switch s {
@@ -76,43 +94,62 @@ var commands = map[string]bool{
 	"QUIT":     true,
 	"TURN":     true,
 	"STARTTLS": true,
+	"AUTH":     true,
+	"BDAT":     true,
 }
 
 // Session holds the state of an SMTP session
 type Session struct {
 	*Server                          // Server this session belongs to.
 	id           int                 // Session ID.
+	ctx          context.Context     // Canceled when the session ends.
+	cancel       context.CancelFunc  // Cancels ctx.
 	conn         net.Conn            // TCP connection.
 	remoteDomain string              // Remote domain from HELO command.
 	remoteHost   string              // Remote host.
 	sendError    error               // Last network send error.
 	state        State               // Session state machine.
 	reader       *bufio.Reader       // Buffered reading for TCP conn.
+	writer       *bufio.Writer       // Buffered responses, flushed before blocking on reader.
 	from         string              // Sender from MAIL command.
+	nullSender   bool                // MAIL command had a null reverse-path.
 	recipients   []*policy.Recipient // Recipients from RCPT commands.
+	chunks       *bytes.Buffer       // Message data from BDAT commands.
+	dsn          DSNEnvelope         // DSN parameters from MAIL and RCPT commands.
 	logger       zerolog.Logger      // Session specific logger.
 	debug        bool                // Print network traffic to stdout.
 	tlsState     *tls.ConnectionState
-	text         *textproto.Conn
+	text         *textproto.Reader
+	authUser     string // Username from successful AUTH command.
+	noopCount    int    // NOOP commands received.
 }
 
 // NewSession creates a new Session for the given connection
 func NewSession(server *Server, id int, conn net.Conn, logger zerolog.Logger) *Session {
-	reader := bufio.NewReader(conn)
 	host, _, _ := net.SplitHostPort(conn.RemoteAddr().String())
 
-	return &Session{
+	ctx, cancel := context.WithCancel(context.Background())
+	s := &Session{
 		Server:     server,
 		id:         id,
-		conn:       conn,
+		ctx:        ctx,
+		cancel:     cancel,
 		state:      GREET,
-		reader:     reader,
 		remoteHost: host,
 		recipients: make([]*policy.Recipient, 0),
 		logger:     logger,
 		debug:      server.config.Debug,
-		text:       textproto.NewConn(conn),
 	}
+	s.setConn(conn)
+	return s
+}
+
+// setConn sets the connection used by the session, discarding any buffered input.
+func (s *Session) setConn(conn net.Conn) {
+	s.conn = conn
+	s.reader = bufio.NewReader(conn)
+	s.writer = bufio.NewWriter(conn)
+	s.text = textproto.NewReader(s.reader)
 }
 
 func (s *Session) String() string {
@@ -142,6 +179,8 @@ func (s *Server) startSession(id int, conn net.Conn) {
 	}()
 
 	ssn := NewSession(s, id, conn, logger)
+	defer ssn.cancel()
+	ssn.event(&event{Event: eventConnect})
 	ssn.greet()
 
 	// This is our command reading loop
@@ -167,16 +206,19 @@ func (s *Server) startSession(id int, conn net.Conn) {
 
 				// Commands we handle in any state
 				switch cmd {
-				case "SEND", "SOML", "SAML", "EXPN", "HELP", "TURN":
+				case "SEND", "SOML", "SAML", "HELP", "TURN":
 					// These commands are not implemented in any state
 					ssn.send(fmt.Sprintf("502 %v command not implemented", cmd))
 					ssn.logger.Warn().Msgf("Command %v not implemented by Inbucket", cmd)
 					continue
 				case "VRFY":
-					ssn.send("252 Cannot VRFY user, but will accept message")
+					ssn.vrfyHandler(arg)
+					continue
+				case "EXPN":
+					ssn.expnHandler(arg)
 					continue
 				case "NOOP":
-					ssn.send("250 I have sucessfully done nothing")
+					ssn.noopHandler()
 					continue
 				case "RSET":
 					// Reset session
@@ -185,9 +227,14 @@ func (s *Server) startSession(id int, conn net.Conn) {
 					ssn.send("250 Session reset")
 					continue
 				case "QUIT":
+					ssn.event(&event{Event: eventQuit})
 					ssn.send("221 Goodnight and good luck")
 					ssn.enterState(QUIT)
 					continue
+				case "BDAT":
+					// Chunk data must be consumed in any state
+					ssn.bdatHandler(arg)
+					continue
 				}
 
 				// Send command to handler for current state
@@ -216,11 +263,13 @@ func (s *Server) startSession(id int, conn net.Conn) {
 					ssn.logger.Info().Msgf("Client closed connection (state %v)", ssn.state)
 				default:
 					ssn.logger.Warn().Msgf("Got EOF while in state %v", ssn.state)
+					ssn.event(&event{Event: eventError, Error: "unexpected EOF"})
 				}
 				break
 			}
 			// not an EOF
 			ssn.logger.Warn().Msgf("Connection error: %v", err)
+			ssn.event(&event{Event: eventError, Error: err.Error()})
 			if netErr, ok := err.(net.Error); ok {
 				if netErr.Timeout() {
 					ssn.send("221 Idle timeout, bye bye")
@@ -231,8 +280,10 @@ func (s *Server) startSession(id int, conn net.Conn) {
 			break
 		}
 	}
+	ssn.flush()
 	if ssn.sendError != nil {
 		ssn.logger.Warn().Msgf("Network send error: %v", ssn.sendError)
+		ssn.event(&event{Event: eventError, Error: ssn.sendError.Error()})
 	}
 	ssn.logger.Info().Msgf("Closing connection")
 }
@@ -248,6 +299,7 @@ func (s *Session) greetHandler(cmd string, arg string) {
 			return
 		}
 		s.remoteDomain = domain
+		s.event(&event{Event: eventEHLO, Domain: domain})
 		s.send("250 " + readyBanner)
 		s.enterState(READY)
 	case "EHLO":
@@ -257,12 +309,16 @@ func (s *Session) greetHandler(cmd string, arg string) {
 			return
 		}
 		s.remoteDomain = domain
+		s.event(&event{Event: eventEHLO, Domain: domain})
 		// features before SIZE per RFC
 		s.send("250-" + readyBanner)
 		s.send("250-8BITMIME")
 		if s.Server.config.TLSEnabled && s.Server.tlsConfig != nil && s.tlsState == nil {
 			s.send("250-STARTTLS")
 		}
+		s.send("250-AUTH PLAIN LOGIN")
+		s.send("250-PIPELINING")
+		s.send("250-CHUNKING")
 		s.send(fmt.Sprintf("250 SIZE %v", s.config.MaxMessageBytes))
 		s.enterState(READY)
 	default:
@@ -278,6 +334,9 @@ func parseHelloArgument(arg string) (string, error) {
 	if domain == "" {
 		return "", fmt.Errorf("Invalid domain")
 	}
+	if domain[0] == '[' && !policy.ValidateDomainPart(domain) {
+		return "", fmt.Errorf("Invalid address literal")
+	}
 	return domain, nil
 }
 
@@ -298,14 +357,27 @@ func (s *Session) readyHandler(cmd string, arg string) {
 		}
 		s.logger.Debug().Msg("Initiating TLS context.")
 		s.send("220 STARTTLS")
-		// start tls connection handshake
+		s.flush()
+		// start tls connection handshake, commands pipelined after STARTTLS are discarded
 		tlsConn := tls.Server(s.conn, s.Server.tlsConfig)
-		s.conn = tlsConn
-		s.text = textproto.NewConn(s.conn)
+		s.setConn(tlsConn)
 		s.tlsState = new(tls.ConnectionState)
 		*s.tlsState = tlsConn.ConnectionState()
+		s.authUser = ""
 		s.enterState(GREET)
+	} else if cmd == "AUTH" {
+		s.authHandler(arg)
 	} else if cmd == "MAIL" {
+		if s.config.TLSRequired && s.tlsState == nil {
+			s.send("530 Must issue a STARTTLS command first")
+			s.logger.Warn().Msg("Rejected MAIL from client without TLS")
+			return
+		}
+		if s.config.AuthRequired && s.authUser == "" {
+			s.send("530 Authentication required")
+			s.logger.Warn().Msg("Rejected MAIL from unauthenticated client")
+			return
+		}
 		// Capture group 1: from address.  2: optional params.
 		m := fromRegex.FindStringSubmatch(arg)
 		if m == nil {
@@ -333,21 +405,28 @@ func (s *Session) readyHandler(cmd string, arg string) {
 				return
 			}
 			if args["SIZE"] != "" {
-				size, err := strconv.ParseInt(args["SIZE"], 10, 32)
+				size, err := strconv.ParseInt(args["SIZE"], 10, 64)
 				if err != nil {
 					s.send("501 Unable to parse SIZE as an integer")
 					s.logger.Warn().Msgf("Unable to parse SIZE %q as an integer", args["SIZE"])
 					return
 				}
-				if int(size) > s.config.MaxMessageBytes {
-					s.send("552 Max message size exceeded")
+				if size > s.config.MaxMessageBytes {
+					s.send("552 5.3.4 Max message size exceeded")
 					s.logger.Warn().Msgf("Client wanted to send oversized message: %v", args["SIZE"])
 					return
 				}
 			}
+			if err := s.dsn.parseMail(args); err != nil {
+				s.send("501 " + err.Error())
+				s.logger.Warn().Msgf("Bad MAIL DSN parameter: %v", err)
+				return
+			}
 		}
 		s.from = from
+		s.nullSender = m[1] == ""
 		s.logger.Info().Msgf("Mail from: %v", from)
+		s.event(&event{Event: eventMailFrom, From: from})
 		s.send(fmt.Sprintf("250 Roger, accepting mail from <%v>", from))
 		s.enterState(MAIL)
 	} else if cmd == "EHLO" {
@@ -360,8 +439,95 @@ func (s *Session) readyHandler(cmd string, arg string) {
 	}
 }
 
+// authHandler handles the AUTH command in READY state, supporting the PLAIN and LOGIN mechanisms.
+func (s *Session) authHandler(arg string) {
+	if s.authUser != "" {
+		s.send("503 Already authenticated")
+		return
+	}
+	mechanism, initial := arg, ""
+	if idx := strings.IndexRune(arg, ' '); idx >= 0 {
+		mechanism, initial = arg[:idx], strings.TrimSpace(arg[idx+1:])
+	}
+	var user, password string
+	var ok bool
+	switch strings.ToUpper(mechanism) {
+	case "PLAIN":
+		// authzid NUL authcid NUL passwd
+		resp, cancel, valid := s.authResponse(initial, "")
+		if cancel || !valid {
+			return
+		}
+		fields := strings.Split(resp, "\x00")
+		if len(fields) != 3 {
+			s.send("501 Malformed PLAIN credentials")
+			return
+		}
+		user, password = fields[1], fields[2]
+	case "LOGIN":
+		var cancel, valid bool
+		if user, cancel, valid = s.authResponse(initial, "Username:"); cancel || !valid {
+			return
+		}
+		if password, cancel, valid = s.authResponse("", "Password:"); cancel || !valid {
+			return
+		}
+	case "":
+		s.send("501 AUTH mechanism required")
+		return
+	default:
+		s.send(fmt.Sprintf("504 Unrecognized authentication mechanism %v", mechanism))
+		return
+	}
+	ok = s.config.Username == "" ||
+		(subtle.ConstantTimeCompare([]byte(user), []byte(s.config.Username)) == 1 &&
+			subtle.ConstantTimeCompare([]byte(password), []byte(s.config.Password)) == 1)
+	if !ok {
+		s.send("535 Authentication credentials invalid")
+		s.logger.Warn().Msgf("Failed AUTH %v for user %q", mechanism, user)
+		return
+	}
+	s.authUser = user
+	s.logger.Info().Msgf("Authenticated as %q", user)
+	s.send("235 Authentication successful")
+}
+
+// authResponse decodes the base64 initial response, or prompts the client for a response if
+// initial is empty.  cancel is true if the client canceled the exchange, and valid is false if
+// the response could not be decoded; an error has been sent to the client in either case.
+func (s *Session) authResponse(initial, prompt string) (resp string, cancel, valid bool) {
+	line := initial
+	if line == "" {
+		s.send("334 " + base64.StdEncoding.EncodeToString([]byte(prompt)))
+		var err error
+		if line, err = s.readLine(); err != nil {
+			s.logger.Warn().Msgf("Connection error during AUTH: %v", err)
+			return "", true, false
+		}
+		line = strings.TrimSpace(line)
+		if line == "*" {
+			s.send("501 Authentication canceled")
+			return "", true, true
+		}
+	} else if line == "=" {
+		// Empty initial response.
+		return "", false, true
+	}
+	b, err := base64.StdEncoding.DecodeString(line)
+	if err != nil {
+		s.send("501 Unable to decode base64 response")
+		return "", false, false
+	}
+	return string(b), false, true
+}
+
 // MAIL state -> waiting for RCPTs followed by DATA
 func (s *Session) mailHandler(cmd string, arg string) {
+	if s.chunks != nil && cmd != "EHLO" {
+		// Only BDAT may follow BDAT
+		s.ooSeq(cmd)
+		return
+	}
 	switch cmd {
 	case "RCPT":
 		if (len(arg) < 4) || (strings.ToUpper(arg[0:3]) != "TO:") {
@@ -369,7 +535,20 @@ func (s *Session) mailHandler(cmd string, arg string) {
 			s.logger.Warn().Msgf("Bad RCPT argument: %q", arg)
 			return
 		}
-		addr := strings.Trim(arg[3:], "<> ")
+		addr, params := arg[3:], ""
+		if i := strings.Index(addr, "> "); i >= 0 {
+			addr, params = addr[:i+1], addr[i+1:]
+		}
+		addr = strings.Trim(addr, "<> ")
+		var args map[string]string
+		if params != "" {
+			var ok bool
+			if args, ok = s.parseArgs(params); !ok {
+				s.send("501 Unable to parse RCPT ESMTP parameters")
+				s.logger.Warn().Msgf("Bad RCPT argument: %q", arg)
+				return
+			}
+		}
 		recip, err := s.addrPolicy.NewRecipient(addr)
 		if err != nil {
 			s.send("501 Bad recipient address syntax")
@@ -383,11 +562,25 @@ func (s *Session) mailHandler(cmd string, arg string) {
 		}
 		if len(s.recipients) >= s.config.MaxRecipients {
 			s.logger.Warn().Msgf("Limit of %v recipients exceeded", s.config.MaxRecipients)
-			s.send(fmt.Sprintf("552 Limit of %v recipients exceeded", s.config.MaxRecipients))
+			s.send("452 4.5.3 Too many recipients")
+			return
+		}
+		if err := s.dsn.parseRcpt(addr, args); err != nil {
+			s.send("501 " + err.Error())
+			s.logger.Warn().Msgf("Bad RCPT DSN parameter: %v", err)
+			return
+		}
+		if decision, err := s.addrPolicy.Route(s.ctx, recip); err != nil {
+			s.send("451 Failed to route recipient")
+			s.logger.Error().Str("to", addr).Err(err).Msg("Failed to route recipient")
 			return
+		} else if decision == policy.CatchAll {
+			s.logger.Debug().Str("to", addr).Str("mailbox", recip.Mailbox).
+				Msg("Routed recipient to catch-all mailbox")
 		}
 		s.recipients = append(s.recipients, recip)
 		s.logger.Debug().Str("to", addr).Msg("Recipient added")
+		s.event(&event{Event: eventRcptTo, To: addr})
 		s.send(fmt.Sprintf("250 I'll make sure <%v> gets this", addr))
 		return
 	case "DATA":
@@ -417,6 +610,12 @@ func (s *Session) mailHandler(cmd string, arg string) {
 func (s *Session) dataHandler() {
 	s.send("354 Start mail input; end with <CRLF>.<CRLF>")
 	msgBuf, err := s.readDataBlock()
+	if err == errMessageTooLarge {
+		s.send("552 5.3.4 Max message size exceeded")
+		s.logger.Warn().Msgf("Rejected message larger than %v bytes", s.config.MaxMessageBytes)
+		s.reset()
+		return
+	}
 	if err != nil {
 		if netErr, ok := err.(net.Error); ok {
 			if netErr.Timeout() {
@@ -424,45 +623,187 @@ func (s *Session) dataHandler() {
 			}
 		}
 		s.logger.Warn().Msgf("Error: %v while reading", err)
+		s.event(&event{Event: eventError, Error: err.Error()})
 		s.enterState(QUIT)
 		return
 	}
-	mailData := bytes.NewBuffer(msgBuf)
+	s.deliverMessage(msgBuf)
+}
+
+// BDAT
+func (s *Session) bdatHandler(arg string) {
+	fields := strings.Fields(arg)
+	if len(fields) < 1 || len(fields) > 2 ||
+		(len(fields) == 2 && strings.ToUpper(fields[1]) != "LAST") {
+		s.send("501 Was expecting BDAT arg syntax of <size> [LAST]")
+		s.logger.Warn().Msgf("Bad BDAT argument: %q", arg)
+		return
+	}
+	size, err := strconv.ParseInt(fields[0], 10, 64)
+	if err != nil || size < 0 {
+		s.send("501 Unable to parse BDAT size as an integer")
+		s.logger.Warn().Msgf("Unable to parse BDAT size %q as an integer", fields[0])
+		return
+	}
+	last := len(fields) == 2
+
+	// Read the chunk, discarding it if it will not be accepted.
+	inSequence := s.state == MAIL && len(s.recipients) > 0
+	tooLarge := false
+	var w io.Writer = ioutil.Discard
+	if inSequence {
+		if s.chunks == nil {
+			s.chunks = new(bytes.Buffer)
+		}
+		if int64(s.chunks.Len())+size > s.config.MaxMessageBytes {
+			tooLarge = true
+		} else {
+			w = s.chunks
+		}
+	}
+	if err := s.awaitInput(); err == nil {
+		_, err = io.CopyN(w, s.reader, size)
+	}
+	if err != nil {
+		s.logger.Warn().Msgf("Error: %v while reading BDAT chunk", err)
+		s.event(&event{Event: eventError, Error: err.Error()})
+		s.send("500 Failed to read BDAT chunk")
+		s.reset()
+		s.enterState(QUIT)
+		return
+	}
+	if s.debug {
+		fmt.Printf("%04d   Received %d bytes\n", s.id, size)
+	}
+	switch {
+	case !inSequence:
+		s.ooSeq("BDAT")
+	case tooLarge:
+		s.send("552 5.3.4 Max message size exceeded")
+		s.logger.Warn().Msgf("Rejected message larger than %v bytes", s.config.MaxMessageBytes)
+		s.reset()
+	case last:
+		s.deliverMessage(s.chunks.Bytes())
+	default:
+		s.send(fmt.Sprintf("250 %v bytes received", size))
+	}
+}
 
-	// Mail data complete.
+// deliverMessage delivers the completed message to each recipient, and resets the session.
+func (s *Session) deliverMessage(msgBuf []byte) {
+	if !s.msgLimiter.Allow(s.remoteHost) {
+		expRateLimitTotal.Add(1)
+		s.send("452 4.5.3 Too many messages")
+		s.logger.Warn().Msg("Rejected message, rate limit exceeded")
+		s.reset()
+		return
+	}
+	mailData := bytes.NewBuffer(msgBuf)
 	tstamp := time.Now().Format(timeStampFormat)
+	var spfResult spf.Result
+	authResults := ""
+	if s.spfResolver != nil {
+		sender := s.from
+		if s.nullSender {
+			sender = ""
+		}
+		spfResult = spf.Check(
+			s.ctx, s.spfResolver, net.ParseIP(s.remoteHost), s.remoteDomain, sender)
+		authResults = s.authenticationResults(spfResult)
+	}
+	stored := false
 	for _, recip := range s.recipients {
 		if recip.ShouldStore() {
 			// Generate Received header.
-			prefix := fmt.Sprintf("Received: from %s ([%s]) by %s\r\n  for <%s>; %s\r\n",
+			prefix := authResults + fmt.Sprintf(
+				"Received: from %s ([%s]) by %s\r\n  for <%s>; %s\r\n",
 				s.remoteDomain, s.remoteHost, s.config.Domain, recip.Address.Address,
 				tstamp)
 
 			// Deliver message.
-			_, err := s.manager.Deliver(
-				recip, s.from, s.recipients, prefix, mailData.Bytes())
+			_, err := s.manager.Deliver(s.ctx, recip, s.from, s.dsn.EnvelopeID,
+				string(spfResult), s.recipients, prefix, mailData.Bytes())
 			if err != nil {
 				s.logger.Error().Msgf("delivery for %v: %v", recip.LocalPart, err)
-				s.send(fmt.Sprintf("451 Failed to store message for %v", recip.LocalPart))
+				s.event(&event{Event: eventError, To: recip.Address.Address, Error: err.Error()})
+				if err == storage.ErrQuotaExceeded {
+					s.send("452 4.2.2 Mailbox full")
+				} else {
+					s.send(fmt.Sprintf("451 Failed to store message for %v", recip.LocalPart))
+				}
 				s.reset()
 				return
 			}
+			stored = true
+		} else {
+			s.logger.Debug().Str("to", recip.Address.Address).
+				Msg("Dropped message for recipient domain not stored")
 		}
 		expReceivedTotal.Add(1)
 	}
+	if !stored {
+		// Every recipient was discarded, count the message once.
+		expDroppedTotal.Add(1)
+	}
 	s.send("250 Mail accepted for delivery")
 	s.logger.Info().Msgf("Message size %v bytes", mailData.Len())
+	s.event(&event{Event: eventDataReceived, From: s.from, Size: mailData.Len(),
+		Recipients: len(s.recipients)})
 	s.reset()
 	return
 }
 
+// authenticationResults returns an Authentication-Results header reporting the SPF result, which
+// was checked against the MAIL FROM address, or the HELO domain if the sender was null.
+func (s *Session) authenticationResults(result spf.Result) string {
+	identity := "smtp.mailfrom=" + s.from
+	if s.nullSender {
+		identity = "smtp.helo=" + s.remoteDomain
+	}
+	return fmt.Sprintf("Authentication-Results: %s;\r\n  spf=%s %s\r\n",
+		s.config.Domain, result, identity)
+}
+
+// event records e in the event log, filling in the time and session details.
+func (s *Session) event(e *event) {
+	if s.eventLog == nil {
+		return
+	}
+	e.Time = time.Now()
+	e.Session = s.id
+	e.Remote = s.remoteHost
+	s.eventLog.record(e)
+}
+
 func (s *Session) enterState(state State) {
 	s.state = state
 	s.logger.Debug().Msgf("Entering state %v", state)
 }
 
 func (s *Session) greet() {
-	s.send(fmt.Sprintf("220 %v Inbucket SMTP ready", s.config.Domain))
+	s.send("220 " + expandBanner(s.config.Banner, s.config.Domain, config.Version, time.Now()))
+}
+
+// expandBanner replaces the {hostname}, {version} and {date} variables in the banner template.
+func expandBanner(banner, hostname, version string, date time.Time) string {
+	if banner == "" {
+		banner = defaultBanner
+	}
+	if version == "" {
+		version = "undefined"
+	}
+	r := strings.NewReplacer(
+		"{hostname}", hostname,
+		"{version}", version,
+		"{date}", date.Format(time.RFC1123Z),
+	)
+	// Line breaks would end the greeting early.
+	return strings.Map(func(c rune) rune {
+		if c == '\r' || c == '\n' {
+			return ' '
+		}
+		return c
+	}, r.Replace(banner))
 }
 
 // nextDeadline calculates the next read or write deadline based on configured timeout.
@@ -470,13 +811,14 @@ func (s *Session) nextDeadline() time.Time {
 	return time.Now().Add(s.config.Timeout)
 }
 
-// Send requested message, store errors in Session.sendError
+// Send requested message, store errors in Session.sendError.  Messages are buffered until the
+// session waits for further input, allowing responses to pipelined commands to be batched.
 func (s *Session) send(msg string) {
 	if err := s.conn.SetWriteDeadline(s.nextDeadline()); err != nil {
 		s.sendError = err
 		return
 	}
-	if err := s.text.PrintfLine("%s", msg); err != nil {
+	if _, err := fmt.Fprintf(s.writer, "%s\r\n", msg); err != nil {
 		s.sendError = err
 		s.logger.Warn().Msgf("Failed to send: %q", msg)
 		return
@@ -486,15 +828,51 @@ func (s *Session) send(msg string) {
 	}
 }
 
-// readDataBlock reads message DATA until `.` using the textproto pkg.
+// flush writes buffered responses to the network, store errors in Session.sendError
+func (s *Session) flush() {
+	if s.sendError != nil || s.writer.Buffered() == 0 {
+		return
+	}
+	if err := s.conn.SetWriteDeadline(s.nextDeadline()); err != nil {
+		s.sendError = err
+		return
+	}
+	if err := s.writer.Flush(); err != nil {
+		s.sendError = err
+	}
+}
+
+// awaitInput flushes buffered responses if the client has not already sent, or pipelined,
+// further input, and sets the read deadline.
+func (s *Session) awaitInput() error {
+	if s.reader.Buffered() == 0 {
+		s.flush()
+		if s.sendError != nil {
+			return s.sendError
+		}
+	}
+	return s.conn.SetReadDeadline(s.nextDeadline())
+}
+
+// readDataBlock reads message DATA until `.` using the textproto pkg.  Messages larger than
+// MaxMessageBytes are discarded, returning errMessageTooLarge once the `.` has been read.
 func (s *Session) readDataBlock() ([]byte, error) {
-	if err := s.conn.SetReadDeadline(s.nextDeadline()); err != nil {
+	if err := s.awaitInput(); err != nil {
 		return nil, err
 	}
-	b, err := s.text.ReadDotBytes()
+	dot := s.text.DotReader()
+	lr := &io.LimitedReader{R: dot, N: s.config.MaxMessageBytes + 1}
+	b, err := ioutil.ReadAll(lr)
 	if err != nil {
 		return nil, err
 	}
+	if lr.N == 0 {
+		// Consume the remainder of the message, so the client sees our response.
+		if _, err := io.Copy(ioutil.Discard, dot); err != nil {
+			return nil, err
+		}
+		return nil, errMessageTooLarge
+	}
 	if s.debug {
 		fmt.Printf("%04d   Received %d bytes\n", s.id, len(b))
 	}
@@ -503,7 +881,7 @@ func (s *Session) readDataBlock() ([]byte, error) {
 
 // readLine reads a line of input respecting deadlines.
 func (s *Session) readLine() (line string, err error) {
-	if err = s.conn.SetReadDeadline(s.nextDeadline()); err != nil {
+	if err = s.awaitInput(); err != nil {
 		return "", err
 	}
 	line, err = s.text.ReadLine()
@@ -547,18 +925,24 @@ func (s *Session) parseCmd(line string) (cmd string, arg string, ok bool) {
 // parseArgs takes the arguments proceeding a command and files them
 // into a map[string]string after uppercasing each key.  Sample arg
 // string:
-//		" BODY=8BITMIME SIZE=1024"
+//
+//	" BODY=8BITMIME SIZE=1024"
+//
 // The leading space is mandatory.
 func (s *Session) parseArgs(arg string) (args map[string]string, ok bool) {
 	args = make(map[string]string)
-	re := regexp.MustCompile(` (\w+)=(\w+)`)
-	pm := re.FindAllStringSubmatch(arg, -1)
-	if pm == nil {
+	params := strings.Fields(arg)
+	if !strings.HasPrefix(arg, " ") || len(params) == 0 {
 		s.logger.Warn().Msgf("Failed to parse arg string: %q", arg)
 		return nil, false
 	}
-	for _, m := range pm {
-		args[strings.ToUpper(m[1])] = m[2]
+	for _, param := range params {
+		kv := strings.SplitN(param, "=", 2)
+		if len(kv) != 2 || !paramKeyRegex.MatchString(kv[0]) || kv[1] == "" {
+			s.logger.Warn().Msgf("Failed to parse arg string: %q", arg)
+			return nil, false
+		}
+		args[strings.ToUpper(kv[0])] = kv[1]
 	}
 	s.logger.Debug().Msgf("ESMTP params: %v", args)
 	return args, true
@@ -567,7 +951,85 @@ func (s *Session) parseArgs(arg string) (args map[string]string, ok bool) {
 func (s *Session) reset() {
 	s.enterState(READY)
 	s.from = ""
+	s.nullSender = false
 	s.recipients = nil
+	s.chunks = nil
+	s.dsn = DSNEnvelope{}
+}
+
+// noopHandler counts NOOP commands, closing the session once it has sent more than the configured
+// maximum so idle clients cannot hold connections open indefinitely.
+func (s *Session) noopHandler() {
+	s.noopCount++
+	expNoopsTotal.Add(1)
+	metric.SMTPNoops.Inc()
+	s.logger.Trace().Int("count", s.noopCount).Msg("NOOP")
+	if s.config.MaxNOOPsPerSession > 0 && s.noopCount > s.config.MaxNOOPsPerSession {
+		s.logger.Warn().Msgf("Closing session after %v NOOPs", s.noopCount)
+		s.send("421 4.3.2 Service not available")
+		s.enterState(QUIT)
+		return
+	}
+	s.send("250 I have sucessfully done nothing")
+}
+
+// vrfyHandler confirms whether the mailbox of an address has received any messages, if enabled.
+func (s *Session) vrfyHandler(arg string) {
+	if !s.config.VRFYEnabled || s.addrPolicy.MailboxExists == nil {
+		s.send("252 Cannot VRFY user, but will accept message")
+		return
+	}
+	recip, ok := s.parseVerbAddress("VRFY", arg, "501 Bad address syntax")
+	if !ok {
+		return
+	}
+	exists, err := s.addrPolicy.MailboxExists(s.ctx, recip.Mailbox)
+	if err != nil {
+		s.send("451 Failed to look up mailbox")
+		s.logger.Error().Str("address", recip.Address.Address).Err(err).
+			Msg("Failed to look up VRFY mailbox")
+		return
+	}
+	if !exists {
+		s.send("550 5.1.1 User unknown")
+		return
+	}
+	s.send(fmt.Sprintf("250 <%v>", recip.Address.Address))
+}
+
+// expnHandler expands an address to itself if enabled, treating each mailbox as a list of one.
+func (s *Session) expnHandler(arg string) {
+	if !s.config.EXPNEnabled {
+		s.send("502 EXPN command not implemented")
+		s.logger.Warn().Msg("Command EXPN not enabled")
+		return
+	}
+	recip, ok := s.parseVerbAddress("EXPN", arg, "550 Invalid mailbox name")
+	if !ok {
+		return
+	}
+	s.send(fmt.Sprintf("250 <%v>", recip.Address.Address))
+}
+
+// parseVerbAddress parses the address argument of VRFY or EXPN, which may be enclosed in angle
+// brackets and preceded by a name.  If the address is invalid it sends the invalid response and
+// returns false.
+func (s *Session) parseVerbAddress(cmd, arg, invalid string) (*policy.Recipient, bool) {
+	addr := strings.TrimSpace(arg)
+	if i := strings.LastIndexByte(addr, '<'); i >= 0 && strings.HasSuffix(addr, ">") {
+		addr = addr[i+1 : len(addr)-1]
+	}
+	if addr == "" {
+		s.send(fmt.Sprintf("501 %v requires an address", cmd))
+		return nil, false
+	}
+	recip, err := s.addrPolicy.NewRecipient(addr)
+	if err != nil {
+		s.send(invalid)
+		s.logger.Warn().Str("address", addr).Err(err).Msgf("Bad address as %v arg", cmd)
+		return nil, false
+	}
+	return recip, true
 }
 
 func (s *Session) ooSeq(cmd string) {
@@ -2,21 +2,28 @@ package smtp
 
 import (
 	"bytes"
+	"context"
+	"crypto/tls"
+	"encoding/base64"
 	"fmt"
 	"io"
-
+	"io/ioutil"
 	"log"
 	"net"
 	"net/textproto"
 	"os"
+	"path/filepath"
+	"strings"
 	"testing"
 	"time"
 
 	"github.com/inbucket/inbucket/pkg/config"
 	"github.com/inbucket/inbucket/pkg/message"
+	"github.com/inbucket/inbucket/pkg/metric"
 	"github.com/inbucket/inbucket/pkg/policy"
 	"github.com/inbucket/inbucket/pkg/storage"
 	"github.com/inbucket/inbucket/pkg/test"
+	"github.com/prometheus/client_golang/prometheus/testutil"
 )
 
 type scriptStep struct {
@@ -217,7 +224,7 @@ func TestMailState(t *testing.T) {
 		{"RCPT TO:<u3@gmail.com>", 250},
 		{"RCPT TO:<u4@gmail.com>", 250},
 		{"RCPT TO:<u5@gmail.com>", 250},
-		{"RCPT TO:<u6@gmail.com>", 552},
+		{"RCPT TO:<u6@gmail.com>", 452},
 	}
 	if err := playSession(t, server, script); err != nil {
 		t.Error(err)
@@ -279,6 +286,112 @@ func TestMailState(t *testing.T) {
 	}
 }
 
+// TestMaxRecipients verifies recipients beyond the limit are rejected with 452, and that the limit
+// applies to each message.
+func TestMaxRecipients(t *testing.T) {
+	ds := test.NewStore()
+	server, logbuf, teardown := setupSMTPServerConfig(ds, func(c *config.SMTP) {
+		c.DefaultStore = true
+	})
+	defer teardown()
+
+	// Configured limit is 5.
+	rcpts := func(n int) []scriptStep {
+		var steps []scriptStep
+		for i := 1; i <= n; i++ {
+			steps = append(steps, scriptStep{fmt.Sprintf("RCPT TO:<u%v@gmail.com>", i), 250})
+		}
+		return steps
+	}
+	script := []scriptStep{
+		{"HELO localhost", 250},
+		{"MAIL FROM:<john@gmail.com>", 250},
+	}
+	script = append(script, rcpts(5)...)
+	script = append(script, []scriptStep{
+		{"RCPT TO:<u6@gmail.com>", 452},
+		{"RSET", 250},
+		{"MAIL FROM:<john@gmail.com>", 250},
+	}...)
+	script = append(script, rcpts(5)...)
+	script = append(script, []scriptStep{
+		{"RCPT TO:<u6@gmail.com>", 452},
+		{"DATA", 354},
+		{"Subject: test\r\n\r\nHi\r\n.", 250},
+		{"MAIL FROM:<john@gmail.com>", 250},
+	}...)
+	script = append(script, rcpts(5)...)
+	if err := playSession(t, server, script); err != nil {
+		t.Error(err)
+	}
+	if msgs, _ := ds.GetMessages(context.Background(), "u6@gmail.com"); len(msgs) != 0 {
+		t.Errorf("Got %v messages for rejected recipient, want 0", len(msgs))
+	}
+
+	if t.Failed() {
+		// Wait for handler to finish logging
+		time.Sleep(2 * time.Second)
+		// Dump buffered log data if there was a failure
+		_, _ = io.Copy(os.Stderr, logbuf)
+	}
+}
+
+// TestBanner verifies the configured greeting is expanded for each session.
+func TestBanner(t *testing.T) {
+	ds := test.NewStore()
+	server, logbuf, teardown := setupSMTPServerConfig(ds, func(c *config.SMTP) {
+		c.Banner = "{hostname} ESMTP Test {version} at {date}"
+	})
+	defer teardown()
+	defer func(v string) { config.Version = v }(config.Version)
+	config.Version = "v1.2.3"
+
+	pipe := setupSMTPSession(server)
+	c := textproto.NewConn(pipe)
+	_, msg, err := c.ReadCodeLine(220)
+	if err != nil {
+		t.Fatalf("Expected a 220 greeting, got %v", err)
+	}
+	const prefix = "inbucket.local ESMTP Test v1.2.3 at "
+	if !strings.HasPrefix(msg, prefix) {
+		t.Errorf("Got greeting %q, want prefix: %q", msg, prefix)
+	} else if date, err := time.Parse(time.RFC1123Z, msg[len(prefix):]); err != nil {
+		t.Errorf("Got unparsable date in greeting %q: %v", msg, err)
+	} else if time.Since(date) > time.Minute {
+		t.Errorf("Got date %v in greeting, want current time", date)
+	}
+	if err := playScriptAgainst(t, c, []scriptStep{{"HELO localhost", 250}}); err != nil {
+		t.Error(err)
+	}
+	_ = pipe.Close()
+
+	if t.Failed() {
+		// Wait for handler to finish logging
+		time.Sleep(2 * time.Second)
+		// Dump buffered log data if there was a failure
+		_, _ = io.Copy(os.Stderr, logbuf)
+	}
+}
+
+func TestExpandBanner(t *testing.T) {
+	date := time.Date(2020, time.March, 4, 5, 6, 7, 0, time.UTC)
+	testCases := []struct {
+		banner, version, want string
+	}{
+		{"", "v3.0.0", "mx.example.com ESMTP Inbucket v3.0.0 ready Wed, 04 Mar 2020 05:06:07 +0000"},
+		{"{hostname} ready", "v3.0.0", "mx.example.com ready"},
+		{"Inbucket {version}", "", "Inbucket undefined"},
+		{"{date} {date}", "", "Wed, 04 Mar 2020 05:06:07 +0000 Wed, 04 Mar 2020 05:06:07 +0000"},
+		{"{unknown}\r\n250 injected", "", "{unknown}  250 injected"},
+	}
+	for _, tc := range testCases {
+		got := expandBanner(tc.banner, "mx.example.com", tc.version, date)
+		if got != tc.want {
+			t.Errorf("Got %q for banner %q, want: %q", got, tc.banner, tc.want)
+		}
+	}
+}
+
 // Test commands in DATA state
 func TestDataState(t *testing.T) {
 	mds := test.NewStore()
@@ -350,6 +463,898 @@ Hi! Can you still deliver this?
 	}
 }
 
+// quotaStore is a Store with every mailbox over quota.
+type quotaStore struct {
+	storage.Store
+}
+
+func (s *quotaStore) AddMessage(ctx context.Context, m storage.Message) (string, error) {
+	return "", storage.ErrQuotaExceeded
+}
+
+// Test delivery to a mailbox over quota
+func TestMailboxQuota(t *testing.T) {
+	server, logbuf, teardown := setupSMTPServerConfig(&quotaStore{test.NewStore()},
+		func(c *config.SMTP) {
+			c.DefaultStore = true
+		})
+	defer teardown()
+
+	pipe := setupSMTPSession(server)
+	c := textproto.NewConn(pipe)
+	if code, _, err := c.ReadCodeLine(220); err != nil {
+		t.Errorf("Expected a 220 greeting, got %v", code)
+	}
+	script := []scriptStep{
+		{"HELO localhost", 250},
+		{"MAIL FROM:<john@gmail.com>", 250},
+		{"RCPT TO:<u1@gmail.com>", 250},
+		{"DATA", 354},
+	}
+	if err := playScriptAgainst(t, c, script); err != nil {
+		t.Error(err)
+	}
+	dw := c.DotWriter()
+	_, _ = io.WriteString(dw, "To: u1@gmail.com\r\nSubject: test\r\n\r\nHi!\r\n")
+	_ = dw.Close()
+	if code, msg, err := c.ReadCodeLine(452); err != nil || msg != "4.2.2 Mailbox full" {
+		t.Errorf("Expected 452 4.2.2 Mailbox full, got %v %v", code, msg)
+	}
+
+	if t.Failed() {
+		// Wait for handler to finish logging
+		time.Sleep(2 * time.Second)
+		// Dump buffered log data if there was a failure
+		_, _ = io.Copy(os.Stderr, logbuf)
+	}
+}
+
+// Test AUTH command
+func TestAuth(t *testing.T) {
+	ds := test.NewStore()
+	server, logbuf, teardown := setupSMTPServerConfig(ds, func(c *config.SMTP) {
+		c.Username = "user"
+		c.Password = "secret"
+	})
+	defer teardown()
+
+	plain := base64.StdEncoding.EncodeToString([]byte("\x00user\x00secret"))
+	wrong := base64.StdEncoding.EncodeToString([]byte("\x00user\x00wrong"))
+	username := base64.StdEncoding.EncodeToString([]byte("user"))
+	password := base64.StdEncoding.EncodeToString([]byte("secret"))
+	scripts := [][]scriptStep{
+		// Authentication is optional.
+		{{"EHLO localhost", 250}, {"MAIL FROM:<john@gmail.com>", 250}},
+		// PLAIN with initial response.
+		{{"EHLO localhost", 250}, {"AUTH PLAIN " + plain, 235}, {"AUTH PLAIN " + plain, 503},
+			{"MAIL FROM:<john@gmail.com>", 250}},
+		// PLAIN with challenge.
+		{{"EHLO localhost", 250}, {"AUTH PLAIN", 334}, {plain, 235}},
+		// LOGIN with challenges.
+		{{"EHLO localhost", 250}, {"AUTH LOGIN", 334}, {username, 334}, {password, 235}},
+		// LOGIN with initial response.
+		{{"EHLO localhost", 250}, {"AUTH LOGIN " + username, 334}, {password, 235}},
+		// Failures.
+		{{"EHLO localhost", 250}, {"AUTH PLAIN " + wrong, 535}, {"AUTH PLAIN !!", 501},
+			{"AUTH PLAIN " + username, 501}, {"AUTH PLAIN", 334}, {"*", 501},
+			{"AUTH CRAM-MD5", 504}, {"AUTH", 501}, {"AUTH LOGIN", 334}, {username, 334},
+			{"*", 501}, {"MAIL FROM:<john@gmail.com>", 250}},
+		// AUTH is not accepted during a mail transaction.
+		{{"EHLO localhost", 250}, {"MAIL FROM:<john@gmail.com>", 250},
+			{"AUTH PLAIN " + plain, 503}},
+	}
+	for _, script := range scripts {
+		if err := playSession(t, server, script); err != nil {
+			t.Error(err)
+		}
+	}
+
+	if t.Failed() {
+		// Wait for handler to finish logging
+		time.Sleep(2 * time.Second)
+		// Dump buffered log data if there was a failure
+		_, _ = io.Copy(os.Stderr, logbuf)
+	}
+}
+
+// Test SIZE extension and message size limit
+func TestMessageSize(t *testing.T) {
+	ds := test.NewStore()
+	server, logbuf, teardown := setupSMTPServerConfig(ds, func(c *config.SMTP) {
+		c.DefaultStore = true
+	})
+	defer teardown()
+
+	pipe := setupSMTPSession(server)
+	c := textproto.NewConn(pipe)
+	if code, _, err := c.ReadCodeLine(220); err != nil {
+		t.Fatalf("Expected a 220 greeting, got %v: %v", code, err)
+	}
+	if msg := ehlo(t, c); !strings.HasSuffix(msg, "\nSIZE 5000") {
+		t.Errorf("EHLO response does not advertise SIZE 5000: %q", msg)
+	}
+	script := []scriptStep{
+		{"MAIL FROM:<john@gmail.com> SIZE=5001", 552},
+		{"MAIL FROM:<john@gmail.com> SIZE=5000", 250},
+		{"RCPT TO:<u1@gmail.com>", 250},
+		{"DATA", 354},
+	}
+	if err := playScriptAgainst(t, c, script); err != nil {
+		t.Fatal(err)
+	}
+	// Declared size is not trusted.
+	dw := c.DotWriter()
+	_, _ = io.WriteString(dw, "Subject: big\r\n\r\n"+strings.Repeat("0123456789\r\n", 500))
+	_ = dw.Close()
+	if code, msg, err := c.ReadCodeLine(552); err != nil {
+		t.Errorf("Expected 552 for oversized DATA, got %v: %q", code, msg)
+	}
+	// Session remains usable after rejection.
+	script = []scriptStep{
+		{"MAIL FROM:<john@gmail.com>", 250},
+		{"RCPT TO:<u1@gmail.com>", 250},
+		{"DATA", 354},
+		{"Subject: small\r\n\r\nHi\r\n.", 250},
+	}
+	if err := playScriptAgainst(t, c, script); err != nil {
+		t.Error(err)
+	}
+	_, _ = c.Cmd("QUIT")
+	_, _, _ = c.ReadCodeLine(221)
+	if msgs, _ := ds.GetMessages(context.Background(), "u1@gmail.com"); len(msgs) != 1 {
+		t.Errorf("Got %v delivered messages, want 1", len(msgs))
+	}
+
+	if t.Failed() {
+		// Wait for handler to finish logging
+		time.Sleep(2 * time.Second)
+		// Dump buffered log data if there was a failure
+		_, _ = io.Copy(os.Stderr, logbuf)
+	}
+}
+
+// Test BDAT command from CHUNKING extension
+func TestChunking(t *testing.T) {
+	ds := test.NewStore()
+	server, logbuf, teardown := setupSMTPServerConfig(ds, func(c *config.SMTP) {
+		c.DefaultStore = true
+	})
+	defer teardown()
+
+	pipe := setupSMTPSession(server)
+	c := textproto.NewConn(pipe)
+	if code, _, err := c.ReadCodeLine(220); err != nil {
+		t.Fatalf("Expected a 220 greeting, got %v: %v", code, err)
+	}
+	if msg := ehlo(t, c); !strings.Contains(msg, "\nCHUNKING\n") {
+		t.Errorf("EHLO response does not advertise CHUNKING: %q", msg)
+	}
+
+	// bdat sends a chunk and checks the response code.
+	bdat := func(chunk string, last bool, expect int) {
+		t.Helper()
+		cmd := fmt.Sprintf("BDAT %d", len(chunk))
+		if last {
+			cmd += " LAST"
+		}
+		_, _ = c.W.WriteString(cmd + "\r\n" + chunk)
+		if err := c.W.Flush(); err != nil {
+			t.Fatal(err)
+		}
+		if code, msg, err := c.ReadResponse(expect); err != nil {
+			t.Fatalf("Sent %q, expected %v, got %v: %q", cmd, expect, code, msg)
+		}
+	}
+	// Chunk data is consumed even when out of sequence.
+	bdat("QUIT\r\n", false, 503)
+	script := []scriptStep{
+		{"MAIL FROM:<john@gmail.com>", 250},
+		{"RCPT TO:<u1@gmail.com>", 250},
+	}
+	if err := playScriptAgainst(t, c, script); err != nil {
+		t.Fatal(err)
+	}
+	// Chunks are not dot-stuffed, and need not end on a line boundary.
+	chunks := []string{
+		"Subject: chunked\r\n\r\nFirst line\r\n.\r\n",
+		"..Second line\r\nbinary \x00\xff",
+		"\r\n",
+	}
+	bdat(chunks[0], false, 250)
+	if err := playScriptAgainst(t, c, []scriptStep{{"DATA", 503}}); err != nil {
+		t.Error(err)
+	}
+	bdat(chunks[1], false, 250)
+	bdat(chunks[2], true, 250)
+	msgs, _ := ds.GetMessages(context.Background(), "u1@gmail.com")
+	if len(msgs) != 1 {
+		t.Fatalf("Got %v delivered messages, want 1", len(msgs))
+	}
+	r, err := msgs[0].Source()
+	if err != nil {
+		t.Fatal(err)
+	}
+	source, _ := ioutil.ReadAll(r)
+	_ = r.Close()
+	want := strings.Join(chunks, "")
+	if !strings.HasPrefix(string(source), "Received: ") || !strings.HasSuffix(string(source), want) {
+		t.Errorf("Got message source %q, want Received header followed by %q", source, want)
+	}
+
+	// Oversized messages are rejected, and the session remains usable.
+	if err := playScriptAgainst(t, c, script); err != nil {
+		t.Fatal(err)
+	}
+	bdat(strings.Repeat("x", 3000), false, 250)
+	bdat(strings.Repeat("x", 3000), true, 552)
+	script = []scriptStep{
+		{"BDAT", 501},
+		{"BDAT 1 MORE", 501},
+		{"MAIL FROM:<john@gmail.com>", 250},
+		{"QUIT", 221},
+	}
+	if err := playScriptAgainst(t, c, script); err != nil {
+		t.Error(err)
+	}
+
+	if t.Failed() {
+		// Wait for handler to finish logging
+		time.Sleep(2 * time.Second)
+		// Dump buffered log data if there was a failure
+		_, _ = io.Copy(os.Stderr, logbuf)
+	}
+}
+
+// Test DSN parameters of MAIL and RCPT
+func TestDSN(t *testing.T) {
+	ds := test.NewStore()
+	server, logbuf, teardown := setupSMTPServerConfig(ds, func(c *config.SMTP) {
+		c.DefaultStore = true
+	})
+	defer teardown()
+
+	script := []scriptStep{
+		{"EHLO localhost", 250},
+		{"MAIL FROM:<john@gmail.com> RET=ALL", 501},
+		{"MAIL FROM:<john@gmail.com> ENVID=bad+ZZ", 501},
+		{"MAIL FROM:<john@gmail.com> RET=FULL ENVID=abc+2Bdef", 250},
+		{"RCPT TO:<u1@gmail.com> NOTIFY=NEVER,SUCCESS", 501},
+		{"RCPT TO:<u1@gmail.com> ORCPT=u1@gmail.com", 501},
+		{"RCPT TO:<u1@gmail.com> NOTIFY=SUCCESS,FAILURE ORCPT=rfc822;u1+40gmail.com", 250},
+		{"RCPT TO:<u2@gmail.com> NOTIFY=NEVER", 250},
+		{"DATA", 354},
+		{"Subject: dsn\r\n\r\nHi\r\n.", 250},
+	}
+	if err := playSession(t, server, script); err != nil {
+		t.Error(err)
+	}
+	msgs, _ := ds.GetMessages(context.Background(), "u1@gmail.com")
+	if len(msgs) != 1 {
+		t.Fatalf("Got %v delivered messages, want 1", len(msgs))
+	}
+	if got, want := msgs[0].EnvelopeID(), "abc+def"; got != want {
+		t.Errorf("Got envelope ID %q, want %q", got, want)
+	}
+
+	if t.Failed() {
+		// Wait for handler to finish logging
+		time.Sleep(2 * time.Second)
+		// Dump buffered log data if there was a failure
+		_, _ = io.Copy(os.Stderr, logbuf)
+	}
+}
+
+// Test address literals in EHLO, MAIL and RCPT
+func TestAddressLiteral(t *testing.T) {
+	ds := test.NewStore()
+	server, logbuf, teardown := setupSMTPServerConfig(ds, func(c *config.SMTP) {
+		c.DefaultStore = true
+	})
+	defer teardown()
+
+	script := []scriptStep{
+		{"EHLO [IPv6:2001:db8::zz]", 501},
+		{"EHLO [192.0.2.1", 501},
+		{"EHLO [IPv6:2001:db8::1]", 250},
+		{"MAIL FROM:<john@[IPv6:::ffff:192.0.2.1]>", 250},
+		{"RCPT TO:<u1@[IPv6:2001:DB8:0::1]>", 250},
+		{"RCPT TO:<u2@[192.0.2.1]>", 250},
+		{"RCPT TO:<u3@[IPv6:192.0.2.1]>", 501},
+		{"DATA", 354},
+		{"Subject: literal\r\n\r\nHi\r\n.", 250},
+	}
+	if err := playSession(t, server, script); err != nil {
+		t.Error(err)
+	}
+	for _, mailbox := range []string{"u1@[ipv6:2001:db8::1]", "u2@[192.0.2.1]"} {
+		if msgs, _ := ds.GetMessages(context.Background(), mailbox); len(msgs) != 1 {
+			t.Errorf("Got %v messages in %q, want 1", len(msgs), mailbox)
+		}
+	}
+
+	if t.Failed() {
+		// Wait for handler to finish logging
+		time.Sleep(2 * time.Second)
+		// Dump buffered log data if there was a failure
+		_, _ = io.Copy(os.Stderr, logbuf)
+	}
+}
+
+// Test AUTH over TCP when authentication is required
+func TestAuthRequired(t *testing.T) {
+	ds := test.NewStore()
+	server, logbuf, teardown := setupSMTPServerConfig(ds, func(c *config.SMTP) {
+		c.AuthRequired = true
+		// Unlike the pipe used by other tests, TCP connections honor deadlines.
+		c.Timeout = 5 * time.Second
+	})
+	defer teardown()
+	conn := setupTCPSession(t, server)
+	defer conn.Close()
+	c := textproto.NewConn(conn)
+	if code, _, err := c.ReadCodeLine(220); err != nil {
+		t.Fatalf("Expected a 220 greeting, got %v: %v", code, err)
+	}
+	if msg := ehlo(t, c); !strings.Contains(msg, "\nAUTH PLAIN LOGIN\n") {
+		t.Errorf("EHLO response does not advertise AUTH PLAIN LOGIN: %q", msg)
+	}
+	// No username is configured, so any credentials are accepted.
+	plain := base64.StdEncoding.EncodeToString([]byte("\x00anyone\x00anything"))
+	script := []scriptStep{
+		{"MAIL FROM:<john@gmail.com>", 530},
+		{"AUTH PLAIN " + plain, 235},
+		{"MAIL FROM:<john@gmail.com>", 250},
+		{"QUIT", 221},
+	}
+	if err := playScriptAgainst(t, c, script); err != nil {
+		t.Error(err)
+	}
+
+	if t.Failed() {
+		// Wait for handler to finish logging
+		time.Sleep(2 * time.Second)
+		// Dump buffered log data if there was a failure
+		_, _ = io.Copy(os.Stderr, logbuf)
+	}
+}
+
+// Test a complete session upgraded with STARTTLS
+func TestStartTLS(t *testing.T) {
+	dir, err := ioutil.TempDir("", "inbucket")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	ds := test.NewStore()
+	server, logbuf, teardown := setupSMTPServerConfig(ds, func(c *config.SMTP) {
+		c.DefaultStore = true
+		c.TLSEnabled = true
+		c.TLSRequired = true
+		c.TLSCert = filepath.Join(dir, "cert.crt")
+		c.TLSPrivKey = filepath.Join(dir, "cert.key")
+	})
+	defer teardown()
+
+	pipe := setupSMTPSession(server)
+	c := textproto.NewConn(pipe)
+	if code, _, err := c.ReadCodeLine(220); err != nil {
+		t.Fatalf("Expected a 220 greeting, got %v: %v", code, err)
+	}
+	if msg := ehlo(t, c); !strings.Contains(msg, "\nSTARTTLS\n") {
+		t.Errorf("EHLO response does not advertise STARTTLS: %q", msg)
+	}
+	script := []scriptStep{
+		{"MAIL FROM:<john@gmail.com>", 530},
+		{"STARTTLS", 220},
+	}
+	if err := playScriptAgainst(t, c, script); err != nil {
+		t.Fatal(err)
+	}
+
+	// Upgrade the client side of the pipe, the server expects a new EHLO.
+	tlsConn := tls.Client(pipe, &tls.Config{ServerName: "inbucket.local", InsecureSkipVerify: true})
+	defer tlsConn.Close()
+	c = textproto.NewConn(tlsConn)
+	script = []scriptStep{
+		{"MAIL FROM:<john@gmail.com>", 503},
+	}
+	if err := playScriptAgainst(t, c, script); err != nil {
+		t.Error(err)
+	}
+	if msg := ehlo(t, c); strings.Contains(msg, "STARTTLS") {
+		t.Errorf("EHLO response advertises STARTTLS after upgrade: %q", msg)
+	}
+	script = []scriptStep{
+		{"STARTTLS", 454},
+		{"MAIL FROM:<john@gmail.com>", 250},
+		{"RCPT TO:<u1@gmail.com>", 250},
+		{"DATA", 354},
+		{"Subject: secure\r\n\r\nHi\r\n.", 250},
+		{"QUIT", 221},
+	}
+	if err := playScriptAgainst(t, c, script); err != nil {
+		t.Error(err)
+	}
+	if !tlsConn.ConnectionState().HandshakeComplete {
+		t.Error("TLS handshake did not complete")
+	}
+	if msgs, _ := ds.GetMessages(context.Background(), "u1@gmail.com"); len(msgs) != 1 {
+		t.Errorf("Got %v delivered messages, want 1", len(msgs))
+	}
+
+	if t.Failed() {
+		// Wait for handler to finish logging
+		time.Sleep(2 * time.Second)
+		// Dump buffered log data if there was a failure
+		_, _ = io.Copy(os.Stderr, logbuf)
+	}
+}
+
+// ehlo sends EHLO and returns the capability lines of the response
+func ehlo(t *testing.T, c *textproto.Conn) string {
+	t.Helper()
+	id, err := c.Cmd("EHLO localhost")
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.StartResponse(id)
+	_, msg, err := c.ReadResponse(250)
+	c.EndResponse(id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return msg
+}
+
+// Test pipelined commands over TCP
+func TestPipelining(t *testing.T) {
+	ds := test.NewStore()
+	server, logbuf, teardown := setupSMTPServerConfig(ds, func(c *config.SMTP) {
+		c.DefaultStore = true
+		// Unlike the pipe used by other tests, TCP connections honor deadlines.
+		c.Timeout = 5 * time.Second
+	})
+	defer teardown()
+	conn := setupTCPSession(t, server)
+	defer conn.Close()
+	c := textproto.NewConn(conn)
+	if code, _, err := c.ReadCodeLine(220); err != nil {
+		t.Fatalf("Expected a 220 greeting, got %v: %v", code, err)
+	}
+
+	// expect reads a response for each of the pipelined commands.
+	expect := func(codes ...int) {
+		t.Helper()
+		for i, code := range codes {
+			if got, msg, err := c.ReadResponse(code); err != nil {
+				t.Fatalf("Response %d, expected %v, got %v: %q", i, code, got, msg)
+			}
+		}
+	}
+	_, err := io.WriteString(conn, "EHLO localhost\r\n"+
+		"MAIL FROM:<john@gmail.com>\r\n"+
+		"RCPT TO:<u1@gmail.com>\r\n"+
+		"DATA\r\n")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, msg, err := c.ReadResponse(250); err != nil {
+		t.Fatal(err)
+	} else if !strings.Contains(msg, "\nPIPELINING\n") {
+		t.Errorf("EHLO response does not advertise PIPELINING: %q", msg)
+	}
+	expect(250, 250, 354)
+
+	// Message data followed by a rolled back transaction.
+	_, err = io.WriteString(conn, "Subject: pipelined\r\n\r\nHi\r\n.\r\n"+
+		"MAIL FROM:<john@gmail.com>\r\n"+
+		"RSET\r\n"+
+		"RCPT TO:<u1@gmail.com>\r\n"+
+		"MAIL FROM:<jane@gmail.com>\r\n"+
+		"RCPT TO:<u2@gmail.com>\r\n"+
+		"QUIT\r\n")
+	if err != nil {
+		t.Fatal(err)
+	}
+	expect(250, 250, 250, 503, 250, 250, 221)
+	if msgs, _ := ds.GetMessages(context.Background(), "u1@gmail.com"); len(msgs) != 1 {
+		t.Errorf("Got %v delivered messages, want 1", len(msgs))
+	}
+
+	if t.Failed() {
+		// Wait for handler to finish logging
+		time.Sleep(2 * time.Second)
+		// Dump buffered log data if there was a failure
+		_, _ = io.Copy(os.Stderr, logbuf)
+	}
+}
+
+// TestVRFY verifies VRFY reports whether a mailbox exists only when enabled.
+func TestVRFY(t *testing.T) {
+	ds := test.NewStore()
+	existing := &message.Delivery{
+		Meta:   message.Metadata{Mailbox: "alice@example.com", ID: "1"},
+		Reader: strings.NewReader("Subject: first\r\n\r\nHi\r\n"),
+	}
+	if _, err := ds.AddMessage(context.Background(), existing); err != nil {
+		t.Fatal(err)
+	}
+	for _, enabled := range []bool{false, true} {
+		server, logbuf, teardown := setupSMTPServerConfig(ds, func(c *config.SMTP) {
+			c.VRFYEnabled = enabled
+		})
+		server.addrPolicy.MailboxExists = func(ctx context.Context, mailbox string) (bool, error) {
+			return storage.MailboxExists(ctx, ds, mailbox)
+		}
+		script := []scriptStep{
+			{"VRFY alice@example.com", 252},
+			{"VRFY nobody@example.com", 252},
+		}
+		if enabled {
+			script = []scriptStep{
+				{"VRFY alice@example.com", 250},
+				{"VRFY Alice <alice@example.com>", 250},
+				{"VRFY nobody@example.com", 550},
+				{"VRFY", 501},
+				{"VRFY not an address", 501},
+				{"HELO localhost", 250},
+				{"VRFY alice@example.com", 250},
+			}
+		}
+		if err := playSession(t, server, script); err != nil {
+			t.Errorf("VRFYEnabled %v: %v", enabled, err)
+		}
+		teardown()
+
+		if t.Failed() {
+			// Wait for handler to finish logging
+			time.Sleep(2 * time.Second)
+			// Dump buffered log data if there was a failure
+			_, _ = io.Copy(os.Stderr, logbuf)
+			return
+		}
+	}
+}
+
+// TestEXPN verifies EXPN expands valid mailbox names to themselves only when enabled.
+func TestEXPN(t *testing.T) {
+	ds := test.NewStore()
+	for _, enabled := range []bool{false, true} {
+		server, logbuf, teardown := setupSMTPServerConfig(ds, func(c *config.SMTP) {
+			c.EXPNEnabled = enabled
+		})
+		script := []scriptStep{{"EXPN user@example.com", 502}}
+		if enabled {
+			script = []scriptStep{
+				{"EXPN user@example.com", 250},
+				{"EXPN List <list@example.com>", 250},
+				{"EXPN @example.com", 550},
+				{"EXPN", 501},
+			}
+		}
+		if err := playSession(t, server, script); err != nil {
+			t.Errorf("EXPNEnabled %v: %v", enabled, err)
+		}
+		teardown()
+
+		if t.Failed() {
+			// Wait for handler to finish logging
+			time.Sleep(2 * time.Second)
+			// Dump buffered log data if there was a failure
+			_, _ = io.Copy(os.Stderr, logbuf)
+			return
+		}
+	}
+}
+
+// TestNOOPLimit verifies NOOPs are counted, and the session is closed after too many.
+func TestNOOPLimit(t *testing.T) {
+	ds := test.NewStore()
+	server, logbuf, teardown := setupSMTPServerConfig(ds, func(c *config.SMTP) {
+		c.MaxNOOPsPerSession = 2
+	})
+	defer teardown()
+	expBefore := expNoopsTotal.Value()
+	promBefore := testutil.ToFloat64(metric.SMTPNoops)
+
+	pipe := setupSMTPSession(server)
+	c := textproto.NewConn(pipe)
+	if code, _, err := c.ReadCodeLine(220); err != nil {
+		t.Fatalf("Expected a 220 greeting, got %v", code)
+	}
+	script := []scriptStep{
+		{"NOOP", 250},
+		{"HELO localhost", 250},
+		{"NOOP", 250},
+		{"NOOP", 421},
+	}
+	if err := playScriptAgainst(t, c, script); err != nil {
+		t.Error(err)
+	}
+	if line, err := c.ReadLine(); err == nil {
+		t.Errorf("Got %q after 421, want connection closed", line)
+	}
+	if got := expNoopsTotal.Value() - expBefore; got != 3 {
+		t.Errorf("Got NoopsTotal increase %v, want: 3", got)
+	}
+	if got := testutil.ToFloat64(metric.SMTPNoops) - promBefore; got != 3 {
+		t.Errorf("Got inbucket_smtp_noop_total increase %v, want: 3", got)
+	}
+
+	if t.Failed() {
+		// Wait for handler to finish logging
+		time.Sleep(2 * time.Second)
+		// Dump buffered log data if there was a failure
+		_, _ = io.Copy(os.Stderr, logbuf)
+	}
+}
+
+// TestDiscardDomains verifies mail for discarded domains is accepted, but not stored.
+func TestDiscardDomains(t *testing.T) {
+	ds := test.NewStore()
+	server, logbuf, teardown := setupSMTPServerConfig(ds, func(c *config.SMTP) {
+		c.DefaultStore = true
+		c.DiscardDomains = []string{"bounce.example"}
+	})
+	defer teardown()
+	before := expDroppedTotal.Value()
+	beforeReceived := expReceivedTotal.Value()
+
+	script := []scriptStep{
+		{"HELO localhost", 250},
+		{"MAIL FROM:<john@gmail.com>", 250},
+		{"RCPT TO:<no-reply@bounce.example>", 250},
+		{"RCPT TO:<postmaster@bounce.example>", 250},
+		{"DATA", 354},
+		{"Subject: bounce\r\n\r\nUndeliverable\r\n.", 250},
+	}
+	if err := playSession(t, server, script); err != nil {
+		t.Error(err)
+	}
+	msgs, err := ds.GetMessages(context.Background(), "no-reply@bounce.example")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(msgs) != 0 {
+		t.Errorf("Got %v messages, want: 0", len(msgs))
+	}
+	if got := expDroppedTotal.Value() - before; got != 1 {
+		t.Errorf("Got DroppedTotal increase %v, want: 1", got)
+	}
+	if got := expReceivedTotal.Value() - beforeReceived; got != 2 {
+		t.Errorf("Got ReceivedTotal increase %v, want: 2", got)
+	}
+
+	if t.Failed() {
+		// Wait for handler to finish logging
+		time.Sleep(2 * time.Second)
+		// Dump buffered log data if there was a failure
+		_, _ = io.Copy(os.Stderr, logbuf)
+	}
+}
+
+// TestCatchAll verifies recipients without a mailbox are routed to the catch-all mailbox.
+func TestCatchAll(t *testing.T) {
+	ds := test.NewStore()
+	server, logbuf, teardown := setupSMTPServerConfig(ds, func(c *config.SMTP) {
+		c.DefaultStore = true
+	})
+	defer teardown()
+	server.addrPolicy.Config.Mailbox.CatchAllMailbox = "catchall"
+	server.addrPolicy.MailboxExists = func(ctx context.Context, mailbox string) (bool, error) {
+		return storage.MailboxExists(ctx, ds, mailbox)
+	}
+	existing := &message.Delivery{
+		Meta:   message.Metadata{Mailbox: "alice@example.com", ID: "1"},
+		Reader: strings.NewReader("Subject: first\r\n\r\nHi\r\n"),
+	}
+	if _, err := ds.AddMessage(context.Background(), existing); err != nil {
+		t.Fatal(err)
+	}
+
+	script := []scriptStep{
+		{"HELO localhost", 250},
+		{"MAIL FROM:<john@gmail.com>", 250},
+		{"RCPT TO:<alice@example.com>", 250},
+		{"RCPT TO:<newbie@example.com>", 250},
+		{"DATA", 354},
+		{"Subject: test\r\n\r\nHi\r\n.", 250},
+	}
+	if err := playSession(t, server, script); err != nil {
+		t.Error(err)
+	}
+	for mailbox, want := range map[string]int{
+		"alice@example.com":  2,
+		"newbie@example.com": 0,
+		"catchall":           1,
+	} {
+		if msgs, _ := ds.GetMessages(context.Background(), mailbox); len(msgs) != want {
+			t.Errorf("Got %v messages in %v, want: %v", len(msgs), mailbox, want)
+		}
+	}
+
+	if t.Failed() {
+		// Wait for handler to finish logging
+		time.Sleep(2 * time.Second)
+		// Dump buffered log data if there was a failure
+		_, _ = io.Copy(os.Stderr, logbuf)
+	}
+}
+
+// TestConnRateLimit verifies connections beyond the per IP limit are rejected with 421.
+func TestConnRateLimit(t *testing.T) {
+	ds := test.NewStore()
+	server, logbuf, teardown := setupSMTPServerConfig(ds, func(c *config.SMTP) {
+		c.MaxConnsPerIPPerMinute = 10
+		c.Timeout = 5 * time.Second
+	})
+	defer teardown()
+	ln, err := net.Listen("tcp4", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	server.listener = ln
+	ctx, cancel := context.WithCancel(context.Background())
+	go server.serve(ctx)
+
+	var conns []*textproto.Conn
+	for i := 1; i <= 11; i++ {
+		conn, err := net.Dial("tcp4", ln.Addr().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		_ = conn.SetDeadline(time.Now().Add(5 * time.Second))
+		c := textproto.NewConn(conn)
+		conns = append(conns, c)
+		want := 220
+		if i == 11 {
+			want = 421
+		}
+		if code, msg, err := c.ReadCodeLine(want); err != nil {
+			t.Errorf("Connection %v: expected %v, got %v: %q", i, want, code, msg)
+		}
+	}
+	cancel()
+	_ = ln.Close()
+	for _, c := range conns {
+		_ = c.Close()
+	}
+	server.Drain()
+
+	if t.Failed() {
+		// Wait for handler to finish logging
+		time.Sleep(2 * time.Second)
+		// Dump buffered log data if there was a failure
+		_, _ = io.Copy(os.Stderr, logbuf)
+	}
+}
+
+// TestMessageRateLimit verifies messages beyond the per IP limit are rejected with 452.
+func TestMessageRateLimit(t *testing.T) {
+	ds := test.NewStore()
+	server, logbuf, teardown := setupSMTPServerConfig(ds, func(c *config.SMTP) {
+		c.DefaultStore = true
+		c.MaxMessagesPerIPPerMinute = 2
+	})
+	defer teardown()
+
+	send := []scriptStep{
+		{"MAIL FROM:<john@gmail.com>", 250},
+		{"RCPT TO:<u1@gmail.com>", 250},
+		{"DATA", 354},
+	}
+	script := []scriptStep{{"HELO localhost", 250}}
+	for _, want := range []int{250, 250, 452} {
+		script = append(script, send...)
+		script = append(script, scriptStep{"Subject: test\r\n\r\nHi\r\n.", want})
+	}
+	if err := playSession(t, server, script); err != nil {
+		t.Error(err)
+	}
+	if msgs, _ := ds.GetMessages(context.Background(), "u1@gmail.com"); len(msgs) != 2 {
+		t.Errorf("Got %v delivered messages, want 2", len(msgs))
+	}
+
+	if t.Failed() {
+		// Wait for handler to finish logging
+		time.Sleep(2 * time.Second)
+		// Dump buffered log data if there was a failure
+		_, _ = io.Copy(os.Stderr, logbuf)
+	}
+}
+
+// spfResolver serves a single SPF record for example.com.
+type spfResolver struct{}
+
+func (spfResolver) LookupTXT(ctx context.Context, name string) ([]string, error) {
+	if name == "example.com" {
+		return []string{"v=spf1 ip4:127.0.0.1 -all"}, nil
+	}
+	return nil, &net.DNSError{Err: "no such host", Name: name, IsNotFound: true}
+}
+
+func (spfResolver) LookupIPAddr(ctx context.Context, host string) ([]net.IPAddr, error) {
+	return nil, &net.DNSError{Err: "no such host", Name: host, IsNotFound: true}
+}
+
+func (spfResolver) LookupMX(ctx context.Context, name string) ([]*net.MX, error) {
+	return nil, &net.DNSError{Err: "no such host", Name: name, IsNotFound: true}
+}
+
+// TestSPFCheck verifies the SPF result is prepended as an Authentication-Results header and
+// recorded with the message.
+func TestSPFCheck(t *testing.T) {
+	ds := test.NewStore()
+	server, logbuf, teardown := setupSMTPServerConfig(ds, func(c *config.SMTP) {
+		c.DefaultStore = true
+		c.SPFCheckEnabled = true
+		c.Timeout = 5 * time.Second
+	})
+	defer teardown()
+	server.spfResolver = spfResolver{}
+
+	testCases := []struct {
+		helo, from, mailbox, header, result string
+	}{
+		{"localhost", "alice@example.com", "u1@gmail.com",
+			"Authentication-Results: inbucket.local;\r\n  spf=pass smtp.mailfrom=alice@example.com\r\n",
+			"pass"},
+		{"localhost", "bob@nospf.example.com", "u2@gmail.com",
+			"Authentication-Results: inbucket.local;\r\n  spf=none smtp.mailfrom=bob@nospf.example.com\r\n",
+			"none"},
+		// Null sender bounces are checked against the HELO domain.
+		{"example.com", "", "u3@gmail.com",
+			"Authentication-Results: inbucket.local;\r\n  spf=pass smtp.helo=example.com\r\n",
+			"pass"},
+	}
+	for _, tc := range testCases {
+		conn := setupTCPSession(t, server)
+		c := textproto.NewConn(conn)
+		if code, _, err := c.ReadCodeLine(220); err != nil {
+			t.Fatalf("Expected a 220 greeting, got %v: %v", code, err)
+		}
+		script := []scriptStep{
+			{"HELO " + tc.helo, 250},
+			{"MAIL FROM:<" + tc.from + ">", 250},
+			{"RCPT TO:<" + tc.mailbox + ">", 250},
+			{"DATA", 354},
+			{"Subject: test\r\n\r\nHi\r\n.", 250},
+			{"QUIT", 221},
+		}
+		if err := playScriptAgainst(t, c, script); err != nil {
+			t.Error(err)
+		}
+		_ = conn.Close()
+
+		msgs, _ := ds.GetMessages(context.Background(), tc.mailbox)
+		if len(msgs) != 1 {
+			t.Fatalf("Got %v messages in %v, want 1", len(msgs), tc.mailbox)
+		}
+		if got := msgs[0].SPFResult(); got != tc.result {
+			t.Errorf("Got SPF result %q, want: %q", got, tc.result)
+		}
+		r, err := msgs[0].Source()
+		if err != nil {
+			t.Fatal(err)
+		}
+		source, err := ioutil.ReadAll(r)
+		_ = r.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !strings.HasPrefix(string(source), tc.header+"Received: ") {
+			t.Errorf("Got source %q, want prefix: %q", source, tc.header)
+		}
+	}
+
+	if t.Failed() {
+		// Wait for handler to finish logging
+		time.Sleep(2 * time.Second)
+		// Dump buffered log data if there was a failure
+		_, _ = io.Copy(os.Stderr, logbuf)
+	}
+}
+
 // playSession creates a new session, reads the greeting and then plays the script
 func playSession(t *testing.T, server *Server, script []scriptStep) error {
 	pipe := setupSMTPSession(server)
@@ -403,6 +1408,12 @@ func (m *mockConn) SetReadDeadline(t time.Time) error  { return nil }
 func (m *mockConn) SetWriteDeadline(t time.Time) error { return nil }
 
 func setupSMTPServer(ds storage.Store) (s *Server, buf *bytes.Buffer, teardown func()) {
+	return setupSMTPServerConfig(ds, nil)
+}
+
+// setupSMTPServerConfig is setupSMTPServer, with configure applied to the SMTP configuration.
+func setupSMTPServerConfig(ds storage.Store, configure func(*config.SMTP)) (
+	s *Server, buf *bytes.Buffer, teardown func()) {
 	cfg := &config.Root{
 		MailboxNaming: config.FullNaming,
 		SMTP: config.SMTP{
@@ -415,6 +1426,9 @@ func setupSMTPServer(ds storage.Store) (s *Server, buf *bytes.Buffer, teardown f
 			Timeout:         5,
 		},
 	}
+	if configure != nil {
+		configure(&cfg.SMTP)
+	}
 	// Capture log output.
 	buf = new(bytes.Buffer)
 	log.SetOutput(buf)
@@ -431,6 +1445,34 @@ func setupSMTPServer(ds storage.Store) (s *Server, buf *bytes.Buffer, teardown f
 
 var sessionNum int
 
+// setupTCPSession starts a session for a TCP connection, and returns the client side of it.
+func setupTCPSession(t *testing.T, server *Server) net.Conn {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	server.wg.Add(1)
+	sessionNum++
+	id := sessionNum
+	go func() {
+		conn, err := ln.Accept()
+		_ = ln.Close()
+		if err != nil {
+			server.wg.Done()
+			return
+		}
+		server.startSession(id, conn)
+	}()
+	conn, err := net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		_ = ln.Close()
+		t.Fatal(err)
+	}
+	_ = conn.SetDeadline(time.Now().Add(5 * time.Second))
+	return conn
+}
+
 func setupSMTPSession(server *Server) net.Conn {
 	// Pair of pipes to communicate.
 	serverConn, clientConn := net.Pipe()
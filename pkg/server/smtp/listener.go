@@ -13,16 +13,21 @@ import (
 	"github.com/inbucket/inbucket/pkg/message"
 	"github.com/inbucket/inbucket/pkg/metric"
 	"github.com/inbucket/inbucket/pkg/policy"
+	"github.com/inbucket/inbucket/pkg/spf"
 	"github.com/rs/zerolog/log"
 )
 
 var (
 	// Raw stat collectors
-	expConnectsTotal   = new(expvar.Int)
-	expConnectsCurrent = new(expvar.Int)
-	expReceivedTotal   = new(expvar.Int)
-	expErrorsTotal     = new(expvar.Int)
-	expWarnsTotal      = new(expvar.Int)
+	expConnectsTotal      = new(expvar.Int)
+	expConnectsCurrent    = new(expvar.Int)
+	expReceivedTotal      = new(expvar.Int)
+	expErrorsTotal        = new(expvar.Int)
+	expWarnsTotal         = new(expvar.Int)
+	expRateLimitTotal     = new(expvar.Int)
+	expEventsDroppedTotal = new(expvar.Int)
+	expNoopsTotal         = new(expvar.Int)
+	expDroppedTotal       = new(expvar.Int)
 
 	// History of certain stats
 	deliveredHist = list.New()
@@ -48,6 +53,10 @@ func init() {
 	m.Set("ErrorsHist", expErrorsHist)
 	m.Set("WarnsTotal", expWarnsTotal)
 	m.Set("WarnsHist", expWarnsHist)
+	m.Set("RateLimitTotal", expRateLimitTotal)
+	m.Set("EventsDroppedTotal", expEventsDroppedTotal)
+	m.Set("NoopsTotal", expNoopsTotal)
+	m.Set("DroppedTotal", expDroppedTotal)
 	metric.AddTickerFunc(func() {
 		expReceivedHist.Set(metric.Push(deliveredHist, expReceivedTotal))
 		expConnectsHist.Set(metric.Push(connectsHist, expConnectsTotal))
@@ -65,6 +74,10 @@ type Server struct {
 	listener       net.Listener       // Incoming network connections.
 	wg             *sync.WaitGroup    // Waitgroup tracks individual sessions.
 	tlsConfig      *tls.Config
+	connLimiter    *ipLimiter   // Limits connections per remote IP, nil if unlimited.
+	msgLimiter     *ipLimiter   // Limits messages per remote IP, nil if unlimited.
+	spfResolver    spf.Resolver // Resolves SPF records, nil if SPF checks are disabled.
+	eventLog       *eventLog    // Records session events, nil if disabled.
 }
 
 // NewServer creates a new Server instance with the specificed config.
@@ -77,7 +90,14 @@ func NewServer(
 	slog := log.With().Str("module", "smtp").Str("phase", "tls").Logger()
 	tlsConfig := &tls.Config{}
 	if smtpConfig.TLSEnabled {
-		var err error
+		generated, err := ensureCertificate(
+			smtpConfig.TLSCert, smtpConfig.TLSPrivKey, smtpConfig.Domain)
+		if err != nil {
+			slog.Error().Msgf("Failed generating self-signed certificate: %v", err)
+		} else if generated {
+			slog.Info().Str("cert", smtpConfig.TLSCert).Str("key", smtpConfig.TLSPrivKey).
+				Msg("Generated self-signed certificate")
+		}
 		tlsConfig.Certificates = make([]tls.Certificate, 1)
 		tlsConfig.Certificates[0], err = tls.LoadX509KeyPair(smtpConfig.TLSCert, smtpConfig.TLSPrivKey)
 		if err != nil {
@@ -88,6 +108,20 @@ func NewServer(
 			slog.Debug().Msg("STARTTLS feature available")
 		}
 	}
+	if smtpConfig.TLSRequired && !smtpConfig.TLSEnabled {
+		slog.Warn().Msg("TLS is required, but STARTTLS is not available; all mail will be rejected")
+	}
+
+	elog, err := newEventLog(smtpConfig.EventLogPath, smtpConfig.EventLogMaxBytes)
+	if err != nil {
+		log.Error().Str("module", "smtp").Str("phase", "startup").Err(err).
+			Str("path", smtpConfig.EventLogPath).Msg("Failed to open event log, disabling it")
+	}
+
+	var spfResolver spf.Resolver
+	if smtpConfig.SPFCheckEnabled {
+		spfResolver = net.DefaultResolver
+	}
 
 	return &Server{
 		config:         smtpConfig,
@@ -96,6 +130,10 @@ func NewServer(
 		addrPolicy:     apolicy,
 		wg:             new(sync.WaitGroup),
 		tlsConfig:      tlsConfig,
+		connLimiter:    newIPLimiter(smtpConfig.MaxConnsPerIPPerMinute),
+		msgLimiter:     newIPLimiter(smtpConfig.MaxMessagesPerIPPerMinute),
+		spfResolver:    spfResolver,
+		eventLog:       elog,
 	}
 }
 
@@ -117,6 +155,9 @@ func (s *Server) Start(ctx context.Context) {
 	}
 	// Listener go routine.
 	go s.serve(ctx)
+	if s.connLimiter != nil || s.msgLimiter != nil {
+		go cleanupLimiters(ctx, s.connLimiter, s.msgLimiter)
+	}
 	// Wait for shutdown.
 	<-ctx.Done()
 	slog = log.With().Str("module", "smtp").Str("phase", "shutdown").Logger()
@@ -163,12 +204,27 @@ func (s *Server) serve(ctx context.Context) {
 		} else {
 			tempDelay = 0
 			expConnectsTotal.Add(1)
+			host, _, _ := net.SplitHostPort(conn.RemoteAddr().String())
+			if !s.connLimiter.Allow(host) {
+				s.rejectConn(conn)
+				continue
+			}
 			s.wg.Add(1)
 			go s.startSession(sessionID, conn)
 		}
 	}
 }
 
+// rejectConn refuses a connection from a remote host which has exceeded its connection rate limit.
+func (s *Server) rejectConn(conn net.Conn) {
+	expRateLimitTotal.Add(1)
+	log.Warn().Str("module", "smtp").Str("remote", conn.RemoteAddr().String()).
+		Msg("Rejected connection, rate limit exceeded")
+	_ = conn.SetWriteDeadline(time.Now().Add(time.Second))
+	_, _ = conn.Write([]byte("421 4.7.0 Too many connections\r\n"))
+	_ = conn.Close()
+}
+
 func (s *Server) emergencyShutdown() {
 	// Shutdown Inbucket.
 	select {
@@ -182,5 +238,6 @@ func (s *Server) emergencyShutdown() {
 func (s *Server) Drain() {
 	// Wait for sessions to close.
 	s.wg.Wait()
+	s.eventLog.Close()
 	log.Debug().Str("module", "smtp").Str("phase", "shutdown").Msg("SMTP connections have drained")
 }
@@ -0,0 +1,86 @@
+package smtp
+
+import (
+	"context"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"golang.org/x/time/rate"
+)
+
+// limiterIdle is how long a bucket must be unused before it is removed by cleanup, it must be at
+// least the time taken to refill an empty bucket.
+const limiterIdle = time.Minute
+
+// ipLimiter applies a token bucket rate limit to each remote IP address.  A nil ipLimiter allows
+// all events.
+type ipLimiter struct {
+	limit   rate.Limit
+	burst   int
+	buckets sync.Map // Remote IP string to *ipBucket.
+}
+
+// ipBucket is the rate limiter for a single remote IP address.
+type ipBucket struct {
+	limiter  *rate.Limiter
+	lastSeen int64 // Unix nanoseconds of the last event, accessed atomically.
+}
+
+// newIPLimiter creates an ipLimiter allowing perMinute events per IP address in any minute, or
+// returns nil if perMinute is not positive.
+func newIPLimiter(perMinute int) *ipLimiter {
+	if perMinute <= 0 {
+		return nil
+	}
+	return &ipLimiter{
+		limit: rate.Limit(float64(perMinute) / time.Minute.Seconds()),
+		burst: perMinute,
+	}
+}
+
+// Allow reports whether an event from ip may happen now, consuming a token if so.
+func (l *ipLimiter) Allow(ip string) bool {
+	if l == nil {
+		return true
+	}
+	now := time.Now()
+	v, ok := l.buckets.Load(ip)
+	if !ok {
+		v, _ = l.buckets.LoadOrStore(ip, &ipBucket{limiter: rate.NewLimiter(l.limit, l.burst)})
+	}
+	b := v.(*ipBucket)
+	atomic.StoreInt64(&b.lastSeen, now.UnixNano())
+	return b.limiter.AllowN(now, 1)
+}
+
+// cleanup removes buckets which have been idle long enough to have refilled, as they are
+// equivalent to a new bucket.
+func (l *ipLimiter) cleanup(now time.Time) {
+	if l == nil {
+		return
+	}
+	cutoff := now.Add(-limiterIdle).UnixNano()
+	l.buckets.Range(func(k, v interface{}) bool {
+		if atomic.LoadInt64(&v.(*ipBucket).lastSeen) < cutoff {
+			l.buckets.Delete(k)
+		}
+		return true
+	})
+}
+
+// cleanupLimiters periodically removes idle buckets from the limiters until ctx is canceled.
+func cleanupLimiters(ctx context.Context, limiters ...*ipLimiter) {
+	ticker := time.NewTicker(limiterIdle)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case now := <-ticker.C:
+			for _, l := range limiters {
+				l.cleanup(now)
+			}
+		}
+	}
+}
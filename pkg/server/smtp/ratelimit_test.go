@@ -0,0 +1,31 @@
+package smtp
+
+import (
+	"testing"
+	"time"
+)
+
+func TestIPLimiter(t *testing.T) {
+	if l := newIPLimiter(0); l != nil || !l.Allow("10.0.0.1") {
+		t.Fatal("Expected nil limiter to allow all events")
+	}
+	l := newIPLimiter(2)
+	for i, want := range []bool{true, true, false} {
+		if got := l.Allow("10.0.0.1"); got != want {
+			t.Errorf("Event %v got %v, want: %v", i+1, got, want)
+		}
+	}
+	if !l.Allow("10.0.0.2") {
+		t.Error("Expected separate bucket for each IP")
+	}
+
+	// Idle buckets are removed.
+	l.cleanup(time.Now())
+	if _, ok := l.buckets.Load("10.0.0.1"); !ok {
+		t.Error("Active bucket was removed")
+	}
+	l.cleanup(time.Now().Add(limiterIdle + time.Second))
+	if _, ok := l.buckets.Load("10.0.0.1"); ok {
+		t.Error("Idle bucket was not removed")
+	}
+}
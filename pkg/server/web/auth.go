@@ -0,0 +1,69 @@
+package web
+
+import (
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/json"
+	"net"
+	"net/http"
+	"strings"
+
+	"github.com/rs/zerolog/log"
+)
+
+// constantTimeCompare is replaced by tests to count comparisons.
+var constantTimeCompare = subtle.ConstantTimeCompare
+
+// APIAuth is middleware which requires an `Authorization: Bearer <key>` header matching one of
+// config.Web.APIKeys, if any are configured.  Requests from loopback addresses are allowed without
+// a key if config.Web.APIAuthBypassLoopback is set, the client address is found by RemoteIP.
+func APIAuth(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if rootConfig == nil || len(rootConfig.Web.APIKeys) == 0 {
+			next.ServeHTTP(w, req)
+			return
+		}
+		if rootConfig.Web.APIAuthBypassLoopback && isLoopback(RemoteIP(req)) {
+			next.ServeHTTP(w, req)
+			return
+		}
+		key := ""
+		if auth := req.Header.Get("Authorization"); len(auth) > 7 &&
+			strings.EqualFold(auth[:7], "Bearer ") {
+			key = auth[7:]
+		}
+		if key == "" || !validAPIKey(key, rootConfig.Web.APIKeys) {
+			log.Info().Str("module", "web").Str("remote", RemoteIP(req)).
+				Str("path", req.RequestURI).Msg("Rejected unauthorized API request")
+			w.Header().Set("WWW-Authenticate", `Bearer realm="Inbucket API"`)
+			w.Header().Set("Content-Type", "application/json; charset=utf-8")
+			w.WriteHeader(http.StatusUnauthorized)
+			_ = json.NewEncoder(w).Encode(map[string]string{"error": "Unauthorized"})
+			return
+		}
+		next.ServeHTTP(w, req)
+	})
+}
+
+// validAPIKey returns true if key matches one of keys.  Every key is compared, and the
+// comparisons are of fixed length digests, so the time taken does not reveal which key matched
+// or how much of it.
+func validAPIKey(key string, keys []string) bool {
+	digest := sha256.Sum256([]byte(key))
+	match := 0
+	for _, k := range keys {
+		kd := sha256.Sum256([]byte(k))
+		match |= constantTimeCompare(digest[:], kd[:])
+	}
+	return match == 1
+}
+
+// isLoopback returns true if the host of addr is a loopback IP address.
+func isLoopback(addr string) bool {
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		host = addr
+	}
+	ip := net.ParseIP(host)
+	return ip != nil && ip.IsLoopback()
+}
@@ -0,0 +1,105 @@
+package web
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/inbucket/inbucket/pkg/config"
+)
+
+func TestAPIAuth(t *testing.T) {
+	handler := APIAuth(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	serve := func(remote, auth string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("GET", "/api/v1/mailbox/test", nil)
+		req.RemoteAddr = remote
+		if auth != "" {
+			req.Header.Set("Authorization", auth)
+		}
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, req)
+		return w
+	}
+	defer func(prev *config.Root) { rootConfig = prev }(rootConfig)
+
+	// Disabled.
+	rootConfig = &config.Root{}
+	if w := serve("192.0.2.1:1234", ""); w.Code != http.StatusNoContent {
+		t.Errorf("got status %v with auth disabled, want: %v", w.Code, http.StatusNoContent)
+	}
+
+	rootConfig = &config.Root{Web: config.Web{APIKeys: []string{"key-one", "key-two"}}}
+	testCases := []struct {
+		name, remote, auth string
+		want               int
+	}{
+		{"first key", "192.0.2.1:1234", "Bearer key-one", http.StatusNoContent},
+		{"second key", "192.0.2.1:1234", "Bearer key-two", http.StatusNoContent},
+		{"lowercase scheme", "192.0.2.1:1234", "bearer key-two", http.StatusNoContent},
+		{"wrong key", "192.0.2.1:1234", "Bearer key-three", http.StatusUnauthorized},
+		{"key prefix", "192.0.2.1:1234", "Bearer key-", http.StatusUnauthorized},
+		{"empty key", "192.0.2.1:1234", "Bearer ", http.StatusUnauthorized},
+		{"basic auth", "192.0.2.1:1234", "Basic a2V5LW9uZQ==", http.StatusUnauthorized},
+		{"no header", "192.0.2.1:1234", "", http.StatusUnauthorized},
+		{"loopback not bypassed", "127.0.0.1:1234", "", http.StatusUnauthorized},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			w := serve(tc.remote, tc.auth)
+			if w.Code != tc.want {
+				t.Errorf("got status %v, want: %v", w.Code, tc.want)
+			}
+			if w.Code != http.StatusUnauthorized {
+				return
+			}
+			if got, want := w.Body.String(), `{"error":"Unauthorized"}`+"\n"; got != want {
+				t.Errorf("got body %q, want: %q", got, want)
+			}
+			if got := w.Header().Get("WWW-Authenticate"); got == "" {
+				t.Error("got no WWW-Authenticate header")
+			}
+		})
+	}
+
+	// Loopback bypass.
+	rootConfig.Web.APIAuthBypassLoopback = true
+	for _, remote := range []string{"127.0.0.1:1234", "[::1]:1234"} {
+		if w := serve(remote, ""); w.Code != http.StatusNoContent {
+			t.Errorf("got status %v from %v, want: %v", w.Code, remote, http.StatusNoContent)
+		}
+	}
+	if w := serve("192.0.2.1:1234", ""); w.Code != http.StatusUnauthorized {
+		t.Errorf("got status %v from remote host, want: %v", w.Code, http.StatusUnauthorized)
+	}
+}
+
+func TestValidAPIKeyComparesAllKeys(t *testing.T) {
+	compare := constantTimeCompare
+	defer func() { constantTimeCompare = compare }()
+	calls := 0
+	lengths := make(map[int]bool)
+	constantTimeCompare = func(x, y []byte) int {
+		calls++
+		lengths[len(x)] = true
+		lengths[len(y)] = true
+		return compare(x, y)
+	}
+	keys := []string{"first", "second-key", "a-much-longer-third-key"}
+	for _, key := range []string{"first", "second-key", "a-much-longer-third-key", "wrong", ""} {
+		calls = 0
+		got := validAPIKey(key, keys)
+		if want := key != "wrong" && key != ""; got != want {
+			t.Errorf("validAPIKey(%q) got %v, want: %v", key, got, want)
+		}
+		// The number of comparisons must not depend on which key, if any, matched.
+		if calls != len(keys) {
+			t.Errorf("validAPIKey(%q) made %v comparisons, want: %v", key, calls, len(keys))
+		}
+	}
+	// Compared values must not reveal key lengths.
+	if len(lengths) != 1 {
+		t.Errorf("got compared lengths %v, want a single fixed length", lengths)
+	}
+}
@@ -0,0 +1,58 @@
+package web
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// ETag returns a quoted entity tag derived from values, which must together identify the content
+// of a response.
+func ETag(values ...string) string {
+	sum := sha256.Sum256([]byte(strings.Join(values, "\x00")))
+	return `"` + hex.EncodeToString(sum[:16]) + `"`
+}
+
+// CheckNotModified sets the ETag and, unless modified is zero, the Last-Modified header of the
+// response.  If the If-None-Match or If-Modified-Since headers of a GET or HEAD request show the
+// client already holds the response, it writes 304 Not Modified and returns true; the caller
+// must not write a body.  If-Modified-Since is ignored when If-None-Match is present.
+func CheckNotModified(w http.ResponseWriter, req *http.Request, etag string,
+	modified time.Time) bool {
+	w.Header().Set("ETag", etag)
+	if !modified.IsZero() {
+		w.Header().Set("Last-Modified", modified.UTC().Format(http.TimeFormat))
+	}
+	if req.Method != http.MethodGet && req.Method != http.MethodHead {
+		return false
+	}
+	if inm := req.Header.Get("If-None-Match"); inm != "" {
+		if !etagMatch(inm, etag) {
+			return false
+		}
+	} else {
+		ims, err := http.ParseTime(req.Header.Get("If-Modified-Since"))
+		if err != nil || modified.IsZero() || modified.Truncate(time.Second).After(ims) {
+			return false
+		}
+	}
+	h := w.Header()
+	h.Del("Content-Type")
+	h.Del("Content-Length")
+	w.WriteHeader(http.StatusNotModified)
+	return true
+}
+
+// etagMatch returns true if the If-None-Match header value lists etag, or is `*`.  Weak tags are
+// compared as if they were strong, as RFC 7232 requires for If-None-Match.
+func etagMatch(header, etag string) bool {
+	for _, tag := range strings.Split(header, ",") {
+		tag = strings.TrimPrefix(strings.TrimSpace(tag), "W/")
+		if tag == "*" || tag == strings.TrimPrefix(etag, "W/") {
+			return true
+		}
+	}
+	return false
+}
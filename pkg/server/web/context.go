@@ -8,6 +8,8 @@ import (
 	"github.com/inbucket/inbucket/pkg/config"
 	"github.com/inbucket/inbucket/pkg/message"
 	"github.com/inbucket/inbucket/pkg/msghub"
+	"github.com/inbucket/inbucket/pkg/pubsub"
+	"github.com/inbucket/inbucket/pkg/replication"
 )
 
 // Context is passed into every request handler function
@@ -15,10 +17,14 @@ import (
 type Context struct {
 	Vars       map[string]string
 	MsgHub     *msghub.Hub
+	Broker     *pubsub.Broker
 	Manager    message.Manager
 	RootConfig *config.Root
+	Config     *config.Current // Reloadable configuration, may be nil.
 	WebConfig  config.Web
 	IsJSON     bool
+	// ReplicationLog is the replication log of a primary, nil if this is not a primary.
+	ReplicationLog *replication.Log
 }
 
 // Close the Context (currently does nothing)
@@ -49,10 +55,14 @@ func NewContext(req *http.Request) (*Context, error) {
 	ctx := &Context{
 		Vars:       vars,
 		MsgHub:     msgHub,
+		Broker:     broker,
 		Manager:    manager,
 		RootConfig: rootConfig,
+		Config:     currentConfig,
 		WebConfig:  rootConfig.Web,
 		IsJSON:     headerMatch(req, "Accept", "application/json"),
+
+		ReplicationLog: replicationLog,
 	}
 	return ctx, nil
 }
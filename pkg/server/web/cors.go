@@ -0,0 +1,59 @@
+package web
+
+import (
+	"net/http"
+	"strings"
+)
+
+const (
+	// corsAllowMethods lists the methods used by the REST API.
+	corsAllowMethods = "GET, POST, PUT, PATCH, DELETE, OPTIONS"
+	// corsAllowHeaders lists the request headers understood by the REST API.
+	corsAllowHeaders = "Accept, Authorization, Content-Type, traceparent"
+	// corsMaxAge is how long, in seconds, browsers may cache a pre-flight response.
+	corsMaxAge = "600"
+)
+
+// CORS is middleware which allows cross-origin requests from the origins listed in
+// config.Web.CORSAllowedOrigins, `*` allows any origin.  Pre-flight requests from allowed origins
+// are answered directly, without calling next.  Requests without an Origin header, or from an
+// origin that is not allowed, are passed through without CORS headers.
+func CORS(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		origin := req.Header.Get("Origin")
+		if origin == "" || rootConfig == nil || !allowedOrigin(origin, rootConfig.Web.CORSAllowedOrigins) {
+			next.ServeHTTP(w, req)
+			return
+		}
+		h := w.Header()
+		h.Set("Access-Control-Allow-Origin", origin)
+		h.Add("Vary", "Origin")
+		if req.Method == http.MethodOptions && req.Header.Get("Access-Control-Request-Method") != "" {
+			// Pre-flight request.
+			h.Set("Access-Control-Allow-Methods", corsAllowMethods)
+			h.Set("Access-Control-Allow-Headers", corsAllowHeaders)
+			h.Set("Access-Control-Max-Age", corsMaxAge)
+			w.WriteHeader(http.StatusNoContent)
+			return
+		}
+		h.Set("Access-Control-Expose-Headers", RequestIDHeader)
+		next.ServeHTTP(w, req)
+	})
+}
+
+// PreflightHandler handles OPTIONS requests that were not answered by the CORS middleware.
+var PreflightHandler = http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+	w.Header().Set("Allow", corsAllowMethods)
+	http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+})
+
+// allowedOrigin returns true if origin exactly matches one of allowed, or allowed contains `*`.
+func allowedOrigin(origin string, allowed []string) bool {
+	for _, a := range allowed {
+		a = strings.TrimSpace(a)
+		if a == "*" || a == origin {
+			return true
+		}
+	}
+	return false
+}
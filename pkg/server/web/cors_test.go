@@ -0,0 +1,100 @@
+package web
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/inbucket/inbucket/pkg/config"
+)
+
+func TestCORS(t *testing.T) {
+	handler := CORS(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.WriteHeader(http.StatusTeapot)
+	}))
+	serve := func(method, origin string, preflight bool) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, "/api/v1/mailbox/test", nil)
+		if origin != "" {
+			req.Header.Set("Origin", origin)
+		}
+		if preflight {
+			req.Header.Set("Access-Control-Request-Method", "DELETE")
+		}
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, req)
+		return w
+	}
+	defer func(prev *config.Root) { rootConfig = prev }(rootConfig)
+	rootConfig = &config.Root{Web: config.Web{
+		CORSAllowedOrigins: []string{"http://dash.example.com", " http://other.example.com"},
+	}}
+
+	t.Run("preflight", func(t *testing.T) {
+		w := serve("OPTIONS", "http://dash.example.com", true)
+		if w.Code != http.StatusNoContent {
+			t.Errorf("got status %v, want: %v", w.Code, http.StatusNoContent)
+		}
+		want := map[string]string{
+			"Access-Control-Allow-Origin":  "http://dash.example.com",
+			"Access-Control-Allow-Methods": corsAllowMethods,
+			"Access-Control-Allow-Headers": corsAllowHeaders,
+			"Vary":                         "Origin",
+		}
+		for k, v := range want {
+			if got := w.Header().Get(k); got != v {
+				t.Errorf("got %v header %q, want: %q", k, got, v)
+			}
+		}
+	})
+
+	t.Run("allowed origin", func(t *testing.T) {
+		w := serve("GET", "http://other.example.com", false)
+		if w.Code != http.StatusTeapot {
+			t.Errorf("got status %v, want: %v", w.Code, http.StatusTeapot)
+		}
+		if got := w.Header().Get("Access-Control-Allow-Origin"); got != "http://other.example.com" {
+			t.Errorf("got Access-Control-Allow-Origin %q, want: %q", got, "http://other.example.com")
+		}
+		if got := w.Header().Get("Access-Control-Allow-Methods"); got != "" {
+			t.Errorf("got Access-Control-Allow-Methods %q on simple request, want none", got)
+		}
+	})
+
+	t.Run("unlisted origin", func(t *testing.T) {
+		for _, method := range []string{"GET", "OPTIONS"} {
+			w := serve(method, "http://evil.example.com", method == "OPTIONS")
+			if w.Code != http.StatusTeapot {
+				t.Errorf("%v got status %v, want: %v", method, w.Code, http.StatusTeapot)
+			}
+			if got := w.Header().Get("Access-Control-Allow-Origin"); got != "" {
+				t.Errorf("%v got Access-Control-Allow-Origin %q, want none", method, got)
+			}
+		}
+	})
+
+	t.Run("no origin", func(t *testing.T) {
+		rootConfig.Web.CORSAllowedOrigins = []string{"*"}
+		w := serve("GET", "", false)
+		if got := w.Header().Get("Access-Control-Allow-Origin"); got != "" {
+			t.Errorf("got Access-Control-Allow-Origin %q, want none", got)
+		}
+	})
+
+	t.Run("wildcard", func(t *testing.T) {
+		rootConfig.Web.CORSAllowedOrigins = []string{"*"}
+		for _, origin := range []string{"http://dash.example.com", "https://anything.test:8443"} {
+			w := serve("OPTIONS", origin, true)
+			if got := w.Header().Get("Access-Control-Allow-Origin"); got != origin {
+				t.Errorf("got Access-Control-Allow-Origin %q, want: %q", got, origin)
+			}
+		}
+	})
+
+	t.Run("disabled", func(t *testing.T) {
+		rootConfig.Web.CORSAllowedOrigins = nil
+		w := serve("GET", "http://dash.example.com", false)
+		if got := w.Header().Get("Access-Control-Allow-Origin"); got != "" {
+			t.Errorf("got Access-Control-Allow-Origin %q, want none", got)
+		}
+	})
+}
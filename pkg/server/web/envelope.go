@@ -0,0 +1,126 @@
+package web
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"mime"
+	"net"
+	"net/http"
+
+	"github.com/google/uuid"
+	"github.com/inbucket/inbucket/pkg/config"
+	"github.com/rs/zerolog/log"
+)
+
+// RequestIDHeader is the response header holding the ID of an enveloped request.
+const RequestIDHeader = "X-Request-Id"
+
+// envelope wraps JSON API responses when config.Web.APIResponseEnvelope is enabled.
+type envelope struct {
+	RequestID string          `json:"requestId"`
+	Version   string          `json:"version"`
+	Data      json.RawMessage `json:"data"`
+}
+
+// ResponseEnvelope is middleware which wraps JSON responses in an envelope holding a request ID
+// and the server version, if enabled by config.Web.APIResponseEnvelope.  The request ID is also
+// returned in the X-Request-Id header.  Other responses, such as errors, message sources, and
+// event streams, are passed through unchanged.
+func ResponseEnvelope(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if rootConfig == nil || !rootConfig.Web.APIResponseEnvelope {
+			next.ServeHTTP(w, req)
+			return
+		}
+		id := uuid.NewString()
+		w.Header().Set(RequestIDHeader, id)
+		ew := &envelopeWriter{ResponseWriter: w}
+		next.ServeHTTP(ew, req)
+		ew.finish(id)
+	})
+}
+
+// envelopeWriter buffers JSON responses so they can be wrapped in an envelope once the handler
+// returns, other responses are written through.
+type envelopeWriter struct {
+	http.ResponseWriter
+	started bool
+	status  int
+	buf     *bytes.Buffer // JSON response body, nil if the response is not JSON.
+}
+
+// WriteHeader buffers the status of JSON responses.
+func (ew *envelopeWriter) WriteHeader(status int) {
+	if ew.started {
+		ew.ResponseWriter.WriteHeader(status)
+		return
+	}
+	ew.started = true
+	ew.status = status
+	mediatype, _, _ := mime.ParseMediaType(ew.Header().Get("Content-Type"))
+	if mediatype == "application/json" {
+		ew.buf = new(bytes.Buffer)
+		return
+	}
+	ew.ResponseWriter.WriteHeader(status)
+}
+
+// Write buffers the body of JSON responses.
+func (ew *envelopeWriter) Write(p []byte) (int, error) {
+	if !ew.started {
+		ew.WriteHeader(http.StatusOK)
+	}
+	if ew.buf != nil {
+		return ew.buf.Write(p)
+	}
+	return ew.ResponseWriter.Write(p)
+}
+
+// Flush implements http.Flusher, it does nothing while a JSON response is being buffered.
+func (ew *envelopeWriter) Flush() {
+	if f, ok := ew.ResponseWriter.(http.Flusher); ok && ew.buf == nil {
+		f.Flush()
+	}
+}
+
+// Unwrap returns the wrapped ResponseWriter, for http.ResponseController.
+func (ew *envelopeWriter) Unwrap() http.ResponseWriter {
+	return ew.ResponseWriter
+}
+
+// Hijack implements http.Hijacker for WebSockets.
+func (ew *envelopeWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	hj, ok := ew.ResponseWriter.(http.Hijacker)
+	if !ok {
+		return nil, nil, errors.New("ResponseWriter does not implement http.Hijacker")
+	}
+	ew.started = true
+	return hj.Hijack()
+}
+
+// finish writes the buffered JSON response wrapped in an envelope.
+func (ew *envelopeWriter) finish(id string) {
+	if ew.buf == nil {
+		return
+	}
+	body, err := json.Marshal(&envelope{
+		RequestID: id,
+		Version:   config.Version,
+		Data:      bytes.TrimSpace(ew.buf.Bytes()),
+	})
+	if err != nil {
+		// Not valid JSON, send it as written.
+		log.Warn().Str("module", "web").Str("id", id).Err(err).
+			Msg("Unable to envelope JSON response")
+		body = ew.buf.Bytes()
+	} else {
+		body = append(body, '\n')
+	}
+	ew.Header().Del("Content-Length")
+	ew.ResponseWriter.WriteHeader(ew.status)
+	if _, err := ew.ResponseWriter.Write(body); err != nil {
+		log.Debug().Str("module", "web").Str("id", id).Err(err).Msg("Failed to write response")
+	}
+}
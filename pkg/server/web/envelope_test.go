@@ -0,0 +1,78 @@
+package web
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/inbucket/inbucket/pkg/config"
+)
+
+func TestResponseEnvelope(t *testing.T) {
+	handler := ResponseEnvelope(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		switch req.URL.Path {
+		case "/json":
+			w.Header().Set("Content-Type", "application/json; charset=utf-8")
+			w.WriteHeader(http.StatusCreated)
+			_, _ = w.Write([]byte(`{"id":"0001"}` + "\n"))
+		case "/text":
+			http.Error(w, "missing", http.StatusNotFound)
+		}
+	}))
+	serve := func(path string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, httptest.NewRequest("GET", path, nil))
+		return w
+	}
+	defer func(prev *config.Root, version string) {
+		rootConfig, config.Version = prev, version
+	}(rootConfig, config.Version)
+	config.Version = "1.2.3"
+
+	// Disabled.
+	rootConfig = &config.Root{}
+	w := serve("/json")
+	if got, want := w.Body.String(), `{"id":"0001"}`+"\n"; got != want {
+		t.Errorf("got body %q, want: %q", got, want)
+	}
+	if got := w.Header().Get(RequestIDHeader); got != "" {
+		t.Errorf("got %v header %q, want none", RequestIDHeader, got)
+	}
+
+	// Enabled.
+	rootConfig = &config.Root{Web: config.Web{APIResponseEnvelope: true}}
+	w = serve("/json")
+	if w.Code != http.StatusCreated {
+		t.Errorf("got status %v, want: %v", w.Code, http.StatusCreated)
+	}
+	var env struct {
+		RequestID string          `json:"requestId"`
+		Version   string          `json:"version"`
+		Data      json.RawMessage `json:"data"`
+	}
+	if err := json.Unmarshal(w.Body.Bytes(), &env); err != nil {
+		t.Fatalf("failed to decode %q: %v", w.Body, err)
+	}
+	if id := w.Header().Get(RequestIDHeader); id == "" || id != env.RequestID {
+		t.Errorf("got %v header %q, want requestId %q", RequestIDHeader, id, env.RequestID)
+	}
+	if env.Version != "1.2.3" {
+		t.Errorf("got version %q, want: %q", env.Version, "1.2.3")
+	}
+	if got, want := string(env.Data), `{"id":"0001"}`; got != want {
+		t.Errorf("got data %s, want: %s", got, want)
+	}
+	if serve("/json").Header().Get(RequestIDHeader) == env.RequestID {
+		t.Error("got same request ID for second request")
+	}
+
+	// Non-JSON responses are not enveloped.
+	w = serve("/text")
+	if w.Code != http.StatusNotFound || w.Body.String() != "missing\n" {
+		t.Errorf("got %v %q, want: 404 \"missing\\n\"", w.Code, w.Body)
+	}
+	if w.Header().Get(RequestIDHeader) == "" {
+		t.Errorf("got no %v header on error response", RequestIDHeader)
+	}
+}
@@ -1,14 +1,20 @@
 package web
 
 import (
+	"errors"
 	"html/template"
 	"net/http"
 	"os"
+	"strings"
 
 	"github.com/inbucket/inbucket/pkg/config"
 	"github.com/rs/zerolog/log"
+	"go.opentelemetry.io/otel/propagation"
 )
 
+// propagator extracts the W3C Trace Context of incoming requests.
+var propagator = propagation.TraceContext{}
+
 // Handler is a function type that handles an HTTP request in Inbucket.
 type Handler func(http.ResponseWriter, *http.Request, *Context) error
 
@@ -23,6 +29,9 @@ func (h Handler) ServeHTTP(w http.ResponseWriter, req *http.Request) {
 	}
 	defer ctx.Close()
 
+	// Continue the caller's trace, if any, in calls to the store.
+	req = req.WithContext(propagator.Extract(req.Context(), propagation.HeaderCarrier(req.Header)))
+
 	// Run the handler, grab the error, and report it.
 	err = h(w, req, ctx)
 	if err != nil {
@@ -36,7 +45,7 @@ func (h Handler) ServeHTTP(w http.ResponseWriter, req *http.Request) {
 // cookieHandler injects an HTTP cookie into the response.
 func cookieHandler(cookie *http.Cookie, next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
-		log.Debug().Str("module", "web").Str("remote", req.RemoteAddr).Str("proto", req.Proto).
+		log.Debug().Str("module", "web").Str("remote", RemoteIP(req)).Str("proto", req.Proto).
 			Str("method", req.Method).Str("path", req.RequestURI).Msg("Injecting cookie")
 		http.SetCookie(w, cookie)
 		next.ServeHTTP(w, req)
@@ -70,7 +79,7 @@ func fileHandler(name string) http.Handler {
 // returning specified statusCode to the client.
 func noMatchHandler(statusCode int, message string) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
-		log.Warn().Str("module", "web").Str("remote", req.RemoteAddr).Str("proto", req.Proto).
+		log.Warn().Str("module", "web").Str("remote", RemoteIP(req)).Str("proto", req.Proto).
 			Str("method", req.Method).Str("path", req.RequestURI).Msg(message)
 		w.WriteHeader(statusCode)
 	})
@@ -79,7 +88,7 @@ func noMatchHandler(statusCode int, message string) http.Handler {
 // requestLoggingWrapper returns middleware that logs client requests.
 func requestLoggingWrapper(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
-		log.Debug().Str("module", "web").Str("remote", req.RemoteAddr).Str("proto", req.Proto).
+		log.Debug().Str("module", "web").Str("remote", RemoteIP(req)).Str("proto", req.Proto).
 			Str("method", req.Method).Str("path", req.RequestURI).Msg("Request")
 		next.ServeHTTP(w, req)
 	})
@@ -94,11 +103,32 @@ func spaTemplateHandler(tmpl *template.Template, basePath string,
 		BasePath: basePath,
 	}
 	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		pushAssets(w, req, basePath, webConfig.PushAssets)
 		err := tmpl.Execute(w, tmplData)
 		if err != nil {
-			log.Error().Str("module", "web").Str("remote", req.RemoteAddr).Str("proto", req.Proto).
+			log.Error().Str("module", "web").Str("remote", RemoteIP(req)).Str("proto", req.Proto).
 				Str("method", req.Method).Str("path", req.RequestURI).Err(err).
 				Msg("Error rendering SPA index template")
 		}
 	})
 }
+
+// pushAssets initiates an HTTP/2 server push of each asset, a path relative to basePath.  Nothing
+// is pushed if the connection does not support it, such as HTTP/1.1 or a client with push
+// disabled.
+func pushAssets(w http.ResponseWriter, req *http.Request, basePath string, assets []string) {
+	pusher, ok := w.(http.Pusher)
+	if !ok || len(assets) == 0 {
+		return
+	}
+	for _, asset := range assets {
+		target := basePath + strings.TrimPrefix(strings.TrimSpace(asset), "/")
+		if err := pusher.Push(target, nil); err != nil {
+			if !errors.Is(err, http.ErrNotSupported) {
+				log.Debug().Str("module", "web").Str("remote", RemoteIP(req)).
+					Str("target", target).Err(err).Msg("HTTP/2 push failed")
+			}
+			return
+		}
+	}
+}
@@ -0,0 +1,93 @@
+package web
+
+import (
+	"crypto/tls"
+	"html/template"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"sync"
+	"testing"
+
+	"github.com/inbucket/inbucket/pkg/config"
+)
+
+// pushRecorder records the targets of HTTP/2 pushes, before passing them to the real Pusher.
+type pushRecorder struct {
+	http.ResponseWriter
+	mu      *sync.Mutex
+	targets *[]string
+}
+
+func (p pushRecorder) Push(target string, opts *http.PushOptions) error {
+	p.mu.Lock()
+	*p.targets = append(*p.targets, target)
+	p.mu.Unlock()
+	return p.ResponseWriter.(http.Pusher).Push(target, opts)
+}
+
+func TestSPATemplateHandlerPush(t *testing.T) {
+	tmpl := template.Must(template.New("index.html").Parse("index {{.BasePath}}"))
+	webConfig := config.Web{PushAssets: []string{"static/index.js", "/static/index.css"}}
+	spa := spaTemplateHandler(tmpl, "/inbucket/", webConfig)
+
+	var mu sync.Mutex
+	var targets []string
+	srv := httptest.NewUnstartedServer(http.HandlerFunc(
+		func(w http.ResponseWriter, req *http.Request) {
+			if _, ok := w.(http.Pusher); ok {
+				w = pushRecorder{ResponseWriter: w, mu: &mu, targets: &targets}
+			}
+			spa.ServeHTTP(w, req)
+		}))
+	srv.EnableHTTP2 = true
+	srv.TLS = &tls.Config{NextProtos: []string{"h2", "http/1.1"}}
+	srv.StartTLS()
+	defer srv.Close()
+
+	resp, err := srv.Client().Get(srv.URL + "/inbucket/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, _ := ioutil.ReadAll(resp.Body)
+	_ = resp.Body.Close()
+	if resp.ProtoMajor != 2 {
+		t.Fatalf("got protocol %v, want HTTP/2", resp.Proto)
+	}
+	if got, want := string(body), "index /inbucket/"; got != want {
+		t.Errorf("got body %q, want: %q", got, want)
+	}
+	// The Go client disables push, so only the first push is attempted before it is refused.
+	mu.Lock()
+	defer mu.Unlock()
+	if want := []string{"/inbucket/static/index.js"}; !reflect.DeepEqual(targets, want) {
+		t.Errorf("got pushes %q, want: %q", targets, want)
+	}
+}
+
+func TestPushAssets(t *testing.T) {
+	req := httptest.NewRequest("GET", "/", nil)
+
+	// HTTP/1.1 ResponseWriters do not implement http.Pusher, and must be left alone.
+	w := httptest.NewRecorder()
+	pushAssets(w, req, "/", []string{"static/index.js"})
+	if w.Code != http.StatusOK || w.Body.Len() != 0 {
+		t.Errorf("got status %v body %q, want untouched response", w.Code, w.Body)
+	}
+
+	var mu sync.Mutex
+	var targets []string
+	p := pushRecorder{ResponseWriter: fakePusher{w}, mu: &mu, targets: &targets}
+	pushAssets(p, req, "/base/", []string{"a.js", " /b.css"})
+	if want := []string{"/base/a.js", "/base/b.css"}; !reflect.DeepEqual(targets, want) {
+		t.Errorf("got pushes %q, want: %q", targets, want)
+	}
+}
+
+// fakePusher accepts every push.
+type fakePusher struct {
+	http.ResponseWriter
+}
+
+func (fakePusher) Push(string, *http.PushOptions) error { return nil }
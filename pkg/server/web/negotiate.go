@@ -0,0 +1,134 @@
+package web
+
+import (
+	"encoding/json"
+	"io"
+	"mime"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/vmihailenco/msgpack/v5"
+)
+
+// Encoding is the media type of a REST API request or response body.
+type Encoding string
+
+const (
+	// EncodingJSON is the default encoding.
+	EncodingJSON Encoding = "application/json"
+	// EncodingMsgpack is the MessagePack binary encoding.
+	EncodingMsgpack Encoding = "application/msgpack"
+)
+
+// contentType returns the Content-Type header value for the encoding.
+func (e Encoding) contentType() string {
+	if e == EncodingJSON {
+		return "application/json; charset=utf-8"
+	}
+	return string(e)
+}
+
+// NegotiateEncoding returns the response encoding preferred by the Accept header of req, JSON if
+// it has none.  It returns false if neither JSON nor msgpack is acceptable.
+func NegotiateEncoding(req *http.Request) (Encoding, bool) {
+	accept := req.Header.Get("Accept")
+	if strings.TrimSpace(accept) == "" {
+		return EncodingJSON, true
+	}
+	jsonQ := acceptQuality(accept, string(EncodingJSON))
+	msgpackQ := acceptQuality(accept, string(EncodingMsgpack))
+	if q := acceptQuality(accept, "application/x-msgpack"); q > msgpackQ {
+		msgpackQ = q
+	}
+	switch {
+	case jsonQ == 0 && msgpackQ == 0:
+		return "", false
+	case msgpackQ > jsonQ:
+		return EncodingMsgpack, true
+	}
+	return EncodingJSON, true
+}
+
+// acceptQuality returns the quality value the Accept header gives mediatype, using the most
+// specific media range that matches it.
+func acceptQuality(accept, mediatype string) float64 {
+	q, specificity := 0.0, -1
+	for _, r := range strings.Split(accept, ",") {
+		rangeType, params, err := mime.ParseMediaType(strings.TrimSpace(r))
+		if err != nil {
+			continue
+		}
+		s := -1
+		switch {
+		case rangeType == mediatype:
+			s = 2
+		case rangeType == "*/*":
+			s = 0
+		case strings.HasSuffix(rangeType, "/*") &&
+			strings.HasPrefix(mediatype, strings.TrimSuffix(rangeType, "*")):
+			s = 1
+		}
+		if s <= specificity {
+			continue
+		}
+		specificity, q = s, 1
+		if v, ok := params["q"]; ok {
+			if f, err := strconv.ParseFloat(v, 64); err == nil {
+				q = f
+			}
+		}
+	}
+	return q
+}
+
+// Negotiate is middleware which responds with 406 Not Acceptable to requests that accept neither
+// JSON nor msgpack, it should wrap handlers which respond using Render.
+func Negotiate(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if _, ok := NegotiateEncoding(req); !ok {
+			http.Error(w, "Response is only available as application/json or application/msgpack",
+				http.StatusNotAcceptable)
+			return
+		}
+		next.ServeHTTP(w, req)
+	})
+}
+
+// Render writes data using the encoding negotiated for req, JSON unless msgpack is preferred.
+func Render(w http.ResponseWriter, req *http.Request, data interface{}) error {
+	return RenderStatus(w, req, http.StatusOK, data)
+}
+
+// RenderStatus is Render with the specified HTTP status.
+func RenderStatus(w http.ResponseWriter, req *http.Request, status int, data interface{}) error {
+	enc, _ := NegotiateEncoding(req)
+	w.Header().Set("Content-Type", enc.contentType())
+	w.Header().Set("Expires", "-1")
+	w.WriteHeader(status)
+	if enc == EncodingMsgpack {
+		return NewMsgpackEncoder(w).Encode(data)
+	}
+	return json.NewEncoder(w).Encode(data)
+}
+
+// DecodeBody decodes the request body into v, as msgpack if that is its Content-Type, otherwise as
+// JSON.
+func DecodeBody(req *http.Request, v interface{}) error {
+	mediatype, _, _ := mime.ParseMediaType(req.Header.Get("Content-Type"))
+	if mediatype == string(EncodingMsgpack) || mediatype == "application/x-msgpack" {
+		dec := msgpack.NewDecoder(req.Body)
+		dec.SetCustomStructTag("json")
+		return dec.Decode(v)
+	}
+	return json.NewDecoder(req.Body).Decode(v)
+}
+
+// NewMsgpackEncoder returns a msgpack encoder which uses the json field names of structs, so both
+// encodings of a response have the same fields.
+func NewMsgpackEncoder(w io.Writer) *msgpack.Encoder {
+	enc := msgpack.NewEncoder(w)
+	enc.SetCustomStructTag("json")
+	enc.UseCompactInts(true)
+	return enc
+}
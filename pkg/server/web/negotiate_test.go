@@ -0,0 +1,116 @@
+package web
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/vmihailenco/msgpack/v5"
+)
+
+func TestNegotiateEncoding(t *testing.T) {
+	testCases := []struct {
+		accept string
+		want   Encoding
+		ok     bool
+	}{
+		{"", EncodingJSON, true},
+		{"application/json", EncodingJSON, true},
+		{"application/msgpack", EncodingMsgpack, true},
+		{"application/x-msgpack", EncodingMsgpack, true},
+		{"*/*", EncodingJSON, true},
+		{"application/*", EncodingJSON, true},
+		{"application/json, application/msgpack", EncodingJSON, true},
+		{"application/json;q=0.5, application/msgpack", EncodingMsgpack, true},
+		{"application/msgpack;q=0.5, */*;q=0.8", EncodingJSON, true},
+		{"text/html,application/xhtml+xml,*/*;q=0.8", EncodingJSON, true},
+		{"application/msgpack, application/json;q=0", EncodingMsgpack, true},
+		{"*/*, application/json;q=0", EncodingMsgpack, true},
+		{"text/plain", "", false},
+		{"application/xml, text/*", "", false},
+		{"*/*;q=0", "", false},
+	}
+	for _, tc := range testCases {
+		req := httptest.NewRequest("GET", "/", nil)
+		req.Header.Set("Accept", tc.accept)
+		got, ok := NegotiateEncoding(req)
+		if got != tc.want || ok != tc.ok {
+			t.Errorf("NegotiateEncoding(%q) got %q, %v, want: %q, %v",
+				tc.accept, got, ok, tc.want, tc.ok)
+		}
+	}
+}
+
+func TestNegotiate(t *testing.T) {
+	handler := Negotiate(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		_ = RenderStatus(w, req, http.StatusCreated, map[string]int{"n": 1})
+	}))
+	serve := func(accept string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("GET", "/", nil)
+		req.Header.Set("Accept", accept)
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, req)
+		return w
+	}
+
+	w := serve("text/plain")
+	if w.Code != http.StatusNotAcceptable {
+		t.Errorf("got status %v, want: %v", w.Code, http.StatusNotAcceptable)
+	}
+
+	w = serve("application/json")
+	if got, want := w.Header().Get("Content-Type"), "application/json; charset=utf-8"; got != want {
+		t.Errorf("got Content-Type %q, want: %q", got, want)
+	}
+	if got, want := w.Body.String(), `{"n":1}`+"\n"; got != want {
+		t.Errorf("got body %q, want: %q", got, want)
+	}
+
+	w = serve("application/msgpack")
+	if w.Code != http.StatusCreated {
+		t.Errorf("got status %v, want: %v", w.Code, http.StatusCreated)
+	}
+	if got, want := w.Header().Get("Content-Type"), "application/msgpack"; got != want {
+		t.Errorf("got Content-Type %q, want: %q", got, want)
+	}
+	var got map[string]int
+	if err := msgpack.Unmarshal(w.Body.Bytes(), &got); err != nil {
+		t.Fatal(err)
+	}
+	if got["n"] != 1 {
+		t.Errorf("got body %v, want: map[n:1]", got)
+	}
+}
+
+func TestDecodeBody(t *testing.T) {
+	type body struct {
+		Name string `json:"name"`
+	}
+	packed, err := msgpack.Marshal(map[string]string{"name": "msgpack"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	testCases := []struct {
+		contentType string
+		body        []byte
+		want        string
+	}{
+		{"", []byte(`{"name":"json"}`), "json"},
+		{"application/json", []byte(`{"name":"json"}`), "json"},
+		{"application/msgpack", packed, "msgpack"},
+		{"application/x-msgpack", packed, "msgpack"},
+	}
+	for _, tc := range testCases {
+		req := httptest.NewRequest("PUT", "/", bytes.NewReader(tc.body))
+		req.Header.Set("Content-Type", tc.contentType)
+		var got body
+		if err := DecodeBody(req, &got); err != nil {
+			t.Errorf("DecodeBody(%q) got error: %v", tc.contentType, err)
+			continue
+		}
+		if got.Name != tc.want {
+			t.Errorf("DecodeBody(%q) got name %q, want: %q", tc.contentType, got.Name, tc.want)
+		}
+	}
+}
@@ -0,0 +1,95 @@
+package web
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"strings"
+
+	"github.com/inbucket/inbucket/pkg/config"
+	"github.com/rs/zerolog/log"
+)
+
+// remoteIPKey is the request context key holding the client IP found by RealIP.
+type remoteIPKey struct{}
+
+// trustedProxies holds the parsed config.Web.TrustedProxyCIDRs.
+var trustedProxies []*net.IPNet
+
+// parseTrustedProxies parses the CIDRs and IPs of trusted reverse proxies, skipping invalid
+// entries.
+func parseTrustedProxies(values []string) []*net.IPNet {
+	var nets []*net.IPNet
+	for _, v := range values {
+		ipnet, err := config.ParseCIDR(v)
+		if err != nil {
+			log.Warn().Str("module", "web").Str("phase", "startup").Str("cidr", v).Err(err).
+				Msg("Ignoring invalid trusted proxy")
+			continue
+		}
+		nets = append(nets, ipnet)
+	}
+	return nets
+}
+
+// RealIP is middleware which finds the IP of the client, stored in the request context for
+// RemoteIP.  If the request came from a trusted proxy, the client is taken from the
+// X-Forwarded-For or X-Real-IP headers, otherwise the headers are ignored.
+func RealIP(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		ctx := context.WithValue(req.Context(), remoteIPKey{}, clientIP(req))
+		next.ServeHTTP(w, req.WithContext(ctx))
+	})
+}
+
+// RemoteIP returns the IP of the client which made the request, as found by RealIP.
+func RemoteIP(req *http.Request) string {
+	if ip, ok := req.Context().Value(remoteIPKey{}).(string); ok {
+		return ip
+	}
+	return clientIP(req)
+}
+
+// clientIP walks back through the proxies in X-Forwarded-For, starting with the peer, until it
+// finds an address that is not trusted; anything to the left of that may have been forged.
+func clientIP(req *http.Request) string {
+	host, _, err := net.SplitHostPort(req.RemoteAddr)
+	if err != nil {
+		host = req.RemoteAddr
+	}
+	if !trustedProxy(host) {
+		return host
+	}
+	if xff := req.Header.Values("X-Forwarded-For"); len(xff) > 0 {
+		hops := strings.Split(strings.Join(xff, ","), ",")
+		for i := len(hops) - 1; i >= 0; i-- {
+			hop := strings.TrimSpace(hops[i])
+			if net.ParseIP(hop) == nil {
+				break
+			}
+			host = hop
+			if !trustedProxy(hop) {
+				break
+			}
+		}
+		return host
+	}
+	if ip := strings.TrimSpace(req.Header.Get("X-Real-IP")); net.ParseIP(ip) != nil {
+		return ip
+	}
+	return host
+}
+
+// trustedProxy returns true if host is an IP within trustedProxies.
+func trustedProxy(host string) bool {
+	ip := net.ParseIP(host)
+	if ip == nil {
+		return false
+	}
+	for _, ipnet := range trustedProxies {
+		if ipnet.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,82 @@
+package web
+
+import (
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/inbucket/inbucket/pkg/config"
+)
+
+func TestRealIP(t *testing.T) {
+	defer func(prev []*net.IPNet) { trustedProxies = prev }(trustedProxies)
+	trustedProxies = parseTrustedProxies([]string{"10.0.0.0/8", "192.0.2.7", "bogus"})
+	if len(trustedProxies) != 2 {
+		t.Fatalf("got %v trusted proxies, want: 2", len(trustedProxies))
+	}
+
+	var got string
+	handler := RealIP(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		got = RemoteIP(req)
+	}))
+	testCases := []struct {
+		name, remote, xff, realIP, want string
+	}{
+		{"no headers", "10.0.0.1:1234", "", "", "10.0.0.1"},
+		{"one hop", "10.0.0.1:1234", "198.51.100.1", "", "198.51.100.1"},
+		{"two hops", "10.0.0.1:1234", "198.51.100.1, 192.0.2.7", "", "198.51.100.1"},
+		{"spoofed entry", "10.0.0.1:1234", "203.0.113.9, 198.51.100.1, 10.1.1.1", "",
+			"198.51.100.1"},
+		{"untrusted peer", "198.51.100.1:1234", "203.0.113.9", "203.0.113.9", "198.51.100.1"},
+		{"all trusted", "10.0.0.1:1234", "10.2.2.2, 10.1.1.1", "", "10.2.2.2"},
+		{"invalid hop", "10.0.0.1:1234", "garbage, 10.1.1.1", "", "10.1.1.1"},
+		{"real ip", "10.0.0.1:1234", "", "198.51.100.1", "198.51.100.1"},
+		{"invalid real ip", "10.0.0.1:1234", "", "garbage", "10.0.0.1"},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			req := httptest.NewRequest("GET", "/", nil)
+			req.RemoteAddr = tc.remote
+			if tc.xff != "" {
+				req.Header.Set("X-Forwarded-For", tc.xff)
+			}
+			if tc.realIP != "" {
+				req.Header.Set("X-Real-IP", tc.realIP)
+			}
+			handler.ServeHTTP(httptest.NewRecorder(), req)
+			if got != tc.want {
+				t.Errorf("got remote IP %q, want: %q", got, tc.want)
+			}
+		})
+	}
+}
+
+func TestRealIPLoopbackBypass(t *testing.T) {
+	defer func(prev *config.Root) { rootConfig = prev }(rootConfig)
+	defer func(prev []*net.IPNet) { trustedProxies = prev }(trustedProxies)
+	rootConfig = &config.Root{
+		Web: config.Web{APIKeys: []string{"key"}, APIAuthBypassLoopback: true}}
+	trustedProxies = parseTrustedProxies([]string{"127.0.0.1"})
+
+	handler := RealIP(APIAuth(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.WriteHeader(http.StatusNoContent)
+	})))
+	serve := func(xff string) int {
+		req := httptest.NewRequest("GET", "/api/v1/mailbox/test", nil)
+		req.RemoteAddr = "127.0.0.1:1234"
+		if xff != "" {
+			req.Header.Set("X-Forwarded-For", xff)
+		}
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, req)
+		return w.Code
+	}
+	if got := serve(""); got != http.StatusNoContent {
+		t.Errorf("got status %v from loopback, want: %v", got, http.StatusNoContent)
+	}
+	// A remote client behind a local proxy must not get the loopback bypass.
+	if got := serve("198.51.100.1"); got != http.StatusUnauthorized {
+		t.Errorf("got status %v from proxied client, want: %v", got, http.StatusUnauthorized)
+	}
+}
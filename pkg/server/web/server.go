@@ -3,9 +3,13 @@ package web
 
 import (
 	"context"
+	"crypto/tls"
+	"crypto/x509"
 	"encoding/json"
 	"expvar"
+	"fmt"
 	"html/template"
+	"io/ioutil"
 	"net"
 	"net/http"
 	"net/http/pprof"
@@ -18,13 +22,17 @@ import (
 	"github.com/inbucket/inbucket/pkg/config"
 	"github.com/inbucket/inbucket/pkg/message"
 	"github.com/inbucket/inbucket/pkg/msghub"
+	"github.com/inbucket/inbucket/pkg/pubsub"
+	"github.com/inbucket/inbucket/pkg/replication"
 	"github.com/inbucket/inbucket/pkg/stringutil"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
 	"github.com/rs/zerolog/log"
 )
 
 var (
 	// msgHub holds a reference to the message pub/sub system
 	msgHub  *msghub.Hub
+	broker  *pubsub.Broker
 	manager message.Manager
 
 	// Router is shared between httpd, webui and rest packages. It sends
@@ -32,17 +40,33 @@ var (
 	Router = mux.NewRouter()
 
 	rootConfig     *config.Root
+	currentConfig  *config.Current
+	replicationLog *replication.Log
 	server         *http.Server
 	listener       net.Listener
 	globalShutdown chan bool
 
 	// ExpWebSocketConnectsCurrent tracks the number of open WebSockets
 	ExpWebSocketConnectsCurrent = new(expvar.Int)
+
+	// ExpStreamConnectsCurrent tracks the number of open mailbox event streams
+	ExpStreamConnectsCurrent = new(expvar.Int)
 )
 
 func init() {
 	m := expvar.NewMap("http")
 	m.Set("WebSocketConnectsCurrent", ExpWebSocketConnectsCurrent)
+	m.Set("StreamConnectsCurrent", ExpStreamConnectsCurrent)
+}
+
+// SetCurrentConfig makes conf available to handlers, allowing the configuration to be reloaded.
+func SetCurrentConfig(conf *config.Current) {
+	currentConfig = conf
+}
+
+// SetReplicationLog makes the replication log of a primary available to handlers.
+func SetReplicationLog(l *replication.Log) {
+	replicationLog = l
 }
 
 // Initialize sets up things for unit tests or the Start() method.
@@ -50,14 +74,17 @@ func Initialize(
 	conf *config.Root,
 	shutdownChan chan bool,
 	mm message.Manager,
-	mh *msghub.Hub) {
+	mh *msghub.Hub,
+	ps *pubsub.Broker) {
 
 	rootConfig = conf
 	globalShutdown = shutdownChan
 
 	// NewContext() will use this DataStore for the web handlers.
 	msgHub = mh
+	broker = ps
 	manager = mm
+	trustedProxies = parseTrustedProxies(conf.Web.TrustedProxyCIDRs)
 
 	// Redirect requests to / if there is a base path configured.
 	prefix := stringutil.MakePathPrefixer(conf.Web.BasePath)
@@ -72,6 +99,7 @@ func Initialize(
 	log.Info().Str("module", "web").Str("phase", "startup").Str("path", conf.Web.UIDir).
 		Msg("Web UI content mapped")
 	Router.Handle(prefix("/debug/vars"), expvar.Handler())
+	Router.Handle(prefix("/metrics"), promhttp.Handler())
 	if conf.Web.PProf {
 		Router.HandleFunc(prefix("/debug/pprof/cmdline"), pprof.Cmdline)
 		Router.HandleFunc(prefix("/debug/pprof/profile"), pprof.Profile)
@@ -124,10 +152,20 @@ func Initialize(
 func Start(ctx context.Context) {
 	server = &http.Server{
 		Addr:         rootConfig.Web.Addr,
-		Handler:      requestLoggingWrapper(Router),
+		Handler:      RealIP(requestLoggingWrapper(Router)),
 		ReadTimeout:  60 * time.Second,
 		WriteTimeout: 60 * time.Second,
 	}
+	if rootConfig.Web.TLSEnabled {
+		tlsConfig, err := NewTLSConfig(rootConfig.Web)
+		if err != nil {
+			log.Error().Str("module", "web").Str("phase", "startup").Err(err).
+				Msg("HTTPS failed to load certificates")
+			emergencyShutdown()
+			return
+		}
+		server.TLSConfig = tlsConfig
+	}
 
 	// We don't use ListenAndServe because it lacks a way to close the listener
 	log.Info().Str("module", "web").Str("phase", "startup").Str("addr", server.Addr).
@@ -158,6 +196,54 @@ func Start(ctx context.Context) {
 	}
 }
 
+// NewTLSConfig loads the certificate for HTTPS.  If conf.AdminTLSClientCAFile is set, clients may
+// present a certificate signed by one of its CAs, which is required by the admin endpoints.  The
+// rest of the server is available without one.
+func NewTLSConfig(conf config.Web) (*tls.Config, error) {
+	cert, err := tls.LoadX509KeyPair(conf.TLSCert, conf.TLSPrivKey)
+	if err != nil {
+		return nil, err
+	}
+	tlsConfig := &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		NextProtos:   []string{"h2", "http/1.1"},
+	}
+	if conf.AdminTLSClientCAFile != "" {
+		pem, err := ioutil.ReadFile(conf.AdminTLSClientCAFile)
+		if err != nil {
+			return nil, err
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificates found in %v", conf.AdminTLSClientCAFile)
+		}
+		tlsConfig.ClientCAs = pool
+		tlsConfig.ClientAuth = tls.VerifyClientCertIfGiven
+	}
+	return tlsConfig, nil
+}
+
+// ClientCertName returns the common name of the verified client certificate of the request, or its
+// first DNS, email, or URI subject alternative name if it has no common name.  It returns an empty
+// string if the client did not present a verified certificate.
+func ClientCertName(req *http.Request) string {
+	if req.TLS == nil || len(req.TLS.VerifiedChains) == 0 || len(req.TLS.VerifiedChains[0]) == 0 {
+		return ""
+	}
+	cert := req.TLS.VerifiedChains[0][0]
+	switch {
+	case cert.Subject.CommonName != "":
+		return cert.Subject.CommonName
+	case len(cert.DNSNames) > 0:
+		return cert.DNSNames[0]
+	case len(cert.EmailAddresses) > 0:
+		return cert.EmailAddresses[0]
+	case len(cert.URIs) > 0:
+		return cert.URIs[0].String()
+	}
+	return cert.Subject.String()
+}
+
 func appConfigCookie(webConfig config.Web) *http.Cookie {
 	o := &jsonAppConfig{
 		BasePath:       webConfig.BasePath,
@@ -178,7 +264,12 @@ func appConfigCookie(webConfig config.Web) *http.Cookie {
 // serve begins serving HTTP requests
 func serve(ctx context.Context) {
 	// server.Serve blocks until we close the listener
-	err := server.Serve(listener)
+	var err error
+	if server.TLSConfig != nil {
+		err = server.ServeTLS(listener, "", "")
+	} else {
+		err = server.Serve(listener)
+	}
 
 	select {
 	case _ = <-ctx.Done():
@@ -0,0 +1,468 @@
+// Package spf evaluates Sender Policy Framework records, as specified by RFC 7208.
+package spf
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/url"
+	"strconv"
+	"strings"
+)
+
+// Result is the outcome of an SPF check, named as in the Authentication-Results header.
+type Result string
+
+const (
+	// None indicates the domain does not publish an SPF record, or could not be determined.
+	None Result = "none"
+	// Neutral indicates the domain makes no assertion about the sending host.
+	Neutral Result = "neutral"
+	// Pass indicates the sending host is authorized by the domain.
+	Pass Result = "pass"
+	// Fail indicates the sending host is not authorized by the domain.
+	Fail Result = "fail"
+	// SoftFail indicates the sending host is probably not authorized by the domain.
+	SoftFail Result = "softfail"
+	// TempError indicates a temporary DNS error prevented the check.
+	TempError Result = "temperror"
+	// PermError indicates the SPF record of the domain could not be interpreted.
+	PermError Result = "permerror"
+)
+
+// maxLookups is the limit on mechanisms and modifiers which query DNS, per RFC 7208 4.6.4.
+const maxLookups = 10
+
+// Resolver looks up the DNS records used by SPF checks; it is implemented by *net.Resolver.
+type Resolver interface {
+	LookupTXT(ctx context.Context, name string) ([]string, error)
+	LookupIPAddr(ctx context.Context, host string) ([]net.IPAddr, error)
+	LookupMX(ctx context.Context, name string) ([]*net.MX, error)
+}
+
+// Check evaluates the SPF policy of the domain of sender, the MAIL FROM address, for a message
+// sent from ip.  If sender is empty, as for bounce messages, the policy of the helo domain is
+// evaluated instead.  The ptr mechanism is treated as never matching.
+func Check(ctx context.Context, resolver Resolver, ip net.IP, helo, sender string) Result {
+	if ip == nil {
+		return None
+	}
+	if i := strings.LastIndexByte(sender, '@'); i < 0 || i == len(sender)-1 {
+		sender = "postmaster@" + helo
+	} else if i == 0 {
+		sender = "postmaster" + sender
+	}
+	c := &checker{ctx: ctx, resolver: resolver, ip: ip, helo: helo, sender: sender}
+	return c.checkHost(sender[strings.LastIndexByte(sender, '@')+1:])
+}
+
+// checker holds the state of a single SPF check.
+type checker struct {
+	ctx      context.Context
+	resolver Resolver
+	ip       net.IP
+	helo     string
+	sender   string
+	lookups  int
+}
+
+// term is a mechanism or modifier of an SPF record.
+type term struct {
+	qualifier Result
+	name      string // Lower case mechanism or modifier name.
+	value     string // Domain spec or network, with any CIDR lengths removed.
+	modifier  bool
+	cidr4     int
+	cidr6     int
+}
+
+var qualifiers = map[byte]Result{'+': Pass, '-': Fail, '~': SoftFail, '?': Neutral}
+
+// checkHost implements the check_host() function of RFC 7208 section 4.
+func (c *checker) checkHost(domain string) Result {
+	domain = strings.TrimSuffix(domain, ".")
+	if !validDomain(domain) {
+		return None
+	}
+	txts, err := c.resolver.LookupTXT(c.ctx, domain)
+	if err != nil {
+		if isNotFound(err) {
+			return None
+		}
+		return TempError
+	}
+	var record string
+	found := 0
+	for _, txt := range txts {
+		if lower := strings.ToLower(txt); lower == "v=spf1" || strings.HasPrefix(lower, "v=spf1 ") {
+			record = txt
+			found++
+		}
+	}
+	switch found {
+	case 0:
+		return None
+	case 1:
+	default:
+		return PermError
+	}
+	terms, err := parseRecord(record)
+	if err != nil {
+		return PermError
+	}
+	var redirect string
+	for _, t := range terms {
+		if t.modifier {
+			if t.name == "redirect" {
+				redirect = t.value
+			}
+			continue
+		}
+		match, result := c.match(t, domain)
+		if result != "" {
+			return result
+		}
+		if match {
+			return t.qualifier
+		}
+	}
+	if redirect != "" {
+		if c.lookups++; c.lookups > maxLookups {
+			return PermError
+		}
+		target, err := c.expand(redirect, domain)
+		if err != nil {
+			return PermError
+		}
+		result := c.checkHost(target)
+		if result == None {
+			return PermError
+		}
+		return result
+	}
+	return Neutral
+}
+
+// match evaluates mechanism t for domain.  A non-empty result is returned if evaluation must
+// stop with that result.
+func (c *checker) match(t *term, domain string) (match bool, result Result) {
+	switch t.name {
+	case "all":
+		return true, ""
+	case "ip4", "ip6":
+		_, network, err := net.ParseCIDR(t.value)
+		if err != nil {
+			return false, PermError
+		}
+		return network.Contains(c.ip), ""
+	}
+	if c.lookups++; c.lookups > maxLookups {
+		return false, PermError
+	}
+	target := domain
+	if t.value != "" {
+		var err error
+		if target, err = c.expand(t.value, domain); err != nil {
+			return false, PermError
+		}
+	}
+	switch t.name {
+	case "include":
+		switch c.checkHost(target) {
+		case Pass:
+			return true, ""
+		case TempError:
+			return false, TempError
+		case PermError, None:
+			return false, PermError
+		}
+		return false, ""
+	case "a", "exists":
+		return c.matchHost(target, t.name == "exists", t.cidr4, t.cidr6)
+	case "mx":
+		mxs, err := c.resolver.LookupMX(c.ctx, target)
+		if err != nil {
+			if isNotFound(err) {
+				return false, ""
+			}
+			return false, TempError
+		}
+		if len(mxs) > maxLookups {
+			return false, PermError
+		}
+		for _, mx := range mxs {
+			if match, result := c.matchHost(mx.Host, false, t.cidr4, t.cidr6); match ||
+				result != "" {
+				return match, result
+			}
+		}
+		return false, ""
+	case "ptr":
+		return false, ""
+	}
+	return false, PermError
+}
+
+// matchHost returns true if an address of host is within the CIDR prefix lengths of the checked
+// IP.  If exists is true, any IPv4 address of host is a match.
+func (c *checker) matchHost(host string, exists bool, cidr4, cidr6 int) (bool, Result) {
+	addrs, err := c.resolver.LookupIPAddr(c.ctx, host)
+	if err != nil {
+		if isNotFound(err) {
+			return false, ""
+		}
+		return false, TempError
+	}
+	for _, addr := range addrs {
+		if exists {
+			if addr.IP.To4() != nil {
+				return true, ""
+			}
+			continue
+		}
+		if sameNetwork(addr.IP, c.ip, cidr4, cidr6) {
+			return true, ""
+		}
+	}
+	return false, ""
+}
+
+// sameNetwork returns true if a and b are the same IP version, and share a prefix of cidr4 or
+// cidr6 bits.
+func sameNetwork(a, b net.IP, cidr4, cidr6 int) bool {
+	if a4, b4 := a.To4(), b.To4(); a4 != nil || b4 != nil {
+		mask := net.CIDRMask(cidr4, 32)
+		return a4 != nil && b4 != nil && a4.Mask(mask).Equal(b4.Mask(mask))
+	}
+	mask := net.CIDRMask(cidr6, 128)
+	return a.To16().Mask(mask).Equal(b.To16().Mask(mask))
+}
+
+// parseRecord parses the terms of an SPF record, following the v=spf1 version.
+func parseRecord(record string) ([]*term, error) {
+	var terms []*term
+	seen := make(map[string]bool)
+	for _, s := range strings.Fields(record)[1:] {
+		t := &term{qualifier: Pass, cidr4: 32, cidr6: 128}
+		if eq := strings.IndexByte(s, '='); eq > 0 && !strings.ContainsAny(s[:eq], ":/") {
+			t.modifier = true
+			t.name = strings.ToLower(s[:eq])
+			t.value = s[eq+1:]
+			if t.name == "redirect" || t.name == "exp" {
+				if seen[t.name] || t.value == "" {
+					return nil, fmt.Errorf("invalid %v modifier", t.name)
+				}
+				seen[t.name] = true
+			}
+			terms = append(terms, t)
+			continue
+		}
+		if q, ok := qualifiers[s[0]]; ok {
+			t.qualifier = q
+			s = s[1:]
+		}
+		t.name = strings.ToLower(s)
+		if i := strings.IndexAny(s, ":/"); i >= 0 {
+			t.name = strings.ToLower(s[:i])
+			s = s[i:]
+		} else {
+			s = ""
+		}
+		switch t.name {
+		case "all":
+			if s != "" {
+				return nil, fmt.Errorf("invalid all mechanism")
+			}
+		case "include", "exists", "ip4", "ip6":
+			if !strings.HasPrefix(s, ":") || len(s) == 1 {
+				return nil, fmt.Errorf("%v mechanism requires a value", t.name)
+			}
+			t.value = s[1:]
+			if t.name == "ip4" || t.name == "ip6" {
+				if !strings.Contains(t.value, "/") {
+					if t.name == "ip4" {
+						t.value += "/32"
+					} else {
+						t.value += "/128"
+					}
+				}
+				if _, _, err := net.ParseCIDR(t.value); err != nil {
+					return nil, err
+				}
+			}
+		case "a", "mx", "ptr":
+			var err error
+			if s, t.cidr4, t.cidr6, err = parseCIDRLengths(s); err != nil {
+				return nil, err
+			}
+			if strings.HasPrefix(s, ":") {
+				t.value = s[1:]
+			} else if s != "" {
+				return nil, fmt.Errorf("invalid %v mechanism", t.name)
+			}
+		default:
+			return nil, fmt.Errorf("unknown mechanism %q", t.name)
+		}
+		terms = append(terms, t)
+	}
+	return terms, nil
+}
+
+// parseCIDRLengths removes the IPv4 and IPv6 CIDR lengths from the end of s, returning the
+// defaults if they are not present.
+func parseCIDRLengths(s string) (rest string, cidr4, cidr6 int, err error) {
+	cidr4, cidr6 = 32, 128
+	if i := strings.Index(s, "//"); i >= 0 {
+		if cidr6, err = strconv.Atoi(s[i+2:]); err != nil || cidr6 < 0 || cidr6 > 128 {
+			return "", 0, 0, fmt.Errorf("invalid IPv6 CIDR length in %q", s)
+		}
+		s = s[:i]
+	}
+	if i := strings.LastIndexByte(s, '/'); i >= 0 {
+		if cidr4, err = strconv.Atoi(s[i+1:]); err != nil || cidr4 < 0 || cidr4 > 32 {
+			return "", 0, 0, fmt.Errorf("invalid IPv4 CIDR length in %q", s)
+		}
+		s = s[:i]
+	}
+	return s, cidr4, cidr6, nil
+}
+
+// expand expands the macros in the domain spec s, per RFC 7208 section 7.
+func (c *checker) expand(s, domain string) (string, error) {
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		if s[i] != '%' {
+			b.WriteByte(s[i])
+			continue
+		}
+		if i++; i >= len(s) {
+			return "", fmt.Errorf("truncated macro in %q", s)
+		}
+		switch s[i] {
+		case '%':
+			b.WriteByte('%')
+			continue
+		case '_':
+			b.WriteByte(' ')
+			continue
+		case '-':
+			b.WriteString("%20")
+			continue
+		case '{':
+		default:
+			return "", fmt.Errorf("invalid macro in %q", s)
+		}
+		end := strings.IndexByte(s[i:], '}')
+		if end < 2 {
+			return "", fmt.Errorf("invalid macro in %q", s)
+		}
+		value, err := c.macro(s[i+1:i+end], domain)
+		if err != nil {
+			return "", err
+		}
+		b.WriteString(value)
+		i += end
+	}
+	return b.String(), nil
+}
+
+// macro returns the value of a single macro, the text between the braces.
+func (c *checker) macro(spec, domain string) (string, error) {
+	letter := spec[0]
+	var value string
+	at := strings.LastIndexByte(c.sender, '@')
+	switch letter | 0x20 {
+	case 's':
+		value = c.sender
+	case 'l':
+		value = c.sender[:at]
+	case 'o':
+		value = c.sender[at+1:]
+	case 'd':
+		value = domain
+	case 'i':
+		value = dottedIP(c.ip)
+	case 'p':
+		value = "unknown"
+	case 'v':
+		value = "in-addr"
+		if c.ip.To4() == nil {
+			value = "ip6"
+		}
+	case 'h':
+		value = c.helo
+	default:
+		return "", fmt.Errorf("unknown macro letter %q", letter)
+	}
+	spec = spec[1:]
+	digits := 0
+	for digits < len(spec) && spec[digits] >= '0' && spec[digits] <= '9' {
+		digits++
+	}
+	keep := 0
+	if digits > 0 {
+		keep, _ = strconv.Atoi(spec[:digits])
+		if keep == 0 {
+			return "", fmt.Errorf("invalid macro transformer %q", spec)
+		}
+	}
+	spec = spec[digits:]
+	reverse := false
+	if strings.HasPrefix(spec, "r") || strings.HasPrefix(spec, "R") {
+		reverse = true
+		spec = spec[1:]
+	}
+	delims := "."
+	if spec != "" {
+		if strings.Trim(spec, ".-+,/_=") != "" {
+			return "", fmt.Errorf("invalid macro delimiters %q", spec)
+		}
+		delims = spec
+	}
+	parts := strings.FieldsFunc(value, func(r rune) bool { return strings.ContainsRune(delims, r) })
+	if reverse {
+		for i, j := 0, len(parts)-1; i < j; i, j = i+1, j-1 {
+			parts[i], parts[j] = parts[j], parts[i]
+		}
+	}
+	if keep > 0 && keep < len(parts) {
+		parts = parts[len(parts)-keep:]
+	}
+	value = strings.Join(parts, ".")
+	if letter >= 'A' && letter <= 'Z' {
+		value = url.QueryEscape(value)
+	}
+	return value, nil
+}
+
+// dottedIP formats ip for the i macro, IPv6 addresses are written as dotted nibbles.
+func dottedIP(ip net.IP) string {
+	if ip4 := ip.To4(); ip4 != nil {
+		return ip4.String()
+	}
+	nibbles := make([]string, 0, 32)
+	for _, b := range ip.To16() {
+		nibbles = append(nibbles, strconv.FormatUint(uint64(b>>4), 16),
+			strconv.FormatUint(uint64(b&0xf), 16))
+	}
+	return strings.Join(nibbles, ".")
+}
+
+// validDomain returns true if domain is a plausible fully qualified domain name.
+func validDomain(domain string) bool {
+	if len(domain) > 253 || !strings.Contains(domain, ".") {
+		return false
+	}
+	for _, label := range strings.Split(domain, ".") {
+		if label == "" || len(label) > 63 {
+			return false
+		}
+	}
+	return true
+}
+
+// isNotFound returns true if err indicates the name or record does not exist.
+func isNotFound(err error) bool {
+	dnsErr, ok := err.(*net.DNSError)
+	return ok && dnsErr.IsNotFound
+}
@@ -0,0 +1,189 @@
+package spf
+
+import (
+	"context"
+	"net"
+	"testing"
+)
+
+// stubResolver serves records from maps, names not present are not found.
+type stubResolver struct {
+	txt  map[string][]string
+	ip   map[string][]string
+	mx   map[string][]string
+	fail bool // Return temporary errors for all lookups.
+}
+
+func (r *stubResolver) lookup(name string) error {
+	if r.fail {
+		return &net.DNSError{Err: "timeout", Name: name, IsTimeout: true}
+	}
+	return &net.DNSError{Err: "no such host", Name: name, IsNotFound: true}
+}
+
+func (r *stubResolver) LookupTXT(ctx context.Context, name string) ([]string, error) {
+	if txts, ok := r.txt[name]; ok && !r.fail {
+		return txts, nil
+	}
+	return nil, r.lookup(name)
+}
+
+func (r *stubResolver) LookupIPAddr(ctx context.Context, host string) ([]net.IPAddr, error) {
+	ips, ok := r.ip[host]
+	if !ok || r.fail {
+		return nil, r.lookup(host)
+	}
+	addrs := make([]net.IPAddr, len(ips))
+	for i, ip := range ips {
+		addrs[i] = net.IPAddr{IP: net.ParseIP(ip)}
+	}
+	return addrs, nil
+}
+
+func (r *stubResolver) LookupMX(ctx context.Context, name string) ([]*net.MX, error) {
+	hosts, ok := r.mx[name]
+	if !ok || r.fail {
+		return nil, r.lookup(name)
+	}
+	mxs := make([]*net.MX, len(hosts))
+	for i, host := range hosts {
+		mxs[i] = &net.MX{Host: host, Pref: uint16(i)}
+	}
+	return mxs, nil
+}
+
+func TestCheck(t *testing.T) {
+	resolver := &stubResolver{
+		txt: map[string][]string{
+			"example.com": {"some verification token",
+				"v=spf1 ip4:192.0.2.0/24 ip6:2001:db8::/32 a:web.example.com/30 mx " +
+					"include:_spf.partner.net -all"},
+			"_spf.partner.net": {"v=spf1 ip4:198.51.100.7 ~all"},
+			"soft.example.com": {"v=spf1 ?ip4:203.0.113.1 ~all"},
+			"neutral.example":  {"v=spf1"},
+			"redirect.example": {"v=spf1 redirect=example.com"},
+			"macro.example":    {"v=spf1 exists:%{ir}.%{l1r-}.allow.example.com -all"},
+			"double.example":   {"v=spf1 -all", "v=spf1 +all"},
+			"bad.example":      {"v=spf1 ip4:192.0.2.300 -all"},
+			"unknown.example":  {"v=spf1 frobnicate -all"},
+			"broken.example":   {"v=spf1 include:missing.example -all"},
+			"helo.example":     {"v=spf1 a -all"},
+			"loop.example":     {"v=spf1 include:loop.example -all"},
+			"ptr.example":      {"v=spf1 ptr -all"},
+			"case.example":     {"V=SPF1 IP4:192.0.2.1 -ALL"},
+			"cidr6.example":    {"v=spf1 a//64 -all"},
+		},
+		ip: map[string][]string{
+			"web.example.com":                   {"203.0.113.9"},
+			"mail.example.com":                  {"198.51.100.20", "2001:db8:1::25"},
+			"helo.example":                      {"192.0.2.200"},
+			"cidr6.example":                     {"2001:db8:2::1"},
+			"9.113.0.203.bob.allow.example.com": {"127.0.0.2"},
+		},
+		mx: map[string][]string{
+			"example.com": {"mail.example.com"},
+		},
+	}
+	testCases := []struct {
+		name   string
+		ip     string
+		helo   string
+		sender string
+		want   Result
+	}{
+		{"ip4", "192.0.2.10", "", "alice@example.com", Pass},
+		{"ip6", "2001:db8::1", "", "alice@example.com", Pass},
+		{"a with CIDR", "203.0.113.10", "", "alice@example.com", Pass},
+		{"a outside CIDR", "203.0.113.13", "", "alice@example.com", Fail},
+		{"mx", "198.51.100.20", "", "alice@example.com", Pass},
+		{"mx ip6", "2001:db8:1::25", "", "alice@example.com", Pass},
+		{"include", "198.51.100.7", "", "alice@example.com", Pass},
+		{"fail", "203.0.113.200", "", "alice@example.com", Fail},
+		{"softfail", "203.0.113.200", "", "alice@soft.example.com", SoftFail},
+		{"neutral qualifier", "203.0.113.1", "", "alice@soft.example.com", Neutral},
+		{"neutral default", "192.0.2.10", "", "alice@neutral.example", Neutral},
+		{"no record", "192.0.2.10", "", "alice@nospf.example", None},
+		{"no domain", "192.0.2.10", "", "alice", None},
+		{"redirect", "192.0.2.10", "", "alice@redirect.example", Pass},
+		{"macro exists", "203.0.113.9", "", "bob-smith@macro.example", Pass},
+		{"macro no match", "203.0.113.9", "", "eve@macro.example", Fail},
+		{"multiple records", "192.0.2.10", "", "alice@double.example", PermError},
+		{"invalid ip4", "192.0.2.10", "", "alice@bad.example", PermError},
+		{"unknown mechanism", "192.0.2.10", "", "alice@unknown.example", PermError},
+		{"include without record", "192.0.2.10", "", "alice@broken.example", PermError},
+		{"null sender uses helo", "192.0.2.200", "helo.example", "", Pass},
+		{"lookup limit", "192.0.2.10", "", "alice@loop.example", PermError},
+		{"ptr never matches", "192.0.2.10", "", "alice@ptr.example", Fail},
+		{"case insensitive", "192.0.2.1", "", "alice@case.example", Pass},
+		{"ip6 CIDR", "2001:db8:2::ffff", "", "alice@cidr6.example", Pass},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			got := Check(context.Background(), resolver, net.ParseIP(tc.ip), tc.helo, tc.sender)
+			if got != tc.want {
+				t.Errorf("Got %v, want: %v", got, tc.want)
+			}
+		})
+	}
+
+	failing := &stubResolver{fail: true}
+	got := Check(context.Background(), failing, net.ParseIP("192.0.2.10"), "", "a@example.com")
+	if got != TempError {
+		t.Errorf("Got %v for DNS failure, want: %v", got, TempError)
+	}
+}
+
+func TestExpand(t *testing.T) {
+	c := &checker{
+		ip:     net.ParseIP("192.0.2.3"),
+		helo:   "mx.example.org",
+		sender: "strong-bad@email.example.com",
+	}
+	// Examples from RFC 7208 section 7.4.
+	testCases := []struct {
+		spec, want string
+	}{
+		{"%{s}", "strong-bad@email.example.com"},
+		{"%{o}", "email.example.com"},
+		{"%{d}", "email.example.com"},
+		{"%{d4}", "email.example.com"},
+		{"%{d3}", "email.example.com"},
+		{"%{d2}", "example.com"},
+		{"%{d1}", "com"},
+		{"%{dr}", "com.example.email"},
+		{"%{d2r}", "example.email"},
+		{"%{l}", "strong-bad"},
+		{"%{l-}", "strong.bad"},
+		{"%{lr}", "strong-bad"},
+		{"%{lr-}", "bad.strong"},
+		{"%{l1r-}", "strong"},
+		{"%{ir}.%{v}._spf.%{d2}", "3.2.0.192.in-addr._spf.example.com"},
+		{"%{lr-}.lp._spf.%{d2}", "bad.strong.lp._spf.example.com"},
+		{"%{d2}.trusted-domains.example.net", "example.com.trusted-domains.example.net"},
+		{"%{h}%%%_%-", "mx.example.org% %20"},
+		{"%{S}", "strong-bad%40email.example.com"},
+	}
+	for _, tc := range testCases {
+		got, err := c.expand(tc.spec, "email.example.com")
+		if err != nil {
+			t.Errorf("Got error %v for %q", err, tc.spec)
+			continue
+		}
+		if got != tc.want {
+			t.Errorf("Got %q for %q, want: %q", got, tc.spec, tc.want)
+		}
+	}
+
+	c.ip = net.ParseIP("2001:db8::cb01")
+	got, err := c.expand("%{ir}.%{v}._spf.%{d2}", "email.example.com")
+	want := "1.0.b.c.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.8.b.d.0.1.0.0.2.ip6._spf.example.com"
+	if err != nil || got != want {
+		t.Errorf("Got %q, %v for IPv6, want: %q", got, err, want)
+	}
+
+	for _, spec := range []string{"%", "%x", "%{", "%{}", "%{q}", "%{d0}", "%{d*}"} {
+		if _, err := c.expand(spec, "example.com"); err == nil {
+			t.Errorf("Expected error for %q", spec)
+		}
+	}
+}
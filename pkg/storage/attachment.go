@@ -0,0 +1,128 @@
+package storage
+
+import (
+	"encoding/base64"
+	"io"
+	"io/ioutil"
+	"mime"
+	"mime/multipart"
+	"mime/quotedprintable"
+	"net/mail"
+	"net/textproto"
+	"strings"
+)
+
+// maxAttachmentDepth limits how deeply nested multipart entities are searched for attachments.
+const maxAttachmentDepth = 10
+
+// AttachmentMessage is implemented by messages from stores which record the attachments of a
+// message when it is added.
+type AttachmentMessage interface {
+	// Attachments returns the number of attachments, and their total decoded size in bytes.
+	Attachments() (count int, size int64)
+}
+
+// CountAttachments reads a message from r, and returns the number of attachments it contains and
+// their total decoded size in bytes.  Parts are streamed rather than held in memory.  Malformed
+// messages are counted as far as they can be parsed, skipping attachments which can not be
+// decoded.  r is always read to the end, so
+// CountAttachments may consume the read side of a pipe.
+func CountAttachments(r io.Reader) (count int, size int64) {
+	s := Summarize(r)
+	return s.AttachmentCount, s.AttachmentBytes
+}
+
+// Summary describes the content of a message, recorded by stores when it is added.
+type Summary struct {
+	AttachmentCount int
+	AttachmentBytes int64 // Total decoded size of the attachments.
+	Snippet         string
+	Priority        int
+}
+
+// Summarize reads a message from r, counting its attachments as CountAttachments does,
+// extracting a snippet of its text as described by SnippetMessage, and parsing its priority with
+// ParsePriority.  r is always read to the end.
+func Summarize(r io.Reader) Summary {
+	defer func() { _, _ = io.Copy(ioutil.Discard, r) }()
+	msg, err := mail.ReadMessage(r)
+	if err != nil {
+		return Summary{Priority: PriorityNormal}
+	}
+	ac := &attachmentCounter{}
+	ac.read(textproto.MIMEHeader(msg.Header), msg.Body, 0)
+	snippet := ac.plain
+	if !ac.hasPlain {
+		snippet = ac.html
+	}
+	return Summary{
+		AttachmentCount: ac.count,
+		AttachmentBytes: ac.size,
+		Snippet:         snippet,
+		Priority:        ParsePriority(msg.Header),
+	}
+}
+
+// attachmentCounter accumulates the attachments and the text of a message as it is walked.
+type attachmentCounter struct {
+	count    int
+	size     int64
+	plain    string // Snippet of the first text/plain body.
+	html     string // Snippet of the first text/html body.
+	hasPlain bool
+	hasHTML  bool
+}
+
+// read counts the entity with the specified header and body if it is an attachment, descending
+// into multipart entities.
+func (ac *attachmentCounter) read(header textproto.MIMEHeader, body io.Reader, depth int) {
+	mediatype, params, err := mime.ParseMediaType(header.Get("Content-Type"))
+	if err == nil && strings.HasPrefix(mediatype, "multipart/") && params["boundary"] != "" {
+		if depth >= maxAttachmentDepth {
+			return
+		}
+		mr := multipart.NewReader(body, params["boundary"])
+		for {
+			part, err := mr.NextPart()
+			if err != nil {
+				return
+			}
+			ac.read(part.Header, part, depth+1)
+		}
+	}
+	if depth == 0 || !isAttachment(header, params) {
+		if err != nil {
+			// A missing or malformed Content-Type is plain text.
+			mediatype = "text/plain"
+		}
+		ac.readText(header, mediatype, body)
+		return
+	}
+	n, err := io.Copy(ioutil.Discard, decodeTransfer(header, body))
+	if err != nil {
+		// Truncated or undecodable.
+		return
+	}
+	ac.count++
+	ac.size += n
+}
+
+// decodeTransfer returns a reader of body with its Content-Transfer-Encoding removed.
+func decodeTransfer(header textproto.MIMEHeader, body io.Reader) io.Reader {
+	switch strings.ToLower(strings.TrimSpace(header.Get("Content-Transfer-Encoding"))) {
+	case "base64":
+		return base64.NewDecoder(base64.StdEncoding, body)
+	case "quoted-printable":
+		return quotedprintable.NewReader(body)
+	}
+	return body
+}
+
+// isAttachment returns true if the part has an attachment disposition, or a file name.
+func isAttachment(header textproto.MIMEHeader, ctypeParams map[string]string) bool {
+	disposition, params, err := mime.ParseMediaType(header.Get("Content-Disposition"))
+	if err == nil && (strings.EqualFold(disposition, "attachment") || params["filename"] != "") {
+		return true
+	}
+	return ctypeParams["name"] != ""
+}
@@ -0,0 +1,68 @@
+package storage_test
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/inbucket/inbucket/pkg/storage"
+)
+
+func TestCountAttachments(t *testing.T) {
+	const header = "From: a@host\r\nMIME-Version: 1.0\r\n"
+	testCases := []struct {
+		name   string
+		source string
+		count  int
+		size   int64
+	}{
+		{"plain", header + "\r\nNo attachments\r\n", 0, 0},
+		{"malformed", "not a message", 0, 0},
+		{
+			"single part",
+			header + "Content-Type: image/png; name=a.png\r\n\r\nxxxx\r\n",
+			0, 0,
+		},
+		{
+			"mixed",
+			header + "Content-Type: multipart/mixed; boundary=b1\r\n\r\n" +
+				"--b1\r\nContent-Type: text/plain\r\n\r\nbody\r\n" +
+				"--b1\r\nContent-Disposition: attachment\r\n" +
+				"Content-Transfer-Encoding: base64\r\n\r\naGVsbG8=\r\n" +
+				"--b1\r\nContent-Type: text/plain; name=\"b.txt\"\r\n" +
+				"Content-Transfer-Encoding: quoted-printable\r\n\r\na=3Db\r\n" +
+				"--b1--\r\n",
+			2, 8,
+		},
+		{
+			"nested",
+			header + "Content-Type: multipart/mixed; boundary=b1\r\n\r\n" +
+				"--b1\r\nContent-Type: multipart/related; boundary=b2\r\n\r\n" +
+				"--b2\r\nContent-Type: text/html\r\n\r\n<img>\r\n" +
+				"--b2\r\nContent-Type: image/gif\r\n" +
+				"Content-Disposition: inline; filename=c.gif\r\n\r\nGIF89a\r\n" +
+				"--b2--\r\n" +
+				"--b1--\r\n",
+			1, 6,
+		},
+		{
+			"truncated",
+			header + "Content-Type: multipart/mixed; boundary=b1\r\n\r\n" +
+				"--b1\r\nContent-Disposition: attachment\r\n\r\nabc\r\n" +
+				"--b1\r\nContent-Disposition: attachment\r\n\r\ndef",
+			1, 3,
+		},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			r := strings.NewReader(tc.source)
+			count, size := storage.CountAttachments(r)
+			if count != tc.count || size != tc.size {
+				t.Errorf("got %v attachments of %v bytes, want: %v of %v bytes",
+					count, size, tc.count, tc.size)
+			}
+			if r.Len() != 0 {
+				t.Errorf("got %v bytes unread, want: 0", r.Len())
+			}
+		})
+	}
+}
@@ -0,0 +1,103 @@
+package badger
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"net/mail"
+	"strings"
+	"time"
+
+	"github.com/dgraph-io/badger/v4"
+	"github.com/inbucket/inbucket/pkg/storage"
+)
+
+// Message is a BadgerDB store message, the content is loaded on demand.
+type Message struct {
+	store   *Store
+	mailbox string
+	id      string
+	rec     *record
+}
+
+var _ storage.Message = &Message{}
+
+// Mailbox returns the mailbox name.
+func (m *Message) Mailbox() string { return m.mailbox }
+
+// ID the message ID.
+func (m *Message) ID() string { return m.id }
+
+// From returns the from address.
+func (m *Message) From() *mail.Address { return parseAddress(m.rec.From) }
+
+// To returns the to address list.
+func (m *Message) To() []*mail.Address { return parseAddressList(m.rec.To) }
+
+// Date returns the date received.
+func (m *Message) Date() time.Time { return m.rec.Date }
+
+// Subject returns the subject line.
+func (m *Message) Subject() string { return m.rec.Subject }
+
+// Source returns a reader for the message source.
+func (m *Message) Source() (io.ReadCloser, error) {
+	var content []byte
+	err := m.store.db.View(func(txn *badger.Txn) error {
+		item, err := txn.Get(rawKey(m.mailbox, m.id))
+		if err != nil {
+			return err
+		}
+		content, err = item.ValueCopy(nil)
+		return err
+	})
+	if err == badger.ErrKeyNotFound {
+		return nil, storage.ErrNotExist
+	}
+	if err != nil {
+		return nil, err
+	}
+	return ioutil.NopCloser(bytes.NewReader(content)), nil
+}
+
+// Size returns the message size in bytes.
+func (m *Message) Size() int64 { return m.rec.Size }
+
+// Seen returns the message seen flag.
+func (m *Message) Seen() bool { return m.rec.Seen }
+
+// EnvelopeID returns the SMTP DSN envelope ID.
+func (m *Message) EnvelopeID() string { return m.rec.EnvID }
+
+// SPFResult returns the result of the SPF check made when the message was received.
+func (m *Message) SPFResult() string { return m.rec.SPF }
+
+// Tags returns the message tags.
+func (m *Message) Tags() []string { return m.rec.Tags }
+
+// parseAddress parses an RFC 5322 address stored by AddMessage.
+func parseAddress(s string) *mail.Address {
+	if s == "" {
+		return nil
+	}
+	a, err := mail.ParseAddress(s)
+	if err != nil {
+		return &mail.Address{Address: s}
+	}
+	return a
+}
+
+// parseAddressList parses the RFC 5322 addresses stored by AddMessage.
+func parseAddressList(list []string) []*mail.Address {
+	if len(list) == 0 {
+		return nil
+	}
+	as, err := mail.ParseAddressList(strings.Join(list, ", "))
+	if err != nil {
+		as = make([]*mail.Address, len(list))
+		for i, s := range list {
+			as[i] = parseAddress(s)
+		}
+	}
+	return as
+}
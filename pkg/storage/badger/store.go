@@ -0,0 +1,551 @@
+// Package badger implements a message store backed by a BadgerDB key-value database, avoiding the
+// random seeks of the file store index on spinning disks.
+package badger
+
+import (
+	"bytes"
+	"context"
+	"encoding/gob"
+	"fmt"
+	"io/ioutil"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/dgraph-io/badger/v4"
+	"github.com/inbucket/inbucket/pkg/config"
+	"github.com/inbucket/inbucket/pkg/storage"
+	"github.com/rs/zerolog"
+	"github.com/rs/zerolog/log"
+)
+
+const (
+	// gcInterval is the period between value log garbage collection runs.
+	gcInterval = time.Hour
+
+	// gcDiscardRatio is the fraction of a value log file which must be stale before it is
+	// rewritten.
+	gcDiscardRatio = 0.5
+
+	// seqBandwidth is the number of message IDs leased from the database at once.
+	seqBandwidth = 100
+
+	// maxAttempts limits retries of transactions which conflict with a concurrent delivery.
+	maxAttempts = 10
+
+	// The badger defaults are sized for large databases, allocating hundreds of megabytes up front.
+	// A value log file must still hold the largest message.
+	memTableSize     = 16 << 20
+	numMemtables     = 2
+	valueLogFileSize = 128 << 20
+
+	// defaultCacheMB is the block cache size used when the cachemb parameter is not set.
+	defaultCacheMB = 32
+)
+
+// seqKey holds the message ID sequence, it can not be mistaken for a message key as it contains
+// no colon.
+var seqKey = []byte("!seq")
+
+// record is the gob encoded metadata of a message.
+type record struct {
+	From    string
+	To      []string
+	Subject string
+	Date    time.Time
+	Size    int64
+	Seen    bool
+	EnvID   string
+	SPF     string
+	Tags    []string
+}
+
+// Store implements storage.Store using BadgerDB.  Message metadata is stored at {mailbox}:{id}
+// and raw message content at {mailbox}:{id}:raw, message IDs are assigned from a sequence so they
+// are always numeric.
+type Store struct {
+	db         *badger.DB
+	seq        *badger.Sequence
+	messageCap int
+	overflow   config.OverflowPolicy
+	done       chan struct{}
+	wg         sync.WaitGroup
+}
+
+var _ storage.Store = &Store{}
+var _ storage.Syncer = &Store{}
+
+// New opens or creates the BadgerDB database in the directory specified by the `path` parameter.
+// The optional `cachemb` parameter sets the size of the block cache in megabytes.
+func New(cfg config.Storage) (storage.Store, error) {
+	path := cfg.Params["path"]
+	if path == "" {
+		return nil, fmt.Errorf("badger storage requires the path parameter")
+	}
+	cacheMB := defaultCacheMB
+	if v := cfg.Params["cachemb"]; v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 0 {
+			return nil, fmt.Errorf("badger cachemb parameter must be a number of megabytes: %q", v)
+		}
+		cacheMB = n
+	}
+	opts := badger.DefaultOptions(path).
+		WithMemTableSize(memTableSize).
+		WithNumMemtables(numMemtables).
+		WithValueLogFileSize(valueLogFileSize).
+		WithBlockCacheSize(int64(cacheMB) << 20).
+		WithLogger(logger{log.With().Str("module", "storage").Logger()})
+	db, err := badger.Open(opts)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open badger database: %v", err)
+	}
+	seq, err := db.GetSequence(seqKey, seqBandwidth)
+	if err != nil {
+		_ = db.Close()
+		return nil, fmt.Errorf("failed to open badger sequence: %v", err)
+	}
+	s := &Store{
+		db:         db,
+		seq:        seq,
+		messageCap: cfg.MailboxMsgCap,
+		overflow:   cfg.OverflowPolicy,
+		done:       make(chan struct{}),
+	}
+	s.wg.Add(1)
+	go s.collectGarbage()
+	return s, nil
+}
+
+// Close stops garbage collection, and closes the underlying database.
+func (s *Store) Close() error {
+	close(s.done)
+	s.wg.Wait()
+	if err := s.seq.Release(); err != nil {
+		_ = s.db.Close()
+		return err
+	}
+	return s.db.Close()
+}
+
+// Sync flushes all pending writes to disk.
+func (s *Store) Sync() error {
+	return s.db.Sync()
+}
+
+// collectGarbage rewrites stale value log files every gcInterval until the store is closed.
+func (s *Store) collectGarbage() {
+	defer s.wg.Done()
+	ticker := time.NewTicker(gcInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-s.done:
+			return
+		case <-ticker.C:
+		}
+		// Each successful run rewrites a single file, repeat until there is nothing to collect.
+		var err error
+		for err == nil {
+			err = s.db.RunValueLogGC(gcDiscardRatio)
+		}
+		if err != badger.ErrNoRewrite {
+			log.Warn().Str("module", "storage").Err(err).Msg("Badger value log GC failed")
+		}
+	}
+}
+
+// AddMessage stores the message, message ID and Size will be ignored.
+func (s *Store) AddMessage(ctx context.Context, m storage.Message) (id string, err error) {
+	if err := ctx.Err(); err != nil {
+		return "", err
+	}
+	r, err := m.Source()
+	if err != nil {
+		return "", err
+	}
+	content, err := ioutil.ReadAll(r)
+	_ = r.Close()
+	if err != nil {
+		return "", err
+	}
+	// Addresses are stored in RFC 5322 form so they can be parsed back losslessly.
+	rec := &record{
+		Subject: m.Subject(),
+		Date:    m.Date(),
+		Size:    int64(len(content)),
+		EnvID:   m.EnvelopeID(),
+		SPF:     m.SPFResult(),
+		Tags:    m.Tags(),
+	}
+	if m.From() != nil {
+		rec.From = m.From().String()
+	}
+	for _, a := range m.To() {
+		rec.To = append(rec.To, a.String())
+	}
+	value, err := encodeRecord(rec)
+	if err != nil {
+		return "", err
+	}
+	seq, err := s.seq.Next()
+	if err != nil {
+		return "", err
+	}
+	// Sequences start at zero, IDs start at one like the other stores.
+	id = strconv.FormatUint(seq+1, 10)
+	mailbox := m.Mailbox()
+	for attempt := 1; ; attempt++ {
+		err = s.db.Update(func(txn *badger.Txn) error {
+			ids, err := listIDs(txn, mailbox)
+			if err != nil {
+				return err
+			}
+			if s.messageCap > 0 && len(ids) >= s.messageCap {
+				switch s.overflow {
+				case config.OverflowReject:
+					return storage.ErrMailboxFull
+				case config.OverflowDropNewest:
+					// Discard the new message.
+					id = ""
+					return nil
+				}
+				// Delete the oldest messages over messageCap.
+				for _, old := range ids[:len(ids)-s.messageCap+1] {
+					if err := deleteMessage(txn, mailbox, old); err != nil {
+						return err
+					}
+				}
+			}
+			if err := txn.Set(metaKey(mailbox, id), value); err != nil {
+				return err
+			}
+			return txn.Set(rawKey(mailbox, id), content)
+		})
+		if err != badger.ErrConflict || attempt == maxAttempts {
+			break
+		}
+	}
+	if err != nil {
+		return "", err
+	}
+	return id, nil
+}
+
+// GetMessage returns the specified message, or storage.ErrNotExist.
+func (s *Store) GetMessage(ctx context.Context, mailbox, id string) (storage.Message, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	var msg *Message
+	err := s.db.View(func(txn *badger.Txn) error {
+		if id == "latest" {
+			ids, err := listIDs(txn, mailbox)
+			if err != nil {
+				return err
+			}
+			if len(ids) == 0 {
+				return storage.ErrNotExist
+			}
+			id = ids[len(ids)-1]
+		}
+		item, err := txn.Get(metaKey(mailbox, id))
+		if err == badger.ErrKeyNotFound {
+			return storage.ErrNotExist
+		}
+		if err != nil {
+			return err
+		}
+		msg, err = s.readMessage(mailbox, id, item)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return msg, nil
+}
+
+// GetMessages returns the messages in the named mailbox, oldest first.
+func (s *Store) GetMessages(ctx context.Context, mailbox string) ([]storage.Message, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	messages := make([]storage.Message, 0)
+	err := s.db.View(func(txn *badger.Txn) error {
+		prefix := mailboxPrefix(mailbox)
+		// Values are not prefetched, as the content keys share the mailbox prefix.
+		it := txn.NewIterator(badger.IteratorOptions{Prefix: prefix})
+		defer it.Close()
+		for it.Rewind(); it.Valid(); it.Next() {
+			item := it.Item()
+			id, ok := parseID(item.Key()[len(prefix):])
+			if !ok {
+				continue
+			}
+			msg, err := s.readMessage(mailbox, id, item)
+			if err != nil {
+				return err
+			}
+			messages = append(messages, msg)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	// Keys sort lexically, IDs must be ordered numerically.
+	sort.Slice(messages, func(i, j int) bool {
+		return lessID(messages[i].ID(), messages[j].ID())
+	})
+	return messages, nil
+}
+
+// MarkSeen flags the message as having been read.
+func (s *Store) MarkSeen(ctx context.Context, mailbox, id string) error {
+	err := s.updateRecord(ctx, mailbox, id, func(rec *record) { rec.Seen = true })
+	if err == storage.ErrNotExist {
+		return nil
+	}
+	return err
+}
+
+// MarkUnseen flags the message as not having been read.
+func (s *Store) MarkUnseen(ctx context.Context, mailbox, id string) error {
+	err := s.updateRecord(ctx, mailbox, id, func(rec *record) { rec.Seen = false })
+	if err == storage.ErrNotExist {
+		return nil
+	}
+	return err
+}
+
+// SetTags replaces the tags of the message.
+func (s *Store) SetTags(ctx context.Context, mailbox, id string, tags []string) error {
+	return s.updateRecord(ctx, mailbox, id, func(rec *record) { rec.Tags = tags })
+}
+
+// PurgeMessages deletes all messages in the named mailbox.
+func (s *Store) PurgeMessages(ctx context.Context, mailbox string) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	var ids []string
+	err := s.db.View(func(txn *badger.Txn) (err error) {
+		ids, err = listIDs(txn, mailbox)
+		return err
+	})
+	if err != nil {
+		return err
+	}
+	// A write batch is not limited by the transaction size, so large mailboxes can be purged at
+	// once.
+	wb := s.db.NewWriteBatch()
+	defer wb.Cancel()
+	for _, id := range ids {
+		if err := wb.Delete(metaKey(mailbox, id)); err != nil {
+			return err
+		}
+		if err := wb.Delete(rawKey(mailbox, id)); err != nil {
+			return err
+		}
+	}
+	return wb.Flush()
+}
+
+// RemoveMessage deletes a message by ID from the specified mailbox.
+func (s *Store) RemoveMessage(ctx context.Context, mailbox, id string) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	return s.db.Update(func(txn *badger.Txn) error {
+		if _, err := txn.Get(metaKey(mailbox, id)); err != nil {
+			if err == badger.ErrKeyNotFound {
+				return storage.ErrNotExist
+			}
+			return err
+		}
+		return deleteMessage(txn, mailbox, id)
+	})
+}
+
+// VisitMailboxes accepts a function that will be called with the messages in each mailbox while it
+// continues to return true.
+func (s *Store) VisitMailboxes(ctx context.Context, f func([]storage.Message) (cont bool)) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	// Only keys are needed to find the mailbox names, the messages are read by GetMessages.
+	names := make([]string, 0)
+	seen := make(map[string]bool)
+	err := s.db.View(func(txn *badger.Txn) error {
+		it := txn.NewIterator(badger.IteratorOptions{PrefetchValues: false})
+		defer it.Close()
+		for it.Rewind(); it.Valid(); it.Next() {
+			key := string(it.Item().Key())
+			i := strings.LastIndexByte(key, ':')
+			if i < 0 {
+				continue
+			}
+			if _, ok := parseID([]byte(key[i+1:])); !ok {
+				continue
+			}
+			if name := key[:i]; !seen[name] {
+				seen[name] = true
+				names = append(names, name)
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	for _, name := range names {
+		messages, err := s.GetMessages(ctx, name)
+		if err != nil {
+			return err
+		}
+		if len(messages) == 0 {
+			// Purged after the names were collected.
+			continue
+		}
+		if !f(messages) {
+			break
+		}
+	}
+	return nil
+}
+
+// updateRecord applies update to the metadata of the specified message, returning
+// storage.ErrNotExist if it is not present.
+func (s *Store) updateRecord(
+	ctx context.Context, mailbox, id string, update func(*record)) (err error) {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	for attempt := 1; ; attempt++ {
+		err = s.db.Update(func(txn *badger.Txn) error {
+			item, err := txn.Get(metaKey(mailbox, id))
+			if err == badger.ErrKeyNotFound {
+				return storage.ErrNotExist
+			}
+			if err != nil {
+				return err
+			}
+			rec := &record{}
+			if err := item.Value(func(val []byte) error { return decodeRecord(val, rec) }); err != nil {
+				return err
+			}
+			update(rec)
+			value, err := encodeRecord(rec)
+			if err != nil {
+				return err
+			}
+			return txn.Set(metaKey(mailbox, id), value)
+		})
+		if err != badger.ErrConflict || attempt == maxAttempts {
+			return err
+		}
+	}
+}
+
+// readMessage builds a Message from the metadata item of a message.
+func (s *Store) readMessage(mailbox, id string, item *badger.Item) (*Message, error) {
+	rec := &record{}
+	if err := item.Value(func(val []byte) error { return decodeRecord(val, rec) }); err != nil {
+		return nil, err
+	}
+	return &Message{store: s, mailbox: mailbox, id: id, rec: rec}, nil
+}
+
+// listIDs returns the IDs of the messages in the named mailbox, oldest first.
+func listIDs(txn *badger.Txn, mailbox string) ([]string, error) {
+	prefix := mailboxPrefix(mailbox)
+	it := txn.NewIterator(badger.IteratorOptions{PrefetchValues: false, Prefix: prefix})
+	defer it.Close()
+	ids := make([]string, 0)
+	for it.Rewind(); it.Valid(); it.Next() {
+		if id, ok := parseID(it.Item().Key()[len(prefix):]); ok {
+			ids = append(ids, id)
+		}
+	}
+	sort.Slice(ids, func(i, j int) bool { return lessID(ids[i], ids[j]) })
+	return ids, nil
+}
+
+// deleteMessage deletes the metadata and content of a message.
+func deleteMessage(txn *badger.Txn, mailbox, id string) error {
+	if err := txn.Delete(metaKey(mailbox, id)); err != nil {
+		return err
+	}
+	return txn.Delete(rawKey(mailbox, id))
+}
+
+// parseID returns the ID if b is a message ID, the keys of mailboxes sharing a prefix with the one
+// being read, and raw content keys, are not.
+func parseID(b []byte) (string, bool) {
+	if len(b) == 0 {
+		return "", false
+	}
+	for _, c := range b {
+		if c < '0' || c > '9' {
+			return "", false
+		}
+	}
+	return string(b), true
+}
+
+// lessID orders numeric message IDs.
+func lessID(a, b string) bool {
+	if len(a) != len(b) {
+		return len(a) < len(b)
+	}
+	return a < b
+}
+
+func encodeRecord(rec *record) ([]byte, error) {
+	var buf bytes.Buffer
+	if err := gob.NewEncoder(&buf).Encode(rec); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func decodeRecord(b []byte, rec *record) error {
+	return gob.NewDecoder(bytes.NewReader(b)).Decode(rec)
+}
+
+func mailboxPrefix(mailbox string) []byte {
+	return []byte(mailbox + ":")
+}
+
+func metaKey(mailbox, id string) []byte {
+	return []byte(mailbox + ":" + id)
+}
+
+func rawKey(mailbox, id string) []byte {
+	return []byte(mailbox + ":" + id + ":raw")
+}
+
+// logger adapts zerolog to the badger.Logger interface.
+type logger struct {
+	log zerolog.Logger
+}
+
+func (l logger) Errorf(format string, args ...interface{}) {
+	l.log.Error().Msgf(strings.TrimSpace(format), args...)
+}
+
+func (l logger) Warningf(format string, args ...interface{}) {
+	l.log.Warn().Msgf(strings.TrimSpace(format), args...)
+}
+
+// Infof logs at debug level, badger reports routine compaction and replay progress as info.
+func (l logger) Infof(format string, args ...interface{}) {
+	l.log.Debug().Msgf(strings.TrimSpace(format), args...)
+}
+
+// Debugf logs at trace level, badger reports each write as debug.
+func (l logger) Debugf(format string, args ...interface{}) {
+	l.log.Trace().Msgf(strings.TrimSpace(format), args...)
+}
@@ -0,0 +1,183 @@
+package badger
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/inbucket/inbucket/pkg/config"
+	"github.com/inbucket/inbucket/pkg/storage"
+	"github.com/inbucket/inbucket/pkg/test"
+)
+
+// TestSuite runs storage package test suite on badger store.
+func TestSuite(t *testing.T) {
+	test.StoreSuite(t, func(conf config.Storage) (storage.Store, func(), error) {
+		s, destroy := setupStore(t, conf)
+		return s, destroy, nil
+	})
+}
+
+// TestCrashRecovery verifies synced messages are readable from a copy of the database taken while
+// the store was open, as it would be left on disk by a crash.
+func TestCrashRecovery(t *testing.T) {
+	s, destroy := setupStore(t, config.Storage{})
+	defer destroy()
+	ids := make([]string, 3)
+	for i := range ids {
+		ids[i], _ = test.DeliverToStore(t, s, "box", "crash", time.Now())
+	}
+	if err := s.MarkSeen(context.Background(), "box", ids[0]); err != nil {
+		t.Fatal(err)
+	}
+	if err := storage.Sync(s); err != nil {
+		t.Fatal(err)
+	}
+	dir, err := ioutil.TempDir("", "inbucket")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	files, err := ioutil.ReadDir(s.db.Opts().Dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, f := range files {
+		b, err := ioutil.ReadFile(filepath.Join(s.db.Opts().Dir, f.Name()))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(filepath.Join(dir, f.Name()), b, f.Mode()); err != nil {
+			t.Fatal(err)
+		}
+	}
+	s2, err := New(config.Storage{Params: map[string]string{"path": dir}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s2.(*Store).Close()
+	msgs := test.GetAndCountMessages(t, s2, "box", len(ids))
+	for i, m := range msgs {
+		if m.ID() != ids[i] {
+			t.Errorf("got message %v ID %q, want: %q", i, m.ID(), ids[i])
+		}
+		r, err := m.Source()
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, err = ioutil.ReadAll(r)
+		_ = r.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	if !msgs[0].Seen() {
+		t.Error("got unseen first message, want seen")
+	}
+	// IDs leased by the first store must not be reused.
+	id, _ := test.DeliverToStore(t, s2, "box", "recovered", time.Now())
+	if !lessID(ids[len(ids)-1], id) {
+		t.Errorf("got ID %q after recovery, want greater than %q", id, ids[len(ids)-1])
+	}
+}
+
+// TestMailboxPrefix verifies mailboxes whose names start with the name of another mailbox and a
+// colon are kept separate.
+func TestMailboxPrefix(t *testing.T) {
+	s, destroy := setupStore(t, config.Storage{})
+	defer destroy()
+	for _, name := range []string{"a", "a:1", "a:1:raw", "b"} {
+		test.DeliverToStore(t, s, name, "prefix", time.Now())
+	}
+	for _, name := range []string{"a", "a:1", "a:1:raw", "b"} {
+		test.GetAndCountMessages(t, s, name, 1)
+	}
+	var visited []string
+	err := s.VisitMailboxes(context.Background(), func(messages []storage.Message) bool {
+		visited = append(visited, messages[0].Mailbox())
+		return true
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(visited) != 4 {
+		t.Errorf("got visited mailboxes %q, want 4", visited)
+	}
+}
+
+// TestIDOrder verifies messages are returned in numeric ID order once IDs grow a digit.
+func TestIDOrder(t *testing.T) {
+	s, destroy := setupStore(t, config.Storage{})
+	defer destroy()
+	for i := 0; i < 12; i++ {
+		test.DeliverToStore(t, s, "box", "order", time.Now())
+	}
+	msgs := test.GetAndCountMessages(t, s, "box", 12)
+	for i := 1; i < len(msgs); i++ {
+		if !lessID(msgs[i-1].ID(), msgs[i].ID()) {
+			t.Errorf("got message %q before %q", msgs[i-1].ID(), msgs[i].ID())
+		}
+	}
+	latest, err := s.GetMessage(context.Background(), "box", "latest")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if latest.ID() != msgs[len(msgs)-1].ID() {
+		t.Errorf("got latest ID %q, want: %q", latest.ID(), msgs[len(msgs)-1].ID())
+	}
+}
+
+func TestMissingPath(t *testing.T) {
+	_, err := New(config.Storage{})
+	if err == nil {
+		t.Error("got nil error, wanted error for missing path")
+	}
+}
+
+func TestInvalidCacheSize(t *testing.T) {
+	for _, v := range []string{"-1", "many"} {
+		_, err := New(config.Storage{Params: map[string]string{"path": t.TempDir(), "cachemb": v}})
+		if err == nil {
+			t.Errorf("got nil error for cachemb %q, wanted error", v)
+		}
+	}
+}
+
+// TestOptions verifies the database is opened with small memory buffers.
+func TestOptions(t *testing.T) {
+	s, destroy := setupStore(t, config.Storage{})
+	defer destroy()
+	opts := s.db.Opts()
+	if opts.MemTableSize != memTableSize || opts.NumMemtables != numMemtables {
+		t.Errorf("got %v memtables of %v bytes, want %v of %v", opts.NumMemtables,
+			opts.MemTableSize, numMemtables, memTableSize)
+	}
+	if opts.BlockCacheSize != 1<<20 {
+		t.Errorf("got block cache size %v, want %v", opts.BlockCacheSize, 1<<20)
+	}
+	if opts.ValueLogFileSize != valueLogFileSize {
+		t.Errorf("got value log file size %v, want %v", opts.ValueLogFileSize, valueLogFileSize)
+	}
+}
+
+// setupStore creates a new Store in a temporary directory, with a minimal block cache.
+func setupStore(t *testing.T, cfg config.Storage) (*Store, func()) {
+	t.Helper()
+	dir, err := ioutil.TempDir("", "inbucket")
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg.Params = map[string]string{"path": dir, "cachemb": "1"}
+	s, err := New(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	destroy := func() {
+		_ = s.(*Store).Close()
+		_ = os.RemoveAll(dir)
+	}
+	return s.(*Store), destroy
+}
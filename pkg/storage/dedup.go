@@ -0,0 +1,197 @@
+package storage
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"io"
+	"io/ioutil"
+	"strings"
+	"sync"
+	"time"
+)
+
+// dedupCapacity is the maximum number of recent fingerprints remembered for each mailbox.
+const dedupCapacity = 100
+
+// traceFields are header fields added to a message in transit, which differ between deliveries of
+// the same message and are ignored when comparing messages.
+var traceFields = map[string]bool{
+	"authentication-results": true,
+	"received":               true,
+	"received-spf":           true,
+	"return-path":            true,
+}
+
+// DedupStore wraps a Store, discarding messages identical to one delivered to the same mailbox
+// within the deduplication window.  Fingerprints of recent messages are held in memory only.
+type DedupStore struct {
+	Store
+	window    time.Duration
+	key       []byte // HMAC key, so fingerprints can not be predicted from message content.
+	mu        sync.Mutex
+	recent    map[string][]fingerprint // Mailbox name to fingerprints, oldest first.
+	lastSweep time.Time
+}
+
+var _ Pager = &DedupStore{}
+var _ LatestVisitor = &DedupStore{}
+
+// fingerprint identifies the content of a stored message.
+type fingerprint struct {
+	sum   [sha256.Size]byte
+	id    string
+	added time.Time
+}
+
+// NewDedupStore wraps store, discarding duplicate messages delivered within window.
+func NewDedupStore(store Store, window time.Duration) *DedupStore {
+	key := make([]byte, sha256.Size)
+	if _, err := rand.Read(key); err != nil {
+		panic(err)
+	}
+	return &DedupStore{
+		Store:     store,
+		window:    window,
+		key:       key,
+		recent:    make(map[string][]fingerprint),
+		lastSweep: timeNow(),
+	}
+}
+
+// AddMessage stores the message, unless an identical message was added to the same mailbox within
+// the deduplication window, in which case the ID of the existing message is returned.
+func (s *DedupStore) AddMessage(ctx context.Context, m Message) (string, error) {
+	r, err := m.Source()
+	if err != nil {
+		return "", err
+	}
+	source, err := ioutil.ReadAll(r)
+	_ = r.Close()
+	if err != nil {
+		return "", err
+	}
+	sum := s.fingerprint(source)
+	mailbox := m.Mailbox()
+	if id := s.lookup(mailbox, sum); id != "" {
+		// The earlier message may have been deleted since.
+		existing, err := s.Store.GetMessage(ctx, mailbox, id)
+		if err != nil && err != ErrNotExist {
+			return "", err
+		}
+		if err == nil && existing != nil {
+			return id, nil
+		}
+	}
+	id, err := s.Store.AddMessage(ctx, &sourceMessage{Message: m, source: source})
+	if err == nil && id != "" {
+		s.remember(mailbox, fingerprint{sum: sum, id: id, added: timeNow()})
+	}
+	return id, err
+}
+
+// PageMessages returns a page of messages from the named mailbox, see Pager.
+func (s *DedupStore) PageMessages(ctx context.Context, mailbox, after string, limit int,
+	match func(Message) bool) ([]Message, bool, error) {
+	return PageMessages(ctx, s.Store, mailbox, after, limit, match)
+}
+
+// VisitLatestMessages calls f with the latest message of each non-empty mailbox, see
+// LatestVisitor.
+func (s *DedupStore) VisitLatestMessages(
+	ctx context.Context, f func(latest Message) (cont bool)) error {
+	return VisitLatestMessages(ctx, s.Store, f)
+}
+
+// lookup returns the ID of the message in mailbox with fingerprint sum, or an empty string.
+func (s *DedupStore) lookup(mailbox string, sum [sha256.Size]byte) string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	now := timeNow()
+	if now.Sub(s.lastSweep) > s.window {
+		// Forget mailboxes which have not received mail recently.
+		for name := range s.recent {
+			s.expire(name, now)
+		}
+		s.lastSweep = now
+	}
+	s.expire(mailbox, now)
+	for _, f := range s.recent[mailbox] {
+		if f.sum == sum {
+			return f.id
+		}
+	}
+	return ""
+}
+
+// remember records the fingerprint of a message added to mailbox, forgetting the oldest if the
+// mailbox is at capacity.
+func (s *DedupStore) remember(mailbox string, f fingerprint) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	fs := append(s.recent[mailbox], f)
+	if len(fs) > dedupCapacity {
+		fs = fs[len(fs)-dedupCapacity:]
+	}
+	s.recent[mailbox] = fs
+}
+
+// expire removes fingerprints older than the window from mailbox, s.mu must be held.
+func (s *DedupStore) expire(mailbox string, now time.Time) {
+	fs := s.recent[mailbox]
+	i := 0
+	for i < len(fs) && now.Sub(fs[i].added) > s.window {
+		i++
+	}
+	if i == len(fs) {
+		delete(s.recent, mailbox)
+	} else if i > 0 {
+		s.recent[mailbox] = fs[i:]
+	}
+}
+
+// fingerprint returns the HMAC-SHA256 of source, excluding trace header fields.
+func (s *DedupStore) fingerprint(source []byte) [sha256.Size]byte {
+	mac := hmac.New(sha256.New, s.key)
+	skip := false
+	rest := source
+	for len(rest) > 0 {
+		line := rest
+		if i := bytes.IndexByte(rest, '\n'); i >= 0 {
+			line = rest[:i+1]
+		}
+		if len(bytes.TrimRight(line, "\r\n")) == 0 {
+			// End of header.
+			break
+		}
+		rest = rest[len(line):]
+		if line[0] != ' ' && line[0] != '\t' {
+			// Start of a new field, continuation lines share its fate.
+			name := line
+			if i := bytes.IndexByte(line, ':'); i >= 0 {
+				name = line[:i]
+			}
+			skip = traceFields[strings.ToLower(string(bytes.TrimSpace(name)))]
+		}
+		if !skip {
+			_, _ = mac.Write(line)
+		}
+	}
+	_, _ = mac.Write(rest)
+	var sum [sha256.Size]byte
+	copy(sum[:], mac.Sum(nil))
+	return sum
+}
+
+// sourceMessage is a Message with its source already read into memory.
+type sourceMessage struct {
+	Message
+	source []byte
+}
+
+// Source returns the buffered message source.
+func (m *sourceMessage) Source() (io.ReadCloser, error) {
+	return ioutil.NopCloser(bytes.NewReader(m.source)), nil
+}
@@ -0,0 +1,81 @@
+package storage_test
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/inbucket/inbucket/pkg/config"
+	"github.com/inbucket/inbucket/pkg/message"
+	"github.com/inbucket/inbucket/pkg/storage"
+	"github.com/inbucket/inbucket/pkg/storage/mem"
+	"github.com/inbucket/inbucket/pkg/test"
+)
+
+// addSource adds a message with the given source to mailbox.
+func addSource(t *testing.T, s storage.Store, mailbox, source string) string {
+	t.Helper()
+	id, err := s.AddMessage(context.Background(), &message.Delivery{
+		Meta:   message.Metadata{Mailbox: mailbox, Date: time.Now(), Size: int64(len(source))},
+		Reader: strings.NewReader(source),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return id
+}
+
+func TestDedupStore(t *testing.T) {
+	ms, err := mem.New(config.Storage{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	ds := storage.NewDedupStore(ms, time.Minute)
+	const body = "From: alice@example.com\r\nSubject: Hello\r\n\r\nHi Bob\r\n"
+
+	id := addSource(t, ds, "bob", body)
+	if got := addSource(t, ds, "bob", body); got != id {
+		t.Errorf("Got ID %q for duplicate, want: %q", got, id)
+	}
+	test.GetAndCountMessages(t, ds, "bob", 1)
+
+	// Trace fields added by each delivery are ignored.
+	retry := "Authentication-Results: inbucket;\r\n  spf=pass\r\n" +
+		"Received: from relay by inbucket; Wed, 04 Mar 2020 05:06:07 +0000\r\n" + body
+	if got := addSource(t, ds, "bob", retry); got != id {
+		t.Errorf("Got ID %q for duplicate with trace fields, want: %q", got, id)
+	}
+	test.GetAndCountMessages(t, ds, "bob", 1)
+
+	// Other mailboxes and content are not duplicates.
+	addSource(t, ds, "carol", body)
+	addSource(t, ds, "bob", strings.Replace(body, "Bob", "Robert", 1))
+	addSource(t, ds, "bob", strings.Replace(body, "Hello", "Hello again", 1))
+	test.GetAndCountMessages(t, ds, "bob", 3)
+	test.GetAndCountMessages(t, ds, "carol", 1)
+
+	// A removed message is delivered again.
+	if err := ds.RemoveMessage(context.Background(), "bob", id); err != nil {
+		t.Fatal(err)
+	}
+	if got := addSource(t, ds, "bob", body); got == id {
+		t.Errorf("Got ID of removed message %q, want new ID", got)
+	}
+	test.GetAndCountMessages(t, ds, "bob", 3)
+}
+
+func TestDedupStoreWindow(t *testing.T) {
+	ms, err := mem.New(config.Storage{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	ds := storage.NewDedupStore(ms, 10*time.Millisecond)
+	const body = "Subject: Hello\r\n\r\nHi\r\n"
+	id := addSource(t, ds, "bob", body)
+	time.Sleep(20 * time.Millisecond)
+	if got := addSource(t, ds, "bob", body); got == id {
+		t.Errorf("Got ID %q after window, want new ID", got)
+	}
+	test.GetAndCountMessages(t, ds, "bob", 2)
+}
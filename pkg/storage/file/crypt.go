@@ -0,0 +1,83 @@
+package file
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+)
+
+// Encrypted message files begin with encMagic followed by a format version byte.  Version 1 is
+// followed by a 12 byte nonce, and then the AES-256-GCM sealed message content.  The magic and
+// version bytes are authenticated as additional data.
+const (
+	encMagic    = "IBENC"
+	encVersion1 = 1
+	encKeyLen   = 32
+)
+
+var (
+	// ErrMissingKey indicates an encrypted message was read without an encryption key configured.
+	ErrMissingKey = errors.New("message is encrypted, but no encryption key is configured")
+
+	// ErrUnsupportedFormat indicates an encrypted message uses an unknown format version.
+	ErrUnsupportedFormat = errors.New("unsupported encrypted message format")
+)
+
+// newAEAD creates an AES-256-GCM cipher from a hex encoded 32 byte key.
+func newAEAD(hexKey string) (cipher.AEAD, error) {
+	key, err := hex.DecodeString(hexKey)
+	if err != nil || len(key) != encKeyLen {
+		return nil, fmt.Errorf("'encryptionkey' parameter must be %v hex encoded bytes", encKeyLen)
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// writeEncrypted seals plaintext and writes it to w in the current format version.
+func (fs *Store) writeEncrypted(w io.Writer, plaintext []byte) error {
+	header := append([]byte(encMagic), encVersion1)
+	nonce := make([]byte, fs.aead.NonceSize())
+	if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
+		return err
+	}
+	out := make([]byte, 0, len(header)+len(nonce)+len(plaintext)+fs.aead.Overhead())
+	out = append(out, header...)
+	out = append(out, nonce...)
+	out = fs.aead.Seal(out, nonce, plaintext, header)
+	_, err := w.Write(out)
+	return err
+}
+
+// isEncrypted returns true if the message file content begins with encMagic.
+func isEncrypted(prefix []byte) bool {
+	return len(prefix) >= len(encMagic) && string(prefix[:len(encMagic)]) == encMagic
+}
+
+// decrypt opens the content of an encrypted message file.
+func (fs *Store) decrypt(data []byte) ([]byte, error) {
+	if fs.aead == nil {
+		return nil, ErrMissingKey
+	}
+	hlen := len(encMagic) + 1
+	if len(data) < hlen || data[len(encMagic)] != encVersion1 {
+		return nil, ErrUnsupportedFormat
+	}
+	header, data := data[:hlen], data[hlen:]
+	nonceSize := fs.aead.NonceSize()
+	if len(data) < nonceSize {
+		return nil, ErrUnsupportedFormat
+	}
+	nonce, data := data[:nonceSize], data[nonceSize:]
+	plaintext, err := fs.aead.Open(nil, nonce, data, header)
+	if err != nil {
+		return nil, fmt.Errorf("failed to decrypt message: %v", err)
+	}
+	return plaintext, nil
+}
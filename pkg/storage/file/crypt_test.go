@@ -0,0 +1,122 @@
+package file
+
+import (
+	"bytes"
+	"context"
+	"io/ioutil"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/inbucket/inbucket/pkg/config"
+	"github.com/inbucket/inbucket/pkg/storage"
+	"github.com/inbucket/inbucket/pkg/test"
+	"github.com/stretchr/testify/assert"
+)
+
+const (
+	testKey  = "000102030405060708090a0b0c0d0e0f101112131415161718191a1b1c1d1e1f"
+	otherKey = "ff0102030405060708090a0b0c0d0e0f101112131415161718191a1b1c1d1e1f"
+)
+
+// TestSuiteEncrypted runs storage package test suite on file store with encryption, and
+// encryption plus compression, enabled.
+func TestSuiteEncrypted(t *testing.T) {
+	for _, compress := range []string{"false", "true"} {
+		t.Run("compress="+compress, func(t *testing.T) {
+			test.StoreSuite(t, func(conf config.Storage) (storage.Store, func(), error) {
+				conf.Params = map[string]string{"encryptionkey": testKey, "compress": compress}
+				ds, _ := setupDataStore(conf)
+				destroy := func() {
+					teardownDataStore(ds)
+				}
+				return ds, destroy, nil
+			})
+		})
+	}
+}
+
+// TestEncryptedFormat verifies the message file is encrypted, and cannot be read without the
+// correct key.
+func TestEncryptedFormat(t *testing.T) {
+	ds, _ := setupDataStore(config.Storage{Params: map[string]string{"encryptionkey": testKey}})
+	defer teardownDataStore(ds)
+	id, size := deliverMessage(ds, "box", "secret subject", time.Now())
+	m, err := ds.GetMessage(context.Background(), "box", id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	raw, err := ioutil.ReadFile(m.(*Message).rawPath())
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.True(t, bytes.HasPrefix(raw, []byte("IBENC\x01")), "encrypted header")
+	assert.False(t, bytes.Contains(raw, []byte("secret subject")), "plaintext in file")
+	r, err := m.Source()
+	if err != nil {
+		t.Fatal(err)
+	}
+	content, err := ioutil.ReadAll(r)
+	assert.Nil(t, err)
+	assert.Nil(t, r.Close())
+	assert.Equal(t, size, int64(len(content)))
+	assert.True(t, strings.Contains(string(content), "Subject: secret subject\r\n"))
+
+	// Without a key.
+	nokey, err := New(config.Storage{Params: map[string]string{"path": ds.path}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	m, err = nokey.GetMessage(context.Background(), "box", id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = m.Source()
+	assert.Equal(t, ErrMissingKey, err)
+
+	// With the wrong key.
+	wrong, err := New(config.Storage{Params: map[string]string{
+		"path": ds.path, "encryptionkey": otherKey}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	m, err = wrong.GetMessage(context.Background(), "box", id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = m.Source()
+	assert.NotNil(t, err)
+}
+
+// TestEncryptedMixed verifies messages stored before encryption was enabled remain readable.
+func TestEncryptedMixed(t *testing.T) {
+	ds, _ := setupDataStore(config.Storage{})
+	defer teardownDataStore(ds)
+	id, size := deliverMessage(ds, "box", "plain", time.Now())
+	eds, err := New(config.Storage{Params: map[string]string{
+		"path": ds.path, "encryptionkey": testKey}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	m, err := eds.GetMessage(context.Background(), "box", id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	r, err := m.Source()
+	if err != nil {
+		t.Fatal(err)
+	}
+	content, err := ioutil.ReadAll(r)
+	assert.Nil(t, err)
+	assert.Nil(t, r.Close())
+	assert.Equal(t, size, int64(len(content)))
+}
+
+// TestInvalidKey verifies the encryptionkey parameter is validated.
+func TestInvalidKey(t *testing.T) {
+	for _, key := range []string{"", "zz", testKey[:62], testKey + "00"} {
+		_, err := New(config.Storage{Params: map[string]string{
+			"path": "/tmp", "encryptionkey": key}})
+		assert.NotNil(t, err, "key %q", key)
+	}
+}
@@ -1,12 +1,19 @@
 package file
 
 import (
+	"bytes"
+	"compress/gzip"
 	"io"
+	"io/ioutil"
 	"net/mail"
 	"os"
 	"path/filepath"
+	"regexp"
 	"time"
 
+	"github.com/inbucket/inbucket/pkg/config"
+	"github.com/inbucket/inbucket/pkg/dkim"
+	"github.com/inbucket/inbucket/pkg/storage"
 	"github.com/rs/zerolog/log"
 )
 
@@ -14,40 +21,68 @@ import (
 // particular email message, and methods to retrieve the rest of it from disk.
 type Message struct {
 	mailbox *mbox
-	// Stored in GOB
-	Fid      string
-	Fdate    time.Time
-	Ffrom    *mail.Address
-	Fto      []*mail.Address
-	Fsubject string
-	Fsize    int64
-	Fseen    bool
-}
-
-// newMessage creates a new FileMessage object and sets the Date and ID fields.
-// It will also delete messages over messageCap if configured.
-func (mb *mbox) newMessage() (*Message, error) {
+	// Stored in index, JSON names must not be changed
+	Fid      string          `json:"id"`
+	Fdate    time.Time       `json:"date"`
+	Ffrom    *mail.Address   `json:"from"`
+	Fto      []*mail.Address `json:"to"`
+	Fsubject string          `json:"subject"`
+	Fsize    int64           `json:"size"`
+	Fseen    bool            `json:"seen"`
+	Fenvid   string          `json:"envid,omitempty"`
+	Fspf     string          `json:"spf,omitempty"`
+	Ftags    []string        `json:"tags,omitempty"`
+	// Fdkim and Fdkimdomain are set once the DKIM signature has been verified.
+	Fdkim       dkim.Result `json:"dkim,omitempty"`
+	Fdkimdomain string      `json:"dkimdomain,omitempty"`
+	// Fcompressed is true if the .raw file is gzip compressed; absent from older indexes.
+	Fcompressed bool `json:"compressed,omitempty"`
+	// Fattachments and Fattachbytes are zero for messages added by older versions.
+	Fattachments int   `json:"attachments,omitempty"`
+	Fattachbytes int64 `json:"attachbytes,omitempty"`
+	// Fsnippet is empty for messages added by older versions.
+	Fsnippet string `json:"snippet,omitempty"`
+	// Fpriority is zero for messages added by older versions.
+	Fpriority int `json:"priority,omitempty"`
+	// Freceived is zero for messages added by older versions.
+	Freceived time.Time `json:"received,omitempty"`
+}
+
+// validID matches message IDs which are safe to use as file names.
+var validID = regexp.MustCompile(`^[0-9A-Za-z][0-9A-Za-z._-]*$`)
+
+// newMessage creates a new FileMessage object and sets the Date and ID fields.  The requested id
+// is used if it is valid and not already present in the mailbox, otherwise a new ID is generated.
+// If the mailbox is at messageCap, the reject policy returns storage.ErrMailboxFull, and the
+// drop-newest policy returns a nil Message.  The drop-oldest policy is applied when the index is
+// written.
+func (mb *mbox) newMessage(id string) (*Message, error) {
 	// Load index
 	if !mb.indexLoaded {
 		if err := mb.readIndex(); err != nil {
 			return nil, err
 		}
 	}
-	// Delete old messages over messageCap
-	if mb.store.messageCap > 0 {
-		for len(mb.messages) >= mb.store.messageCap {
+	if mb.store.messageCap > 0 && len(mb.messages) >= mb.store.messageCap {
+		switch mb.store.overflow {
+		case config.OverflowReject:
 			log.Info().Str("module", "storage").Str("mailbox", mb.name).
-				Msg("Mailbox over message cap")
-			id := mb.messages[0].ID()
-			if err := mb.removeMessage(id); err != nil {
-				log.Error().Str("module", "storage").Str("mailbox", mb.name).Str("id", id).
-					Err(err).Msg("Unable to delete message")
-			}
+				Msg("Mailbox over message cap, rejecting message")
+			return nil, storage.ErrMailboxFull
+		case config.OverflowDropNewest:
+			log.Info().Str("module", "storage").Str("mailbox", mb.name).
+				Msg("Mailbox over message cap, discarding message")
+			return nil, nil
 		}
 	}
 	date := time.Now()
-	id := generateID(date)
-	return &Message{mailbox: mb, Fid: id, Fdate: date}, nil
+	if id == "latest" || !validID.MatchString(id) {
+		id = generateID(date)
+	} else if _, err := mb.getMessage(id); err == nil {
+		// Already in use.
+		id = generateID(date)
+	}
+	return &Message{mailbox: mb, Fid: id, Fdate: date, Freceived: date}, nil
 }
 
 // Mailbox returns the name of the mailbox this message resides in.
@@ -80,7 +115,7 @@ func (m *Message) Subject() string {
 	return m.Fsubject
 }
 
-// Size returns the size of the Message on disk in bytes
+// Size returns the uncompressed size of the Message in bytes
 func (m *Message) Size() int64 {
 	return m.Fsize
 }
@@ -89,16 +124,113 @@ func (m *Message) rawPath() string {
 	return filepath.Join(m.mailbox.path, m.Fid+".raw")
 }
 
-// Source opens the .raw portion of a Message as an io.ReadCloser
+// Source opens the .raw portion of a Message as an io.ReadCloser, decrypting and decompressing
+// it if required.
 func (m *Message) Source() (reader io.ReadCloser, err error) {
 	file, err := os.Open(m.rawPath())
 	if err != nil {
 		return nil, err
 	}
-	return file, nil
+	reader = file
+	prefix := make([]byte, len(encMagic))
+	n, _ := io.ReadFull(file, prefix)
+	if isEncrypted(prefix[:n]) {
+		data, err := ioutil.ReadAll(io.MultiReader(bytes.NewReader(prefix), file))
+		_ = file.Close()
+		if err != nil {
+			return nil, err
+		}
+		plaintext, err := m.mailbox.store.decrypt(data)
+		if err != nil {
+			return nil, err
+		}
+		reader = ioutil.NopCloser(bytes.NewReader(plaintext))
+	} else if _, err := file.Seek(0, io.SeekStart); err != nil {
+		_ = file.Close()
+		return nil, err
+	}
+	if !m.Fcompressed {
+		return countingReadCloser{reader}, nil
+	}
+	gz, err := gzip.NewReader(reader)
+	if err != nil {
+		_ = reader.Close()
+		return nil, err
+	}
+	return countingReadCloser{&gzipReadCloser{Reader: gz, closer: reader}}, nil
+}
+
+// gzipReadCloser closes both the gzip.Reader and the underlying reader.
+type gzipReadCloser struct {
+	*gzip.Reader
+	closer io.Closer
+}
+
+// Close closes the gzip.Reader and the underlying reader.
+func (r *gzipReadCloser) Close() error {
+	err := r.Reader.Close()
+	if cerr := r.closer.Close(); err == nil {
+		err = cerr
+	}
+	return err
 }
 
 // Seen returns the seen flag value.
 func (m *Message) Seen() bool {
 	return m.Fseen
 }
+
+// EnvelopeID returns the SMTP DSN envelope ID.
+func (m *Message) EnvelopeID() string {
+	return m.Fenvid
+}
+
+// SPFResult returns the result of the SPF check made when the message was received.
+func (m *Message) SPFResult() string {
+	return m.Fspf
+}
+
+// Tags returns the tags set on the message.
+func (m *Message) Tags() []string {
+	return m.Ftags
+}
+
+// DKIM returns the recorded DKIM result and signing domain.
+func (m *Message) DKIM() (dkim.Result, string) {
+	return m.Fdkim, m.Fdkimdomain
+}
+
+// Attachments returns the number of attachments, and their total decoded size.
+func (m *Message) Attachments() (int, int64) {
+	return m.Fattachments, m.Fattachbytes
+}
+
+// Snippet returns the beginning of the message text.
+func (m *Message) Snippet() string {
+	return m.Fsnippet
+}
+
+// Priority returns the priority of the message, normal for messages added by older versions.
+func (m *Message) Priority() int {
+	if m.Fpriority == 0 {
+		return storage.PriorityNormal
+	}
+	return m.Fpriority
+}
+
+// ReceivedAt returns the time the message was added to the store.  For messages added by older
+// versions it is parsed from the ID, or is the zero time for imported IDs.
+func (m *Message) ReceivedAt() time.Time {
+	if !m.Freceived.IsZero() {
+		return m.Freceived
+	}
+	for _, layout := range []string{idPrefixLayout, legacyIDPrefixLayout} {
+		if len(m.Fid) < len(layout) {
+			continue
+		}
+		if t, err := time.ParseInLocation(layout, m.Fid[:len(layout)], time.Local); err == nil {
+			return t
+		}
+	}
+	return time.Time{}
+}
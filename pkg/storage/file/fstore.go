@@ -2,27 +2,68 @@ package file
 
 import (
 	"bufio"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"crypto/cipher"
+	"errors"
 	"fmt"
 	"io"
+	"io/ioutil"
 	"os"
 	"path/filepath"
+	"regexp"
+	"strconv"
 	"sync"
 	"time"
 
+	lru "github.com/hashicorp/golang-lru/v2"
 	"github.com/inbucket/inbucket/pkg/config"
+	"github.com/inbucket/inbucket/pkg/dkim"
+	"github.com/inbucket/inbucket/pkg/metric"
 	"github.com/inbucket/inbucket/pkg/storage"
 	"github.com/inbucket/inbucket/pkg/stringutil"
 	"github.com/rs/zerolog/log"
 )
 
-// Name of index file in each mailbox
-const indexFileName = "index.gob"
+const (
+	// Name of index file in each mailbox
+	indexFileName = "index.jsonl"
+
+	// Name of the gob index file written by older versions
+	legacyIndexFileName = "index.gob"
+
+	// Layout of the time at the start of generated message IDs, and its length
+	idPrefixLayout = "20060102T150405.000"
+	idPrefixLen    = len(idPrefixLayout)
+
+	// Layout of the time at the start of message IDs generated by older versions, without
+	// milliseconds
+	legacyIDPrefixLayout = "20060102T150405"
+
+	// Default number of directory entries read at a time by VisitMailboxes
+	defaultDirBatchSize = 256
+
+	// Default number of decoded mailbox indexes held in memory
+	defaultIndexCacheSize = 256
+
+	// Default size in bytes below which messages are written in a single call, see
+	// BenchmarkWriteMessage
+	defaultSmallMessage = 4096
+
+	// Number of sequence numbers buffered by countChannel, so bursts of deliveries do not wait on
+	// the generator goroutine
+	countBufferSize = 1024
+)
 
 var (
+	// errStopWalk is returned by walkDir callbacks to end the walk early.
+	errStopWalk = errors.New("stop walk")
+
 	// countChannel is filled with a sequential numbers (0000..9999), which are
 	// used by generateID() to generate unique message IDs.  It's global
 	// because we only want one regardless of the number of DataStore objects
-	countChannel = make(chan int, 10)
+	countChannel = make(chan int, countBufferSize)
 )
 
 func init() {
@@ -44,7 +85,20 @@ type Store struct {
 	path          string
 	mailPath      string
 	messageCap    int
+	overflow      config.OverflowPolicy
+	quota         int64 // Maximum bytes of messages per mailbox, zero for no limit.
+	dirBatchSize  int
+	compress      bool
+	smallMessage  int64       // Messages smaller than this are written in one call, zero to disable.
+	verifyIndex   bool        // Decode each index after writing, before it replaces the live index.
+	fsync         bool        // Sync message and index files to stable storage after writing.
+	aead          cipher.AEAD // Encrypts message content, nil if encryption is disabled.
+	utc           bool        // Store and load message dates in UTC, rather than their offset.
+	rewrites      []subjectRewrite
 	bufReaderPool sync.Pool
+
+	// indexCache holds decoded mailbox indexes keyed by mailbox hash, nil if disabled.
+	indexCache *lru.Cache[string, *indexEntry]
 }
 
 // New creates a new DataStore object using the specified path
@@ -53,6 +107,73 @@ func New(cfg config.Storage) (storage.Store, error) {
 	if path == "" {
 		return nil, fmt.Errorf("'path' parameter not specified")
 	}
+	dirBatchSize := defaultDirBatchSize
+	if str, ok := cfg.Params["dirbatch"]; ok {
+		n, err := strconv.Atoi(str)
+		if err != nil || n <= 0 {
+			return nil, fmt.Errorf("invalid 'dirbatch' parameter: %q", str)
+		}
+		dirBatchSize = n
+	}
+	var indexCache *lru.Cache[string, *indexEntry]
+	indexCacheSize := defaultIndexCacheSize
+	if str, ok := cfg.Params["indexcache"]; ok {
+		n, err := strconv.Atoi(str)
+		if err != nil || n < 0 {
+			return nil, fmt.Errorf("invalid 'indexcache' parameter: %q", str)
+		}
+		indexCacheSize = n
+	}
+	if indexCacheSize > 0 {
+		var err error
+		if indexCache, err = lru.New[string, *indexEntry](indexCacheSize); err != nil {
+			return nil, err
+		}
+	}
+	smallMessage := int64(defaultSmallMessage)
+	if str, ok := cfg.Params["smallmessage"]; ok {
+		n, err := strconv.ParseInt(str, 10, 64)
+		if err != nil || n < 0 {
+			return nil, fmt.Errorf("invalid 'smallmessage' parameter: %q", str)
+		}
+		smallMessage = n
+	}
+	compress := false
+	if str, ok := cfg.Params["compress"]; ok {
+		var err error
+		if compress, err = strconv.ParseBool(str); err != nil {
+			return nil, fmt.Errorf("invalid 'compress' parameter: %q", str)
+		}
+	}
+	verifyIndex := false
+	if str, ok := cfg.Params["verifyindex"]; ok {
+		var err error
+		if verifyIndex, err = strconv.ParseBool(str); err != nil {
+			return nil, fmt.Errorf("invalid 'verifyindex' parameter: %q", str)
+		}
+	}
+	fsync := false
+	if str, ok := cfg.Params["fsync"]; ok {
+		var err error
+		if fsync, err = strconv.ParseBool(str); err != nil {
+			return nil, fmt.Errorf("invalid 'fsync' parameter: %q", str)
+		}
+	}
+	var aead cipher.AEAD
+	if key, ok := cfg.Params["encryptionkey"]; ok {
+		var err error
+		if aead, err = newAEAD(key); err != nil {
+			return nil, err
+		}
+	}
+	rewrites := make([]subjectRewrite, len(cfg.SubjectRewriteRules))
+	for i, rule := range cfg.SubjectRewriteRules {
+		re, err := regexp.Compile(rule.Pattern)
+		if err != nil {
+			return nil, fmt.Errorf("invalid subject rewrite pattern %q: %v", rule.Pattern, err)
+		}
+		rewrites[i] = subjectRewrite{re: re, replacement: rule.Replacement}
+	}
 	mailPath := filepath.Join(path, "mail")
 	if _, err := os.Stat(mailPath); err != nil {
 		// Mail datastore does not yet exist
@@ -61,20 +182,49 @@ func New(cfg config.Storage) (storage.Store, error) {
 				Msg("Error creating dir")
 		}
 	}
-	return &Store{
-		path:       path,
-		mailPath:   mailPath,
-		messageCap: cfg.MailboxMsgCap,
+	fs := &Store{
+		path:         path,
+		mailPath:     mailPath,
+		messageCap:   cfg.MailboxMsgCap,
+		overflow:     cfg.OverflowPolicy,
+		quota:        cfg.QuotaBytes,
+		dirBatchSize: dirBatchSize,
+		compress:     compress,
+		smallMessage: smallMessage,
+		verifyIndex:  verifyIndex,
+		fsync:        fsync,
+		aead:         aead,
+		utc:          cfg.TimezoneNormalize,
+		rewrites:     rewrites,
+		indexCache:   indexCache,
 		bufReaderPool: sync.Pool{
 			New: func() interface{} {
 				return bufio.NewReader(nil)
 			},
 		},
-	}, nil
+	}
+	fs.initMetrics()
+	return fs, nil
 }
 
 // AddMessage adds a message to the specified mailbox.
-func (fs *Store) AddMessage(m storage.Message) (id string, err error) {
+func (fs *Store) AddMessage(ctx context.Context, m storage.Message) (id string, err error) {
+	return fs.addMessage(ctx, m, "")
+}
+
+// ImportMessage adds a message to the specified mailbox, keeping its ID if it is a valid file
+// name and not already present in the mailbox.
+func (fs *Store) ImportMessage(ctx context.Context, m storage.Message) (id string, err error) {
+	return fs.addMessage(ctx, m, m.ID())
+}
+
+// addMessage adds a message to the specified mailbox with the requested ID, a new ID is generated
+// if it is empty or unusable.  The mailbox lock is held from reading the index until the updated
+// index is written, so concurrent additions to a mailbox can not overwrite each other.
+func (fs *Store) addMessage(ctx context.Context, m storage.Message, id string) (string, error) {
+	if err := ctx.Err(); err != nil {
+		return "", err
+	}
 	mb := fs.mbox(m.Mailbox())
 	mb.Lock()
 	defer mb.Unlock()
@@ -83,72 +233,355 @@ func (fs *Store) AddMessage(m storage.Message) (id string, err error) {
 		return "", err
 	}
 	// Create a new message.
-	fm, err := mb.newMessage()
+	fm, err := mb.newMessage(id)
 	if err != nil {
+		_ = r.Close()
 		return "", err
 	}
+	if fm == nil {
+		// Discarded by the overflow policy.
+		_ = r.Close()
+		return "", nil
+	}
+	if mb.overQuota(1) {
+		// No room for even the smallest message.
+		_ = r.Close()
+		log.Info().Str("module", "storage").Str("mailbox", mb.name).
+			Msg("Mailbox over quota, rejecting message")
+		return "", storage.ErrQuotaExceeded
+	}
 	// Ensure mailbox directory exists.
 	if err := mb.createDir(); err != nil {
 		return "", err
 	}
 	// Write the message content
-	file, err := os.Create(fm.rawPath())
-	if err != nil {
-		return "", err
+	var wr written
+	var small bool
+	if fs.smallMessage > 0 && !fs.compress && fs.aead == nil &&
+		m.Size() > 0 && m.Size() < fs.smallMessage {
+		wr, small, r, err = fs.writeSmallMessage(fm.rawPath(), r, fs.smallMessage)
 	}
-	w := bufio.NewWriter(file)
-	size, err := io.Copy(w, r)
-	if err != nil {
-		// Try to remove the file
-		_ = file.Close()
-		_ = os.Remove(fm.rawPath())
-		return "", err
+	if err == nil && !small {
+		wr, err = fs.writeMessage(fm.rawPath(), r)
 	}
 	_ = r.Close()
-	if err := w.Flush(); err != nil {
-		// Try to remove the file
-		_ = file.Close()
-		_ = os.Remove(fm.rawPath())
+	if err != nil {
 		return "", err
 	}
-	if err := file.Close(); err != nil {
-		// Try to remove the file
+	size := wr.size
+	if mb.overQuota(size) {
 		_ = os.Remove(fm.rawPath())
-		return "", err
+		if len(mb.messages) == 0 {
+			_ = mb.removeDir()
+		}
+		log.Info().Str("module", "storage").Str("mailbox", mb.name).Int64("size", size).
+			Msg("Message would exceed mailbox quota, rejecting message")
+		return "", storage.ErrQuotaExceeded
 	}
 	// Update the index.
 	fm.Fdate = m.Date()
+	if fs.utc {
+		fm.Fdate = fm.Fdate.UTC()
+	}
 	fm.Ffrom = m.From()
 	fm.Fto = m.To()
 	fm.Fsize = size
-	fm.Fsubject = m.Subject()
+	fm.Fcompressed = wr.compressed
+	fm.Fsubject = fs.rewriteSubject(stringutil.DecodeHeader(m.Subject()))
+	fm.Fenvid = m.EnvelopeID()
+	fm.Fspf = m.SPFResult()
+	fm.Ftags = m.Tags()
+	fm.Fattachments = wr.summary.AttachmentCount
+	fm.Fattachbytes = wr.summary.AttachmentBytes
+	fm.Fsnippet = wr.summary.Snippet
+	fm.Fpriority = wr.summary.Priority
+	prev := mb.messages
 	mb.messages = append(mb.messages, fm)
+	var evicted []*Message
+	if fs.messageCap > 0 && len(mb.messages) > fs.messageCap {
+		// Evict the oldest messages over messageCap in the same index write.
+		n := len(mb.messages) - fs.messageCap
+		evicted = append(evicted, mb.messages[:n]...)
+		mb.messages = mb.messages[n:]
+	}
 	if err := mb.writeIndex(); err != nil {
 		// Try to remove the file
 		_ = os.Remove(fm.rawPath())
+		mb.messages = prev
 		return "", err
 	}
+	expAddedTotal.Add(1)
+	expBytesWrittenTotal.Add(size)
+	expRemovedTotal.Add(int64(len(evicted)))
+	for _, old := range evicted {
+		log.Info().Str("module", "storage").Str("mailbox", mb.name).Str("id", old.Fid).
+			Msg("Mailbox over message cap, deleting oldest message")
+		if err := os.Remove(old.rawPath()); err != nil {
+			log.Error().Str("module", "storage").Str("mailbox", mb.name).Str("id", old.Fid).
+				Err(err).Msg("Unable to delete message")
+		}
+	}
+	mb.updateMetrics()
 	return fm.Fid, nil
 }
 
+// written describes message content written to a file.
+type written struct {
+	size       int64
+	compressed bool
+	summary    storage.Summary
+}
+
+// subjectRewrite is a compiled config.SubjectRewriteRule.
+type subjectRewrite struct {
+	re          *regexp.Regexp
+	replacement string
+}
+
+// rewriteSubject applies the subject rewrite rules to subject in order.
+func (fs *Store) rewriteSubject(subject string) string {
+	if len(fs.rewrites) == 0 {
+		return subject
+	}
+	rewritten := subject
+	for _, rw := range fs.rewrites {
+		rewritten = rw.re.ReplaceAllString(rewritten, rw.replacement)
+	}
+	if rewritten != subject {
+		log.Debug().Str("module", "storage").Str("subject", subject).
+			Str("rewritten", rewritten).Msg("Rewrote message subject")
+	}
+	return rewritten
+}
+
+// writeMessage streams the content of r to a new file at path, compressing or encrypting it if
+// configured.  The file is removed if it can not be completely written.
+func (fs *Store) writeMessage(path string, r io.Reader) (written, error) {
+	file, err := os.Create(path)
+	if err != nil {
+		return written{}, err
+	}
+	var dst io.Writer = file
+	var plain *bytes.Buffer
+	if fs.aead != nil {
+		// Messages are encrypted in one piece, once the content has been read.
+		plain = new(bytes.Buffer)
+		dst = plain
+	}
+	var gz *gzip.Writer
+	if fs.compress {
+		gz = gzip.NewWriter(dst)
+		dst = gz
+	}
+	w := bufio.NewWriter(dst)
+	// Attachments are counted, and the snippet found, from a copy of the content as it is
+	// written.
+	pr, pw := io.Pipe()
+	var summary storage.Summary
+	counted := make(chan struct{})
+	go func() {
+		summary = storage.Summarize(pr)
+		close(counted)
+	}()
+	size, err := io.Copy(w, io.TeeReader(r, pw))
+	_ = pw.CloseWithError(err)
+	<-counted
+	if err != nil {
+		// Try to remove the file
+		_ = file.Close()
+		_ = os.Remove(path)
+		return written{}, err
+	}
+	if err := w.Flush(); err != nil {
+		// Try to remove the file
+		_ = file.Close()
+		_ = os.Remove(path)
+		return written{}, err
+	}
+	if gz != nil {
+		if err := gz.Close(); err != nil {
+			// Try to remove the file
+			_ = file.Close()
+			_ = os.Remove(path)
+			return written{}, err
+		}
+	}
+	if plain != nil {
+		if err := fs.writeEncrypted(file, plain.Bytes()); err != nil {
+			// Try to remove the file
+			_ = file.Close()
+			_ = os.Remove(path)
+			return written{}, err
+		}
+	}
+	if fs.fsync {
+		if err := syncFile(file); err != nil {
+			// Try to remove the file
+			_ = file.Close()
+			_ = os.Remove(path)
+			return written{}, err
+		}
+	}
+	if err := file.Close(); err != nil {
+		// Try to remove the file
+		_ = os.Remove(path)
+		return written{}, err
+	}
+	return written{size: size, compressed: gz != nil, summary: summary}, nil
+}
+
+// writeSmallMessage reads the content of r into memory and writes it to a new file at path in a
+// single call, avoiding the buffers and goroutine of writeMessage.  If r holds threshold bytes or
+// more, nothing is written and ok is false; the returned reader then yields the entire content
+// for writeMessage.
+func (fs *Store) writeSmallMessage(path string, r io.ReadCloser, threshold int64) (
+	wr written, ok bool, rest io.ReadCloser, err error) {
+	buf := bytes.NewBuffer(make([]byte, 0, threshold))
+	if _, err := buf.ReadFrom(io.LimitReader(r, threshold)); err != nil {
+		return wr, false, r, err
+	}
+	if int64(buf.Len()) >= threshold {
+		// The size of the message was understated.
+		return wr, false, readCloser{io.MultiReader(buf, r), r}, nil
+	}
+	if err := fs.writeFile(path, buf.Bytes()); err != nil {
+		_ = os.Remove(path)
+		return wr, false, r, err
+	}
+	wr.size = int64(buf.Len())
+	wr.summary = storage.Summarize(bytes.NewReader(buf.Bytes()))
+	return wr, true, r, nil
+}
+
+// writeFile writes data to a new file at path, syncing it to stable storage if configured.
+func (fs *Store) writeFile(path string, data []byte) error {
+	if !fs.fsync {
+		return ioutil.WriteFile(path, data, 0666)
+	}
+	file, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	if _, err := file.Write(data); err != nil {
+		_ = file.Close()
+		return err
+	}
+	if err := syncFile(file); err != nil {
+		_ = file.Close()
+		return err
+	}
+	return file.Close()
+}
+
+// syncFile is replaced by tests to count calls.
+var syncFile = (*os.File).Sync
+
+// syncDir commits the entries of the directory at path to stable storage, so files created or
+// renamed within it survive a power failure.
+func syncDir(path string) error {
+	dir, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer dir.Close()
+	return syncFile(dir)
+}
+
+// readCloser combines a Reader with the Closer of the source it reads from.
+type readCloser struct {
+	io.Reader
+	io.Closer
+}
+
+// MailPath returns the directory messages are stored in.
+func (fs *Store) MailPath() string {
+	return fs.mailPath
+}
+
 // GetMessage returns the messages in the named mailbox, or an error.
-func (fs *Store) GetMessage(mailbox, id string) (storage.Message, error) {
+func (fs *Store) GetMessage(ctx context.Context, mailbox, id string) (storage.Message, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
 	mb := fs.mbox(mailbox)
 	mb.RLock()
 	defer mb.RUnlock()
 	return mb.getMessage(id)
 }
 
+// MailboxExists returns true if the named mailbox contains any messages, by checking for its
+// directory, which is removed along with the last message.
+func (fs *Store) MailboxExists(ctx context.Context, mailbox string) (bool, error) {
+	if err := ctx.Err(); err != nil {
+		return false, err
+	}
+	mb := fs.mbox(mailbox)
+	mb.RLock()
+	defer mb.RUnlock()
+	_, err := os.Stat(mb.indexPath)
+	if os.IsNotExist(err) {
+		return false, nil
+	}
+	return err == nil, err
+}
+
 // GetMessages returns the messages in the named mailbox, or an error.
-func (fs *Store) GetMessages(mailbox string) ([]storage.Message, error) {
+func (fs *Store) GetMessages(ctx context.Context, mailbox string) ([]storage.Message, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
 	mb := fs.mbox(mailbox)
 	mb.RLock()
 	defer mb.RUnlock()
 	return mb.getMessages()
 }
 
+// PageMessages returns a page of messages from the mailbox, see storage.Pager.  Unless the index
+// is already loaded or cached, it is decoded without being kept in memory.
+func (fs *Store) PageMessages(ctx context.Context, mailbox, after string, limit int,
+	match func(storage.Message) bool) ([]storage.Message, bool, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, false, err
+	}
+	mb := fs.mbox(mailbox)
+	mb.RLock()
+	defer mb.RUnlock()
+	page := storage.NewPage(after, limit, match)
+	if mb.indexLoaded || mb.loadCachedIndex() {
+		for _, m := range mb.messages {
+			if !page.Visit(m) {
+				break
+			}
+		}
+	} else {
+		full := false
+		_, err := mb.scanIndex(func(msg *Message) {
+			if !full {
+				full = !page.Visit(msg)
+			}
+		})
+		if err != nil {
+			return nil, false, err
+		}
+	}
+	return page.Result()
+}
+
 // MarkSeen flags the message as having been read.
-func (fs *Store) MarkSeen(mailbox, id string) error {
+func (fs *Store) MarkSeen(ctx context.Context, mailbox, id string) error {
+	return fs.setSeen(ctx, mailbox, id, true)
+}
+
+// MarkUnseen flags the message as not having been read.
+func (fs *Store) MarkUnseen(ctx context.Context, mailbox, id string) error {
+	return fs.setSeen(ctx, mailbox, id, false)
+}
+
+// setSeen sets the seen flag of the message, writing the index if it changed.
+func (fs *Store) setSeen(ctx context.Context, mailbox, id string, seen bool) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
 	mb := fs.mbox(mailbox)
 	mb.Lock()
 	defer mb.Unlock()
@@ -159,68 +592,253 @@ func (fs *Store) MarkSeen(mailbox, id string) error {
 	}
 	for _, m := range mb.messages {
 		if m.Fid == id {
-			if m.Fseen {
-				// Already marked seen.
+			if m.Fseen == seen {
+				// Already marked.
 				return nil
 			}
-			m.Fseen = true
+			m.Fseen = seen
 			break
 		}
 	}
 	return mb.writeIndex()
 }
 
+// SetTags replaces the tags of the message in the mailbox index.
+func (fs *Store) SetTags(ctx context.Context, mailbox, id string, tags []string) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	mb := fs.mbox(mailbox)
+	mb.Lock()
+	defer mb.Unlock()
+	if !mb.indexLoaded {
+		if err := mb.readIndex(); err != nil {
+			return err
+		}
+	}
+	for _, m := range mb.messages {
+		if m.Fid == id {
+			m.Ftags = append([]string(nil), tags...)
+			return mb.writeIndex()
+		}
+	}
+	return storage.ErrNotExist
+}
+
+// SetDKIM records the DKIM result and signing domain of the message in the mailbox index.
+func (fs *Store) SetDKIM(
+	ctx context.Context, mailbox, id string, result dkim.Result, domain string) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	mb := fs.mbox(mailbox)
+	mb.Lock()
+	defer mb.Unlock()
+	if !mb.indexLoaded {
+		if err := mb.readIndex(); err != nil {
+			return err
+		}
+	}
+	for _, m := range mb.messages {
+		if m.Fid == id {
+			m.Fdkim = result
+			m.Fdkimdomain = domain
+			return mb.writeIndex()
+		}
+	}
+	return storage.ErrNotExist
+}
+
 // RemoveMessage deletes a message by ID from the specified mailbox.
-func (fs *Store) RemoveMessage(mailbox, id string) error {
+func (fs *Store) RemoveMessage(ctx context.Context, mailbox, id string) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
 	mb := fs.mbox(mailbox)
 	mb.Lock()
 	defer mb.Unlock()
-	return mb.removeMessage(id)
+	if err := mb.removeMessage(id); err != nil {
+		return err
+	}
+	expRemovedTotal.Add(1)
+	mb.updateMetrics()
+	return nil
 }
 
 // PurgeMessages deletes all messages in the named mailbox, or returns an error.
-func (fs *Store) PurgeMessages(mailbox string) error {
+func (fs *Store) PurgeMessages(ctx context.Context, mailbox string) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
 	mb := fs.mbox(mailbox)
 	mb.Lock()
 	defer mb.Unlock()
-	return mb.purge()
+	// The index may not have been read yet, which is required to count the purged messages.
+	purged := 0
+	if msgs, err := mb.getMessages(); err == nil {
+		purged = len(msgs)
+	}
+	if err := mb.purge(); err != nil {
+		return err
+	}
+	expPurgedTotal.Add(int64(purged))
+	mb.updateMetrics()
+	return nil
 }
 
 // VisitMailboxes accepts a function that will be called with the messages in each mailbox while it
-// continues to return true.
-func (fs *Store) VisitMailboxes(f func([]storage.Message) (cont bool)) error {
-	names1, err := readDirNames(fs.mailPath)
-	if err != nil {
-		return err
-	}
+// continues to return true.  Directories are read in batches, so memory use does not grow with the
+// number of mailboxes.
+func (fs *Store) VisitMailboxes(ctx context.Context, f func([]storage.Message) (cont bool)) error {
 	// Loop over level 1 directories
-	for _, name1 := range names1 {
-		names2, err := readDirNames(fs.mailPath, name1)
-		if err != nil {
-			return err
-		}
+	err := fs.walkDir(ctx, fs.mailPath, func(name1 string) error {
 		// Loop over level 2 directories
-		for _, name2 := range names2 {
-			names3, err := readDirNames(fs.mailPath, name1, name2)
-			if err != nil {
-				return err
-			}
+		return fs.walkDir(ctx, filepath.Join(fs.mailPath, name1), func(name2 string) error {
 			// Loop over mailboxes
-			for _, name3 := range names3 {
-				mb := fs.mboxFromHash(name3)
-				mb.RLock()
-				msgs, err := mb.getMessages()
-				mb.RUnlock()
-				if err != nil {
-					return err
-				}
-				if !f(msgs) {
+			return fs.walkDir(ctx, filepath.Join(fs.mailPath, name1, name2),
+				func(name3 string) error {
+					if err := ctx.Err(); err != nil {
+						return err
+					}
+					mb := fs.mboxFromHash(name3)
+					mb.RLock()
+					msgs, err := mb.getMessages()
+					mb.RUnlock()
+					if err != nil {
+						return err
+					}
+					if !f(msgs) {
+						return errStopWalk
+					}
 					return nil
-				}
-			}
+				})
+		})
+	})
+	if err == errStopWalk {
+		return nil
+	}
+	return err
+}
+
+// VisitLatestMessages calls f with the latest message of each non-empty mailbox, until f returns
+// false.  Indexes which are not cached are decoded without keeping the earlier messages.
+func (fs *Store) VisitLatestMessages(
+	ctx context.Context, f func(latest storage.Message) (cont bool)) error {
+	err := fs.walkDir(ctx, fs.mailPath, func(name1 string) error {
+		return fs.walkDir(ctx, filepath.Join(fs.mailPath, name1), func(name2 string) error {
+			return fs.walkDir(ctx, filepath.Join(fs.mailPath, name1, name2),
+				func(name3 string) error {
+					if err := ctx.Err(); err != nil {
+						return err
+					}
+					mb := fs.mboxFromHash(name3)
+					mb.RLock()
+					latest, err := mb.latestMessage()
+					mb.RUnlock()
+					if err != nil {
+						return err
+					}
+					if latest != nil && !f(latest) {
+						return errStopWalk
+					}
+					return nil
+				})
+		})
+	})
+	if err == errStopWalk {
+		return nil
+	}
+	return err
+}
+
+// MigrateIndexes converts mailbox indexes written in the legacy gob format to JSON lines,
+// returning the number of mailboxes converted.
+func (fs *Store) MigrateIndexes() (count int, err error) {
+	ctx := context.Background()
+	err = fs.walkDir(ctx, fs.mailPath, func(name1 string) error {
+		return fs.walkDir(ctx, filepath.Join(fs.mailPath, name1), func(name2 string) error {
+			return fs.walkDir(ctx, filepath.Join(fs.mailPath, name1, name2),
+				func(name3 string) error {
+					mb := fs.mboxFromHash(name3)
+					mb.Lock()
+					defer mb.Unlock()
+					if _, err := os.Stat(mb.legacyIndexPath()); err != nil {
+						// Nothing to migrate.
+						return nil
+					}
+					if err := mb.readIndex(); err != nil {
+						return err
+					}
+					if err := mb.writeIndex(); err != nil {
+						return err
+					}
+					count++
+					return nil
+				})
+		})
+	})
+	return count, err
+}
+
+// CompactReport lists the inconsistencies between mailbox indexes and message files found by
+// Compact.
+type CompactReport struct {
+	// OrphanFiles are the paths of message files not referenced by their mailbox index.
+	OrphanFiles []string
+	// MissingFiles are the paths of message files referenced by an index, but not present on disk.
+	MissingFiles []string
+}
+
+// Compact removes message files not referenced by their mailbox index, and index entries whose
+// message file is missing.  When dryRun is true, the inconsistencies are reported but the store is
+// not modified.
+func (fs *Store) Compact(dryRun bool) (report *CompactReport, err error) {
+	report = &CompactReport{}
+	// Mailboxes are listed before compacting, as emptied mailbox directories are removed along
+	// with their parents.
+	var hashes []string
+	ctx := context.Background()
+	err = fs.walkDir(ctx, fs.mailPath, func(name1 string) error {
+		return fs.walkDir(ctx, filepath.Join(fs.mailPath, name1), func(name2 string) error {
+			return fs.walkDir(ctx, filepath.Join(fs.mailPath, name1, name2),
+				func(name3 string) error {
+					hashes = append(hashes, name3)
+					return nil
+				})
+		})
+	})
+	if err != nil {
+		return report, err
+	}
+	for _, hash := range hashes {
+		mb := fs.mboxFromHash(hash)
+		mb.Lock()
+		err = mb.compact(report, dryRun)
+		mb.Unlock()
+		if err != nil {
+			return report, err
 		}
 	}
-	return nil
+	return report, nil
+}
+
+// initMetrics populates the mailbox metrics with the existing contents of the store.
+func (fs *Store) initMetrics() {
+	err := fs.VisitMailboxes(context.Background(), func(msgs []storage.Message) bool {
+		if len(msgs) == 0 {
+			return true
+		}
+		var size int64
+		for _, m := range msgs {
+			size += m.Size()
+		}
+		metric.SetMailbox(msgs[0].Mailbox(), len(msgs), size)
+		return true
+	})
+	if err != nil {
+		log.Error().Str("module", "storage").Str("path", fs.mailPath).Err(err).
+			Msg("Failed to initialize mailbox metrics")
+	}
 }
 
 // mbox returns the named mailbox.
@@ -268,23 +886,47 @@ func (fs *Store) putPooledReader(br *bufio.Reader) {
 }
 
 // generatePrefix converts a Time object into the ISO style format we use
-// as a prefix for message files.  Note:  It is used directly by unit
-// tests.
+// as a prefix for message files, with millisecond precision.  The
+// milliseconds are always three digits, so IDs have a fixed length.
+// Note:  It is used directly by unit tests.
 func generatePrefix(date time.Time) string {
-	return date.Format("20060102T150405")
+	return date.Format(idPrefixLayout)
 }
 
 // generateId adds a 4-digit unique number onto the end of the string
-// returned by generatePrefix().
+// returned by generatePrefix(), such as 20060102T150405.999-0000.
+//
+// The sequence number wraps after 9999, so IDs are unique provided fewer than
+// 10,000 are generated within the same millisecond; a sustained rate of up to
+// 10 million messages per second.  IDs generated before the millisecond
+// prefix was added, such as 20060102T150405-0000, remain valid.
 func generateID(date time.Time) string {
 	return generatePrefix(date) + "-" + fmt.Sprintf("%04d", <-countChannel)
 }
 
-// readDirNames returns a slice of filenames in the specified directory or an error.
-func readDirNames(elem ...string) ([]string, error) {
-	f, err := os.Open(filepath.Join(elem...))
+// walkDir calls fn with the name of each entry in the specified directory, reading dirBatchSize
+// entries at a time.  It stops at the first error returned by fn, or once ctx is canceled.
+func (fs *Store) walkDir(ctx context.Context, path string, fn func(name string) error) error {
+	f, err := os.Open(path)
 	if err != nil {
-		return nil, err
+		return err
+	}
+	defer f.Close()
+	for {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		names, err := f.Readdirnames(fs.dirBatchSize)
+		for _, name := range names {
+			if err := fn(name); err != nil {
+				return err
+			}
+		}
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
 	}
-	return f.Readdirnames(0)
 }
@@ -3,16 +3,30 @@ package file
 import (
 	"bufio"
 	"encoding/gob"
+	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"os"
 	"path/filepath"
 	"sync"
 
+	"github.com/inbucket/inbucket/pkg/metric"
 	"github.com/inbucket/inbucket/pkg/storage"
+	"github.com/inbucket/inbucket/pkg/stringutil"
 	"github.com/rs/zerolog/log"
 )
 
+// indexVersion is the schema version of the JSON lines index written by this version.  Version 1
+// indexes do not record their version; they are read as is, and upgraded by the next writeIndex.
+const indexVersion = 2
+
+// ErrUnknownIndexVersion indicates a mailbox index was written with a newer schema version.
+var ErrUnknownIndexVersion = errors.New("unknown mailbox index version")
+
+// wrapIndexWriter is replaced by tests to simulate failed index writes.
+var wrapIndexWriter = func(w io.Writer) io.Writer { return w }
+
 // mbox manages the mail for a specific user and correlates to a particular directory on disk.
 // mbox methods are not thread safe, mbox.RWMutex must be held prior to calling.
 type mbox struct {
@@ -24,6 +38,7 @@ type mbox struct {
 	indexLoaded bool
 	indexPath   string
 	messages    []*Message
+	totalSize   int64 // Sum of message sizes, updated whenever the index is read or written.
 }
 
 // getMessages scans the mailbox directory for .gob files and decodes them into
@@ -97,86 +112,302 @@ func (mb *mbox) purge() error {
 	return mb.writeIndex()
 }
 
-// readIndex loads the mailbox index data from disk
+// compact removes message files not present in the index, and index entries without a message
+// file, adding them to report.
+func (mb *mbox) compact(report *CompactReport, dryRun bool) error {
+	if err := mb.readIndex(); err != nil {
+		return err
+	}
+	indexed := make(map[string]bool, len(mb.messages))
+	kept := make([]*Message, 0, len(mb.messages))
+	for _, m := range mb.messages {
+		indexed[m.Fid+".raw"] = true
+		if _, err := os.Stat(m.rawPath()); err != nil {
+			if !os.IsNotExist(err) {
+				return err
+			}
+			report.MissingFiles = append(report.MissingFiles, m.rawPath())
+			continue
+		}
+		kept = append(kept, m)
+	}
+	names, err := filepath.Glob(filepath.Join(mb.path, "*.raw"))
+	if err != nil {
+		return err
+	}
+	orphans := 0
+	for _, path := range names {
+		if indexed[filepath.Base(path)] {
+			continue
+		}
+		report.OrphanFiles = append(report.OrphanFiles, path)
+		orphans++
+		if !dryRun {
+			log.Debug().Str("module", "storage").Str("path", path).Msg("Deleting orphan file")
+			if err := os.Remove(path); err != nil {
+				return err
+			}
+		}
+	}
+	if dryRun || (orphans == 0 && len(kept) == len(mb.messages)) {
+		return nil
+	}
+	mb.messages = kept
+	return mb.writeIndex()
+}
+
+// updateMetrics records the message count and total size of the mailbox.
+func (mb *mbox) updateMetrics() {
+	metric.SetMailbox(mb.name, len(mb.messages), mb.totalSize)
+}
+
+// updateTotalSize sums the sizes of the messages in the mailbox, so the quota can be checked
+// without visiting every message.
+func (mb *mbox) updateTotalSize() {
+	var size int64
+	for _, m := range mb.messages {
+		size += m.Fsize
+	}
+	mb.totalSize = size
+}
+
+// overQuota returns true if adding a message of size bytes would take the mailbox over the
+// quota of the store.
+func (mb *mbox) overQuota(size int64) bool {
+	return mb.store.quota > 0 && mb.totalSize+size > mb.store.quota
+}
+
+// indexHeader is the first line of a JSON lines index, it is followed by one line per Message.
+type indexHeader struct {
+	Mailbox string `json:"mailbox"`
+	Version int    `json:"version,omitempty"` // Schema version, absent from version 1 indexes.
+}
+
+// indexEntry is a decoded mailbox index held in the Store index cache.  The messages are copied
+// in and out of the cache, so the copies held by an mbox may be modified while its lock is held.
+type indexEntry struct {
+	name      string
+	messages  []Message
+	totalSize int64
+}
+
+// readIndex loads the mailbox index data from the index cache or disk, falling back to the legacy
+// gob index if a JSON lines index is not present.
 func (mb *mbox) readIndex() error {
-	// Clear message slice, open index
-	mb.messages = mb.messages[:0]
-	// Check if index exists
-	if _, err := os.Stat(mb.indexPath); err != nil {
-		// Does not exist, but that's not an error in our world
-		log.Debug().Str("module", "storage").Str("path", mb.indexPath).
-			Msg("Index does not yet exist")
-		mb.indexLoaded = true
+	if mb.loadCachedIndex() {
 		return nil
 	}
-	file, err := os.Open(mb.indexPath)
+	// Clear message slice
+	mb.messages = mb.messages[:0]
+	found, err := mb.scanIndex(func(msg *Message) {
+		mb.messages = append(mb.messages, msg)
+	})
 	if err != nil {
+		mb.messages = mb.messages[:0]
+		mb.totalSize = 0
 		return err
 	}
+	mb.indexLoaded = true
+	mb.updateTotalSize()
+	if found {
+		mb.cacheIndex()
+	}
+	return nil
+}
+
+// latestMessage returns the last message in the mailbox index, or nil if the mailbox is empty.
+// Unless the index is already loaded or cached, it is decoded without being kept in memory.
+func (mb *mbox) latestMessage() (*Message, error) {
+	if !mb.indexLoaded && !mb.loadCachedIndex() {
+		var latest *Message
+		_, err := mb.scanIndex(func(msg *Message) {
+			latest = msg
+		})
+		return latest, err
+	}
+	if len(mb.messages) == 0 {
+		return nil, nil
+	}
+	return mb.messages[len(mb.messages)-1], nil
+}
+
+// scanIndex decodes the mailbox index from disk, falling back to the legacy gob index if a JSON
+// lines index is not present, and calls visit with each message in order.  It returns false if
+// neither index exists.
+func (mb *mbox) scanIndex(visit func(msg *Message)) (found bool, err error) {
+	path := mb.indexPath
+	decode := mb.decodeIndex
+	// Check if index exists
+	if _, err := os.Stat(path); err != nil {
+		path = mb.legacyIndexPath()
+		decode = mb.decodeLegacyIndex
+		if _, err := os.Stat(path); err != nil {
+			// Does not exist, but that's not an error in our world
+			log.Debug().Str("module", "storage").Str("path", mb.indexPath).
+				Msg("Index does not yet exist")
+			return false, nil
+		}
+	}
+	file, err := os.Open(path)
+	if err != nil {
+		return false, err
+	}
 	defer func() {
 		if err := file.Close(); err != nil {
-			log.Error().Str("module", "storage").Str("path", mb.indexPath).Err(err).
+			log.Error().Str("module", "storage").Str("path", path).Err(err).
 				Msg("Failed to close")
 		}
 	}()
-	// Decode gob data
+	if mb.store.utc {
+		// Dates in indexes written before normalization was enabled may have any offset.
+		next := visit
+		visit = func(msg *Message) {
+			msg.Fdate = msg.Fdate.UTC()
+			next(msg)
+		}
+	}
 	br := mb.store.getPooledReader(file)
 	defer mb.store.putPooledReader(br)
-	dec := gob.NewDecoder(br)
+	if err := decode(br, visit); err != nil {
+		if err == ErrUnknownIndexVersion {
+			return false, fmt.Errorf("Mailbox %q: %w", path, err)
+		}
+		return false, fmt.Errorf("Corrupt mailbox %q: %v", path, err)
+	}
+	return true, nil
+}
+
+// loadCachedIndex copies the mailbox index from the store index cache, returning false if it is
+// not cached.
+func (mb *mbox) loadCachedIndex() bool {
+	if mb.store.indexCache == nil {
+		return false
+	}
+	entry, ok := mb.store.indexCache.Get(mb.dirName)
+	if !ok {
+		return false
+	}
+	mb.name = entry.name
+	mb.messages = make([]*Message, len(entry.messages))
+	for i := range entry.messages {
+		m := entry.messages[i]
+		m.mailbox = mb
+		mb.messages[i] = &m
+	}
+	mb.totalSize = entry.totalSize
+	mb.indexLoaded = true
+	return true
+}
+
+// cacheIndex copies the loaded mailbox index into the store index cache.
+func (mb *mbox) cacheIndex() {
+	if mb.store.indexCache == nil {
+		return
+	}
+	entry := &indexEntry{
+		name:      mb.name,
+		messages:  make([]Message, len(mb.messages)),
+		totalSize: mb.totalSize,
+	}
+	for i, m := range mb.messages {
+		entry.messages[i] = *m
+		entry.messages[i].mailbox = nil
+	}
+	mb.store.indexCache.Add(mb.dirName, entry)
+}
+
+// decodeIndex decodes JSON lines index data, calling visit with each message.  It returns
+// ErrUnknownIndexVersion, before calling visit, if the index has an unknown schema version.
+func (mb *mbox) decodeIndex(r io.Reader, visit func(msg *Message)) error {
+	dec := json.NewDecoder(r)
+	header := indexHeader{}
+	if err := dec.Decode(&header); err != nil {
+		return err
+	}
+	switch header.Version {
+	case 0, 1, indexVersion:
+	default:
+		return ErrUnknownIndexVersion
+	}
+	mb.name = header.Mailbox
+	for {
+		// Load messages until EOF
+		msg := &Message{}
+		if err := dec.Decode(msg); err != nil {
+			if err == io.EOF {
+				return nil
+			}
+			return err
+		}
+		// Older versions stored encoded subjects, written back decoded by the next writeIndex.
+		msg.Fsubject = stringutil.DecodeHeader(msg.Fsubject)
+		msg.mailbox = mb
+		visit(msg)
+	}
+}
+
+// decodeLegacyIndex decodes gob index data, as written by older versions of Inbucket, calling
+// visit with each message.
+func (mb *mbox) decodeLegacyIndex(r io.Reader, visit func(msg *Message)) error {
+	dec := gob.NewDecoder(r)
 	name := ""
-	if err = dec.Decode(&name); err != nil {
-		return fmt.Errorf("Corrupt mailbox %q: %v", mb.indexPath, err)
+	if err := dec.Decode(&name); err != nil {
+		return err
 	}
 	mb.name = name
 	for {
 		// Load messages until EOF
 		msg := &Message{}
-		if err = dec.Decode(msg); err != nil {
+		if err := dec.Decode(msg); err != nil {
 			if err == io.EOF {
-				break
+				return nil
 			}
-			return fmt.Errorf("Corrupt mailbox %q: %v", mb.indexPath, err)
+			return err
 		}
+		// Older versions stored encoded subjects, written back decoded by the next writeIndex.
+		msg.Fsubject = stringutil.DecodeHeader(msg.Fsubject)
 		msg.mailbox = mb
-		mb.messages = append(mb.messages, msg)
+		visit(msg)
 	}
-	mb.indexLoaded = true
-	return nil
 }
 
-// writeIndex overwrites the index on disk with the current mailbox data
+// writeIndex overwrites the index on disk with the current mailbox data, in JSON lines format.
+// Any legacy gob index is removed, along with the cached copy of the index.
 func (mb *mbox) writeIndex() error {
+	if mb.store.indexCache != nil {
+		mb.store.indexCache.Remove(mb.dirName)
+	}
+	mb.updateTotalSize()
 	// Lock for writing
 	if len(mb.messages) > 0 {
 		// Ensure mailbox directory exists
 		if err := mb.createDir(); err != nil {
 			return err
 		}
-		// Open index for writing
-		file, err := os.Create(mb.indexPath)
-		if err != nil {
-			return err
-		}
-		writer := bufio.NewWriter(file)
-		// Write each message and then flush
-		enc := gob.NewEncoder(writer)
-		if err = enc.Encode(mb.name); err != nil {
-			_ = file.Close()
+		// Write the index beside the live one, then replace it, so a failed write can not leave
+		// the mailbox with a truncated index.
+		tmpPath := mb.indexPath + ".tmp"
+		if err := mb.writeIndexFile(tmpPath); err != nil {
+			_ = os.Remove(tmpPath)
 			return err
 		}
-		for _, m := range mb.messages {
-			if err = enc.Encode(m); err != nil {
-				_ = file.Close()
+		if mb.store.verifyIndex {
+			if err := mb.verifyIndexFile(tmpPath); err != nil {
+				_ = os.Remove(tmpPath)
 				return err
 			}
 		}
-		if err := writer.Flush(); err != nil {
-			_ = file.Close()
+		if err := replaceFile(tmpPath, mb.indexPath, mb.store.fsync); err != nil {
+			_ = os.Remove(tmpPath)
 			return err
 		}
-		if err := file.Close(); err != nil {
-			log.Error().Str("module", "storage").Str("path", mb.indexPath).Err(err).
-				Msg("Failed to close")
+		if mb.store.fsync {
+			// Commit the names of the index and any new message files.
+			if err := syncDir(mb.path); err != nil {
+				return err
+			}
+		}
+		if err := os.Remove(mb.legacyIndexPath()); err != nil && !os.IsNotExist(err) {
 			return err
 		}
 	} else {
@@ -187,6 +418,102 @@ func (mb *mbox) writeIndex() error {
 	return nil
 }
 
+// writeIndexFile encodes the mailbox index to a new file at path.
+func (mb *mbox) writeIndexFile(path string) error {
+	file, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	writer := bufio.NewWriter(wrapIndexWriter(file))
+	// Write each message and then flush
+	enc := json.NewEncoder(writer)
+	if err = enc.Encode(&indexHeader{Mailbox: mb.name, Version: indexVersion}); err != nil {
+		_ = file.Close()
+		return err
+	}
+	for _, m := range mb.messages {
+		if err = enc.Encode(m); err != nil {
+			_ = file.Close()
+			return err
+		}
+	}
+	if err := writer.Flush(); err != nil {
+		_ = file.Close()
+		return err
+	}
+	if mb.store.fsync {
+		if err := syncFile(file); err != nil {
+			_ = file.Close()
+			return err
+		}
+	}
+	if err := file.Close(); err != nil {
+		log.Error().Str("module", "storage").Str("path", path).Err(err).
+			Msg("Failed to close")
+		return err
+	}
+	return nil
+}
+
+// verifyIndexFile decodes the index at path, checking it holds every message in the mailbox.
+func (mb *mbox) verifyIndexFile(path string) error {
+	file, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	count := 0
+	br := mb.store.getPooledReader(file)
+	defer mb.store.putPooledReader(br)
+	if err := mb.decodeIndex(br, func(*Message) { count++ }); err != nil {
+		return fmt.Errorf("verifying index %q: %v", path, err)
+	}
+	if count != len(mb.messages) {
+		return fmt.Errorf("verifying index %q: found %v messages, want %v", path, count,
+			len(mb.messages))
+	}
+	return nil
+}
+
+// replaceFile renames src to dst, replacing it.  If the rename fails, such as across devices, dst
+// is overwritten with a copy of src instead, synced to stable storage if sync is true.
+func replaceFile(src, dst string, sync bool) error {
+	err := os.Rename(src, dst)
+	if err == nil {
+		return nil
+	}
+	log.Warn().Str("module", "storage").Str("path", dst).Err(err).
+		Msg("Failed to rename index, copying instead")
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	out, err := os.Create(dst)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(out, in); err != nil {
+		_ = out.Close()
+		return err
+	}
+	if sync {
+		if err := syncFile(out); err != nil {
+			_ = out.Close()
+			return err
+		}
+	}
+	if err := out.Close(); err != nil {
+		return err
+	}
+	return os.Remove(src)
+}
+
+// legacyIndexPath returns the path of the gob index written by older versions of Inbucket.
+func (mb *mbox) legacyIndexPath() string {
+	return filepath.Join(mb.path, legacyIndexFileName)
+}
+
 // createDir checks for the presence of the path for this mailbox, creates it if needed
 func (mb *mbox) createDir() error {
 	if _, err := os.Stat(mb.path); err != nil {
@@ -195,6 +522,15 @@ func (mb *mbox) createDir() error {
 				Msg("Failed to create directory")
 			return err
 		}
+		if mb.store.fsync {
+			// Commit the new directories to their parents, up to the mail root.
+			for dir := mb.path; dir != mb.store.mailPath && dir != filepath.Dir(dir); {
+				dir = filepath.Dir(dir)
+				if err := syncDir(dir); err != nil {
+					return err
+				}
+			}
+		}
 	}
 	return nil
 }
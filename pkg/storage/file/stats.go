@@ -0,0 +1,48 @@
+package file
+
+import (
+	"expvar"
+	"io"
+)
+
+var (
+	// Store activity since startup, published under the "store" expvar map.
+	expAddedTotal        = new(expvar.Int)
+	expRemovedTotal      = new(expvar.Int)
+	expPurgedTotal       = new(expvar.Int)
+	expBytesWrittenTotal = new(expvar.Int)
+	expBytesReadTotal    = new(expvar.Int)
+)
+
+func init() {
+	m := expvar.NewMap("store")
+	m.Set("AddedTotal", expAddedTotal)
+	m.Set("RemovedTotal", expRemovedTotal)
+	m.Set("PurgedTotal", expPurgedTotal)
+	m.Set("BytesWrittenTotal", expBytesWrittenTotal)
+	m.Set("BytesReadTotal", expBytesReadTotal)
+	// A persistently empty ID queue means message IDs are generated faster than the generator
+	// can supply them.
+	m.Set("IDQueueDepth", expvar.Func(func() interface{} {
+		return len(countChannel)
+	}))
+}
+
+// ResetStats zeroes the store activity counters, for example after a maintenance window.
+func ResetStats() {
+	for _, v := range []*expvar.Int{expAddedTotal, expRemovedTotal, expPurgedTotal,
+		expBytesWrittenTotal, expBytesReadTotal} {
+		v.Set(0)
+	}
+}
+
+// countingReadCloser adds the number of bytes read to expBytesReadTotal.
+type countingReadCloser struct {
+	io.ReadCloser
+}
+
+func (r countingReadCloser) Read(p []byte) (int, error) {
+	n, err := r.ReadCloser.Read(p)
+	expBytesReadTotal.Add(int64(n))
+	return n, err
+}
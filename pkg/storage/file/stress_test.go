@@ -0,0 +1,154 @@
+package file
+
+import (
+	"context"
+	"fmt"
+	"math/rand"
+	"net/mail"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/inbucket/inbucket/pkg/config"
+	"github.com/inbucket/inbucket/pkg/message"
+	"github.com/inbucket/inbucket/pkg/storage"
+	"github.com/inbucket/inbucket/pkg/stringutil"
+)
+
+// TestStress runs workers performing a random mix of operations on shared mailboxes, then checks
+// that the indexes and raw message files agree.  Run with -race to detect unsynchronized access.
+func TestStress(t *testing.T) {
+	workers, iterations := 16, 200
+	if testing.Short() {
+		workers, iterations = 4, 50
+	}
+	mailboxes := []string{"alpha", "bravo", "charlie", "delta", "echo"}
+	ds, _ := setupDataStore(config.Storage{})
+	defer teardownDataStore(ds)
+	ctx := context.Background()
+
+	var ops int64
+	var wg sync.WaitGroup
+	start := time.Now()
+	for w := 0; w < workers; w++ {
+		wg.Add(1)
+		go func(w int) {
+			defer wg.Done()
+			rnd := rand.New(rand.NewSource(int64(w)))
+			for i := 0; i < iterations; i++ {
+				mailbox := mailboxes[rnd.Intn(len(mailboxes))]
+				if err := stressOp(ctx, ds, rnd, mailbox, fmt.Sprintf("%v-%v", w, i)); err != nil {
+					t.Errorf("Worker %v: %v", w, err)
+					return
+				}
+				atomic.AddInt64(&ops, 1)
+			}
+		}(w)
+	}
+	wg.Wait()
+	elapsed := time.Since(start)
+
+	// Every indexed message must have a raw file in the directory of its mailbox, and belong to a
+	// single mailbox.
+	indexed := make(map[string]string)
+	count := 0
+	err := ds.VisitMailboxes(ctx, func(msgs []storage.Message) bool {
+		for _, m := range msgs {
+			count++
+			fm := m.(*Message)
+			path := fm.rawPath()
+			if prev, ok := indexed[m.ID()]; ok {
+				t.Errorf("Message %v is indexed in mailboxes %v and %v", m.ID(), prev, m.Mailbox())
+			}
+			indexed[m.ID()] = m.Mailbox()
+			if want := stringutil.HashMailboxName(m.Mailbox()); filepath.Base(fm.mailbox.path) != want {
+				t.Errorf("Message %v of mailbox %v is in directory %v", m.ID(), m.Mailbox(),
+					fm.mailbox.path)
+			}
+			if !isFile(path) {
+				t.Errorf("Message %v of mailbox %v has no raw file %v", m.ID(), m.Mailbox(), path)
+			}
+		}
+		return true
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Every raw file must be referenced by an index.
+	err = filepath.Walk(ds.mailPath, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if info.IsDir() || !strings.HasSuffix(path, ".raw") {
+			return nil
+		}
+		if _, ok := indexed[strings.TrimSuffix(info.Name(), ".raw")]; !ok {
+			t.Errorf("Raw file %v is not referenced by an index", path)
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	t.Logf("%v operations by %v workers in %v (%.0f ops/s), %v messages remain", ops, workers,
+		elapsed, float64(ops)/elapsed.Seconds(), count)
+}
+
+// stressOp performs a random operation on the mailbox: adding a message about half of the time,
+// otherwise listing, removing a message, or occasionally purging the mailbox.
+func stressOp(ctx context.Context, ds *Store, rnd *rand.Rand, mailbox, subject string) error {
+	switch n := rnd.Intn(100); {
+	case n < 50:
+		source := "From: stress@example.com\r\nSubject: " + subject + "\r\n\r\n" +
+			strings.Repeat("Stress test body.\r\n", rnd.Intn(200)+1)
+		_, err := ds.AddMessage(ctx, &message.Delivery{
+			Meta: message.Metadata{
+				Mailbox: mailbox,
+				From:    &mail.Address{Address: "stress@example.com"},
+				Subject: subject,
+				Date:    time.Now(),
+				Size:    int64(len(source)),
+			},
+			Reader: strings.NewReader(source),
+		})
+		if err != nil {
+			return fmt.Errorf("add to %v: %v", mailbox, err)
+		}
+	case n < 70:
+		msgs, err := ds.GetMessages(ctx, mailbox)
+		if err != nil {
+			return fmt.Errorf("get messages of %v: %v", mailbox, err)
+		}
+		for _, m := range msgs {
+			if m.Mailbox() != mailbox {
+				return fmt.Errorf("got message %v of mailbox %v listing %v", m.ID(), m.Mailbox(),
+					mailbox)
+			}
+		}
+	case n < 95:
+		msgs, err := ds.GetMessages(ctx, mailbox)
+		if err != nil {
+			return fmt.Errorf("get messages of %v: %v", mailbox, err)
+		}
+		if len(msgs) == 0 {
+			return nil
+		}
+		id := msgs[rnd.Intn(len(msgs))].ID()
+		// Another worker may have removed the message since it was listed.
+		err = ds.RemoveMessage(ctx, mailbox, id)
+		if err != nil && err != storage.ErrNotExist {
+			return fmt.Errorf("remove %v from %v: %v", id, mailbox, err)
+		}
+	default:
+		if err := ds.PurgeMessages(ctx, mailbox); err != nil {
+			return fmt.Errorf("purge %v: %v", mailbox, err)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,89 @@
+package storage
+
+import (
+	"context"
+	"sync"
+)
+
+// Freezer is implemented by stores which can block changes while a consistent copy is made.
+type Freezer interface {
+	// Freeze blocks changes to the store until thaw is called.
+	Freeze() (thaw func())
+}
+
+// FreezableStore wraps a Store, blocking calls which change the store while it is frozen.
+type FreezableStore struct {
+	Store
+	mu sync.RWMutex
+}
+
+var _ Freezer = &FreezableStore{}
+var _ Pager = &FreezableStore{}
+var _ LatestVisitor = &FreezableStore{}
+
+// NewFreezableStore wraps store, allowing it to be frozen.
+func NewFreezableStore(store Store) *FreezableStore {
+	return &FreezableStore{Store: store}
+}
+
+// Freeze blocks changes to the store until thaw is called, waiting for changes in progress to
+// complete.
+func (s *FreezableStore) Freeze() (thaw func()) {
+	s.mu.Lock()
+	return s.mu.Unlock
+}
+
+// AddMessage stores the message, once the store is not frozen.
+func (s *FreezableStore) AddMessage(ctx context.Context, m Message) (string, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.Store.AddMessage(ctx, m)
+}
+
+// MarkSeen flags the message as having been read, once the store is not frozen.
+func (s *FreezableStore) MarkSeen(ctx context.Context, mailbox, id string) error {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.Store.MarkSeen(ctx, mailbox, id)
+}
+
+// MarkUnseen flags the message as not having been read, once the store is not frozen.
+func (s *FreezableStore) MarkUnseen(ctx context.Context, mailbox, id string) error {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.Store.MarkUnseen(ctx, mailbox, id)
+}
+
+// SetTags replaces the tags of the message, once the store is not frozen.
+func (s *FreezableStore) SetTags(ctx context.Context, mailbox, id string, tags []string) error {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.Store.SetTags(ctx, mailbox, id, tags)
+}
+
+// PurgeMessages deletes all messages in the named mailbox, once the store is not frozen.
+func (s *FreezableStore) PurgeMessages(ctx context.Context, mailbox string) error {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.Store.PurgeMessages(ctx, mailbox)
+}
+
+// RemoveMessage deletes the specified message, once the store is not frozen.
+func (s *FreezableStore) RemoveMessage(ctx context.Context, mailbox, id string) error {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.Store.RemoveMessage(ctx, mailbox, id)
+}
+
+// PageMessages returns a page of messages from the named mailbox, see Pager.
+func (s *FreezableStore) PageMessages(ctx context.Context, mailbox, after string, limit int,
+	match func(Message) bool) ([]Message, bool, error) {
+	return PageMessages(ctx, s.Store, mailbox, after, limit, match)
+}
+
+// VisitLatestMessages calls f with the latest message of each non-empty mailbox, see
+// LatestVisitor.
+func (s *FreezableStore) VisitLatestMessages(
+	ctx context.Context, f func(latest Message) (cont bool)) error {
+	return VisitLatestMessages(ctx, s.Store, f)
+}
@@ -0,0 +1,44 @@
+package storage_test
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/inbucket/inbucket/pkg/config"
+	"github.com/inbucket/inbucket/pkg/storage"
+	"github.com/inbucket/inbucket/pkg/storage/mem"
+	"github.com/inbucket/inbucket/pkg/test"
+)
+
+func TestFreezableStore(t *testing.T) {
+	ms, err := mem.New(config.Storage{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	fs := storage.NewFreezableStore(ms)
+	id, _ := test.DeliverToStore(t, fs, "box", "subject", time.Now())
+
+	thaw := fs.Freeze()
+	done := make(chan struct{})
+	go func() {
+		test.DeliverToStore(t, fs, "box", "blocked", time.Now())
+		close(done)
+	}()
+	// Reads are not blocked.
+	if _, err := fs.GetMessage(context.Background(), "box", id); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case <-done:
+		t.Fatal("AddMessage completed while frozen")
+	case <-time.After(50 * time.Millisecond):
+	}
+	thaw()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("AddMessage did not complete after thaw")
+	}
+	test.GetAndCountMessages(t, fs, "box", 2)
+}
@@ -0,0 +1,183 @@
+package storage
+
+import (
+	"context"
+	"time"
+
+	"github.com/inbucket/inbucket/pkg/metric"
+	"github.com/rs/zerolog/log"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// tracerName identifies the instrumentation library in recorded spans.
+const tracerName = "github.com/inbucket/inbucket/pkg/storage"
+
+// Span attribute keys.
+const (
+	attrMailbox = attribute.Key("mailbox.name")
+	attrID      = attribute.Key("message.id")
+	attrSize    = attribute.Key("message.size")
+)
+
+// timeNow is replaced by tests.
+var timeNow = time.Now
+
+// InstrumentedStore wraps a Store, recording Prometheus metrics for each call, logging changes to
+// the store at debug level, and recording OpenTelemetry spans for message operations.
+type InstrumentedStore struct {
+	store Store
+}
+
+var _ Store = &InstrumentedStore{}
+var _ Pager = &InstrumentedStore{}
+var _ LatestVisitor = &InstrumentedStore{}
+
+// NewInstrumentedStore wraps store, recording metrics for its calls.
+func NewInstrumentedStore(store Store) *InstrumentedStore {
+	return &InstrumentedStore{store: store}
+}
+
+// AddMessage stores the message, recording the duration of the call.
+func (s *InstrumentedStore) AddMessage(ctx context.Context, message Message) (string, error) {
+	ctx, span := startSpan(ctx, "AddMessage",
+		attrMailbox.String(message.Mailbox()), attrSize.Int64(message.Size()))
+	defer span.End()
+	start := timeNow()
+	id, err := s.store.AddMessage(ctx, message)
+	metric.StoreAddSeconds.WithLabelValues(metric.Outcome(err)).
+		Observe(timeNow().Sub(start).Seconds())
+	span.SetAttributes(attrID.String(id))
+	recordError(span, err)
+	if err == nil && id != "" {
+		log.Debug().Str("module", "storage").Str("mailbox", message.Mailbox()).Str("id", id).
+			Int64("size", message.Size()).Msg("Stored message")
+	}
+	return id, err
+}
+
+// GetMessage returns the specified message.
+func (s *InstrumentedStore) GetMessage(ctx context.Context, mailbox, id string) (Message, error) {
+	ctx, span := startSpan(ctx, "GetMessage", attrMailbox.String(mailbox), attrID.String(id))
+	defer span.End()
+	m, err := s.store.GetMessage(ctx, mailbox, id)
+	count("get_message", err)
+	if m != nil {
+		span.SetAttributes(attrSize.Int64(m.Size()))
+	}
+	recordError(span, err)
+	return m, err
+}
+
+// GetMessages returns the messages in the named mailbox.
+func (s *InstrumentedStore) GetMessages(ctx context.Context, mailbox string) ([]Message, error) {
+	ms, err := s.store.GetMessages(ctx, mailbox)
+	count("get_messages", err)
+	return ms, err
+}
+
+// PageMessages returns a page of messages from the named mailbox, see Pager.
+func (s *InstrumentedStore) PageMessages(ctx context.Context, mailbox, after string, limit int,
+	match func(Message) bool) ([]Message, bool, error) {
+	ms, more, err := PageMessages(ctx, s.store, mailbox, after, limit, match)
+	count("page_messages", err)
+	return ms, more, err
+}
+
+// MarkSeen flags the message as having been read.
+func (s *InstrumentedStore) MarkSeen(ctx context.Context, mailbox, id string) error {
+	err := s.store.MarkSeen(ctx, mailbox, id)
+	count("mark_seen", err)
+	if err == nil {
+		log.Debug().Str("module", "storage").Str("mailbox", mailbox).Str("id", id).
+			Msg("Marked message seen")
+	}
+	return err
+}
+
+// MarkUnseen flags the message as not having been read.
+func (s *InstrumentedStore) MarkUnseen(ctx context.Context, mailbox, id string) error {
+	err := s.store.MarkUnseen(ctx, mailbox, id)
+	count("mark_unseen", err)
+	if err == nil {
+		log.Debug().Str("module", "storage").Str("mailbox", mailbox).Str("id", id).
+			Msg("Marked message unseen")
+	}
+	return err
+}
+
+// SetTags replaces the tags of the message.
+func (s *InstrumentedStore) SetTags(ctx context.Context, mailbox, id string, tags []string) error {
+	err := s.store.SetTags(ctx, mailbox, id, tags)
+	count("set_tags", err)
+	if err == nil {
+		log.Debug().Str("module", "storage").Str("mailbox", mailbox).Str("id", id).
+			Strs("tags", tags).Msg("Set message tags")
+	}
+	return err
+}
+
+// PurgeMessages deletes all messages in the named mailbox.
+func (s *InstrumentedStore) PurgeMessages(ctx context.Context, mailbox string) error {
+	ctx, span := startSpan(ctx, "PurgeMessages", attrMailbox.String(mailbox))
+	defer span.End()
+	err := s.store.PurgeMessages(ctx, mailbox)
+	count("purge_messages", err)
+	recordError(span, err)
+	if err == nil {
+		log.Debug().Str("module", "storage").Str("mailbox", mailbox).Msg("Purged mailbox")
+	}
+	return err
+}
+
+// RemoveMessage deletes the specified message.
+func (s *InstrumentedStore) RemoveMessage(ctx context.Context, mailbox, id string) error {
+	ctx, span := startSpan(ctx, "RemoveMessage", attrMailbox.String(mailbox), attrID.String(id))
+	defer span.End()
+	err := s.store.RemoveMessage(ctx, mailbox, id)
+	count("remove_message", err)
+	recordError(span, err)
+	if err == nil {
+		log.Debug().Str("module", "storage").Str("mailbox", mailbox).Str("id", id).
+			Msg("Removed message")
+	}
+	return err
+}
+
+// VisitMailboxes accepts a function that will be called with the messages in each mailbox.
+func (s *InstrumentedStore) VisitMailboxes(
+	ctx context.Context, f func([]Message) (cont bool)) error {
+	err := s.store.VisitMailboxes(ctx, f)
+	count("visit_mailboxes", err)
+	return err
+}
+
+// VisitLatestMessages calls f with the latest message of each non-empty mailbox, see
+// LatestVisitor.
+func (s *InstrumentedStore) VisitLatestMessages(
+	ctx context.Context, f func(latest Message) (cont bool)) error {
+	err := VisitLatestMessages(ctx, s.store, f)
+	count("visit_latest_messages", err)
+	return err
+}
+
+// count increments the operation counter.
+func count(operation string, err error) {
+	metric.StoreOperations.WithLabelValues(operation, metric.Outcome(err)).Inc()
+}
+
+// startSpan starts a span for the named store operation, as a child of any span in ctx.
+func startSpan(
+	ctx context.Context, operation string, attrs ...attribute.KeyValue) (context.Context, trace.Span) {
+	return otel.Tracer(tracerName).Start(ctx, "storage."+operation, trace.WithAttributes(attrs...))
+}
+
+// recordError marks span as failed if err is not nil.
+func recordError(span trace.Span, err error) {
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+}
@@ -0,0 +1,252 @@
+package storage
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/inbucket/inbucket/pkg/metric"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/rs/zerolog"
+	"github.com/rs/zerolog/log"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// stubStore returns err from every call.
+type stubStore struct {
+	err error
+}
+
+func (s *stubStore) AddMessage(context.Context, Message) (string, error)               { return "1", s.err }
+func (s *stubStore) GetMessage(context.Context, string, string) (Message, error)       { return nil, s.err }
+func (s *stubStore) GetMessages(context.Context, string) ([]Message, error)            { return nil, s.err }
+func (s *stubStore) MarkSeen(context.Context, string, string) error                    { return s.err }
+func (s *stubStore) MarkUnseen(context.Context, string, string) error                  { return s.err }
+func (s *stubStore) SetTags(context.Context, string, string, []string) error           { return s.err }
+func (s *stubStore) PurgeMessages(context.Context, string) error                       { return s.err }
+func (s *stubStore) RemoveMessage(context.Context, string, string) error               { return s.err }
+func (s *stubStore) VisitMailboxes(context.Context, func([]Message) (cont bool)) error { return s.err }
+
+// stubMessage implements the Message methods used by InstrumentedStore.
+type stubMessage struct {
+	Message
+	mailbox string
+	size    int64
+}
+
+func (m *stubMessage) Mailbox() string { return m.mailbox }
+func (m *stubMessage) Size() int64     { return m.size }
+
+func TestInstrumentedStore(t *testing.T) {
+	// Each AddMessage call takes the next duration from elapsed.
+	epoch := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	elapsed := []time.Duration{
+		500 * time.Microsecond, 20 * time.Millisecond, 3 * time.Second, 20 * time.Second}
+	calls := 0
+	timeNow = func() time.Time {
+		calls++
+		if calls%2 == 1 {
+			return epoch
+		}
+		return epoch.Add(elapsed[calls/2-1])
+	}
+	defer func() { timeNow = time.Now }()
+	metric.StoreAddSeconds.Reset()
+	metric.StoreOperations.Reset()
+
+	ok := NewInstrumentedStore(&stubStore{})
+	failing := NewInstrumentedStore(&stubStore{err: errors.New("failed")})
+	for i := 0; i < 3; i++ {
+		if _, err := ok.AddMessage(context.Background(), &stubMessage{}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err := failing.AddMessage(context.Background(), &stubMessage{}); err == nil {
+		t.Fatal("expected error")
+	}
+	_, _ = ok.GetMessage(context.Background(), "box", "1")
+	_, _ = ok.GetMessage(context.Background(), "box", "2")
+	_, _ = failing.GetMessage(context.Background(), "box", "3")
+	_ = ok.RemoveMessage(context.Background(), "box", "1")
+	_ = failing.RemoveMessage(context.Background(), "box", "2")
+	_ = ok.PurgeMessages(context.Background(), "box")
+
+	sum := elapsed[0].Seconds() + elapsed[1].Seconds() + elapsed[2].Seconds()
+	want := `
+# HELP inbucket_store_add_message_duration_seconds Duration of message store AddMessage calls.
+# TYPE inbucket_store_add_message_duration_seconds histogram
+inbucket_store_add_message_duration_seconds_bucket{outcome="error",le="0.001"} 0
+inbucket_store_add_message_duration_seconds_bucket{outcome="error",le="0.0025"} 0
+inbucket_store_add_message_duration_seconds_bucket{outcome="error",le="0.005"} 0
+inbucket_store_add_message_duration_seconds_bucket{outcome="error",le="0.01"} 0
+inbucket_store_add_message_duration_seconds_bucket{outcome="error",le="0.025"} 0
+inbucket_store_add_message_duration_seconds_bucket{outcome="error",le="0.05"} 0
+inbucket_store_add_message_duration_seconds_bucket{outcome="error",le="0.1"} 0
+inbucket_store_add_message_duration_seconds_bucket{outcome="error",le="0.25"} 0
+inbucket_store_add_message_duration_seconds_bucket{outcome="error",le="0.5"} 0
+inbucket_store_add_message_duration_seconds_bucket{outcome="error",le="1"} 0
+inbucket_store_add_message_duration_seconds_bucket{outcome="error",le="2.5"} 0
+inbucket_store_add_message_duration_seconds_bucket{outcome="error",le="5"} 0
+inbucket_store_add_message_duration_seconds_bucket{outcome="error",le="10"} 0
+inbucket_store_add_message_duration_seconds_bucket{outcome="error",le="+Inf"} 1
+inbucket_store_add_message_duration_seconds_sum{outcome="error"} 20
+inbucket_store_add_message_duration_seconds_count{outcome="error"} 1
+inbucket_store_add_message_duration_seconds_bucket{outcome="success",le="0.001"} 1
+inbucket_store_add_message_duration_seconds_bucket{outcome="success",le="0.0025"} 1
+inbucket_store_add_message_duration_seconds_bucket{outcome="success",le="0.005"} 1
+inbucket_store_add_message_duration_seconds_bucket{outcome="success",le="0.01"} 1
+inbucket_store_add_message_duration_seconds_bucket{outcome="success",le="0.025"} 2
+inbucket_store_add_message_duration_seconds_bucket{outcome="success",le="0.05"} 2
+inbucket_store_add_message_duration_seconds_bucket{outcome="success",le="0.1"} 2
+inbucket_store_add_message_duration_seconds_bucket{outcome="success",le="0.25"} 2
+inbucket_store_add_message_duration_seconds_bucket{outcome="success",le="0.5"} 2
+inbucket_store_add_message_duration_seconds_bucket{outcome="success",le="1"} 2
+inbucket_store_add_message_duration_seconds_bucket{outcome="success",le="2.5"} 2
+inbucket_store_add_message_duration_seconds_bucket{outcome="success",le="5"} 3
+inbucket_store_add_message_duration_seconds_bucket{outcome="success",le="10"} 3
+inbucket_store_add_message_duration_seconds_bucket{outcome="success",le="+Inf"} 3
+inbucket_store_add_message_duration_seconds_sum{outcome="success"} ` +
+		strconv.FormatFloat(sum, 'g', -1, 64) + `
+inbucket_store_add_message_duration_seconds_count{outcome="success"} 3
+# HELP inbucket_store_operations_total Number of message store operations.
+# TYPE inbucket_store_operations_total counter
+inbucket_store_operations_total{operation="get_message",outcome="error"} 1
+inbucket_store_operations_total{operation="get_message",outcome="success"} 2
+inbucket_store_operations_total{operation="purge_messages",outcome="success"} 1
+inbucket_store_operations_total{operation="remove_message",outcome="error"} 1
+inbucket_store_operations_total{operation="remove_message",outcome="success"} 1
+`
+	err := testutil.GatherAndCompare(prometheus.DefaultGatherer, strings.NewReader(want),
+		"inbucket_store_add_message_duration_seconds", "inbucket_store_operations_total")
+	if err != nil {
+		t.Error(err)
+	}
+}
+
+// TestInstrumentedStoreLog verifies changes to the store are logged with structured fields.
+func TestInstrumentedStoreLog(t *testing.T) {
+	buf := new(bytes.Buffer)
+	defer func(logger zerolog.Logger) { log.Logger = logger }(log.Logger)
+	log.Logger = zerolog.New(buf).Level(zerolog.DebugLevel)
+	store := NewInstrumentedStore(&stubStore{})
+	ctx := context.Background()
+	if _, err := store.AddMessage(ctx, &stubMessage{mailbox: "box", size: 1234}); err != nil {
+		t.Fatal(err)
+	}
+	_ = store.MarkSeen(ctx, "box", "2")
+	_ = store.RemoveMessage(ctx, "box", "3")
+	_ = store.PurgeMessages(ctx, "other")
+	// Failed calls are logged by the caller.
+	_ = NewInstrumentedStore(&stubStore{err: errors.New("failed")}).RemoveMessage(ctx, "box", "4")
+
+	want := []map[string]interface{}{
+		{"message": "Stored message", "mailbox": "box", "id": "1", "size": 1234.0},
+		{"message": "Marked message seen", "mailbox": "box", "id": "2"},
+		{"message": "Removed message", "mailbox": "box", "id": "3"},
+		{"message": "Purged mailbox", "mailbox": "other"},
+	}
+	dec := json.NewDecoder(buf)
+	i := 0
+	for ; dec.More(); i++ {
+		var got map[string]interface{}
+		if err := dec.Decode(&got); err != nil {
+			t.Fatal(err)
+		}
+		if i >= len(want) {
+			t.Errorf("unexpected log entry: %v", got)
+			continue
+		}
+		if got["level"] != "debug" || got["module"] != "storage" {
+			t.Errorf("entry %v got level %v module %v, want debug storage", i, got["level"],
+				got["module"])
+		}
+		for k, v := range want[i] {
+			if got[k] != v {
+				t.Errorf("entry %v got %v %v, want: %v", i, k, got[k], v)
+			}
+		}
+	}
+	if i != len(want) {
+		t.Errorf("got %v log entries, want: %v", i, len(want))
+	}
+}
+
+// TestInstrumentedStoreTrace verifies spans are recorded for message operations.
+func TestInstrumentedStoreTrace(t *testing.T) {
+	exporter := tracetest.NewInMemoryExporter()
+	defer func(tp trace.TracerProvider) { otel.SetTracerProvider(tp) }(otel.GetTracerProvider())
+	otel.SetTracerProvider(sdktrace.NewTracerProvider(
+		sdktrace.WithSpanProcessor(sdktrace.NewSimpleSpanProcessor(exporter))))
+	store := NewInstrumentedStore(&stubStore{})
+	ctx := context.Background()
+	if _, err := store.AddMessage(ctx, &stubMessage{mailbox: "box", size: 1234}); err != nil {
+		t.Fatal(err)
+	}
+	_, _ = store.GetMessage(ctx, "box", "2")
+	_ = store.RemoveMessage(ctx, "box", "3")
+	_ = store.PurgeMessages(ctx, "other")
+	_ = store.MarkSeen(ctx, "box", "4")
+	_ = NewInstrumentedStore(&stubStore{err: errors.New("failed")}).RemoveMessage(ctx, "box", "5")
+
+	want := []struct {
+		name   string
+		attrs  map[attribute.Key]attribute.Value
+		status codes.Code
+	}{
+		{"storage.AddMessage", map[attribute.Key]attribute.Value{
+			attrMailbox: attribute.StringValue("box"),
+			attrID:      attribute.StringValue("1"),
+			attrSize:    attribute.Int64Value(1234),
+		}, codes.Unset},
+		{"storage.GetMessage", map[attribute.Key]attribute.Value{
+			attrMailbox: attribute.StringValue("box"),
+			attrID:      attribute.StringValue("2"),
+		}, codes.Unset},
+		{"storage.RemoveMessage", map[attribute.Key]attribute.Value{
+			attrMailbox: attribute.StringValue("box"),
+			attrID:      attribute.StringValue("3"),
+		}, codes.Unset},
+		{"storage.PurgeMessages", map[attribute.Key]attribute.Value{
+			attrMailbox: attribute.StringValue("other"),
+		}, codes.Unset},
+		{"storage.RemoveMessage", map[attribute.Key]attribute.Value{
+			attrMailbox: attribute.StringValue("box"),
+			attrID:      attribute.StringValue("5"),
+		}, codes.Error},
+	}
+	spans := exporter.GetSpans()
+	if len(spans) != len(want) {
+		t.Fatalf("got %v spans, want: %v", len(spans), len(want))
+	}
+	for i, span := range spans {
+		if span.Name != want[i].name {
+			t.Errorf("span %v got name %q, want: %q", i, span.Name, want[i].name)
+		}
+		if span.Parent.IsValid() {
+			t.Errorf("span %v got parent %v, want root span", i, span.Parent.SpanID())
+		}
+		if span.Status.Code != want[i].status {
+			t.Errorf("span %v got status %v, want: %v", i, span.Status.Code, want[i].status)
+		}
+		got := make(map[attribute.Key]attribute.Value)
+		for _, kv := range span.Attributes {
+			got[kv.Key] = kv.Value
+		}
+		for k, v := range want[i].attrs {
+			if got[k] != v {
+				t.Errorf("span %v got %v %v, want: %v", i, k, got[k].Emit(), v.Emit())
+			}
+		}
+	}
+}
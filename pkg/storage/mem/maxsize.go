@@ -23,24 +23,23 @@ func (s *Store) maxSizeEnforcer(maxSize int64) {
 			el := all.PushBack(m)
 			m.el = el
 			curSize += int64(m.Size())
-			for curSize > maxSize {
+			for curSize > maxSize && all.Len() > 0 {
 				// Remove oldest message.
-				el := all.Front()
-				all.Remove(el)
-				m := el.Value.(*Message)
-				if s.removeMessage(m.mailbox, m.id) != nil {
-					curSize -= int64(m.Size())
-				}
+				m := all.Remove(all.Front()).(*Message)
+				m.el = nil
+				curSize -= int64(m.Size())
+				s.removeMessage(m.mailbox, m.id)
 			}
 			close(md.done)
 		case md, ok := <-s.remove:
 			if !ok {
 				return
 			}
-			// Remove message from all.
+			// Remove message from all, unless it was already evicted.
 			m := md.msg
-			el := all.Remove(m.el)
-			if el != nil {
+			if m.el != nil {
+				all.Remove(m.el)
+				m.el = nil
 				curSize -= int64(m.Size())
 			}
 			close(md.done)
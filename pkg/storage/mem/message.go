@@ -8,6 +8,7 @@ import (
 	"net/mail"
 	"time"
 
+	"github.com/inbucket/inbucket/pkg/dkim"
 	"github.com/inbucket/inbucket/pkg/storage"
 )
 
@@ -22,10 +23,25 @@ type Message struct {
 	subject string
 	source  []byte
 	seen    bool
+	envid   string
+	spf     string
+	tags    []string
+	dkim    dkim.Result
+	dkimdom string
+	nattach int
+	attsize int64
+	snippet string
+	prio    int
+	recv    time.Time
 	el      *list.Element // This message in Store.messages
 }
 
 var _ storage.Message = &Message{}
+var _ storage.DKIMMessage = &Message{}
+var _ storage.AttachmentMessage = &Message{}
+var _ storage.SnippetMessage = &Message{}
+var _ storage.PriorityMessage = &Message{}
+var _ storage.ReceivedMessage = &Message{}
 
 // Mailbox returns the mailbox name.
 func (m *Message) Mailbox() string { return m.mailbox }
@@ -55,3 +71,27 @@ func (m *Message) Size() int64 { return int64(len(m.source)) }
 
 // Seen returns the message seen flag.
 func (m *Message) Seen() bool { return m.seen }
+
+// EnvelopeID returns the SMTP DSN envelope ID.
+func (m *Message) EnvelopeID() string { return m.envid }
+
+// SPFResult returns the result of the SPF check made when the message was received.
+func (m *Message) SPFResult() string { return m.spf }
+
+// Tags returns the message tags.
+func (m *Message) Tags() []string { return m.tags }
+
+// DKIM returns the recorded DKIM result and signing domain.
+func (m *Message) DKIM() (dkim.Result, string) { return m.dkim, m.dkimdom }
+
+// Attachments returns the number of attachments, and their total decoded size.
+func (m *Message) Attachments() (int, int64) { return m.nattach, m.attsize }
+
+// Snippet returns the beginning of the message text.
+func (m *Message) Snippet() string { return m.snippet }
+
+// Priority returns the priority of the message.
+func (m *Message) Priority() int { return m.prio }
+
+// ReceivedAt returns the time the message was added to the store.
+func (m *Message) ReceivedAt() time.Time { return m.recv }
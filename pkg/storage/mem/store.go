@@ -1,13 +1,17 @@
 package mem
 
 import (
+	"bytes"
+	"context"
 	"fmt"
 	"io/ioutil"
 	"sort"
 	"strconv"
 	"sync"
+	"time"
 
 	"github.com/inbucket/inbucket/pkg/config"
+	"github.com/inbucket/inbucket/pkg/dkim"
 	"github.com/inbucket/inbucket/pkg/storage"
 )
 
@@ -15,9 +19,10 @@ import (
 type Store struct {
 	sync.Mutex
 	boxes    map[string]*mbox
-	cap      int           // Per-mailbox message cap.
-	incoming chan *msgDone // New messages for size enforcer.
-	remove   chan *msgDone // Remove deleted messages from size enforcer.
+	cap      int                   // Per-mailbox message cap.
+	overflow config.OverflowPolicy // Applied to mailboxes at the cap.
+	incoming chan *msgDone         // New messages for size enforcer.
+	remove   chan *msgDone         // Remove deleted messages from size enforcer.
 }
 
 type mbox struct {
@@ -29,12 +34,14 @@ type mbox struct {
 }
 
 var _ storage.Store = &Store{}
+var _ storage.DKIMRecorder = &Store{}
 
 // New returns an emtpy memory store.
 func New(cfg config.Storage) (storage.Store, error) {
 	s := &Store{
-		boxes: make(map[string]*mbox),
-		cap:   cfg.MailboxMsgCap,
+		boxes:    make(map[string]*mbox),
+		cap:      cfg.MailboxMsgCap,
+		overflow: cfg.OverflowPolicy,
 	}
 	if str, ok := cfg.Params["maxkb"]; ok {
 		maxKB, err := strconv.ParseInt(str, 10, 64)
@@ -52,7 +59,10 @@ func New(cfg config.Storage) (storage.Store, error) {
 }
 
 // AddMessage stores the message, message ID and Size will be ignored.
-func (s *Store) AddMessage(message storage.Message) (id string, err error) {
+func (s *Store) AddMessage(ctx context.Context, message storage.Message) (id string, err error) {
+	if err := ctx.Err(); err != nil {
+		return "", err
+	}
 	r, ierr := message.Source()
 	if ierr != nil {
 		err = ierr
@@ -69,8 +79,28 @@ func (s *Store) AddMessage(message storage.Message) (id string, err error) {
 		to:      message.To(),
 		date:    message.Date(),
 		subject: message.Subject(),
+		envid:   message.EnvelopeID(),
+		spf:     message.SPFResult(),
+		tags:    message.Tags(),
+		recv:    time.Now(),
 	}
+	summary := storage.Summarize(bytes.NewReader(source))
+	m.nattach, m.attsize, m.snippet = summary.AttachmentCount, summary.AttachmentBytes,
+		summary.Snippet
+	m.prio = summary.Priority
+	var capped []*Message
+	discard := false
 	s.withMailbox(message.Mailbox(), true, func(mb *mbox) {
+		if s.cap > 0 && len(mb.messages) >= s.cap {
+			switch s.overflow {
+			case config.OverflowReject:
+				err = storage.ErrMailboxFull
+				return
+			case config.OverflowDropNewest:
+				discard = true
+				return
+			}
+		}
 		// Generate message ID.
 		mb.last++
 		m.index = mb.last
@@ -81,19 +111,32 @@ func (s *Store) AddMessage(message storage.Message) (id string, err error) {
 		if s.cap > 0 {
 			// Enforce cap.
 			for len(mb.messages) > s.cap {
-				delete(mb.messages, strconv.Itoa(mb.first))
+				first := strconv.Itoa(mb.first)
+				if old := mb.messages[first]; old != nil {
+					capped = append(capped, old)
+					delete(mb.messages, first)
+				}
 				mb.first++
 			}
 		}
 	})
+	if err != nil || discard {
+		return "", err
+	}
+	for _, old := range capped {
+		s.enforcerRemove(old)
+	}
 	s.enforcerDeliver(m)
 	return id, err
 }
 
 // GetMessage gets a mesage.
-func (s *Store) GetMessage(mailbox, id string) (m storage.Message, err error) {
+func (s *Store) GetMessage(ctx context.Context, mailbox, id string) (m storage.Message, err error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
 	if id == "latest" {
-		ms, err := s.GetMessages(mailbox)
+		ms, err := s.GetMessages(ctx, mailbox)
 		if err != nil {
 			return nil, err
 		}
@@ -114,7 +157,10 @@ func (s *Store) GetMessage(mailbox, id string) (m storage.Message, err error) {
 }
 
 // GetMessages gets a list of messages.
-func (s *Store) GetMessages(mailbox string) (ms []storage.Message, err error) {
+func (s *Store) GetMessages(ctx context.Context, mailbox string) (ms []storage.Message, err error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
 	s.withMailbox(mailbox, false, func(mb *mbox) {
 		ms = make([]storage.Message, 0, len(mb.messages))
 		for _, v := range mb.messages {
@@ -128,7 +174,10 @@ func (s *Store) GetMessages(mailbox string) (ms []storage.Message, err error) {
 }
 
 // MarkSeen marks a message as having been read.
-func (s *Store) MarkSeen(mailbox, id string) error {
+func (s *Store) MarkSeen(ctx context.Context, mailbox, id string) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
 	s.withMailbox(mailbox, true, func(mb *mbox) {
 		m := mb.messages[id]
 		if m != nil {
@@ -138,8 +187,61 @@ func (s *Store) MarkSeen(mailbox, id string) error {
 	return nil
 }
 
+// MarkUnseen marks a message as not having been read.
+func (s *Store) MarkUnseen(ctx context.Context, mailbox, id string) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	s.withMailbox(mailbox, true, func(mb *mbox) {
+		m := mb.messages[id]
+		if m != nil {
+			m.seen = false
+		}
+	})
+	return nil
+}
+
+// SetTags replaces the tags of a message.
+func (s *Store) SetTags(ctx context.Context, mailbox, id string, tags []string) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	var err error
+	s.withMailbox(mailbox, true, func(mb *mbox) {
+		m := mb.messages[id]
+		if m == nil {
+			err = storage.ErrNotExist
+			return
+		}
+		m.tags = append([]string(nil), tags...)
+	})
+	return err
+}
+
+// SetDKIM records the DKIM result and signing domain of a message.
+func (s *Store) SetDKIM(
+	ctx context.Context, mailbox, id string, result dkim.Result, domain string) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	var err error
+	s.withMailbox(mailbox, true, func(mb *mbox) {
+		m := mb.messages[id]
+		if m == nil {
+			err = storage.ErrNotExist
+			return
+		}
+		m.dkim = result
+		m.dkimdom = domain
+	})
+	return err
+}
+
 // PurgeMessages deletes the contents of a mailbox.
-func (s *Store) PurgeMessages(mailbox string) error {
+func (s *Store) PurgeMessages(ctx context.Context, mailbox string) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
 	var messages map[string]*Message
 	s.withMailbox(mailbox, true, func(mb *mbox) {
 		messages = mb.messages
@@ -167,7 +269,10 @@ func (s *Store) removeMessage(mailbox, id string) *Message {
 }
 
 // RemoveMessage deletes a single message.
-func (s *Store) RemoveMessage(mailbox, id string) error {
+func (s *Store) RemoveMessage(ctx context.Context, mailbox, id string) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
 	m := s.removeMessage(mailbox, id)
 	if m != nil {
 		s.enforcerRemove(m)
@@ -176,7 +281,7 @@ func (s *Store) RemoveMessage(mailbox, id string) error {
 }
 
 // VisitMailboxes visits each mailbox in the store.
-func (s *Store) VisitMailboxes(f func([]storage.Message) (cont bool)) error {
+func (s *Store) VisitMailboxes(ctx context.Context, f func([]storage.Message) (cont bool)) error {
 	// Lock store, get names of all mailboxes.
 	s.Lock()
 	boxNames := make([]string, 0, len(s.boxes))
@@ -186,7 +291,10 @@ func (s *Store) VisitMailboxes(f func([]storage.Message) (cont bool)) error {
 	s.Unlock()
 	// Process mailboxes.
 	for _, mailbox := range boxNames {
-		ms, _ := s.GetMessages(mailbox)
+		ms, err := s.GetMessages(ctx, mailbox)
+		if err != nil {
+			return err
+		}
 		if !f(ms) {
 			break
 		}
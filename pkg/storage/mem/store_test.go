@@ -1,6 +1,7 @@
 package mem
 
 import (
+	"context"
 	"sync"
 	"testing"
 	"time"
@@ -45,7 +46,7 @@ func TestMaxSize(t *testing.T) {
 	}
 	// Calculate actual size.
 	gotSize := int64(0)
-	s.VisitMailboxes(func(messages []storage.Message) bool {
+	s.VisitMailboxes(context.Background(), func(messages []storage.Message) bool {
 		for _, m := range messages {
 			gotSize += m.Size()
 		}
@@ -63,16 +64,16 @@ func TestMaxSize(t *testing.T) {
 	wg.Add(len(boxes))
 	for _, mailbox := range boxes {
 		go func(mailbox string) {
-			err := s.PurgeMessages(mailbox)
+			defer wg.Done()
+			err := s.PurgeMessages(context.Background(), mailbox)
 			if err != nil {
-				t.Fatal(err)
+				t.Error(err)
 			}
-			wg.Done()
 		}(mailbox)
 	}
 	wg.Wait()
 	count := 0
-	s.VisitMailboxes(func(messages []storage.Message) bool {
+	s.VisitMailboxes(context.Background(), func(messages []storage.Message) bool {
 		count += len(messages)
 		return true
 	})
@@ -80,3 +81,63 @@ func TestMaxSize(t *testing.T) {
 		t.Errorf("Got %v total messages, want: %v", count, 0)
 	}
 }
+
+// TestPurgeReleasesSize verifies purged messages no longer count towards maxkb.
+func TestPurgeReleasesSize(t *testing.T) {
+	s, _ := New(config.Storage{Params: map[string]string{"maxkb": "2"}})
+	// Fill the store using the first mailbox, then purge it.
+	n := 0
+	for size := int64(0); size < 2048; n++ {
+		_, nbytes := test.DeliverToStore(t, s, "alpha", "subject", time.Now())
+		size += nbytes
+	}
+	if err := s.PurgeMessages(context.Background(), "alpha"); err != nil {
+		t.Fatal(err)
+	}
+	test.GetAndCountMessages(t, s, "alpha", 0)
+	// Delivering fewer messages than fit in the store should not trigger deletions.
+	for i := 0; i < n-2; i++ {
+		test.DeliverToStore(t, s, "beta", "subject", time.Now())
+	}
+	test.GetAndCountMessages(t, s, "beta", n-2)
+}
+
+// TestConcurrentAccess exercises the store from multiple goroutines, it should be run with the race
+// detector enabled.
+func TestConcurrentAccess(t *testing.T) {
+	s, _ := New(config.Storage{MailboxMsgCap: 5, Params: map[string]string{"maxkb": "4"}})
+	boxes := []string{"alpha", "beta", "gamma"}
+	wg := &sync.WaitGroup{}
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func(mailbox string) {
+			defer wg.Done()
+			for j := 0; j < 20; j++ {
+				id, _ := test.DeliverToStore(t, s, mailbox, "subject", time.Now())
+				msgs, err := s.GetMessages(context.Background(), mailbox)
+				if err != nil {
+					t.Error(err)
+					return
+				}
+				if len(msgs) > 5 {
+					t.Errorf("Mailbox %q has %v messages, should be capped at 5", mailbox, len(msgs))
+				}
+				for _, m := range msgs {
+					_ = m.Seen()
+				}
+				if err := s.MarkSeen(context.Background(), mailbox, id); err != nil {
+					t.Error(err)
+				}
+				if j%5 == 0 {
+					if err := s.RemoveMessage(context.Background(), mailbox, id); err != nil {
+						t.Error(err)
+					}
+				}
+			}
+			if err := s.PurgeMessages(context.Background(), mailbox); err != nil {
+				t.Error(err)
+			}
+		}(boxes[i%len(boxes)])
+	}
+	wg.Wait()
+}
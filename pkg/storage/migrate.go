@@ -0,0 +1,39 @@
+package storage
+
+import "context"
+
+// MigrateProgress is called by Migrate after each message of a mailbox has been copied.
+type MigrateProgress func(mailbox string, n, total int)
+
+// Migrate copies every message in src to dst, returning the number of messages copied.  Messages
+// keep their date and seen flag, and their ID if dst implements Importer.  Each message is added
+// to dst individually, so if an error occurs the messages copied so far remain in dst.
+func Migrate(ctx context.Context, src, dst Store, progress MigrateProgress) (count int, err error) {
+	add := dst.AddMessage
+	if importer, ok := dst.(Importer); ok {
+		add = importer.ImportMessage
+	}
+	verr := src.VisitMailboxes(ctx, func(messages []Message) bool {
+		for i, m := range messages {
+			var id string
+			id, err = add(ctx, m)
+			if err != nil {
+				return false
+			}
+			if id != "" && m.Seen() {
+				if err = dst.MarkSeen(ctx, m.Mailbox(), id); err != nil {
+					return false
+				}
+			}
+			count++
+			if progress != nil {
+				progress(m.Mailbox(), i+1, len(messages))
+			}
+		}
+		return true
+	})
+	if err != nil {
+		return count, err
+	}
+	return count, verr
+}
@@ -0,0 +1,155 @@
+package storage_test
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"net/mail"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/inbucket/inbucket/pkg/config"
+	"github.com/inbucket/inbucket/pkg/message"
+	"github.com/inbucket/inbucket/pkg/storage"
+	"github.com/inbucket/inbucket/pkg/storage/file"
+	"github.com/inbucket/inbucket/pkg/storage/sqlite"
+)
+
+// TestMigrate copies messages from a file store to SQLite and back, verifying nothing is lost.
+func TestMigrate(t *testing.T) {
+	dir, err := ioutil.TempDir("", "inbucket")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	src := openStore(t, "file", filepath.Join(dir, "src"))
+	base := time.Date(2021, 1, 2, 3, 4, 5, 0, time.UTC)
+	for i := 0; i < 100; i++ {
+		mailbox := fmt.Sprintf("box%v", i%7)
+		content := fmt.Sprintf("Subject: message %v\r\n\r\nbody %v\r\n", i, i)
+		id, err := src.AddMessage(context.Background(), &message.Delivery{
+			Meta: message.Metadata{
+				Mailbox:    mailbox,
+				From:       &mail.Address{Name: "Sender", Address: "from@example.com"},
+				To:         []*mail.Address{{Address: mailbox + "@example.com"}},
+				Date:       base.Add(time.Duration(i) * time.Minute),
+				Subject:    fmt.Sprintf("message %v", i),
+				EnvelopeID: fmt.Sprintf("env%v", i),
+			},
+			Reader: strings.NewReader(content),
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if i%3 == 0 {
+			if err := src.MarkSeen(context.Background(), mailbox, id); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+
+	db := openStore(t, "sqlite", filepath.Join(dir, "inbucket.db"))
+	defer db.(*sqlite.Store).Close()
+	progress := make(map[string]string)
+	count, err := storage.Migrate(context.Background(), src, db, func(mailbox string, n, total int) {
+		progress[mailbox] = fmt.Sprintf("%v/%v", n, total)
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if count != 100 {
+		t.Errorf("migrated %v messages, want 100", count)
+	}
+	if len(progress) != 7 || progress["box0"] != "15/15" || progress["box6"] != "14/14" {
+		t.Errorf("got final progress %v", progress)
+	}
+	compareStores(t, src, db, false)
+
+	// SQLite IDs are kept by the file store.
+	dst := openStore(t, "file", filepath.Join(dir, "dst"))
+	count, err = storage.Migrate(context.Background(), db, dst, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if count != 100 {
+		t.Errorf("migrated %v messages, want 100", count)
+	}
+	compareStores(t, db, dst, true)
+}
+
+// openStore creates a store of the given type at path.
+func openStore(t *testing.T, kind string, path string) storage.Store {
+	t.Helper()
+	var store storage.Store
+	var err error
+	conf := config.Storage{Type: kind, Params: map[string]string{"path": path}}
+	switch kind {
+	case "file":
+		store, err = file.New(conf)
+	case "sqlite":
+		store, err = sqlite.New(conf)
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	return store
+}
+
+// compareStores verifies every message in a has an equivalent in b.
+func compareStores(t *testing.T, a, b storage.Store, sameIDs bool) {
+	t.Helper()
+	total := 0
+	err := a.VisitMailboxes(context.Background(), func(want []storage.Message) bool {
+		mailbox := want[0].Mailbox()
+		got, err := b.GetMessages(context.Background(), mailbox)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(got) != len(want) {
+			t.Errorf("mailbox %v has %v messages, want %v", mailbox, len(got), len(want))
+			return true
+		}
+		for i, w := range want {
+			g := got[i]
+			if sameIDs && g.ID() != w.ID() {
+				t.Errorf("%v message %v got ID %q, want %q", mailbox, i, g.ID(), w.ID())
+			}
+			if g.Subject() != w.Subject() || !g.Date().Equal(w.Date()) ||
+				g.From().String() != w.From().String() || g.Seen() != w.Seen() ||
+				g.EnvelopeID() != w.EnvelopeID() || len(g.To()) != 1 {
+				t.Errorf("%v message %v got %q %v %v seen=%v, want %q %v %v seen=%v", mailbox, i,
+					g.Subject(), g.Date(), g.From(), g.Seen(),
+					w.Subject(), w.Date(), w.From(), w.Seen())
+			}
+			if gs, ws := readSource(t, g), readSource(t, w); gs != ws {
+				t.Errorf("%v message %v got source %q, want %q", mailbox, i, gs, ws)
+			}
+			total++
+		}
+		return true
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if total != 100 {
+		t.Errorf("compared %v messages, want 100", total)
+	}
+}
+
+// readSource returns the content of message m.
+func readSource(t *testing.T, m storage.Message) string {
+	t.Helper()
+	r, err := m.Source()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+	b, err := ioutil.ReadAll(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(b)
+}
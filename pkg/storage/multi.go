@@ -0,0 +1,165 @@
+package storage
+
+import (
+	"context"
+	"fmt"
+	"path/filepath"
+	"strings"
+
+	"github.com/inbucket/inbucket/pkg/config"
+)
+
+// RoutingFunc returns the store holding the named mailbox.
+type RoutingFunc func(mailbox string) Store
+
+// MultiStore is a Store which routes each mailbox to one of several backend stores.
+type MultiStore struct {
+	route  RoutingFunc
+	stores []Store
+}
+
+var _ Store = &MultiStore{}
+var _ MailboxChecker = &MultiStore{}
+var _ Syncer = &MultiStore{}
+var _ Pager = &MultiStore{}
+var _ LatestVisitor = &MultiStore{}
+
+// NewMultiStore creates a MultiStore over stores, which must include every store returned by
+// route.
+func NewMultiStore(route RoutingFunc, stores ...Store) *MultiStore {
+	return &MultiStore{route: route, stores: stores}
+}
+
+// NewDomainStore creates a MultiStore holding the mailboxes of domains matching each route in
+// routes, and all other mailboxes in def.  A mailbox name is matched against the part following
+// its last @, or the whole name if it has none, so routing requires full or domain mailbox
+// naming.  The first matching route is used.
+func NewDomainStore(def Store, routes []config.StoreRoute, stores []Store) *MultiStore {
+	route := func(mailbox string) Store {
+		domain := strings.ToLower(mailbox[strings.LastIndex(mailbox, "@")+1:])
+		for i, r := range routes {
+			if ok, _ := filepath.Match(r.DomainGlob, domain); ok {
+				return stores[i]
+			}
+		}
+		return def
+	}
+	return NewMultiStore(route, append([]Store{def}, stores...)...)
+}
+
+// multiFromConfig creates the additional stores configured by c.Stores, and combines them with
+// def.
+func multiFromConfig(c config.Storage, def Store) (Store, error) {
+	stores := make([]Store, len(c.Stores))
+	for i, r := range c.Stores {
+		sc := c
+		sc.Type = r.Type
+		sc.Params = make(map[string]string)
+		for k, v := range r.Params {
+			sc.Params[k] = v
+		}
+		if r.Path != "" {
+			sc.Params["path"] = r.Path
+		}
+		sc.Stores = nil
+		store, err := FromConfig(sc)
+		if err != nil {
+			return nil, fmt.Errorf("store %q: %v", r.Name, err)
+		}
+		stores[i] = store
+	}
+	return NewDomainStore(def, c.Stores, stores), nil
+}
+
+// AddMessage stores the message in the store for its mailbox.
+func (s *MultiStore) AddMessage(ctx context.Context, m Message) (string, error) {
+	return s.route(m.Mailbox()).AddMessage(ctx, m)
+}
+
+// GetMessage returns the specified message.
+func (s *MultiStore) GetMessage(ctx context.Context, mailbox, id string) (Message, error) {
+	return s.route(mailbox).GetMessage(ctx, mailbox, id)
+}
+
+// GetMessages returns the messages in the named mailbox.
+func (s *MultiStore) GetMessages(ctx context.Context, mailbox string) ([]Message, error) {
+	return s.route(mailbox).GetMessages(ctx, mailbox)
+}
+
+// MarkSeen flags the message as having been read.
+func (s *MultiStore) MarkSeen(ctx context.Context, mailbox, id string) error {
+	return s.route(mailbox).MarkSeen(ctx, mailbox, id)
+}
+
+// MarkUnseen flags the message as not having been read.
+func (s *MultiStore) MarkUnseen(ctx context.Context, mailbox, id string) error {
+	return s.route(mailbox).MarkUnseen(ctx, mailbox, id)
+}
+
+// SetTags replaces the tags of the message.
+func (s *MultiStore) SetTags(ctx context.Context, mailbox, id string, tags []string) error {
+	return s.route(mailbox).SetTags(ctx, mailbox, id, tags)
+}
+
+// PurgeMessages deletes all messages in the named mailbox.
+func (s *MultiStore) PurgeMessages(ctx context.Context, mailbox string) error {
+	return s.route(mailbox).PurgeMessages(ctx, mailbox)
+}
+
+// RemoveMessage deletes the specified message.
+func (s *MultiStore) RemoveMessage(ctx context.Context, mailbox, id string) error {
+	return s.route(mailbox).RemoveMessage(ctx, mailbox, id)
+}
+
+// VisitMailboxes visits the mailboxes of each backend store in turn, until f returns false.
+func (s *MultiStore) VisitMailboxes(ctx context.Context, f func([]Message) (cont bool)) error {
+	cont := true
+	for _, store := range s.stores {
+		err := store.VisitMailboxes(ctx, func(messages []Message) bool {
+			cont = f(messages)
+			return cont
+		})
+		if err != nil || !cont {
+			return err
+		}
+	}
+	return nil
+}
+
+// MailboxExists returns true if the named mailbox contains any messages.
+func (s *MultiStore) MailboxExists(ctx context.Context, mailbox string) (bool, error) {
+	return MailboxExists(ctx, s.route(mailbox), mailbox)
+}
+
+// Sync flushes pending writes of each backend store to disk.
+func (s *MultiStore) Sync() error {
+	for _, store := range s.stores {
+		if err := Sync(store); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// PageMessages returns a page of messages from the named mailbox, see Pager.
+func (s *MultiStore) PageMessages(ctx context.Context, mailbox, after string, limit int,
+	match func(Message) bool) ([]Message, bool, error) {
+	return PageMessages(ctx, s.route(mailbox), mailbox, after, limit, match)
+}
+
+// VisitLatestMessages calls f with the latest message of each non-empty mailbox of each backend
+// store in turn, until f returns false.
+func (s *MultiStore) VisitLatestMessages(
+	ctx context.Context, f func(latest Message) (cont bool)) error {
+	cont := true
+	for _, store := range s.stores {
+		err := VisitLatestMessages(ctx, store, func(latest Message) bool {
+			cont = f(latest)
+			return cont
+		})
+		if err != nil || !cont {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,115 @@
+package storage_test
+
+import (
+	"context"
+	"sort"
+	"testing"
+	"time"
+
+	"github.com/inbucket/inbucket/pkg/config"
+	"github.com/inbucket/inbucket/pkg/storage"
+	"github.com/inbucket/inbucket/pkg/storage/mem"
+	"github.com/inbucket/inbucket/pkg/test"
+)
+
+func TestDomainStore(t *testing.T) {
+	def, _ := mem.New(config.Storage{})
+	a, _ := mem.New(config.Storage{})
+	b, _ := mem.New(config.Storage{})
+	store := storage.NewDomainStore(def, []config.StoreRoute{
+		{Name: "a", Type: "memory", DomainGlob: "a.example"},
+		{Name: "b", Type: "memory", DomainGlob: "*.b.example"},
+	}, []storage.Store{a, b})
+	ctx := context.Background()
+
+	idA, _ := test.DeliverToStore(t, store, "alice@a.example", "to a", time.Now())
+	test.DeliverToStore(t, store, "bob@mail.B.example", "to b", time.Now())
+	test.DeliverToStore(t, store, "carol@c.example", "to default", time.Now())
+	test.DeliverToStore(t, store, "b.example", "to default", time.Now())
+
+	// Each mailbox is stored in, and only in, its routed store.
+	test.GetAndCountMessages(t, a, "alice@a.example", 1)
+	test.GetAndCountMessages(t, b, "bob@mail.B.example", 1)
+	test.GetAndCountMessages(t, def, "carol@c.example", 1)
+	test.GetAndCountMessages(t, def, "b.example", 1)
+	test.GetAndCountMessages(t, def, "alice@a.example", 0)
+	test.GetAndCountMessages(t, b, "alice@a.example", 0)
+	test.GetAndCountMessages(t, a, "bob@mail.B.example", 0)
+	test.GetAndCountMessages(t, store, "alice@a.example", 1)
+
+	// Changes are routed to the same store.
+	if err := store.MarkSeen(ctx, "alice@a.example", idA); err != nil {
+		t.Fatal(err)
+	}
+	if m, _ := a.GetMessage(ctx, "alice@a.example", idA); m == nil || !m.Seen() {
+		t.Errorf("Got message %v after MarkSeen, want seen", m)
+	}
+	if ok, err := storage.MailboxExists(ctx, store, "alice@a.example"); !ok || err != nil {
+		t.Errorf("MailboxExists got %v, %v, want: true", ok, err)
+	}
+	if err := store.PurgeMessages(ctx, "alice@a.example"); err != nil {
+		t.Fatal(err)
+	}
+	test.GetAndCountMessages(t, a, "alice@a.example", 0)
+
+	// Mailboxes of every store are visited.
+	var got []string
+	err := store.VisitMailboxes(ctx, func(messages []storage.Message) bool {
+		for _, m := range messages {
+			got = append(got, m.Mailbox())
+		}
+		return true
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	sort.Strings(got)
+	want := []string{"b.example", "bob@mail.B.example", "carol@c.example"}
+	if len(got) != len(want) || got[0] != want[0] || got[1] != want[1] || got[2] != want[2] {
+		t.Errorf("Visited %v, want: %v", got, want)
+	}
+	visits := 0
+	err = store.VisitMailboxes(ctx, func(messages []storage.Message) bool {
+		visits++
+		return false
+	})
+	if err != nil || visits != 1 {
+		t.Errorf("Got %v visits, error %v after stopping, want: 1", visits, err)
+	}
+}
+
+func TestMultiStoreFromConfig(t *testing.T) {
+	defer func(prev func(config.Storage) (storage.Store, error)) {
+		storage.Constructors["memory"] = prev
+	}(storage.Constructors["memory"])
+	var params []map[string]string
+	storage.Constructors["memory"] = func(c config.Storage) (storage.Store, error) {
+		params = append(params, c.Params)
+		return mem.New(c)
+	}
+	store, err := storage.FromConfig(config.Storage{
+		Type:   "memory",
+		Params: map[string]string{"maxkb": "10"},
+		Stores: []config.StoreRoute{
+			{Name: "a", Type: "memory", Path: "/tmp/a", DomainGlob: "a.example"},
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := store.(*storage.MultiStore); !ok {
+		t.Fatalf("Got store %T, want: *storage.MultiStore", store)
+	}
+	if len(params) != 2 || params[0]["maxkb"] != "10" || params[1]["path"] != "/tmp/a" ||
+		params[1]["maxkb"] != "" {
+		t.Errorf("Got store params %v", params)
+	}
+
+	_, err = storage.FromConfig(config.Storage{
+		Type:   "memory",
+		Stores: []config.StoreRoute{{Name: "a", Type: "bogus", DomainGlob: "a.example"}},
+	})
+	if err == nil {
+		t.Error("Got nil error for unknown store type, want error")
+	}
+}
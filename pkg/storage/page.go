@@ -0,0 +1,46 @@
+package storage
+
+// Page collects one page of the messages of a mailbox, as they are visited in mailbox order.  The
+// page starts after the message with the cursor ID, or at the first message if the cursor is
+// empty, and holds at most limit messages; a limit of zero or less does not limit the page.
+type Page struct {
+	after    string
+	limit    int
+	match    func(Message) bool
+	started  bool
+	more     bool
+	messages []Message
+}
+
+// NewPage returns a Page starting after the message with ID after, which only collects messages
+// accepted by match, unless match is nil.
+func NewPage(after string, limit int, match func(Message) bool) *Page {
+	return &Page{after: after, limit: limit, match: match, started: after == ""}
+}
+
+// Visit offers the next message of the mailbox to the page, returning false once the page is
+// full and a further matching message has been seen.
+func (p *Page) Visit(m Message) (cont bool) {
+	if !p.started {
+		p.started = m.ID() == p.after
+		return true
+	}
+	if p.match != nil && !p.match(m) {
+		return true
+	}
+	if p.limit > 0 && len(p.messages) >= p.limit {
+		p.more = true
+		return false
+	}
+	p.messages = append(p.messages, m)
+	return true
+}
+
+// Result returns the messages collected, and true if further matching messages follow them.  It
+// returns ErrNotExist if no message with the cursor ID was visited.
+func (p *Page) Result() (messages []Message, more bool, err error) {
+	if !p.started {
+		return nil, false, ErrNotExist
+	}
+	return p.messages, p.more, nil
+}
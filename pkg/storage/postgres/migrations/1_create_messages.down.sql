@@ -0,0 +1,3 @@
+DROP TABLE message_bodies;
+DROP TABLE messages;
+DROP SEQUENCE message_ids;
@@ -0,0 +1,24 @@
+CREATE SEQUENCE message_ids;
+
+CREATE TABLE messages (
+	id        TEXT        PRIMARY KEY,
+	seq       BIGINT      NOT NULL,
+	mailbox   TEXT        NOT NULL,
+	from_addr TEXT        NOT NULL,
+	to_addrs  JSONB       NOT NULL,
+	subject   TEXT        NOT NULL,
+	date      TIMESTAMPTZ NOT NULL,
+	date_nsec INTEGER     NOT NULL DEFAULT 0,
+	size      BIGINT      NOT NULL,
+	seen      BOOLEAN     NOT NULL DEFAULT FALSE,
+	envid     TEXT        NOT NULL DEFAULT '',
+	spf       TEXT        NOT NULL DEFAULT '',
+	tags      JSONB
+);
+
+CREATE INDEX messages_mailbox ON messages (mailbox, seq);
+
+CREATE TABLE message_bodies (
+	id   TEXT  PRIMARY KEY REFERENCES messages (id) ON DELETE CASCADE,
+	body BYTEA NOT NULL
+);
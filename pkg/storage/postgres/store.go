@@ -0,0 +1,418 @@
+// Package postgres implements a message store backed by a PostgreSQL database, allowing multiple
+// Inbucket instances to share their mailboxes.
+package postgres
+
+import (
+	"context"
+	"embed"
+	"fmt"
+	"io/ioutil"
+	"strconv"
+	"time"
+
+	"github.com/golang-migrate/migrate/v4"
+	migratepgx "github.com/golang-migrate/migrate/v4/database/pgx/v5"
+	"github.com/golang-migrate/migrate/v4/source/iofs"
+	"github.com/inbucket/inbucket/pkg/config"
+	"github.com/inbucket/inbucket/pkg/storage"
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgxpool"
+	"github.com/jackc/pgx/v5/stdlib"
+)
+
+// migrations holds the schema migrations applied by New.
+//
+//go:embed migrations/*.sql
+var migrations embed.FS
+
+// visitBatch is the number of rows fetched at a time by VisitMailboxes.
+const visitBatch = 256
+
+// selectMessage selects the columns read by scanMessage.
+const selectMessage = `SELECT id, mailbox, from_addr, to_addrs, subject, date, date_nsec, size,
+	seen, envid, spf, tags FROM messages`
+
+// Names of the statements prepared on each connection.
+const (
+	stmtLock    = "lock"
+	stmtCount   = "count"
+	stmtInsert  = "insert"
+	stmtBody    = "insert_body"
+	stmtTrim    = "trim"
+	stmtGet     = "get"
+	stmtLatest  = "latest"
+	stmtList    = "list"
+	stmtSeen    = "seen"
+	stmtTags    = "tags"
+	stmtPurge   = "purge"
+	stmtRemove  = "remove"
+	stmtContent = "content"
+)
+
+// statements maps statement names to SQL, they are prepared when a connection is opened.
+var statements = map[string]string{
+	stmtLock:  `SELECT pg_advisory_xact_lock(hashtext($1))`,
+	stmtCount: `SELECT COUNT(*) FROM messages WHERE mailbox = $1`,
+	stmtInsert: `WITH next AS (SELECT nextval('message_ids') AS seq)
+		INSERT INTO messages (id, seq, mailbox, from_addr, to_addrs, subject, date, date_nsec, size,
+			envid, spf, tags)
+		SELECT seq::text, seq, $1::text, $2::text, $3::jsonb, $4::text, $5::timestamptz,
+			$6::integer, $7::bigint, $8::text, $9::text, $10::jsonb FROM next
+		RETURNING id`,
+	stmtBody: `INSERT INTO message_bodies (id, body) VALUES ($1, $2)`,
+	stmtTrim: `DELETE FROM messages WHERE mailbox = $1 AND seq NOT IN
+		(SELECT seq FROM messages WHERE mailbox = $1 ORDER BY seq DESC LIMIT $2)`,
+	stmtGet:     selectMessage + ` WHERE mailbox = $1 AND id = $2`,
+	stmtLatest:  selectMessage + ` WHERE mailbox = $1 ORDER BY seq DESC LIMIT 1`,
+	stmtList:    selectMessage + ` WHERE mailbox = $1 ORDER BY seq`,
+	stmtSeen:    `UPDATE messages SET seen = $3 WHERE mailbox = $1 AND id = $2`,
+	stmtTags:    `UPDATE messages SET tags = $3 WHERE mailbox = $1 AND id = $2`,
+	stmtPurge:   `DELETE FROM messages WHERE mailbox = $1`,
+	stmtRemove:  `DELETE FROM messages WHERE mailbox = $1 AND id = $2`,
+	stmtContent: `SELECT body FROM message_bodies WHERE id = $1`,
+}
+
+// Store implements storage.Store using PostgreSQL.  Message metadata is stored in the messages
+// table, and message content in the message_bodies table.
+type Store struct {
+	pool       *pgxpool.Pool
+	messageCap int
+	overflow   config.OverflowPolicy
+}
+
+var _ storage.Store = &Store{}
+
+// New connects to the PostgreSQL database specified by the `url` parameter, and applies any
+// pending schema migrations.  The optional `maxconns` parameter limits the size of the connection
+// pool.
+func New(cfg config.Storage) (storage.Store, error) {
+	url := cfg.Params["url"]
+	if url == "" {
+		return nil, fmt.Errorf("postgres storage requires the url parameter")
+	}
+	poolConfig, err := pgxpool.ParseConfig(url)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse postgres url: %v", err)
+	}
+	if v := cfg.Params["maxconns"]; v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 2 {
+			// VisitMailboxes holds a connection while the visitor uses the store.
+			return nil, fmt.Errorf("postgres maxconns parameter must be at least 2: %q", v)
+		}
+		poolConfig.MaxConns = int32(n)
+	}
+	if err := migrateSchema(poolConfig.ConnConfig); err != nil {
+		return nil, err
+	}
+	poolConfig.AfterConnect = func(ctx context.Context, conn *pgx.Conn) error {
+		for name, sql := range statements {
+			if _, err := conn.Prepare(ctx, name, sql); err != nil {
+				return fmt.Errorf("failed to prepare %s statement: %v", name, err)
+			}
+		}
+		return nil
+	}
+	pool, err := pgxpool.NewWithConfig(context.Background(), poolConfig)
+	if err != nil {
+		return nil, fmt.Errorf("failed to connect to postgres: %v", err)
+	}
+	if err := pool.Ping(context.Background()); err != nil {
+		pool.Close()
+		return nil, fmt.Errorf("failed to connect to postgres: %v", err)
+	}
+	return &Store{pool: pool, messageCap: cfg.MailboxMsgCap, overflow: cfg.OverflowPolicy}, nil
+}
+
+// migrateSchema applies the pending migrations to the database.
+func migrateSchema(connConfig *pgx.ConnConfig) error {
+	src, err := iofs.New(migrations, "migrations")
+	if err != nil {
+		return err
+	}
+	driver, err := migratepgx.WithInstance(stdlib.OpenDB(*connConfig), &migratepgx.Config{})
+	if err != nil {
+		return fmt.Errorf("failed to connect to postgres: %v", err)
+	}
+	m, err := migrate.NewWithInstance("iofs", src, "pgx5", driver)
+	if err != nil {
+		_ = driver.Close()
+		return err
+	}
+	defer m.Close()
+	if err := m.Up(); err != nil && err != migrate.ErrNoChange {
+		return fmt.Errorf("failed to migrate postgres schema: %v", err)
+	}
+	return nil
+}
+
+// Close closes the connection pool.
+func (s *Store) Close() error {
+	s.pool.Close()
+	return nil
+}
+
+// AddMessage stores the message, message ID and Size will be ignored.
+func (s *Store) AddMessage(ctx context.Context, m storage.Message) (id string, err error) {
+	if err := ctx.Err(); err != nil {
+		return "", err
+	}
+	r, err := m.Source()
+	if err != nil {
+		return "", err
+	}
+	content, err := ioutil.ReadAll(r)
+	_ = r.Close()
+	if err != nil {
+		return "", err
+	}
+	// Addresses are stored in RFC 5322 form so they can be parsed back losslessly.
+	from := ""
+	if m.From() != nil {
+		from = m.From().String()
+	}
+	to := make([]string, len(m.To()))
+	for i, a := range m.To() {
+		to[i] = a.String()
+	}
+	mailbox := m.Mailbox()
+	tx, err := s.pool.Begin(ctx)
+	if err != nil {
+		return "", ctxErr(ctx, err)
+	}
+	defer func() {
+		if err != nil {
+			_ = tx.Rollback(context.Background())
+		}
+	}()
+	// Serialize deliveries to the mailbox, so the message cap is enforced across instances.
+	if _, err = tx.Exec(ctx, stmtLock, mailbox); err != nil {
+		return "", ctxErr(ctx, err)
+	}
+	if s.messageCap > 0 &&
+		(s.overflow == config.OverflowReject || s.overflow == config.OverflowDropNewest) {
+		var count int
+		if err = tx.QueryRow(ctx, stmtCount, mailbox).Scan(&count); err != nil {
+			return "", ctxErr(ctx, err)
+		}
+		if count >= s.messageCap {
+			if s.overflow == config.OverflowReject {
+				err = storage.ErrMailboxFull
+				return "", err
+			}
+			// Discard the new message.
+			_ = tx.Rollback(context.Background())
+			return "", nil
+		}
+	}
+	date := m.Date()
+	err = tx.QueryRow(ctx, stmtInsert, mailbox, from, to, m.Subject(), date,
+		date.Nanosecond()%1000, len(content), m.EnvelopeID(), m.SPFResult(),
+		tagsValue(m.Tags())).Scan(&id)
+	if err != nil {
+		return "", ctxErr(ctx, err)
+	}
+	if _, err = tx.Exec(ctx, stmtBody, id, content); err != nil {
+		return "", ctxErr(ctx, err)
+	}
+	if s.messageCap > 0 {
+		// Delete the oldest messages over messageCap.
+		if _, err = tx.Exec(ctx, stmtTrim, mailbox, s.messageCap); err != nil {
+			return "", ctxErr(ctx, err)
+		}
+	}
+	if err = tx.Commit(ctx); err != nil {
+		return "", ctxErr(ctx, err)
+	}
+	return id, nil
+}
+
+// GetMessage returns the specified message, or storage.ErrNotExist.
+func (s *Store) GetMessage(ctx context.Context, mailbox, id string) (storage.Message, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	var row pgx.Row
+	if id == "latest" {
+		row = s.pool.QueryRow(ctx, stmtLatest, mailbox)
+	} else {
+		row = s.pool.QueryRow(ctx, stmtGet, mailbox, id)
+	}
+	m, err := s.scanMessage(row)
+	if err == pgx.ErrNoRows {
+		return nil, storage.ErrNotExist
+	}
+	return m, ctxErr(ctx, err)
+}
+
+// GetMessages returns the messages in the named mailbox, oldest first.
+func (s *Store) GetMessages(ctx context.Context, mailbox string) ([]storage.Message, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	rows, err := s.pool.Query(ctx, stmtList, mailbox)
+	if err != nil {
+		return nil, ctxErr(ctx, err)
+	}
+	defer rows.Close()
+	messages := make([]storage.Message, 0)
+	for rows.Next() {
+		m, err := s.scanMessage(rows)
+		if err != nil {
+			return nil, ctxErr(ctx, err)
+		}
+		messages = append(messages, m)
+	}
+	return messages, ctxErr(ctx, rows.Err())
+}
+
+// MarkSeen flags the message as having been read.
+func (s *Store) MarkSeen(ctx context.Context, mailbox, id string) error {
+	_, err := s.exec(ctx, stmtSeen, mailbox, id, true)
+	return err
+}
+
+// MarkUnseen flags the message as not having been read.
+func (s *Store) MarkUnseen(ctx context.Context, mailbox, id string) error {
+	_, err := s.exec(ctx, stmtSeen, mailbox, id, false)
+	return err
+}
+
+// SetTags replaces the tags of the message.
+func (s *Store) SetTags(ctx context.Context, mailbox, id string, tags []string) error {
+	n, err := s.exec(ctx, stmtTags, mailbox, id, tagsValue(tags))
+	if err == nil && n == 0 {
+		return storage.ErrNotExist
+	}
+	return err
+}
+
+// PurgeMessages deletes all messages in the named mailbox.
+func (s *Store) PurgeMessages(ctx context.Context, mailbox string) error {
+	_, err := s.exec(ctx, stmtPurge, mailbox)
+	return err
+}
+
+// RemoveMessage deletes a message by ID from the specified mailbox.
+func (s *Store) RemoveMessage(ctx context.Context, mailbox, id string) error {
+	n, err := s.exec(ctx, stmtRemove, mailbox, id)
+	if err == nil && n == 0 {
+		return storage.ErrNotExist
+	}
+	return err
+}
+
+// VisitMailboxes accepts a function that will be called with the messages in each mailbox while it
+// continues to return true.  Messages are read through a server side cursor, so only one mailbox
+// is held in memory at a time.
+func (s *Store) VisitMailboxes(ctx context.Context, f func([]storage.Message) (cont bool)) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	// Cursors only exist within a transaction, it provides a consistent snapshot of all
+	// mailboxes.
+	tx, err := s.pool.BeginTx(ctx, pgx.TxOptions{
+		IsoLevel:   pgx.RepeatableRead,
+		AccessMode: pgx.ReadOnly,
+	})
+	if err != nil {
+		return ctxErr(ctx, err)
+	}
+	defer func() {
+		_ = tx.Rollback(context.Background())
+	}()
+	_, err = tx.Exec(ctx,
+		`DECLARE mailbox_visit NO SCROLL CURSOR FOR `+selectMessage+` ORDER BY mailbox, seq`)
+	if err != nil {
+		return ctxErr(ctx, err)
+	}
+	var messages []storage.Message
+	for {
+		batch, err := s.fetch(ctx, tx)
+		if err != nil {
+			return ctxErr(ctx, err)
+		}
+		if len(batch) == 0 {
+			break
+		}
+		for _, m := range batch {
+			if len(messages) > 0 && messages[0].Mailbox() != m.Mailbox() {
+				if !f(messages) {
+					return nil
+				}
+				messages = nil
+			}
+			messages = append(messages, m)
+		}
+	}
+	if len(messages) > 0 {
+		f(messages)
+	}
+	return nil
+}
+
+// fetch reads the next batch of messages from the VisitMailboxes cursor.
+func (s *Store) fetch(ctx context.Context, tx pgx.Tx) ([]*Message, error) {
+	rows, err := tx.Query(ctx, `FETCH FORWARD `+strconv.Itoa(visitBatch)+` FROM mailbox_visit`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	batch := make([]*Message, 0, visitBatch)
+	for rows.Next() {
+		m, err := s.scanMessage(rows)
+		if err != nil {
+			return nil, err
+		}
+		batch = append(batch, m)
+	}
+	return batch, rows.Err()
+}
+
+// exec executes a prepared statement, returning the number of rows affected.
+func (s *Store) exec(ctx context.Context, name string, args ...interface{}) (int64, error) {
+	if err := ctx.Err(); err != nil {
+		return 0, err
+	}
+	tag, err := s.pool.Exec(ctx, name, args...)
+	if err != nil {
+		return 0, ctxErr(ctx, err)
+	}
+	return tag.RowsAffected(), nil
+}
+
+// scanMessage builds a Message from a row selected with selectMessage.
+func (s *Store) scanMessage(row pgx.Row) (*Message, error) {
+	var (
+		from string
+		to   []string
+		nsec int
+	)
+	m := &Message{store: s}
+	err := row.Scan(&m.id, &m.mailbox, &from, &to, &m.subject, &m.date, &nsec, &m.size, &m.seen,
+		&m.envid, &m.spf, &m.tags)
+	if err != nil {
+		return nil, err
+	}
+	// TIMESTAMPTZ has microsecond resolution, the remainder is stored separately.
+	m.date = m.date.Add(time.Duration(nsec))
+	m.from = parseAddress(from)
+	m.to = parseAddressList(to)
+	return m, nil
+}
+
+// tagsValue returns tags for storage in a JSONB column, NULL if there are none.
+func tagsValue(tags []string) interface{} {
+	if len(tags) == 0 {
+		return nil
+	}
+	return tags
+}
+
+// ctxErr returns the error of ctx if it is done, pgx wraps it in connection errors.
+func ctxErr(ctx context.Context, err error) error {
+	if err != nil && ctx.Err() != nil {
+		return ctx.Err()
+	}
+	return err
+}
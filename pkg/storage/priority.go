@@ -0,0 +1,42 @@
+package storage
+
+import (
+	"net/mail"
+	"strings"
+)
+
+// Message priorities, as used by the X-Priority header.
+const (
+	PriorityHighest = 1
+	PriorityNormal  = 3
+	PriorityLowest  = 5
+)
+
+// PriorityMessage is implemented by messages from stores which record the priority of a message
+// when it is added.
+type PriorityMessage interface {
+	// Priority returns the priority of the message, from PriorityHighest to PriorityLowest.
+	Priority() int
+}
+
+// ParsePriority returns the priority set by the X-Priority, Importance, or X-MS-Importance
+// header, in that order of preference, or PriorityNormal if none of them are valid.
+func ParsePriority(header mail.Header) int {
+	// X-Priority values are a digit, usually followed by a comment such as "1 (Highest)".
+	if v := strings.TrimSpace(header.Get("X-Priority")); v != "" {
+		if p := int(v[0] - '0'); PriorityHighest <= p && p <= PriorityLowest {
+			return p
+		}
+	}
+	for _, name := range []string{"Importance", "X-MS-Importance"} {
+		switch strings.ToLower(strings.TrimSpace(header.Get(name))) {
+		case "high":
+			return PriorityHighest
+		case "normal":
+			return PriorityNormal
+		case "low":
+			return PriorityLowest
+		}
+	}
+	return PriorityNormal
+}
@@ -0,0 +1,40 @@
+package storage_test
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/inbucket/inbucket/pkg/storage"
+)
+
+func TestSummarizePriority(t *testing.T) {
+	testCases := []struct {
+		name   string
+		header string
+		want   int
+	}{
+		{"missing", "", storage.PriorityNormal},
+		{"x-priority", "X-Priority: 1 (Highest)\r\n", storage.PriorityHighest},
+		{"x-priority bare", "X-Priority: 2\r\n", 2},
+		{"x-priority invalid", "X-Priority: urgent\r\n", storage.PriorityNormal},
+		{"importance high", "Importance: High\r\n", storage.PriorityHighest},
+		{"importance low", "Importance: low\r\n", storage.PriorityLowest},
+		{"ms importance", "X-MS-Importance: high\r\n", storage.PriorityHighest},
+		{"importance invalid", "Importance: whenever\r\n", storage.PriorityNormal},
+		{"conflict", "Importance: high\r\nX-Priority: 5 (Lowest)\r\n", storage.PriorityLowest},
+		{"ms conflict", "X-MS-Importance: high\r\nImportance: low\r\n", storage.PriorityLowest},
+		{"invalid x-priority", "X-Priority: 9\r\nImportance: high\r\n", storage.PriorityHighest},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			source := "From: a@host\r\n" + tc.header + "\r\nBody\r\n"
+			got := storage.Summarize(strings.NewReader(source)).Priority
+			if got != tc.want {
+				t.Errorf("Got priority %v, want: %v", got, tc.want)
+			}
+		})
+	}
+	if got := storage.Summarize(strings.NewReader("not a message")).Priority; got != 3 {
+		t.Errorf("Got priority %v for malformed message, want: 3", got)
+	}
+}
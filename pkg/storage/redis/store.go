@@ -0,0 +1,336 @@
+// Package redis implements a message store backed by Redis, allowing multiple Inbucket instances
+// to share their mailboxes.
+package redis
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+	"github.com/inbucket/inbucket/pkg/config"
+	"github.com/inbucket/inbucket/pkg/storage"
+)
+
+// defaultPrefix is prepended to all keys unless the prefix parameter is specified.
+const defaultPrefix = "inbucket"
+
+// Store implements storage.Store using Redis.  Each mailbox has a sorted set of message IDs
+// stored at {prefix}:{mailbox}:index, each message has a metadata hash stored at
+// {prefix}:{mailbox}:meta:{id}, and raw message content stored at {prefix}:{mailbox}:raw:{id}.
+type Store struct {
+	client     *redis.Client
+	prefix     string
+	messageCap int
+	overflow   config.OverflowPolicy
+}
+
+var _ storage.Store = &Store{}
+
+// New connects to the Redis server specified by the `url` parameter.
+func New(cfg config.Storage) (storage.Store, error) {
+	url := cfg.Params["url"]
+	if url == "" {
+		return nil, fmt.Errorf("redis storage requires the url parameter")
+	}
+	opts, err := redis.ParseURL(url)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse redis url: %v", err)
+	}
+	prefix := cfg.Params["prefix"]
+	if prefix == "" {
+		prefix = defaultPrefix
+	}
+	client := redis.NewClient(opts)
+	if err := client.Ping(context.Background()).Err(); err != nil {
+		_ = client.Close()
+		return nil, fmt.Errorf("failed to connect to redis: %v", err)
+	}
+	return &Store{
+		client:     client,
+		prefix:     prefix,
+		messageCap: cfg.MailboxMsgCap,
+		overflow:   cfg.OverflowPolicy,
+	}, nil
+}
+
+// Close closes the connection to Redis.
+func (s *Store) Close() error {
+	return s.client.Close()
+}
+
+// AddMessage stores the message, message ID and Size will be ignored.
+func (s *Store) AddMessage(ctx context.Context, m storage.Message) (id string, err error) {
+	r, err := m.Source()
+	if err != nil {
+		return "", err
+	}
+	content, err := ioutil.ReadAll(r)
+	_ = r.Close()
+	if err != nil {
+		return "", err
+	}
+	mailbox := m.Mailbox()
+	if s.messageCap > 0 &&
+		(s.overflow == config.OverflowReject || s.overflow == config.OverflowDropNewest) {
+		count, err := s.client.ZCard(ctx, s.indexKey(mailbox)).Result()
+		if err != nil {
+			return "", err
+		}
+		if count >= int64(s.messageCap) {
+			if s.overflow == config.OverflowReject {
+				return "", storage.ErrMailboxFull
+			}
+			// Discard the new message.
+			return "", nil
+		}
+	}
+	seq, err := s.client.Incr(ctx, s.prefix+":seq").Result()
+	if err != nil {
+		return "", err
+	}
+	id = strconv.FormatInt(seq, 10)
+	from := ""
+	if m.From() != nil {
+		from = m.From().String()
+	}
+	to := make([]string, len(m.To()))
+	for i, a := range m.To() {
+		to[i] = a.String()
+	}
+	_, err = s.client.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+		pipe.Set(ctx, s.rawKey(mailbox, id), content, 0)
+		pipe.HSet(ctx, s.metaKey(mailbox, id), map[string]interface{}{
+			"from":    from,
+			"to":      strings.Join(to, ", "),
+			"subject": m.Subject(),
+			"date":    m.Date().UnixNano(),
+			"size":    len(content),
+			"seen":    0,
+			"envid":   m.EnvelopeID(),
+			"spf":     m.SPFResult(),
+			"tags":    encodeTags(m.Tags()),
+		})
+		pipe.ZAdd(ctx, s.indexKey(mailbox), &redis.Z{Score: float64(seq), Member: id})
+		return nil
+	})
+	if err != nil {
+		return "", err
+	}
+	if s.messageCap > 0 {
+		// Delete the oldest messages over messageCap.
+		old, err := s.client.ZRange(ctx, s.indexKey(mailbox), 0, int64(-s.messageCap-1)).Result()
+		if err != nil {
+			return "", err
+		}
+		if err := s.removeIDs(ctx, mailbox, old); err != nil {
+			return "", err
+		}
+	}
+	return id, nil
+}
+
+// GetMessage returns the specified message, or storage.ErrNotExist.
+func (s *Store) GetMessage(ctx context.Context, mailbox, id string) (storage.Message, error) {
+	if id == "latest" {
+		ids, err := s.client.ZRevRange(ctx, s.indexKey(mailbox), 0, 0).Result()
+		if err != nil {
+			return nil, err
+		}
+		if len(ids) == 0 {
+			return nil, storage.ErrNotExist
+		}
+		id = ids[0]
+	}
+	fields, err := s.client.HGetAll(ctx, s.metaKey(mailbox, id)).Result()
+	if err != nil {
+		return nil, err
+	}
+	if len(fields) == 0 {
+		return nil, storage.ErrNotExist
+	}
+	return s.newMessage(mailbox, id, fields), nil
+}
+
+// GetMessages returns the messages in the named mailbox, oldest first.
+func (s *Store) GetMessages(ctx context.Context, mailbox string) ([]storage.Message, error) {
+	ids, err := s.client.ZRange(ctx, s.indexKey(mailbox), 0, -1).Result()
+	if err != nil {
+		return nil, err
+	}
+	cmds := make([]*redis.StringStringMapCmd, len(ids))
+	_, err = s.client.Pipelined(ctx, func(pipe redis.Pipeliner) error {
+		for i, id := range ids {
+			cmds[i] = pipe.HGetAll(ctx, s.metaKey(mailbox, id))
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	messages := make([]storage.Message, 0, len(ids))
+	for i, cmd := range cmds {
+		fields := cmd.Val()
+		if len(fields) == 0 {
+			// Removed after the index was read.
+			continue
+		}
+		messages = append(messages, s.newMessage(mailbox, ids[i], fields))
+	}
+	return messages, nil
+}
+
+// MarkSeen flags the message as having been read.
+func (s *Store) MarkSeen(ctx context.Context, mailbox, id string) error {
+	n, err := s.client.Exists(ctx, s.metaKey(mailbox, id)).Result()
+	if err != nil || n == 0 {
+		return err
+	}
+	return s.client.HSet(ctx, s.metaKey(mailbox, id), "seen", 1).Err()
+}
+
+// MarkUnseen flags the message as not having been read.
+func (s *Store) MarkUnseen(ctx context.Context, mailbox, id string) error {
+	n, err := s.client.Exists(ctx, s.metaKey(mailbox, id)).Result()
+	if err != nil || n == 0 {
+		return err
+	}
+	return s.client.HSet(ctx, s.metaKey(mailbox, id), "seen", 0).Err()
+}
+
+// SetTags replaces the tags of the message.
+func (s *Store) SetTags(ctx context.Context, mailbox, id string, tags []string) error {
+	n, err := s.client.Exists(ctx, s.metaKey(mailbox, id)).Result()
+	if err != nil {
+		return err
+	}
+	if n == 0 {
+		return storage.ErrNotExist
+	}
+	return s.client.HSet(ctx, s.metaKey(mailbox, id), "tags", encodeTags(tags)).Err()
+}
+
+// PurgeMessages deletes all messages in the named mailbox.
+func (s *Store) PurgeMessages(ctx context.Context, mailbox string) error {
+	ids, err := s.client.ZRange(ctx, s.indexKey(mailbox), 0, -1).Result()
+	if err != nil {
+		return err
+	}
+	return s.removeIDs(ctx, mailbox, ids)
+}
+
+// RemoveMessage deletes a message by ID from the specified mailbox.
+func (s *Store) RemoveMessage(ctx context.Context, mailbox, id string) error {
+	n, err := s.client.ZRem(ctx, s.indexKey(mailbox), id).Result()
+	if err != nil {
+		return err
+	}
+	if n == 0 {
+		return storage.ErrNotExist
+	}
+	return s.client.Del(ctx, s.metaKey(mailbox, id), s.rawKey(mailbox, id)).Err()
+}
+
+// VisitMailboxes accepts a function that will be called with the messages in each mailbox while it
+// continues to return true.
+func (s *Store) VisitMailboxes(ctx context.Context, f func([]storage.Message) (cont bool)) error {
+	// SCAN may return a key more than once, collect the unique mailbox names first.
+	names := make([]string, 0)
+	seen := make(map[string]bool)
+	iter := s.client.Scan(ctx, 0, s.prefix+":*:index", 0).Iterator()
+	for iter.Next(ctx) {
+		key := iter.Val()
+		name := strings.TrimSuffix(strings.TrimPrefix(key, s.prefix+":"), ":index")
+		if !seen[name] {
+			seen[name] = true
+			names = append(names, name)
+		}
+	}
+	if err := iter.Err(); err != nil {
+		return err
+	}
+	for _, name := range names {
+		messages, err := s.GetMessages(ctx, name)
+		if err != nil {
+			return err
+		}
+		if !f(messages) {
+			break
+		}
+	}
+	return nil
+}
+
+// removeIDs deletes the listed messages from the mailbox index, along with their metadata and
+// content.
+func (s *Store) removeIDs(ctx context.Context, mailbox string, ids []string) error {
+	if len(ids) == 0 {
+		return nil
+	}
+	members := make([]interface{}, len(ids))
+	keys := make([]string, 0, 2*len(ids))
+	for i, id := range ids {
+		members[i] = id
+		keys = append(keys, s.metaKey(mailbox, id), s.rawKey(mailbox, id))
+	}
+	_, err := s.client.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+		pipe.ZRem(ctx, s.indexKey(mailbox), members...)
+		pipe.Del(ctx, keys...)
+		return nil
+	})
+	return err
+}
+
+// newMessage builds a Message from the fields of a metadata hash.
+func (s *Store) newMessage(mailbox, id string, fields map[string]string) *Message {
+	date, _ := strconv.ParseInt(fields["date"], 10, 64)
+	size, _ := strconv.ParseInt(fields["size"], 10, 64)
+	return &Message{
+		store:   s,
+		mailbox: mailbox,
+		id:      id,
+		from:    parseAddress(fields["from"]),
+		to:      parseAddressList(fields["to"]),
+		date:    time.Unix(0, date),
+		subject: fields["subject"],
+		size:    size,
+		seen:    fields["seen"] == "1",
+		envid:   fields["envid"],
+		spf:     fields["spf"],
+		tags:    decodeTags(fields["tags"]),
+	}
+}
+
+// encodeTags returns tags as a JSON array, or an empty string if there are none.
+func encodeTags(tags []string) string {
+	if len(tags) == 0 {
+		return ""
+	}
+	b, _ := json.Marshal(tags)
+	return string(b)
+}
+
+// decodeTags parses tags encoded by encodeTags.
+func decodeTags(s string) []string {
+	var tags []string
+	if s != "" {
+		_ = json.Unmarshal([]byte(s), &tags)
+	}
+	return tags
+}
+
+func (s *Store) indexKey(mailbox string) string {
+	return s.prefix + ":" + mailbox + ":index"
+}
+
+func (s *Store) metaKey(mailbox, id string) string {
+	return s.prefix + ":" + mailbox + ":meta:" + id
+}
+
+func (s *Store) rawKey(mailbox, id string) string {
+	return s.prefix + ":" + mailbox + ":raw:" + id
+}
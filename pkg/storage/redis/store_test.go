@@ -0,0 +1,110 @@
+package redis
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/inbucket/inbucket/pkg/config"
+	"github.com/inbucket/inbucket/pkg/storage"
+	"github.com/inbucket/inbucket/pkg/test"
+	"github.com/ory/dockertest/v3"
+)
+
+// redisURL is set by TestMain when a Redis container is available.
+var redisURL string
+
+// TestMain starts a Redis container for the integration tests, they will be skipped if Docker is
+// not available.
+func TestMain(m *testing.M) {
+	var resource *dockertest.Resource
+	pool, err := dockertest.NewPool("")
+	if err == nil {
+		err = pool.Client.Ping()
+	}
+	if err == nil {
+		resource, err = pool.Run("redis", "6-alpine", nil)
+	}
+	if err == nil {
+		redisURL = fmt.Sprintf("redis://localhost:%s/0", resource.GetPort("6379/tcp"))
+		err = pool.Retry(func() error {
+			s, err := New(config.Storage{Params: map[string]string{"url": redisURL}})
+			if err != nil {
+				return err
+			}
+			return s.(*Store).Close()
+		})
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Redis unavailable, integration tests will be skipped: %v\n", err)
+		redisURL = ""
+	}
+	code := m.Run()
+	if resource != nil {
+		_ = pool.Purge(resource)
+	}
+	os.Exit(code)
+}
+
+// TestSuite runs storage package test suite on redis store.
+func TestSuite(t *testing.T) {
+	if redisURL == "" {
+		t.Skip("Redis unavailable")
+	}
+	test.StoreSuite(t, func(conf config.Storage) (storage.Store, func(), error) {
+		s, destroy := setupStore(t, conf)
+		return s, destroy, nil
+	})
+}
+
+// TestKeyPrefix verifies keys are namespaced by the prefix parameter.
+func TestKeyPrefix(t *testing.T) {
+	s, destroy := setupStore(t, config.Storage{Params: map[string]string{"prefix": "custom"}})
+	defer destroy()
+	id, _ := test.DeliverToStore(t, s, "box", "subject", time.Now())
+	ctx := context.Background()
+	for _, key := range []string{"custom:box:index", "custom:box:meta:" + id, "custom:box:raw:" + id} {
+		n, err := s.client.Exists(ctx, key).Result()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if n != 1 {
+			t.Errorf("key %q does not exist", key)
+		}
+	}
+}
+
+// TestMissingURL verifies a url parameter is required.
+func TestMissingURL(t *testing.T) {
+	_, err := New(config.Storage{})
+	if err == nil {
+		t.Error("got nil error, wanted error for missing url")
+	}
+}
+
+// setupStore connects to the test Redis instance and clears it, skipping the test if Redis is not
+// available.
+func setupStore(t *testing.T, cfg config.Storage) (*Store, func()) {
+	t.Helper()
+	if redisURL == "" {
+		t.Skip("Redis unavailable")
+	}
+	if cfg.Params == nil {
+		cfg.Params = make(map[string]string)
+	}
+	cfg.Params["url"] = redisURL
+	s, err := New(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rs := s.(*Store)
+	if err := rs.client.FlushDB(context.Background()).Err(); err != nil {
+		t.Fatal(err)
+	}
+	destroy := func() {
+		_ = rs.Close()
+	}
+	return rs, destroy
+}
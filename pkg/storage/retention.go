@@ -2,6 +2,7 @@ package storage
 
 import (
 	"container/list"
+	"context"
 	"expvar"
 	"time"
 
@@ -49,17 +50,18 @@ func init() {
 }
 
 // RetentionScanner looks for messages older than the configured retention period and deletes them.
+// The retention settings are read from the current configuration before each scan, so they may be
+// reloaded while the scanner is running.
 type RetentionScanner struct {
 	globalShutdown    chan bool // Closes when Inbucket needs to shut down
 	retentionShutdown chan bool // Closed after the scanner has shut down
 	ds                Store
-	retentionPeriod   time.Duration
-	retentionSleep    time.Duration
+	conf              *config.Current
 }
 
 // NewRetentionScanner configures a new RententionScanner.
 func NewRetentionScanner(
-	cfg config.Storage,
+	conf *config.Current,
 	ds Store,
 	shutdownChannel chan bool,
 ) *RetentionScanner {
@@ -67,23 +69,23 @@ func NewRetentionScanner(
 		globalShutdown:    shutdownChannel,
 		retentionShutdown: make(chan bool),
 		ds:                ds,
-		retentionPeriod:   cfg.RetentionPeriod,
-		retentionSleep:    cfg.RetentionSleep,
+		conf:              conf,
 	}
 	// expRetentionPeriod is displayed on the status page
-	expRetentionPeriod.Set(int64(cfg.RetentionPeriod / time.Second))
+	expRetentionPeriod.Set(int64(conf.Get().Storage.RetentionPeriod / time.Second))
 	return rs
 }
 
 // Start up the retention scanner if retention period > 0
 func (rs *RetentionScanner) Start() {
-	if rs.retentionPeriod <= 0 {
+	period := rs.conf.Get().Storage.RetentionPeriod
+	if period <= 0 {
 		log.Info().Str("phase", "startup").Str("module", "storage").Msg("Retention scanner disabled")
 		close(rs.retentionShutdown)
 		return
 	}
 	log.Info().Str("phase", "startup").Str("module", "storage").
-		Msgf("Retention configured for %v", rs.retentionPeriod)
+		Msgf("Retention configured for %v", period)
 	go rs.run()
 }
 
@@ -93,10 +95,10 @@ func (rs *RetentionScanner) run() {
 	start := time.Now()
 retentionLoop:
 	for {
-		// Prevent scanner from starting more than once a minute
+		// Prevent scanner from starting more than once per retentionInterval
 		since := time.Since(start)
-		if since < time.Minute {
-			dur := time.Minute - since
+		if interval := rs.conf.Get().Storage.RetentionInterval; since < interval {
+			dur := interval - since
 			slog.Debug().Msgf("Retention scanner sleeping for %v", dur)
 			select {
 			case <-rs.globalShutdown:
@@ -106,7 +108,7 @@ retentionLoop:
 		}
 		// Kickoff scan
 		start = time.Now()
-		if err := rs.DoScan(); err != nil {
+		if err := rs.DoScan(context.Background()); err != nil {
 			slog.Error().Err(err).Msg("Error during retention scan")
 		}
 		// Check for global shutdown
@@ -121,19 +123,21 @@ retentionLoop:
 }
 
 // DoScan does a single pass of all mailboxes looking for messages that can be purged.
-func (rs *RetentionScanner) DoScan() error {
+func (rs *RetentionScanner) DoScan(ctx context.Context) error {
 	slog := log.With().Str("module", "storage").Logger()
 	slog.Debug().Msg("Starting retention scan")
-	cutoff := time.Now().Add(-1 * rs.retentionPeriod)
+	cfg := rs.conf.Get().Storage
+	expRetentionPeriod.Set(int64(cfg.RetentionPeriod / time.Second))
+	cutoff := time.Now().Add(-1 * cfg.RetentionPeriod)
 	retained := 0
 	storeSize := int64(0)
 	// Loop over all mailboxes.
-	err := rs.ds.VisitMailboxes(func(messages []Message) bool {
+	err := rs.ds.VisitMailboxes(ctx, func(messages []Message) bool {
 		for _, msg := range messages {
 			if msg.Date().Before(cutoff) {
 				slog.Debug().Str("mailbox", msg.Mailbox()).
 					Msgf("Purging expired message %v", msg.ID())
-				if err := rs.ds.RemoveMessage(msg.Mailbox(), msg.ID()); err != nil {
+				if err := rs.ds.RemoveMessage(ctx, msg.Mailbox(), msg.ID()); err != nil {
 					slog.Error().Str("mailbox", msg.Mailbox()).Err(err).
 						Msgf("Failed to purge message %v", msg.ID())
 				} else {
@@ -148,7 +152,7 @@ func (rs *RetentionScanner) DoScan() error {
 		case <-rs.globalShutdown:
 			slog.Debug().Str("phase", "shutdown").Msg("Retention scan aborted due to shutdown")
 			return false
-		case <-time.After(rs.retentionSleep):
+		case <-time.After(cfg.RetentionSleep):
 			// Reduce disk thrashing
 		}
 		return true
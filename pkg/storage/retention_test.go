@@ -1,13 +1,16 @@
 package storage_test
 
 import (
+	"context"
 	"fmt"
+	"strings"
 	"testing"
 	"time"
 
 	"github.com/inbucket/inbucket/pkg/config"
 	"github.com/inbucket/inbucket/pkg/message"
 	"github.com/inbucket/inbucket/pkg/storage"
+	"github.com/inbucket/inbucket/pkg/storage/mem"
 	"github.com/inbucket/inbucket/pkg/test"
 )
 
@@ -20,20 +23,21 @@ func TestDoRetentionScan(t *testing.T) {
 	old1 := stubMessage("mb1", 4)
 	old2 := stubMessage("mb1", 12)
 	old3 := stubMessage("mb2", 24)
-	ds.AddMessage(new1)
-	ds.AddMessage(old1)
-	ds.AddMessage(old2)
-	ds.AddMessage(old3)
-	ds.AddMessage(new2)
-	ds.AddMessage(new3)
+	ds.AddMessage(context.Background(), new1)
+	ds.AddMessage(context.Background(), old1)
+	ds.AddMessage(context.Background(), old2)
+	ds.AddMessage(context.Background(), old3)
+	ds.AddMessage(context.Background(), new2)
+	ds.AddMessage(context.Background(), new3)
 	// Test 4 hour retention
 	cfg := config.Storage{
 		RetentionPeriod: 239 * time.Minute,
 		RetentionSleep:  0,
 	}
 	shutdownChan := make(chan bool)
-	rs := storage.NewRetentionScanner(cfg, ds, shutdownChan)
-	if err := rs.DoScan(); err != nil {
+	rs := storage.NewRetentionScanner(
+		config.NewCurrent(&config.Root{Storage: cfg}, nil), ds, shutdownChan)
+	if err := rs.DoScan(context.Background()); err != nil {
 		t.Error(err)
 	}
 	// Delete should not have been called on new messages
@@ -50,6 +54,86 @@ func TestDoRetentionScan(t *testing.T) {
 	}
 }
 
+func TestRetentionScannerInterval(t *testing.T) {
+	ds := test.NewStore()
+	fresh := stubMessage("mb1", 0)
+	old := stubMessage("mb1", 2)
+	ds.AddMessage(context.Background(), fresh)
+	ds.AddMessage(context.Background(), old)
+	cfg := config.Storage{
+		RetentionPeriod:   time.Hour,
+		RetentionInterval: 10 * time.Millisecond,
+		RetentionSleep:    0,
+	}
+	shutdownChan := make(chan bool)
+	rs := storage.NewRetentionScanner(
+		config.NewCurrent(&config.Root{Storage: cfg}, nil), ds, shutdownChan)
+	rs.Start()
+	time.Sleep(100 * time.Millisecond)
+	close(shutdownChan)
+	rs.Join()
+	if ds.MessageDeleted(fresh) {
+		t.Errorf("Expected %v to be present, was deleted", fresh.ID())
+	}
+	if !ds.MessageDeleted(old) {
+		t.Errorf("Expected %v to be deleted, was present", old.ID())
+	}
+}
+
+// TestRetentionScannerReload verifies a reloaded retention period is used by the running scanner.
+func TestRetentionScannerReload(t *testing.T) {
+	// The memory store is safe to check while the scanner is running.
+	ds, err := mem.New(config.Storage{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, age := range []int{0, 2} {
+		m := stubMessage("mb1", age).(*message.Delivery)
+		m.Reader = strings.NewReader("")
+		if _, err := ds.AddMessage(context.Background(), m); err != nil {
+			t.Fatal(err)
+		}
+	}
+	count := func() int {
+		msgs, err := ds.GetMessages(context.Background(), "mb1")
+		if err != nil {
+			t.Fatal(err)
+		}
+		return len(msgs)
+	}
+	cfg := config.Storage{
+		RetentionPeriod:   3 * time.Hour,
+		RetentionInterval: 10 * time.Millisecond,
+		RetentionSleep:    0,
+	}
+	reloaded := cfg
+	reloaded.RetentionPeriod = time.Hour
+	conf := config.NewCurrent(&config.Root{Storage: cfg}, func() (*config.Root, error) {
+		return &config.Root{Storage: reloaded}, nil
+	})
+	shutdownChan := make(chan bool)
+	rs := storage.NewRetentionScanner(conf, ds, shutdownChan)
+	rs.Start()
+	defer func() {
+		close(shutdownChan)
+		rs.Join()
+	}()
+	time.Sleep(50 * time.Millisecond)
+	if n := count(); n != 2 {
+		t.Fatalf("Got %v messages before reload, want: 2", n)
+	}
+	if _, err := conf.Reload(); err != nil {
+		t.Fatal(err)
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	for count() != 1 {
+		if time.Now().After(deadline) {
+			t.Fatal("Expected 2 hour old message to be deleted after reload, was present")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
 // stubMessage creates a message stub of a specific age
 func stubMessage(mailbox string, ageHours int) storage.Message {
 	return &message.Delivery{
@@ -0,0 +1,106 @@
+package s3
+
+import (
+	"context"
+	"io"
+	"net/mail"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/inbucket/inbucket/pkg/storage"
+)
+
+// Message is an S3 store message, the content is loaded on demand.
+type Message struct {
+	store   *Store
+	mailbox string
+	id      string
+	from    *mail.Address
+	to      []*mail.Address
+	date    time.Time
+	subject string
+	size    int64
+	seen    bool
+	envid   string
+	spf     string
+	tags    []string
+}
+
+var _ storage.Message = &Message{}
+
+// Mailbox returns the mailbox name.
+func (m *Message) Mailbox() string { return m.mailbox }
+
+// ID the message ID.
+func (m *Message) ID() string { return m.id }
+
+// From returns the from address.
+func (m *Message) From() *mail.Address { return m.from }
+
+// To returns the to address list.
+func (m *Message) To() []*mail.Address { return m.to }
+
+// Date returns the date received.
+func (m *Message) Date() time.Time { return m.date }
+
+// Subject returns the subject line.
+func (m *Message) Subject() string { return m.subject }
+
+// Source returns a reader for the message source.
+func (m *Message) Source() (io.ReadCloser, error) {
+	out, err := m.store.client.GetObject(context.Background(), &s3.GetObjectInput{
+		Bucket: aws.String(m.store.bucket),
+		Key:    aws.String(m.store.rawKey(m.mailbox, m.id)),
+	})
+	if err != nil {
+		if errorCode(err) == "NoSuchKey" {
+			return nil, storage.ErrNotExist
+		}
+		return nil, err
+	}
+	return out.Body, nil
+}
+
+// Size returns the message size in bytes.
+func (m *Message) Size() int64 { return m.size }
+
+// Seen returns the message seen flag.
+func (m *Message) Seen() bool { return m.seen }
+
+// EnvelopeID returns the SMTP DSN envelope ID.
+func (m *Message) EnvelopeID() string { return m.envid }
+
+// SPFResult returns the result of the SPF check made when the message was received.
+func (m *Message) SPFResult() string { return m.spf }
+
+// Tags returns the message tags.
+func (m *Message) Tags() []string { return m.tags }
+
+// parseAddress parses an RFC 5322 address stored by AddMessage.
+func parseAddress(s string) *mail.Address {
+	if s == "" {
+		return nil
+	}
+	a, err := mail.ParseAddress(s)
+	if err != nil {
+		return &mail.Address{Address: s}
+	}
+	return a
+}
+
+// parseAddressList parses the RFC 5322 addresses stored by AddMessage.
+func parseAddressList(list []string) []*mail.Address {
+	if len(list) == 0 {
+		return nil
+	}
+	as, err := mail.ParseAddressList(strings.Join(list, ", "))
+	if err != nil {
+		as = make([]*mail.Address, len(list))
+		for i, s := range list {
+			as[i] = parseAddress(s)
+		}
+	}
+	return as
+}
@@ -0,0 +1,552 @@
+// Package s3 implements a message store backed by an S3 compatible object storage bucket,
+// allowing multiple Inbucket instances to share their mailboxes.
+package s3
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	awsconfig "github.com/aws/aws-sdk-go-v2/config"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	smithy "github.com/aws/smithy-go"
+	"github.com/inbucket/inbucket/pkg/config"
+	"github.com/inbucket/inbucket/pkg/storage"
+	"github.com/inbucket/inbucket/pkg/stringutil"
+	"github.com/rs/zerolog/log"
+)
+
+const (
+	// defaultPrefix is prepended to all object keys unless the prefix parameter is specified.
+	defaultPrefix = "inbucket"
+
+	// defaultRegion is used unless the region parameter is specified.
+	defaultRegion = "us-east-1"
+
+	// indexName is the name of the mailbox index object.
+	indexName = "index.json"
+
+	// maxAttempts limits the number of times a conflicting index update is retried.
+	maxAttempts = 10
+)
+
+var (
+	// errUnchanged is returned by an index update function to skip writing the index.
+	errUnchanged = errors.New("index unchanged")
+
+	// errDropped is returned by an index update function when the new message is discarded.
+	errDropped = errors.New("message dropped")
+
+	// errConflict indicates an object was modified by another writer.
+	errConflict = errors.New("conflicting write")
+)
+
+// Store implements storage.Store using S3.  Each mailbox is stored under {prefix}/{hash}/, where
+// hash is the hashed mailbox name.  The raw content of each message is stored in {id}.raw, and
+// the mailbox name and message metadata are stored as JSON in index.json.
+//
+// The index is updated with conditional writes, so that concurrent deliveries from multiple
+// instances are not lost.  If the server does not support conditional writes, the store falls
+// back to unconditional writes.
+type Store struct {
+	client      *s3.Client
+	bucket      string
+	prefix      string
+	messageCap  int
+	overflow    config.OverflowPolicy
+	conditional int32 // Set to 0 once the server rejects a conditional write.
+}
+
+var _ storage.Store = &Store{}
+
+// index is the JSON representation of a mailbox index.
+type index struct {
+	Mailbox  string   `json:"mailbox"`
+	Messages []*entry `json:"messages"`
+}
+
+// entry holds the metadata of a message in the mailbox index.
+type entry struct {
+	ID      string    `json:"id"`
+	From    string    `json:"from"`
+	To      []string  `json:"to"`
+	Subject string    `json:"subject"`
+	Date    time.Time `json:"date"`
+	Size    int64     `json:"size"`
+	Seen    bool      `json:"seen,omitempty"`
+	EnvID   string    `json:"envid,omitempty"`
+	SPF     string    `json:"spf,omitempty"`
+	Tags    []string  `json:"tags,omitempty"`
+}
+
+// New connects to the bucket specified by the `bucket` parameter.  The `endpoint` parameter selects
+// an S3 compatible service other than AWS, credentials are loaded from the standard AWS
+// environment variables and configuration files.
+func New(cfg config.Storage) (storage.Store, error) {
+	bucket := cfg.Params["bucket"]
+	if bucket == "" {
+		return nil, fmt.Errorf("s3 storage requires the bucket parameter")
+	}
+	prefix := strings.Trim(cfg.Params["prefix"], "/")
+	if prefix == "" {
+		prefix = defaultPrefix
+	}
+	region := cfg.Params["region"]
+	if region == "" {
+		region = defaultRegion
+	}
+	ctx := context.Background()
+	awsConf, err := awsconfig.LoadDefaultConfig(ctx, awsconfig.WithRegion(region))
+	if err != nil {
+		return nil, fmt.Errorf("failed to load s3 configuration: %v", err)
+	}
+	endpoint := cfg.Params["endpoint"]
+	client := s3.NewFromConfig(awsConf, func(o *s3.Options) {
+		if endpoint != "" {
+			o.BaseEndpoint = aws.String(endpoint)
+			o.UsePathStyle = true
+			// Many S3 compatible services do not support the flexible checksums sent by default.
+			o.RequestChecksumCalculation = aws.RequestChecksumCalculationWhenRequired
+			o.ResponseChecksumValidation = aws.ResponseChecksumValidationWhenRequired
+		}
+	})
+	_, err = client.HeadBucket(ctx, &s3.HeadBucketInput{Bucket: aws.String(bucket)})
+	if err != nil {
+		return nil, fmt.Errorf("failed to access s3 bucket %q: %v", bucket, err)
+	}
+	return &Store{
+		client:      client,
+		bucket:      bucket,
+		prefix:      prefix,
+		messageCap:  cfg.MailboxMsgCap,
+		overflow:    cfg.OverflowPolicy,
+		conditional: 1,
+	}, nil
+}
+
+// AddMessage stores the message, message ID and Size will be ignored.
+func (s *Store) AddMessage(ctx context.Context, m storage.Message) (id string, err error) {
+	if err := ctx.Err(); err != nil {
+		return "", err
+	}
+	r, err := m.Source()
+	if err != nil {
+		return "", err
+	}
+	content, err := ioutil.ReadAll(r)
+	_ = r.Close()
+	if err != nil {
+		return "", err
+	}
+	mailbox := m.Mailbox()
+	// If-None-Match prevents two deliveries from claiming the same ID.
+	for attempt := 0; ; attempt++ {
+		id = strconv.FormatInt(time.Now().UnixNano(), 10)
+		err = s.putObject(ctx, s.rawKey(mailbox, id), content, "", true)
+		if err != errConflict || attempt == maxAttempts {
+			break
+		}
+	}
+	if err != nil {
+		return "", ctxErr(ctx, err)
+	}
+	e := &entry{
+		ID:      id,
+		Subject: m.Subject(),
+		Date:    m.Date(),
+		Size:    int64(len(content)),
+		EnvID:   m.EnvelopeID(),
+		SPF:     m.SPFResult(),
+		Tags:    m.Tags(),
+	}
+	if m.From() != nil {
+		e.From = m.From().String()
+	}
+	for _, a := range m.To() {
+		e.To = append(e.To, a.String())
+	}
+	var removed []string
+	err = s.updateIndex(ctx, mailbox, func(idx *index) error {
+		removed = nil
+		if s.messageCap > 0 && len(idx.Messages) >= s.messageCap {
+			switch s.overflow {
+			case config.OverflowReject:
+				return storage.ErrMailboxFull
+			case config.OverflowDropNewest:
+				return errDropped
+			}
+		}
+		idx.Messages = append(idx.Messages, e)
+		if s.messageCap > 0 && len(idx.Messages) > s.messageCap {
+			// Delete the oldest messages over messageCap.
+			excess := len(idx.Messages) - s.messageCap
+			for _, old := range idx.Messages[:excess] {
+				removed = append(removed, old.ID)
+			}
+			idx.Messages = idx.Messages[excess:]
+		}
+		return nil
+	})
+	if err != nil {
+		s.deleteRaw(mailbox, []string{id})
+		if err == errDropped {
+			// Discard the new message.
+			return "", nil
+		}
+		return "", err
+	}
+	s.deleteRaw(mailbox, removed)
+	return id, nil
+}
+
+// GetMessage returns the specified message, or storage.ErrNotExist.
+func (s *Store) GetMessage(ctx context.Context, mailbox, id string) (storage.Message, error) {
+	idx, _, err := s.readIndex(ctx, mailbox)
+	if err != nil {
+		return nil, err
+	}
+	if id == "latest" && len(idx.Messages) != 0 {
+		return s.newMessage(idx, idx.Messages[len(idx.Messages)-1]), nil
+	}
+	for _, e := range idx.Messages {
+		if e.ID == id {
+			return s.newMessage(idx, e), nil
+		}
+	}
+	return nil, storage.ErrNotExist
+}
+
+// GetMessages returns the messages in the named mailbox, oldest first.
+func (s *Store) GetMessages(ctx context.Context, mailbox string) ([]storage.Message, error) {
+	idx, _, err := s.readIndex(ctx, mailbox)
+	if err != nil {
+		return nil, err
+	}
+	return s.messages(idx), nil
+}
+
+// MarkSeen flags the message as having been read.
+func (s *Store) MarkSeen(ctx context.Context, mailbox, id string) error {
+	return s.setSeen(ctx, mailbox, id, true)
+}
+
+// MarkUnseen flags the message as not having been read.
+func (s *Store) MarkUnseen(ctx context.Context, mailbox, id string) error {
+	return s.setSeen(ctx, mailbox, id, false)
+}
+
+// setSeen updates the seen flag of the message, if it exists.
+func (s *Store) setSeen(ctx context.Context, mailbox, id string, seen bool) error {
+	return s.updateIndex(ctx, mailbox, func(idx *index) error {
+		e := idx.find(id)
+		if e == nil || e.Seen == seen {
+			return errUnchanged
+		}
+		e.Seen = seen
+		return nil
+	})
+}
+
+// SetTags replaces the tags of the message.
+func (s *Store) SetTags(ctx context.Context, mailbox, id string, tags []string) error {
+	tags = append([]string(nil), tags...)
+	return s.updateIndex(ctx, mailbox, func(idx *index) error {
+		e := idx.find(id)
+		if e == nil {
+			return storage.ErrNotExist
+		}
+		e.Tags = tags
+		return nil
+	})
+}
+
+// PurgeMessages deletes all messages in the named mailbox.
+func (s *Store) PurgeMessages(ctx context.Context, mailbox string) error {
+	var removed []string
+	err := s.updateIndex(ctx, mailbox, func(idx *index) error {
+		removed = nil
+		if len(idx.Messages) == 0 {
+			return errUnchanged
+		}
+		for _, e := range idx.Messages {
+			removed = append(removed, e.ID)
+		}
+		idx.Messages = nil
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	s.deleteRaw(mailbox, removed)
+	return nil
+}
+
+// RemoveMessage deletes a message by ID from the specified mailbox.
+func (s *Store) RemoveMessage(ctx context.Context, mailbox, id string) error {
+	err := s.updateIndex(ctx, mailbox, func(idx *index) error {
+		for i, e := range idx.Messages {
+			if e.ID == id {
+				idx.Messages = append(idx.Messages[:i], idx.Messages[i+1:]...)
+				return nil
+			}
+		}
+		return storage.ErrNotExist
+	})
+	if err != nil {
+		return err
+	}
+	s.deleteRaw(mailbox, []string{id})
+	return nil
+}
+
+// VisitMailboxes accepts a function that will be called with the messages in each mailbox while it
+// continues to return true.
+func (s *Store) VisitMailboxes(ctx context.Context, f func([]storage.Message) (cont bool)) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	pages := s3.NewListObjectsV2Paginator(s.client, &s3.ListObjectsV2Input{
+		Bucket:    aws.String(s.bucket),
+		Prefix:    aws.String(s.prefix + "/"),
+		Delimiter: aws.String("/"),
+	})
+	for pages.HasMorePages() {
+		page, err := pages.NextPage(ctx)
+		if err != nil {
+			return ctxErr(ctx, err)
+		}
+		for _, p := range page.CommonPrefixes {
+			idx, _, err := s.getIndex(ctx, aws.ToString(p.Prefix)+indexName)
+			if err != nil {
+				return err
+			}
+			if idx == nil {
+				// Purged, or the first delivery is in progress.
+				continue
+			}
+			if !f(s.messages(idx)) {
+				return nil
+			}
+		}
+	}
+	return nil
+}
+
+// updateIndex reads the index of mailbox, applies fn to it and writes it back, retrying if it was
+// modified concurrently.  If fn returns errUnchanged the index is not written.  An index without
+// messages is deleted.
+func (s *Store) updateIndex(ctx context.Context, mailbox string, fn func(*index) error) error {
+	key := s.indexKey(mailbox)
+	for attempt := 0; attempt < maxAttempts; attempt++ {
+		idx, etag, err := s.readIndex(ctx, mailbox)
+		if err != nil {
+			return err
+		}
+		if err := fn(idx); err != nil {
+			if err == errUnchanged {
+				return nil
+			}
+			return err
+		}
+		if len(idx.Messages) == 0 {
+			err = s.deleteObject(ctx, key, etag)
+		} else {
+			var content []byte
+			content, err = json.Marshal(idx)
+			if err != nil {
+				return err
+			}
+			err = s.putObject(ctx, key, content, etag, etag == "")
+		}
+		if err != errConflict {
+			return ctxErr(ctx, err)
+		}
+	}
+	return fmt.Errorf("failed to update s3 index %q: too many conflicting writes", key)
+}
+
+// readIndex returns the index of mailbox and its ETag, or an empty index and ETag if the mailbox
+// does not exist.
+func (s *Store) readIndex(ctx context.Context, mailbox string) (*index, string, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, "", err
+	}
+	idx, etag, err := s.getIndex(ctx, s.indexKey(mailbox))
+	if err == nil && idx == nil {
+		idx = &index{Mailbox: mailbox}
+	}
+	return idx, etag, err
+}
+
+// getIndex returns the index stored at key and its ETag, or nil if it does not exist.
+func (s *Store) getIndex(ctx context.Context, key string) (*index, string, error) {
+	out, err := s.client.GetObject(ctx, &s3.GetObjectInput{
+		Bucket: aws.String(s.bucket),
+		Key:    aws.String(key),
+	})
+	if err != nil {
+		if errorCode(err) == "NoSuchKey" {
+			return nil, "", nil
+		}
+		return nil, "", ctxErr(ctx, err)
+	}
+	defer out.Body.Close()
+	idx := &index{}
+	if err := json.NewDecoder(out.Body).Decode(idx); err != nil {
+		return nil, "", ctxErr(ctx, fmt.Errorf("failed to decode s3 index %q: %v", key, err))
+	}
+	return idx, aws.ToString(out.ETag), nil
+}
+
+// putObject writes content to key.  If etag is not empty, the write is conditional on the object
+// matching it.  If create is true, the write is conditional on the object not existing.
+// errConflict is returned if the condition is not met.
+func (s *Store) putObject(
+	ctx context.Context, key string, content []byte, etag string, create bool,
+) error {
+	input := &s3.PutObjectInput{
+		Bucket: aws.String(s.bucket),
+		Key:    aws.String(key),
+		Body:   bytes.NewReader(content),
+	}
+	if atomic.LoadInt32(&s.conditional) == 1 {
+		if etag != "" {
+			input.IfMatch = aws.String(etag)
+		}
+		if create {
+			input.IfNoneMatch = aws.String("*")
+		}
+	}
+	_, err := s.client.PutObject(ctx, input)
+	if err != nil && (input.IfMatch != nil || input.IfNoneMatch != nil) {
+		switch errorCode(err) {
+		case "PreconditionFailed", "ConditionalRequestConflict":
+			return errConflict
+		case "NotImplemented":
+			s.disableConditional(err)
+			return s.putObject(ctx, key, content, etag, create)
+		}
+	}
+	return err
+}
+
+// deleteObject deletes key.  If etag is not empty, the delete is conditional on the object
+// matching it, and errConflict is returned if it does not.
+func (s *Store) deleteObject(ctx context.Context, key, etag string) error {
+	input := &s3.DeleteObjectInput{
+		Bucket: aws.String(s.bucket),
+		Key:    aws.String(key),
+	}
+	if etag != "" && atomic.LoadInt32(&s.conditional) == 1 {
+		input.IfMatch = aws.String(etag)
+	}
+	_, err := s.client.DeleteObject(ctx, input)
+	if err != nil && input.IfMatch != nil {
+		switch errorCode(err) {
+		case "PreconditionFailed", "ConditionalRequestConflict", "NoSuchKey":
+			return errConflict
+		case "NotImplemented":
+			s.disableConditional(err)
+			return s.deleteObject(ctx, key, etag)
+		}
+	}
+	return err
+}
+
+// disableConditional switches to unconditional writes after the server rejected a conditional
+// write.
+func (s *Store) disableConditional(err error) {
+	if atomic.CompareAndSwapInt32(&s.conditional, 1, 0) {
+		log.Warn().Str("module", "storage").Err(err).
+			Msg("S3 server does not support conditional writes, concurrent updates may be lost")
+	}
+}
+
+// deleteRaw deletes the content of the listed messages, they must already have been removed from
+// the mailbox index.  Failures are logged, as the message is no longer reachable.
+func (s *Store) deleteRaw(mailbox string, ids []string) {
+	for _, id := range ids {
+		_, err := s.client.DeleteObject(context.Background(), &s3.DeleteObjectInput{
+			Bucket: aws.String(s.bucket),
+			Key:    aws.String(s.rawKey(mailbox, id)),
+		})
+		if err != nil {
+			log.Warn().Str("module", "storage").Str("mailbox", mailbox).Str("id", id).Err(err).
+				Msg("Failed to delete S3 message content")
+		}
+	}
+}
+
+// messages builds the Messages listed in idx.
+func (s *Store) messages(idx *index) []storage.Message {
+	messages := make([]storage.Message, len(idx.Messages))
+	for i, e := range idx.Messages {
+		messages[i] = s.newMessage(idx, e)
+	}
+	return messages
+}
+
+// newMessage builds a Message from an index entry.
+func (s *Store) newMessage(idx *index, e *entry) *Message {
+	return &Message{
+		store:   s,
+		mailbox: idx.Mailbox,
+		id:      e.ID,
+		from:    parseAddress(e.From),
+		to:      parseAddressList(e.To),
+		date:    e.Date,
+		subject: e.Subject,
+		size:    e.Size,
+		seen:    e.Seen,
+		envid:   e.EnvID,
+		spf:     e.SPF,
+		tags:    e.Tags,
+	}
+}
+
+// find returns the entry for the message with the specified ID, or nil.
+func (idx *index) find(id string) *entry {
+	for _, e := range idx.Messages {
+		if e.ID == id {
+			return e
+		}
+	}
+	return nil
+}
+
+// errorCode returns the error code reported by S3, or an empty string.
+func errorCode(err error) string {
+	var ae smithy.APIError
+	if errors.As(err, &ae) {
+		return ae.ErrorCode()
+	}
+	return ""
+}
+
+// ctxErr returns the error of ctx if it is done, the SDK wraps it in operation errors.
+func ctxErr(ctx context.Context, err error) error {
+	if err != nil && ctx.Err() != nil {
+		return ctx.Err()
+	}
+	return err
+}
+
+func (s *Store) mailboxPrefix(mailbox string) string {
+	return s.prefix + "/" + stringutil.HashMailboxName(mailbox) + "/"
+}
+
+func (s *Store) indexKey(mailbox string) string {
+	return s.mailboxPrefix(mailbox) + indexName
+}
+
+func (s *Store) rawKey(mailbox, id string) string {
+	return s.mailboxPrefix(mailbox) + id + ".raw"
+}
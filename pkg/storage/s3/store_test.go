@@ -0,0 +1,144 @@
+package s3
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/inbucket/inbucket/pkg/config"
+	"github.com/inbucket/inbucket/pkg/storage"
+	"github.com/inbucket/inbucket/pkg/stringutil"
+	"github.com/inbucket/inbucket/pkg/test"
+	minio "github.com/minio/minio-go/v7"
+	"github.com/minio/minio-go/v7/pkg/credentials"
+	"github.com/ory/dockertest/v3"
+)
+
+const (
+	testBucket    = "inbucket-test"
+	testAccessKey = "inbucket"
+	testSecretKey = "inbucket-secret"
+)
+
+var (
+	// minioEndpoint is set by TestMain when a MinIO container is available.
+	minioEndpoint string
+
+	// minioClient is used to prepare and inspect the test bucket.
+	minioClient *minio.Client
+)
+
+// TestMain starts a MinIO container for the integration tests, they will be skipped if Docker is
+// not available.
+func TestMain(m *testing.M) {
+	var resource *dockertest.Resource
+	pool, err := dockertest.NewPool("")
+	if err == nil {
+		err = pool.Client.Ping()
+	}
+	if err == nil {
+		resource, err = pool.RunWithOptions(&dockertest.RunOptions{
+			Repository: "minio/minio",
+			Tag:        "latest",
+			Cmd:        []string{"server", "/data"},
+			Env: []string{
+				"MINIO_ROOT_USER=" + testAccessKey,
+				"MINIO_ROOT_PASSWORD=" + testSecretKey,
+			},
+		})
+	}
+	if err == nil {
+		host := "localhost:" + resource.GetPort("9000/tcp")
+		minioClient, err = minio.New(host, &minio.Options{
+			Creds: credentials.NewStaticV4(testAccessKey, testSecretKey, ""),
+		})
+		if err == nil {
+			err = pool.Retry(func() error {
+				return minioClient.MakeBucket(
+					context.Background(), testBucket, minio.MakeBucketOptions{})
+			})
+		}
+		minioEndpoint = "http://" + host
+	}
+	if err == nil {
+		// Read by the AWS SDK default credential chain.
+		_ = os.Setenv("AWS_ACCESS_KEY_ID", testAccessKey)
+		_ = os.Setenv("AWS_SECRET_ACCESS_KEY", testSecretKey)
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "MinIO unavailable, integration tests will be skipped: %v\n", err)
+		minioEndpoint = ""
+	}
+	code := m.Run()
+	if resource != nil {
+		_ = pool.Purge(resource)
+	}
+	os.Exit(code)
+}
+
+// TestSuite runs storage package test suite on s3 store.
+func TestSuite(t *testing.T) {
+	if minioEndpoint == "" {
+		t.Skip("MinIO unavailable")
+	}
+	test.StoreSuite(t, func(conf config.Storage) (storage.Store, func(), error) {
+		return setupStore(t, conf), func() {}, nil
+	})
+}
+
+// TestObjectLayout verifies objects are stored under the prefix parameter and hashed mailbox name.
+func TestObjectLayout(t *testing.T) {
+	s := setupStore(t, config.Storage{Params: map[string]string{"prefix": "custom/"}})
+	id, _ := test.DeliverToStore(t, s, "box", "subject", time.Now())
+	dir := "custom/" + stringutil.HashMailboxName("box") + "/"
+	ctx := context.Background()
+	for _, key := range []string{dir + "index.json", dir + id + ".raw"} {
+		_, err := minioClient.StatObject(ctx, testBucket, key, minio.StatObjectOptions{})
+		if err != nil {
+			t.Errorf("object %q: %v", key, err)
+		}
+	}
+	// An emptied mailbox is removed, so it is no longer visited.
+	if err := s.RemoveMessage(ctx, "box", id); err != nil {
+		t.Fatal(err)
+	}
+	for obj := range minioClient.ListObjects(ctx, testBucket, minio.ListObjectsOptions{
+		Prefix: dir, Recursive: true}) {
+		t.Errorf("got object %q after mailbox emptied, want none", obj.Key)
+	}
+}
+
+// TestMissingBucket verifies a bucket parameter is required.
+func TestMissingBucket(t *testing.T) {
+	_, err := New(config.Storage{})
+	if err == nil {
+		t.Error("got nil error, wanted error for missing bucket")
+	}
+}
+
+// setupStore connects to the test MinIO instance and empties the test bucket, skipping the test if
+// MinIO is not available.
+func setupStore(t *testing.T, cfg config.Storage) *Store {
+	t.Helper()
+	if minioEndpoint == "" {
+		t.Skip("MinIO unavailable")
+	}
+	ctx := context.Background()
+	objects := minioClient.ListObjects(ctx, testBucket, minio.ListObjectsOptions{Recursive: true})
+	errs := minioClient.RemoveObjects(ctx, testBucket, objects, minio.RemoveObjectsOptions{})
+	for err := range errs {
+		t.Fatal(err.Err)
+	}
+	if cfg.Params == nil {
+		cfg.Params = make(map[string]string)
+	}
+	cfg.Params["bucket"] = testBucket
+	cfg.Params["endpoint"] = minioEndpoint
+	s, err := New(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return s.(*Store)
+}
@@ -0,0 +1,100 @@
+package storage
+
+import (
+	"io"
+	"io/ioutil"
+	"net/textproto"
+	"strings"
+	"unicode/utf8"
+
+	"golang.org/x/net/html"
+	"golang.org/x/net/html/charset"
+)
+
+// SnippetLength is the maximum number of runes in a message snippet.
+const SnippetLength = 200
+
+// maxSnippetSource limits how much of a body is read to find its snippet.
+const maxSnippetSource = 64 * 1024
+
+// SnippetMessage is implemented by messages from stores which record the beginning of the message
+// text when it is added.
+type SnippetMessage interface {
+	// Snippet returns up to SnippetLength runes of the first text/plain body of the message, or of
+	// the first text/html body with its markup removed if there is no plain text.  The snippet is
+	// plain text with runs of white space collapsed, and HTML entities decoded.
+	Snippet() string
+}
+
+// readText records the snippet of a text body, if it is the first of its type.
+func (ac *attachmentCounter) readText(header textproto.MIMEHeader, mediatype string,
+	body io.Reader) {
+	switch {
+	case mediatype == "text/plain" && !ac.hasPlain:
+		ac.hasPlain = true
+		ac.plain = snippet(readBody(header, body))
+	case mediatype == "text/html" && !ac.hasHTML:
+		ac.hasHTML = true
+		ac.html = snippet(htmlText(readBody(header, body)))
+	}
+}
+
+// readBody returns the beginning of a text body, decoded to UTF-8.
+func readBody(header textproto.MIMEHeader, body io.Reader) string {
+	r := io.LimitReader(decodeTransfer(header, body), maxSnippetSource)
+	if cr, err := charset.NewReader(r, header.Get("Content-Type")); err == nil {
+		r = cr
+	}
+	// A truncated or undecodable body is used as far as it was read.
+	b, _ := ioutil.ReadAll(r)
+	return strings.ToValidUTF8(string(b), "")
+}
+
+// htmlSkip lists elements whose content is not displayed.
+var htmlSkip = map[string]bool{"head": true, "script": true, "style": true, "title": true}
+
+// htmlBreak lists elements which separate words, such as paragraphs and table cells.
+var htmlBreak = map[string]bool{
+	"br": true, "div": true, "h1": true, "h2": true, "h3": true, "h4": true, "h5": true,
+	"h6": true, "hr": true, "li": true, "p": true, "td": true, "th": true, "tr": true,
+}
+
+// htmlText returns the displayed text of an HTML document, with entities decoded.
+func htmlText(s string) string {
+	b := &strings.Builder{}
+	skip := 0
+	z := html.NewTokenizer(strings.NewReader(s))
+	for {
+		tt := z.Next()
+		switch tt {
+		case html.ErrorToken:
+			return b.String()
+		case html.TextToken:
+			if skip == 0 {
+				b.Write(z.Text())
+			}
+		case html.StartTagToken, html.EndTagToken, html.SelfClosingTagToken:
+			name, _ := z.TagName()
+			tag := string(name)
+			if htmlSkip[tag] {
+				if tt == html.StartTagToken {
+					skip++
+				} else if tt == html.EndTagToken && skip > 0 {
+					skip--
+				}
+			}
+			if htmlBreak[tag] {
+				b.WriteByte(' ')
+			}
+		}
+	}
+}
+
+// snippet collapses the white space in s, and truncates it to SnippetLength runes.
+func snippet(s string) string {
+	s = strings.Join(strings.Fields(s), " ")
+	if utf8.RuneCountInString(s) <= SnippetLength {
+		return s
+	}
+	return string([]rune(s)[:SnippetLength])
+}
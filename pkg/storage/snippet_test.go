@@ -0,0 +1,59 @@
+package storage_test
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/inbucket/inbucket/pkg/storage"
+)
+
+func TestSummarizeSnippet(t *testing.T) {
+	const header = "From: a@host\r\nMIME-Version: 1.0\r\n"
+	testCases := []struct {
+		name   string
+		source string
+		want   string
+	}{
+		{"plain", header + "\r\nHello,\r\n\r\n  plain   text.\r\n", "Hello, plain text."},
+		{"no body", header + "\r\n", ""},
+		{"malformed", "not a message", ""},
+		{
+			"html only",
+			header + "Content-Type: text/html; charset=utf-8\r\n\r\n" +
+				"<html><head><title>T</title><style>p {}</style></head>" +
+				"<body><p>Caf&eacute; &amp; <b>bar</b></p><p>&lt;tag&gt;</p>" +
+				"<script>x()</script></body></html>\r\n",
+			"Café & bar <tag>",
+		},
+		{
+			"alternative",
+			header + "Content-Type: multipart/alternative; boundary=b1\r\n\r\n" +
+				"--b1\r\nContent-Type: text/html\r\n\r\n<p>From HTML</p>\r\n" +
+				"--b1\r\nContent-Type: text/plain; charset=iso-8859-1\r\n" +
+				"Content-Transfer-Encoding: quoted-printable\r\n\r\nFrom plain, caf=E9\r\n" +
+				"--b1--\r\n",
+			"From plain, café",
+		},
+		{
+			"attachment only",
+			header + "Content-Type: multipart/mixed; boundary=b1\r\n\r\n" +
+				"--b1\r\nContent-Type: text/plain\r\n" +
+				"Content-Disposition: attachment; filename=a.txt\r\n\r\nattached\r\n" +
+				"--b1--\r\n",
+			"",
+		},
+		{
+			"truncated",
+			header + "\r\n" + strings.Repeat("é", storage.SnippetLength+10),
+			strings.Repeat("é", storage.SnippetLength),
+		},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			got := storage.Summarize(strings.NewReader(tc.source)).Snippet
+			if got != tc.want {
+				t.Errorf("got snippet %q, want: %q", got, tc.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,73 @@
+package sqlite
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"net/mail"
+	"strconv"
+	"time"
+
+	"github.com/inbucket/inbucket/pkg/storage"
+)
+
+// Message is a SQLite store message, the content is loaded from the blobs table on demand.
+type Message struct {
+	store   *Store
+	rowID   int64
+	mailbox string
+	from    *mail.Address
+	to      []*mail.Address
+	date    time.Time
+	subject string
+	size    int64
+	seen    bool
+	envid   string
+	spf     string
+	tags    []string
+}
+
+var _ storage.Message = &Message{}
+
+// Mailbox returns the mailbox name.
+func (m *Message) Mailbox() string { return m.mailbox }
+
+// ID the message ID.
+func (m *Message) ID() string { return strconv.FormatInt(m.rowID, 10) }
+
+// From returns the from address.
+func (m *Message) From() *mail.Address { return m.from }
+
+// To returns the to address list.
+func (m *Message) To() []*mail.Address { return m.to }
+
+// Date returns the date received.
+func (m *Message) Date() time.Time { return m.date }
+
+// Subject returns the subject line.
+func (m *Message) Subject() string { return m.subject }
+
+// Source returns a reader for the message source.
+func (m *Message) Source() (io.ReadCloser, error) {
+	var content []byte
+	err := m.store.db.QueryRow(`SELECT content FROM blobs WHERE id = ?`, m.rowID).Scan(&content)
+	if err != nil {
+		return nil, err
+	}
+	return ioutil.NopCloser(bytes.NewReader(content)), nil
+}
+
+// Size returns the message size in bytes.
+func (m *Message) Size() int64 { return m.size }
+
+// Seen returns the message seen flag.
+func (m *Message) Seen() bool { return m.seen }
+
+// EnvelopeID returns the SMTP DSN envelope ID.
+func (m *Message) EnvelopeID() string { return m.envid }
+
+// SPFResult returns the result of the SPF check made when the message was received.
+func (m *Message) SPFResult() string { return m.spf }
+
+// Tags returns the message tags.
+func (m *Message) Tags() []string { return m.tags }
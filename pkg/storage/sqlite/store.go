@@ -0,0 +1,397 @@
+// Package sqlite implements a message store backed by a single SQLite database file.
+package sqlite
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/mail"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/inbucket/inbucket/pkg/config"
+	"github.com/inbucket/inbucket/pkg/storage"
+
+	// Registers the sqlite3 database/sql driver.
+	_ "github.com/mattn/go-sqlite3"
+)
+
+// schema is applied each time the store is opened.
+var schema = []string{
+	`CREATE TABLE IF NOT EXISTS messages (
+		id      INTEGER PRIMARY KEY AUTOINCREMENT,
+		mailbox TEXT    NOT NULL,
+		"from"  TEXT    NOT NULL,
+		"to"    TEXT    NOT NULL,
+		subject TEXT    NOT NULL,
+		date    INTEGER NOT NULL,
+		size    INTEGER NOT NULL,
+		seen    INTEGER NOT NULL DEFAULT 0,
+		envid   TEXT    NOT NULL DEFAULT '',
+		spf     TEXT    NOT NULL DEFAULT '',
+		tags    TEXT    NOT NULL DEFAULT ''
+	)`,
+	`CREATE INDEX IF NOT EXISTS messages_mailbox ON messages (mailbox, id)`,
+	`CREATE TABLE IF NOT EXISTS blobs (
+		id      INTEGER PRIMARY KEY REFERENCES messages (id) ON DELETE CASCADE,
+		content BLOB    NOT NULL
+	)`,
+}
+
+// migrations add columns to databases created by earlier versions, duplicate column errors are
+// ignored.
+var migrations = []string{
+	`ALTER TABLE messages ADD COLUMN envid TEXT NOT NULL DEFAULT ''`,
+	`ALTER TABLE messages ADD COLUMN spf TEXT NOT NULL DEFAULT ''`,
+	`ALTER TABLE messages ADD COLUMN tags TEXT NOT NULL DEFAULT ''`,
+}
+
+// Store implements storage.Store using a SQLite database.
+type Store struct {
+	db         *sql.DB
+	messageCap int
+	overflow   config.OverflowPolicy
+}
+
+var _ storage.Store = &Store{}
+var _ storage.Importer = &Store{}
+
+// New opens or creates the SQLite database specified by the `path` parameter.
+func New(cfg config.Storage) (storage.Store, error) {
+	path := cfg.Params["path"]
+	if path == "" {
+		return nil, fmt.Errorf("sqlite storage requires the path parameter")
+	}
+	// WAL mode allows readers to proceed while a delivery is being written; immediate transactions
+	// prevent writers from deadlocking when upgrading read locks.
+	dsn := "file:" + path +
+		"?_journal_mode=WAL&_busy_timeout=5000&_foreign_keys=1&_txlock=immediate"
+	db, err := sql.Open("sqlite3", dsn)
+	if err != nil {
+		return nil, err
+	}
+	for _, stmt := range schema {
+		if _, err := db.Exec(stmt); err != nil {
+			_ = db.Close()
+			return nil, fmt.Errorf("failed to create sqlite schema: %v", err)
+		}
+	}
+	for _, stmt := range migrations {
+		if _, err := db.Exec(stmt); err != nil &&
+			!strings.Contains(err.Error(), "duplicate column name") {
+			_ = db.Close()
+			return nil, fmt.Errorf("failed to migrate sqlite schema: %v", err)
+		}
+	}
+	return &Store{db: db, messageCap: cfg.MailboxMsgCap, overflow: cfg.OverflowPolicy}, nil
+}
+
+// Close closes the underlying database.
+func (s *Store) Close() error {
+	return s.db.Close()
+}
+
+// AddMessage stores the message, message ID and Size will be ignored.
+func (s *Store) AddMessage(ctx context.Context, m storage.Message) (id string, err error) {
+	return s.addMessage(ctx, m, 0)
+}
+
+// ImportMessage stores the message, keeping its ID if it is a positive integer not already in
+// use.
+func (s *Store) ImportMessage(ctx context.Context, m storage.Message) (id string, err error) {
+	rowID, err := strconv.ParseInt(m.ID(), 10, 64)
+	if err != nil || rowID <= 0 {
+		rowID = 0
+	}
+	return s.addMessage(ctx, m, rowID)
+}
+
+// addMessage stores the message with the requested row ID, a new ID is assigned if it is zero or
+// already in use.
+func (s *Store) addMessage(
+	ctx context.Context, m storage.Message, rowID int64) (id string, err error) {
+	r, err := m.Source()
+	if err != nil {
+		return "", err
+	}
+	content, err := ioutil.ReadAll(r)
+	_ = r.Close()
+	if err != nil {
+		return "", err
+	}
+	// Addresses are stored in RFC 5322 form so they can be parsed back losslessly.
+	from := ""
+	if m.From() != nil {
+		from = m.From().String()
+	}
+	to := make([]string, len(m.To()))
+	for i, a := range m.To() {
+		to[i] = a.String()
+	}
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return "", err
+	}
+	defer func() {
+		if err != nil {
+			_ = tx.Rollback()
+		}
+	}()
+	if s.messageCap > 0 &&
+		(s.overflow == config.OverflowReject || s.overflow == config.OverflowDropNewest) {
+		var count int
+		err = tx.QueryRowContext(ctx, `SELECT COUNT(*) FROM messages WHERE mailbox = ?`, m.Mailbox()).
+			Scan(&count)
+		if err != nil {
+			return "", err
+		}
+		if count >= s.messageCap {
+			if s.overflow == config.OverflowReject {
+				err = storage.ErrMailboxFull
+				return "", err
+			}
+			// Discard the new message.
+			_ = tx.Rollback()
+			return "", nil
+		}
+	}
+	if rowID != 0 {
+		var exists int
+		err = tx.QueryRowContext(ctx, `SELECT COUNT(*) FROM messages WHERE id = ?`, rowID).Scan(&exists)
+		if err != nil {
+			return "", err
+		}
+		if exists > 0 {
+			rowID = 0
+		}
+	}
+	// A NULL id is assigned the next row ID.
+	var reqID interface{}
+	if rowID != 0 {
+		reqID = rowID
+	}
+	res, err := tx.ExecContext(ctx,
+		`INSERT INTO messages (id, mailbox, "from", "to", subject, date, size, envid, spf,
+			tags) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`,
+		reqID, m.Mailbox(), from, strings.Join(to, ", "), m.Subject(),
+		m.Date().UnixNano(), len(content), m.EnvelopeID(), m.SPFResult(),
+		encodeTags(m.Tags()))
+	if err != nil {
+		return "", err
+	}
+	rowID, err = res.LastInsertId()
+	if err != nil {
+		return "", err
+	}
+	_, err = tx.ExecContext(ctx, `INSERT INTO blobs (id, content) VALUES (?, ?)`, rowID, content)
+	if err != nil {
+		return "", err
+	}
+	if s.messageCap > 0 {
+		// Delete the oldest messages over messageCap.
+		_, err = tx.ExecContext(ctx,
+			`DELETE FROM messages WHERE mailbox = ? AND id NOT IN
+				(SELECT id FROM messages WHERE mailbox = ? ORDER BY id DESC LIMIT ?)`,
+			m.Mailbox(), m.Mailbox(), s.messageCap)
+		if err != nil {
+			return "", err
+		}
+	}
+	if err = tx.Commit(); err != nil {
+		return "", err
+	}
+	return strconv.FormatInt(rowID, 10), nil
+}
+
+// GetMessage returns the specified message, or storage.ErrNotExist.
+func (s *Store) GetMessage(ctx context.Context, mailbox, id string) (storage.Message, error) {
+	var row *sql.Row
+	if id == "latest" {
+		row = s.db.QueryRowContext(ctx,
+			selectMessage+` WHERE mailbox = ? ORDER BY id DESC LIMIT 1`, mailbox)
+	} else {
+		rowID, err := strconv.ParseInt(id, 10, 64)
+		if err != nil {
+			return nil, storage.ErrNotExist
+		}
+		row = s.db.QueryRowContext(ctx, selectMessage+` WHERE mailbox = ? AND id = ?`, mailbox, rowID)
+	}
+	m, err := s.scanMessage(row)
+	if err == sql.ErrNoRows {
+		return nil, storage.ErrNotExist
+	}
+	return m, err
+}
+
+// GetMessages returns the messages in the named mailbox, oldest first.
+func (s *Store) GetMessages(ctx context.Context, mailbox string) ([]storage.Message, error) {
+	rows, err := s.db.QueryContext(ctx, selectMessage+` WHERE mailbox = ? ORDER BY id`, mailbox)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	messages := make([]storage.Message, 0)
+	for rows.Next() {
+		m, err := s.scanMessage(rows)
+		if err != nil {
+			return nil, err
+		}
+		messages = append(messages, m)
+	}
+	return messages, rows.Err()
+}
+
+// MarkSeen flags the message as having been read.
+func (s *Store) MarkSeen(ctx context.Context, mailbox, id string) error {
+	rowID, err := strconv.ParseInt(id, 10, 64)
+	if err != nil {
+		return storage.ErrNotExist
+	}
+	_, err = s.db.ExecContext(ctx,
+		`UPDATE messages SET seen = 1 WHERE mailbox = ? AND id = ?`, mailbox, rowID)
+	return err
+}
+
+// MarkUnseen flags the message as not having been read.
+func (s *Store) MarkUnseen(ctx context.Context, mailbox, id string) error {
+	rowID, err := strconv.ParseInt(id, 10, 64)
+	if err != nil {
+		return storage.ErrNotExist
+	}
+	_, err = s.db.ExecContext(ctx,
+		`UPDATE messages SET seen = 0 WHERE mailbox = ? AND id = ?`, mailbox, rowID)
+	return err
+}
+
+// SetTags replaces the tags of the message.
+func (s *Store) SetTags(ctx context.Context, mailbox, id string, tags []string) error {
+	rowID, err := strconv.ParseInt(id, 10, 64)
+	if err != nil {
+		return storage.ErrNotExist
+	}
+	res, err := s.db.ExecContext(ctx,
+		`UPDATE messages SET tags = ? WHERE mailbox = ? AND id = ?`, encodeTags(tags), mailbox,
+		rowID)
+	if err != nil {
+		return err
+	}
+	n, err := res.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if n == 0 {
+		return storage.ErrNotExist
+	}
+	return nil
+}
+
+// PurgeMessages deletes all messages in the named mailbox.
+func (s *Store) PurgeMessages(ctx context.Context, mailbox string) error {
+	_, err := s.db.ExecContext(ctx, `DELETE FROM messages WHERE mailbox = ?`, mailbox)
+	return err
+}
+
+// RemoveMessage deletes a message by ID from the specified mailbox.
+func (s *Store) RemoveMessage(ctx context.Context, mailbox, id string) error {
+	rowID, err := strconv.ParseInt(id, 10, 64)
+	if err != nil {
+		return storage.ErrNotExist
+	}
+	res, err := s.db.ExecContext(ctx,
+		`DELETE FROM messages WHERE mailbox = ? AND id = ?`, mailbox, rowID)
+	if err != nil {
+		return err
+	}
+	if n, err := res.RowsAffected(); err == nil && n == 0 {
+		return storage.ErrNotExist
+	}
+	return nil
+}
+
+// VisitMailboxes accepts a function that will be called with the messages in each mailbox while it
+// continues to return true.
+func (s *Store) VisitMailboxes(ctx context.Context, f func([]storage.Message) (cont bool)) error {
+	rows, err := s.db.QueryContext(ctx, `SELECT DISTINCT mailbox FROM messages`)
+	if err != nil {
+		return err
+	}
+	var names []string
+	for rows.Next() {
+		var name string
+		if err := rows.Scan(&name); err != nil {
+			_ = rows.Close()
+			return err
+		}
+		names = append(names, name)
+	}
+	_ = rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+	for _, name := range names {
+		messages, err := s.GetMessages(ctx, name)
+		if err != nil {
+			return err
+		}
+		if !f(messages) {
+			break
+		}
+	}
+	return nil
+}
+
+const selectMessage = `SELECT id, mailbox, "from", "to", subject, date, size, seen, envid, spf,
+	tags FROM messages`
+
+// scanner is implemented by both sql.Row and sql.Rows.
+type scanner interface {
+	Scan(dest ...interface{}) error
+}
+
+// scanMessage builds a Message from a row selected with selectMessage.
+func (s *Store) scanMessage(row scanner) (*Message, error) {
+	var (
+		from, to, tags string
+		date           int64
+	)
+	m := &Message{store: s}
+	err := row.Scan(&m.rowID, &m.mailbox, &from, &to, &m.subject, &date, &m.size, &m.seen,
+		&m.envid, &m.spf, &tags)
+	if err != nil {
+		return nil, err
+	}
+	m.date = time.Unix(0, date)
+	m.tags = decodeTags(tags)
+	if from != "" {
+		if m.from, err = mail.ParseAddress(from); err != nil {
+			m.from = &mail.Address{Address: from}
+		}
+	}
+	if to != "" {
+		if m.to, err = mail.ParseAddressList(to); err != nil {
+			m.to = []*mail.Address{{Address: to}}
+		}
+	}
+	return m, nil
+}
+
+// encodeTags returns tags as a JSON array, or an empty string if there are none.
+func encodeTags(tags []string) string {
+	if len(tags) == 0 {
+		return ""
+	}
+	b, _ := json.Marshal(tags)
+	return string(b)
+}
+
+// decodeTags parses tags encoded by encodeTags.
+func decodeTags(s string) []string {
+	var tags []string
+	if s != "" {
+		_ = json.Unmarshal([]byte(s), &tags)
+	}
+	return tags
+}
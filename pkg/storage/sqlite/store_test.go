@@ -0,0 +1,137 @@
+package sqlite
+
+import (
+	"context"
+	"database/sql"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/inbucket/inbucket/pkg/config"
+	"github.com/inbucket/inbucket/pkg/message"
+	"github.com/inbucket/inbucket/pkg/storage"
+	"github.com/inbucket/inbucket/pkg/test"
+)
+
+// TestSuite runs storage package test suite on sqlite store.
+func TestSuite(t *testing.T) {
+	test.StoreSuite(t, func(conf config.Storage) (storage.Store, func(), error) {
+		s, destroy := setupStore(t, conf)
+		return s, destroy, nil
+	})
+}
+
+// TestWALMode verifies the database is opened in write-ahead log mode.
+func TestWALMode(t *testing.T) {
+	s, destroy := setupStore(t, config.Storage{})
+	defer destroy()
+	var mode string
+	if err := s.db.QueryRow("PRAGMA journal_mode").Scan(&mode); err != nil {
+		t.Fatal(err)
+	}
+	if mode != "wal" {
+		t.Errorf("got journal_mode %q, want: %q", mode, "wal")
+	}
+}
+
+// TestMigrate verifies databases created before the envid column was added can be opened, and
+// reopened.
+func TestMigrate(t *testing.T) {
+	dir, err := ioutil.TempDir("", "inbucket")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "inbucket.db")
+	db, err := sql.Open("sqlite3", "file:"+path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = db.Exec(`CREATE TABLE messages (
+		id      INTEGER PRIMARY KEY AUTOINCREMENT,
+		mailbox TEXT    NOT NULL,
+		"from"  TEXT    NOT NULL,
+		"to"    TEXT    NOT NULL,
+		subject TEXT    NOT NULL,
+		date    INTEGER NOT NULL,
+		size    INTEGER NOT NULL,
+		seen    INTEGER NOT NULL DEFAULT 0
+	)`)
+	_ = db.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg := config.Storage{Params: map[string]string{"path": path}}
+	for i := 0; i < 2; i++ {
+		s, err := New(cfg)
+		if err != nil {
+			t.Fatal(err)
+		}
+		test.DeliverToStore(t, s, "box", "migrated", time.Now())
+		_ = s.(*Store).Close()
+	}
+}
+
+// TestMissingPath verifies a path parameter is required.
+// TestImportMessage verifies positive integer IDs not already in use are kept by ImportMessage.
+func TestImportMessage(t *testing.T) {
+	s, destroy := setupStore(t, config.Storage{})
+	defer destroy()
+	for _, tc := range []struct {
+		id   string
+		want string
+	}{
+		{"42", "42"},
+		{"7", "7"},
+		{"42", "43"},
+		{"0", "44"},
+		{"20210102T030405-0001", "45"},
+	} {
+		id, err := s.ImportMessage(context.Background(), &message.Delivery{
+			Meta:   message.Metadata{Mailbox: "box", ID: tc.id, Date: time.Now()},
+			Reader: strings.NewReader("Subject: import\r\n\r\nbody\r\n"),
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if id != tc.want {
+			t.Errorf("imported ID %q got %q, want %q", tc.id, id, tc.want)
+		}
+	}
+	msgs, err := s.GetMessages(context.Background(), "box")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(msgs) != 5 || msgs[0].ID() != "7" {
+		t.Errorf("got %v messages, first %q, want 5, first \"7\"", len(msgs), msgs[0].ID())
+	}
+}
+
+func TestMissingPath(t *testing.T) {
+	_, err := New(config.Storage{})
+	if err == nil {
+		t.Error("got nil error, wanted error for missing path")
+	}
+}
+
+// setupStore creates a new Store in a temporary directory.
+func setupStore(t *testing.T, cfg config.Storage) (*Store, func()) {
+	t.Helper()
+	dir, err := ioutil.TempDir("", "inbucket")
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg.Params = map[string]string{"path": filepath.Join(dir, "inbucket.db")}
+	s, err := New(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	destroy := func() {
+		_ = s.(*Store).Close()
+		_ = os.RemoveAll(dir)
+	}
+	return s.(*Store), destroy
+}
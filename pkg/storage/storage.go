@@ -2,6 +2,7 @@
 package storage
 
 import (
+	"context"
 	"errors"
 	"fmt"
 	"io"
@@ -9,6 +10,7 @@ import (
 	"time"
 
 	"github.com/inbucket/inbucket/pkg/config"
+	"github.com/inbucket/inbucket/pkg/dkim"
 )
 
 var (
@@ -18,20 +20,169 @@ var (
 	// ErrNotWritable indicates the message is closed; no longer writable
 	ErrNotWritable = errors.New("Message not writable")
 
+	// ErrMailboxFull indicates the mailbox is at its message cap, and the overflow policy is
+	// reject.
+	ErrMailboxFull = errors.New("mailbox is full")
+
+	// ErrQuotaExceeded indicates storing the message would take the mailbox over its quota of
+	// bytes.
+	ErrQuotaExceeded = errors.New("mailbox quota exceeded")
+
+	// ErrReadOnly indicates the store is a replica, changes must be made on the primary.
+	ErrReadOnly = errors.New("store is read-only")
+
 	// Constructors tracks registered storage constructors
 	Constructors = make(map[string]func(config.Storage) (Store, error))
 )
 
-// Store is the interface Inbucket uses to interact with storage implementations.
+// Store is the interface Inbucket uses to interact with storage implementations.  Each method
+// returns the context error if ctx is canceled before the operation completes.
 type Store interface {
-	// AddMessage stores the message, message ID and Size will be ignored.
-	AddMessage(message Message) (id string, err error)
-	GetMessage(mailbox, id string) (Message, error)
-	GetMessages(mailbox string) ([]Message, error)
-	MarkSeen(mailbox, id string) error
-	PurgeMessages(mailbox string) error
-	RemoveMessage(mailbox, id string) error
-	VisitMailboxes(f func([]Message) (cont bool)) error
+	// AddMessage stores the message, message ID and Size will be ignored.  If the mailbox is at
+	// its message cap, the configured config.OverflowPolicy is applied; ErrMailboxFull is returned
+	// by reject, and drop-newest discards the message and returns an empty ID.
+	AddMessage(ctx context.Context, message Message) (id string, err error)
+	GetMessage(ctx context.Context, mailbox, id string) (Message, error)
+	GetMessages(ctx context.Context, mailbox string) ([]Message, error)
+	MarkSeen(ctx context.Context, mailbox, id string) error
+	MarkUnseen(ctx context.Context, mailbox, id string) error
+	// SetTags replaces the tags of the specified message, returning ErrNotExist if it is not
+	// present.
+	SetTags(ctx context.Context, mailbox, id string, tags []string) error
+	PurgeMessages(ctx context.Context, mailbox string) error
+	RemoveMessage(ctx context.Context, mailbox, id string) error
+	VisitMailboxes(ctx context.Context, f func([]Message) (cont bool)) error
+}
+
+// PathStore is implemented by stores which keep messages in a local directory.
+type PathStore interface {
+	// MailPath returns the directory messages are stored in.
+	MailPath() string
+}
+
+// Importer is implemented by stores which can add a message while keeping its existing ID.
+type Importer interface {
+	// ImportMessage stores the message like AddMessage, but keeps the ID of the message if it is
+	// valid for this store and not already in use, otherwise a new ID is assigned.
+	ImportMessage(ctx context.Context, message Message) (id string, err error)
+}
+
+// MailboxChecker is implemented by stores which can check for a mailbox more cheaply than by
+// listing its messages.
+type MailboxChecker interface {
+	// MailboxExists returns true if the named mailbox contains any messages.
+	MailboxExists(ctx context.Context, mailbox string) (bool, error)
+}
+
+// MailboxExists returns true if the named mailbox in store contains any messages, using the
+// MailboxChecker implementation of store if available.
+func MailboxExists(ctx context.Context, store Store, mailbox string) (bool, error) {
+	if c, ok := store.(MailboxChecker); ok {
+		return c.MailboxExists(ctx, mailbox)
+	}
+	messages, err := store.GetMessages(ctx, mailbox)
+	return len(messages) > 0, err
+}
+
+// Syncer is implemented by stores which buffer writes, and can flush them to disk on request.
+type Syncer interface {
+	// Sync flushes pending writes to disk.
+	Sync() error
+}
+
+// Sync flushes pending writes of store to disk if it implements Syncer, other stores persist
+// each write before returning.
+func Sync(store Store) error {
+	if s, ok := store.(Syncer); ok {
+		return s.Sync()
+	}
+	return nil
+}
+
+// LatestVisitor is implemented by stores which can read the latest message of each mailbox
+// without loading the rest of its messages.
+type LatestVisitor interface {
+	// VisitLatestMessages calls f with the latest message of each non-empty mailbox, until f
+	// returns false.
+	VisitLatestMessages(ctx context.Context, f func(latest Message) (cont bool)) error
+}
+
+// VisitLatestMessages calls f with the latest message of each non-empty mailbox in store, until f
+// returns false.  Stores which do not implement LatestVisitor are visited with VisitMailboxes.
+func VisitLatestMessages(
+	ctx context.Context, store Store, f func(latest Message) (cont bool)) error {
+	if lv, ok := store.(LatestVisitor); ok {
+		return lv.VisitLatestMessages(ctx, f)
+	}
+	return store.VisitMailboxes(ctx, func(messages []Message) bool {
+		if len(messages) == 0 {
+			return true
+		}
+		return f(messages[len(messages)-1])
+	})
+}
+
+// Pager is implemented by stores which can list a page of a mailbox without holding all of its
+// messages in memory.
+type Pager interface {
+	// PageMessages returns up to limit messages accepted by match, or all of them if match is nil,
+	// which follow the message with ID after in mailbox order.  more is true if further matching
+	// messages follow the page.  ErrNotExist is returned if after is not empty and does not name
+	// a message in the mailbox.
+	PageMessages(ctx context.Context, mailbox, after string, limit int,
+		match func(Message) bool) (messages []Message, more bool, err error)
+}
+
+// PageMessages returns a page of messages from the named mailbox in store, using the Pager
+// implementation of store if available, see Pager.PageMessages.
+func PageMessages(ctx context.Context, store Store, mailbox, after string, limit int,
+	match func(Message) bool) (messages []Message, more bool, err error) {
+	if p, ok := store.(Pager); ok {
+		return p.PageMessages(ctx, mailbox, after, limit, match)
+	}
+	all, err := store.GetMessages(ctx, mailbox)
+	if err != nil {
+		return nil, false, err
+	}
+	page := NewPage(after, limit, match)
+	for _, m := range all {
+		if !page.Visit(m) {
+			break
+		}
+	}
+	return page.Result()
+}
+
+// DKIMRecorder is implemented by stores which can record the result of verifying the DKIM
+// signature of a message after it has been added.
+type DKIMRecorder interface {
+	// SetDKIM records the DKIM result and signing domain of the specified message.
+	SetDKIM(ctx context.Context, mailbox, id string, result dkim.Result, domain string) error
+}
+
+// DKIMMessage is implemented by messages from stores which implement DKIMRecorder.
+type DKIMMessage interface {
+	// DKIM returns the recorded DKIM result and signing domain, the zero Result if the message
+	// has not been verified.
+	DKIM() (result dkim.Result, domain string)
+}
+
+// ReceivedMessage is implemented by messages from stores which record when a message was added,
+// independent of its Date.
+type ReceivedMessage interface {
+	// ReceivedAt returns the time the message was added to the store.
+	ReceivedAt() time.Time
+}
+
+// ReceivedAt returns the time m was added to its store, or its Date if the store does not
+// implement ReceivedMessage.
+func ReceivedAt(m Message) time.Time {
+	if rm, ok := m.(ReceivedMessage); ok {
+		if t := rm.ReceivedAt(); !t.IsZero() {
+			return t
+		}
+	}
+	return m.Date()
 }
 
 // Message represents a message to be stored, or returned from a storage implementation.
@@ -45,12 +196,20 @@ type Message interface {
 	Source() (io.ReadCloser, error)
 	Size() int64
 	Seen() bool
+	EnvelopeID() string
+	SPFResult() string
+	Tags() []string
 }
 
-// FromConfig creates an instance of the Store based on the provided configuration.
+// FromConfig creates an instance of the Store based on the provided configuration.  If additional
+// stores are configured, a MultiStore routing mailboxes between them is returned.
 func FromConfig(c config.Storage) (store Store, err error) {
-	if cf := Constructors[c.Type]; cf != nil {
-		return cf(c)
+	cf := Constructors[c.Type]
+	if cf == nil {
+		return nil, fmt.Errorf("unknown storage type configured: %q", c.Type)
+	}
+	if store, err = cf(c); err != nil || len(c.Stores) == 0 {
+		return store, err
 	}
-	return nil, fmt.Errorf("unknown storage type configured: %q", c.Type)
+	return multiFromConfig(c, store)
 }
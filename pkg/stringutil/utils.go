@@ -4,8 +4,11 @@ import (
 	"crypto/sha1"
 	"fmt"
 	"io"
+	"mime"
 	"net/mail"
 	"strings"
+
+	"golang.org/x/net/html/charset"
 )
 
 // HashMailboxName accepts a mailbox name and hashes it.  filestore uses this as
@@ -74,3 +77,19 @@ func MakePathPrefixer(prefix string) func(string) string {
 		return prefix + path
 	}
 }
+
+// headerDecoder decodes RFC 2047 encoded words in any charset known to golang.org/x/net.
+var headerDecoder = &mime.WordDecoder{CharsetReader: charset.NewReaderLabel}
+
+// DecodeHeader decodes RFC 2047 encoded words in a header value.  The value is returned as-is if
+// it cannot be decoded.
+func DecodeHeader(value string) string {
+	if !strings.Contains(value, "=?") {
+		return value
+	}
+	decoded, err := headerDecoder.DecodeHeader(value)
+	if err != nil {
+		return value
+	}
+	return decoded
+}
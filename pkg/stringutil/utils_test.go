@@ -16,6 +16,25 @@ func TestHashMailboxName(t *testing.T) {
 	}
 }
 
+func TestDecodeHeader(t *testing.T) {
+	testCases := []struct {
+		input, want string
+	}{
+		{"plain subject", "plain subject"},
+		{"=?UTF-8?B?Q2Fmw6k=?=", "Café"},
+		{"=?iso-8859-1?q?caf=E9?= menu", "café menu"},
+		{"=?ISO-2022-JP?B?GyRCJUYlOSVIJWEhPCVrGyhC?=", "テストメール"},
+		{"=?unknown-charset?q?abc?=", "=?unknown-charset?q?abc?="},
+		{"=?UTF-8?B?broken", "=?UTF-8?B?broken"},
+	}
+	for _, tc := range testCases {
+		got := stringutil.DecodeHeader(tc.input)
+		if got != tc.want {
+			t.Errorf("DecodeHeader(%q) got %q, want %q", tc.input, got, tc.want)
+		}
+	}
+}
+
 func TestStringAddressList(t *testing.T) {
 	input := []*mail.Address{
 		{Name: "Fred ß. Fish", Address: "fred@fish.org"},
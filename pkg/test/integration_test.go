@@ -15,6 +15,7 @@ import (
 	"github.com/inbucket/inbucket/pkg/message"
 	"github.com/inbucket/inbucket/pkg/msghub"
 	"github.com/inbucket/inbucket/pkg/policy"
+	"github.com/inbucket/inbucket/pkg/pubsub"
 	"github.com/inbucket/inbucket/pkg/rest"
 	"github.com/inbucket/inbucket/pkg/rest/client"
 	"github.com/inbucket/inbucket/pkg/server/smtp"
@@ -167,13 +168,15 @@ func startServer() (func(), error) {
 		rootCancel()
 		return nil, err
 	}
+	broker := pubsub.NewBroker()
+	store = pubsub.NewStore(store, broker)
 	msgHub := msghub.New(rootCtx, conf.Web.MonitorHistory)
 	addrPolicy := &policy.Addressing{Config: conf}
 	mmanager := &message.StoreManager{AddrPolicy: addrPolicy, Store: store, Hub: msgHub}
 	// Start HTTP server.
 	webui.SetupRoutes(web.Router.PathPrefix("/serve/").Subrouter())
 	rest.SetupRoutes(web.Router.PathPrefix("/api/").Subrouter())
-	web.Initialize(conf, shutdownChan, mmanager, msgHub)
+	web.Initialize(conf, shutdownChan, mmanager, msgHub, broker)
 	go web.Start(rootCtx)
 	// Start SMTP server.
 	smtpServer := smtp.NewServer(conf.SMTP, shutdownChan, mmanager, addrPolicy)
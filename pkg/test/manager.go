@@ -1,7 +1,12 @@
 package test
 
 import (
+	"context"
 	"errors"
+	"fmt"
+	"net/mail"
+	"sort"
+	"time"
 
 	"github.com/inbucket/inbucket/pkg/config"
 	"github.com/inbucket/inbucket/pkg/message"
@@ -22,14 +27,19 @@ func NewManager() *ManagerStub {
 	}
 }
 
-// AddMessage adds a message to the specified mailbox.
+// AddMessage adds a message to the specified mailbox.  A zero priority is set to normal, as
+// message.StoreManager reports for stores which do not record it.
 func (m *ManagerStub) AddMessage(mailbox string, msg *message.Message) {
+	if msg.Priority == 0 {
+		msg.Priority = storage.PriorityNormal
+	}
 	messages := m.mailboxes[mailbox]
 	m.mailboxes[mailbox] = append(messages, msg)
 }
 
 // GetMessage gets a message by ID from the specified mailbox.
-func (m *ManagerStub) GetMessage(mailbox, id string) (*message.Message, error) {
+func (m *ManagerStub) GetMessage(
+	ctx context.Context, mailbox, id string) (*message.Message, error) {
 	if mailbox == "messageerr" {
 		return nil, errors.New("internal error")
 	}
@@ -41,8 +51,29 @@ func (m *ManagerStub) GetMessage(mailbox, id string) (*message.Message, error) {
 	return nil, storage.ErrNotExist
 }
 
+// GetMailboxes summarizes all mailboxes, sorted by name.
+func (m *ManagerStub) GetMailboxes(ctx context.Context) ([]*message.MailboxSummary, error) {
+	summaries := make([]*message.MailboxSummary, 0, len(m.mailboxes))
+	for name, messages := range m.mailboxes {
+		summary := &message.MailboxSummary{Name: name}
+		for _, msg := range messages {
+			summary.MessageCount++
+			summary.TotalBytes += msg.Size
+			if msg.Date.After(summary.LatestDate) {
+				summary.LatestDate = msg.Date
+			}
+		}
+		summaries = append(summaries, summary)
+	}
+	sort.Slice(summaries, func(i, j int) bool {
+		return summaries[i].Name < summaries[j].Name
+	})
+	return summaries, nil
+}
+
 // GetMetadata gets all the metadata for the specified mailbox.
-func (m *ManagerStub) GetMetadata(mailbox string) ([]*message.Metadata, error) {
+func (m *ManagerStub) GetMetadata(
+	ctx context.Context, mailbox string) ([]*message.Metadata, error) {
 	if mailbox == "messageserr" {
 		return nil, errors.New("internal error")
 	}
@@ -54,6 +85,53 @@ func (m *ManagerStub) GetMetadata(mailbox string) ([]*message.Metadata, error) {
 	return metas, nil
 }
 
+// GetMetadataPage gets a page of the metadata for the specified mailbox.
+func (m *ManagerStub) GetMetadataPage(ctx context.Context, mailbox, after string, limit int,
+	match func(*message.Metadata) bool) ([]*message.Metadata, string, error) {
+	metas, err := m.GetMetadata(ctx, mailbox)
+	if err != nil {
+		return nil, "", err
+	}
+	started := after == ""
+	var page []*message.Metadata
+	for _, meta := range metas {
+		switch {
+		case !started:
+			started = meta.ID == after
+		case match != nil && !match(meta):
+		case limit > 0 && len(page) >= limit:
+			return page, page[len(page)-1].ID, nil
+		default:
+			page = append(page, meta)
+		}
+	}
+	if !started {
+		return nil, "", storage.ErrNotExist
+	}
+	return page, "", nil
+}
+
+// Import adds a message to the specified mailbox, with a sequential ID.
+func (m *ManagerStub) Import(
+	ctx context.Context, mailbox string, msg *mail.Message, source []byte) (string, error) {
+	if mailbox == "messageerr" {
+		return "", errors.New("internal error")
+	}
+	date, err := msg.Header.Date()
+	if err != nil {
+		date = time.Now()
+	}
+	id := fmt.Sprintf("%04d", len(m.mailboxes[mailbox])+1)
+	m.AddMessage(mailbox, &message.Message{Metadata: message.Metadata{
+		Mailbox: mailbox,
+		ID:      id,
+		Subject: msg.Header.Get("Subject"),
+		Date:    date,
+		Size:    int64(len(source)),
+	}})
+	return id, nil
+}
+
 // MailboxForAddress invokes policy.ParseMailboxName.
 func (m *ManagerStub) MailboxForAddress(address string) (string, error) {
 	addrPolicy := &policy.Addressing{Config: &config.Root{
@@ -63,7 +141,7 @@ func (m *ManagerStub) MailboxForAddress(address string) (string, error) {
 }
 
 // MarkSeen marks a message as having been read.
-func (m *ManagerStub) MarkSeen(mailbox, id string) error {
+func (m *ManagerStub) MarkSeen(ctx context.Context, mailbox, id string) error {
 	if mailbox == "messageerr" {
 		return errors.New("internal error")
 	}
@@ -75,3 +153,57 @@ func (m *ManagerStub) MarkSeen(mailbox, id string) error {
 	}
 	return storage.ErrNotExist
 }
+
+// MarkUnseen marks a message as not having been read.
+func (m *ManagerStub) MarkUnseen(ctx context.Context, mailbox, id string) error {
+	if mailbox == "messageerr" {
+		return errors.New("internal error")
+	}
+	for _, msg := range m.mailboxes[mailbox] {
+		if msg.ID == id {
+			msg.Metadata.Seen = false
+			return nil
+		}
+	}
+	return storage.ErrNotExist
+}
+
+// SetTags replaces the tags of a message.
+func (m *ManagerStub) SetTags(ctx context.Context, mailbox, id string, tags []string) error {
+	if mailbox == "messageerr" {
+		return errors.New("internal error")
+	}
+	for _, msg := range m.mailboxes[mailbox] {
+		if msg.ID == id {
+			msg.Metadata.Tags = tags
+			return nil
+		}
+	}
+	return storage.ErrNotExist
+}
+
+// PurgeMessages removes all messages from the specified mailbox.
+func (m *ManagerStub) PurgeMessages(ctx context.Context, mailbox string) error {
+	if mailbox == "messageserr" {
+		return errors.New("internal error")
+	}
+	delete(m.mailboxes, mailbox)
+	return nil
+}
+
+// VisitMetadata calls f with the metadata of each mailbox, sorted by name, until f returns false.
+func (m *ManagerStub) VisitMetadata(
+	ctx context.Context, f func(messages []*message.Metadata) (cont bool)) error {
+	names := make([]string, 0, len(m.mailboxes))
+	for name := range m.mailboxes {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		metas, _ := m.GetMetadata(ctx, name)
+		if len(metas) > 0 && !f(metas) {
+			break
+		}
+	}
+	return nil
+}
@@ -1,6 +1,7 @@
 package test
 
 import (
+	"context"
 	"errors"
 
 	"github.com/inbucket/inbucket/pkg/storage"
@@ -22,7 +23,7 @@ func NewStore() *StoreStub {
 }
 
 // AddMessage adds a message to the specified mailbox.
-func (s *StoreStub) AddMessage(m storage.Message) (id string, err error) {
+func (s *StoreStub) AddMessage(ctx context.Context, m storage.Message) (id string, err error) {
 	mb := m.Mailbox()
 	msgs := s.mailboxes[mb]
 	s.mailboxes[mb] = append(msgs, m)
@@ -30,7 +31,7 @@ func (s *StoreStub) AddMessage(m storage.Message) (id string, err error) {
 }
 
 // GetMessage gets a message by ID from the specified mailbox.
-func (s *StoreStub) GetMessage(mailbox, id string) (storage.Message, error) {
+func (s *StoreStub) GetMessage(ctx context.Context, mailbox, id string) (storage.Message, error) {
 	if mailbox == "messageerr" {
 		return nil, errors.New("internal error")
 	}
@@ -43,7 +44,7 @@ func (s *StoreStub) GetMessage(mailbox, id string) (storage.Message, error) {
 }
 
 // GetMessages gets all the messages for the specified mailbox.
-func (s *StoreStub) GetMessages(mailbox string) ([]storage.Message, error) {
+func (s *StoreStub) GetMessages(ctx context.Context, mailbox string) ([]storage.Message, error) {
 	if mailbox == "messageserr" {
 		return nil, errors.New("internal error")
 	}
@@ -51,7 +52,7 @@ func (s *StoreStub) GetMessages(mailbox string) ([]storage.Message, error) {
 }
 
 // RemoveMessage deletes a message by ID from the specified mailbox.
-func (s *StoreStub) RemoveMessage(mailbox, id string) error {
+func (s *StoreStub) RemoveMessage(ctx context.Context, mailbox, id string) error {
 	mb, ok := s.mailboxes[mailbox]
 	if ok {
 		var msg storage.Message
@@ -72,7 +73,8 @@ func (s *StoreStub) RemoveMessage(mailbox, id string) error {
 
 // VisitMailboxes accepts a function that will be called with the messages in each mailbox while it
 // continues to return true.
-func (s *StoreStub) VisitMailboxes(f func([]storage.Message) (cont bool)) error {
+func (s *StoreStub) VisitMailboxes(
+	ctx context.Context, f func([]storage.Message) (cont bool)) error {
 	for _, v := range s.mailboxes {
 		if !f(v) {
 			return nil
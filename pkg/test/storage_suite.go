@@ -2,6 +2,7 @@ package test
 
 import (
 	"bytes"
+	"context"
 	"fmt"
 	"io/ioutil"
 	"net/mail"
@@ -31,11 +32,19 @@ func StoreSuite(t *testing.T, factory StoreFactory) {
 		{"naming", testNaming, config.Storage{}},
 		{"size", testSize, config.Storage{}},
 		{"seen", testSeen, config.Storage{}},
+		{"tags", testTags, config.Storage{}},
 		{"delete", testDelete, config.Storage{}},
 		{"purge", testPurge, config.Storage{}},
 		{"cap=10", testMsgCap, config.Storage{MailboxMsgCap: 10}},
 		{"cap=0", testNoMsgCap, config.Storage{MailboxMsgCap: 0}},
+		{"overflow reject", testOverflowReject,
+			config.Storage{MailboxMsgCap: 2, OverflowPolicy: config.OverflowReject}},
+		{"overflow drop-oldest", testOverflowDropOldest,
+			config.Storage{MailboxMsgCap: 2, OverflowPolicy: config.OverflowDropOldest}},
+		{"overflow drop-newest", testOverflowDropNewest,
+			config.Storage{MailboxMsgCap: 2, OverflowPolicy: config.OverflowDropNewest}},
 		{"visit mailboxes", testVisitMailboxes, config.Storage{}},
+		{"canceled", testCanceled, config.Storage{}},
 	}
 	for _, tc := range testCases {
 		t.Run(tc.name, func(t *testing.T) {
@@ -59,20 +68,26 @@ func testMetadata(t *testing.T, store storage.Store) {
 	}
 	date := time.Now()
 	subject := "fantastic test subject line"
+	envid := "QQ314159"
+	spfResult := "softfail"
+	tags := []string{"signup", "run 42"}
 	content := "doesn't matter"
 	delivery := &message.Delivery{
 		Meta: message.Metadata{
 			// ID and Size will be determined by the Store.
-			Mailbox: mailbox,
-			From:    from,
-			To:      to,
-			Date:    date,
-			Subject: subject,
-			Seen:    false,
+			Mailbox:    mailbox,
+			From:       from,
+			To:         to,
+			Date:       date,
+			Subject:    subject,
+			Seen:       false,
+			EnvelopeID: envid,
+			SPFResult:  spfResult,
+			Tags:       tags,
 		},
 		Reader: strings.NewReader(content),
 	}
-	id, err := store.AddMessage(delivery)
+	id, err := store.AddMessage(context.Background(), delivery)
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -80,7 +95,7 @@ func testMetadata(t *testing.T, store storage.Store) {
 		t.Fatal("Expected AddMessage() to return non-empty ID string")
 	}
 	// Retrieve and validate the message.
-	sm, err := store.GetMessage(mailbox, id)
+	sm, err := store.GetMessage(context.Background(), mailbox, id)
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -114,6 +129,15 @@ func testMetadata(t *testing.T, store storage.Store) {
 	if sm.Seen() {
 		t.Errorf("got seen %v, want: false", sm.Seen())
 	}
+	if sm.EnvelopeID() != envid {
+		t.Errorf("got envelope ID %q, want: %q", sm.EnvelopeID(), envid)
+	}
+	if sm.SPFResult() != spfResult {
+		t.Errorf("got SPF result %q, want: %q", sm.SPFResult(), spfResult)
+	}
+	if fmt.Sprint(sm.Tags()) != fmt.Sprint(tags) {
+		t.Errorf("got tags %q, want: %q", sm.Tags(), tags)
+	}
 }
 
 // testContent generates some binary content and makes sure it is correctly retrieved.
@@ -140,12 +164,12 @@ func testContent(t *testing.T, store storage.Store) {
 		},
 		Reader: bytes.NewReader(content),
 	}
-	id, err := store.AddMessage(delivery)
+	id, err := store.AddMessage(context.Background(), delivery)
 	if err != nil {
 		t.Fatal(err)
 	}
 	// Get and check.
-	m, err := store.GetMessage(mailbox, id)
+	m, err := store.GetMessage(context.Background(), mailbox, id)
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -202,7 +226,7 @@ func testLatest(t *testing.T, store storage.Store) {
 		DeliverToStore(t, store, mailbox, subj, time.Now())
 	}
 	// Confirm latest.
-	latest, err := store.GetMessage(mailbox, "latest")
+	latest, err := store.GetMessage(context.Background(), mailbox, "latest")
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -235,7 +259,7 @@ func testSize(t *testing.T, store storage.Store) {
 		sentSizes[i] = size
 	}
 	for i, id := range sentIds {
-		msg, err := store.GetMessage(mailbox, id)
+		msg, err := store.GetMessage(context.Background(), mailbox, id)
 		if err != nil {
 			t.Fatal(err)
 		}
@@ -247,13 +271,13 @@ func testSize(t *testing.T, store storage.Store) {
 	}
 }
 
-// testSeen verifies a message can be marked as seen.
+// testSeen verifies a message can be marked as seen, and unseen again.
 func testSeen(t *testing.T, store storage.Store) {
 	mailbox := "lisa"
 	id1, _ := DeliverToStore(t, store, mailbox, "whatever", time.Now())
 	id2, _ := DeliverToStore(t, store, mailbox, "hello?", time.Now())
 	// Confirm unseen.
-	msg, err := store.GetMessage(mailbox, id1)
+	msg, err := store.GetMessage(context.Background(), mailbox, id1)
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -261,12 +285,12 @@ func testSeen(t *testing.T, store storage.Store) {
 		t.Errorf("got seen %v, want: false", msg.Seen())
 	}
 	// Mark id1 seen.
-	err = store.MarkSeen(mailbox, id1)
+	err = store.MarkSeen(context.Background(), mailbox, id1)
 	if err != nil {
 		t.Fatal(err)
 	}
 	// Verify id1 seen.
-	msg, err = store.GetMessage(mailbox, id1)
+	msg, err = store.GetMessage(context.Background(), mailbox, id1)
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -274,13 +298,64 @@ func testSeen(t *testing.T, store storage.Store) {
 		t.Errorf("id1 got seen %v, want: true", msg.Seen())
 	}
 	// Verify id2 still unseen.
-	msg, err = store.GetMessage(mailbox, id2)
+	msg, err = store.GetMessage(context.Background(), mailbox, id2)
 	if err != nil {
 		t.Fatal(err)
 	}
 	if msg.Seen() {
 		t.Errorf("id2 got seen %v, want: false", msg.Seen())
 	}
+	// Mark id1 unseen again.
+	err = store.MarkUnseen(context.Background(), mailbox, id1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	msg, err = store.GetMessage(context.Background(), mailbox, id1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if msg.Seen() {
+		t.Errorf("id1 got seen %v after MarkUnseen, want: false", msg.Seen())
+	}
+}
+
+// testTags replaces the tags of a message.
+func testTags(t *testing.T, store storage.Store) {
+	mailbox := "tagged"
+	id1, _ := DeliverToStore(t, store, mailbox, "alpha", time.Now())
+	id2, _ := DeliverToStore(t, store, mailbox, "bravo", time.Now())
+	checkTags := func(id string, want ...string) {
+		t.Helper()
+		msg, err := store.GetMessage(context.Background(), mailbox, id)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if fmt.Sprint(msg.Tags()) != fmt.Sprint(want) {
+			t.Errorf("got tags %q for %v, want: %q", msg.Tags(), id, want)
+		}
+	}
+	checkTags(id1)
+	tags := []string{"one", "two, three"}
+	if err := store.SetTags(context.Background(), mailbox, id1, tags); err != nil {
+		t.Fatal(err)
+	}
+	tags[0] = "modified after SetTags"
+	checkTags(id1, "one", "two, three")
+	checkTags(id2)
+	// Tags are replaced, not merged.
+	if err := store.SetTags(context.Background(), mailbox, id1, []string{"four"}); err != nil {
+		t.Fatal(err)
+	}
+	checkTags(id1, "four")
+	if err := store.SetTags(context.Background(), mailbox, id1, nil); err != nil {
+		t.Fatal(err)
+	}
+	checkTags(id1)
+	// Missing messages are reported.
+	if err := store.SetTags(context.Background(), mailbox, id2+"0", []string{"x"}); err !=
+		storage.ErrNotExist {
+		t.Errorf("got error %v for missing message, want: %v", err, storage.ErrNotExist)
+	}
 }
 
 // testDelete creates and deletes some messages.
@@ -292,11 +367,11 @@ func testDelete(t *testing.T, store storage.Store) {
 	}
 	msgs := GetAndCountMessages(t, store, mailbox, len(subjects))
 	// Delete a couple messages.
-	err := store.RemoveMessage(mailbox, msgs[1].ID())
+	err := store.RemoveMessage(context.Background(), mailbox, msgs[1].ID())
 	if err != nil {
 		t.Fatal(err)
 	}
-	err = store.RemoveMessage(mailbox, msgs[3].ID())
+	err = store.RemoveMessage(context.Background(), mailbox, msgs[3].ID())
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -330,7 +405,7 @@ func testPurge(t *testing.T, store storage.Store) {
 	}
 	GetAndCountMessages(t, store, mailbox, len(subjects))
 	// Purge and verify.
-	err := store.PurgeMessages(mailbox)
+	err := store.PurgeMessages(context.Background(), mailbox)
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -344,7 +419,7 @@ func testMsgCap(t *testing.T, store storage.Store) {
 	for i := 0; i < 20; i++ {
 		subj := fmt.Sprintf("subject %v", i)
 		DeliverToStore(t, store, mailbox, subj, time.Now())
-		msgs, err := store.GetMessages(mailbox)
+		msgs, err := store.GetMessages(context.Background(), mailbox)
 		if err != nil {
 			t.Fatalf("Failed to GetMessages for %q: %v", mailbox, err)
 		}
@@ -374,6 +449,62 @@ func testNoMsgCap(t *testing.T, store storage.Store) {
 	}
 }
 
+// testOverflowReject verifies messages delivered to a full mailbox are rejected.
+func testOverflowReject(t *testing.T, store storage.Store) {
+	mailbox := "captain"
+	DeliverToStore(t, store, mailbox, "subject 0", time.Now())
+	DeliverToStore(t, store, mailbox, "subject 1", time.Now())
+	delivery := &message.Delivery{
+		Meta: message.Metadata{
+			Mailbox: mailbox,
+			To:      []*mail.Address{{Name: "Some Body", Address: "somebody@host"}},
+			From:    &mail.Address{Name: "Some B. Else", Address: "somebodyelse@host"},
+			Subject: "subject 2",
+			Date:    time.Now(),
+		},
+		Reader: ioutil.NopCloser(strings.NewReader("Subject: subject 2\r\n\r\nbody\r\n")),
+	}
+	if _, err := store.AddMessage(context.Background(), delivery); err != storage.ErrMailboxFull {
+		t.Errorf("got err %v, want: %v", err, storage.ErrMailboxFull)
+	}
+	checkSubjects(t, store, mailbox, "subject 0", "subject 1")
+}
+
+// testOverflowDropOldest verifies the oldest message is deleted to make room for new messages.
+func testOverflowDropOldest(t *testing.T, store storage.Store) {
+	mailbox := "captain"
+	for i := 0; i < 4; i++ {
+		DeliverToStore(t, store, mailbox, fmt.Sprintf("subject %v", i), time.Now())
+	}
+	checkSubjects(t, store, mailbox, "subject 2", "subject 3")
+}
+
+// testOverflowDropNewest verifies messages delivered to a full mailbox are discarded.
+func testOverflowDropNewest(t *testing.T, store storage.Store) {
+	mailbox := "captain"
+	for i := 0; i < 4; i++ {
+		DeliverToStore(t, store, mailbox, fmt.Sprintf("subject %v", i), time.Now())
+	}
+	checkSubjects(t, store, mailbox, "subject 0", "subject 1")
+}
+
+// checkSubjects verifies the mailbox contains messages with the specified subjects, in order.
+func checkSubjects(t *testing.T, store storage.Store, mailbox string, subjects ...string) {
+	t.Helper()
+	msgs := GetAndCountMessages(t, store, mailbox, len(subjects))
+	for i, m := range msgs {
+		if m.Subject() != subjects[i] {
+			t.Errorf("got subject %q at %v, want: %q", m.Subject(), i, subjects[i])
+		}
+		r, err := m.Source()
+		if err != nil {
+			t.Errorf("message %v source: %v", m.ID(), err)
+			continue
+		}
+		_ = r.Close()
+	}
+}
+
 // testVisitMailboxes creates some mailboxes and confirms the VisitMailboxes method visits all of
 // them.
 func testVisitMailboxes(t *testing.T, ds storage.Store) {
@@ -383,7 +514,7 @@ func testVisitMailboxes(t *testing.T, ds storage.Store) {
 		DeliverToStore(t, ds, name, "New Message", time.Now())
 	}
 	seen := 0
-	err := ds.VisitMailboxes(func(messages []storage.Message) bool {
+	err := ds.VisitMailboxes(context.Background(), func(messages []storage.Message) bool {
 		seen++
 		count := len(messages)
 		if count != 2 {
@@ -399,6 +530,50 @@ func testVisitMailboxes(t *testing.T, ds storage.Store) {
 	}
 }
 
+// testCanceled verifies each method returns context.Canceled, without modifying the store, once
+// the context is canceled.
+func testCanceled(t *testing.T, ds storage.Store) {
+	id, _ := DeliverToStore(t, ds, "box", "subject", time.Now())
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	delivery := &message.Delivery{
+		Meta:   message.Metadata{Mailbox: "box", Date: time.Now()},
+		Reader: strings.NewReader("Subject: canceled\r\n\r\nbody\r\n"),
+	}
+	_, err := ds.AddMessage(ctx, delivery)
+	checkCanceled(t, "AddMessage", err)
+	_, err = ds.GetMessage(ctx, "box", id)
+	checkCanceled(t, "GetMessage", err)
+	_, err = ds.GetMessages(ctx, "box")
+	checkCanceled(t, "GetMessages", err)
+	checkCanceled(t, "MarkSeen", ds.MarkSeen(ctx, "box", id))
+	checkCanceled(t, "MarkUnseen", ds.MarkUnseen(ctx, "box", id))
+	checkCanceled(t, "SetTags", ds.SetTags(ctx, "box", id, []string{"canceled"}))
+	checkCanceled(t, "RemoveMessage", ds.RemoveMessage(ctx, "box", id))
+	checkCanceled(t, "PurgeMessages", ds.PurgeMessages(ctx, "box"))
+	visits := 0
+	err = ds.VisitMailboxes(ctx, func([]storage.Message) bool {
+		visits++
+		return true
+	})
+	checkCanceled(t, "VisitMailboxes", err)
+	if visits != 0 {
+		t.Errorf("VisitMailboxes visited %v mailboxes, want 0", visits)
+	}
+	msgs := GetAndCountMessages(t, ds, "box", 1)
+	if len(msgs) == 1 && msgs[0].Seen() {
+		t.Error("message was marked seen")
+	}
+}
+
+// checkCanceled reports an error if err is not context.Canceled.
+func checkCanceled(t *testing.T, method string, err error) {
+	t.Helper()
+	if err != context.Canceled {
+		t.Errorf("%v got error %v, want: %v", method, err, context.Canceled)
+	}
+}
+
 // DeliverToStore creates and delivers a message to the specific mailbox, returning the size of the
 // generated message.
 func DeliverToStore(
@@ -422,7 +597,7 @@ func DeliverToStore(
 		Meta:   meta,
 		Reader: ioutil.NopCloser(strings.NewReader(testMsg)),
 	}
-	id, err := store.AddMessage(delivery)
+	id, err := store.AddMessage(context.Background(), delivery)
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -433,7 +608,7 @@ func DeliverToStore(
 // also checks return error.
 func GetAndCountMessages(t *testing.T, s storage.Store, mailbox string, count int) []storage.Message {
 	t.Helper()
-	msgs, err := s.GetMessages(mailbox)
+	msgs, err := s.GetMessages(context.Background(), mailbox)
 	if err != nil {
 		t.Fatalf("Failed to GetMessages for %q: %v", mailbox, err)
 	}
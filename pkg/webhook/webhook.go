@@ -0,0 +1,170 @@
+// Package webhook notifies an HTTP endpoint as new messages are delivered.
+package webhook
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"expvar"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"time"
+
+	"github.com/inbucket/inbucket/pkg/config"
+	"github.com/inbucket/inbucket/pkg/msghub"
+	"github.com/inbucket/inbucket/pkg/rest/model"
+	"github.com/rs/zerolog/log"
+)
+
+const (
+	// SignatureHeader contains the hex encoded HMAC-SHA256 of the request body.
+	SignatureHeader = "X-Inbucket-Signature"
+
+	// Maximum number of notifications waiting to be sent.
+	queueLen = 100
+
+	// Number of times a failed notification will be retried.
+	maxRetries = 3
+)
+
+var (
+	expDeliveredTotal = new(expvar.Int)
+	expFailedTotal    = new(expvar.Int)
+	expDroppedTotal   = new(expvar.Int)
+)
+
+func init() {
+	m := expvar.NewMap("webhook")
+	m.Set("DeliveredTotal", expDeliveredTotal)
+	m.Set("FailedTotal", expFailedTotal)
+	m.Set("DroppedTotal", expDroppedTotal)
+}
+
+// Notifier is a msghub.Listener that POSTs a JSON description of each new message to the
+// configured URL.  The URL and secret are read from the current configuration for each request, so
+// they may be reloaded while the Notifier is running.
+type Notifier struct {
+	conf    *config.Current
+	client  *http.Client
+	queue   chan msghub.Message
+	backoff time.Duration // Delay before the first retry, doubled for each subsequent retry.
+}
+
+// New creates a Notifier for the provided configuration.
+func New(conf *config.Current) *Notifier {
+	return &Notifier{
+		conf:    conf,
+		client:  &http.Client{Timeout: conf.Get().Webhook.Timeout},
+		queue:   make(chan msghub.Message, queueLen),
+		backoff: time.Second,
+	}
+}
+
+// Start registers the Notifier with the hub, then sends notifications until the context is
+// canceled.
+func (n *Notifier) Start(ctx context.Context, hub *msghub.Hub) {
+	log.Info().Str("phase", "startup").Str("module", "webhook").Str("url", n.conf.Get().Webhook.URL).
+		Msg("Webhook notifications enabled")
+	hub.AddListener(n)
+	go n.run(ctx)
+}
+
+// Receive queues a message notification, it will be dropped if the queue is full.
+func (n *Notifier) Receive(msg msghub.Message) error {
+	select {
+	case n.queue <- msg:
+	default:
+		expDroppedTotal.Add(1)
+		log.Warn().Str("module", "webhook").Str("mailbox", msg.Mailbox).Str("id", msg.ID).
+			Msg("Webhook queue full, dropped notification")
+	}
+	return nil
+}
+
+// run sends queued notifications until the context is canceled.
+func (n *Notifier) run(ctx context.Context) {
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case msg := <-n.queue:
+			n.deliver(ctx, msg)
+		}
+	}
+}
+
+// deliver sends a notification, retrying with exponential back-off.
+func (n *Notifier) deliver(ctx context.Context, msg msghub.Message) {
+	slog := log.With().Str("module", "webhook").Str("mailbox", msg.Mailbox).
+		Str("id", msg.ID).Logger()
+	body, err := json.Marshal(&model.JSONMessageHeaderV1{
+		Mailbox:     msg.Mailbox,
+		ID:          msg.ID,
+		From:        msg.From,
+		To:          msg.To,
+		Subject:     msg.Subject,
+		Date:        msg.Date,
+		PosixMillis: msg.Date.UnixNano() / 1000000,
+		Size:        msg.Size,
+	})
+	if err != nil {
+		slog.Error().Err(err).Msg("Failed to encode webhook payload")
+		return
+	}
+	delay := n.backoff
+	for attempt := 0; ; attempt++ {
+		err = n.post(ctx, body)
+		if err == nil {
+			expDeliveredTotal.Add(1)
+			return
+		}
+		if attempt == maxRetries {
+			break
+		}
+		slog.Debug().Err(err).Msgf("Webhook delivery failed, retrying in %v", delay)
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(delay):
+		}
+		delay *= 2
+	}
+	expFailedTotal.Add(1)
+	slog.Warn().Err(err).Msg("Webhook delivery failed")
+}
+
+// post makes a single delivery attempt.
+func (n *Notifier) post(ctx context.Context, body []byte) error {
+	cfg := n.conf.Get().Webhook
+	req, err := http.NewRequest("POST", cfg.URL, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req = req.WithContext(ctx)
+	req.Header.Set("Content-Type", "application/json")
+	if cfg.Secret != "" {
+		req.Header.Set(SignatureHeader, Sign([]byte(cfg.Secret), body))
+	}
+	resp, err := n.client.Do(req)
+	if err != nil {
+		return err
+	}
+	_, _ = io.Copy(ioutil.Discard, resp.Body)
+	_ = resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("webhook returned status %v", resp.Status)
+	}
+	return nil
+}
+
+// Sign returns the hex encoded HMAC-SHA256 of body using secret, as sent in SignatureHeader.
+func Sign(secret, body []byte) string {
+	mac := hmac.New(sha256.New, secret)
+	_, _ = mac.Write(body)
+	return hex.EncodeToString(mac.Sum(nil))
+}
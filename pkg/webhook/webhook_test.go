@@ -0,0 +1,144 @@
+package webhook
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/inbucket/inbucket/pkg/config"
+	"github.com/inbucket/inbucket/pkg/msghub"
+)
+
+type request struct {
+	header http.Header
+	body   []byte
+}
+
+// setupServer starts an HTTP server which fails the first failures requests, and records the
+// rest.
+func setupServer(t *testing.T, failures int32) (*httptest.Server, chan request, *int32) {
+	t.Helper()
+	reqs := make(chan request, 10)
+	var count int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if atomic.AddInt32(&count, 1) <= failures {
+			http.Error(w, "unavailable", http.StatusServiceUnavailable)
+			return
+		}
+		body, _ := ioutil.ReadAll(req.Body)
+		reqs <- request{header: req.Header, body: body}
+	}))
+	t.Cleanup(srv.Close)
+	return srv, reqs, &count
+}
+
+func startNotifier(t *testing.T, cfg config.Webhook) *msghub.Hub {
+	t.Helper()
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(cancel)
+	hub := msghub.New(ctx, 0)
+	n := New(config.NewCurrent(&config.Root{Webhook: cfg}, nil))
+	n.backoff = time.Millisecond
+	n.Start(ctx, hub)
+	hub.Sync()
+	return hub
+}
+
+func waitRequest(t *testing.T, reqs chan request) request {
+	t.Helper()
+	select {
+	case r := <-reqs:
+		return r
+	case <-time.After(5 * time.Second):
+		t.Fatal("Timeout waiting for webhook request")
+	}
+	return request{}
+}
+
+func TestPayload(t *testing.T) {
+	srv, reqs, _ := setupServer(t, 0)
+	hub := startNotifier(t, config.Webhook{URL: srv.URL, Secret: "s3cret", Timeout: time.Second})
+	date := time.Date(2012, 2, 1, 10, 11, 12, 253, time.UTC)
+	hub.Dispatch(msghub.Message{
+		Mailbox: "box",
+		ID:      "0001",
+		From:    "<from@host>",
+		To:      []string{"<to@host>"},
+		Subject: "subject",
+		Date:    date,
+		Size:    42,
+	})
+	r := waitRequest(t, reqs)
+
+	if got := r.header.Get("Content-Type"); got != "application/json" {
+		t.Errorf("got Content-Type %q, want: %q", got, "application/json")
+	}
+	want := Sign([]byte("s3cret"), r.body)
+	if got := r.header.Get(SignatureHeader); got != want {
+		t.Errorf("got signature %q, want: %q", got, want)
+	}
+	var payload map[string]interface{}
+	if err := json.Unmarshal(r.body, &payload); err != nil {
+		t.Fatal(err)
+	}
+	for k, want := range map[string]interface{}{
+		"mailbox":      "box",
+		"id":           "0001",
+		"from":         "<from@host>",
+		"subject":      "subject",
+		"date":         "2012-02-01T10:11:12.000000253Z",
+		"posix-millis": float64(1328091072000),
+		"size":         float64(42),
+	} {
+		if got := payload[k]; got != want {
+			t.Errorf("got %v %v, want: %v", k, got, want)
+		}
+	}
+	if to, ok := payload["to"].([]interface{}); !ok || len(to) != 1 || to[0] != "<to@host>" {
+		t.Errorf("got to %v, want: [<to@host>]", payload["to"])
+	}
+}
+
+func TestNoSecret(t *testing.T) {
+	srv, reqs, _ := setupServer(t, 0)
+	hub := startNotifier(t, config.Webhook{URL: srv.URL, Timeout: time.Second})
+	hub.Dispatch(msghub.Message{Mailbox: "box", ID: "0001"})
+	r := waitRequest(t, reqs)
+	if got := r.header.Get(SignatureHeader); got != "" {
+		t.Errorf("got signature %q, want none", got)
+	}
+}
+
+func TestRetry(t *testing.T) {
+	srv, reqs, count := setupServer(t, maxRetries)
+	hub := startNotifier(t, config.Webhook{URL: srv.URL, Timeout: time.Second})
+	hub.Dispatch(msghub.Message{Mailbox: "box", ID: "0001"})
+	waitRequest(t, reqs)
+	if got := atomic.LoadInt32(count); got != maxRetries+1 {
+		t.Errorf("got %v requests, want: %v", got, maxRetries+1)
+	}
+}
+
+func TestRetryGivesUp(t *testing.T) {
+	srv, reqs, count := setupServer(t, maxRetries+1)
+	hub := startNotifier(t, config.Webhook{URL: srv.URL, Timeout: time.Second})
+	hub.Dispatch(msghub.Message{Mailbox: "box", ID: "0001"})
+	hub.Dispatch(msghub.Message{Mailbox: "box", ID: "0002"})
+	// The first message exhausts its retries, the second succeeds.
+	r := waitRequest(t, reqs)
+	var payload map[string]interface{}
+	if err := json.Unmarshal(r.body, &payload); err != nil {
+		t.Fatal(err)
+	}
+	if payload["id"] != "0002" {
+		t.Errorf("got id %v, want: 0002", payload["id"])
+	}
+	if got := atomic.LoadInt32(count); got != maxRetries+2 {
+		t.Errorf("got %v requests, want: %v", got, maxRetries+2)
+	}
+}
@@ -21,7 +21,7 @@ func MailboxMessage(w http.ResponseWriter, req *http.Request, ctx *web.Context)
 	if err != nil {
 		return err
 	}
-	msg, err := ctx.Manager.GetMessage(name, id)
+	msg, err := ctx.Manager.GetMessage(req.Context(), name, id)
 	if err != nil && err != storage.ErrNotExist {
 		return fmt.Errorf("GetMessage(%q) failed: %v", id, err)
 	}
@@ -87,7 +87,7 @@ func MailboxHTML(w http.ResponseWriter, req *http.Request, ctx *web.Context) (er
 	if err != nil {
 		return err
 	}
-	msg, err := ctx.Manager.GetMessage(name, id)
+	msg, err := ctx.Manager.GetMessage(req.Context(), name, id)
 	if err == storage.ErrNotExist {
 		http.NotFound(w, req)
 		return nil
@@ -110,7 +110,7 @@ func MailboxSource(w http.ResponseWriter, req *http.Request, ctx *web.Context) (
 	if err != nil {
 		return err
 	}
-	r, err := ctx.Manager.SourceReader(name, id)
+	r, err := ctx.Manager.SourceReader(req.Context(), name, id)
 	if err == storage.ErrNotExist {
 		http.NotFound(w, req)
 		return nil
@@ -138,7 +138,7 @@ func MailboxViewAttach(w http.ResponseWriter, req *http.Request, ctx *web.Contex
 	if err != nil {
 		return err
 	}
-	msg, err := ctx.Manager.GetMessage(name, id)
+	msg, err := ctx.Manager.GetMessage(req.Context(), name, id)
 	if err == storage.ErrNotExist {
 		http.NotFound(w, req)
 		return nil
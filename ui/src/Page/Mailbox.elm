@@ -49,6 +49,7 @@ import Html.Attributes
         , value
         )
 import Html.Events as Events
+import Http
 import HttpUtil
 import Json.Decode as D
 import Json.Encode as E
@@ -252,7 +253,13 @@ update msg model =
             ( model, Effect.none )
 
         PurgedMailbox (Err err) ->
-            ( model, Effect.showFlash (HttpUtil.errorFlash err) )
+            case err.error of
+                Http.BadStatus 404 ->
+                    -- Mailbox was already empty.
+                    ( model, Effect.none )
+
+                _ ->
+                    ( model, Effect.showFlash (HttpUtil.errorFlash err) )
 
         MarkSeenTriggered timer ->
             if timer == model.markSeenTimer then